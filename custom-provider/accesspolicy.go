@@ -0,0 +1,176 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+)
+
+// One provider instance can serve several teams, each deploying from its own subscription or
+// resource group. Access policies restrict what each of them may do, as a guardrail on top of
+// Azure RBAC on the custom provider: every rule names a subscription and resource group (with *
+// wildcards) and the operations allowed there. A request is allowed when a rule matching the
+// subscription and resource group of its request path allows its operation; with policies loaded,
+// anything else is answered with 403. Without policies every request is allowed, as before.
+//
+// Operations are read (GET, and actions whose name starts with list, which ARM also treats as
+// reads), write (PUT and PATCH), delete, action (every action), an action name, or * for all.
+
+// AccessPolicy allows operations in the subscriptions and resource groups it matches
+type AccessPolicy struct {
+	Subscription  string   `json:"subscription"`
+	ResourceGroup string   `json:"resourceGroup,omitempty"`
+	Operations    []string `json:"operations"`
+}
+
+const (
+	accessRead   = "read"
+	accessWrite  = "write"
+	accessDelete = "delete"
+	accessAction = "action"
+)
+
+// accessPolicies is loaded once at startup by loadAccessPolicies; nil allows every request
+var accessPolicies []AccessPolicy
+
+// loadAccessPolicies reads the policies from ACCESS_POLICIES_FILE (a JSON array of rules), or
+// inline JSON in ACCESS_POLICIES. Neither being set means every request is allowed.
+func loadAccessPolicies() error {
+	data := []byte(os.Getenv("ACCESS_POLICIES"))
+	if file := os.Getenv("ACCESS_POLICIES_FILE"); file != "" {
+		var err error
+		data, err = os.ReadFile(file)
+		if err != nil {
+			return fmt.Errorf("failed to read ACCESS_POLICIES_FILE: %w", err)
+		}
+	}
+	if len(data) == 0 {
+		accessPolicies = nil
+		return nil
+	}
+
+	var policies []AccessPolicy
+	if err := json.Unmarshal(data, &policies); err != nil {
+		return fmt.Errorf("failed to parse access policies: %w", err)
+	}
+	for i, policy := range policies {
+		if err := policy.check(); err != nil {
+			return fmt.Errorf("access policy %d: %w", i, err)
+		}
+	}
+	accessPolicies = policies
+
+	for _, policy := range policies {
+		log.Printf("INFO: Loaded access policy - subscription: %s, resource group: %s, operations: %s",
+			policy.Subscription, policy.scopeResourceGroup(), strings.Join(policy.Operations, ","))
+	}
+	return nil
+}
+
+// check reports a rule that cannot match anything
+func (p AccessPolicy) check() error {
+	if p.Subscription == "" {
+		return fmt.Errorf("subscription is required, use * for every subscription")
+	}
+	for _, pattern := range []string{p.Subscription, p.scopeResourceGroup()} {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid pattern %q: %w", pattern, err)
+		}
+	}
+	if len(p.Operations) == 0 {
+		return fmt.Errorf("operations is required")
+	}
+	for _, operation := range p.Operations {
+		switch strings.ToLower(operation) {
+		case "*", accessRead, accessWrite, accessDelete, accessAction:
+		default:
+			if _, ok := lookupProviderEntry(actions, operation); !ok {
+				return fmt.Errorf("unknown operation %q", operation)
+			}
+		}
+	}
+	return nil
+}
+
+// scopeResourceGroup is the rule's resource group pattern; a rule without one covers the subscription
+func (p AccessPolicy) scopeResourceGroup() string {
+	if p.ResourceGroup == "" {
+		return "*"
+	}
+	return p.ResourceGroup
+}
+
+// matches reports whether the rule covers a subscription and resource group; names are
+// case-insensitive, as in ARM
+func (p AccessPolicy) matches(subscription, resourceGroup string) bool {
+	subMatch, _ := path.Match(strings.ToLower(p.Subscription), strings.ToLower(subscription))
+	rgMatch, _ := path.Match(strings.ToLower(p.scopeResourceGroup()), strings.ToLower(resourceGroup))
+	return subMatch && rgMatch
+}
+
+// allows reports whether the rule allows an operation; action is the action name for POSTs
+func (p AccessPolicy) allows(operation, action string) bool {
+	for _, allowed := range p.Operations {
+		switch {
+		case allowed == "*", strings.EqualFold(allowed, operation):
+			return true
+		case action != "" && strings.EqualFold(allowed, action):
+			return true
+		case action != "" && strings.EqualFold(allowed, accessRead) && strings.HasPrefix(strings.ToLower(action), "list"):
+			return true
+		}
+	}
+	return false
+}
+
+// requestOperation classifies a custom provider request as read, write, delete or action
+func requestOperation(method string) string {
+	switch method {
+	case http.MethodGet:
+		return accessRead
+	case http.MethodDelete:
+		return accessDelete
+	case http.MethodPost:
+		return accessAction
+	default:
+		return accessWrite
+	}
+}
+
+// checkAccessPolicy reports whether the request's subscription and resource group may perform
+// its operation, answering the request with 403 when they may not
+func checkAccessPolicy(w http.ResponseWriter, r *http.Request, cpRequest CustomProviderRequestPath) bool {
+	if accessPolicies == nil {
+		return true
+	}
+	operation, action := requestOperation(r.Method), ""
+	if operation == accessAction {
+		action = cpRequest.ResourceTypeName
+	}
+	for _, policy := range accessPolicies {
+		if policy.matches(cpRequest.Subscriptions, cpRequest.ResourceGroups) && policy.allows(operation, action) {
+			return true
+		}
+	}
+
+	what := fmt.Sprintf("%s on %s", operation, cpRequest.ResourceTypeName)
+	if action != "" {
+		what = "action " + action
+	}
+	log.Printf("WARNING: [op=%s] Access policy denies %s in subscription %s, resource group %s", operationID(r), what, cpRequest.Subscriptions, cpRequest.ResourceGroups)
+	sendJSONError(w, http.StatusForbidden, "OperationNotAllowed",
+		fmt.Sprintf("The provider's access policies do not allow %s in subscription %s, resource group %s", what, cpRequest.Subscriptions, cpRequest.ResourceGroups))
+	return false
+}
+
+// accessPolicyDescription is the startup fingerprint's view of the access policies
+func accessPolicyDescription() interface{} {
+	if accessPolicies == nil {
+		return "none"
+	}
+	return accessPolicies
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestAccessPolicies(t *testing.T) {
+	policies := `[
+		{"subscription": "sub-prod", "resourceGroup": "team-a-*", "operations": ["read", "write", "delete", "action"]},
+		{"subscription": "sub-prod", "operations": ["read"]},
+		{"subscription": "sub-dev", "operations": ["*"]},
+		{"subscription": "sub-audit", "operations": ["read", "exportAudit"]}
+	]`
+	const base = "/providers/Microsoft.CustomProviders/resourceProviders/CyberArkProvider"
+
+	tests := []struct {
+		name        string
+		method      string
+		requestPath string
+		allowed     bool
+	}{
+		{"team resource group may write", http.MethodPut, "/subscriptions/sub-prod/resourceGroups/team-a-web" + base + "/safes/safe1", true},
+		{"resource group names are case-insensitive", http.MethodDelete, "/subscriptions/SUB-PROD/resourceGroups/Team-A-Web" + base + "/safes/safe1", true},
+		{"other resource groups read", http.MethodGet, "/subscriptions/sub-prod/resourceGroups/team-b" + base + "/accounts/safe1.acct1", true},
+		{"other resource groups may not write", http.MethodPut, "/subscriptions/sub-prod/resourceGroups/team-b" + base + "/accounts/safe1.acct1", false},
+		{"other resource groups may not delete", http.MethodDelete, "/subscriptions/sub-prod/resourceGroups/team-b" + base + "/safes/safe1", false},
+		{"list actions are reads", http.MethodPost, "/subscriptions/sub-prod/resourceGroups/team-b" + base + "/listAccounts", true},
+		{"other actions are not reads", http.MethodPost, "/subscriptions/sub-prod/resourceGroups/team-b" + base + "/retrievePassword", false},
+		{"named action", http.MethodPost, "/subscriptions/sub-audit/resourceGroups/rg1" + base + "/exportAudit", true},
+		{"only the named action", http.MethodPost, "/subscriptions/sub-audit/resourceGroups/rg1" + base + "/detectDrift", false},
+		{"wildcard operations", http.MethodPatch, "/subscriptions/sub-dev/resourceGroups/rg1" + base + "/accounts/safe1.acct1", true},
+		{"unlisted subscription", http.MethodGet, "/subscriptions/sub-other/resourceGroups/rg1" + base + "/safes/safe1", false},
+	}
+
+	t.Setenv("ACCESS_POLICIES", policies)
+	if err := loadAccessPolicies(); err != nil {
+		t.Fatalf("load access policies: %v", err)
+	}
+	defer func() { accessPolicies = nil }()
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(tt.method, "/", nil)
+			req.Header.Set(requestPathHeader, tt.requestPath)
+			cpRequest, err := ParseCustomProviderRequestPath(req)
+			if err != nil {
+				t.Fatalf("parse request path: %v", err)
+			}
+			w := httptest.NewRecorder()
+			if got := checkAccessPolicy(w, req, cpRequest); got != tt.allowed {
+				t.Fatalf("expected allowed %v, got %v", tt.allowed, got)
+			}
+			if !tt.allowed && (w.Code != http.StatusForbidden || !strings.Contains(w.Body.String(), "OperationNotAllowed")) {
+				t.Errorf("expected 403 OperationNotAllowed, got %d %s", w.Code, w.Body.String())
+			}
+		})
+	}
+}
+
+func TestLoadAccessPoliciesErrors(t *testing.T) {
+	tests := []struct {
+		name     string
+		policies string
+		wantErr  string
+	}{
+		{"no policies", "", ""},
+		{"missing subscription", `[{"operations": ["read"]}]`, "subscription is required"},
+		{"missing operations", `[{"subscription": "sub1"}]`, "operations is required"},
+		{"unknown operation", `[{"subscription": "sub1", "operations": ["reed"]}]`, "unknown operation"},
+		{"invalid pattern", `[{"subscription": "sub[", "operations": ["read"]}]`, "invalid pattern"},
+		{"not an array", `{"subscription": "sub1"}`, "failed to parse"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("ACCESS_POLICIES", tt.policies)
+			defer func() { accessPolicies = nil }()
+			err := loadAccessPolicies()
+			if tt.wantErr == "" {
+				if err != nil || accessPolicies != nil {
+					t.Errorf("expected every request to be allowed, got %v, %v", accessPolicies, err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("expected error containing %q, got %v", tt.wantErr, err)
+			}
+		})
+	}
+}
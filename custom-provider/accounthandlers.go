@@ -1,19 +1,22 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
+	"strconv"
 	"strings"
-	"time"
 
+	"cyberark-custom-provider/retry"
 	"github.com/davidh-cyberark/privilegeaccessmanager-sdk-go/pam"
 )
 
 // AccountRequest represents the request to create a safe
 type AccountRequest struct {
-	Properties pam.PostAddAccountRequest `json:"properties"`
+	Properties AccountProperties `json:"properties"`
 }
 
 type PostAccountResponse struct {
@@ -28,18 +31,31 @@ type GetAccountsResponse struct {
 	AccountResourceId *string
 }
 
+// addAccountRecordProperties adds the settings the provider keeps for an account, rather than PCloud, to its properties
+func addAccountRecordProperties(properties map[string]interface{}, rec ResourceRecord) {
+	addKeyProperties(properties, rec)
+	addDeletionPolicyProperty(properties, rec)
+}
+
 // handleSafe routes safe-related requests to appropriate handlers
 func handleAccount(w http.ResponseWriter, r *http.Request, cpRequest CustomProviderRequestPath) {
 	LogRequestDebug("Account", r)
 
 	// Account name will be in the cpRequest path
+	if r.Method != http.MethodGet && !checkPreconditions(w, r, cpRequest, handleGetAccount) {
+		return
+	}
 	switch r.Method {
 	case "GET":
 		handleGetAccount(w, r, cpRequest)
 	case "PUT":
-		handleCreateAccount(w, r, cpRequest)
+		provision(w, r, cpRequest, handleCreateAccount)
+	case "PATCH":
+		handleUpdateAccount(w, r, cpRequest)
 	case "DELETE":
 		handleDeleteAccount(w, r, cpRequest)
+	default:
+		sendJSONError(w, http.StatusMethodNotAllowed, "MethodNotAllowed", fmt.Sprintf("Method %s is not supported for accounts", r.Method))
 	}
 }
 
@@ -60,8 +76,11 @@ func parseSafeNameAccountName(resname string) (string, string, error) {
 // handleGetAccount handles retrieving an account
 func handleGetAccount(w http.ResponseWriter, r *http.Request, cpRequest CustomProviderRequestPath) {
 	LogRequestDebug("GetAccount", r)
+	if serveRecentlyCreated(w, r, cpRequest) {
+		return
+	}
 
-	safename, acctname, pErr := parseSafeNameAccountName(cpRequest.ResourceInstanceName)
+	safename, acctname, pErr := resolveAccountName(cpRequest)
 	if pErr != nil {
 		log.Printf("DEBUG: %s", pErr.Error())
 		sendJSONError(w, http.StatusConflict, "ResourceNameMalformed", pErr.Error())
@@ -87,30 +106,25 @@ func handleGetAccount(w http.ResponseWriter, r *http.Request, cpRequest CustomPr
 	}
 
 	getone, getoneErr := FindAccount(getresp, acctname)
+	if errors.Is(getoneErr, errAccountNotFound) {
+		sendJSONError(w, http.StatusNotFound, "ResourceNotFound", getoneErr.Error())
+		return
+	}
 	if getoneErr != nil {
 		log.Printf("DEBUG: %s", getoneErr.Error())
 		sendJSONError(w, http.StatusConflict, "GetAccountsError", getoneErr.Error())
 		return
 	}
 
-	acctresponsejson, err := json.Marshal(getone)
+	acctresponsemap, err := accountResourceProperties(r, getone)
 	if err != nil {
-		m := fmt.Sprintf("Failed to marshal response: %v", err)
-		log.Printf("DEBUG: %s", m)
-		sendJSONError(w, http.StatusConflict, "GetAccountMarshalError", m)
+		log.Printf("DEBUG: %s", err.Error())
+		sendJSONError(w, http.StatusConflict, "GetAccountMarshalError", err.Error())
 		return
 	}
-
-	// Unmarshal the JSON byte slice into a map[string]interface{}
-	var acctresponsemap map[string]interface{}
-	err = json.Unmarshal(acctresponsejson, &acctresponsemap)
-	if err != nil {
-		m := fmt.Sprintf("Failed to unmarshal response: %v", err)
-		log.Printf("DEBUG: %s", m)
-		sendJSONError(w, http.StatusConflict, "GetAccountUnMarshalError", m)
-		return
+	if rec, found, err := stateStore.Get(cpRequest.ID()); err == nil && found && rec.PCloudID == getone.ID {
+		addAccountRecordProperties(acctresponsemap, rec)
 	}
-	acctresponsemap["provisioningState"] = "Succeeded"
 
 	response := CustomProviderResponse{
 		ID:         cpRequest.ID(),
@@ -119,36 +133,99 @@ func handleGetAccount(w http.ResponseWriter, r *http.Request, cpRequest CustomPr
 		Properties: acctresponsemap,
 	}
 	log.Printf("DEBUG: Responding: %+v", response)
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusOK)
-	json.NewEncoder(w).Encode(response)
+	sendJSONResource(w, r, http.StatusOK, response)
 }
 
 // handleCreateAccount handles the creation of an account
 func handleCreateAccount(w http.ResponseWriter, r *http.Request, cpRequest CustomProviderRequestPath) {
 	LogRequestDebug("CreateAccount", r)
 
-	acctresponse, err := AddAccount(w, r, cpRequest)
+	var request AccountRequest
+	if err := decodeRequestBody(r, &request); err != nil {
+		var unknownErr *UnknownPropertiesError
+		if errors.As(err, &unknownErr) {
+			sendJSONError(w, http.StatusBadRequest, "UnknownProperties", err.Error())
+			return
+		}
+		sendJSONError(w, http.StatusConflict, "AddAccountError", err.Error())
+		return
+	}
+	if details := append(validateRequest(request), validateAccountLinks(request.Properties)...); len(details) > 0 {
+		sendValidationError(w, details)
+		return
+	}
+
+	if !ensureAccountSafe(w, r, cpRequest, request.Properties) {
+		return
+	}
+
+	// A template that changed the account's safe or name moves it, see accounttransition.go
+	transition, handled := transitionAccount(w, r, cpRequest, request.Properties)
+	if handled {
+		return
+	}
+
+	// A re-run deployment PUTs the account again; answer with the existing account instead of adding a duplicate
+	existing, err := findExistingAccount(w, r, cpRequest, request.Properties.PostAddAccountRequest)
 	if err != nil {
 		sendJSONError(w, http.StatusConflict, "AddAccountError", err.Error())
 		return
 	}
+	if existing != nil {
+		handleExistingAccount(w, r, cpRequest, request.Properties, existing, nil)
+		return
+	}
+	if details := validatePlatformProperties(r, request.Properties.PostAddAccountRequest); len(details) > 0 {
+		sendValidationError(w, details)
+		return
+	}
+	key, details, err := prepareAccountKey(&request.Properties)
+	if len(details) > 0 {
+		sendValidationError(w, details)
+		return
+	}
+	if err != nil {
+		sendJSONError(w, http.StatusInternalServerError, "SecretGenerationError", err.Error())
+		return
+	}
 
-	// Cast the acctresponse.Response to a map[string]interface{}
-	acctresponsejson, err := json.Marshal(acctresponse.Response)
+	acctresponse, err := AddAccount(w, r, cpRequest, request)
 	if err != nil {
-		sendJSONError(w, http.StatusConflict, "AddAccountMarshalError", fmt.Sprintf("Failed to marshal response: %v", err))
+		sendJSONError(w, http.StatusConflict, "AddAccountError", err.Error())
+		return
+	}
+	rec := ResourceRecord{
+		ResourceID:   cpRequest.ID(),
+		ResourceType: cpRequest.ResourceTypeName,
+		SafeName:     acctresponse.Response.SafeName,
+		AccountName:  acctresponse.Response.Name,
+		PCloudID:     acctresponse.Response.ID,
+		Deployment:   newDeploymentStamp(r),
+		Declared: accountDriftSettings(acctresponse.Response.PlatformID, acctresponse.Response.Address, acctresponse.Response.UserName,
+			acctresponse.Response.SecretManagement, acctresponse.Response.PlatformAccountProperties),
+
+		DeletionPolicy: recordedDeletionPolicy(request.Properties.DeletionPolicy),
+	}
+	if key != nil {
+		rec.KeyFingerprint, rec.PublicKey = key.Fingerprint, key.PublicKey
+	}
+	accountIndex.Put(acctresponse.Response.SafeName, acctresponse.Response.Name, acctresponse.Response.ID)
+	if details := linkAccount(r, acctresponse.Response.ID, acctresponse.Response.SafeName, request.Properties, false); len(details) > 0 {
+		recordResource(rec)
+		sendAccountLinkError(w, acctresponse.Response.ID, details)
 		return
 	}
 
-	// Unmarshal the JSON byte slice into a map[string]interface{}
-	var acctresponsemap map[string]interface{}
-	err = json.Unmarshal(acctresponsejson, &acctresponsemap)
+	acctresponsemap, err := accountResourceProperties(r, acctresponse.Response)
 	if err != nil {
-		sendJSONError(w, http.StatusConflict, "AddAccountUnMarshalError", fmt.Sprintf("Failed to unmarshal response: %v", err))
+		recordResource(rec)
+		sendJSONError(w, http.StatusConflict, "AddAccountMarshalError", err.Error())
 		return
 	}
-	acctresponsemap["provisioningState"] = "Succeeded"
+	addAccountRecordProperties(acctresponsemap, rec)
+	if transition != nil {
+		acctresponsemap["transition"] = transition
+	}
 
 	response := CustomProviderResponse{
 		ID:         cpRequest.ID(),
@@ -156,6 +233,10 @@ func handleCreateAccount(w http.ResponseWriter, r *http.Request, cpRequest Custo
 		Type:       fmt.Sprintf("Microsoft.CustomProviders/resourceProviders/%s", cpRequest.ResourceTypeName),
 		Properties: acctresponsemap,
 	}
+	rec.ETag = resourceETag(response)
+	recordResource(rec)
+	recentlyCreated.Put(response)
+	notifyLifecycle(r, "Created", rec)
 
 	log.Printf("DEBUG: Responding: %+v", response)
 	w.Header().Set("Content-Type", "application/json")
@@ -163,18 +244,172 @@ func handleCreateAccount(w http.ResponseWriter, r *http.Request, cpRequest Custo
 	json.NewEncoder(w).Encode(response)
 }
 
+// findExistingAccount returns the account a PUT names when it already exists in the safe, or nil
+func findExistingAccount(w http.ResponseWriter, r *http.Request, cpRequest CustomProviderRequestPath, properties pam.PostAddAccountRequest) (*pam.GetAccountResponse, error) {
+	_, acctname, err := parseSafeNameAccountName(cpRequest.ResourceInstanceName)
+	if err != nil {
+		return nil, err
+	}
+	if properties.Name != "" {
+		acctname = properties.Name
+	}
+	if properties.SafeName == "" || acctname == "" {
+		return nil, nil
+	}
+
+	getresp, err := GetAccounts(w, r, properties.SafeName)
+	if err != nil {
+		return nil, err
+	}
+	account, err := FindAccount(getresp, acctname)
+	if err != nil {
+		return nil, nil
+	}
+	return account, nil
+}
+
+// accountDifferences lists the requested platform, address and user name that differ from the account's
+func accountDifferences(properties AccountProperties, account *pam.GetAccountResponse) []string {
+	var differences []string
+	for _, field := range []struct{ name, requested, actual string }{
+		{"platformId", properties.PlatformID, account.PlatformID},
+		{"address", properties.Address, account.Address},
+		{"userName", properties.UserName, account.UserName},
+	} {
+		if field.requested != "" && !strings.EqualFold(field.requested, field.actual) {
+			differences = append(differences, fmt.Sprintf("%s (requested %q, actual %q)", field.name, field.requested, field.actual))
+		}
+	}
+	return differences
+}
+
+// handleExistingAccount answers a PUT for an account that already exists: 200 with the existing
+// account when it has the requested platform, address and user name, 409 otherwise. The secret
+// cannot be compared and is left unchanged. transition is set when the PUT moved the account.
+func handleExistingAccount(w http.ResponseWriter, r *http.Request, cpRequest CustomProviderRequestPath, properties AccountProperties, account *pam.GetAccountResponse, transition *accountTransition) {
+	if differences := accountDifferences(properties, account); len(differences) > 0 {
+		sendJSONError(w, http.StatusConflict, "AccountAlreadyExists",
+			fmt.Sprintf("Account %s already exists in safe %s with different settings: %s", account.Name, account.SafeName, strings.Join(differences, ", ")))
+		return
+	}
+	log.Printf("INFO: (CreateAccount) account %s already exists in safe %s with the requested settings", account.Name, account.SafeName)
+
+	rec := ResourceRecord{
+		ResourceID:   cpRequest.ID(),
+		ResourceType: cpRequest.ResourceTypeName,
+		SafeName:     account.SafeName,
+		AccountName:  account.Name,
+		PCloudID:     account.ID,
+		Deployment:   newDeploymentStamp(r),
+		Declared:     accountDriftSettings(account.PlatformID, account.Address, account.UserName, account.SecretManagement, account.PlatformAccountProperties),
+
+		DeletionPolicy: recordedDeletionPolicy(properties.DeletionPolicy),
+	}
+	// The key cannot be read back from PCloud, so keep what was recorded when it was set
+	if previous, found, err := stateStore.Get(rec.ResourceID); err == nil && found &&
+		(previous.PCloudID == account.ID || transition != nil && previous.PCloudID == transition.PreviousAccountID) {
+		rec.KeyFingerprint, rec.PublicKey = previous.KeyFingerprint, previous.PublicKey
+	}
+	recordResource(rec)
+	accountIndex.Put(account.SafeName, account.Name, account.ID)
+	if details := linkAccount(r, account.ID, account.SafeName, properties, true); len(details) > 0 {
+		sendAccountLinkError(w, account.ID, details)
+		return
+	}
+
+	acctresponsemap, err := accountResourceProperties(r, account)
+	if err != nil {
+		sendJSONError(w, http.StatusConflict, "AddAccountMarshalError", err.Error())
+		return
+	}
+	addAccountRecordProperties(acctresponsemap, rec)
+	if transition != nil {
+		acctresponsemap["transition"] = transition
+		notifyLifecycle(r, "Moved", rec)
+	}
+	sendJSONResource(w, r, http.StatusOK, CustomProviderResponse{
+		ID:         cpRequest.ID(),
+		Name:       cpRequest.ResourceInstanceName,
+		Type:       fmt.Sprintf("Microsoft.CustomProviders/resourceProviders/%s", cpRequest.ResourceTypeName),
+		Properties: acctresponsemap,
+	})
+}
+
 // handleDeleteAccount handles the deletion of an account
 func handleDeleteAccount(w http.ResponseWriter, r *http.Request, cpRequest CustomProviderRequestPath) {
 	LogRequestDebug("DeleteAccount", r)
 
-	_ = cpRequest // placeholder for future
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusBadRequest)
-	w.Write([]byte(`{"status": "not implemented"}`))
+	safename, acctname, pErr := resolveAccountName(cpRequest)
+	if pErr != nil {
+		log.Printf("DEBUG: %s", pErr.Error())
+		sendJSONError(w, http.StatusConflict, "ResourceNameMalformed", pErr.Error())
+		return
+	}
+	if retainOnDelete(w, r, cpRequest) {
+		return
+	}
+
+	getresp, err := GetAccounts(w, r, safename)
+	if err != nil {
+		log.Printf("DEBUG: %s", err.Error())
+		sendJSONError(w, http.StatusConflict, "GetAccountsError", err.Error())
+		return
+	}
+	account, err := FindAccount(getresp, acctname)
+	if errors.Is(err, errAccountNotFound) {
+		// ARM treats DELETE as idempotent, so an account that is already gone is a successful delete
+		log.Printf("INFO: (DeleteAccount) %s does not exist, nothing to delete", cpRequest.ResourceInstanceName)
+		forgetResource(cpRequest.ID())
+		accountIndex.Remove(safename, acctname)
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	if err != nil {
+		log.Printf("DEBUG: (DeleteAccount) %s", err.Error())
+		sendJSONError(w, http.StatusConflict, "GetAccountsError", err.Error())
+		return
+	}
+
+	// Deletes are batched with other in-flight deletes so a resource group teardown runs in dependency order
+	stopPAM := startPhase(r, "pam")
+	err = deletes.Submit(r.Context(), deleteRankAccount, account.ID, func(pamService PAMService) error {
+		return deleteAccount(r.Context(), pamService, account.ID)
+	})
+	stopPAM()
+	if err != nil {
+		sendJSONError(w, http.StatusConflict, "AccountDeletionError", err.Error())
+		return
+	}
+	forgetResource(cpRequest.ID())
+	accountIndex.Remove(account.SafeName, account.Name)
+	notifyLifecycle(r, "Deleted", ResourceRecord{ResourceID: cpRequest.ID(), ResourceType: cpRequest.ResourceTypeName, SafeName: account.SafeName, AccountName: account.Name, PCloudID: account.ID})
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// deleteAccount deletes an account using the PAM service
+func deleteAccount(ctx context.Context, pamService PAMService, accountID string) error {
+	retcode, err := statusRetry(ctx, "accounts", "DeleteAccount", true, func(ctx context.Context) (int, error) {
+		return pamService.DeleteAccount(ctx, accountID)
+	})
+	if retcode == http.StatusNotFound {
+		log.Printf("INFO: Account %s was already deleted", accountID)
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to delete account %s: (%d) %v", accountID, retcode, err)
+	}
+	log.Printf("INFO: Deleted account %s", accountID)
+	return nil
 }
 
-func GetAccounts(w http.ResponseWriter, r *http.Request, safename string) (*GetAccountsResponse, error) {
-	pamClient, err := createPAMClient()
+func GetAccounts(w http.ResponseWriter, r *http.Request, safename string) (response *GetAccountsResponse, err error) {
+	getSpan := startSpan(r, "GetAccounts", "pcloud.safeName", safename)
+	defer func() { getSpan.End(err) }()
+
+	stopAuth := startPhase(r, "auth")
+	pamService, err := newPAMService()
+	stopAuth()
 	if err != nil {
 		return nil, err
 	}
@@ -182,14 +417,21 @@ func GetAccounts(w http.ResponseWriter, r *http.Request, safename string) (*GetA
 	filter := fmt.Sprintf("safeName eq %s", safename)
 
 	accountresponse := GetAccountsResponse{}
-	accountresponse.Response, accountresponse.ResponseCode, err = pamClient.GetAccounts(nil, nil, nil, &filter, nil, nil, nil)
+	stopPAM := startPhase(r, "pam")
+	accountresponse.Response, accountresponse.ResponseCode, err = pcloudRetry(r.Context(), "accounts", "GetAccounts", true, func(ctx context.Context) (*pam.GetAccountsResponse, int, error) {
+		return pamService.GetAccounts(ctx, filter)
+	})
+	stopPAM()
 	if err != nil {
-		return nil, fmt.Errorf("error, could not get accounts: (%d) %s", accountresponse.ResponseCode, err.Error())
+		return nil, checkMaintenance(fmt.Errorf("error, could not get accounts: (%d) %s", accountresponse.ResponseCode, err.Error()))
 	}
 
 	return &accountresponse, nil
 }
 
+// errAccountNotFound is returned by FindAccount when the safe has no account of that name
+var errAccountNotFound = errors.New("not found")
+
 func FindAccount(accounts *GetAccountsResponse, matchacctname string) (*pam.GetAccountResponse, error) {
 	getone := pam.GetAccountResponse{
 		ID: "NOTFOUND",
@@ -217,19 +459,14 @@ func FindAccount(accounts *GetAccountsResponse, matchacctname string) (*pam.GetA
 
 	// Account not found
 	if accounts.Response.Count == 0 || getone.ID == "NOTFOUND" {
-		return nil, fmt.Errorf("account name, %s, not found", matchacctname)
+		return nil, fmt.Errorf("account name, %s, %w", matchacctname, errAccountNotFound)
 	}
 
 	return &getone, nil
 }
 
-func AddAccount(w http.ResponseWriter, r *http.Request, cpRequest CustomProviderRequestPath) (*PostAccountResponse, error) {
-	var request AccountRequest
-	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
-		return nil, err
-	}
-
-	newaccountrequest := request.Properties
+func AddAccount(w http.ResponseWriter, r *http.Request, cpRequest CustomProviderRequestPath, request AccountRequest) (*PostAccountResponse, error) {
+	newaccountrequest := request.Properties.PostAddAccountRequest
 	if len(newaccountrequest.SafeName) == 0 {
 		return nil, fmt.Errorf("error, safeName is not set")
 	}
@@ -241,21 +478,30 @@ func AddAccount(w http.ResponseWriter, r *http.Request, cpRequest CustomProvider
 	if err != nil {
 		log.Printf("DEBUG: failed to marshal request: %s", err.Error())
 	} else {
-		log.Printf("DEBUG: request body: %s", debugjson)
+		log.Printf("DEBUG: request body: %s", redactJSON(debugjson))
 	}
 
-	pamClient, err := createPAMClient()
+	stopAuth := startPhase(r, "auth")
+	pamService, err := newPAMService()
+	stopAuth()
 	if err != nil {
 		return nil, err
 	}
 
 	newaccountresponse := PostAccountResponse{}
-	newaccountresponse.Response, newaccountresponse.ResponseCode, err = pamClient.AddAccount(newaccountrequest)
+	stopPAM := startPhase(r, "pam")
+	addSpan := startSpan(r, "AddAccount", "pcloud.safeName", newaccountrequest.SafeName, "pcloud.platformId", newaccountrequest.PlatformID)
+	newaccountresponse.Response, newaccountresponse.ResponseCode, err = pcloudRetry(r.Context(), "accounts", "AddAccount", false, func(ctx context.Context) (pam.PostAddAccountResponse, int, error) {
+		return pamService.AddAccount(ctx, newaccountrequest)
+	})
+	addSpan.SetAttr("pcloud.status", strconv.Itoa(newaccountresponse.ResponseCode))
+	addSpan.End(err)
+	stopPAM()
 	log.Printf("DEBUG: (AddAccount) pamclient.AddAccount response: %+v", newaccountresponse.Response)
 
 	if err != nil {
 		log.Printf("ERROR: failed to add account: %s", err.Error())
-		return &newaccountresponse, fmt.Errorf("failed to add account: %s", err.Error())
+		return &newaccountresponse, checkMaintenance(fmt.Errorf("failed to add account: %s", err.Error()))
 	}
 	if newaccountresponse.ResponseCode >= 300 {
 		return &newaccountresponse, fmt.Errorf("call to priv cloud returned non-success code: %d", newaccountresponse.ResponseCode)
@@ -264,35 +510,50 @@ func AddAccount(w http.ResponseWriter, r *http.Request, cpRequest CustomProvider
 	if len(newaccountresponse.Response.ID) == 0 {
 		return &newaccountresponse, fmt.Errorf("no account id was set in the response")
 	}
-	url := fmt.Sprintf("%s/%s", pamClient.Config.PcloudUrl, newaccountresponse.Response.ID)
+	url := fmt.Sprintf("%s/%s", pamService.PCloudURL(), newaccountresponse.Response.ID)
 
-	// Here we make a best attempt to see if the account exists
-	// This is an attempt to work around a potential race condition in Azure PUT/GET resource flow
-	safename, acctname, pErr := parseSafeNameAccountName(cpRequest.ResourceInstanceName)
-	if pErr != nil {
+	// ARM's GET right after the PUT is answered from recentlyCreated, so reading the account back is
+	// only a check that PCloud lists it; VERIFY_ATTEMPTS=0 skips it
+	policy := policyFor("accounts")
+	if policy.VerifyAttempts == 0 {
+		newaccountresponse.AccountResourceId = &url
+		return &newaccountresponse, nil
+	}
+	// The template's safe and name, which differ from the resource name once the account was moved
+	safename, acctname := requestedAccountName(cpRequest, request.Properties)
+	if acctname == "" {
+		pErr := fmt.Errorf("resource name must be in format: {safename}.{accountname}")
 		log.Printf("DEBUG: %s", pErr.Error())
 		return nil, pErr
 	}
 	log.Printf("DEBUG: (AddAccount) safename: %s, acctname: %s", safename, acctname)
 
-	getresp, err := GetAccounts(w, r, safename)
-	if err != nil {
+	// The account is read back until PCloud lists it, waiting VERIFY_INTERVAL before the first
+	// read-back and twice as long before each further one; only a failing first read is an error
+	defer startPhase(r, "verification")()
+	verify := retry.Policy{MaxRetries: policy.VerifyAttempts, Base: policy.VerifyInterval, MaxDelay: maxRetryDelay}
+	var getresp *GetAccountsResponse
+	err = retry.Do(r.Context(), verify, func(attempt int) error {
+		current, err := GetAccounts(w, r, safename)
+		if err != nil {
+			if attempt == 1 {
+				return err
+			}
+			log.Printf("DEBUG: (AddAccount) getaccounts[%d] failed: %s", attempt-1, err.Error())
+			return retry.Retryable(err)
+		}
+		getresp = current
+		log.Printf("DEBUG: (AddAccount) getaccounts[%d] response: %+v", attempt-1, getresp.Response)
+		if getresp.Response == nil || getresp.Response.Count == 0 {
+			return retry.Retryable(fmt.Errorf("no accounts listed in safe %s yet", safename))
+		}
+		return nil
+	})
+	if getresp == nil {
 		log.Printf("DEBUG: %s", err.Error())
 		return nil, err
 	}
 
-	log.Printf("DEBUG: (AddAccount) getaccounts[0] response: %+v", getresp.Response)
-	count := 3
-	for i := 1; i <= count; i++ {
-		time.Sleep(2 * time.Second) // Sleep a couple seconds to let the dust settle in PAM
-		getresp, err = GetAccounts(w, r, safename)
-		log.Printf("DEBUG: (AddAccount) getaccounts[%d] response: %+v", i, getresp.Response)
-
-		if err == nil && getresp != nil && getresp.Response != nil && getresp.Response.Count > 0 {
-			break
-		}
-	}
-
 	getone, getoneErr := FindAccount(getresp, acctname)
 	log.Printf("DEBUG: (AddAccount) findaccount: %+v", getone)
 	if getoneErr != nil {
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// safeAccountIndex maps account name to account ID for one safe
+type safeAccountIndex struct {
+	accounts map[string]string
+	fetched  time.Time
+}
+
+// accountIndexCache is a per-safe cache of account names, refreshed from PCloud after ttl
+type accountIndexCache struct {
+	ttl   time.Duration
+	mu    sync.Mutex
+	safes map[string]*safeAccountIndex
+}
+
+// accountIndex is shared by the handlers; ACCOUNT_INDEX_TTL (default 60s) controls freshness
+var accountIndex = newAccountIndexCache(accountIndexTTL())
+
+func init() {
+	registerFlusher("accountIndex", accountIndex.Flush)
+}
+
+func accountIndexTTL() time.Duration {
+	ttl, err := time.ParseDuration(getEnvOrDefault("ACCOUNT_INDEX_TTL", "60s"))
+	if err != nil {
+		log.Printf("WARNING: Invalid ACCOUNT_INDEX_TTL, using 60s: %v", err)
+		return 60 * time.Second
+	}
+	return ttl
+}
+
+func newAccountIndexCache(ttl time.Duration) *accountIndexCache {
+	return &accountIndexCache{ttl: ttl, safes: map[string]*safeAccountIndex{}}
+}
+
+// Safe names are case-insensitive in PCloud
+func accountIndexKey(safeName string) string {
+	return strings.ToLower(safeName)
+}
+
+// Lookup returns the account ID for the name, reading the safe's accounts from PCloud when the
+// cached index is missing or stale. cached reports whether the answer came from the cache.
+func (c *accountIndexCache) Lookup(r *http.Request, safeName, accountName string) (id string, found bool, cached bool, err error) {
+	c.mu.Lock()
+	index, ok := c.safes[accountIndexKey(safeName)]
+	if ok && time.Since(index.fetched) < c.ttl {
+		id, found = index.accounts[accountName]
+		c.mu.Unlock()
+		return id, found, true, nil
+	}
+	c.mu.Unlock()
+
+	getresp, err := GetAccounts(nil, r, safeName)
+	if err != nil {
+		return "", false, false, err
+	}
+	if getresp.Response == nil {
+		return "", false, false, fmt.Errorf("ERROR: response returned nil pointer for Response property")
+	}
+
+	index = &safeAccountIndex{accounts: map[string]string{}, fetched: time.Now()}
+	for _, account := range getresp.Response.Value {
+		index.accounts[account.Name] = account.ID
+	}
+	c.mu.Lock()
+	c.safes[accountIndexKey(safeName)] = index
+	c.mu.Unlock()
+
+	id, found = index.accounts[accountName]
+	return id, found, false, nil
+}
+
+// Put records a newly created account in an already cached index
+func (c *accountIndexCache) Put(safeName, accountName, accountID string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if index, ok := c.safes[accountIndexKey(safeName)]; ok {
+		index.accounts[accountName] = accountID
+	}
+}
+
+// Remove drops a deleted account from the cached index
+func (c *accountIndexCache) Remove(safeName, accountName string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if index, ok := c.safes[accountIndexKey(safeName)]; ok {
+		delete(index.accounts, accountName)
+	}
+}
+
+// Flush drops every cached safe index and returns how many there were
+func (c *accountIndexCache) Flush() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	n := len(c.safes)
+	c.safes = map[string]*safeAccountIndex{}
+	return n
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+
+	"github.com/davidh-cyberark/privilegeaccessmanager-sdk-go/pam"
+)
+
+// Accounts with secretType key hold an SSH private key. A PUT either passes the key as secret, in
+// PEM (PKCS#1 or PKCS#8) or OpenSSH format, or sets generateKey so the provider generates one from
+// the platform's secret policy (an ed25519 key when the policy is for passwords). The private key is
+// sent to PCloud and never returned; its public key and SHA256 fingerprint are kept with the
+// resource record and returned as publicKey and keyFingerprint, since PCloud does not return them.
+
+// AccountProperties is the properties of an accounts PUT: the PCloud account plus provider options
+type AccountProperties struct {
+	pam.PostAddAccountRequest
+	// GenerateKey has the provider generate the SSH key of a secretType key account
+	GenerateKey bool `json:"generateKey,omitempty"`
+	// DeletionPolicy Retain keeps the account in PCloud when the resource is deleted, see deletionpolicy.go
+	DeletionPolicy string `json:"deletionPolicy,omitempty" validate:"pattern=deletionPolicy"`
+	// EnsureSafe creates the account's safe when it does not exist, see ensuresafe.go
+	EnsureSafe bool `json:"ensureSafe,omitempty"`
+	// LinkedAccounts and AccountGroup are applied once the account is added, see accountlinks.go
+	LinkedAccounts []LinkedAccount         `json:"linkedAccounts,omitempty"`
+	AccountGroup   *AccountGroupMembership `json:"accountGroup,omitempty"`
+}
+
+// accountKey is the public half of an account's SSH key
+type accountKey struct {
+	PublicKey   string // authorized_keys format; empty when the private key is encrypted
+	Fingerprint string // SHA256:..., as ssh-keygen -l prints it
+}
+
+// defaultKeyPolicy generates keys for platforms whose secret policy is for passwords
+var defaultKeyPolicy = SecretPolicy{SecretType: "key", KeyType: "ed25519"}
+
+// prepareAccountKey generates or checks the SSH key of a secretType key account and returns its
+// public half; properties.Secret is set to a generated key. Problems with the request are returned
+// as validation details.
+func prepareAccountKey(properties *AccountProperties) (*accountKey, []ErrorDetails, error) {
+	if properties.GenerateKey {
+		if properties.SecretType == "" {
+			properties.SecretType = "key"
+		}
+		if properties.SecretType != "key" {
+			return nil, []ErrorDetails{{Code: "PropertyInvalidValue", Target: "properties.generateKey", Message: "generateKey needs secretType key"}}, nil
+		}
+		if properties.Secret != "" {
+			return nil, []ErrorDetails{{Code: "PropertyInvalidValue", Target: "properties.generateKey", Message: "generateKey cannot be combined with secret"}}, nil
+		}
+		policy := secretPolicyFor(properties.PlatformID)
+		if policy.SecretType != "key" {
+			policy = defaultKeyPolicy
+		}
+		secret, err := generateSecret(policy)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to generate an SSH key: %w", err)
+		}
+		registerSensitiveValue(secret.Secret)
+		properties.Secret = secret.Secret
+		return &accountKey{PublicKey: secret.PublicKey, Fingerprint: sshFingerprint(secret.PublicKey)}, nil, nil
+	}
+
+	if properties.SecretType != "key" || properties.Secret == "" {
+		return nil, nil, nil
+	}
+	key, err := parseSSHPrivateKey(properties.Secret)
+	if err != nil {
+		return nil, []ErrorDetails{{Code: "PropertyInvalidFormat", Target: "properties.secret",
+			Message: fmt.Sprintf("secret must be an SSH private key in PEM or OpenSSH format: %v", err)}}, nil
+	}
+	return key, nil, nil
+}
+
+// parseSSHPrivateKey reads the public half of a PEM or OpenSSH private key. Encrypted PEM keys are
+// accepted without one; OpenSSH keys keep their public key unencrypted.
+func parseSSHPrivateKey(secret string) (*accountKey, error) {
+	block, _ := pem.Decode([]byte(strings.TrimSpace(secret)))
+	if block == nil {
+		return nil, errors.New("no PEM block found")
+	}
+	if block.Type == "OPENSSH PRIVATE KEY" {
+		return parseOpenSSHPrivateKey(block.Bytes)
+	}
+	if block.Type == "ENCRYPTED PRIVATE KEY" || strings.Contains(block.Headers["Proc-Type"], "ENCRYPTED") {
+		return &accountKey{}, nil
+	}
+
+	var private interface{}
+	var err error
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		private, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "PRIVATE KEY":
+		private, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	default:
+		return nil, fmt.Errorf("unsupported PEM block %q", block.Type)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var publicKey string
+	switch key := private.(type) {
+	case *rsa.PrivateKey:
+		publicKey = sshAuthorizedKey("ssh-rsa", sshString([]byte("ssh-rsa")), sshMPInt(big.NewInt(int64(key.E))), sshMPInt(key.N))
+	case ed25519.PrivateKey:
+		publicKey = sshAuthorizedKey("ssh-ed25519", sshString([]byte("ssh-ed25519")), sshString(key.Public().(ed25519.PublicKey)))
+	default:
+		return nil, fmt.Errorf("unsupported key type %T, expected rsa or ed25519", private)
+	}
+	return &accountKey{PublicKey: publicKey, Fingerprint: sshFingerprint(publicKey)}, nil
+}
+
+// parseOpenSSHPrivateKey reads the public key from the header of an openssh-key-v1 private key
+func parseOpenSSHPrivateKey(data []byte) (*accountKey, error) {
+	const magic = "openssh-key-v1\x00"
+	if !bytes.HasPrefix(data, []byte(magic)) {
+		return nil, errors.New("not an openssh-key-v1 key")
+	}
+	rest := data[len(magic):]
+	// cipher name, KDF name and KDF options precede the key count and the public key
+	for i := 0; i < 3; i++ {
+		if _, rest = readSSHString(rest); rest == nil {
+			return nil, errors.New("truncated key")
+		}
+	}
+	if len(rest) < 4 || binary.BigEndian.Uint32(rest) != 1 {
+		return nil, errors.New("expected exactly one key")
+	}
+	blob, rest := readSSHString(rest[4:])
+	if rest == nil {
+		return nil, errors.New("truncated key")
+	}
+	keyType, _ := readSSHString(blob)
+	publicKey := strings.Join([]string{string(keyType), base64.StdEncoding.EncodeToString(blob)}, " ")
+	return &accountKey{PublicKey: publicKey, Fingerprint: sshFingerprint(publicKey)}, nil
+}
+
+// readSSHString reads a length-prefixed string; rest is nil when data is too short
+func readSSHString(data []byte) (value, rest []byte) {
+	if len(data) < 4 {
+		return nil, nil
+	}
+	n := binary.BigEndian.Uint32(data)
+	if uint64(len(data)-4) < uint64(n) {
+		return nil, nil
+	}
+	return data[4 : 4+n], data[4+n:]
+}
+
+// sshFingerprint is the SHA256 fingerprint of an authorized_keys line
+func sshFingerprint(publicKey string) string {
+	fields := strings.Fields(publicKey)
+	if len(fields) < 2 {
+		return ""
+	}
+	blob, err := base64.StdEncoding.DecodeString(fields[1])
+	if err != nil {
+		return ""
+	}
+	sum := sha256.Sum256(blob)
+	return "SHA256:" + base64.RawStdEncoding.EncodeToString(sum[:])
+}
+
+// addKeyProperties adds the key kept with a record to an account's response properties
+func addKeyProperties(properties map[string]interface{}, rec ResourceRecord) {
+	if rec.KeyFingerprint != "" {
+		properties["keyFingerprint"] = rec.KeyFingerprint
+	}
+	if rec.PublicKey != "" {
+		properties["publicKey"] = rec.PublicKey
+	}
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/davidh-cyberark/privilegeaccessmanager-sdk-go/pam"
+)
+
+// An account PUT can link the account's logon, enable and reconcile accounts and add it to an
+// account group of its safe, which PCloud only offers as calls after AddAccount. Each link and the
+// group membership is its own call: when one fails the account is kept and recorded, the PUT fails
+// with one detail per failed step, and a re-run of the deployment applies the steps again. Linking
+// is repeatable; the group membership is checked first, as adding a member twice fails.
+
+// linkedAccountIndexes are PCloud's extraPasswordIndex of each linked account type
+var linkedAccountIndexes = map[string]int{"logon": 1, "enable": 2, "reconcile": 3}
+
+// LinkedAccount is an account linked to the account of a PUT
+type LinkedAccount struct {
+	Type     string `json:"type" validate:"required,pattern=linkedAccountType"`
+	SafeName string `json:"safeName" validate:"required,max=28,pattern=safeName"`
+	Name     string `json:"name" validate:"required,max=128,pattern=accountName"`
+	// Folder defaults to Root
+	Folder string `json:"folder,omitempty" validate:"max=255"`
+}
+
+// AccountGroupMembership is the account group of the account's safe the account joins
+type AccountGroupMembership struct {
+	Name string `json:"name" validate:"required,max=100"`
+	// PlatformID is the group platform a missing group is created with; without it the group must exist
+	PlatformID string `json:"platformId,omitempty" validate:"max=99,pattern=platformId"`
+}
+
+// pcloudAccountGroup is an account group as the AccountGroups API returns it
+type pcloudAccountGroup struct {
+	GroupID         string `json:"GroupID"`
+	GroupName       string `json:"GroupName"`
+	GroupPlatformID string `json:"GroupPlatformID"`
+	Safe            string `json:"Safe"`
+}
+
+// pcloudAccountGroupMember is a member of an account group as the AccountGroups API returns it
+type pcloudAccountGroupMember struct {
+	AccountID string `json:"AccountID"`
+}
+
+// validateAccountLinks reports link types given more than once, which PCloud would silently overwrite
+func validateAccountLinks(properties AccountProperties) []ErrorDetails {
+	var details []ErrorDetails
+	seen := map[string]bool{}
+	for i, link := range properties.LinkedAccounts {
+		kind := strings.ToLower(link.Type)
+		if seen[kind] {
+			details = append(details, ErrorDetails{Code: "PropertyInvalidValue", Target: fmt.Sprintf("properties.linkedAccounts[%d].type", i),
+				Message: fmt.Sprintf("an account can have only one %s account", kind)})
+		}
+		seen[kind] = true
+	}
+	return details
+}
+
+// linkAccount links the account's linked accounts and adds it to its account group. It returns one
+// detail per failed step; the caller has already recorded the account. existing is set for an
+// account that was not added by this request, whose group membership may already be in place.
+func linkAccount(r *http.Request, accountID, safeName string, properties AccountProperties, existing bool) []ErrorDetails {
+	if len(properties.LinkedAccounts) == 0 && properties.AccountGroup == nil {
+		return nil
+	}
+
+	stopAuth := startPhase(r, "auth")
+	pamClient, err := createPAMClient()
+	stopAuth()
+	if err != nil {
+		return []ErrorDetails{{Code: "PAMClientError", Message: fmt.Sprintf("Failed to create PAM client: %v", err)}}
+	}
+	stopPAM := startPhase(r, "pam")
+	defer stopPAM()
+
+	var details []ErrorDetails
+	for i, link := range properties.LinkedAccounts {
+		kind := strings.ToLower(link.Type)
+		folder := link.Folder
+		if folder == "" {
+			folder = "Root"
+		}
+		span := startSpan(r, "LinkAccount", "pcloud.accountId", accountID, "pcloud.linkType", kind)
+		retcode, err := pamDoRetry(r.Context(), pamClient, "accounts", http.MethodPost, fmt.Sprintf("/PasswordVault/API/Accounts/%s/LinkAccount/", accountID),
+			map[string]interface{}{"safe": link.SafeName, "extraPasswordIndex": linkedAccountIndexes[kind], "name": link.Name, "folder": folder}, nil)
+		span.SetAttr("pcloud.status", strconv.Itoa(retcode))
+		span.End(err)
+		if err != nil {
+			log.Printf("ERROR: Failed to link %s account %s/%s to account %s: (%d) %v", kind, link.SafeName, link.Name, accountID, retcode, err)
+			details = append(details, ErrorDetails{Code: "LinkAccountError", Target: fmt.Sprintf("properties.linkedAccounts[%d]", i),
+				Message: fmt.Sprintf("Failed to link %s account %s in safe %s: (%d) %v", kind, link.Name, link.SafeName, retcode, checkMaintenance(err))})
+			continue
+		}
+		log.Printf("INFO: Linked %s account %s/%s to account %s", kind, link.SafeName, link.Name, accountID)
+	}
+
+	if group := properties.AccountGroup; group != nil {
+		span := startSpan(r, "AddAccountGroupMember", "pcloud.accountId", accountID, "pcloud.groupName", group.Name)
+		err := joinAccountGroup(r, pamClient, accountID, safeName, *group, existing)
+		span.End(err)
+		if err != nil {
+			log.Printf("ERROR: Failed to add account %s to account group %s: %v", accountID, group.Name, err)
+			details = append(details, ErrorDetails{Code: "AccountGroupError", Target: "properties.accountGroup",
+				Message: fmt.Sprintf("Failed to add the account to account group %s: %v", group.Name, checkMaintenance(err))})
+		}
+	}
+	return details
+}
+
+// sendAccountLinkError answers a PUT whose account is in place but whose links or group membership failed
+func sendAccountLinkError(w http.ResponseWriter, accountID string, details []ErrorDetails) {
+	sendJSONErrorDetails(w, http.StatusInternalServerError, ErrorDetails{
+		Code:    "AccountLinkError",
+		Message: fmt.Sprintf("Account %s is in place, but %d of its links failed; re-run the deployment to apply them again", accountID, len(details)),
+		Details: details,
+	})
+}
+
+// joinAccountGroup adds the account to the named account group of its safe, creating the group
+// when it is missing and a group platform is given
+func joinAccountGroup(r *http.Request, pamClient *pam.Client, accountID, safeName string, group AccountGroupMembership, existing bool) error {
+	var groups []pcloudAccountGroup
+	retcode, err := pamDoRetry(r.Context(), pamClient, "accounts", http.MethodGet, "/PasswordVault/API/AccountGroups/?Safe="+url.QueryEscape(safeName), nil, &groups)
+	if err != nil {
+		return fmt.Errorf("listing the account groups of safe %s: (%d) %w", safeName, retcode, err)
+	}
+	var groupID string
+	for _, g := range groups {
+		if strings.EqualFold(g.GroupName, group.Name) {
+			groupID = g.GroupID
+			break
+		}
+	}
+
+	if groupID == "" {
+		if group.PlatformID == "" {
+			return fmt.Errorf("safe %s has no account group %s; set accountGroup.platformId to create it", safeName, group.Name)
+		}
+		var created pcloudAccountGroup
+		retcode, err = pamDoRetry(r.Context(), pamClient, "accounts", http.MethodPost, "/PasswordVault/API/AccountGroups/",
+			pcloudAccountGroup{GroupName: group.Name, GroupPlatformID: group.PlatformID, Safe: safeName}, &created)
+		if err != nil {
+			return fmt.Errorf("creating the group: (%d) %w", retcode, err)
+		}
+		log.Printf("INFO: Created account group %s (%s) in safe %s", group.Name, created.GroupID, safeName)
+		groupID, existing = created.GroupID, false
+	}
+
+	membersPath := fmt.Sprintf("/PasswordVault/API/AccountGroups/%s/Members/", url.PathEscape(groupID))
+	if existing {
+		var members []pcloudAccountGroupMember
+		retcode, err = pamDoRetry(r.Context(), pamClient, "accounts", http.MethodGet, membersPath, nil, &members)
+		if err != nil {
+			return fmt.Errorf("listing the group's members: (%d) %w", retcode, err)
+		}
+		for _, member := range members {
+			if member.AccountID == accountID {
+				return nil
+			}
+		}
+	}
+	retcode, err = pamDoRetry(r.Context(), pamClient, "accounts", http.MethodPost, membersPath, pcloudAccountGroupMember{AccountID: accountID}, nil)
+	if err != nil {
+		return fmt.Errorf("(%d) %w", retcode, err)
+	}
+	log.Printf("INFO: Added account %s to account group %s (%s)", accountID, group.Name, groupID)
+	return nil
+}
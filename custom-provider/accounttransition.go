@@ -0,0 +1,176 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/davidh-cyberark/privilegeaccessmanager-sdk-go/pam"
+)
+
+// A redeployed template can change the safeName or name of an account resource that already
+// exists. ARM PUTs the same resource again, so the change is recognised from the resource record:
+// the PUT names a different safe or account than the one the resource points at. What happens is
+// set by ACCOUNT_MOVE_POLICY:
+//
+//   - move (the default) renames the account in place and moves it to the new safe like a PATCH
+//     does (see moveAccount), so its secret is kept
+//   - recreate deletes the old account and creates a new one from the template, with the
+//     template's secret; with deletionPolicy Retain the old account is left in PCloud instead
+//   - reject answers 409 and leaves the account alone
+//
+// The PUT response reports what was done in properties.transition.
+
+const (
+	accountMovePolicyMove     = "move"
+	accountMovePolicyRecreate = "recreate"
+	accountMovePolicyReject   = "reject"
+)
+
+// accountTransition describes how a PUT moved or renamed an account
+type accountTransition struct {
+	// Action is moved, renamed or recreated
+	Action            string `json:"action"`
+	PreviousSafeName  string `json:"previousSafeName"`
+	PreviousName      string `json:"previousName"`
+	PreviousAccountID string `json:"previousAccountId"`
+}
+
+// accountMovePolicy reads ACCOUNT_MOVE_POLICY
+func accountMovePolicy() string {
+	switch policy := strings.ToLower(getEnvOrDefault("ACCOUNT_MOVE_POLICY", accountMovePolicyMove)); policy {
+	case accountMovePolicyMove, accountMovePolicyRecreate, accountMovePolicyReject:
+		return policy
+	default:
+		log.Printf("WARNING: Invalid ACCOUNT_MOVE_POLICY %q, using %s", policy, accountMovePolicyMove)
+		return accountMovePolicyMove
+	}
+}
+
+// requestedAccountName is the safe and account a PUT names
+func requestedAccountName(cpRequest CustomProviderRequestPath, properties AccountProperties) (string, string) {
+	_, acctname, err := parseSafeNameAccountName(cpRequest.ResourceInstanceName)
+	if err != nil || properties.Name != "" {
+		acctname = properties.Name
+	}
+	return properties.SafeName, acctname
+}
+
+// transitionAccount handles a PUT that changes the safe or name of the account a resource points
+// at. It reports whether it answered the request; when it did not, the PUT creates the account as
+// usual, and transition is set when the old account was removed first.
+func transitionAccount(w http.ResponseWriter, r *http.Request, cpRequest CustomProviderRequestPath, properties AccountProperties) (transition *accountTransition, handled bool) {
+	previous, found, err := stateStore.Get(cpRequest.ID())
+	if err != nil || !found || previous.PCloudID == "" {
+		return nil, false
+	}
+	safename, acctname := requestedAccountName(cpRequest, properties)
+	if safename == "" || acctname == "" || (strings.EqualFold(safename, previous.SafeName) && acctname == previous.AccountName) {
+		return nil, false
+	}
+
+	account, retcode, err := lookupAccount(r, AccountSelector{AccountID: previous.PCloudID})
+	if retcode == http.StatusNotFound {
+		log.Printf("INFO: (CreateAccount) %s pointed at account %s, which no longer exists", cpRequest.ID(), previous.PCloudID)
+		return nil, false
+	}
+	if err != nil {
+		sendJSONError(w, http.StatusConflict, "GetAccountsError", err.Error())
+		return nil, true
+	}
+
+	policy := accountMovePolicy()
+	if policy == accountMovePolicyReject {
+		sendJSONError(w, http.StatusConflict, "AccountMoveRejected",
+			fmt.Sprintf("%s points at account %s in safe %s; moving it to %s in safe %s is not allowed (ACCOUNT_MOVE_POLICY=reject)",
+				cpRequest.ResourceInstanceName, account.Name, account.SafeName, acctname, safename))
+		return nil, true
+	}
+
+	existing, err := findExistingAccount(w, r, cpRequest, properties.PostAddAccountRequest)
+	if err != nil {
+		sendJSONError(w, http.StatusConflict, "AddAccountError", err.Error())
+		return nil, true
+	}
+	if existing != nil && existing.ID != account.ID {
+		sendJSONError(w, http.StatusConflict, "AccountAlreadyExists",
+			fmt.Sprintf("Cannot move account %s to %s in safe %s, an account with that name already exists there", account.ID, acctname, safename))
+		return nil, true
+	}
+
+	transition = &accountTransition{PreviousSafeName: account.SafeName, PreviousName: account.Name, PreviousAccountID: account.ID}
+	if policy == accountMovePolicyRecreate {
+		transition.Action = "recreated"
+		if previous.DeletionPolicy == deletionPolicyRetain {
+			log.Printf("INFO: (CreateAccount) %s has deletionPolicy Retain, leaving account %s in PCloud", cpRequest.ID(), account.ID)
+		} else if err := removeAccount(r, account.ID); err != nil {
+			sendJSONError(w, http.StatusConflict, "AccountMoveError", fmt.Sprintf("Could not delete account %s before recreating it: %v", account.ID, err))
+			return nil, true
+		}
+		log.Printf("INFO: (CreateAccount) recreating account %s of %s as %s in safe %s", account.ID, cpRequest.ID(), acctname, safename)
+		accountIndex.Remove(account.SafeName, account.Name)
+		return transition, false
+	}
+
+	if differences := accountDifferences(properties, account); len(differences) > 0 {
+		sendJSONError(w, http.StatusConflict, "AccountMoveError",
+			fmt.Sprintf("Account %s can only be moved with its current settings, the template changes: %s", account.ID, strings.Join(differences, ", ")))
+		return nil, true
+	}
+
+	transition.Action = "renamed"
+	if acctname != account.Name {
+		if account, err = renameAccount(r, account, acctname); err != nil {
+			sendJSONError(w, http.StatusConflict, "AccountMoveError", err.Error())
+			return nil, true
+		}
+	}
+	if !strings.EqualFold(safename, account.SafeName) {
+		transition.Action = "moved"
+		moved, err := moveAccount(r, account, safename)
+		if err != nil {
+			log.Printf("ERROR: (CreateAccount) move of %s to %s failed: %v", account.ID, safename, err)
+			sendJSONError(w, http.StatusConflict, "AccountMoveError", err.Error())
+			return nil, true
+		}
+		account = moved
+	}
+	log.Printf("INFO: (CreateAccount) %s %s account %s from %s.%s to %s.%s", cpRequest.ID(), transition.Action, transition.PreviousAccountID,
+		transition.PreviousSafeName, transition.PreviousName, account.SafeName, account.Name)
+	accountIndex.Remove(transition.PreviousSafeName, transition.PreviousName)
+	handleExistingAccount(w, r, cpRequest, properties, account, transition)
+	return transition, true
+}
+
+// renameAccount changes an account's name in place
+func renameAccount(r *http.Request, account *pam.GetAccountResponse, name string) (*pam.GetAccountResponse, error) {
+	stopAuth := startPhase(r, "auth")
+	pamClient, err := createPAMClient()
+	stopAuth()
+	if err != nil {
+		return nil, err
+	}
+	var renamed pam.GetAccountResponse
+	stopPAM := startPhase(r, "pam")
+	retcode, err := pamDoRetry(r.Context(), pamClient, "accounts", http.MethodPatch, fmt.Sprintf("/PasswordVault/API/Accounts/%s/", account.ID),
+		[]jsonPatchOperation{{Op: "replace", Path: "/name", Value: name}}, &renamed)
+	stopPAM()
+	if err != nil {
+		return nil, fmt.Errorf("could not rename account %s to %s: (%d) %v", account.ID, name, retcode, err)
+	}
+	return &renamed, nil
+}
+
+// removeAccount deletes an account by ID
+func removeAccount(r *http.Request, accountID string) error {
+	stopAuth := startPhase(r, "auth")
+	pamService, err := newPAMService()
+	stopAuth()
+	if err != nil {
+		return err
+	}
+	stopPAM := startPhase(r, "pam")
+	defer stopPAM()
+	return deleteAccount(r.Context(), pamService, accountID)
+}
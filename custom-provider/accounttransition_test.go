@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"cyberark-custom-provider/client"
+)
+
+func TestAccountTransitionOnPut(t *testing.T) {
+	tests := []struct {
+		policy     string
+		safeName   string
+		name       string
+		wantAction string
+		wantErr    string
+	}{
+		{"move", "safe2", "root-web01", "moved", ""},
+		{"move", "safe1", "admin-web01", "renamed", ""},
+		{"move", "safe2", "admin-web01", "moved", ""},
+		{"recreate", "safe2", "root-web01", "recreated", ""},
+		{"reject", "safe2", "root-web01", "", "AccountMoveRejected"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.policy+" to "+tt.safeName+"."+tt.name, func(t *testing.T) {
+			mock := newMockPCloud()
+			pcloud := httptest.NewServer(mock.router())
+			defer pcloud.Close()
+			t.Setenv("IDTENANTURL", pcloud.URL)
+			t.Setenv("PCLOUDURL", pcloud.URL)
+			t.Setenv("PAMUSER", "mock-user")
+			t.Setenv("PAMPASS", "mock-pass")
+			t.Setenv("ACCOUNT_MOVE_POLICY", tt.policy)
+
+			stateStore = newBufferedStateStore(newMemoryStateStore(), 0)
+			for _, name := range flusherNames() {
+				flushersMu.Lock()
+				flush := flushers[name]
+				flushersMu.Unlock()
+				flush()
+			}
+
+			router, _ := newRouter()
+			provider := httptest.NewServer(router)
+			defer provider.Close()
+			c := client.New(provider.URL, "sub1", "rg1", "CyberArkProvider")
+			ctx := context.Background()
+
+			for _, safe := range []string{"safe1", "safe2"} {
+				if _, err := c.CreateSafe(ctx, safe, client.SafeProperties{SafeName: safe}); err != nil {
+					t.Fatalf("create safe: %v", err)
+				}
+			}
+			account := client.AccountProperties{SafeName: "safe1", Name: "root-web01", PlatformID: "UnixSSH", Address: "web01", UserName: "root", Secret: "s3cret"}
+			created, err := c.CreateAccount(ctx, account)
+			if err != nil {
+				t.Fatalf("create account: %v", err)
+			}
+			recentlyCreated.Flush()
+
+			// The template now names another safe or account for the same resource
+			account.SafeName, account.Name = tt.safeName, tt.name
+			got, err := c.PutResource(ctx, "accounts", "safe1.root-web01", account)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("expected %s, got %v", tt.wantErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("redeploy: %v", err)
+			}
+			transition, _ := got.Properties["transition"].(map[string]interface{})
+			if transition["action"] != tt.wantAction || transition["previousAccountId"] != created.Properties["accountId"] || transition["previousSafeName"] != "safe1" {
+				t.Errorf("expected the %s transition to be reported, got %v", tt.wantAction, got.Properties["transition"])
+			}
+			if got.Properties["safeName"] != tt.safeName || got.Properties["name"] != tt.name {
+				t.Errorf("expected the account in %s.%s, got %v", tt.safeName, tt.name, got.Properties)
+			}
+
+			// Only the moved account is left, and the resource resolves to it
+			if len(mock.accounts) != 1 {
+				t.Errorf("expected one account in PCloud, got %d", len(mock.accounts))
+			}
+			recentlyCreated.Flush()
+			read, err := c.GetResource(ctx, "accounts", "safe1.root-web01")
+			if err != nil || read.Properties["safeName"] != tt.safeName || read.Properties["name"] != tt.name {
+				t.Errorf("expected GET to find the account in %s.%s, got %+v, %v", tt.safeName, tt.name, read, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,282 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"slices"
+	"sort"
+	"strings"
+
+	"github.com/davidh-cyberark/privilegeaccessmanager-sdk-go/pam"
+)
+
+// AccountPatchRequest is the body of an accounts PATCH
+type AccountPatchRequest struct {
+	Properties map[string]json.RawMessage `json:"properties"`
+}
+
+// jsonPatchOperation is one operation of the JSON Patch body PCloud's Update Account API takes
+type jsonPatchOperation struct {
+	Op    string      `json:"op"`
+	Path  string      `json:"path"`
+	Value interface{} `json:"value,omitempty"`
+}
+
+// patchableAccountProperties are the account properties that become a "replace" operation
+var patchableAccountProperties = []string{"name", "address", "userName", "platformId"}
+
+// accountPatchOperations translates the PATCH properties (other than safeName) into JSON Patch
+// operations. platformAccountProperties entries set to "" or null are removed.
+func accountPatchOperations(properties map[string]json.RawMessage) ([]jsonPatchOperation, error) {
+	var unsupported []string
+	var ops []jsonPatchOperation
+	for name, raw := range properties {
+		switch {
+		case name == "safeName" || name == "deletionPolicy":
+			continue
+		case slices.Contains(patchableAccountProperties, name):
+			var value string
+			if err := json.Unmarshal(raw, &value); err != nil {
+				return nil, fmt.Errorf("invalid %s: %v", name, err)
+			}
+			ops = append(ops, jsonPatchOperation{Op: "replace", Path: "/" + name, Value: value})
+		case name == "platformAccountProperties":
+			var values map[string]*string
+			if err := json.Unmarshal(raw, &values); err != nil {
+				return nil, fmt.Errorf("invalid platformAccountProperties: %v", err)
+			}
+			for key, value := range values {
+				if value == nil || *value == "" {
+					ops = append(ops, jsonPatchOperation{Op: "remove", Path: "/platformAccountProperties/" + key})
+					continue
+				}
+				ops = append(ops, jsonPatchOperation{Op: "replace", Path: "/platformAccountProperties/" + key, Value: *value})
+			}
+		case name == "secretManagement" || name == "remoteMachinesAccess":
+			var values map[string]interface{}
+			if err := json.Unmarshal(raw, &values); err != nil {
+				return nil, fmt.Errorf("invalid %s: %v", name, err)
+			}
+			for key, value := range values {
+				ops = append(ops, jsonPatchOperation{Op: "replace", Path: "/" + name + "/" + key, Value: value})
+			}
+		default:
+			unsupported = append(unsupported, name)
+		}
+	}
+	if len(unsupported) > 0 {
+		sort.Strings(unsupported)
+		return nil, fmt.Errorf("these properties cannot be changed with PATCH: %s", strings.Join(unsupported, ", "))
+	}
+	sort.Slice(ops, func(i, j int) bool { return ops[i].Path < ops[j].Path })
+	return ops, nil
+}
+
+// handleUpdateAccount handles PATCH on an account. Account properties are updated in place with
+// PCloud's Update Account API. Changing properties.safeName moves the account to another safe;
+// PCloud has no move API, so the account is recreated in the target safe with its current secret
+// and the original is deleted.
+func handleUpdateAccount(w http.ResponseWriter, r *http.Request, cpRequest CustomProviderRequestPath) {
+	LogRequestDebug("UpdateAccount", r)
+	recentlyCreated.Forget(cpRequest.ID())
+
+	var request AccountPatchRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		sendJSONError(w, http.StatusBadRequest, "InvalidRequestBody", fmt.Sprintf("Invalid request body: %v", err))
+		return
+	}
+	ops, err := accountPatchOperations(request.Properties)
+	if err != nil {
+		sendJSONError(w, http.StatusBadRequest, "UnsupportedPatch", err.Error())
+		return
+	}
+	var targetSafe string
+	if raw, ok := request.Properties["safeName"]; ok {
+		if err := json.Unmarshal(raw, &targetSafe); err != nil {
+			sendJSONError(w, http.StatusBadRequest, "InvalidRequestBody", fmt.Sprintf("Invalid safeName: %v", err))
+			return
+		}
+	}
+	var deletionPolicy *string
+	if raw, ok := request.Properties["deletionPolicy"]; ok {
+		if err := json.Unmarshal(raw, &deletionPolicy); err != nil || deletionPolicy == nil {
+			sendJSONError(w, http.StatusBadRequest, "InvalidRequestBody", fmt.Sprintf("Invalid deletionPolicy: %s", raw))
+			return
+		}
+		if details := checkDeletionPolicy(*deletionPolicy); len(details) > 0 {
+			sendValidationError(w, details)
+			return
+		}
+	}
+
+	safename, acctname, err := resolveAccountName(cpRequest)
+	if err != nil {
+		sendJSONError(w, http.StatusConflict, "ResourceNameMalformed", err.Error())
+		return
+	}
+	account, retcode, err := lookupAccount(r, AccountSelector{SafeName: safename, AccountName: acctname})
+	if err != nil {
+		if retcode == http.StatusNotFound {
+			sendJSONError(w, http.StatusNotFound, "ResourceNotFound", err.Error())
+			return
+		}
+		sendJSONError(w, http.StatusConflict, "GetAccountsError", err.Error())
+		return
+	}
+
+	original := *account
+
+	if len(ops) > 0 {
+		stopAuth := startPhase(r, "auth")
+		pamService, err := newPAMService()
+		stopAuth()
+		if err != nil {
+			sendJSONError(w, http.StatusInternalServerError, "PAMClientError", fmt.Sprintf("Failed to create PAM client: %v", err))
+			return
+		}
+		var updated pam.GetAccountResponse
+		stopPAM := startPhase(r, "pam")
+		retcode, err := statusRetry(r.Context(), "accounts", "UpdateAccount", false, func(ctx context.Context) (int, error) {
+			var status int
+			var err error
+			updated, status, err = pamService.UpdateAccount(ctx, account.ID, ops)
+			return status, err
+		})
+		stopPAM()
+		if err != nil {
+			sendJSONError(w, http.StatusConflict, "UpdateAccountError", fmt.Sprintf("Failed to update account: (%d) %v", retcode, err))
+			return
+		}
+		log.Printf("INFO: (UpdateAccount) applied %d changes to account %s", len(ops), account.ID)
+		account = &updated
+	}
+
+	if targetSafe != "" && !strings.EqualFold(targetSafe, account.SafeName) {
+		moved, err := moveAccount(r, account, targetSafe)
+		if err != nil {
+			log.Printf("ERROR: (UpdateAccount) move of %s to %s failed: %v", account.ID, targetSafe, err)
+			sendJSONError(w, http.StatusConflict, "AccountMoveError", err.Error())
+			return
+		}
+		log.Printf("INFO: (UpdateAccount) moved account %s from safe %s to %s as %s", account.ID, account.SafeName, moved.SafeName, moved.ID)
+		account = moved
+	}
+
+	// Keep the mapping pointing at the account when its safe, name or ID changed, and drift
+	// detection in line with the declared settings
+	rec, found, _ := stateStore.Get(cpRequest.ID())
+	if !found {
+		rec = ResourceRecord{ResourceID: cpRequest.ID(), ResourceType: cpRequest.ResourceTypeName, Deployment: newDeploymentStamp(r)}
+	}
+	if account.SafeName != original.SafeName || account.Name != original.Name || account.ID != original.ID || len(ops) > 0 || deletionPolicy != nil {
+		rec.SafeName = account.SafeName
+		rec.AccountName = account.Name
+		rec.PCloudID = account.ID
+		rec.Declared = accountDriftSettings(account.PlatformID, account.Address, account.UserName, account.SecretManagement, account.PlatformAccountProperties)
+		if deletionPolicy != nil {
+			rec.DeletionPolicy = recordedDeletionPolicy(*deletionPolicy)
+		}
+		recordResource(rec)
+		accountIndex.Remove(original.SafeName, original.Name)
+		accountIndex.Put(account.SafeName, account.Name, account.ID)
+	}
+
+	properties, err := accountResourceProperties(r, account)
+	if err != nil {
+		sendJSONError(w, http.StatusConflict, "UpdateAccountMarshalError", err.Error())
+		return
+	}
+	addAccountRecordProperties(properties, rec)
+	response := CustomProviderResponse{
+		ID:         cpRequest.ID(),
+		Name:       cpRequest.ResourceInstanceName,
+		Type:       fmt.Sprintf("Microsoft.CustomProviders/resourceProviders/%s", cpRequest.ResourceTypeName),
+		Properties: properties,
+	}
+	notifyLifecycle(r, "Updated", ResourceRecord{ResourceID: cpRequest.ID(), ResourceType: cpRequest.ResourceTypeName, SafeName: account.SafeName, AccountName: account.Name, PCloudID: account.ID})
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// moveAccount recreates the account in targetSafe with its current secret, then deletes the original.
+// If the original cannot be deleted the copy is removed again, so the account is never left in both safes.
+func moveAccount(r *http.Request, account *pam.GetAccountResponse, targetSafe string) (*pam.GetAccountResponse, error) {
+	stopAuth := startPhase(r, "auth")
+	pamService, err := newPAMService()
+	stopAuth()
+	if err != nil {
+		return nil, err
+	}
+
+	stopPAM := startPhase(r, "pam")
+	defer stopPAM()
+
+	var secret string
+	retcode, err := statusRetry(r.Context(), "accounts", "RetrieveSecret", false, func(ctx context.Context) (int, error) {
+		var status int
+		var err error
+		secret, status, err = pamService.RetrieveSecret(ctx, account.ID, fmt.Sprintf("Moving account to safe %s", targetSafe))
+		return status, err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("could not retrieve the current secret to preserve it: (%d) %v", retcode, err)
+	}
+
+	created, retcode, err := pcloudRetry(r.Context(), "accounts", "AddAccount", false, func(ctx context.Context) (pam.PostAddAccountResponse, int, error) {
+		return pamService.AddAccount(ctx, pam.PostAddAccountRequest{
+			SafeName:                  targetSafe,
+			PlatformID:                account.PlatformID,
+			Name:                      account.Name,
+			Address:                   account.Address,
+			UserName:                  account.UserName,
+			SecretType:                account.SecretType,
+			Secret:                    secret,
+			SecretManagement:          pam.SecretManagement{AutomaticManagementEnabled: account.SecretManagement.AutomaticManagementEnabled, ManualManagementReason: account.SecretManagement.ManualManagementReason},
+			PlatformAccountProperties: account.PlatformAccountProperties,
+			RemoteMachinesAccess:      account.RemoteMachinesAccess,
+		})
+	})
+	if err != nil {
+		return nil, checkMaintenance(fmt.Errorf("could not create the account in safe %s: (%d) %v", targetSafe, retcode, err))
+	}
+
+	if err := deleteAccount(r.Context(), pamService, account.ID); err != nil {
+		if rollbackErr := deleteAccount(r.Context(), pamService, created.ID); rollbackErr != nil {
+			return nil, fmt.Errorf("could not delete the original account (%v), and removing the copy %s in safe %s also failed: %v",
+				err, created.ID, targetSafe, rollbackErr)
+		}
+		return nil, fmt.Errorf("could not delete the original account, move rolled back: %v", err)
+	}
+
+	moved := pam.GetAccountResponse{
+		ID:                        created.ID,
+		Name:                      created.Name,
+		Address:                   created.Address,
+		UserName:                  created.UserName,
+		PlatformID:                created.PlatformID,
+		SafeName:                  created.SafeName,
+		SecretType:                created.SecretType,
+		PlatformAccountProperties: created.PlatformAccountProperties,
+		SecretManagement:          created.SecretManagement,
+		RemoteMachinesAccess:      account.RemoteMachinesAccess,
+		CreatedTime:               created.CreatedTime,
+		CategoryModificationTime:  created.CategoryModificationTime,
+	}
+	return &moved, nil
+}
+
+// resolveAccountName returns the safe and account an ARM account resource points at. The name is
+// {safename}.{accountname}, but once an account has been moved the state store is authoritative.
+func resolveAccountName(cpRequest CustomProviderRequestPath) (string, string, error) {
+	safename, acctname, err := parseSafeNameAccountName(cpRequest.ResourceInstanceName)
+	if err != nil {
+		return "", "", err
+	}
+	if rec, found, err := stateStore.Get(cpRequest.ID()); err == nil && found && rec.SafeName != "" && rec.AccountName != "" {
+		return rec.SafeName, rec.AccountName, nil
+	}
+	return safename, acctname, nil
+}
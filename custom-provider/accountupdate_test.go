@@ -0,0 +1,61 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestAccountPatchOperations(t *testing.T) {
+	tests := []struct {
+		name    string
+		body    string
+		want    []jsonPatchOperation
+		wantErr bool
+	}{
+		{
+			name: "replace simple properties, safeName ignored",
+			body: `{"address": "10.0.0.5", "safeName": "other", "userName": "root"}`,
+			want: []jsonPatchOperation{
+				{Op: "replace", Path: "/address", Value: "10.0.0.5"},
+				{Op: "replace", Path: "/userName", Value: "root"},
+			},
+		},
+		{
+			name: "platform properties set and removed",
+			body: `{"platformAccountProperties": {"Port": "2222", "LogonDomain": "", "Location": null}}`,
+			want: []jsonPatchOperation{
+				{Op: "remove", Path: "/platformAccountProperties/Location"},
+				{Op: "remove", Path: "/platformAccountProperties/LogonDomain"},
+				{Op: "replace", Path: "/platformAccountProperties/Port", Value: "2222"},
+			},
+		},
+		{
+			name: "secret management",
+			body: `{"secretManagement": {"automaticManagementEnabled": false}}`,
+			want: []jsonPatchOperation{
+				{Op: "replace", Path: "/secretManagement/automaticManagementEnabled", Value: false},
+			},
+		},
+		{
+			name:    "unsupported property",
+			body:    `{"secret": "hunter2"}`,
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var properties map[string]json.RawMessage
+			if err := json.Unmarshal([]byte(tt.body), &properties); err != nil {
+				t.Fatal(err)
+			}
+			got, err := accountPatchOperations(properties)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
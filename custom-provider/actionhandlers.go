@@ -0,0 +1,661 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/davidh-cyberark/privilegeaccessmanager-sdk-go/pam"
+)
+
+// AccountSelector identifies an existing PCloud account by id, or by name within a safe
+type AccountSelector struct {
+	SafeName    string `json:"safeName"`
+	AccountName string `json:"accountName,omitempty"`
+	AccountID   string `json:"accountId,omitempty"`
+}
+
+// ImportAccountRequest is the body of the importAccount action
+type ImportAccountRequest struct {
+	AccountSelector
+}
+
+// RegenerateSecretRequest is the body of the regenerateSecret action
+type RegenerateSecretRequest struct {
+	AccountSelector
+	// ChangeImmediately has the CPM push the new secret to the target; otherwise only the vault copy is updated
+	ChangeImmediately bool `json:"changeImmediately,omitempty"`
+}
+
+// ListSecretVersionsRequest is the body of the listSecretVersions action
+type ListSecretVersionsRequest struct {
+	AccountSelector
+	// ShowTemporary includes temporary versions, e.g. secrets set by a CPM change that is still running
+	ShowTemporary bool `json:"showTemporary,omitempty"`
+}
+
+// pcloudSecretVersion is one entry of the PCloud Get Secret Versions response
+type pcloudSecretVersion struct {
+	VersionID        int    `json:"versionID"`
+	ModifiedBy       string `json:"modifiedBy"`
+	ModificationDate int64  `json:"modificationDate"`
+	IsTemporary      bool   `json:"isTemporary"`
+}
+
+// SecretVersion is the metadata of one version of an account's secret; the secret is never returned
+type SecretVersion struct {
+	VersionID   int       `json:"versionId"`
+	ModifiedBy  string    `json:"modifiedBy"`
+	ModifiedAt  time.Time `json:"modifiedAt"`
+	IsTemporary bool      `json:"isTemporary,omitempty"`
+}
+
+// handleImportAccount brings an existing PCloud account under template management: it verifies the
+// account exists, records it in the state store, and returns the accounts resource representation
+func handleImportAccount(w http.ResponseWriter, r *http.Request, cpRequest CustomProviderRequestPath) {
+	LogRequestDebug("ImportAccount", r)
+
+	var request ImportAccountRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		sendJSONError(w, http.StatusBadRequest, "InvalidRequestBody", fmt.Sprintf("Invalid request body: %v", err))
+		return
+	}
+	if request.SafeName == "" || (request.AccountName == "" && request.AccountID == "") {
+		sendJSONError(w, http.StatusBadRequest, "InvalidRequestBody", "safeName and one of accountName or accountId are required")
+		return
+	}
+
+	account, retcode, err := lookupAccount(r, request.AccountSelector)
+	if err != nil {
+		log.Printf("DEBUG: (ImportAccount) %s", err.Error())
+		if retcode == http.StatusNotFound {
+			sendJSONError(w, http.StatusNotFound, "AccountNotFound", err.Error())
+			return
+		}
+		sendJSONError(w, http.StatusConflict, "ImportAccountError", err.Error())
+		return
+	}
+	if !strings.EqualFold(account.SafeName, request.SafeName) {
+		sendJSONError(w, http.StatusConflict, "SafeNameMismatch",
+			fmt.Sprintf("Account %s belongs to safe %s, not %s", account.ID, account.SafeName, request.SafeName))
+		return
+	}
+
+	acctRequest := cpRequest
+	acctRequest.ResourceTypeName = "accounts"
+	acctRequest.ResourceInstanceName = fmt.Sprintf("%s.%s", account.SafeName, account.Name)
+
+	if existing, found, err := stateStore.Get(acctRequest.ID()); err == nil && found && existing.PCloudID != account.ID {
+		sendJSONError(w, http.StatusConflict, "AccountAlreadyMapped",
+			fmt.Sprintf("%s is already mapped to account %s", acctRequest.ID(), existing.PCloudID))
+		return
+	}
+	recordResource(ResourceRecord{
+		ResourceID:   acctRequest.ID(),
+		ResourceType: acctRequest.ResourceTypeName,
+		SafeName:     account.SafeName,
+		AccountName:  account.Name,
+		PCloudID:     account.ID,
+		Deployment:   newDeploymentStamp(r),
+		Declared:     accountDriftSettings(account.PlatformID, account.Address, account.UserName, account.SecretManagement, account.PlatformAccountProperties),
+	})
+
+	properties, err := accountResourceProperties(r, account)
+	if err != nil {
+		sendJSONError(w, http.StatusConflict, "ImportAccountMarshalError", err.Error())
+		return
+	}
+
+	response := CustomProviderResponse{
+		ID:         acctRequest.ID(),
+		Name:       acctRequest.ResourceInstanceName,
+		Type:       fmt.Sprintf("Microsoft.CustomProviders/resourceProviders/%s", acctRequest.ResourceTypeName),
+		Properties: properties,
+	}
+	log.Printf("INFO: (ImportAccount) imported account %s as %s", account.ID, acctRequest.ID())
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(response)
+}
+
+// lookupAccount finds the account by ID, or by name within the safe
+func lookupAccount(r *http.Request, request AccountSelector) (*pam.GetAccountResponse, int, error) {
+	if request.AccountID == "" {
+		getresp, err := GetAccounts(nil, r, request.SafeName)
+		if err != nil {
+			return nil, http.StatusConflict, err
+		}
+		account, err := FindAccount(getresp, request.AccountName)
+		if err != nil {
+			return nil, http.StatusNotFound, err
+		}
+		return account, http.StatusOK, nil
+	}
+
+	stopAuth := startPhase(r, "auth")
+	pamClient, err := createPAMClient()
+	stopAuth()
+	if err != nil {
+		return nil, http.StatusInternalServerError, err
+	}
+
+	stopPAM := startPhase(r, "pam")
+	account, retcode, err := pcloudRetry(r.Context(), "accounts", "GetAccount", true, func(ctx context.Context) (pam.GetAccountResponse, int, error) {
+		return pamGetAccount(ctx, pamClient, request.AccountID)
+	})
+	stopPAM()
+	if retcode == http.StatusNotFound {
+		return nil, retcode, fmt.Errorf("account id, %s, not found", request.AccountID)
+	}
+	if err != nil {
+		return nil, retcode, fmt.Errorf("error, could not get account: (%d) %s", retcode, err.Error())
+	}
+	if request.AccountName != "" && account.Name != request.AccountName {
+		return nil, http.StatusConflict, fmt.Errorf("account id %s has name %s, not %s", account.ID, account.Name, request.AccountName)
+	}
+	return &account, retcode, nil
+}
+
+// handleRegenerateSecret generates a new secret for an account according to its platform's secret
+// policy and stores it in PCloud; the secret itself is never returned
+func handleRegenerateSecret(w http.ResponseWriter, r *http.Request, cpRequest CustomProviderRequestPath) {
+	LogRequestDebug("RegenerateSecret", r)
+
+	var request RegenerateSecretRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		sendJSONError(w, http.StatusBadRequest, "InvalidRequestBody", fmt.Sprintf("Invalid request body: %v", err))
+		return
+	}
+	if request.SafeName == "" || (request.AccountName == "" && request.AccountID == "") {
+		sendJSONError(w, http.StatusBadRequest, "InvalidRequestBody", "safeName and one of accountName or accountId are required")
+		return
+	}
+
+	account, retcode, err := lookupAccount(r, request.AccountSelector)
+	if err != nil {
+		log.Printf("DEBUG: (RegenerateSecret) %s", err.Error())
+		if retcode == http.StatusNotFound {
+			sendJSONError(w, http.StatusNotFound, "AccountNotFound", err.Error())
+			return
+		}
+		sendJSONError(w, http.StatusConflict, "RegenerateSecretError", err.Error())
+		return
+	}
+
+	policy := secretPolicyFor(account.PlatformID)
+	if account.SecretType != "" && account.SecretType != policy.SecretType {
+		sendJSONError(w, http.StatusConflict, "SecretPolicyMismatch",
+			fmt.Sprintf("Account secretType is %s but the policy for platform %s generates a %s", account.SecretType, account.PlatformID, policy.SecretType))
+		return
+	}
+	secret, err := generateSecret(policy)
+	if err != nil {
+		sendJSONError(w, http.StatusInternalServerError, "SecretGenerationError", err.Error())
+		return
+	}
+
+	stopAuth := startPhase(r, "auth")
+	pamClient, err := createPAMClient()
+	stopAuth()
+	if err != nil {
+		sendJSONError(w, http.StatusInternalServerError, "PAMClientError", fmt.Sprintf("Failed to create PAM client: %v", err))
+		return
+	}
+
+	status := "Updated"
+	stopPAM := startPhase(r, "pam")
+	if request.ChangeImmediately {
+		status = "ChangeScheduled"
+		retcode, err = pamDoRetry(r.Context(), pamClient, "accounts", http.MethodPost, fmt.Sprintf("/PasswordVault/API/Accounts/%s/SetNextPassword/", account.ID),
+			map[string]interface{}{"ChangeImmediately": true, "NewCredentials": secret.Secret}, nil)
+	} else {
+		retcode, err = pamDoRetry(r.Context(), pamClient, "accounts", http.MethodPost, fmt.Sprintf("/PasswordVault/API/Accounts/%s/Password/Update/", account.ID),
+			map[string]interface{}{"NewCredentials": secret.Secret}, nil)
+	}
+	stopPAM()
+	if err != nil {
+		sendJSONError(w, http.StatusConflict, "RegenerateSecretError", fmt.Sprintf("Failed to store new secret: (%d) %v", retcode, err))
+		return
+	}
+
+	response := map[string]interface{}{
+		"accountId":  account.ID,
+		"safeName":   account.SafeName,
+		"name":       account.Name,
+		"platformId": account.PlatformID,
+		"secretType": policy.SecretType,
+		"status":     status,
+	}
+	if secret.PublicKey != "" {
+		response["publicKey"] = secret.PublicKey
+	}
+	log.Printf("INFO: (RegenerateSecret) %s new %s for account %s", status, policy.SecretType, account.ID)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// handleListSecretVersions returns the version history of an account's secret (who changed it and
+// when) so rotation cadence can be audited through ARM; secret values are never read
+func handleListSecretVersions(w http.ResponseWriter, r *http.Request, cpRequest CustomProviderRequestPath) {
+	LogRequestDebug("ListSecretVersions", r)
+
+	var request ListSecretVersionsRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		sendJSONError(w, http.StatusBadRequest, "InvalidRequestBody", fmt.Sprintf("Invalid request body: %v", err))
+		return
+	}
+	if request.SafeName == "" || (request.AccountName == "" && request.AccountID == "") {
+		sendJSONError(w, http.StatusBadRequest, "InvalidRequestBody", "safeName and one of accountName or accountId are required")
+		return
+	}
+
+	account, retcode, err := lookupAccount(r, request.AccountSelector)
+	if err != nil {
+		log.Printf("DEBUG: (ListSecretVersions) %s", err.Error())
+		if retcode == http.StatusNotFound {
+			sendJSONError(w, http.StatusNotFound, "AccountNotFound", err.Error())
+			return
+		}
+		sendJSONError(w, http.StatusConflict, "ListSecretVersionsError", err.Error())
+		return
+	}
+
+	stopAuth := startPhase(r, "auth")
+	pamClient, err := createPAMClient()
+	stopAuth()
+	if err != nil {
+		sendJSONError(w, http.StatusInternalServerError, "PAMClientError", fmt.Sprintf("Failed to create PAM client: %v", err))
+		return
+	}
+
+	var versions struct {
+		Versions []pcloudSecretVersion `json:"Versions"`
+	}
+	path := fmt.Sprintf("/PasswordVault/API/Accounts/%s/Secret/Versions/", account.ID)
+	if request.ShowTemporary {
+		path += "?showTemporary=true"
+	}
+	stopPAM := startPhase(r, "pam")
+	retcode, err = pamDoRetry(r.Context(), pamClient, "accounts", http.MethodGet, path, nil, &versions)
+	stopPAM()
+	if err != nil {
+		sendJSONError(w, http.StatusConflict, "ListSecretVersionsError", fmt.Sprintf("Failed to get secret versions of account %s: (%d) %v", account.ID, retcode, err))
+		return
+	}
+
+	response := map[string]interface{}{
+		"accountId": account.ID,
+		"safeName":  account.SafeName,
+		"name":      account.Name,
+		"versions":  secretVersions(versions.Versions),
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// secretVersions converts PCloud versions (epoch seconds) to the action's response, newest first
+func secretVersions(in []pcloudSecretVersion) []SecretVersion {
+	out := make([]SecretVersion, 0, len(in))
+	for _, v := range in {
+		out = append(out, SecretVersion{
+			VersionID:   v.VersionID,
+			ModifiedBy:  v.ModifiedBy,
+			ModifiedAt:  time.Unix(v.ModificationDate, 0).UTC(),
+			IsTemporary: v.IsTemporary,
+		})
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].VersionID > out[j].VersionID })
+	return out
+}
+
+// RotateAccountPasswordRequest is the body of the rotateAccountPassword action
+type RotateAccountPasswordRequest struct {
+	AccountSelector
+	// ChangeEntireGroup also changes the other accounts in the account's group
+	ChangeEntireGroup bool `json:"changeEntireGroup,omitempty"`
+}
+
+// RetrievePasswordRequest is the body of the retrievePassword action
+type RetrievePasswordRequest struct {
+	AccountSelector
+	// KeyVaultURI and SecretName name the Key Vault secret the password is written to
+	KeyVaultURI string `json:"keyVaultUri"`
+	SecretName  string `json:"secretName"`
+	// Reason is recorded with the retrieval in the PCloud audit
+	Reason string `json:"reason,omitempty"`
+}
+
+// SafeMembersRequest is the body of the listSafeMembers action
+type SafeMembersRequest struct {
+	SafeName string `json:"safeName"`
+}
+
+// ListAccountsRequest is the body of the listAccounts action
+type ListAccountsRequest struct {
+	SafeName string `json:"safeName"`
+	// Top and SkipToken ask for one page of the accounts, see pagination.go
+	Top       int    `json:"top,omitempty"`
+	SkipToken string `json:"skipToken,omitempty"`
+}
+
+// handleRotateAccountPassword asks the CPM to change an account's secret now, using the platform's
+// own change process (unlike regenerateSecret, the provider never sees the new secret)
+func handleRotateAccountPassword(w http.ResponseWriter, r *http.Request, cpRequest CustomProviderRequestPath) {
+	LogRequestDebug("RotateAccountPassword", r)
+
+	var request RotateAccountPasswordRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		sendJSONError(w, http.StatusBadRequest, "InvalidRequestBody", fmt.Sprintf("Invalid request body: %v", err))
+		return
+	}
+	cpmOperation(w, r, "RotateAccountPassword", request.AccountSelector, "Change", map[string]interface{}{"ChangeEntireGroup": request.ChangeEntireGroup}, "ChangeScheduled")
+}
+
+// handleVerifyAccount asks the CPM to verify that an account's secret still works on the target
+func handleVerifyAccount(w http.ResponseWriter, r *http.Request, cpRequest CustomProviderRequestPath) {
+	LogRequestDebug("VerifyAccount", r)
+
+	var request AccountSelector
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		sendJSONError(w, http.StatusBadRequest, "InvalidRequestBody", fmt.Sprintf("Invalid request body: %v", err))
+		return
+	}
+	cpmOperation(w, r, "VerifyAccount", request, "Verify", nil, "VerifyScheduled")
+}
+
+// cpmOperation marks an account for a CPM operation (Change or Verify). PCloud only queues the
+// operation; its outcome shows up in the account's secretManagement status.
+func cpmOperation(w http.ResponseWriter, r *http.Request, name string, selector AccountSelector, operation string, body interface{}, status string) {
+	if selector.SafeName == "" || (selector.AccountName == "" && selector.AccountID == "") {
+		sendJSONError(w, http.StatusBadRequest, "InvalidRequestBody", "safeName and one of accountName or accountId are required")
+		return
+	}
+
+	account, retcode, err := lookupAccount(r, selector)
+	if err != nil {
+		log.Printf("DEBUG: (%s) %s", name, err.Error())
+		if retcode == http.StatusNotFound {
+			sendJSONError(w, http.StatusNotFound, "AccountNotFound", err.Error())
+			return
+		}
+		sendJSONError(w, http.StatusConflict, name+"Error", err.Error())
+		return
+	}
+
+	stopAuth := startPhase(r, "auth")
+	pamClient, err := createPAMClient()
+	stopAuth()
+	if err != nil {
+		sendJSONError(w, http.StatusInternalServerError, "PAMClientError", fmt.Sprintf("Failed to create PAM client: %v", err))
+		return
+	}
+
+	stopPAM := startPhase(r, "pam")
+	retcode, err = pamDoRetry(r.Context(), pamClient, "accounts", http.MethodPost, fmt.Sprintf("/PasswordVault/API/Accounts/%s/%s/", account.ID, operation), body, nil)
+	stopPAM()
+	if err != nil {
+		sendJSONError(w, http.StatusConflict, name+"Error", fmt.Sprintf("Failed to schedule %s of account %s: (%d) %v", strings.ToLower(operation), account.ID, retcode, err))
+		return
+	}
+
+	log.Printf("INFO: (%s) %s for account %s", name, status, account.ID)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"accountId":  account.ID,
+		"safeName":   account.SafeName,
+		"name":       account.Name,
+		"platformId": account.PlatformID,
+		"status":     status,
+	})
+}
+
+// handleListSafeMembers returns the members of a safe and their permissions
+func handleListSafeMembers(w http.ResponseWriter, r *http.Request, cpRequest CustomProviderRequestPath) {
+	LogRequestDebug("ListSafeMembers", r)
+
+	var request SafeMembersRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		sendJSONError(w, http.StatusBadRequest, "InvalidRequestBody", fmt.Sprintf("Invalid request body: %v", err))
+		return
+	}
+	if request.SafeName == "" {
+		sendJSONError(w, http.StatusBadRequest, "InvalidRequestBody", "safeName is required")
+		return
+	}
+
+	stopAuth := startPhase(r, "auth")
+	pamClient, err := createPAMClient()
+	stopAuth()
+	if err != nil {
+		sendJSONError(w, http.StatusInternalServerError, "PAMClientError", fmt.Sprintf("Failed to create PAM client: %v", err))
+		return
+	}
+
+	stopPAM := startPhase(r, "pam")
+	defer stopPAM()
+	safe, retcode, err := pcloudRetry(r.Context(), "safes", "GetSafeDetails", true, func(ctx context.Context) (pam.GetSafeDetails, int, error) {
+		return pamGetSafeDetails(ctx, pamClient, request.SafeName)
+	})
+	if retcode == http.StatusNotFound {
+		sendJSONError(w, http.StatusNotFound, "SafeNotFound", fmt.Sprintf("Safe not found: %s", request.SafeName))
+		return
+	}
+	if err != nil {
+		sendJSONError(w, http.StatusConflict, "GetSafeDetailsError", fmt.Sprintf("Failed to get safe: %v", checkMaintenance(err)))
+		return
+	}
+	members, retcode, err := listSafeMembers(r.Context(), pamClient, safe.SafeURLID)
+	if err != nil {
+		sendJSONError(w, http.StatusConflict, "GetSafeMembersError", fmt.Sprintf("Failed to list safe members: (%d) %v", retcode, err))
+		return
+	}
+
+	value := make([]SafeMemberResourceProperties, 0, len(members))
+	for _, member := range members {
+		value = append(value, SafeMemberResourceProperties{
+			SafeName:                 safe.SafeName,
+			MemberName:               member.MemberName,
+			MemberID:                 member.MemberID,
+			MemberType:               member.MemberType,
+			MembershipExpirationDate: member.MembershipExpirationDate,
+			IsPredefinedUser:         member.IsPredefinedUser,
+			Permissions:              member.Permissions,
+			ProvisioningState:        "Succeeded",
+		})
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"safeName": safe.SafeName, "members": value})
+}
+
+// handleListSafeAccounts returns every account in a safe with its resource properties, including
+// accounts not onboarded through the provider; those that are carry their ARM resourceId. With top
+// set only that many accounts are returned, with a token for the next page.
+func handleListSafeAccounts(w http.ResponseWriter, r *http.Request, cpRequest CustomProviderRequestPath) {
+	LogRequestDebug("ListAccounts", r)
+
+	var request ListAccountsRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		sendJSONError(w, http.StatusBadRequest, "InvalidRequestBody", fmt.Sprintf("Invalid request body: %v", err))
+		return
+	}
+	if request.SafeName == "" {
+		sendJSONError(w, http.StatusBadRequest, "InvalidRequestBody", "safeName is required")
+		return
+	}
+	top := ""
+	if request.Top != 0 {
+		top = strconv.Itoa(request.Top)
+	}
+	page, err := parseListPage(top, request.SkipToken)
+	if err != nil {
+		sendJSONError(w, http.StatusBadRequest, "InvalidPageRequest", err.Error())
+		return
+	}
+
+	stopAuth := startPhase(r, "auth")
+	pamClient, err := createPAMClient()
+	stopAuth()
+	if err != nil {
+		sendJSONError(w, http.StatusInternalServerError, "PAMClientError", fmt.Sprintf("Failed to create PAM client: %v", err))
+		return
+	}
+
+	// PCloud answers an account search on a missing safe with an empty list, so check the safe first
+	stopPAM := startPhase(r, "pam")
+	safe, retcode, err := pcloudRetry(r.Context(), "safes", "GetSafeDetails", true, func(ctx context.Context) (pam.GetSafeDetails, int, error) {
+		return pamGetSafeDetails(ctx, pamClient, request.SafeName)
+	})
+	stopPAM()
+	if retcode == http.StatusNotFound {
+		sendJSONError(w, http.StatusNotFound, "SafeNotFound", fmt.Sprintf("Safe not found: %s", request.SafeName))
+		return
+	}
+	if err != nil {
+		sendJSONError(w, http.StatusConflict, "GetSafeDetailsError", fmt.Sprintf("Failed to get safe: %v", checkMaintenance(err)))
+		return
+	}
+	// A page is read from PCloud as one page; without one every page is read
+	var accounts []pam.GetAccountResponse
+	total, next := 0, -1
+	if page.top > 0 {
+		stopPAM := startPhase(r, "pam")
+		getresp, retcode, err := pcloudRetry(r.Context(), "accounts", "GetAccounts", true, func(ctx context.Context) (*pam.GetAccountsResponse, int, error) {
+			return pamGetAccountsPage(ctx, pamClient, fmt.Sprintf("safeName eq %s", safe.SafeName), page.offset, page.top)
+		})
+		stopPAM()
+		if err != nil {
+			sendJSONError(w, http.StatusConflict, "GetAccountsError", checkMaintenance(fmt.Errorf("error, could not get accounts: (%d) %s", retcode, err.Error())).Error())
+			return
+		}
+		accounts, total = getresp.Value, getresp.Count
+		if len(accounts) > 0 && page.offset+len(accounts) < total {
+			next = page.offset + len(accounts)
+		}
+	} else {
+		getresp, err := GetAccounts(w, r, safe.SafeName)
+		if err != nil {
+			sendJSONError(w, http.StatusConflict, "GetAccountsError", err.Error())
+			return
+		}
+		start, end, _ := page.bounds(len(getresp.Response.Value))
+		accounts, total = getresp.Response.Value[start:end], len(getresp.Response.Value)
+	}
+
+	acctRequest := cpRequest
+	acctRequest.ResourceTypeName = "accounts"
+	value := []map[string]interface{}{}
+	for _, account := range accounts {
+		properties, err := accountResourceProperties(r, account)
+		if err != nil {
+			sendJSONError(w, http.StatusInternalServerError, "GetAccountMarshalError", err.Error())
+			return
+		}
+		acctRequest.ResourceInstanceName = fmt.Sprintf("%s.%s", account.SafeName, account.Name)
+		if rec, found, err := stateStore.Get(acctRequest.ID()); err == nil && found && rec.PCloudID == account.ID {
+			properties["resourceId"] = rec.ResourceID
+			addAccountRecordProperties(properties, rec)
+		}
+		value = append(value, properties)
+	}
+
+	log.Printf("DEBUG: (ListAccounts) safe %s has %d accounts", safe.SafeName, len(value))
+	w.Header().Set("Content-Type", "application/json")
+	response := map[string]interface{}{"safeName": safe.SafeName, "count": len(value), "totalCount": total, "accounts": value}
+	if next >= 0 {
+		response["nextSkipToken"] = encodeSkipToken(next)
+	}
+	json.NewEncoder(w).Encode(response)
+}
+
+// handleRetrievePassword retrieves an account's password from PCloud and writes it to a Key Vault
+// secret with the provider's managed identity, so templates can hand a new account's password to
+// an application without it passing through ARM; the password is never returned
+func handleRetrievePassword(w http.ResponseWriter, r *http.Request, cpRequest CustomProviderRequestPath) {
+	LogRequestDebug("RetrievePassword", r)
+
+	var request RetrievePasswordRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		sendJSONError(w, http.StatusBadRequest, "InvalidRequestBody", fmt.Sprintf("Invalid request body: %v", err))
+		return
+	}
+	if request.SafeName == "" || (request.AccountName == "" && request.AccountID == "") {
+		sendJSONError(w, http.StatusBadRequest, "InvalidRequestBody", "safeName and one of accountName or accountId are required")
+		return
+	}
+	if err := validKeyVaultURI(request.KeyVaultURI); err != nil {
+		sendJSONError(w, http.StatusBadRequest, "InvalidKeyVaultUri", err.Error())
+		return
+	}
+	if !keyVaultSecretName.MatchString(request.SecretName) {
+		sendJSONError(w, http.StatusBadRequest, "InvalidRequestBody", "secretName must be 1-127 letters, digits and dashes")
+		return
+	}
+
+	account, retcode, err := lookupAccount(r, request.AccountSelector)
+	if err != nil {
+		log.Printf("DEBUG: (RetrievePassword) %s", err.Error())
+		if retcode == http.StatusNotFound {
+			sendJSONError(w, http.StatusNotFound, "AccountNotFound", err.Error())
+			return
+		}
+		sendJSONError(w, http.StatusConflict, "RetrievePasswordError", err.Error())
+		return
+	}
+
+	stopAuth := startPhase(r, "auth")
+	pamService, err := newPAMService()
+	stopAuth()
+	if err != nil {
+		sendJSONError(w, http.StatusInternalServerError, "PAMClientError", fmt.Sprintf("Failed to create PAM client: %v", err))
+		return
+	}
+
+	reason := request.Reason
+	if reason == "" {
+		reason = fmt.Sprintf("Written to Key Vault secret %s/secrets/%s by the CyberArk custom provider", request.KeyVaultURI, request.SecretName)
+	}
+	var password string
+	stopPAM := startPhase(r, "pam")
+	retcode, err = statusRetry(r.Context(), "accounts", "RetrieveSecret", false, func(ctx context.Context) (int, error) {
+		var status int
+		var err error
+		password, status, err = pamService.RetrieveSecret(ctx, account.ID, reason)
+		return status, err
+	})
+	stopPAM()
+	if err != nil {
+		sendJSONError(w, http.StatusConflict, "RetrievePasswordError", fmt.Sprintf("Failed to retrieve the password of account %s: (%d) %v", account.ID, retcode, err))
+		return
+	}
+	registerSensitiveValue(password)
+
+	stored := startSpan(r, "SetKeyVaultSecret", "keyvault.uri", request.KeyVaultURI, "keyvault.secretName", request.SecretName)
+	secretID, err := putKeyVaultSecret(request.KeyVaultURI, request.SecretName, password, map[string]string{
+		"cyberarkAccountId": account.ID,
+		"cyberarkSafeName":  account.SafeName,
+	})
+	stored.End(err)
+	if err != nil {
+		log.Printf("ERROR: (RetrievePassword) Could not write account %s to Key Vault secret %s: %v", account.ID, request.SecretName, err)
+		sendJSONError(w, http.StatusBadGateway, "KeyVaultError", fmt.Sprintf("Failed to write Key Vault secret %s: %v", request.SecretName, err))
+		return
+	}
+
+	log.Printf("INFO: (RetrievePassword) Wrote the password of account %s to %s", account.ID, secretID)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"accountId":   account.ID,
+		"safeName":    account.SafeName,
+		"name":        account.Name,
+		"keyVaultUri": request.KeyVaultURI,
+		"secretName":  request.SecretName,
+		"secretId":    secretID,
+		"status":      "Stored",
+	})
+}
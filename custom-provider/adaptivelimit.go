@@ -0,0 +1,194 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Outbound PCloud calls run under an AIMD (additive increase, multiplicative decrease) concurrency
+// limit instead of a hand-tuned static one: every healthy response raises the limit by 1/limit, so
+// it grows by about one per round of calls, and a 429, a 5xx, a transport failure or a response
+// slower than PCLOUD_LATENCY_TARGET halves it. Calls over the limit wait for a slot, or until their
+// request ends.
+
+// adaptiveLimiter bounds the number of in-flight calls by a limit that adapts to their outcomes
+type adaptiveLimiter struct {
+	mu sync.Mutex
+	// changed is closed, and replaced, whenever a slot is released or the limit changes
+	changed       chan struct{}
+	limit         float64
+	min, max      float64
+	inFlight      int
+	latencyTarget time.Duration
+	lastDecrease  time.Time
+	// observe, when set, is called with the outcome of every call (see metrics.go)
+	observe func(status int, latency time.Duration)
+}
+
+func newAdaptiveLimiter(initial, min, max int, latencyTarget time.Duration) *adaptiveLimiter {
+	if min < 1 {
+		min = 1
+	}
+	if max < min {
+		max = min
+	}
+	l := &adaptiveLimiter{
+		limit:         math.Max(float64(min), math.Min(float64(initial), float64(max))),
+		min:           float64(min),
+		max:           float64(max),
+		latencyTarget: latencyTarget,
+		changed:       make(chan struct{}),
+	}
+	return l
+}
+
+// pcloudLimiter limits calls to Privilege Cloud. PCLOUD_CONCURRENCY_INITIAL (default 8),
+// PCLOUD_CONCURRENCY_MIN (default 1), PCLOUD_CONCURRENCY_MAX (default 32) and
+// PCLOUD_LATENCY_TARGET (default 2s) tune it.
+var pcloudLimiter = newAdaptiveLimiter(
+	limiterInt("PCLOUD_CONCURRENCY_INITIAL", 8),
+	limiterInt("PCLOUD_CONCURRENCY_MIN", 1),
+	limiterInt("PCLOUD_CONCURRENCY_MAX", 32),
+	limiterDuration("PCLOUD_LATENCY_TARGET", 2*time.Second),
+)
+
+func init() {
+	pcloudLimiter.observe = func(status int, latency time.Duration) {
+		observePCloudCall(status, latency)
+		pcloudBreaker.record(pcloudStatusError(status))
+	}
+}
+
+var pcloudThrottledTotal = newCounter("provider_pcloud_limit_decreases_total", "Times the PCloud concurrency limit was halved")
+
+func limiterInt(name string, fallback int) int {
+	n, err := strconv.Atoi(getEnvOrDefault(name, strconv.Itoa(fallback)))
+	if err != nil {
+		log.Printf("WARNING: Invalid %s, using %d: %v", name, fallback, err)
+		return fallback
+	}
+	return n
+}
+
+func limiterDuration(name string, fallback time.Duration) time.Duration {
+	d, err := time.ParseDuration(getEnvOrDefault(name, fallback.String()))
+	if err != nil {
+		log.Printf("WARNING: Invalid %s, using %s: %v", name, fallback, err)
+		return fallback
+	}
+	return d
+}
+
+// statusCanceled is released for a call abandoned because its request ended, which says nothing
+// about the health of PCloud
+const statusCanceled = -1
+
+// acquire waits for a slot, or returns ctx's error once ctx is done; the returned func must be
+// called with the call's status code (0 when the call never got a response, statusCanceled when it
+// was abandoned)
+func (l *adaptiveLimiter) acquire(ctx context.Context) (func(status int), error) {
+	for {
+		l.mu.Lock()
+		if float64(l.inFlight) < math.Floor(l.limit) {
+			l.inFlight++
+			l.mu.Unlock()
+			break
+		}
+		changed := l.changed
+		l.mu.Unlock()
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+
+	start := time.Now()
+	return func(status int) {
+		latency := time.Since(start)
+		if status == statusCanceled {
+			l.mu.Lock()
+			l.inFlight--
+			l.broadcast()
+			l.mu.Unlock()
+			return
+		}
+		if l.observe != nil {
+			l.observe(status, latency)
+		}
+		l.release(status, latency)
+	}, nil
+}
+
+// broadcast wakes the calls waiting for a slot; l.mu must be held
+func (l *adaptiveLimiter) broadcast() {
+	close(l.changed)
+	l.changed = make(chan struct{})
+}
+
+func (l *adaptiveLimiter) release(status int, latency time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.inFlight--
+
+	overloaded := status == 0 || status == 429 || status >= 500 || latency > l.latencyTarget
+	switch {
+	case overloaded && time.Since(l.lastDecrease) > l.latencyTarget:
+		// Calls already in flight when the backend degraded fail together; halve once per burst
+		previous := l.limit
+		l.limit = math.Max(l.min, l.limit/2)
+		l.lastDecrease = time.Now()
+		pcloudThrottledTotal.Inc()
+		log.Printf("WARNING: PCloud concurrency limit %d -> %d (status %d, latency %dms)", int(previous), int(l.limit), status, latency.Milliseconds())
+	case !overloaded:
+		l.limit = math.Min(l.max, l.limit+1/l.limit)
+	}
+	l.broadcast()
+}
+
+// snapshot returns the current limit and number of in-flight calls
+func (l *adaptiveLimiter) snapshot() (int, int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return int(l.limit), l.inFlight
+}
+
+// pcloudCall runs a PCloud SDK call under the rate and adaptive concurrency limits; a 401 drops the
+// shared session. A call abandoned because ctx was canceled (the caller went away) is not counted
+// as a PCloud failure; one that ran past its deadline is. A call that could not be sent before ctx
+// ended returns ctx's error with status 0, one turned away by the PCloud circuit breaker status 503.
+func pcloudCall[T any](ctx context.Context, call func(ctx context.Context) (T, int, error)) (T, int, error) {
+	if err := pcloudRate.wait(ctx); err != nil {
+		var result T
+		return result, 0, err
+	}
+	release, err := pcloudLimiter.acquire(ctx)
+	if err != nil {
+		var result T
+		return result, 0, err
+	}
+	if err := pcloudBreaker.check(); err != nil {
+		release(statusCanceled)
+		var result T
+		return result, http.StatusServiceUnavailable, err
+	}
+	result, status, err := call(ctx)
+	pcloudRate.throttled(status, nil)
+	pamSessions.rejected(status)
+	switch {
+	case err != nil && errors.Is(ctx.Err(), context.Canceled):
+		release(statusCanceled)
+		pcloudBreaker.abandon()
+	case err != nil && status < 300:
+		release(0)
+	default:
+		release(status)
+	}
+	return result, status, err
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+// mustAcquire takes a slot of l without a deadline
+func mustAcquire(t *testing.T, l *adaptiveLimiter) func(int) {
+	t.Helper()
+	release, err := l.acquire(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return release
+}
+
+func TestAdaptiveLimiter(t *testing.T) {
+	l := newAdaptiveLimiter(4, 1, 6, time.Hour)
+
+	// Healthy calls raise the limit by 1/limit each, about one per round
+	for i := 0; i < 5; i++ {
+		mustAcquire(t, l)(200)
+	}
+	if limit, _ := l.snapshot(); limit != 5 {
+		t.Fatalf("expected limit 5 after a healthy round, got %d", limit)
+	}
+	for i := 0; i < 100; i++ {
+		mustAcquire(t, l)(404)
+	}
+	if limit, _ := l.snapshot(); limit != 6 {
+		t.Fatalf("expected limit capped at 6, got %d", limit)
+	}
+
+	// A 429 halves the limit; further failures in the same burst do not
+	mustAcquire(t, l)(429)
+	mustAcquire(t, l)(503)
+	if limit, _ := l.snapshot(); limit != 3 {
+		t.Fatalf("expected limit 3 after throttling, got %d", limit)
+	}
+
+	// Calls over the limit wait for a slot
+	releases := []func(int){mustAcquire(t, l), mustAcquire(t, l), mustAcquire(t, l)}
+	acquired := make(chan struct{})
+	go func() {
+		mustAcquire(t, l)(200)
+		close(acquired)
+	}()
+	select {
+	case <-acquired:
+		t.Fatal("expected the fourth call to wait")
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	// A call whose request ends stops waiting
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if _, err := l.acquire(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected the waiting call to give up with its request, got %v", err)
+	}
+
+	releases[0](200)
+	select {
+	case <-acquired:
+	case <-time.After(time.Second):
+		t.Fatal("expected the waiting call to run once a slot was released")
+	}
+	releases[1](200)
+	releases[2](200)
+	if _, inFlight := l.snapshot(); inFlight != 0 {
+		t.Errorf("expected no calls in flight, got %d", inFlight)
+	}
+}
+
+func TestAdaptiveLimiterLatency(t *testing.T) {
+	l := newAdaptiveLimiter(8, 2, 16, time.Millisecond)
+	release := mustAcquire(t, l)
+	time.Sleep(5 * time.Millisecond)
+	release(200)
+	if limit, _ := l.snapshot(); limit != 4 {
+		t.Errorf("expected a slow call to halve the limit to 4, got %d", limit)
+	}
+}
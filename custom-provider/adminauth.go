@@ -0,0 +1,155 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The admin realm is separate from ARM-facing traffic: admin endpoints accept only
+// "Authorization: Bearer $ADMIN_TOKEN" or an Entra ID token carrying the ADMIN_APP_ROLE app role,
+// never the credentials ARM presents, and every admin call (allowed or denied) is written to the
+// admin audit trail.
+
+// adminAuditCapacity is the number of admin audit entries kept in memory for GET /admin/audit
+const adminAuditCapacity = 500
+
+// AdminAuditEntry records one call to an admin endpoint
+type AdminAuditEntry struct {
+	Time       time.Time `json:"time"`
+	Actor      string    `json:"actor"`
+	Method     string    `json:"method"`
+	Path       string    `json:"path"`
+	RemoteAddr string    `json:"remoteAddr"`
+	Outcome    string    `json:"outcome"`
+	Status     int       `json:"status"`
+}
+
+var (
+	adminAuditMu sync.Mutex
+	adminAudit   []AdminAuditEntry
+)
+
+// recordAdminAudit logs the entry and appends it to the in-memory trail
+func recordAdminAudit(entry AdminAuditEntry) {
+	line, _ := json.Marshal(entry)
+	log.Printf("ADMIN-AUDIT: %s", line)
+
+	adminAuditMu.Lock()
+	defer adminAuditMu.Unlock()
+	adminAudit = append(adminAudit, entry)
+	if len(adminAudit) > adminAuditCapacity {
+		adminAudit = adminAudit[len(adminAudit)-adminAuditCapacity:]
+	}
+}
+
+// adminEntra validates Entra ID tokens for the admin realm; nil unless ADMIN_APP_ROLE and ENTRA_TENANT_ID are set
+var adminEntra = loadAdminEntraValidator()
+
+func init() {
+	if adminEntra != nil {
+		registerFlusher("adminEntraKeys", adminEntra.Flush)
+	}
+}
+
+// adminAppRole is the app role an Entra ID token needs to call admin endpoints
+func adminAppRole() string {
+	return strings.TrimSpace(os.Getenv("ADMIN_APP_ROLE"))
+}
+
+// loadAdminEntraValidator validates admin tokens of the ENTRA_TENANT_ID tenant issued for
+// ADMIN_AUDIENCE (default ENTRA_AUDIENCE). The ARM-facing ENTRA_ALLOWED_APP_IDS does not apply:
+// the app role decides who is an operator.
+func loadAdminEntraValidator() *entraValidator {
+	if adminAppRole() == "" {
+		return nil
+	}
+	v := loadEntraValidator()
+	if v == nil {
+		log.Printf("WARNING: ADMIN_APP_ROLE is set without ENTRA_TENANT_ID, admin tokens will not be accepted")
+		return nil
+	}
+	v.audiences = splitSet(getEnvOrDefault("ADMIN_AUDIENCE", os.Getenv("ENTRA_AUDIENCE")))
+	v.appIDs = map[string]bool{}
+	return v
+}
+
+// adminRealmEnabled reports whether any admin credential is configured
+func adminRealmEnabled() bool {
+	return os.Getenv("ADMIN_TOKEN") != "" || adminEntra != nil
+}
+
+// adminActor identifies the caller by a fingerprint of the presented token, never the token itself
+func adminActor(token string) string {
+	if token == "" {
+		return "anonymous"
+	}
+	sum := sha256.Sum256([]byte(token))
+	return "token:" + hex.EncodeToString(sum[:])[:12]
+}
+
+// adminAuthMiddleware requires "Authorization: Bearer $ADMIN_TOKEN", or an Entra ID token with the
+// admin app role, and audits every call
+func adminAuthMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		expected := os.Getenv("ADMIN_TOKEN")
+		entry := AdminAuditEntry{
+			Time:       time.Now().UTC(),
+			Actor:      adminActor(token),
+			Method:     r.Method,
+			Path:       r.URL.Path,
+			RemoteAddr: r.RemoteAddr,
+		}
+
+		allowed := expected != "" && subtle.ConstantTimeCompare([]byte(token), []byte(expected)) == 1
+		if !allowed && adminEntra != nil && token != "" {
+			claims, err := adminEntra.validate(token)
+			switch {
+			case err != nil:
+				log.Printf("DEBUG: Admin Entra ID token rejected: %v", err)
+			case !claims.hasRole(adminAppRole()):
+				log.Printf("DEBUG: Admin Entra ID token of application %s lacks the %s app role", claims.clientID(), adminAppRole())
+			default:
+				allowed = true
+				entry.Actor = "app:" + claims.clientID()
+			}
+		}
+		if !allowed {
+			entry.Outcome = "denied"
+			entry.Status = http.StatusUnauthorized
+			recordAdminAudit(entry)
+			sendJSONError(w, http.StatusUnauthorized, "Unauthorized", "Admin token is missing or invalid")
+			return
+		}
+
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(rec, r)
+
+		entry.Outcome = "allowed"
+		entry.Status = rec.status
+		recordAdminAudit(entry)
+	})
+}
+
+// handleGetAdminAudit returns the most recent admin audit entries, newest last
+func handleGetAdminAudit(w http.ResponseWriter, r *http.Request) {
+	LogRequestDebug("AdminAudit", r)
+
+	adminAuditMu.Lock()
+	entries := make([]AdminAuditEntry, len(adminAudit))
+	copy(entries, adminAudit)
+	adminAuditMu.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"value": entries,
+	})
+}
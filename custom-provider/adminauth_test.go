@@ -0,0 +1,122 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAdminAuthMiddleware(t *testing.T) {
+	t.Setenv("ADMIN_TOKEN", "s3cret")
+
+	handler := adminAuthMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusAccepted)
+	}))
+
+	tests := []struct {
+		name           string
+		authorization  string
+		expectedStatus int
+		expectedResult string
+	}{
+		{name: "missing token", authorization: "", expectedStatus: http.StatusUnauthorized, expectedResult: "denied"},
+		{name: "wrong token", authorization: "Bearer nope", expectedStatus: http.StatusUnauthorized, expectedResult: "denied"},
+		{name: "valid token", authorization: "Bearer s3cret", expectedStatus: http.StatusAccepted, expectedResult: "allowed"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("POST", "/admin/flush", nil)
+			if tt.authorization != "" {
+				req.Header.Set("Authorization", tt.authorization)
+			}
+			rr := httptest.NewRecorder()
+			handler.ServeHTTP(rr, req)
+
+			if rr.Code != tt.expectedStatus {
+				t.Errorf("expected status %d, got %d", tt.expectedStatus, rr.Code)
+			}
+
+			adminAuditMu.Lock()
+			last := adminAudit[len(adminAudit)-1]
+			adminAuditMu.Unlock()
+			if last.Outcome != tt.expectedResult || last.Status != tt.expectedStatus {
+				t.Errorf("expected audit %s/%d, got %s/%d", tt.expectedResult, tt.expectedStatus, last.Outcome, last.Status)
+			}
+			if last.Actor == "token:s3cret" {
+				t.Errorf("audit actor must not contain the raw token")
+			}
+		})
+	}
+}
+
+func TestAdminAuthMiddlewareAppRole(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	authority, _ := newTestEntraAuthority(t, key, "key1")
+	t.Setenv("ADMIN_TOKEN", "")
+	t.Setenv("ADMIN_APP_ROLE", "Provider.Admin")
+	t.Setenv("ADMIN_AUDIENCE", "api://cyberark-provider-admin")
+	t.Setenv("ENTRA_TENANT_ID", testTenant)
+	t.Setenv("ENTRA_AUTHORITY_HOST", authority.URL)
+	t.Setenv("ENTRA_AUDIENCE", "api://cyberark-provider")
+	t.Setenv("ENTRA_ALLOWED_APP_IDS", "arm")
+
+	saved := adminEntra
+	defer func() { adminEntra = saved }()
+	adminEntra = loadAdminEntraValidator()
+
+	handler := adminAuthMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	token := func(aud string, roles ...string) string {
+		return signTestToken(t, key, "key1", "RS256", map[string]interface{}{
+			"aud":   aud,
+			"iss":   authority.URL + "/" + testTenant + "/v2.0",
+			"tid":   testTenant,
+			"azp":   "ops-console",
+			"roles": roles,
+			"exp":   time.Now().Add(time.Hour).Unix(),
+		})
+	}
+
+	tests := []struct {
+		name           string
+		token          string
+		expectedStatus int
+	}{
+		{"admin app role", token("api://cyberark-provider-admin", "Provider.Admin"), http.StatusAccepted},
+		{"missing app role", token("api://cyberark-provider-admin", "Provider.Reader"), http.StatusUnauthorized},
+		{"ARM-facing audience", token("api://cyberark-provider", "Provider.Admin"), http.StatusUnauthorized},
+		{"no token", "", http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("POST", "/admin/drain", nil)
+			if tt.token != "" {
+				req.Header.Set("Authorization", "Bearer "+tt.token)
+			}
+			rr := httptest.NewRecorder()
+			handler.ServeHTTP(rr, req)
+			if rr.Code != tt.expectedStatus {
+				t.Errorf("expected status %d, got %d", tt.expectedStatus, rr.Code)
+			}
+
+			adminAuditMu.Lock()
+			last := adminAudit[len(adminAudit)-1]
+			adminAuditMu.Unlock()
+			if tt.expectedStatus == http.StatusAccepted && last.Actor != "app:ops-console" {
+				t.Errorf("expected the audit actor to name the application, got %s", last.Actor)
+			}
+			if strings.Contains(last.Actor, tt.token) && tt.token != "" {
+				t.Errorf("audit actor must not contain the raw token")
+			}
+		})
+	}
+}
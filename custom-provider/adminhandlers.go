@@ -0,0 +1,144 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/http/pprof"
+	"sort"
+	"sync"
+
+	"github.com/gorilla/mux"
+)
+
+var (
+	flushersMu sync.Mutex
+	flushers   = map[string]func() int{}
+)
+
+// registerFlusher makes an in-memory cache flushable through POST /admin/flush/{name}.
+// The flush func returns the number of entries it dropped.
+func registerFlusher(name string, flush func() int) {
+	flushersMu.Lock()
+	defer flushersMu.Unlock()
+	flushers[name] = flush
+}
+
+// flusherNames lists the registered caches in a stable order
+func flusherNames() []string {
+	flushersMu.Lock()
+	defer flushersMu.Unlock()
+	names := make([]string, 0, len(flushers))
+	for name := range flushers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// registerAdminRoutes adds the operator-only /admin endpoints; they are disabled unless ADMIN_TOKEN
+// or ADMIN_APP_ROLE is set
+func registerAdminRoutes(r *mux.Router) {
+	if !adminRealmEnabled() {
+		log.Printf("INFO: ADMIN_TOKEN and ADMIN_APP_ROLE not set, admin endpoints are disabled")
+		return
+	}
+
+	admin := r.PathPrefix("/admin").Subrouter()
+	admin.Use(adminAuthMiddleware)
+	admin.HandleFunc("/audit", handleGetAdminAudit).Methods("GET")
+	admin.HandleFunc("/cleanupOrphans", handleCleanupOrphans).Methods("POST")
+	admin.HandleFunc("/drain", handleSetDrain).Methods("POST")
+	admin.HandleFunc("/flush", handleFlush).Methods("POST")
+	admin.HandleFunc("/flush/{name}", handleFlush).Methods("POST")
+	admin.HandleFunc("/logLevel", handleGetLogLevel).Methods("GET")
+	admin.HandleFunc("/logLevel", handleSetLogLevel).Methods("PUT")
+	admin.HandleFunc("/maintenance", handleSetMaintenance).Methods("POST")
+	admin.HandleFunc("/pamSession/refresh", handleRefreshPAMSession).Methods("POST")
+
+	// Go runtime profiling, e.g. go tool pprof -H "Authorization: Bearer $ADMIN_TOKEN" .../admin/debug/pprof/heap
+	admin.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	admin.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	admin.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	admin.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	admin.PathPrefix("/debug/pprof/").HandlerFunc(pprof.Index)
+}
+
+// handleFlush drops one named cache, or all of them when no name is given, so the next
+// request reads fresh state from Privilege Cloud
+func handleFlush(w http.ResponseWriter, r *http.Request) {
+	LogRequestDebug("Flush", r)
+
+	names := flusherNames()
+	if name, ok := mux.Vars(r)["name"]; ok {
+		flushersMu.Lock()
+		_, known := flushers[name]
+		flushersMu.Unlock()
+		if !known {
+			sendJSONError(w, http.StatusNotFound, "UnknownCache", fmt.Sprintf("Unknown cache %q, expected one of %v", name, names))
+			return
+		}
+		names = []string{name}
+	}
+
+	flushed := map[string]int{}
+	for _, name := range names {
+		flushersMu.Lock()
+		flush := flushers[name]
+		flushersMu.Unlock()
+		flushed[name] = flush()
+		log.Printf("INFO: (Flush) flushed %s, %d entries dropped", name, flushed[name])
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"flushed": flushed,
+	})
+}
+
+// handleGetLogLevel returns the current log level: {"level": "info"}
+func handleGetLogLevel(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"level": currentLogLevel()})
+}
+
+// handleSetLogLevel changes the log level until the next restart: {"level": "info"}
+func handleSetLogLevel(w http.ResponseWriter, r *http.Request) {
+	LogRequestDebug("SetLogLevel", r)
+
+	var request struct {
+		Level string `json:"level"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		sendJSONError(w, http.StatusBadRequest, "InvalidRequestBody", fmt.Sprintf("Invalid request body: %v", err))
+		return
+	}
+	level, err := parseLogLevel(request.Level)
+	if err != nil {
+		sendJSONError(w, http.StatusBadRequest, "InvalidLogLevel", err.Error())
+		return
+	}
+	previous := currentLogLevel()
+	logLevel.Store(int32(level))
+	// Logged at WARNING so the change is visible at any level
+	log.Printf("WARNING: Log level changed from %s to %s by operator", previous, currentLogLevel())
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"level": currentLogLevel(), "previous": previous})
+}
+
+// handleRefreshPAMSession opens a new PCloud session at once instead of waiting for the cached one
+// to expire or be rejected; the cached session stays in use if opening the new one fails
+func handleRefreshPAMSession(w http.ResponseWriter, r *http.Request) {
+	LogRequestDebug("RefreshPAMSession", r)
+
+	if err := pamSessions.refresh("admin"); err != nil {
+		sendJSONError(w, http.StatusBadGateway, "SessionRefreshFailed", fmt.Sprintf("Could not open a PCloud session: %v", err))
+		return
+	}
+	log.Printf("INFO: PCloud session refreshed by operator")
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(pamSessions.details())
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// ARM forwards the api-version of the caller's request in the query string. Each version the
+// provider accepts is listed in apiVersions with the schemas it uses, so a breaking change to a
+// request or response schema can be made under a new version while templates sending an older one
+// keep getting the schema they were written for. Requests without an api-version, e.g. from the
+// client package or curl, use the first version; unknown versions are rejected the way ARM rejects
+// them.
+
+// apiVersion is one version of the provider's request and response schemas
+type apiVersion struct {
+	Name string
+	// Shape is the response property shape, v1 or legacy; empty follows RESPONSE_SHAPE
+	Shape string
+}
+
+var apiVersions = []apiVersion{
+	// The Microsoft.CustomProviders api-version ARM forwards for resources declared in templates
+	{Name: "2018-09-01-preview"},
+	// The v1 property schema whatever RESPONSE_SHAPE is set to, for callers of the provider endpoint
+	{Name: "2025-06-01", Shape: "v1"},
+}
+
+type apiVersionKey struct{}
+
+// apiVersionNames lists the accepted api-versions, for errors and /metadata
+func apiVersionNames() []string {
+	names := make([]string, 0, len(apiVersions))
+	for _, version := range apiVersions {
+		names = append(names, version.Name)
+	}
+	return names
+}
+
+// apiVersionMiddleware resolves the request's api-version into the request context and answers
+// 400 InvalidApiVersionParameter for versions the provider does not know
+func apiVersionMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		name := r.URL.Query().Get("api-version")
+		if name == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		for _, version := range apiVersions {
+			if strings.EqualFold(name, version.Name) {
+				next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), apiVersionKey{}, version)))
+				return
+			}
+		}
+		sendJSONError(w, http.StatusBadRequest, "InvalidApiVersionParameter",
+			fmt.Sprintf("The api-version '%s' is invalid. The supported versions are '%s'.", name, strings.Join(apiVersionNames(), ",")))
+	})
+}
+
+// requestAPIVersion returns the api-version a request was resolved to
+func requestAPIVersion(r *http.Request) apiVersion {
+	if version, ok := r.Context().Value(apiVersionKey{}).(apiVersion); ok {
+		return version
+	}
+	return apiVersions[0]
+}
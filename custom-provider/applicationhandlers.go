@@ -0,0 +1,482 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/davidh-cyberark/privilegeaccessmanager-sdk-go/pam"
+)
+
+// The applications resource type provisions the application IDs that Credential Provider and
+// Central Credential Provider consumers authenticate as, with the machines and OS users allowed to
+// use them. Privilege Cloud serves applications only through the classic PIMServices API, which has
+// no call to change an application's details: a PUT that asks for different details is answered
+// with 409, while the allowed machines and OS users are brought in line with the template.
+
+// applicationsPath is the PIMServices path of the applications collection
+const applicationsPath = "/PasswordVault/WebServices/PIMServices.svc/Applications/"
+
+// application authentication types managed through allowedMachines and osUsers; other types, such
+// as paths and hashes, are left as they are
+const (
+	appAuthMachineAddress = "machineAddress"
+	appAuthOSUser         = "osUser"
+)
+
+var errApplicationNotFound = errors.New("application not found")
+
+// ApplicationRequest represents the request to create or update an application
+type ApplicationRequest struct {
+	Properties ApplicationProperties `json:"properties"`
+}
+
+// ApplicationProperties is the properties schema of the applications resource type. The
+// application ID is taken from the resource name.
+type ApplicationProperties struct {
+	AppID       string `json:"appId,omitempty" validate:"max=128"`
+	Description string `json:"description,omitempty" validate:"max=200"`
+	// Location is the folder of the application, default \
+	Location string `json:"location,omitempty" validate:"max=255"`
+	// AccessPermittedFrom and AccessPermittedTo are the hours (0-23) the application may retrieve secrets
+	AccessPermittedFrom int    `json:"accessPermittedFrom,omitempty" validate:"max=23"`
+	AccessPermittedTo   int    `json:"accessPermittedTo,omitempty" validate:"max=23"`
+	ExpirationDate      string `json:"expirationDate,omitempty" validate:"pattern=applicationExpirationDate"`
+	Disabled            bool   `json:"disabled,omitempty"`
+
+	BusinessOwner *ApplicationOwner `json:"businessOwner,omitempty"`
+
+	// AllowedMachines are the addresses or subnets the application may connect from
+	AllowedMachines []string `json:"allowedMachines,omitempty"`
+	// OSUsers are the operating system users the application may run as
+	OSUsers []string `json:"osUsers,omitempty"`
+}
+
+// ApplicationOwner is the business owner of an application
+type ApplicationOwner struct {
+	FirstName string `json:"firstName,omitempty" validate:"max=29"`
+	LastName  string `json:"lastName,omitempty" validate:"max=29"`
+	Email     string `json:"email,omitempty" validate:"max=29"`
+	Phone     string `json:"phone,omitempty" validate:"max=24"`
+}
+
+// ApplicationResourceProperties is the properties of an applications resource returned to ARM
+type ApplicationResourceProperties struct {
+	AppID               string            `json:"appId"`
+	Description         string            `json:"description,omitempty"`
+	Location            string            `json:"location,omitempty"`
+	AccessPermittedFrom int               `json:"accessPermittedFrom"`
+	AccessPermittedTo   int               `json:"accessPermittedTo"`
+	ExpirationDate      string            `json:"expirationDate,omitempty"`
+	Disabled            bool              `json:"disabled"`
+	BusinessOwner       *ApplicationOwner `json:"businessOwner,omitempty"`
+	AllowedMachines     []string          `json:"allowedMachines"`
+	OSUsers             []string          `json:"osUsers"`
+	ProvisioningState   string            `json:"provisioningState"`
+}
+
+// pcloudApplication is an application as the PIMServices API takes and returns it
+type pcloudApplication struct {
+	AppID               string `json:"AppID"`
+	Description         string `json:"Description,omitempty"`
+	Location            string `json:"Location,omitempty"`
+	AccessPermittedFrom int    `json:"AccessPermittedFrom"`
+	AccessPermittedTo   int    `json:"AccessPermittedTo"`
+	ExpirationDate      string `json:"ExpirationDate,omitempty"`
+	Disabled            bool   `json:"Disabled"`
+	BusinessOwnerFName  string `json:"BusinessOwnerFName,omitempty"`
+	BusinessOwnerLName  string `json:"BusinessOwnerLName,omitempty"`
+	BusinessOwnerEmail  string `json:"BusinessOwnerEmail,omitempty"`
+	BusinessOwnerPhone  string `json:"BusinessOwnerPhone,omitempty"`
+}
+
+// pcloudAppAuthentication is one authentication method of an application
+type pcloudAppAuthentication struct {
+	AuthID    string `json:"authID,omitempty"`
+	AuthType  string `json:"AuthType"`
+	AuthValue string `json:"AuthValue"`
+}
+
+// handleApplication routes applications requests to the appropriate handlers
+func handleApplication(w http.ResponseWriter, r *http.Request, cpRequest CustomProviderRequestPath) {
+	LogRequestDebug("Application", r)
+
+	switch r.Method {
+	case "PUT":
+		provision(w, r, cpRequest, handlePutApplication)
+	case "GET":
+		handleGetApplication(w, r, cpRequest)
+	case "DELETE":
+		handleDeleteApplication(w, r, cpRequest)
+	default:
+		sendJSONError(w, http.StatusMethodNotAllowed, "MethodNotAllowed", fmt.Sprintf("Method %s is not supported for applications", r.Method))
+	}
+}
+
+// applicationPath is the PIMServices path of one application
+func applicationPath(appID string) string {
+	return applicationsPath + url.PathEscape(appID) + "/"
+}
+
+// getApplication reads an application; errApplicationNotFound when it does not exist
+func getApplication(ctx context.Context, pamClient *pam.Client, appID string) (pcloudApplication, error) {
+	var body struct {
+		Application pcloudApplication `json:"application"`
+	}
+	retcode, err := pamDoRetry(ctx, pamClient, "applications", http.MethodGet, applicationPath(appID), nil, &body)
+	if retcode == http.StatusNotFound {
+		return body.Application, fmt.Errorf("%w: %s", errApplicationNotFound, appID)
+	}
+	if err != nil {
+		return body.Application, fmt.Errorf("failed to get application %s: (%d) %v", appID, retcode, err)
+	}
+	return body.Application, nil
+}
+
+// listApplicationAuthentications reads the authentication methods of an application
+func listApplicationAuthentications(ctx context.Context, pamClient *pam.Client, appID string) ([]pcloudAppAuthentication, error) {
+	var body struct {
+		Authentication []pcloudAppAuthentication `json:"authentication"`
+	}
+	retcode, err := pamDoRetry(ctx, pamClient, "applications", http.MethodGet, applicationPath(appID)+"Authentications/", nil, &body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list the authentication methods of application %s: (%d) %v", appID, retcode, err)
+	}
+	return body.Authentication, nil
+}
+
+// deleteApplication deletes an application; errApplicationNotFound when it does not exist
+func deleteApplication(ctx context.Context, pamClient *pam.Client, appID string) error {
+	retcode, err := pamDoRetry(ctx, pamClient, "applications", http.MethodDelete, applicationPath(appID), nil, nil)
+	if retcode == http.StatusNotFound {
+		return fmt.Errorf("%w: %s", errApplicationNotFound, appID)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to delete application %s: (%d) %v", appID, retcode, err)
+	}
+	return nil
+}
+
+// requestedApplication is the PIMServices application a PUT asks for
+func requestedApplication(appID string, properties ApplicationProperties) pcloudApplication {
+	app := pcloudApplication{
+		AppID:               appID,
+		Description:         properties.Description,
+		Location:            properties.Location,
+		AccessPermittedFrom: properties.AccessPermittedFrom,
+		AccessPermittedTo:   properties.AccessPermittedTo,
+		ExpirationDate:      properties.ExpirationDate,
+		Disabled:            properties.Disabled,
+	}
+	if app.Location == "" {
+		app.Location = `\`
+	}
+	if app.AccessPermittedTo == 0 {
+		app.AccessPermittedTo = 23
+	}
+	if owner := properties.BusinessOwner; owner != nil {
+		app.BusinessOwnerFName, app.BusinessOwnerLName = owner.FirstName, owner.LastName
+		app.BusinessOwnerEmail, app.BusinessOwnerPhone = owner.Email, owner.Phone
+	}
+	return app
+}
+
+// applicationDifferences lists the details a PUT sets that differ from the existing application's
+func applicationDifferences(properties ApplicationProperties, app pcloudApplication) []string {
+	var differences []string
+	fields := []struct{ name, requested, actual string }{
+		{"description", properties.Description, app.Description},
+		{"location", properties.Location, app.Location},
+		{"expirationDate", properties.ExpirationDate, app.ExpirationDate},
+	}
+	if properties.AccessPermittedFrom != 0 {
+		fields = append(fields, struct{ name, requested, actual string }{"accessPermittedFrom", strconv.Itoa(properties.AccessPermittedFrom), strconv.Itoa(app.AccessPermittedFrom)})
+	}
+	if properties.AccessPermittedTo != 0 {
+		fields = append(fields, struct{ name, requested, actual string }{"accessPermittedTo", strconv.Itoa(properties.AccessPermittedTo), strconv.Itoa(app.AccessPermittedTo)})
+	}
+	if owner := properties.BusinessOwner; owner != nil {
+		fields = append(fields, []struct{ name, requested, actual string }{
+			{"businessOwner.firstName", owner.FirstName, app.BusinessOwnerFName},
+			{"businessOwner.lastName", owner.LastName, app.BusinessOwnerLName},
+			{"businessOwner.email", owner.Email, app.BusinessOwnerEmail},
+			{"businessOwner.phone", owner.Phone, app.BusinessOwnerPhone},
+		}...)
+	}
+	for _, field := range fields {
+		if field.requested != "" && field.requested != field.actual {
+			differences = append(differences, fmt.Sprintf("%s (requested %q, actual %q)", field.name, field.requested, field.actual))
+		}
+	}
+	if properties.Disabled != app.Disabled {
+		differences = append(differences, fmt.Sprintf("disabled (requested %t, actual %t)", properties.Disabled, app.Disabled))
+	}
+	return differences
+}
+
+// planAuthenticationChanges compares the declared machines and OS users with the application's
+// methods and returns the methods to add and the methods to remove
+func planAuthenticationChanges(properties ApplicationProperties, current []pcloudAppAuthentication) (add, remove []pcloudAppAuthentication) {
+	declared := map[string][]string{appAuthMachineAddress: properties.AllowedMachines, appAuthOSUser: properties.OSUsers}
+	for _, authType := range []string{appAuthMachineAddress, appAuthOSUser} {
+		wanted := map[string]bool{}
+		for _, value := range declared[authType] {
+			wanted[strings.ToLower(value)] = true
+		}
+		have := map[string]bool{}
+		for _, auth := range current {
+			if !strings.EqualFold(auth.AuthType, authType) {
+				continue
+			}
+			have[strings.ToLower(auth.AuthValue)] = true
+			if !wanted[strings.ToLower(auth.AuthValue)] {
+				remove = append(remove, auth)
+			}
+		}
+		for _, value := range declared[authType] {
+			if !have[strings.ToLower(value)] {
+				have[strings.ToLower(value)] = true
+				add = append(add, pcloudAppAuthentication{AuthType: authType, AuthValue: value})
+			}
+		}
+	}
+	return add, remove
+}
+
+// applyAuthenticationChanges adds and removes authentication methods and returns the ones that failed
+func applyAuthenticationChanges(ctx context.Context, pamClient *pam.Client, appID string, add, remove []pcloudAppAuthentication) []string {
+	var failed []string
+	for _, auth := range add {
+		body := map[string]interface{}{"authentication": auth}
+		if retcode, err := pamDoRetry(ctx, pamClient, "applications", http.MethodPost, applicationPath(appID)+"Authentications/", body, nil); err != nil {
+			failed = append(failed, fmt.Sprintf("adding %s %s: (%d) %v", auth.AuthType, auth.AuthValue, retcode, err))
+			continue
+		}
+		log.Printf("INFO: (PutApplication) allowed %s %s for application %s", auth.AuthType, auth.AuthValue, appID)
+	}
+	for _, auth := range remove {
+		path := applicationPath(appID) + "Authentications/" + url.PathEscape(auth.AuthID) + "/"
+		if retcode, err := pamDoRetry(ctx, pamClient, "applications", http.MethodDelete, path, nil, nil); err != nil && retcode != http.StatusNotFound {
+			failed = append(failed, fmt.Sprintf("removing %s %s: (%d) %v", auth.AuthType, auth.AuthValue, retcode, err))
+			continue
+		}
+		log.Printf("INFO: (PutApplication) removed %s %s from application %s", auth.AuthType, auth.AuthValue, appID)
+	}
+	return failed
+}
+
+// applicationResponse shapes an application and its authentication methods as an applications resource
+func applicationResponse(cpRequest CustomProviderRequestPath, app pcloudApplication, auths []pcloudAppAuthentication) (CustomProviderResponse, error) {
+	resource := ApplicationResourceProperties{
+		AppID:               app.AppID,
+		Description:         app.Description,
+		Location:            app.Location,
+		AccessPermittedFrom: app.AccessPermittedFrom,
+		AccessPermittedTo:   app.AccessPermittedTo,
+		ExpirationDate:      app.ExpirationDate,
+		Disabled:            app.Disabled,
+		AllowedMachines:     []string{},
+		OSUsers:             []string{},
+		ProvisioningState:   "Succeeded",
+	}
+	if app.BusinessOwnerFName != "" || app.BusinessOwnerLName != "" || app.BusinessOwnerEmail != "" || app.BusinessOwnerPhone != "" {
+		resource.BusinessOwner = &ApplicationOwner{FirstName: app.BusinessOwnerFName, LastName: app.BusinessOwnerLName, Email: app.BusinessOwnerEmail, Phone: app.BusinessOwnerPhone}
+	}
+	for _, auth := range auths {
+		switch {
+		case strings.EqualFold(auth.AuthType, appAuthMachineAddress):
+			resource.AllowedMachines = append(resource.AllowedMachines, auth.AuthValue)
+		case strings.EqualFold(auth.AuthType, appAuthOSUser):
+			resource.OSUsers = append(resource.OSUsers, auth.AuthValue)
+		}
+	}
+	sort.Strings(resource.AllowedMachines)
+	sort.Strings(resource.OSUsers)
+
+	properties, err := toProperties(resource)
+	if err != nil {
+		return CustomProviderResponse{}, err
+	}
+	return CustomProviderResponse{
+		ID:         cpRequest.ID(),
+		Name:       cpRequest.ResourceInstanceName,
+		Type:       fmt.Sprintf("Microsoft.CustomProviders/resourceProviders/%s", cpRequest.ResourceTypeName),
+		Properties: properties,
+	}, nil
+}
+
+// handlePutApplication adds the application when it does not exist, and brings its allowed
+// machines and OS users in line with the request
+func handlePutApplication(w http.ResponseWriter, r *http.Request, cpRequest CustomProviderRequestPath) {
+	LogRequestDebug("PutApplication", r)
+	appID := cpRequest.ResourceInstanceName
+
+	var request ApplicationRequest
+	if err := decodeRequestBody(r, &request); err != nil {
+		var unknownErr *UnknownPropertiesError
+		if errors.As(err, &unknownErr) {
+			sendJSONError(w, http.StatusBadRequest, "UnknownProperties", err.Error())
+			return
+		}
+		sendJSONError(w, http.StatusBadRequest, "InvalidRequestBody", fmt.Sprintf("Invalid request body: %v", err))
+		return
+	}
+	if request.Properties.AppID != "" && request.Properties.AppID != appID {
+		sendJSONError(w, http.StatusBadRequest, "InvalidRequestBody", fmt.Sprintf("properties.appId %q does not match the resource name %q", request.Properties.AppID, appID))
+		return
+	}
+	if details := validateRequest(request); len(details) > 0 {
+		sendValidationError(w, details)
+		return
+	}
+
+	stopAuth := startPhase(r, "auth")
+	pamClient, err := createPAMClient()
+	stopAuth()
+	if err != nil {
+		sendJSONError(w, http.StatusInternalServerError, "PAMClientError", fmt.Sprintf("Failed to create PAM client: %v", err))
+		return
+	}
+
+	stopPAM := startPhase(r, "pam")
+	defer stopPAM()
+
+	code := http.StatusOK
+	app, err := getApplication(r.Context(), pamClient, appID)
+	switch {
+	case errors.Is(err, errApplicationNotFound):
+		app = requestedApplication(appID, request.Properties)
+		span := startSpan(r, "AddApplication", "pcloud.appId", appID)
+		retcode, err := pamDoRetry(r.Context(), pamClient, "applications", http.MethodPost, applicationsPath, map[string]interface{}{"application": app}, nil)
+		span.SetAttr("pcloud.status", strconv.Itoa(retcode))
+		span.End(err)
+		if err != nil {
+			sendJSONError(w, http.StatusConflict, "ApplicationCreationError", fmt.Sprintf("Failed to add application %s: (%d) %v", appID, retcode, checkMaintenance(err)))
+			return
+		}
+		log.Printf("INFO: (PutApplication) added application %s", appID)
+		code = http.StatusCreated
+	case err != nil:
+		sendJSONError(w, http.StatusConflict, "ApplicationError", err.Error())
+		return
+	default:
+		if differences := applicationDifferences(request.Properties, app); len(differences) > 0 {
+			sendJSONError(w, http.StatusConflict, "ApplicationAlreadyExists",
+				fmt.Sprintf("Application %s already exists with different settings: %s; Privilege Cloud cannot change them in place, delete the application to recreate it", appID, strings.Join(differences, ", ")))
+			return
+		}
+	}
+
+	recordResource(ResourceRecord{
+		ResourceID:   cpRequest.ID(),
+		ResourceType: cpRequest.ResourceTypeName,
+		PCloudID:     appID,
+		Deployment:   newDeploymentStamp(r),
+	})
+
+	var current []pcloudAppAuthentication
+	if code == http.StatusOK {
+		if current, err = listApplicationAuthentications(r.Context(), pamClient, appID); err != nil {
+			sendJSONError(w, http.StatusConflict, "ApplicationAuthenticationError", err.Error())
+			return
+		}
+	}
+	add, remove := planAuthenticationChanges(request.Properties, current)
+	if failed := applyAuthenticationChanges(r.Context(), pamClient, appID, add, remove); len(failed) > 0 {
+		sendJSONError(w, http.StatusConflict, "ApplicationAuthenticationError",
+			fmt.Sprintf("Application %s is in place, but updating its authentication methods failed: %s", appID, strings.Join(failed, "; ")))
+		return
+	}
+
+	auths := append(current[:0:0], add...)
+	for _, auth := range current {
+		kept := true
+		for _, removed := range remove {
+			kept = kept && removed.AuthID != auth.AuthID
+		}
+		if kept {
+			auths = append(auths, auth)
+		}
+	}
+	response, err := applicationResponse(cpRequest, app, auths)
+	if err != nil {
+		sendJSONError(w, http.StatusInternalServerError, "ApplicationMarshalError", err.Error())
+		return
+	}
+	sendJSONResource(w, r, code, response)
+}
+
+// handleGetApplication returns an application with its allowed machines and OS users
+func handleGetApplication(w http.ResponseWriter, r *http.Request, cpRequest CustomProviderRequestPath) {
+	LogRequestDebug("GetApplication", r)
+	appID := cpRequest.ResourceInstanceName
+
+	stopAuth := startPhase(r, "auth")
+	pamClient, err := createPAMClient()
+	stopAuth()
+	if err != nil {
+		sendJSONError(w, http.StatusInternalServerError, "PAMClientError", fmt.Sprintf("Failed to create PAM client: %v", err))
+		return
+	}
+
+	stopPAM := startPhase(r, "pam")
+	app, err := getApplication(r.Context(), pamClient, appID)
+	var auths []pcloudAppAuthentication
+	if err == nil {
+		auths, err = listApplicationAuthentications(r.Context(), pamClient, appID)
+	}
+	stopPAM()
+	if errors.Is(err, errApplicationNotFound) {
+		sendJSONError(w, http.StatusNotFound, "ResourceNotFound", err.Error())
+		return
+	}
+	if err != nil {
+		sendJSONError(w, http.StatusConflict, "ApplicationError", err.Error())
+		return
+	}
+
+	response, err := applicationResponse(cpRequest, app, auths)
+	if err != nil {
+		sendJSONError(w, http.StatusInternalServerError, "ApplicationMarshalError", err.Error())
+		return
+	}
+	sendJSONResource(w, r, http.StatusOK, response)
+}
+
+// handleDeleteApplication deletes an application, and with it its authentication methods
+func handleDeleteApplication(w http.ResponseWriter, r *http.Request, cpRequest CustomProviderRequestPath) {
+	LogRequestDebug("DeleteApplication", r)
+	appID := cpRequest.ResourceInstanceName
+
+	stopAuth := startPhase(r, "auth")
+	pamClient, err := createPAMClient()
+	stopAuth()
+	if err != nil {
+		sendJSONError(w, http.StatusInternalServerError, "PAMClientError", fmt.Sprintf("Failed to create PAM client: %v", err))
+		return
+	}
+
+	stopPAM := startPhase(r, "pam")
+	span := startSpan(r, "DeleteApplication", "pcloud.appId", appID)
+	err = deleteApplication(r.Context(), pamClient, appID)
+	span.End(err)
+	stopPAM()
+	if errors.Is(err, errApplicationNotFound) {
+		forgetResource(cpRequest.ID())
+		sendJSONError(w, http.StatusNotFound, "ResourceNotFound", err.Error())
+		return
+	}
+	if err != nil {
+		sendJSONError(w, http.StatusConflict, "ApplicationDeletionError", err.Error())
+		return
+	}
+	log.Printf("INFO: (DeleteApplication) deleted application %s", appID)
+	forgetResource(cpRequest.ID())
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	armEndpoint = "https://management.azure.com"
+	// armCustomProvidersAPIVersion is the api-version for Microsoft.CustomProviders resources
+	armCustomProvidersAPIVersion = "2018-09-01-preview"
+)
+
+// armResourceExists asks ARM whether a resource still exists.
+// The managed identity needs read access on the resource group that holds the custom provider.
+func armResourceExists(resourceID string) (bool, error) {
+	token, err := getManagedIdentityToken(armEndpoint + "/")
+	if err != nil {
+		return false, err
+	}
+
+	apiurl := fmt.Sprintf("%s%s?api-version=%s", armEndpoint, resourceID, armCustomProvidersAPIVersion)
+	req, err := http.NewRequest(http.MethodGet, apiurl, nil)
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+
+	client := newOutboundClient(30 * time.Second)
+	resp, err := client.Do(req)
+	if err != nil {
+		return false, fmt.Errorf("ARM request failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == http.StatusNotFound:
+		return false, nil
+	case resp.StatusCode < 300:
+		return true, nil
+	default:
+		return false, fmt.Errorf("ARM returned status %d for %s", resp.StatusCode, resourceID)
+	}
+}
+
+// providerIDFromResourceID trims a custom resource ID down to its resourceProviders/{name} parent.
+// Proxy resource types are not stored by ARM (a GET is forwarded back to us), so the parent
+// custom provider and its resource group are what tell us whether the ARM side still exists.
+func providerIDFromResourceID(resourceID string) (string, error) {
+	segments := strings.Split(strings.Trim(resourceID, "/"), "/")
+	if len(segments) < 8 || !strings.EqualFold(segments[6], "resourceProviders") {
+		return "", fmt.Errorf("not a custom provider resource ID: %s", resourceID)
+	}
+	return "/" + strings.Join(segments[:8], "/"), nil
+}
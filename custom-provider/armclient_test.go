@@ -0,0 +1,47 @@
+package main
+
+import "testing"
+
+func TestProviderIDFromResourceID(t *testing.T) {
+	tests := []struct {
+		name        string
+		resourceID  string
+		expected    string
+		expectError bool
+	}{
+		{
+			name:       "safe resource",
+			resourceID: "/subscriptions/test-sub/resourceGroups/test-rg/providers/Microsoft.CustomProviders/resourceProviders/test-provider/safes/test-safe",
+			expected:   "/subscriptions/test-sub/resourceGroups/test-rg/providers/Microsoft.CustomProviders/resourceProviders/test-provider",
+		},
+		{
+			name:       "account resource with dots",
+			resourceID: "/subscriptions/test-sub/resourceGroups/test-rg/providers/Microsoft.CustomProviders/resourceProviders/test-provider/accounts/safe1.acct.one",
+			expected:   "/subscriptions/test-sub/resourceGroups/test-rg/providers/Microsoft.CustomProviders/resourceProviders/test-provider",
+		},
+		{
+			name:        "not a custom provider resource",
+			resourceID:  "/subscriptions/test-sub/resourceGroups/test-rg",
+			expectError: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result, err := providerIDFromResourceID(tt.resourceID)
+			if tt.expectError {
+				if err == nil {
+					t.Errorf("expected error but got none")
+				}
+				return
+			}
+			if err != nil {
+				t.Errorf("unexpected error: %v", err)
+				return
+			}
+			if result != tt.expected {
+				t.Errorf("expected %s, got %s", tt.expected, result)
+			}
+		})
+	}
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Handlers report a failed PCloud or Conjur call with the blanket 409 or 500, and the error text
+// carries the upstream status and body as the SDK and pamDo format them ("received non-200 status
+// code(403): {...}"). sendJSONError reads them back so the ARM error has a status that says who is
+// at fault and an innererror with the upstream error code and message as they were returned.
+
+// InnerError is the upstream error behind an ARM error, as PCloud or Conjur returned it
+type InnerError struct {
+	Source  string `json:"source"`
+	Status  int    `json:"status,omitempty"`
+	Code    string `json:"code,omitempty"`
+	Message string `json:"message,omitempty"`
+}
+
+// upstreamStatusPatterns find the upstream status in an error message: PCloud responses through the
+// SDK and pamDo, Conjur responses, and a rejected PCloud session request
+var upstreamStatusPatterns = []*regexp.Regexp{
+	regexp.MustCompile(`status code\((\d{3})\)(?::\s*(\{.*\}))?`),
+	regexp.MustCompile(`returned status (\d{3})(?::\s*(\{.*\}))?`),
+	regexp.MustCompile(`session token: (\d{3})`),
+}
+
+// parseInnerError finds the upstream status, code and message in an error message
+func parseInnerError(source, message string) *InnerError {
+	for _, pattern := range upstreamStatusPatterns {
+		match := pattern.FindStringSubmatch(message)
+		if match == nil {
+			continue
+		}
+		inner := &InnerError{Source: source}
+		inner.Status, _ = strconv.Atoi(match[1])
+		if len(match) > 2 && match[2] != "" {
+			var body struct {
+				// PCloud
+				ErrorCode    string `json:"ErrorCode"`
+				ErrorMessage string `json:"ErrorMessage"`
+				// Identity tenant
+				Error            json.RawMessage `json:"error"`
+				ErrorDescription string          `json:"error_description"`
+			}
+			if json.Unmarshal([]byte(match[2]), &body) == nil {
+				inner.Code, inner.Message = body.ErrorCode, body.ErrorMessage
+				// Conjur nests {"error": {"code": ..., "message": ...}}, the identity tenant sends a string
+				var conjur struct{ Code, Message string }
+				if json.Unmarshal(body.Error, &conjur) == nil && conjur.Code != "" {
+					inner.Code, inner.Message = conjur.Code, conjur.Message
+				} else if code := strings.Trim(string(body.Error), `"`); code != "" && inner.Code == "" {
+					inner.Code, inner.Message = code, body.ErrorDescription
+				}
+			}
+		}
+		return inner
+	}
+	if strings.Contains(message, "failed to send") {
+		return &InnerError{Source: source, Message: "the request did not reach " + source}
+	}
+	return nil
+}
+
+// upstreamARMStatus maps an upstream status to the status returned to ARM: the caller's request was
+// wrong (400), PCloud refused the provider's user (403), the object is missing (404) or in a
+// conflicting state (409), or the upstream failed (502). 0 keeps the handler's status.
+func upstreamARMStatus(status int) int {
+	switch {
+	case status == 0:
+		return http.StatusBadGateway
+	case status == http.StatusBadRequest, status == http.StatusUnprocessableEntity:
+		return http.StatusBadRequest
+	case status == http.StatusUnauthorized:
+		// The provider's own credentials were rejected, which the caller cannot fix
+		return http.StatusBadGateway
+	case status == http.StatusForbidden, status == http.StatusNotFound, status == http.StatusConflict, status == http.StatusTooManyRequests:
+		return status
+	case status >= 500:
+		return http.StatusBadGateway
+	}
+	return 0
+}
+
+// armError turns a handler's error into the ARM error contract. Only the blanket 409 and 500 are
+// remapped, statuses a handler chose deliberately are kept.
+func armError(code int, details ErrorDetails) (int, ErrorDetails) {
+	if code != http.StatusConflict && code != http.StatusInternalServerError {
+		return code, details
+	}
+	source := "PCloud"
+	if strings.Contains(details.Code, "Conjur") {
+		source = "Conjur"
+	}
+	inner := parseInnerError(source, details.Message)
+	if inner == nil {
+		return code, details
+	}
+	details.InnerError = inner
+	if status := upstreamARMStatus(inner.Status); status != 0 {
+		code = status
+	}
+	return code, details
+}
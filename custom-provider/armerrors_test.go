@@ -0,0 +1,85 @@
+package main
+
+import (
+	"net/http"
+	"reflect"
+	"testing"
+)
+
+func TestARMError(t *testing.T) {
+	tests := []struct {
+		name           string
+		status         int
+		code           string
+		message        string
+		expectedStatus int
+		expectedInner  *InnerError
+	}{
+		{
+			name:           "PCloud rejects the request",
+			status:         http.StatusConflict,
+			code:           "AddAccountError",
+			message:        `failed to add account: received non-200 status code(400): {"ErrorCode":"PASWS027E","ErrorMessage":"Invalid platform"}`,
+			expectedStatus: http.StatusBadRequest,
+			expectedInner:  &InnerError{Source: "PCloud", Status: 400, Code: "PASWS027E", Message: "Invalid platform"},
+		},
+		{
+			name:           "PCloud server error",
+			status:         http.StatusInternalServerError,
+			code:           "SafeCreationError",
+			message:        `Failed to create safe: received non-200 status code(500): {"ErrorCode":"PASWS001E","ErrorMessage":"Internal error"}`,
+			expectedStatus: http.StatusBadGateway,
+			expectedInner:  &InnerError{Source: "PCloud", Status: 500, Code: "PASWS001E", Message: "Internal error"},
+		},
+		{
+			name:           "PCloud rejects the provider's credentials",
+			status:         http.StatusInternalServerError,
+			code:           "PAMClientError",
+			message:        "Failed to create PAM client: could not refresh session: failed to get session token: 401",
+			expectedStatus: http.StatusBadGateway,
+			expectedInner:  &InnerError{Source: "PCloud", Status: 401},
+		},
+		{
+			name:           "Conjur denies the policy load",
+			status:         http.StatusConflict,
+			code:           "ConjurSecretError",
+			message:        `Failed to declare Conjur variable data/x: (403) POST /policies/conjur/policy/data returned status 403: {"error":{"code":"forbidden","message":"Forbidden"}}`,
+			expectedStatus: http.StatusForbidden,
+			expectedInner:  &InnerError{Source: "Conjur", Status: 403, Code: "forbidden", Message: "Forbidden"},
+		},
+		{
+			name:           "PCloud unreachable",
+			status:         http.StatusConflict,
+			code:           "GetAccountsError",
+			message:        "failed to send get acount request. dial tcp: connection refused",
+			expectedStatus: http.StatusBadGateway,
+			expectedInner:  &InnerError{Source: "PCloud", Message: "the request did not reach PCloud"},
+		},
+		{
+			name:           "deliberate status is kept",
+			status:         http.StatusNotFound,
+			code:           "ResourceNotFound",
+			message:        "received non-200 status code(500): {}",
+			expectedStatus: http.StatusNotFound,
+		},
+		{
+			name:           "no upstream error",
+			status:         http.StatusConflict,
+			code:           "SafeAlreadyExists",
+			message:        "Safe safe1 already exists",
+			expectedStatus: http.StatusConflict,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			status, details := armError(tt.status, ErrorDetails{Code: tt.code, Message: tt.message})
+			if status != tt.expectedStatus {
+				t.Errorf("expected status %d, got %d", tt.expectedStatus, status)
+			}
+			if !reflect.DeepEqual(details.InnerError, tt.expectedInner) {
+				t.Errorf("expected innererror %+v, got %+v", tt.expectedInner, details.InnerError)
+			}
+		})
+	}
+}
@@ -0,0 +1,277 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Safe and account creation can outlast ARM's synchronous request timeout (PCloud verification
+// alone waits several seconds). With the asyncProvisioning feature flag, or X-Provider-Async: true on a
+// request, a PUT is answered with 202 Accepted at once and a background worker runs the normal
+// create handler. ARM polls the Azure-AsyncOperation URL (/operations/{id}) for the status and
+// reads the final resource from the Location URL (/operations/{id}/result). An operation accepted
+// during a PCloud maintenance window stays Accepted until the window ends.
+
+// asyncOperation statuses, as ARM expects them
+const (
+	asyncAccepted  = "Accepted"
+	asyncRunning   = "Running"
+	asyncSucceeded = "Succeeded"
+	asyncFailed    = "Failed"
+)
+
+// asyncOperationError is the error of a failed operation
+type asyncOperationError struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// asyncOperation is one background provisioning operation; its ID is the operation ID of the PUT
+type asyncOperation struct {
+	ID         string               `json:"id"`
+	Name       string               `json:"name"`
+	ResourceID string               `json:"resourceId"`
+	Status     string               `json:"status"`
+	StartTime  time.Time            `json:"startTime"`
+	EndTime    *time.Time           `json:"endTime,omitempty"`
+	Error      *asyncOperationError `json:"error,omitempty"`
+
+	resultCode   int
+	resultHeader http.Header
+	resultBody   []byte
+}
+
+// asyncOperationStore keeps operations in memory until they are older than the retention
+type asyncOperationStore struct {
+	mu         sync.Mutex
+	operations map[string]*asyncOperation
+	retention  time.Duration
+	slots      chan struct{}
+	// running counts the operations not finished yet, so shutdown can wait for them
+	running sync.WaitGroup
+}
+
+// asyncOperations is the store used by the PUT handlers. ASYNC_WORKERS (default 4) bounds how many
+// operations run at once; ASYNC_OPERATION_RETENTION (default 24h) is how long results can be polled.
+var asyncOperations = newAsyncOperationStore(asyncWorkers(), asyncOperationRetention())
+
+func newAsyncOperationStore(workers int, retention time.Duration) *asyncOperationStore {
+	if workers < 1 {
+		workers = 1
+	}
+	return &asyncOperationStore{operations: map[string]*asyncOperation{}, retention: retention, slots: make(chan struct{}, workers)}
+}
+
+func asyncWorkers() int {
+	n, err := strconv.Atoi(getEnvOrDefault("ASYNC_WORKERS", "4"))
+	if err != nil {
+		log.Printf("WARNING: Invalid ASYNC_WORKERS, using 4: %v", err)
+		return 4
+	}
+	return n
+}
+
+func asyncOperationRetention() time.Duration {
+	d, err := time.ParseDuration(getEnvOrDefault("ASYNC_OPERATION_RETENTION", "24h"))
+	if err != nil {
+		log.Printf("WARNING: Invalid ASYNC_OPERATION_RETENTION, using 24h: %v", err)
+		return 24 * time.Hour
+	}
+	return d
+}
+
+// asyncProvisioning reports whether a PUT runs in the background: the asyncProvisioning feature flag
+// turns it on for everyone, and the async request flag overrides that per request
+func asyncProvisioning(r *http.Request) bool {
+	if enabled, set := requestFlag(r, "async"); set {
+		return enabled
+	}
+	return featureEnabled("asyncProvisioning")
+}
+
+// get returns a copy of an operation so callers can read it without holding the lock
+func (s *asyncOperationStore) get(id string) (asyncOperation, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	op, ok := s.operations[id]
+	if !ok {
+		return asyncOperation{}, false
+	}
+	return *op, true
+}
+
+// start records a new operation and runs fn on a worker slot; fn's response becomes the result
+func (s *asyncOperationStore) start(id string, cpRequest CustomProviderRequestPath, fn func(w http.ResponseWriter)) {
+	s.mu.Lock()
+	for key, op := range s.operations {
+		if op.EndTime != nil && time.Since(*op.EndTime) > s.retention {
+			delete(s.operations, key)
+		}
+	}
+	op := &asyncOperation{ID: id, Name: id, ResourceID: cpRequest.ID(), Status: asyncAccepted, StartTime: time.Now().UTC()}
+	s.operations[id] = op
+	s.mu.Unlock()
+
+	s.running.Add(1)
+	go func() {
+		defer s.running.Done()
+		maintenance.wait()
+		s.slots <- struct{}{}
+		defer func() { <-s.slots }()
+
+		s.mu.Lock()
+		op.Status = asyncRunning
+		s.mu.Unlock()
+
+		result := &bufferedResponse{header: http.Header{}, code: http.StatusOK}
+		fn(result)
+
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		end := time.Now().UTC()
+		op.EndTime = &end
+		op.resultCode = result.code
+		op.resultHeader = result.header
+		op.resultBody = result.body.Bytes()
+		if result.code < 300 {
+			op.Status = asyncSucceeded
+		} else {
+			op.Status = asyncFailed
+			var body struct {
+				Error asyncOperationError `json:"error"`
+			}
+			if err := json.Unmarshal(op.resultBody, &body); err != nil || body.Error.Code == "" {
+				body.Error = asyncOperationError{Code: "ProvisioningFailed", Message: fmt.Sprintf("provisioning returned status %d", result.code)}
+			}
+			op.Error = &body.Error
+		}
+		log.Printf("INFO: [op=%s] async operation for %s finished: %s (%d) after %s", id, op.ResourceID, op.Status, result.code, end.Sub(op.StartTime).Round(time.Millisecond))
+	}()
+}
+
+// drain waits until all started operations have finished or ctx is done, and returns how many are
+// still running
+func (s *asyncOperationStore) drain(ctx context.Context) int {
+	done := make(chan struct{})
+	go func() {
+		s.running.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	running := 0
+	for _, op := range s.operations {
+		if op.EndTime == nil {
+			running++
+		}
+	}
+	return running
+}
+
+// bufferedResponse collects a handler's response for an async operation
+type bufferedResponse struct {
+	header http.Header
+	code   int
+	body   bytes.Buffer
+	wrote  bool
+}
+
+func (b *bufferedResponse) Header() http.Header { return b.header }
+
+func (b *bufferedResponse) WriteHeader(code int) {
+	if !b.wrote {
+		b.wrote = true
+		b.code = code
+	}
+}
+
+func (b *bufferedResponse) Write(p []byte) (int, error) {
+	b.WriteHeader(http.StatusOK)
+	return b.body.Write(p)
+}
+
+// provision runs a create handler synchronously, or in the background when async provisioning
+// is on for the request
+func provision(w http.ResponseWriter, r *http.Request, cpRequest CustomProviderRequestPath, handler providerHandler) {
+	if !asyncProvisioning(r) {
+		handler(w, r, cpRequest)
+		return
+	}
+
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		sendJSONError(w, http.StatusBadRequest, "InvalidRequestBody", fmt.Sprintf("Invalid request body: %v", err))
+		return
+	}
+	// The background request keeps the operation ID and flags but must outlive this response
+	background := r.Clone(context.WithoutCancel(r.Context()))
+	background.Body = io.NopCloser(bytes.NewReader(body))
+
+	id := operationID(r)
+	asyncOperations.start(id, cpRequest, func(w http.ResponseWriter) {
+		handler(w, background, cpRequest)
+	})
+	log.Printf("INFO: [op=%s] accepted %s for async provisioning", id, cpRequest.ID())
+
+	operationURL := fmt.Sprintf("%s/operations/%s", providerEndpoint(r), id)
+	w.Header().Set("Azure-AsyncOperation", operationURL)
+	w.Header().Set("Location", operationURL+"/result")
+	w.Header().Set("Retry-After", "5")
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(CustomProviderResponse{
+		ID:         cpRequest.ID(),
+		Name:       cpRequest.ResourceInstanceName,
+		Type:       fmt.Sprintf("Microsoft.CustomProviders/resourceProviders/%s", cpRequest.ResourceTypeName),
+		Properties: map[string]interface{}{"provisioningState": asyncAccepted},
+	})
+}
+
+// handleGetOperation reports the status of an async operation (the Azure-AsyncOperation URL)
+func handleGetOperation(w http.ResponseWriter, r *http.Request) {
+	op, ok := asyncOperations.get(mux.Vars(r)["id"])
+	if !ok {
+		sendJSONError(w, http.StatusNotFound, "OperationNotFound", fmt.Sprintf("Operation %s not found", mux.Vars(r)["id"]))
+		return
+	}
+	if op.EndTime == nil {
+		w.Header().Set("Retry-After", "5")
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(op)
+}
+
+// handleGetOperationResult answers 202 while an operation runs and then replays the create
+// handler's response (the Location URL)
+func handleGetOperationResult(w http.ResponseWriter, r *http.Request) {
+	op, ok := asyncOperations.get(mux.Vars(r)["id"])
+	if !ok {
+		sendJSONError(w, http.StatusNotFound, "OperationNotFound", fmt.Sprintf("Operation %s not found", mux.Vars(r)["id"]))
+		return
+	}
+	if op.EndTime == nil {
+		w.Header().Set("Location", fmt.Sprintf("%s/operations/%s/result", providerEndpoint(r), op.ID))
+		w.Header().Set("Retry-After", "5")
+		w.WriteHeader(http.StatusAccepted)
+		return
+	}
+	for key, values := range op.resultHeader {
+		w.Header()[key] = values
+	}
+	w.WriteHeader(op.resultCode)
+	w.Write(op.resultBody)
+}
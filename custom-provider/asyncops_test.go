@@ -0,0 +1,143 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// clearMaintenance ends a maintenance window earlier tests may have left behind, which would hold
+// back async operations
+func clearMaintenance() {
+	maintenance.mu.Lock()
+	defer maintenance.mu.Unlock()
+	maintenance.manual = false
+	maintenance.detectedUntil = time.Time{}
+}
+
+func TestAsyncProvisioning(t *testing.T) {
+	t.Setenv("ASYNC_PROVISIONING", "true")
+	t.Setenv("PROVIDER_ENDPOINT", "https://provider.example.com")
+	clearMaintenance()
+
+	tests := []struct {
+		name       string
+		code       int
+		body       string
+		wantStatus string
+		wantError  string
+	}{
+		{name: "succeeded", code: http.StatusOK, body: `{"id":"x","properties":{"provisioningState":"Succeeded"}}`, wantStatus: asyncSucceeded},
+		{name: "failed", code: http.StatusConflict, body: `{"error":{"code":"AddAccountError","message":"boom"}}`, wantStatus: asyncFailed, wantError: "AddAccountError"},
+	}
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			release := make(chan struct{})
+			handler := func(w http.ResponseWriter, r *http.Request, cpRequest CustomProviderRequestPath) {
+				<-release
+				if body, _ := io.ReadAll(r.Body); string(body) != `{"properties":{}}` {
+					t.Errorf("background handler got body %q", body)
+				}
+				w.WriteHeader(tt.code)
+				w.Write([]byte(tt.body))
+			}
+
+			id := "op-test" + string(rune('a'+i))
+			r := httptest.NewRequest(http.MethodPut, "/", strings.NewReader(`{"properties":{}}`))
+			r = r.WithContext(context.WithValue(r.Context(), operationIDKey{}, id))
+			w := httptest.NewRecorder()
+			provision(w, r, CustomProviderRequestPath{ResourceTypeName: "accounts", ResourceInstanceName: "safe1.acct1"}, handler)
+
+			if w.Code != http.StatusAccepted {
+				t.Fatalf("expected 202, got %d", w.Code)
+			}
+			if got := w.Header().Get("Azure-AsyncOperation"); got != "https://provider.example.com/operations/"+id {
+				t.Errorf("unexpected Azure-AsyncOperation %q", got)
+			}
+
+			result := httptest.NewRecorder()
+			handleGetOperationResult(result, mux.SetURLVars(httptest.NewRequest(http.MethodGet, "/", nil), map[string]string{"id": id}))
+			if result.Code != http.StatusAccepted {
+				t.Errorf("expected 202 while running, got %d", result.Code)
+			}
+
+			close(release)
+			deadline := time.Now().Add(5 * time.Second)
+			op, _ := asyncOperations.get(id)
+			for op.EndTime == nil && time.Now().Before(deadline) {
+				time.Sleep(5 * time.Millisecond)
+				op, _ = asyncOperations.get(id)
+			}
+			if op.Status != tt.wantStatus {
+				t.Fatalf("expected status %s, got %s", tt.wantStatus, op.Status)
+			}
+			if tt.wantError != "" && (op.Error == nil || op.Error.Code != tt.wantError) {
+				t.Errorf("expected error %s, got %+v", tt.wantError, op.Error)
+			}
+
+			result = httptest.NewRecorder()
+			handleGetOperationResult(result, mux.SetURLVars(httptest.NewRequest(http.MethodGet, "/", nil), map[string]string{"id": id}))
+			if result.Code != tt.code || result.Body.String() != tt.body {
+				t.Errorf("expected the handler's response, got %d %s", result.Code, result.Body.String())
+			}
+		})
+	}
+}
+
+func TestAsyncProvisioningQueuedDuringMaintenance(t *testing.T) {
+	t.Setenv("ASYNC_PROVISIONING", "false")
+	t.Setenv("PROVIDER_ENDPOINT", "https://provider.example.com")
+	savedInterval := maintenancePollInterval
+	maintenancePollInterval = 10 * time.Millisecond
+	defer func() { maintenancePollInterval = savedInterval }()
+	clearMaintenance()
+	defer clearMaintenance()
+	maintenance.mu.Lock()
+	maintenance.manual = true
+	maintenance.mu.Unlock()
+
+	ran := make(chan struct{})
+	handler := maintenanceMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		provision(w, r, CustomProviderRequestPath{ResourceTypeName: "safes", ResourceInstanceName: "safe1"}, func(w http.ResponseWriter, r *http.Request, cpRequest CustomProviderRequestPath) {
+			close(ran)
+			w.WriteHeader(http.StatusOK)
+		})
+	}))
+	put := func(async bool) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodPut, "/subscriptions/sub1/resourceGroups/rg1/providers/Microsoft.CustomProviders/resourceProviders/CyberArkProvider/safes/safe1", strings.NewReader(`{"properties":{}}`))
+		r.Header.Set("x-ms-customproviders-requestpath", r.URL.Path)
+		ctx := context.WithValue(r.Context(), operationIDKey{}, "op-maintenance")
+		r = r.WithContext(context.WithValue(ctx, requestFlagsKey{}, map[string]bool{"async": async}))
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w
+	}
+
+	if w := put(false); w.Code != http.StatusServiceUnavailable {
+		t.Fatalf("expected a synchronous PUT to get 503 during maintenance, got %d", w.Code)
+	}
+	if w := put(true); w.Code != http.StatusAccepted {
+		t.Fatalf("expected an async PUT to be accepted during maintenance, got %d", w.Code)
+	}
+	select {
+	case <-ran:
+		t.Fatal("expected the operation to wait for the maintenance window to end")
+	case <-time.After(100 * time.Millisecond):
+	}
+	if op, _ := asyncOperations.get("op-maintenance"); op.Status != asyncAccepted {
+		t.Errorf("expected the queued operation to stay %s, got %s", asyncAccepted, op.Status)
+	}
+
+	clearMaintenance()
+	select {
+	case <-ran:
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the operation to start once the maintenance window ended")
+	}
+}
@@ -0,0 +1,267 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Audit entries of mutating requests (PUT, PATCH, DELETE and actions other than list*) can be kept
+// beyond the in-memory trail of exportAudit: AUDIT_BLOB_CONTAINER_URL appends them as JSON lines to
+// a daily append blob, AUDIT_LOG_ANALYTICS_WORKSPACE_ID sends them to a Log Analytics custom table
+// through the HTTP Data Collector API. Entries are shipped in batches every few seconds and on
+// shutdown; a failed batch is kept for the next attempt.
+
+// auditSink ships batches of audit entries to one store
+type auditSink struct {
+	name   string
+	target string // logged and shown in /healthex, without secrets
+	send   func(entries []OperationAuditEntry) error
+
+	flushMu sync.Mutex // one batch in flight at a time, so batches are appended in order
+	mu      sync.Mutex
+	pending []OperationAuditEntry
+}
+
+// maxPendingAuditEntries bounds the entries kept while a store is unreachable; older ones are dropped
+const maxPendingAuditEntries = 4096
+
+var auditSinks = newAuditSinks()
+
+func newAuditSinks() []*auditSink {
+	var sinks []*auditSink
+	client := newOutboundClient(30 * time.Second)
+	if container := os.Getenv("AUDIT_BLOB_CONTAINER_URL"); container != "" {
+		blob := &appendBlobWriter{container: container, client: client}
+		sinks = append(sinks, &auditSink{name: "auditBlob", target: redactURL(container), send: blob.write})
+	}
+	if workspace := os.Getenv("AUDIT_LOG_ANALYTICS_WORKSPACE_ID"); workspace != "" {
+		collector := &logAnalyticsWriter{
+			endpoint:  fmt.Sprintf("https://%s.ods.opinsights.azure.com/api/logs?api-version=2016-04-01", workspace),
+			workspace: workspace,
+			key:       os.Getenv("AUDIT_LOG_ANALYTICS_SHARED_KEY"),
+			logType:   getEnvOrDefault("AUDIT_LOG_ANALYTICS_LOG_TYPE", "CyberArkProviderAudit"),
+			client:    client,
+		}
+		sinks = append(sinks, &auditSink{name: "auditLogAnalytics", target: workspace, send: collector.write})
+	}
+	return sinks
+}
+
+func init() {
+	for _, sink := range auditSinks {
+		sink := sink
+		registerDependency(sink.name, func() map[string]interface{} {
+			sink.mu.Lock()
+			defer sink.mu.Unlock()
+			return map[string]interface{}{"target": sink.target, "pendingEntries": len(sink.pending)}
+		})
+		registerShutdownHook(sink.name, func() { sink.flush() })
+		go func() {
+			for range time.Tick(5 * time.Second) {
+				sink.flush()
+			}
+		}()
+	}
+}
+
+// auditSinkNames lists the configured audit stores for the startup fingerprint
+func auditSinkNames() []string {
+	names := []string{}
+	for _, sink := range auditSinks {
+		names = append(names, sink.name)
+	}
+	return names
+}
+
+// mutatingOperation reports whether an audit entry's operation can change PCloud
+func mutatingOperation(method, resourceType string) bool {
+	switch method {
+	case http.MethodPut, http.MethodPatch, http.MethodDelete:
+		return true
+	case http.MethodPost:
+		return !strings.HasPrefix(resourceType, "list")
+	}
+	return false
+}
+
+// shipOperationAudit queues an entry for every configured audit store
+func shipOperationAudit(entry OperationAuditEntry) {
+	for _, sink := range auditSinks {
+		sink.mu.Lock()
+		sink.pending = append(sink.pending, entry)
+		if len(sink.pending) > maxPendingAuditEntries {
+			sink.pending = sink.pending[len(sink.pending)-maxPendingAuditEntries:]
+		}
+		sink.mu.Unlock()
+	}
+}
+
+// flush ships the queued entries; on failure they are kept for the next flush
+func (s *auditSink) flush() error {
+	s.flushMu.Lock()
+	defer s.flushMu.Unlock()
+	s.mu.Lock()
+	batch := s.pending
+	s.pending = nil
+	s.mu.Unlock()
+	if len(batch) == 0 {
+		return nil
+	}
+
+	err := s.send(batch)
+	recordDependencyResult(s.name, err)
+	if err != nil {
+		log.Printf("WARNING: Could not ship %d audit entries to %s: %v", len(batch), s.target, err)
+		s.mu.Lock()
+		s.pending = append(batch, s.pending...)
+		if len(s.pending) > maxPendingAuditEntries {
+			s.pending = s.pending[len(s.pending)-maxPendingAuditEntries:]
+		}
+		s.mu.Unlock()
+	}
+	return err
+}
+
+// appendBlobWriter appends entries to {container}/{yyyy}/{mm}/{dd}.jsonl. A container URL with a
+// SAS token is used as is; without one the managed identity needs Storage Blob Data Contributor.
+type appendBlobWriter struct {
+	container string
+	client    *http.Client
+	created   string // the blob known to exist
+}
+
+func (b *appendBlobWriter) write(entries []OperationAuditEntry) error {
+	content, _, err := formatOperationAudit(entries, "jsonl")
+	if err != nil {
+		return err
+	}
+	blob := entries[0].Time.UTC().Format("2006/01/02") + ".jsonl"
+	if blob != b.created {
+		// Creating an existing blob fails with 409, which is fine: another replica created it
+		status, err := b.do(blob, nil, nil, map[string]string{"x-ms-blob-type": "AppendBlob", "If-None-Match": "*"})
+		if err != nil && status != http.StatusConflict {
+			return err
+		}
+		b.created = blob
+	}
+	status, err := b.do(blob, url.Values{"comp": {"appendblock"}}, content, nil)
+	if status == http.StatusNotFound {
+		b.created = ""
+	}
+	return err
+}
+
+// do PUTs to the blob and returns the status; errors include the storage error code
+func (b *appendBlobWriter) do(blob string, query url.Values, body []byte, headers map[string]string) (int, error) {
+	u, err := url.Parse(b.container)
+	if err != nil {
+		return 0, err
+	}
+	u.Path = strings.TrimSuffix(u.Path, "/") + "/" + blob
+	sas := u.RawQuery != ""
+	if query != nil {
+		q := u.Query()
+		for key, values := range query {
+			q[key] = values
+		}
+		u.RawQuery = q.Encode()
+	}
+
+	req, err := http.NewRequest(http.MethodPut, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("x-ms-version", "2021-08-06")
+	req.Header.Set("Content-Type", "application/x-ndjson")
+	for key, value := range headers {
+		req.Header.Set(key, value)
+	}
+	if !sas {
+		token, err := getManagedIdentityToken("https://storage.azure.com/")
+		if err != nil {
+			return 0, fmt.Errorf("could not get a managed identity token: %w", err)
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	res, err := b.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer res.Body.Close()
+	io.Copy(io.Discard, res.Body)
+	if res.StatusCode == http.StatusUnauthorized && !sas {
+		forgetManagedIdentityToken("https://storage.azure.com/")
+	}
+	if res.StatusCode >= 300 {
+		return res.StatusCode, fmt.Errorf("blob storage returned status %d (%s)", res.StatusCode, res.Header.Get("x-ms-error-code"))
+	}
+	return res.StatusCode, nil
+}
+
+// logAnalyticsWriter posts entries to a Log Analytics workspace with the HTTP Data Collector API;
+// they land in the {logType}_CL table
+type logAnalyticsWriter struct {
+	endpoint  string
+	workspace string
+	key       string // the workspace's primary or secondary key, base64
+	logType   string
+	client    *http.Client
+}
+
+func (l *logAnalyticsWriter) write(entries []OperationAuditEntry) error {
+	body, err := json.Marshal(entries)
+	if err != nil {
+		return err
+	}
+	date := time.Now().UTC().Format(http.TimeFormat)
+	signature, err := l.signature(date, len(body))
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, l.endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Log-Type", l.logType)
+	req.Header.Set("x-ms-date", date)
+	req.Header.Set("time-generated-field", "time")
+	req.Header.Set("Authorization", fmt.Sprintf("SharedKey %s:%s", l.workspace, signature))
+
+	res, err := l.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode >= 300 {
+		msg, _ := io.ReadAll(io.LimitReader(res.Body, 1024))
+		return fmt.Errorf("Log Analytics returned status %d: %s", res.StatusCode, string(msg))
+	}
+	return nil
+}
+
+// signature is the Data Collector API's SharedKey signature of a POST of length bytes
+func (l *logAnalyticsWriter) signature(date string, length int) (string, error) {
+	key, err := base64.StdEncoding.DecodeString(l.key)
+	if err != nil {
+		return "", fmt.Errorf("AUDIT_LOG_ANALYTICS_SHARED_KEY is not base64: %w", err)
+	}
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte("POST\n" + strconv.Itoa(length) + "\napplication/json\nx-ms-date:" + date + "\n/api/logs"))
+	return base64.StdEncoding.EncodeToString(mac.Sum(nil)), nil
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestOperationAuditMutatingEntries(t *testing.T) {
+	var shipped []OperationAuditEntry
+	sink := &auditSink{name: "test", send: func(entries []OperationAuditEntry) error {
+		shipped = append(shipped, entries...)
+		return nil
+	}}
+	saved := auditSinks
+	auditSinks = []*auditSink{sink}
+	defer func() { auditSinks = saved }()
+
+	handler := operationAuditMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if body, _ := io.ReadAll(r.Body); r.Method == http.MethodPut && string(body) != `{"properties":{}}` {
+			t.Errorf("expected the handler to read the full body, got %q", body)
+		}
+		if r.Method == http.MethodPut {
+			sendJSONError(w, http.StatusConflict, "AddAccountError", "failed")
+		}
+	}))
+	base := "/subscriptions/sub1/resourceGroups/rg1/providers/Microsoft.CustomProviders/resourceProviders/CyberArkProvider/"
+	for _, tt := range []struct{ method, path, body string }{
+		{http.MethodPut, base + "accounts/safe1.root", `{"properties":{}}`},
+		{http.MethodGet, base + "accounts/safe1.root", ""},
+		{http.MethodPost, base + "listPlatforms", `{}`},
+		{http.MethodPost, base + "regenerateSecret", `{}`},
+	} {
+		r := httptest.NewRequest(tt.method, "/", strings.NewReader(tt.body))
+		r.Header.Set("X-Ms-Customproviders-Requestpath", tt.path)
+		r.Header.Set("X-Ms-Client-Principal-Name", "alice@example.com")
+		handler.ServeHTTP(httptest.NewRecorder(), r)
+	}
+	if err := sink.flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(shipped) != 2 {
+		t.Fatalf("expected the PUT and regenerateSecret to be shipped, got %+v", shipped)
+	}
+	sum := sha256.Sum256([]byte(`{"properties":{}}`))
+	put := shipped[0]
+	if put.Operation != http.MethodPut || put.Caller != "alice@example.com" || put.BodySHA256 != hex.EncodeToString(sum[:]) || put.Status != http.StatusConflict || put.ErrorCode != "AddAccountError" {
+		t.Errorf("unexpected PUT entry %+v", put)
+	}
+	if action := shipped[1]; action.Operation != "POST regenerateSecret" || action.ErrorCode != "" {
+		t.Errorf("unexpected action entry %+v", action)
+	}
+}
+
+func TestAppendBlobWriter(t *testing.T) {
+	var requests []string
+	var appended string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests = append(requests, r.Method+" "+r.URL.Path+" "+r.URL.Query().Get("comp")+" "+r.Header.Get("x-ms-blob-type"))
+		if r.URL.Query().Get("sig") != "s1" {
+			t.Errorf("expected the SAS token to be kept, got %s", r.URL.RawQuery)
+		}
+		if r.URL.Query().Get("comp") == "appendblock" {
+			body, _ := io.ReadAll(r.Body)
+			appended += string(body)
+		} else if len(requests) > 1 {
+			w.WriteHeader(http.StatusConflict)
+			return
+		}
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer server.Close()
+
+	b := &appendBlobWriter{container: server.URL + "/audit?sv=2022&sig=s1", client: server.Client()}
+	day := time.Date(2025, 6, 1, 12, 0, 0, 0, time.UTC)
+	for _, batch := range [][]OperationAuditEntry{
+		{{Time: day, Operation: "PUT"}, {Time: day, Operation: "DELETE"}},
+		{{Time: day, Operation: "PATCH"}},
+		{{Time: day.Add(24 * time.Hour), Operation: "PUT"}},
+	} {
+		if err := b.write(batch); err != nil {
+			t.Fatalf("write: %v", err)
+		}
+	}
+
+	want := []string{
+		"PUT /audit/2025/06/01.jsonl  AppendBlob",
+		"PUT /audit/2025/06/01.jsonl appendblock ",
+		"PUT /audit/2025/06/01.jsonl appendblock ",
+		"PUT /audit/2025/06/02.jsonl  AppendBlob",
+		"PUT /audit/2025/06/02.jsonl appendblock ",
+	}
+	if strings.Join(requests, "\n") != strings.Join(want, "\n") {
+		t.Errorf("unexpected requests:\n%s", strings.Join(requests, "\n"))
+	}
+	if lines := strings.Count(appended, "\n"); lines != 4 {
+		t.Errorf("expected 4 appended JSON lines, got %d: %s", lines, appended)
+	}
+}
+
+func TestLogAnalyticsWriter(t *testing.T) {
+	key := base64.StdEncoding.EncodeToString([]byte("workspace-key"))
+	var got []OperationAuditEntry
+	var l *logAnalyticsWriter
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		signature, _ := l.signature(r.Header.Get("x-ms-date"), len(body))
+		if r.Header.Get("Authorization") != "SharedKey ws1:"+signature || r.Header.Get("Log-Type") != "CyberArkProviderAudit" || r.Header.Get("time-generated-field") != "time" {
+			t.Errorf("unexpected headers %v", r.Header)
+		}
+		json.Unmarshal(body, &got)
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	l = &logAnalyticsWriter{endpoint: server.URL + "/api/logs?api-version=2016-04-01", workspace: "ws1", key: key, logType: "CyberArkProviderAudit", client: server.Client()}
+	if err := l.write([]OperationAuditEntry{{Operation: "DELETE", ResourceID: "/subscriptions/sub1/x"}}); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	if len(got) != 1 || got[0].Operation != "DELETE" {
+		t.Errorf("unexpected entries %+v", got)
+	}
+
+	l.key = "not base64!"
+	if err := l.write([]OperationAuditEntry{{Operation: "DELETE"}}); err == nil {
+		t.Error("expected an invalid key to fail")
+	}
+}
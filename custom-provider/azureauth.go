@@ -0,0 +1,110 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// managedIdentityToken is an access token issued to the container's managed identity
+type managedIdentityToken struct {
+	AccessToken string `json:"access_token"`
+	ExpiresOn   string `json:"expires_on"`
+	expires     time.Time
+}
+
+var (
+	miTokenMu    sync.Mutex
+	miTokenCache = map[string]managedIdentityToken{}
+)
+
+func init() {
+	registerFlusher("managedIdentityTokens", flushManagedIdentityTokens)
+}
+
+// flushManagedIdentityTokens drops the cached managed identity tokens, so the next call asks for new ones
+func flushManagedIdentityTokens() int {
+	miTokenMu.Lock()
+	defer miTokenMu.Unlock()
+	n := len(miTokenCache)
+	miTokenCache = map[string]managedIdentityToken{}
+	return n
+}
+
+// getManagedIdentityToken returns an access token for the given resource (e.g. https://management.azure.com/)
+// Container Apps exposes IDENTITY_ENDPOINT/IDENTITY_HEADER; otherwise fall back to the VM instance metadata service.
+// Set AZURE_CLIENT_ID to select a user-assigned identity.
+func getManagedIdentityToken(resource string) (string, error) {
+	miTokenMu.Lock()
+	defer miTokenMu.Unlock()
+
+	if tok, ok := miTokenCache[resource]; ok && time.Until(tok.expires) > 5*time.Minute {
+		return tok.AccessToken, nil
+	}
+
+	q := url.Values{}
+	q.Set("resource", resource)
+	if clientID := os.Getenv("AZURE_CLIENT_ID"); clientID != "" {
+		q.Set("client_id", clientID)
+	}
+
+	var req *http.Request
+	var err error
+	if endpoint := os.Getenv("IDENTITY_ENDPOINT"); endpoint != "" {
+		q.Set("api-version", "2019-08-01")
+		req, err = http.NewRequest(http.MethodGet, endpoint+"?"+q.Encode(), nil)
+		if err != nil {
+			return "", err
+		}
+		req.Header.Set("X-IDENTITY-HEADER", os.Getenv("IDENTITY_HEADER"))
+	} else {
+		q.Set("api-version", "2018-02-01")
+		req, err = http.NewRequest(http.MethodGet, "http://169.254.169.254/metadata/identity/oauth2/token?"+q.Encode(), nil)
+		if err != nil {
+			return "", err
+		}
+		req.Header.Set("Metadata", "true")
+	}
+
+	client := newDirectClient(10 * time.Second)
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("managed identity token request failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return "", fmt.Errorf("failed to read managed identity token response: %w", err)
+	}
+	if resp.StatusCode >= 300 {
+		return "", fmt.Errorf("managed identity token request returned status %d: %s", resp.StatusCode, string(body))
+	}
+
+	var tok managedIdentityToken
+	if err := json.Unmarshal(body, &tok); err != nil {
+		return "", fmt.Errorf("failed to parse managed identity token response: %w", err)
+	}
+	tok.expires = time.Now().Add(time.Hour)
+	if secs, err := strconv.ParseInt(tok.ExpiresOn, 10, 64); err == nil {
+		tok.expires = time.Unix(secs, 0)
+	}
+	miTokenCache[resource] = tok
+
+	log.Printf("DEBUG: Acquired managed identity token for %s, expires %s", resource, tok.expires.Format(time.RFC3339))
+	return tok.AccessToken, nil
+}
+
+// forgetManagedIdentityToken drops the cached token for a resource after the resource rejected it
+func forgetManagedIdentityToken(resource string) {
+	miTokenMu.Lock()
+	defer miTokenMu.Unlock()
+	delete(miTokenCache, resource)
+}
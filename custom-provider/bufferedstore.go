@@ -0,0 +1,271 @@
+package main
+
+import (
+	"log"
+	"sort"
+	"sync"
+	"time"
+)
+
+// When the state store cannot be reached the provider keeps serving ARM instead of failing every
+// request: reads fall back to PCloud (callers treat a Get error like a missing record), writes are
+// queued in memory and replayed once the store answers again, and resource properties carry
+// degradedMode so templates and operators can see that the provider's records are behind.
+
+// pendingStateWrite is a queued Put (record set) or Delete (record nil)
+type pendingStateWrite struct {
+	resourceID string
+	record     *ResourceRecord
+	queuedAt   time.Time
+}
+
+// bufferedStateStore wraps a StateStore and queues writes while it is unavailable
+type bufferedStateStore struct {
+	inner StateStore
+
+	mu            sync.Mutex
+	pending       map[string]pendingStateWrite
+	degradedSince time.Time
+	// writing holds a lock per resource while it is written to the wrapped store, so a replayed
+	// write cannot land after a newer live one
+	writing map[string]*stateKeyLock
+}
+
+// stateKeyLock serializes the writes for one resource; refs counts the writers holding or waiting for it
+type stateKeyLock struct {
+	sync.Mutex
+	refs int
+}
+
+// newBufferedStateStore wraps inner; with a positive interval queued writes are retried in the background
+func newBufferedStateStore(inner StateStore, interval time.Duration) *bufferedStateStore {
+	s := &bufferedStateStore{inner: inner, pending: map[string]pendingStateWrite{}, writing: map[string]*stateKeyLock{}}
+	registerDependency("stateStore", s.healthDetails)
+	registerShutdownHook("stateStore", s.flush)
+	if interval > 0 {
+		go func() {
+			for range time.Tick(interval) {
+				s.flush()
+			}
+		}()
+	}
+	return s
+}
+
+// stateStoreRetryInterval is read from STATE_STORE_RETRY_INTERVAL (Go duration, default 30s)
+func stateStoreRetryInterval() time.Duration {
+	interval, err := time.ParseDuration(getEnvOrDefault("STATE_STORE_RETRY_INTERVAL", "30s"))
+	if err != nil {
+		log.Printf("WARNING: Invalid STATE_STORE_RETRY_INTERVAL, using 30s: %v", err)
+		return 30 * time.Second
+	}
+	return interval
+}
+
+func (s *bufferedStateStore) Name() string {
+	return s.inner.Name()
+}
+
+// result records the outcome of a call to the wrapped store; the store stays degraded until
+// a call succeeds with nothing left in the queue
+func (s *bufferedStateStore) result(err error) {
+	recordDependencyResult("stateStore", err)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	switch {
+	case err != nil && s.degradedSince.IsZero():
+		log.Printf("WARNING: State store %s unavailable, entering degraded mode: %v", s.inner.Name(), err)
+		s.degradedSince = time.Now().UTC()
+	case err == nil && len(s.pending) == 0 && !s.degradedSince.IsZero():
+		log.Printf("INFO: State store %s available again after %s", s.inner.Name(), time.Since(s.degradedSince).Round(time.Second))
+		s.degradedSince = time.Time{}
+	}
+}
+
+// lockKey takes the write lock of a resource and returns the function that releases it
+func (s *bufferedStateStore) lockKey(key string) func() {
+	s.mu.Lock()
+	lock, ok := s.writing[key]
+	if !ok {
+		lock = &stateKeyLock{}
+		s.writing[key] = lock
+	}
+	lock.refs++
+	s.mu.Unlock()
+
+	lock.Lock()
+	return func() {
+		lock.Unlock()
+		s.mu.Lock()
+		if lock.refs--; lock.refs == 0 {
+			delete(s.writing, key)
+		}
+		s.mu.Unlock()
+	}
+}
+
+func (s *bufferedStateStore) queue(resourceID string, rec *ResourceRecord) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.pending[stateKey(resourceID)] = pendingStateWrite{resourceID: resourceID, record: rec, queuedAt: time.Now().UTC()}
+	log.Printf("WARNING: Queued state store write for %s (%d pending)", resourceID, len(s.pending))
+}
+
+func (s *bufferedStateStore) Put(rec ResourceRecord) error {
+	unlock := s.lockKey(stateKey(rec.ResourceID))
+	defer unlock()
+	err := s.inner.Put(rec)
+	if err != nil {
+		s.queue(rec.ResourceID, &rec)
+	} else {
+		s.mu.Lock()
+		delete(s.pending, stateKey(rec.ResourceID))
+		s.mu.Unlock()
+	}
+	s.result(err)
+	return nil
+}
+
+func (s *bufferedStateStore) Delete(resourceID string) error {
+	unlock := s.lockKey(stateKey(resourceID))
+	defer unlock()
+	err := s.inner.Delete(resourceID)
+	if err != nil {
+		s.queue(resourceID, nil)
+	} else {
+		s.mu.Lock()
+		delete(s.pending, stateKey(resourceID))
+		s.mu.Unlock()
+	}
+	s.result(err)
+	return nil
+}
+
+// Get answers from the queue first, since queued writes are newer than what the store holds
+func (s *bufferedStateStore) Get(resourceID string) (ResourceRecord, bool, error) {
+	s.mu.Lock()
+	write, queued := s.pending[stateKey(resourceID)]
+	s.mu.Unlock()
+	if queued {
+		if write.record == nil {
+			return ResourceRecord{}, false, nil
+		}
+		return *write.record, true, nil
+	}
+
+	rec, found, err := s.inner.Get(resourceID)
+	s.result(err)
+	return rec, found, err
+}
+
+func (s *bufferedStateStore) List() ([]ResourceRecord, error) {
+	recs, err := s.inner.List()
+	s.result(err)
+	if err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.pending) == 0 {
+		return recs, nil
+	}
+	merged := make([]ResourceRecord, 0, len(recs)+len(s.pending))
+	for _, rec := range recs {
+		if _, queued := s.pending[stateKey(rec.ResourceID)]; !queued {
+			merged = append(merged, rec)
+		}
+	}
+	for _, write := range s.pending {
+		if write.record != nil {
+			merged = append(merged, *write.record)
+		}
+	}
+	sort.Slice(merged, func(i, j int) bool { return merged[i].ResourceID < merged[j].ResourceID })
+	return merged, nil
+}
+
+// flush replays queued writes in the order they were queued, stopping at the first failure. Each
+// write is replayed under the resource's write lock and only if it is still queued, so a live
+// write that got through in the meantime is not overwritten.
+func (s *bufferedStateStore) flush() {
+	s.mu.Lock()
+	keys := make([]string, 0, len(s.pending))
+	for key := range s.pending {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool { return s.pending[keys[i]].queuedAt.Before(s.pending[keys[j]].queuedAt) })
+	s.mu.Unlock()
+	if len(keys) == 0 {
+		return
+	}
+
+	for _, key := range keys {
+		replayed, err := s.replay(key)
+		if err != nil {
+			s.result(err)
+			return
+		}
+		if replayed != "" {
+			log.Printf("INFO: Replayed queued state store write for %s", replayed)
+		}
+	}
+	s.result(nil)
+}
+
+// replay writes the queued write of a resource, if there still is one, and returns its resource ID
+func (s *bufferedStateStore) replay(key string) (string, error) {
+	unlock := s.lockKey(key)
+	defer unlock()
+	s.mu.Lock()
+	write, ok := s.pending[key]
+	s.mu.Unlock()
+	if !ok {
+		return "", nil
+	}
+
+	var err error
+	if write.record != nil {
+		err = s.inner.Put(*write.record)
+	} else {
+		err = s.inner.Delete(write.resourceID)
+	}
+	if err != nil {
+		return "", err
+	}
+
+	s.mu.Lock()
+	delete(s.pending, key)
+	s.mu.Unlock()
+	return write.resourceID, nil
+}
+
+// degraded reports whether the wrapped store is currently failing or has writes waiting
+func (s *bufferedStateStore) degraded() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return !s.degradedSince.IsZero() || len(s.pending) > 0
+}
+
+func (s *bufferedStateStore) healthDetails() map[string]interface{} {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	details := map[string]interface{}{
+		"store":         s.inner.Name(),
+		"degraded":      !s.degradedSince.IsZero() || len(s.pending) > 0,
+		"pendingWrites": len(s.pending),
+	}
+	if !s.degradedSince.IsZero() {
+		details["degradedSince"] = s.degradedSince.Format(time.RFC3339)
+	}
+	return details
+}
+
+// degradedMode is the degradedMode resource property: empty normally, "stateStoreUnavailable"
+// while resource records cannot be written
+func degradedMode() string {
+	if store, ok := stateStore.(*bufferedStateStore); ok && store.degraded() {
+		return "stateStoreUnavailable"
+	}
+	return ""
+}
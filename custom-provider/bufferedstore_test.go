@@ -0,0 +1,133 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+// flakyStateStore is a memory store that fails every call while down is set
+type flakyStateStore struct {
+	*memoryStateStore
+	down bool
+}
+
+var errStoreDown = errors.New("store unreachable")
+
+func (s *flakyStateStore) Put(rec ResourceRecord) error {
+	if s.down {
+		return errStoreDown
+	}
+	return s.memoryStateStore.Put(rec)
+}
+
+func (s *flakyStateStore) Get(resourceID string) (ResourceRecord, bool, error) {
+	if s.down {
+		return ResourceRecord{}, false, errStoreDown
+	}
+	return s.memoryStateStore.Get(resourceID)
+}
+
+func (s *flakyStateStore) Delete(resourceID string) error {
+	if s.down {
+		return errStoreDown
+	}
+	return s.memoryStateStore.Delete(resourceID)
+}
+
+func TestBufferedStateStore(t *testing.T) {
+	inner := &flakyStateStore{memoryStateStore: newMemoryStateStore()}
+	store := newBufferedStateStore(inner, 0)
+
+	if err := store.Put(ResourceRecord{ResourceID: "/safes/kept", SafeName: "kept"}); err != nil {
+		t.Fatal(err)
+	}
+
+	inner.down = true
+	if err := store.Put(ResourceRecord{ResourceID: "/safes/new", SafeName: "new"}); err != nil {
+		t.Fatalf("Put while down should queue, got %v", err)
+	}
+	if err := store.Delete("/safes/kept"); err != nil {
+		t.Fatalf("Delete while down should queue, got %v", err)
+	}
+	if !store.degraded() {
+		t.Fatal("expected degraded mode while the store is down")
+	}
+	if rec, found, err := store.Get("/SAFES/NEW"); err != nil || !found || rec.SafeName != "new" {
+		t.Errorf("expected the queued record, got %+v %t %v", rec, found, err)
+	}
+	if _, found, err := store.Get("/safes/kept"); err != nil || found {
+		t.Errorf("expected the queued delete to hide the record, got %t %v", found, err)
+	}
+	if _, _, err := store.Get("/safes/other"); err == nil {
+		t.Error("expected an error for a record that is not queued")
+	}
+
+	store.flush()
+	if !store.degraded() {
+		t.Fatal("flush while down must keep the queue")
+	}
+
+	inner.down = false
+	store.flush()
+	if store.degraded() {
+		t.Fatal("expected degraded mode to end once the queue is replayed")
+	}
+	recs, _ := inner.List()
+	if len(recs) != 1 || recs[0].SafeName != "new" {
+		t.Errorf("expected only the new record in the store, got %+v", recs)
+	}
+}
+
+// gatedStateStore holds a Put of the record named gated until release is closed
+type gatedStateStore struct {
+	*memoryStateStore
+	gated   string
+	entered chan struct{}
+	release chan struct{}
+}
+
+func (s *gatedStateStore) Put(rec ResourceRecord) error {
+	if rec.SafeName == s.gated {
+		close(s.entered)
+		<-s.release
+	}
+	return s.memoryStateStore.Put(rec)
+}
+
+func TestBufferedStateStoreReplayBeforeLiveWrite(t *testing.T) {
+	flaky := &flakyStateStore{memoryStateStore: newMemoryStateStore(), down: true}
+	store := newBufferedStateStore(flaky, 0)
+	store.Put(ResourceRecord{ResourceID: "/safes/a", SafeName: "old"})
+
+	// The store is back; the replay of the old record is in flight when a live write arrives
+	gated := &gatedStateStore{memoryStateStore: flaky.memoryStateStore, gated: "old", entered: make(chan struct{}), release: make(chan struct{})}
+	store.inner = gated
+	flushed := make(chan struct{})
+	go func() {
+		store.flush()
+		close(flushed)
+	}()
+	<-gated.entered
+
+	written := make(chan struct{})
+	go func() {
+		store.Put(ResourceRecord{ResourceID: "/safes/a", SafeName: "new"})
+		close(written)
+	}()
+	select {
+	case <-written:
+		t.Fatal("expected the live write to wait for the replay of the same resource")
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(gated.release)
+	<-flushed
+	<-written
+
+	if rec, found, _ := gated.Get("/safes/a"); !found || rec.SafeName != "new" {
+		t.Errorf("expected the live write to win, got %+v", rec)
+	}
+	if store.degraded() {
+		t.Error("expected nothing left in the queue")
+	}
+}
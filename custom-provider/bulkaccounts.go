@@ -0,0 +1,162 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/davidh-cyberark/privilegeaccessmanager-sdk-go/pam"
+)
+
+// bulkAddMaxAccounts bounds one bulkAddAccounts request, so it finishes well within ARM's timeout
+const bulkAddMaxAccounts = 200
+
+// BulkAddAccountsRequest is the body of the bulkAddAccounts action
+type BulkAddAccountsRequest struct {
+	Accounts []pam.PostAddAccountRequest `json:"accounts"`
+	// MaxParallelism lowers the number of accounts added at once below BULK_ADD_CONCURRENCY
+	MaxParallelism int `json:"maxParallelism,omitempty"`
+}
+
+// BulkAccountResult is the outcome for one account of a bulkAddAccounts request
+type BulkAccountResult struct {
+	Index    int    `json:"index"`
+	SafeName string `json:"safeName"`
+	Name     string `json:"name"`
+	// Status is Created, Exists (an account with the same name, platform, address and user name
+	// was already there) or Failed
+	Status     string        `json:"status"`
+	StatusCode int           `json:"statusCode"`
+	ID         string        `json:"id,omitempty"`
+	Error      *ErrorDetails `json:"error,omitempty"`
+}
+
+// bulkAddConcurrency is how many accounts one bulkAddAccounts request adds at once
+// (BULK_ADD_CONCURRENCY, default 4); PCloud calls stay under the shared PCloud limits
+func bulkAddConcurrency() int {
+	n, err := strconv.Atoi(getEnvOrDefault("BULK_ADD_CONCURRENCY", "4"))
+	if err != nil || n < 1 {
+		return 4
+	}
+	return n
+}
+
+// handleBulkAddAccounts adds many accounts in one request, a few at a time. Each account is checked
+// and added as an accounts PUT would be, but no accounts resource is recorded for it. The response
+// is 200 with one result per account, in request order, even when some failed.
+func handleBulkAddAccounts(w http.ResponseWriter, r *http.Request, cpRequest CustomProviderRequestPath) {
+	LogRequestDebug("BulkAddAccounts", r)
+
+	var request BulkAddAccountsRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		sendJSONError(w, http.StatusBadRequest, "InvalidRequestBody", fmt.Sprintf("Invalid request body: %v", err))
+		return
+	}
+	if len(request.Accounts) == 0 {
+		sendJSONError(w, http.StatusBadRequest, "InvalidRequestBody", "accounts is required")
+		return
+	}
+	if len(request.Accounts) > bulkAddMaxAccounts {
+		sendJSONError(w, http.StatusBadRequest, "TooManyAccounts",
+			fmt.Sprintf("At most %d accounts can be added in one request, got %d", bulkAddMaxAccounts, len(request.Accounts)))
+		return
+	}
+
+	parallelism := bulkAddConcurrency()
+	if request.MaxParallelism > 0 && request.MaxParallelism < parallelism {
+		parallelism = request.MaxParallelism
+	}
+
+	results := make([]BulkAccountResult, len(request.Accounts))
+	slots := make(chan struct{}, parallelism)
+	var wg sync.WaitGroup
+	for i, account := range request.Accounts {
+		wg.Add(1)
+		slots <- struct{}{}
+		go func(i int, account pam.PostAddAccountRequest) {
+			defer func() { <-slots; wg.Done() }()
+			results[i] = bulkAddAccount(w, r, cpRequest, account)
+			results[i].Index = i
+		}(i, account)
+	}
+	wg.Wait()
+
+	summary := map[string]int{"Created": 0, "Exists": 0, "Failed": 0}
+	for _, result := range results {
+		summary[result.Status]++
+	}
+	log.Printf("INFO: (BulkAddAccounts) %d accounts: %d created, %d existing, %d failed",
+		len(results), summary["Created"], summary["Exists"], summary["Failed"])
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"results":  results,
+		"created":  summary["Created"],
+		"existing": summary["Exists"],
+		"failed":   summary["Failed"],
+	})
+}
+
+// bulkAddAccount adds one account of a bulkAddAccounts request
+func bulkAddAccount(w http.ResponseWriter, r *http.Request, cpRequest CustomProviderRequestPath, account pam.PostAddAccountRequest) BulkAccountResult {
+	result := BulkAccountResult{SafeName: account.SafeName, Name: account.Name}
+	fail := func(status int, detail ErrorDetails) BulkAccountResult {
+		status, detail = armError(status, detail)
+		result.Status, result.StatusCode, result.Error = "Failed", status, &detail
+		return result
+	}
+
+	details := validateRequest(AccountRequest{Properties: AccountProperties{PostAddAccountRequest: account}})
+	if account.Name == "" {
+		details = append(details, ErrorDetails{Code: "PropertyRequired", Target: "properties.name", Message: "name is required for bulk added accounts"})
+	}
+	if len(details) > 0 {
+		return fail(http.StatusBadRequest, ErrorDetails{Code: "InvalidRequestContent", Message: "The account is invalid", Details: details})
+	}
+
+	accounts, err := GetAccounts(w, r, account.SafeName)
+	if err != nil {
+		return fail(http.StatusConflict, ErrorDetails{Code: "GetAccountsError", Message: err.Error()})
+	}
+	existing, err := FindAccount(accounts, account.Name)
+	if err != nil && !errors.Is(err, errAccountNotFound) {
+		return fail(http.StatusConflict, ErrorDetails{Code: "GetAccountsError", Message: err.Error()})
+	}
+	if existing != nil {
+		for _, field := range []struct{ name, requested, actual string }{
+			{"platformId", account.PlatformID, existing.PlatformID},
+			{"address", account.Address, existing.Address},
+			{"userName", account.UserName, existing.UserName},
+		} {
+			if field.requested != "" && !strings.EqualFold(field.requested, field.actual) {
+				return fail(http.StatusConflict, ErrorDetails{Code: "AccountAlreadyExists", Target: "properties." + field.name,
+					Message: fmt.Sprintf("Account %s already exists in safe %s with %s %q", existing.Name, existing.SafeName, field.name, field.actual)})
+			}
+		}
+		result.Status, result.StatusCode, result.ID = "Exists", http.StatusOK, existing.ID
+		return result
+	}
+	if details := validatePlatformProperties(r, account); len(details) > 0 {
+		return fail(http.StatusBadRequest, ErrorDetails{Code: "InvalidRequestContent", Message: "The account is invalid", Details: details})
+	}
+	if _, details, _ := prepareAccountKey(&AccountProperties{PostAddAccountRequest: account}); len(details) > 0 {
+		return fail(http.StatusBadRequest, ErrorDetails{Code: "InvalidRequestContent", Message: "The account is invalid", Details: details})
+	}
+
+	acctRequest := cpRequest
+	acctRequest.ResourceTypeName = "accounts"
+	acctRequest.ResourceInstanceName = fmt.Sprintf("%s.%s", account.SafeName, account.Name)
+	added, err := AddAccount(w, r, acctRequest, AccountRequest{Properties: AccountProperties{PostAddAccountRequest: account}})
+	if err != nil {
+		return fail(http.StatusConflict, ErrorDetails{Code: "AddAccountError", Message: err.Error()})
+	}
+	accountIndex.Put(added.Response.SafeName, added.Response.Name, added.Response.ID)
+	result.Status, result.StatusCode, result.ID = "Created", http.StatusCreated, added.Response.ID
+	return result
+}
@@ -0,0 +1,251 @@
+package main
+
+import (
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// ARM reaches the provider over its public endpoint, so custom provider requests (and the async
+// operation endpoints they lead to) are only served to callers that present CALLER_AUTH_TOKEN, a
+// client certificate listed in CALLER_CERT_THUMBPRINTS / CALLER_CERT_SUBJECTS, or an Entra ID
+// access token accepted by entraValidator (see entraauth.go). The token is read from the
+// X-Provider-Token header or the "code" query parameter, which is how it is put into the custom
+// provider's endpoint definition. Client certificates are read from the TLS connection or, behind
+// Container Apps ingress with client certificates enabled, from X-Forwarded-Client-Cert. With none
+// of them configured every caller is accepted, as before.
+
+// callerTokenHeader carries the pre-shared caller token
+const callerTokenHeader = "X-Provider-Token"
+
+// callerAuthFailuresTotal counts rejected (or, in report-only mode, flagged) callers by reason
+var callerAuthFailuresTotal = newCounter("provider_caller_auth_failures_total", "Custom provider requests without valid caller credentials, by reason")
+
+// callerAuthConfig is the accepted caller credentials
+type callerAuthConfig struct {
+	token       string
+	thumbprints map[string]bool
+	subjects    map[string]bool
+	// roots verifies certificates accepted by subject; nil uses the system roots
+	roots *x509.CertPool
+	// entra validates Entra ID bearer tokens; nil when ENTRA_TENANT_ID is unset
+	entra *entraValidator
+	// trustXFCC accepts certificates from X-Forwarded-Client-Cert, which only a trusted ingress may set
+	trustXFCC bool
+}
+
+var callerAuth = loadCallerAuthConfig()
+
+func loadCallerAuthConfig() *callerAuthConfig {
+	c := &callerAuthConfig{token: os.Getenv("CALLER_AUTH_TOKEN"), thumbprints: map[string]bool{}, subjects: map[string]bool{}}
+	for _, thumbprint := range strings.Split(os.Getenv("CALLER_CERT_THUMBPRINTS"), ",") {
+		thumbprint = normalizeThumbprint(thumbprint)
+		if thumbprint == "" {
+			continue
+		}
+		if len(thumbprint) != 2*sha1.Size && len(thumbprint) != 2*sha256.Size {
+			log.Printf("WARNING: Ignoring CALLER_CERT_THUMBPRINTS entry %q, expected a SHA-1 or SHA-256 hex thumbprint", thumbprint)
+			continue
+		}
+		c.thumbprints[thumbprint] = true
+	}
+	for _, subject := range strings.Split(os.Getenv("CALLER_CERT_SUBJECTS"), ",") {
+		if subject = strings.TrimSpace(subject); subject != "" {
+			c.subjects[strings.ToLower(subject)] = true
+		}
+	}
+	c.entra = loadEntraValidator()
+	c.trustXFCC = strings.EqualFold(os.Getenv("CALLER_CERT_TRUST_XFCC"), "true")
+	return c
+}
+
+func init() {
+	if callerAuth.entra != nil {
+		registerDependency("entraId", callerAuth.entra.healthDetails)
+		registerFlusher("entraKeys", callerAuth.entra.Flush)
+	}
+}
+
+func normalizeThumbprint(thumbprint string) string {
+	return strings.ToLower(strings.NewReplacer(":", "", " ", "").Replace(strings.TrimSpace(thumbprint)))
+}
+
+// enabled reports whether callers have to authenticate
+func (c *callerAuthConfig) enabled() bool {
+	return c.token != "" || len(c.thumbprints) > 0 || len(c.subjects) > 0 || c.entra != nil
+}
+
+// describe lists the configured methods for the startup fingerprint, without the credentials
+func (c *callerAuthConfig) describe() map[string]interface{} {
+	entraTenant := ""
+	if c.entra != nil {
+		entraTenant = c.entra.tenantID
+	}
+	return map[string]interface{}{
+		"token":       redactSecret(c.token),
+		"thumbprints": len(c.thumbprints),
+		"subjects":    len(c.subjects),
+		"trustXFCC":   c.trustXFCC,
+		"entraTenant": entraTenant,
+		"reportOnly":  featureEnabled("callerAuthReportOnly"),
+	}
+}
+
+// authenticate returns how the caller authenticated, or why it could not
+func (c *callerAuthConfig) authenticate(r *http.Request) (string, error) {
+	if c.token != "" {
+		token := r.Header.Get(callerTokenHeader)
+		if token == "" {
+			token = r.URL.Query().Get("code")
+		}
+		if token != "" {
+			if subtle.ConstantTimeCompare([]byte(token), []byte(c.token)) == 1 {
+				return "token", nil
+			}
+			return "", fmt.Errorf("invalidToken")
+		}
+	}
+	if bearer, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok && c.entra != nil {
+		claims, err := c.entra.validate(strings.TrimSpace(bearer))
+		if err != nil {
+			return "", fmt.Errorf("invalidBearerToken: %w", err)
+		}
+		return "Entra ID token of application " + claims.clientID(), nil
+	}
+	if len(c.thumbprints) == 0 && len(c.subjects) == 0 {
+		return "", fmt.Errorf("missingCredentials")
+	}
+
+	cert, intermediates, err := clientCertificate(r, c.trustXFCC)
+	if err != nil {
+		return "", fmt.Errorf("invalidCertificate: %w", err)
+	}
+	if cert == nil {
+		return "", fmt.Errorf("missingCredentials")
+	}
+	sha1Sum, sha256Sum := sha1.Sum(cert.Raw), sha256.Sum256(cert.Raw)
+	if c.thumbprints[hex.EncodeToString(sha1Sum[:])] || c.thumbprints[hex.EncodeToString(sha256Sum[:])] {
+		return "certificateThumbprint", nil
+	}
+	if c.subjects[strings.ToLower(cert.Subject.CommonName)] {
+		pool := x509.NewCertPool()
+		for _, intermediate := range intermediates {
+			pool.AddCert(intermediate)
+		}
+		_, err := cert.Verify(x509.VerifyOptions{Roots: c.roots, Intermediates: pool, KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}})
+		if err != nil {
+			return "", fmt.Errorf("untrustedCertificate: %w", err)
+		}
+		return "certificateSubject", nil
+	}
+	return "", fmt.Errorf("unknownCertificate: %s", cert.Subject.CommonName)
+}
+
+// clientCertificate returns the caller's certificate and the intermediates it sent, from the TLS
+// connection or, with trustXFCC, the X-Forwarded-Client-Cert header set by the ingress; nil when
+// there is none. The header carries only the public certificate, not proof of its private key, so
+// it is never read from a connection the provider terminated itself, where no ingress replaced it.
+func clientCertificate(r *http.Request, trustXFCC bool) (*x509.Certificate, []*x509.Certificate, error) {
+	if r.TLS != nil {
+		if len(r.TLS.PeerCertificates) > 0 {
+			return r.TLS.PeerCertificates[0], r.TLS.PeerCertificates[1:], nil
+		}
+		return nil, nil, nil
+	}
+	xfcc := r.Header.Get("X-Forwarded-Client-Cert")
+	if xfcc == "" || !trustXFCC {
+		return nil, nil, nil
+	}
+	// Only the element added by the ingress, the last one, is used
+	elements := strings.Split(xfcc, ",")
+	var cert *x509.Certificate
+	var chain []*x509.Certificate
+	for _, field := range strings.Split(elements[len(elements)-1], ";") {
+		key, value, _ := strings.Cut(field, "=")
+		if !strings.EqualFold(key, "Cert") && !strings.EqualFold(key, "Chain") {
+			continue
+		}
+		decoded, err := url.QueryUnescape(strings.Trim(value, `"`))
+		if err != nil {
+			return nil, nil, err
+		}
+		certs, err := parsePEMCertificates([]byte(decoded))
+		if err != nil {
+			return nil, nil, err
+		}
+		if strings.EqualFold(key, "Cert") && len(certs) > 0 {
+			cert = certs[0]
+		} else {
+			chain = certs
+		}
+	}
+	if cert == nil && len(chain) > 0 {
+		cert, chain = chain[0], chain[1:]
+	} else if len(chain) > 0 && chain[0].Equal(cert) {
+		chain = chain[1:]
+	}
+	return cert, chain, nil
+}
+
+func parsePEMCertificates(data []byte) ([]*x509.Certificate, error) {
+	var certs []*x509.Certificate
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			return certs, nil
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		certs = append(certs, cert)
+	}
+}
+
+// callerAuthRequired reports whether the request is custom provider traffic: the provider root
+// ARM sends resource and action requests to, the same requests at their full /subscriptions/...
+// path, and the async operation endpoints
+func callerAuthRequired(r *http.Request) bool {
+	return r.URL.Path == "/" || strings.HasPrefix(strings.ToLower(r.URL.Path), "/subscriptions/") || strings.HasPrefix(r.URL.Path, "/operations/")
+}
+
+// callerAuthMiddleware rejects custom provider requests without valid caller credentials with 401.
+// With the callerAuthReportOnly feature flag they are logged and counted but still served, so the
+// credentials can be rolled out to the custom provider definition first.
+func callerAuthMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !callerAuth.enabled() || !callerAuthRequired(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		method, err := callerAuth.authenticate(r)
+		if err == nil {
+			log.Printf("DEBUG: [op=%s] Caller authenticated by %s", operationID(r), method)
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		reason, _, _ := strings.Cut(err.Error(), ":")
+		callerAuthFailuresTotal.Inc("reason", reason)
+		if featureEnabled("callerAuthReportOnly") {
+			log.Printf("WARNING: [op=%s] Caller not authenticated (%v), serving it in report-only mode - Method: %s, URL: %s, RemoteAddr: %s", operationID(r), err, r.Method, r.URL.Path, r.RemoteAddr)
+			next.ServeHTTP(w, r)
+			return
+		}
+		log.Printf("WARNING: [op=%s] Rejected unauthenticated caller (%v) - Method: %s, URL: %s, RemoteAddr: %s", operationID(r), err, r.Method, r.URL.Path, r.RemoteAddr)
+		sendJSONError(w, http.StatusUnauthorized, "Unauthorized", "Caller credentials are missing or invalid")
+	})
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+// newTestCertificate issues a client certificate for cn, signed by parent (self-signed when nil)
+func newTestCertificate(t *testing.T, cn string, isCA bool, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: cn},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  isCA,
+	}
+	if isCA {
+		template.KeyUsage |= x509.KeyUsageCertSign
+	}
+	if parent == nil {
+		parent, parentKey = template, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert, key
+}
+
+func TestCallerAuthMiddleware(t *testing.T) {
+	ca, caKey := newTestCertificate(t, "Test CA", true, nil, nil)
+	trusted, _ := newTestCertificate(t, "arm-caller", false, ca, caKey)
+	untrusted, _ := newTestCertificate(t, "arm-caller", false, nil, nil)
+	pinned, _ := newTestCertificate(t, "pinned", false, nil, nil)
+	pinnedSum := sha256.Sum256(pinned.Raw)
+
+	xfcc := func(cert *x509.Certificate) string {
+		return `Hash=abc;Cert="` + url.QueryEscape(string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw}))) + `"`
+	}
+
+	handler := callerAuthMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	tests := []struct {
+		name           string
+		env            map[string]string
+		path           string
+		header         map[string]string
+		peer           *x509.Certificate
+		tlsConn        bool
+		expectedStatus int
+	}{
+		{name: "not configured", path: "/", expectedStatus: http.StatusOK},
+		{name: "token header", env: map[string]string{"CALLER_AUTH_TOKEN": "s3cret"}, path: "/", header: map[string]string{"X-Provider-Token": "s3cret"}, expectedStatus: http.StatusOK},
+		{name: "token query parameter", env: map[string]string{"CALLER_AUTH_TOKEN": "s3cret"}, path: "/?code=s3cret", expectedStatus: http.StatusOK},
+		{name: "wrong token", env: map[string]string{"CALLER_AUTH_TOKEN": "s3cret"}, path: "/", header: map[string]string{"X-Provider-Token": "nope"}, expectedStatus: http.StatusUnauthorized},
+		{name: "missing token", env: map[string]string{"CALLER_AUTH_TOKEN": "s3cret"}, path: "/", expectedStatus: http.StatusUnauthorized},
+		{name: "request path in the URL", env: map[string]string{"CALLER_AUTH_TOKEN": "s3cret"}, path: "/subscriptions/sub1/resourceGroups/rg1/providers/Microsoft.CustomProviders/resourceProviders/CyberArkProvider/safes/safe1", expectedStatus: http.StatusUnauthorized},
+		{name: "operation status", env: map[string]string{"CALLER_AUTH_TOKEN": "s3cret"}, path: "/operations/op1", expectedStatus: http.StatusUnauthorized},
+		{name: "health is not custom provider traffic", env: map[string]string{"CALLER_AUTH_TOKEN": "s3cret"}, path: "/health", expectedStatus: http.StatusOK},
+		{name: "report only", env: map[string]string{"CALLER_AUTH_TOKEN": "s3cret", "FEATURE_FLAGS": "callerAuthReportOnly"}, path: "/", expectedStatus: http.StatusOK},
+		{name: "pinned thumbprint", env: map[string]string{"CALLER_CERT_THUMBPRINTS": hex.EncodeToString(pinnedSum[:])}, path: "/", peer: pinned, expectedStatus: http.StatusOK},
+		{name: "unknown certificate", env: map[string]string{"CALLER_CERT_THUMBPRINTS": hex.EncodeToString(pinnedSum[:])}, path: "/", peer: trusted, expectedStatus: http.StatusUnauthorized},
+		{name: "no certificate", env: map[string]string{"CALLER_CERT_SUBJECTS": "arm-caller"}, path: "/", expectedStatus: http.StatusUnauthorized},
+		{name: "trusted subject from ingress", env: map[string]string{"CALLER_CERT_SUBJECTS": "arm-caller", "CALLER_CERT_TRUST_XFCC": "true"}, path: "/", header: map[string]string{"X-Forwarded-Client-Cert": xfcc(trusted)}, expectedStatus: http.StatusOK},
+		{name: "untrusted subject", env: map[string]string{"CALLER_CERT_SUBJECTS": "arm-caller", "CALLER_CERT_TRUST_XFCC": "true"}, path: "/", header: map[string]string{"X-Forwarded-Client-Cert": xfcc(untrusted)}, expectedStatus: http.StatusUnauthorized},
+		{name: "forged header without a trusted ingress", env: map[string]string{"CALLER_CERT_SUBJECTS": "arm-caller"}, path: "/", header: map[string]string{"X-Forwarded-Client-Cert": xfcc(trusted)}, expectedStatus: http.StatusUnauthorized},
+		{name: "forged pinned thumbprint", env: map[string]string{"CALLER_CERT_THUMBPRINTS": hex.EncodeToString(pinnedSum[:])}, path: "/", header: map[string]string{"X-Forwarded-Client-Cert": xfcc(pinned)}, expectedStatus: http.StatusUnauthorized},
+		{name: "forged header over TLS", env: map[string]string{"CALLER_CERT_SUBJECTS": "arm-caller", "CALLER_CERT_TRUST_XFCC": "true"}, path: "/", header: map[string]string{"X-Forwarded-Client-Cert": xfcc(trusted)}, tlsConn: true, expectedStatus: http.StatusUnauthorized},
+		{name: "certificate when the token is missing", env: map[string]string{"CALLER_AUTH_TOKEN": "s3cret", "CALLER_CERT_SUBJECTS": "arm-caller"}, path: "/", peer: trusted, expectedStatus: http.StatusOK},
+	}
+
+	saved := callerAuth
+	defer func() { callerAuth = saved }()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, name := range []string{"CALLER_AUTH_TOKEN", "CALLER_CERT_THUMBPRINTS", "CALLER_CERT_SUBJECTS", "CALLER_CERT_TRUST_XFCC", "FEATURE_FLAGS"} {
+				t.Setenv(name, tt.env[name])
+			}
+			callerAuth = loadCallerAuthConfig()
+			callerAuth.roots = x509.NewCertPool()
+			callerAuth.roots.AddCert(ca)
+
+			req := httptest.NewRequest("PUT", tt.path, nil)
+			for name, value := range tt.header {
+				req.Header.Set(name, value)
+			}
+			if tt.peer != nil {
+				req.TLS = &tls.ConnectionState{PeerCertificates: []*x509.Certificate{tt.peer}}
+			} else if tt.tlsConn {
+				req.TLS = &tls.ConnectionState{}
+			}
+			rr := httptest.NewRecorder()
+			handler.ServeHTTP(rr, req)
+
+			if rr.Code != tt.expectedStatus {
+				t.Errorf("expected status %d, got %d: %s", tt.expectedStatus, rr.Code, rr.Body.String())
+			}
+		})
+	}
+}
+
+func TestNormalizeThumbprint(t *testing.T) {
+	if got := normalizeThumbprint(" AB:cd:EF "); got != "abcdef" {
+		t.Errorf("expected abcdef, got %q", got)
+	}
+}
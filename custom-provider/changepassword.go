@@ -0,0 +1,142 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/davidh-cyberark/privilegeaccessmanager-sdk-go/pam"
+)
+
+// ChangePasswordRequest is the body of the changePassword action
+type ChangePasswordRequest struct {
+	AccountSelector
+	// Mode is cpm (default), where the CPM generates the new password, or immediate, where the
+	// provider generates it from the platform's secret policy and the CPM sets it on the target now
+	Mode string `json:"mode,omitempty"`
+	// ChangeEntireGroup also changes the other accounts in the account's group (cpm mode only)
+	ChangeEntireGroup bool `json:"changeEntireGroup,omitempty"`
+}
+
+// PasswordRotation is the account's secret management state after a changePassword request
+type PasswordRotation struct {
+	AutomaticManagementEnabled bool       `json:"automaticManagementEnabled"`
+	Status                     string     `json:"status,omitempty"`
+	LastModifiedTime           *time.Time `json:"lastModifiedTime,omitempty"`
+	LastVerifiedTime           *time.Time `json:"lastVerifiedTime,omitempty"`
+	LastReconciledTime         *time.Time `json:"lastReconciledTime,omitempty"`
+}
+
+// handleChangePassword has the CPM change an account's password on the target, either with a
+// password it generates or with one the provider generates from the platform's secret policy. The
+// new password is never returned; the response carries the account's rotation status.
+func handleChangePassword(w http.ResponseWriter, r *http.Request, cpRequest CustomProviderRequestPath) {
+	LogRequestDebug("ChangePassword", r)
+
+	var request ChangePasswordRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		sendJSONError(w, http.StatusBadRequest, "InvalidRequestBody", fmt.Sprintf("Invalid request body: %v", err))
+		return
+	}
+	if request.SafeName == "" || (request.AccountName == "" && request.AccountID == "") {
+		sendJSONError(w, http.StatusBadRequest, "InvalidRequestBody", "safeName and one of accountName or accountId are required")
+		return
+	}
+	if request.Mode == "" {
+		request.Mode = "cpm"
+	}
+	if request.Mode != "cpm" && request.Mode != "immediate" {
+		sendJSONErrorDetails(w, http.StatusBadRequest, ErrorDetails{Code: "InvalidRequestBody", Target: "mode",
+			Message: fmt.Sprintf("mode must be cpm or immediate, got %q", request.Mode)})
+		return
+	}
+
+	account, retcode, err := lookupAccount(r, request.AccountSelector)
+	if err != nil {
+		log.Printf("DEBUG: (ChangePassword) %s", err.Error())
+		if retcode == http.StatusNotFound {
+			sendJSONError(w, http.StatusNotFound, "AccountNotFound", err.Error())
+			return
+		}
+		sendJSONError(w, http.StatusConflict, "ChangePasswordError", err.Error())
+		return
+	}
+	if !account.SecretManagement.AutomaticManagementEnabled {
+		sendJSONError(w, http.StatusConflict, "AutomaticManagementDisabled",
+			fmt.Sprintf("Account %s is not managed by the CPM (%s); use regenerateSecret to store a new secret instead", account.ID, account.SecretManagement.ManualManagementReason))
+		return
+	}
+
+	path := fmt.Sprintf("/PasswordVault/API/Accounts/%s/Change/", account.ID)
+	body := map[string]interface{}{"ChangeEntireGroup": request.ChangeEntireGroup}
+	if request.Mode == "immediate" {
+		policy := secretPolicyFor(account.PlatformID)
+		if policy.SecretType != "password" {
+			sendJSONError(w, http.StatusConflict, "SecretPolicyMismatch",
+				fmt.Sprintf("The secret policy for platform %s generates a %s; immediate mode only sets passwords", account.PlatformID, policy.SecretType))
+			return
+		}
+		secret, err := generateSecret(policy)
+		if err != nil {
+			sendJSONError(w, http.StatusInternalServerError, "SecretGenerationError", err.Error())
+			return
+		}
+		path = fmt.Sprintf("/PasswordVault/API/Accounts/%s/SetNextPassword/", account.ID)
+		body = map[string]interface{}{"ChangeImmediately": true, "NewCredentials": secret.Secret}
+	}
+
+	stopAuth := startPhase(r, "auth")
+	pamClient, err := createPAMClient()
+	stopAuth()
+	if err != nil {
+		sendJSONError(w, http.StatusInternalServerError, "PAMClientError", fmt.Sprintf("Failed to create PAM client: %v", err))
+		return
+	}
+
+	stopPAM := startPhase(r, "pam")
+	retcode, err = pamDoRetry(r.Context(), pamClient, "accounts", http.MethodPost, path, body, nil)
+	stopPAM()
+	if err != nil {
+		sendJSONError(w, http.StatusConflict, "ChangePasswordError", fmt.Sprintf("Failed to schedule the password change of account %s: (%d) %v", account.ID, retcode, err))
+		return
+	}
+	log.Printf("INFO: (ChangePassword) %s change scheduled for account %s", request.Mode, account.ID)
+
+	// The CPM picks the change up asynchronously; report the state it is in now
+	rotation := passwordRotation(account.SecretManagement)
+	if current, _, err := lookupAccount(r, AccountSelector{SafeName: account.SafeName, AccountID: account.ID}); err != nil {
+		log.Printf("WARNING: (ChangePassword) Could not read the rotation status of account %s: %v", account.ID, err)
+	} else {
+		rotation = passwordRotation(current.SecretManagement)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"accountId":  account.ID,
+		"safeName":   account.SafeName,
+		"name":       account.Name,
+		"platformId": account.PlatformID,
+		"mode":       request.Mode,
+		"status":     "ChangeScheduled",
+		"rotation":   rotation,
+	})
+}
+
+func passwordRotation(sm pam.SecretManagement) PasswordRotation {
+	optional := func(t time.Time) *time.Time {
+		if t.IsZero() {
+			return nil
+		}
+		t = t.UTC()
+		return &t
+	}
+	return PasswordRotation{
+		AutomaticManagementEnabled: sm.AutomaticManagementEnabled,
+		Status:                     sm.Status,
+		LastModifiedTime:           optional(sm.LastModifiedDateTime),
+		LastVerifiedTime:           optional(sm.LastVerifiedDateTime),
+		LastReconciledTime:         optional(sm.LastReconciledDateTime),
+	}
+}
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// When the identity tenant or PCloud fails call after call, every ARM request would still wait
+// through its retries before failing, and the provider would keep adding load to a tenant that is
+// already struggling. A circuit breaker per upstream counts consecutive failures (a transport error
+// or a 5xx; other errors are the caller's problem, not the tenant's). After
+// CIRCUIT_BREAKER_THRESHOLD of them the breaker opens: requests for the resource types and actions
+// that use the upstream (see providerEntry.Upstreams) are answered with 503 and Retry-After, so ARM
+// retries later, and calls to it fail without being sent. After CIRCUIT_BREAKER_OPEN_DURATION it
+// half-opens and lets the next call through to test the upstream: a successful call closes it, a
+// failure opens it again. A threshold of 0 turns the breakers off.
+
+// circuit breaker states
+const (
+	circuitClosed   = "closed"
+	circuitOpen     = "open"
+	circuitHalfOpen = "halfOpen"
+)
+
+// circuitBreakerTripsTotal counts the times a breaker opened, by upstream
+var circuitBreakerTripsTotal = newCounter("provider_circuit_breaker_trips_total", "Times a circuit breaker opened after repeated failures, by upstream")
+
+// circuitBreakerRejectionsTotal counts requests answered with 503, and calls not sent, by an open
+// breaker, by upstream
+var circuitBreakerRejectionsTotal = newCounter("provider_circuit_breaker_rejections_total", "Requests answered with 503, and calls not sent, while a circuit breaker was open, by upstream")
+
+// circuitBreaker tracks the consecutive failures of calls to one upstream
+type circuitBreaker struct {
+	name string
+
+	mu       sync.Mutex
+	state    string
+	failures int
+	openedAt time.Time
+	// probeStarted is when the request testing a half-open breaker was let through
+	probeStarted time.Time
+	lastErr      string
+}
+
+func newCircuitBreaker(name string) *circuitBreaker {
+	return &circuitBreaker{name: name, state: circuitClosed}
+}
+
+var (
+	identityBreaker = newCircuitBreaker("identity")
+	pcloudBreaker   = newCircuitBreaker("pcloud")
+)
+
+// pcloudUpstreams are the breakers of registry entries that call PCloud, which needs a session from
+// the identity tenant
+var pcloudUpstreams = []*circuitBreaker{identityBreaker, pcloudBreaker}
+
+// circuitBreakerThreshold reads CIRCUIT_BREAKER_THRESHOLD (default 5, 0 turns the breakers off)
+func circuitBreakerThreshold() int {
+	n, err := strconv.Atoi(getEnvOrDefault("CIRCUIT_BREAKER_THRESHOLD", "5"))
+	if err != nil || n < 0 {
+		log.Printf("WARNING: Invalid CIRCUIT_BREAKER_THRESHOLD, using 5: %v", err)
+		return 5
+	}
+	return n
+}
+
+// circuitBreakerOpenDuration reads CIRCUIT_BREAKER_OPEN_DURATION (default 30s), how long a breaker
+// stays open before it lets a request through to test the upstream
+func circuitBreakerOpenDuration() time.Duration {
+	d, err := time.ParseDuration(getEnvOrDefault("CIRCUIT_BREAKER_OPEN_DURATION", "30s"))
+	if err != nil || d <= 0 {
+		log.Printf("WARNING: Invalid CIRCUIT_BREAKER_OPEN_DURATION, using 30s: %v", err)
+		return 30 * time.Second
+	}
+	return d
+}
+
+// record notes the outcome of a call; err is nil for a call the upstream handled
+func (b *circuitBreaker) record(err error) {
+	threshold := circuitBreakerThreshold()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if err == nil {
+		if b.state != circuitClosed {
+			log.Printf("INFO: %s circuit breaker closed, the upstream answered again", b.name)
+		}
+		b.state, b.failures, b.lastErr = circuitClosed, 0, ""
+		return
+	}
+	b.failures++
+	b.lastErr = err.Error()
+	if threshold == 0 || b.state == circuitOpen || (b.state == circuitClosed && b.failures < threshold) {
+		return
+	}
+	// a failed test of a half-open breaker opens it again for another period
+	b.state, b.openedAt = circuitOpen, time.Now()
+	circuitBreakerTripsTotal.Inc("upstream", b.name)
+	log.Printf("WARNING: %s circuit breaker opened after %d consecutive failures, failing fast for %s: %s",
+		b.name, b.failures, circuitBreakerOpenDuration(), b.lastErr)
+}
+
+// allow reports whether a call may be sent, and otherwise how long until the breaker lets one
+// through. The first call after the open period is let through as a test; others keep being
+// turned away until it has recorded an outcome or was abandoned, or for another open period if
+// neither happens.
+func (b *circuitBreaker) allow() (bool, time.Duration) {
+	if circuitBreakerThreshold() == 0 {
+		return true, 0
+	}
+	openFor := circuitBreakerOpenDuration()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch b.state {
+	case circuitOpen:
+		if remaining := openFor - time.Since(b.openedAt); remaining > 0 {
+			return false, remaining
+		}
+		log.Printf("INFO: %s circuit breaker half-open, letting a request through to test the upstream", b.name)
+		b.state, b.probeStarted = circuitHalfOpen, time.Now()
+		return true, 0
+	case circuitHalfOpen:
+		if remaining := openFor - time.Since(b.probeStarted); remaining > 0 {
+			return false, remaining
+		}
+		b.probeStarted = time.Now()
+		return true, 0
+	}
+	return true, 0
+}
+
+// rejecting reports whether calls are being turned away, and for how long, without taking the test
+// of a half-open breaker: a request is only turned away up front while no call could go through
+func (b *circuitBreaker) rejecting() (bool, time.Duration) {
+	if circuitBreakerThreshold() == 0 {
+		return false, 0
+	}
+	openFor := circuitBreakerOpenDuration()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch b.state {
+	case circuitOpen:
+		if remaining := openFor - time.Since(b.openedAt); remaining > 0 {
+			return true, remaining
+		}
+	case circuitHalfOpen:
+		if remaining := openFor - time.Since(b.probeStarted); remaining > 0 {
+			return true, remaining
+		}
+	}
+	return false, 0
+}
+
+// abandon gives back the test of a half-open breaker when the call was abandoned without an
+// outcome, so the next call tests the upstream instead of waiting out another open period
+func (b *circuitBreaker) abandon() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.state == circuitHalfOpen {
+		b.probeStarted = time.Time{}
+	}
+}
+
+// check is allow for a call about to be sent: it returns the error to fail the call with while
+// calls are turned away
+func (b *circuitBreaker) check() error {
+	if ok, retryAfter := b.allow(); !ok {
+		circuitBreakerRejectionsTotal.Inc("upstream", b.name)
+		return fmt.Errorf("calls to %s keep failing, the provider is not sending it requests for another %d seconds", b.name, int(retryAfter.Seconds())+1)
+	}
+	return nil
+}
+
+// details is the breaker's part of the /healthex dependency report
+func (b *circuitBreaker) details() map[string]interface{} {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	details := map[string]interface{}{"state": b.state, "consecutiveFailures": b.failures}
+	if b.state != circuitClosed {
+		details["openedAt"] = b.openedAt.UTC().Format(time.RFC3339)
+		details["lastError"] = b.lastErr
+	}
+	return details
+}
+
+// pcloudStatusError turns a PCloud call's status into a breaker outcome: no response or a 5xx is a
+// failure of the tenant
+func pcloudStatusError(status int) error {
+	if status == 0 || status >= 500 {
+		return fmt.Errorf("PCloud call returned status %d", status)
+	}
+	return nil
+}
+
+// requestUpstreams returns the breakers of the registry entry a custom provider request is for
+func requestUpstreams(r *http.Request) []*circuitBreaker {
+	if !HasCustomProviderRequestPath(r) {
+		return nil
+	}
+	cpRequest, err := ParseCustomProviderRequestPath(r)
+	if err != nil {
+		return nil
+	}
+	entries := resourceTypes
+	if r.Method == http.MethodPost {
+		entries = actions
+	}
+	entry, _ := lookupProviderEntry(entries, cpRequest.ResourceTypeName)
+	return entry.Upstreams
+}
+
+// circuitBreakerMiddleware answers custom provider requests with 503 and Retry-After while a
+// breaker of an upstream they use is turning calls away
+func circuitBreakerMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for _, breaker := range requestUpstreams(r) {
+			if rejecting, retryAfter := breaker.rejecting(); rejecting {
+				seconds := int(retryAfter.Seconds()) + 1
+				log.Printf("INFO: Rejecting %s %s while the %s circuit breaker is open, retry after %ds", r.Method, r.URL.Path, breaker.name, seconds)
+				circuitBreakerRejectionsTotal.Inc("upstream", breaker.name)
+				w.Header().Set("Retry-After", strconv.Itoa(seconds))
+				sendJSONError(w, http.StatusServiceUnavailable, "UpstreamUnavailable",
+					fmt.Sprintf("Calls to %s keep failing, the provider is not sending it requests for now; retry after %d seconds", breaker.name, seconds))
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+	t.Setenv("CIRCUIT_BREAKER_THRESHOLD", "3")
+	t.Setenv("CIRCUIT_BREAKER_OPEN_DURATION", "50ms")
+	failure := errors.New("PCloud call returned status 503")
+
+	b := newCircuitBreaker("test")
+	b.record(failure)
+	b.record(failure)
+	b.record(nil)
+	b.record(failure)
+	b.record(failure)
+	if ok, _ := b.allow(); !ok || b.state != circuitClosed {
+		t.Fatalf("expected a success to reset the failure count, got state %s", b.state)
+	}
+
+	b.record(failure)
+	if ok, retryAfter := b.allow(); ok || retryAfter <= 0 || b.state != circuitOpen {
+		t.Fatalf("expected the breaker to open after 3 consecutive failures, got allowed %t, retry after %s, state %s", ok, retryAfter, b.state)
+	}
+
+	time.Sleep(60 * time.Millisecond)
+	if ok, _ := b.allow(); !ok || b.state != circuitHalfOpen {
+		t.Fatalf("expected one request through after the open period, got state %s", b.state)
+	}
+	if ok, _ := b.allow(); ok {
+		t.Fatal("expected other requests to be turned away while the test request runs")
+	}
+	b.record(failure)
+	if ok, _ := b.allow(); ok || b.state != circuitOpen {
+		t.Fatalf("expected a failed test to open the breaker again, got state %s", b.state)
+	}
+
+	time.Sleep(60 * time.Millisecond)
+	b.allow()
+	b.record(nil)
+	if ok, _ := b.allow(); !ok || b.state != circuitClosed || b.failures != 0 {
+		t.Fatalf("expected a successful test to close the breaker, got state %s with %d failures", b.state, b.failures)
+	}
+
+	t.Setenv("CIRCUIT_BREAKER_THRESHOLD", "0")
+	for i := 0; i < 10; i++ {
+		b.record(failure)
+	}
+	if ok, _ := b.allow(); !ok {
+		t.Error("expected a threshold of 0 to turn the breaker off")
+	}
+}
+
+func TestCircuitBreakerMiddleware(t *testing.T) {
+	t.Setenv("CIRCUIT_BREAKER_THRESHOLD", "1")
+	t.Setenv("CIRCUIT_BREAKER_OPEN_DURATION", "50ms")
+	t.Cleanup(func() { pcloudBreaker.record(nil) })
+	pcloudBreaker.record(errors.New("PCloud call returned status 0"))
+
+	handler := circuitBreakerMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	serve := func(method, requestPath string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, "/", nil)
+		if requestPath != "" {
+			req.Header.Set(requestPathHeader, "/subscriptions/sub1/resourceGroups/rg1/providers/Microsoft.CustomProviders/resourceProviders/CyberArkProvider/"+requestPath)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w
+	}
+
+	if w := serve(http.MethodGet, "safes/safe1"); w.Code != http.StatusServiceUnavailable || w.Header().Get("Retry-After") == "" || !strings.Contains(w.Body.String(), "UpstreamUnavailable") {
+		t.Errorf("expected 503 UpstreamUnavailable with Retry-After, got %d %v %s", w.Code, w.Header(), w.Body.String())
+	}
+	if w := serve(http.MethodPost, "retrievePassword"); w.Code != http.StatusServiceUnavailable {
+		t.Errorf("expected an action on accounts to be turned away, got %d", w.Code)
+	}
+
+	// Resource types that do not call PCloud, and requests that are not custom provider requests,
+	// such as health checks, are not turned away
+	if w := serve(http.MethodGet, "conjurSecrets/secret1"); w.Code != http.StatusOK {
+		t.Errorf("expected a Conjur request to pass, got %d", w.Code)
+	}
+	if w := serve(http.MethodGet, ""); w.Code != http.StatusOK {
+		t.Errorf("expected a health check to pass, got %d", w.Code)
+	}
+
+	// Once the open period is over requests go through, and the test of the upstream is only taken
+	// by a call to it
+	time.Sleep(60 * time.Millisecond)
+	if w := serve(http.MethodGet, "safes/safe1"); w.Code != http.StatusOK || pcloudBreaker.state != circuitOpen {
+		t.Fatalf("expected the request through without taking the test, got %d with state %s", w.Code, pcloudBreaker.state)
+	}
+	if err := pcloudBreaker.check(); err != nil {
+		t.Fatalf("expected the first call to test PCloud, got %v", err)
+	}
+	if w := serve(http.MethodGet, "safes/safe1"); w.Code != http.StatusServiceUnavailable {
+		t.Errorf("expected requests turned away while the test call runs, got %d", w.Code)
+	}
+	if err := pcloudBreaker.check(); err == nil {
+		t.Error("expected a second call to be turned away while the test call runs")
+	}
+
+	// A test call abandoned with its request lets the next call test PCloud
+	pcloudBreaker.abandon()
+	if w := serve(http.MethodGet, "safes/safe1"); w.Code != http.StatusOK {
+		t.Errorf("expected requests through once the test call was abandoned, got %d", w.Code)
+	}
+	if err := pcloudBreaker.check(); err != nil {
+		t.Errorf("expected the next call to test PCloud, got %v", err)
+	}
+}
+
+func TestPcloudCallCircuitBreaker(t *testing.T) {
+	t.Setenv("CIRCUIT_BREAKER_THRESHOLD", "1")
+	t.Setenv("CIRCUIT_BREAKER_OPEN_DURATION", "1m")
+	t.Cleanup(func() { pcloudBreaker.record(nil) })
+	pcloudBreaker.record(errors.New("PCloud call returned status 0"))
+
+	called := false
+	_, status, err := pcloudCall(context.Background(), func(ctx context.Context) (struct{}, int, error) {
+		called = true
+		return struct{}{}, http.StatusOK, nil
+	})
+	if called || status != http.StatusServiceUnavailable || err == nil {
+		t.Errorf("expected the call turned away with 503, got called %t, status %d, %v", called, status, err)
+	}
+	if _, inFlight := pcloudLimiter.snapshot(); inFlight != 0 {
+		t.Errorf("expected the turned away call to give back its slot, got %d in flight", inFlight)
+	}
+}
@@ -0,0 +1,315 @@
+// Package client is a typed Go client for the CyberArk custom provider's HTTP surface. It sends
+// requests the way ARM does for a Proxy custom provider: to the provider root with the resource
+// path in the X-Ms-Customproviders-Requestpath header. Integration tests and external tooling
+// use it instead of building requests by hand.
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// RequestPathHeader is the header ARM uses to pass the resource path to a Proxy custom provider
+const RequestPathHeader = "X-Ms-Customproviders-Requestpath"
+
+// Client calls one custom provider instance (subscription, resource group and provider name)
+type Client struct {
+	// BaseURL is the provider endpoint, e.g. https://myapp.azurecontainerapps.io
+	BaseURL        string
+	SubscriptionID string
+	ResourceGroup  string
+	ProviderName   string
+
+	// HTTPClient defaults to a client with a 60 second timeout
+	HTTPClient *http.Client
+	// Header is added to every request, e.g. X-Provider-Strict-Validation or X-Ms-Correlation-Request-Id
+	Header http.Header
+}
+
+// New returns a client for the custom provider providerName in the given subscription and resource group
+func New(baseURL, subscriptionID, resourceGroup, providerName string) *Client {
+	return &Client{
+		BaseURL:        baseURL,
+		SubscriptionID: subscriptionID,
+		ResourceGroup:  resourceGroup,
+		ProviderName:   providerName,
+		HTTPClient:     &http.Client{Timeout: 60 * time.Second},
+		Header:         http.Header{},
+	}
+}
+
+// Resource is a custom provider resource as returned by the provider
+type Resource struct {
+	ID         string                 `json:"id"`
+	Name       string                 `json:"name"`
+	Type       string                 `json:"type"`
+	Properties map[string]interface{} `json:"properties"`
+	// ETag is the ETag response header, usable with If-None-Match
+	ETag string `json:"-"`
+}
+
+// SafeProperties is the body of a safes PUT
+type SafeProperties struct {
+	SafeName      string `json:"safeName"`
+	Description   string `json:"description,omitempty"`
+	Profile       string `json:"profile,omitempty"`
+	ConfirmDelete bool   `json:"confirmDelete,omitempty"`
+	// PreventDeletion refuses deletes of the safe until it is set back to false
+	PreventDeletion bool `json:"preventDeletion,omitempty"`
+	// DeletionPolicy is Retain or Delete (the default), see the README's Deletion Policy section
+	DeletionPolicy string `json:"deletionPolicy,omitempty"`
+}
+
+// SecretManagement is the secretManagement block of an account
+type SecretManagement struct {
+	AutomaticManagementEnabled bool   `json:"automaticManagementEnabled"`
+	ManualManagementReason     string `json:"manualManagementReason,omitempty"`
+}
+
+// AccountProperties is the body of an accounts PUT
+type AccountProperties struct {
+	SafeName   string `json:"safeName"`
+	PlatformID string `json:"platformId"`
+	Name       string `json:"name,omitempty"`
+	Address    string `json:"address,omitempty"`
+	UserName   string `json:"userName,omitempty"`
+	SecretType string `json:"secretType,omitempty"`
+	Secret     string `json:"secret,omitempty"`
+	// GenerateKey has the provider generate an SSH key for a secretType key account instead of Secret
+	GenerateKey               bool              `json:"generateKey,omitempty"`
+	DeletionPolicy            string            `json:"deletionPolicy,omitempty"`
+	SecretManagement          *SecretManagement `json:"secretManagement,omitempty"`
+	PlatformAccountProperties map[string]string `json:"platformAccountProperties,omitempty"`
+}
+
+// Error is an error response from the provider
+type Error struct {
+	StatusCode int
+	Code       string
+	Message    string
+	Target     string
+	Details    []ErrorDetail
+	// InnerError is the PCloud or Conjur error behind this one, when there was one
+	InnerError  *InnerError
+	OperationID string
+}
+
+// InnerError is the upstream error behind an Error, as PCloud or Conjur returned it
+type InnerError struct {
+	// Source is PCloud or Conjur
+	Source  string `json:"source"`
+	Status  int    `json:"status,omitempty"`
+	Code    string `json:"code,omitempty"`
+	Message string `json:"message,omitempty"`
+}
+
+// ErrorDetail is one underlying problem of an Error, e.g. one invalid property of a PUT body
+type ErrorDetail struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+	Target  string `json:"target,omitempty"`
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("provider returned %d %s: %s", e.StatusCode, e.Code, e.Message)
+}
+
+// IsNotFound reports whether err is a 404 from the provider
+func IsNotFound(err error) bool {
+	providerErr, ok := err.(*Error)
+	return ok && providerErr.StatusCode == http.StatusNotFound
+}
+
+// ResourceID returns the ARM ID of a resource (or, with an empty name, of an action or a resource type collection) of this provider
+func (c *Client) ResourceID(resourceType, name string) string {
+	id := fmt.Sprintf("/subscriptions/%s/resourceGroups/%s/providers/Microsoft.CustomProviders/resourceProviders/%s/%s",
+		c.SubscriptionID, c.ResourceGroup, c.ProviderName, resourceType)
+	if name != "" {
+		id += "/" + name
+	}
+	return id
+}
+
+// CreateSafe creates (PUT) a safe
+func (c *Client) CreateSafe(ctx context.Context, name string, properties SafeProperties) (*Resource, error) {
+	return c.PutResource(ctx, "safes", name, properties)
+}
+
+// GetSafe reads a safe
+func (c *Client) GetSafe(ctx context.Context, name string) (*Resource, error) {
+	return c.GetResource(ctx, "safes", name)
+}
+
+// DeleteSafe deletes a safe
+func (c *Client) DeleteSafe(ctx context.Context, name string) error {
+	return c.DeleteResource(ctx, "safes", name)
+}
+
+// CreateAccount creates (PUT) an account; the resource name is {safeName}.{accountName}
+func (c *Client) CreateAccount(ctx context.Context, properties AccountProperties) (*Resource, error) {
+	return c.PutResource(ctx, "accounts", AccountResourceName(properties.SafeName, properties.Name), properties)
+}
+
+// GetAccount reads an account
+func (c *Client) GetAccount(ctx context.Context, safeName, accountName string) (*Resource, error) {
+	return c.GetResource(ctx, "accounts", AccountResourceName(safeName, accountName))
+}
+
+// DeleteAccount deletes an account
+func (c *Client) DeleteAccount(ctx context.Context, safeName, accountName string) error {
+	return c.DeleteResource(ctx, "accounts", AccountResourceName(safeName, accountName))
+}
+
+// AccountResourceName is the ARM resource name of an account
+func AccountResourceName(safeName, accountName string) string {
+	return safeName + "." + accountName
+}
+
+// PutResource creates or replaces a resource of any type with the given properties
+func (c *Client) PutResource(ctx context.Context, resourceType, name string, properties interface{}) (*Resource, error) {
+	var resource Resource
+	body := map[string]interface{}{"properties": properties}
+	header, err := c.do(ctx, http.MethodPut, c.ResourceID(resourceType, name), body, &resource)
+	if err != nil {
+		return nil, err
+	}
+	resource.ETag = header.Get("ETag")
+	return &resource, nil
+}
+
+// PatchResource partially updates a resource
+func (c *Client) PatchResource(ctx context.Context, resourceType, name string, properties interface{}) (*Resource, error) {
+	var resource Resource
+	body := map[string]interface{}{"properties": properties}
+	if _, err := c.do(ctx, http.MethodPatch, c.ResourceID(resourceType, name), body, &resource); err != nil {
+		return nil, err
+	}
+	return &resource, nil
+}
+
+// GetResource reads a resource of any type
+func (c *Client) GetResource(ctx context.Context, resourceType, name string) (*Resource, error) {
+	var resource Resource
+	header, err := c.do(ctx, http.MethodGet, c.ResourceID(resourceType, name), nil, &resource)
+	if err != nil {
+		return nil, err
+	}
+	resource.ETag = header.Get("ETag")
+	return &resource, nil
+}
+
+// ListResources returns every resource of a type managed by the provider, following nextLink
+// when the provider answers in pages
+func (c *Client) ListResources(ctx context.Context, resourceType string) ([]Resource, error) {
+	var resources []Resource
+	requestPath := c.ResourceID(resourceType, "")
+	for {
+		var list struct {
+			Value    []Resource `json:"value"`
+			NextLink string     `json:"nextLink"`
+		}
+		if _, err := c.do(ctx, http.MethodGet, requestPath, nil, &list); err != nil {
+			return nil, err
+		}
+		resources = append(resources, list.Value...)
+		if list.NextLink == "" {
+			return resources, nil
+		}
+		next, err := url.Parse(list.NextLink)
+		if err != nil {
+			return nil, fmt.Errorf("invalid nextLink %q: %w", list.NextLink, err)
+		}
+		requestPath = next.Path + "?" + next.RawQuery
+	}
+}
+
+// DeleteResource deletes a resource of any type
+func (c *Client) DeleteResource(ctx context.Context, resourceType, name string) error {
+	_, err := c.do(ctx, http.MethodDelete, c.ResourceID(resourceType, name), nil, nil)
+	return err
+}
+
+// InvokeAction POSTs body to a custom action and decodes the response into out (which may be nil)
+func (c *Client) InvokeAction(ctx context.Context, action string, body, out interface{}) error {
+	_, err := c.do(ctx, http.MethodPost, c.ResourceID(action, ""), body, out)
+	return err
+}
+
+// do sends one request to the provider root with the request path header set
+func (c *Client) do(ctx context.Context, method, requestPath string, body, out interface{}) (http.Header, error) {
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return nil, fmt.Errorf("failed to marshal request body: %w", err)
+		}
+		reader = bytes.NewReader(data)
+	}
+
+	endpoint, err := url.JoinPath(c.BaseURL, "/")
+	if err != nil {
+		return nil, fmt.Errorf("invalid base URL %q: %w", c.BaseURL, err)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, endpoint, reader)
+	if err != nil {
+		return nil, err
+	}
+	for key, values := range c.Header {
+		for _, value := range values {
+			req.Header.Add(key, value)
+		}
+	}
+	req.Header.Set(RequestPathHeader, requestPath)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	httpClient := c.HTTPClient
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+	res, err := httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	data, err := io.ReadAll(res.Body)
+	if err != nil {
+		return res.Header, fmt.Errorf("failed to read response body: %w", err)
+	}
+	if res.StatusCode >= 300 {
+		providerErr := &Error{StatusCode: res.StatusCode, OperationID: res.Header.Get("X-Provider-Operation-Id")}
+		var errorResponse struct {
+			Error struct {
+				Code       string        `json:"code"`
+				Message    string        `json:"message"`
+				Target     string        `json:"target"`
+				Details    []ErrorDetail `json:"details"`
+				InnerError *InnerError   `json:"innererror"`
+			} `json:"error"`
+		}
+		if json.Unmarshal(data, &errorResponse) == nil {
+			providerErr.Code = errorResponse.Error.Code
+			providerErr.Message = errorResponse.Error.Message
+			providerErr.Target = errorResponse.Error.Target
+			providerErr.Details = errorResponse.Error.Details
+			providerErr.InnerError = errorResponse.Error.InnerError
+		} else {
+			providerErr.Message = string(data)
+		}
+		return res.Header, providerErr
+	}
+	if out != nil && len(data) > 0 {
+		if err := json.Unmarshal(data, out); err != nil {
+			return res.Header, fmt.Errorf("failed to parse response: %w", err)
+		}
+	}
+	return res.Header, nil
+}
@@ -0,0 +1,120 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestClientRequests(t *testing.T) {
+	const base = "/subscriptions/sub1/resourceGroups/rg1/providers/Microsoft.CustomProviders/resourceProviders/CyberArkProvider"
+
+	tests := []struct {
+		name           string
+		call           func(c *Client) error
+		expectedVerb   string
+		expectedPath   string
+		status         int
+		response       string
+		expectNotFound bool
+	}{
+		{
+			name: "create safe",
+			call: func(c *Client) error {
+				res, err := c.CreateSafe(context.Background(), "safe1", SafeProperties{SafeName: "safe1"})
+				if err == nil && res.Properties["safeName"] != "safe1" {
+					t.Errorf("unexpected properties %v", res.Properties)
+				}
+				return err
+			},
+			expectedVerb: http.MethodPut,
+			expectedPath: base + "/safes/safe1",
+			status:       http.StatusCreated,
+			response:     `{"id": "x", "name": "safe1", "properties": {"safeName": "safe1"}}`,
+		},
+		{
+			name: "get account",
+			call: func(c *Client) error {
+				_, err := c.GetAccount(context.Background(), "safe1", "acct.1")
+				return err
+			},
+			expectedVerb: http.MethodGet,
+			expectedPath: base + "/accounts/safe1.acct.1",
+			status:       http.StatusOK,
+			response:     `{"name": "safe1.acct.1", "properties": {}}`,
+		},
+		{
+			name: "invoke action",
+			call: func(c *Client) error {
+				var out map[string]interface{}
+				err := c.InvokeAction(context.Background(), "importAccount", map[string]string{"safeName": "safe1"}, &out)
+				if err == nil && out["name"] != "safe1.acct1" {
+					t.Errorf("unexpected response %v", out)
+				}
+				return err
+			},
+			expectedVerb: http.MethodPost,
+			expectedPath: base + "/importAccount",
+			status:       http.StatusOK,
+			response:     `{"name": "safe1.acct1"}`,
+		},
+		{
+			name: "not found",
+			call: func(c *Client) error {
+				return c.DeleteSafe(context.Background(), "missing")
+			},
+			expectedVerb:   http.MethodDelete,
+			expectedPath:   base + "/safes/missing",
+			status:         http.StatusNotFound,
+			response:       `{"error": {"code": "SafeNotFound", "message": "Safe not found: missing"}}`,
+			expectNotFound: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.URL.Path != "/" {
+					t.Errorf("expected request to the provider root, got %s", r.URL.Path)
+				}
+				if r.Method != tt.expectedVerb {
+					t.Errorf("expected %s, got %s", tt.expectedVerb, r.Method)
+				}
+				if got := r.Header.Get(RequestPathHeader); got != tt.expectedPath {
+					t.Errorf("expected request path %s, got %s", tt.expectedPath, got)
+				}
+				if got := r.Header.Get("X-Provider-Strict-Validation"); got != "true" {
+					t.Errorf("expected default header to be sent, got %q", got)
+				}
+				if r.Method == http.MethodPut {
+					var body map[string]json.RawMessage
+					if err := json.NewDecoder(r.Body).Decode(&body); err != nil || body["properties"] == nil {
+						t.Errorf("expected a properties body, got %v (%v)", body, err)
+					}
+				}
+				w.WriteHeader(tt.status)
+				w.Write([]byte(tt.response))
+			}))
+			defer server.Close()
+
+			c := New(server.URL, "sub1", "rg1", "CyberArkProvider")
+			c.Header.Set("X-Provider-Strict-Validation", "true")
+			err := tt.call(c)
+
+			if tt.expectNotFound {
+				if !IsNotFound(err) {
+					t.Fatalf("expected not found error, got %v", err)
+				}
+				if providerErr := err.(*Error); providerErr.Code != "SafeNotFound" {
+					t.Errorf("expected code SafeNotFound, got %s", providerErr.Code)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+		})
+	}
+}
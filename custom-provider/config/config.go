@@ -0,0 +1,543 @@
+// Package config loads the provider's settings from a mounted file, e.g. a Container Apps secret
+// volume, in addition to environment variables. The file is named by CONFIG_FILE and holds the
+// same names as the environment, optionally grouped in sections; a variable that is set in the
+// environment overrides the file. The provider reads its settings while its package variables
+// are initialised, so the file is applied to the environment in this package's init, which runs
+// first.
+package config
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Kinds of setting values, checked when the file is loaded
+const (
+	kindString   = "string"
+	kindDuration = "duration"
+	kindInt      = "int"
+	kindFloat    = "float"
+	kindBool     = "bool"
+	kindURL      = "url"
+)
+
+// settings are the variables a config file may set, with the kind of value each takes
+var settings = map[string]string{
+	"ACCESS_POLICIES":                    kindString,
+	"ACCESS_POLICIES_FILE":               kindString,
+	"ACCOUNT_INDEX_TTL":                  kindDuration,
+	"ACCOUNT_MOVE_POLICY":                kindString,
+	"ADMIN_APP_ROLE":                     kindString,
+	"ADMIN_AUDIENCE":                     kindString,
+	"ADMIN_TOKEN":                        kindString,
+	"APPCONFIG_ENDPOINT":                 kindURL,
+	"APPCONFIG_LABEL":                    kindString,
+	"APPCONFIG_REFRESH_INTERVAL":         kindDuration,
+	"ASYNC_OPERATION_RETENTION":          kindDuration,
+	"ASYNC_PROVISIONING":                 kindBool,
+	"ASYNC_WORKERS":                      kindInt,
+	"AUDIT_BLOB_CONTAINER_URL":           kindURL,
+	"AUDIT_LOG_ANALYTICS_LOG_TYPE":       kindString,
+	"AUDIT_LOG_ANALYTICS_SHARED_KEY":     kindString,
+	"AUDIT_LOG_ANALYTICS_WORKSPACE_ID":   kindString,
+	"AZURE_CLIENT_ID":                    kindString,
+	"BLOB_STORAGE_SUFFIX":                kindString,
+	"BULK_ADD_CONCURRENCY":               kindInt,
+	"CA_BUNDLE_FILE":                     kindString,
+	"CALLER_AUTH_TOKEN":                  kindString,
+	"CALLER_CERT_SUBJECTS":               kindString,
+	"CALLER_CERT_THUMBPRINTS":            kindString,
+	"CALLER_CERT_TRUST_XFCC":             kindBool,
+	"CIRCUIT_BREAKER_OPEN_DURATION":      kindDuration,
+	"CIRCUIT_BREAKER_THRESHOLD":          kindInt,
+	"CONJUR_ACCOUNT":                     kindString,
+	"CONJUR_APPLIANCE_URL":               kindURL,
+	"CONJUR_AUTHN_JWT_AUDIENCE":          kindString,
+	"CONJUR_AUTHN_LOGIN":                 kindString,
+	"CONJUR_AUTHN_SERVICE_ID":            kindString,
+	"CONJUR_AUTHN_TYPE":                  kindString,
+	"CONJUR_CREDENTIALS_TTL":             kindDuration,
+	"CONJUR_HOSTS_POLICY_BRANCH":         kindString,
+	"CONJUR_SECRETS_POLICY_BRANCH":       kindString,
+	"CREATED_RESOURCE_TTL":               kindDuration,
+	"CREDENTIALS_REFRESH_INTERVAL":       kindDuration,
+	"DELETE_BATCH_WINDOW":                kindDuration,
+	"DELETE_MAX_CONCURRENCY":             kindInt,
+	"DELETE_PROTECTION_WINDOW":           kindDuration,
+	"EGRESS_IP":                          kindString,
+	"EGRESS_IP_SOURCE":                   kindString,
+	"ENABLED_RESOURCE_TYPES":             kindString,
+	"ENTRA_ALLOWED_APP_IDS":              kindString,
+	"ENTRA_AUDIENCE":                     kindString,
+	"ENTRA_AUTHORITY_HOST":               kindURL,
+	"ENTRA_ISSUER":                       kindString,
+	"ENTRA_TENANT_ID":                    kindString,
+	"EVENTGRID_TOPIC_ENDPOINT":           kindURL,
+	"EVENTGRID_TOPIC_KEY":                kindString,
+	"FEATURE_FLAGS":                      kindString,
+	"HTTPS_PROXY":                        kindString,
+	"HTTP_IDLE_TIMEOUT":                  kindDuration,
+	"HTTP_PROXY":                         kindString,
+	"HTTP_READ_HEADER_TIMEOUT":           kindDuration,
+	"HTTP_READ_TIMEOUT":                  kindDuration,
+	"HTTP_WRITE_TIMEOUT":                 kindDuration,
+	"IDTENANTURL":                        kindURL,
+	"KEYVAULT_CREDENTIALS_TTL":           kindDuration,
+	"KEYVAULT_URI":                       kindURL,
+	"LIST_PAGE_SIZE":                     kindInt,
+	"LOG_LEVEL":                          kindString,
+	"LOG_REDACT_KEYS":                    kindString,
+	"MAINTENANCE_MODE":                   kindBool,
+	"MAINTENANCE_RETRY_AFTER":            kindDuration,
+	"MAINTENANCE_SIGNATURES":             kindString,
+	"MAX_REQUEST_BODY_BYTES":             kindInt,
+	"METRICS_TOKEN":                      kindString,
+	"MOCK_PAM":                           kindBool,
+	"MOCK_PAM_ADDR":                      kindString,
+	"NOTIFY_WEBHOOK_HEADERS":             kindString,
+	"NO_PROXY":                           kindString,
+	"NOTIFY_WEBHOOK_URL":                 kindURL,
+	"OPERATION_AUDIT_CAPACITY":           kindInt,
+	"OTEL_EXPORTER_OTLP_ENDPOINT":        kindURL,
+	"OTEL_EXPORTER_OTLP_HEADERS":         kindString,
+	"OTEL_EXPORTER_OTLP_TRACES_ENDPOINT": kindURL,
+	"OTEL_SERVICE_NAME":                  kindString,
+	"PAMPASS":                            kindString,
+	"PAMUSER":                            kindString,
+	"PAM_AUTH_MODE":                      kindString,
+	"PAM_OIDC_APP_ID":                    kindString,
+	"PAM_OIDC_AUDIENCE":                  kindString,
+	"PAM_OIDC_SCOPE":                     kindString,
+	"PCLOUDURL":                          kindURL,
+	"PCLOUD_CONCURRENCY_INITIAL":         kindInt,
+	"PCLOUD_CONCURRENCY_MAX":             kindInt,
+	"PCLOUD_CONCURRENCY_MIN":             kindInt,
+	"PCLOUD_LATENCY_TARGET":              kindDuration,
+	"PCLOUD_RATE_BURST":                  kindInt,
+	"PCLOUD_RATE_LIMIT":                  kindFloat,
+	"PCLOUD_RETRY_AFTER_MAX":             kindDuration,
+	"PLATFORM_CACHE_TTL":                 kindDuration,
+	"PORT":                               kindInt,
+	"PROBE_TOKEN":                        kindString,
+	"PROVIDER_ENDPOINT":                  kindURL,
+	"READYZ_SESSION_MAX_AGE":             kindDuration,
+	"READYZ_TIMEOUT":                     kindDuration,
+	"REQUEST_FLAGS_ALLOWED":              kindString,
+	"RESPONSE_SHAPE":                     kindString,
+	"SAFE_DELETE_ACCOUNT_THRESHOLD":      kindInt,
+	"SAFE_PROFILES":                      kindString,
+	"SAFE_PROFILES_FILE":                 kindString,
+	"SECRET_POLICIES_FILE":               kindString,
+	"SHUTDOWN_GRACE_PERIOD":              kindDuration,
+	"SLOW_REQUEST_THRESHOLD":             kindDuration,
+	"STATE_STORE":                        kindString,
+	"STATE_STORE_RETRY_INTERVAL":         kindDuration,
+	"STATE_STORE_TABLE_ENDPOINT":         kindURL,
+	"STATE_STORE_TABLE_KEY":              kindString,
+	"STATE_STORE_TABLE_NAME":             kindString,
+	"STRICT_REQUEST_BODIES":              kindBool,
+	"TLS_CERT_FILE":                      kindString,
+	"TLS_CERT_REFRESH_INTERVAL":          kindDuration,
+	"TLS_HTTP2":                          kindBool,
+	"TLS_KEY_FILE":                       kindString,
+	"TLS_KEYVAULT_CERT":                  kindString,
+}
+
+// policySettings can also be set per type with a SAFES_, ACCOUNTS_ or MEMBERS_ prefix
+var policySettings = map[string]string{
+	"REQUEST_TIMEOUT":      kindDuration,
+	"PAM_CALL_TIMEOUT":     kindDuration,
+	"PAM_RETRY_MAX":        kindInt,
+	"PAM_RETRY_BASE":       kindDuration,
+	"PCLOUD_RETRIES":       kindInt,
+	"PCLOUD_RETRY_BACKOFF": kindDuration,
+	"VERIFY_ATTEMPTS":      kindInt,
+	"VERIFY_INTERVAL":      kindDuration,
+}
+
+// namePrefixes are families of settings named after the credential they hold, e.g. CONJUR_VAR_PAMPASS
+var namePrefixes = []string{"CONJUR_VAR_", "KEYVAULT_SECRET_"}
+
+func init() {
+	for name, kind := range policySettings {
+		settings[name] = kind
+		for _, prefix := range []string{"SAFES_", "ACCOUNTS_", "MEMBERS_"} {
+			settings[prefix+name] = kind
+		}
+	}
+
+	file = os.Getenv("CONFIG_FILE")
+	if file == "" {
+		return
+	}
+	values, warnings, err := Load(file)
+	if err != nil {
+		loadErr = err
+		return
+	}
+	loadWarnings = warnings
+	for _, name := range sortedNames(values) {
+		if os.Getenv(name) != "" {
+			overridden = append(overridden, name)
+			continue
+		}
+		os.Setenv(name, values[name])
+		fromFile[name] = true
+	}
+}
+
+var (
+	file         string
+	loadErr      error
+	fromFile     = map[string]bool{}
+	overridden   []string
+	loadWarnings []string
+)
+
+// File returns the CONFIG_FILE path, or "" when no config file is used
+func File() string { return file }
+
+// Err returns why the config file could not be loaded; no setting of the file is applied then
+func Err() error { return loadErr }
+
+// Warnings returns a line for each name in the config file that is not a provider setting; such
+// names are still applied, so a setting added after this list is not lost
+func Warnings() []string { return loadWarnings }
+
+// Overridden returns the names the config file sets that the environment overrides
+func Overridden() []string { return overridden }
+
+var (
+	envName     = regexp.MustCompile(`^[A-Z][A-Z0-9_]*$`)
+	sectionName = regexp.MustCompile(`^[A-Za-z][A-Za-z0-9_-]*$`)
+)
+
+// Load reads a .json, .yaml or .yml config file and checks every value against the kind of its
+// setting. It returns the settings by name and a warning for each name that is not a provider setting.
+func Load(path string) (map[string]string, []string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, nil, fmt.Errorf("cannot read config file: %v", err)
+	}
+	var values map[string]string
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".json":
+		values, err = parseJSON(data)
+	case ".yaml", ".yml":
+		values, err = parseYAML(data)
+	default:
+		return nil, nil, fmt.Errorf("config file %s must be .json, .yaml or .yml", path)
+	}
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid config file %s: %v", path, err)
+	}
+
+	var problems, warnings []string
+	for _, name := range sortedNames(values) {
+		if name == "CONFIG_FILE" {
+			problems = append(problems, "CONFIG_FILE cannot be set in the config file")
+			continue
+		}
+		kind, known := kindOf(name)
+		if !known {
+			warnings = append(warnings, fmt.Sprintf("%s is not a provider setting", name))
+			continue
+		}
+		if err := checkValue(kind, values[name]); err != nil {
+			problems = append(problems, fmt.Sprintf("%s: %v", name, err))
+		}
+	}
+	if len(problems) > 0 {
+		return nil, nil, fmt.Errorf("invalid config file %s: %s", path, strings.Join(problems, "; "))
+	}
+	return values, warnings, nil
+}
+
+func kindOf(name string) (string, bool) {
+	if kind, ok := settings[name]; ok {
+		return kind, true
+	}
+	for _, prefix := range namePrefixes {
+		if strings.HasPrefix(name, prefix) && len(name) > len(prefix) {
+			return kindString, true
+		}
+	}
+	return "", false
+}
+
+// checkValue parses value the way the provider will; "" leaves the setting at its default
+func checkValue(kind, value string) error {
+	if value == "" {
+		return nil
+	}
+	var err error
+	switch kind {
+	case kindDuration:
+		_, err = time.ParseDuration(value)
+	case kindInt:
+		_, err = strconv.Atoi(value)
+	case kindFloat:
+		_, err = strconv.ParseFloat(value, 64)
+	case kindBool:
+		_, err = strconv.ParseBool(value)
+	case kindURL:
+		if u, parseErr := url.Parse(value); parseErr != nil || u.Scheme == "" || u.Host == "" {
+			return errors.New("must be an absolute URL")
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("invalid %s %q", kind, value)
+	}
+	return nil
+}
+
+// addValue adds one setting, rejecting names that are not environment variable names or repeat
+func addValue(values map[string]string, name, value string) error {
+	if !envName.MatchString(name) {
+		return fmt.Errorf("%q is not a setting name; names are upper-case environment variable names", name)
+	}
+	if _, ok := values[name]; ok {
+		return fmt.Errorf("%s is set more than once", name)
+	}
+	values[name] = value
+	return nil
+}
+
+// parseJSON reads an object of settings; an object value is a section of settings
+func parseJSON(data []byte) (map[string]string, error) {
+	var doc map[string]json.RawMessage
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return nil, err
+	}
+	values := map[string]string{}
+	for key, raw := range doc {
+		var section map[string]json.RawMessage
+		if json.Unmarshal(raw, &section) == nil && section != nil {
+			if !sectionName.MatchString(key) {
+				return nil, fmt.Errorf("%q is not a section name", key)
+			}
+			for name, raw := range section {
+				if err := addJSONValue(values, name, raw); err != nil {
+					return nil, fmt.Errorf("%s: %v", key, err)
+				}
+			}
+			continue
+		}
+		if err := addJSONValue(values, key, raw); err != nil {
+			return nil, err
+		}
+	}
+	return values, nil
+}
+
+// addJSONValue takes a string, number or boolean; numbers and booleans keep their JSON text
+func addJSONValue(values map[string]string, name string, raw json.RawMessage) error {
+	var value string
+	text := strings.TrimSpace(string(raw))
+	switch {
+	case strings.HasPrefix(text, `"`):
+		if err := json.Unmarshal(raw, &value); err != nil {
+			return fmt.Errorf("%s: %v", name, err)
+		}
+	case text == "true" || text == "false":
+		value = text
+	default:
+		var number json.Number
+		if err := json.Unmarshal(raw, &number); err != nil {
+			return fmt.Errorf("%s must be a string, number or boolean", name)
+		}
+		value = number.String()
+	}
+	return addValue(values, name, value)
+}
+
+// parseYAML reads the subset of YAML a config file needs: "NAME: value" lines, plain or quoted
+// scalars, comments, and one level of sections whose settings are indented. Lists, flow
+// collections, anchors and multi-line scalars are rejected.
+func parseYAML(data []byte) (map[string]string, error) {
+	values := map[string]string{}
+	section, sectionIndent := "", 0
+	for i, line := range strings.Split(string(data), "\n") {
+		lineno := i + 1
+		line = strings.TrimRight(line, " \t\r")
+		trimmed := strings.TrimLeft(line, " ")
+		if trimmed == "" || strings.HasPrefix(trimmed, "#") || (i == 0 && trimmed == "---") {
+			continue
+		}
+		if strings.HasPrefix(line, "\t") {
+			return nil, fmt.Errorf("line %d: indent with spaces, not tabs", lineno)
+		}
+		indent := len(line) - len(trimmed)
+		if strings.HasPrefix(trimmed, "- ") || trimmed == "-" {
+			return nil, fmt.Errorf("line %d: lists are not supported", lineno)
+		}
+		key, rest, ok := strings.Cut(trimmed, ":")
+		if !ok || (rest != "" && rest[0] != ' ') {
+			return nil, fmt.Errorf("line %d: expected NAME: value", lineno)
+		}
+		key = strings.TrimSpace(key)
+		value, err := yamlScalar(strings.TrimSpace(rest))
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", lineno, err)
+		}
+
+		switch {
+		case indent == 0 && value == nil:
+			if !sectionName.MatchString(key) {
+				return nil, fmt.Errorf("line %d: %q is not a section name", lineno, key)
+			}
+			section, sectionIndent = key, 0
+		case indent == 0:
+			section = ""
+			if err := addValue(values, key, *value); err != nil {
+				return nil, fmt.Errorf("line %d: %v", lineno, err)
+			}
+		case section == "":
+			return nil, fmt.Errorf("line %d: unexpected indentation", lineno)
+		case value == nil:
+			return nil, fmt.Errorf("line %d: sections cannot be nested", lineno)
+		default:
+			if sectionIndent == 0 {
+				sectionIndent = indent
+			}
+			if indent != sectionIndent {
+				return nil, fmt.Errorf("line %d: inconsistent indentation in section %s", lineno, section)
+			}
+			if err := addValue(values, key, *value); err != nil {
+				return nil, fmt.Errorf("line %d: %v", lineno, err)
+			}
+		}
+	}
+	return values, nil
+}
+
+// yamlScalar returns the value after "NAME:", or nil when there is none (a section header)
+func yamlScalar(text string) (*string, error) {
+	if text == "" || strings.HasPrefix(text, "#") {
+		return nil, nil
+	}
+	var value string
+	switch text[0] {
+	case '"':
+		end := closingQuote(text)
+		if end < 0 {
+			return nil, errors.New("unterminated double-quoted value")
+		}
+		unquoted, err := strconv.Unquote(text[:end+1])
+		if err != nil {
+			return nil, fmt.Errorf("invalid double-quoted value: %v", err)
+		}
+		value, text = unquoted, text[end+1:]
+	case '\'':
+		end := 1
+		for ; end < len(text); end++ {
+			if text[end] == '\'' {
+				if end+1 < len(text) && text[end+1] == '\'' {
+					end++
+					continue
+				}
+				break
+			}
+		}
+		if end >= len(text) {
+			return nil, errors.New("unterminated single-quoted value")
+		}
+		value, text = strings.ReplaceAll(text[1:end], "''", "'"), text[end+1:]
+	case '[', '{', '|', '>', '&', '*', '!':
+		return nil, fmt.Errorf("%q values are not supported; quote the value", text[:1])
+	default:
+		value, _, _ = strings.Cut(text, " #")
+		value = strings.TrimSpace(value)
+		if value == "~" || value == "null" {
+			value = ""
+		}
+		return &value, nil
+	}
+	if rest := strings.TrimSpace(text); rest != "" && !strings.HasPrefix(rest, "#") {
+		return nil, fmt.Errorf("unexpected %q after the quoted value", rest)
+	}
+	return &value, nil
+}
+
+// closingQuote returns the index of the quote ending a double-quoted value, skipping escapes
+func closingQuote(text string) int {
+	for i := 1; i < len(text); i++ {
+		switch text[i] {
+		case '\\':
+			i++
+		case '"':
+			return i
+		}
+	}
+	return -1
+}
+
+// Setting is one entry of the effective configuration
+type Setting struct {
+	Value  string `json:"value"`
+	Source string `json:"source"` // "file" or "env"
+}
+
+// Effective returns every provider setting that is set, with where its value came from. Secrets
+// are reported only as set and URLs lose their credentials and query, so the result can be logged.
+func Effective() map[string]Setting {
+	effective := map[string]Setting{}
+	for _, entry := range os.Environ() {
+		name, value, _ := strings.Cut(entry, "=")
+		if value == "" {
+			continue
+		}
+		kind, known := kindOf(name)
+		if !known && !fromFile[name] && name != "CONFIG_FILE" {
+			continue
+		}
+		source := "env"
+		if fromFile[name] {
+			source = "file"
+		}
+		effective[name] = Setting{Value: redact(name, kind, value), Source: source}
+	}
+	return effective
+}
+
+// secretSuffixes mark settings whose values are credentials
+var secretSuffixes = []string{"PASS", "PASSWORD", "SECRET", "TOKEN", "_KEY", "HEADERS"}
+
+func redact(name, kind, value string) string {
+	for _, suffix := range secretSuffixes {
+		if strings.HasSuffix(name, suffix) && !strings.HasPrefix(name, "CONJUR_VAR_") && !strings.HasPrefix(name, "KEYVAULT_SECRET_") {
+			return "[REDACTED]"
+		}
+	}
+	u, err := url.Parse(value)
+	if err != nil || u.Host == "" {
+		return value
+	}
+	if kind == kindURL {
+		u.User, u.RawQuery, u.Fragment = nil, "", ""
+		return u.String()
+	}
+	if u.User != nil {
+		// e.g. the credentials of a proxy URL
+		return u.Scheme + "://[REDACTED]@" + u.Host + u.Path
+	}
+	return value
+}
+
+func sortedNames(values map[string]string) []string {
+	names := make([]string, 0, len(values))
+	for name := range values {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
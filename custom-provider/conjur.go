@@ -0,0 +1,224 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// conjurClient calls the Conjur Cloud REST API as the provider's managed identity, authenticating
+// with authn-azure or, with CONJUR_AUTHN_TYPE=jwt, with authn-jwt. It is configured by
+// CONJUR_APPLIANCE_URL, CONJUR_ACCOUNT, CONJUR_AUTHN_SERVICE_ID and CONJUR_AUTHN_LOGIN, and is used
+// both to read PCloud credentials and to manage conjurSecrets resources.
+type conjurClient struct {
+	applianceURL string
+	account      string
+	authnType    string
+	serviceID    string
+	login        string
+	// jwtAudience is the audience of the managed identity token sent to authn-jwt
+	jwtAudience string
+	client      *http.Client
+}
+
+// conjurAuthnTypes are the Conjur authenticators the provider can use
+var conjurAuthnTypes = []string{"azure", "jwt"}
+
+// defaultConjurJWTAudience is the audience Entra ID issues federated identity tokens for
+const defaultConjurJWTAudience = "api://AzureADTokenExchange"
+
+func newConjurClient() *conjurClient {
+	return &conjurClient{
+		applianceURL: strings.TrimSuffix(os.Getenv("CONJUR_APPLIANCE_URL"), "/"),
+		account:      getEnvOrDefault("CONJUR_ACCOUNT", "conjur"),
+		authnType:    strings.ToLower(getEnvOrDefault("CONJUR_AUTHN_TYPE", "azure")),
+		serviceID:    os.Getenv("CONJUR_AUTHN_SERVICE_ID"),
+		login:        os.Getenv("CONJUR_AUTHN_LOGIN"),
+		jwtAudience:  getEnvOrDefault("CONJUR_AUTHN_JWT_AUDIENCE", defaultConjurJWTAudience),
+		client:       newOutboundClient(10 * time.Second),
+	}
+}
+
+// missingSettings lists the environment variables the client still needs
+func (c *conjurClient) missingSettings() []string {
+	var missingVars []string
+	if c.applianceURL == "" {
+		missingVars = append(missingVars, "CONJUR_APPLIANCE_URL")
+	}
+	if !slices.Contains(conjurAuthnTypes, c.authnType) {
+		missingVars = append(missingVars, "CONJUR_AUTHN_TYPE (azure or jwt)")
+	}
+	if c.serviceID == "" {
+		missingVars = append(missingVars, "CONJUR_AUTHN_SERVICE_ID")
+	}
+	// authn-jwt can take the host from a claim of the token instead
+	if c.login == "" && c.authnType != "jwt" {
+		missingVars = append(missingVars, "CONJUR_AUTHN_LOGIN")
+	}
+	return missingVars
+}
+
+// conjurAccessToken is a Conjur access token; Conjur issues them for 8 minutes
+type conjurAccessToken struct {
+	token   string
+	expires time.Time
+}
+
+const conjurTokenLifetime = 8 * time.Minute
+
+var (
+	conjurTokenMu    sync.Mutex
+	conjurTokenCache = map[string]conjurAccessToken{}
+)
+
+func init() {
+	registerFlusher("conjurTokens", func() int {
+		conjurTokenMu.Lock()
+		defer conjurTokenMu.Unlock()
+		dropped := len(conjurTokenCache)
+		conjurTokenCache = map[string]conjurAccessToken{}
+		return dropped
+	})
+}
+
+// tokenKey identifies the client's cached access token
+func (c *conjurClient) tokenKey() string {
+	return c.applianceURL + "|" + c.account + "|" + c.authnType + "|" + c.login
+}
+
+// accessToken returns a cached access token with at least a minute left, or authenticates for a new one
+func (c *conjurClient) accessToken() (string, error) {
+	conjurTokenMu.Lock()
+	defer conjurTokenMu.Unlock()
+
+	if tok, ok := conjurTokenCache[c.tokenKey()]; ok && time.Until(tok.expires) > time.Minute {
+		return tok.token, nil
+	}
+	// The token is shared, so authenticating is bounded by PAM_CALL_TIMEOUT rather than by the
+	// context of the request that happens to hold the lock
+	ctx, cancel := policyFor("").attemptContext(context.Background())
+	defer cancel()
+	token, err := c.authenticate(ctx)
+	if err != nil {
+		return "", err
+	}
+	conjurTokenCache[c.tokenKey()] = conjurAccessToken{token: token, expires: time.Now().Add(conjurTokenLifetime)}
+	registerSensitiveValue(token)
+	return token, nil
+}
+
+// forgetAccessToken drops the cached access token after Conjur rejected it
+func (c *conjurClient) forgetAccessToken() {
+	conjurTokenMu.Lock()
+	defer conjurTokenMu.Unlock()
+	delete(conjurTokenCache, c.tokenKey())
+}
+
+// authenticate exchanges a managed identity token for a Conjur access token. authn-azure takes a
+// token for Azure Resource Manager and checks the identity against the host's annotations; authn-jwt
+// takes a token for jwtAudience (by default the one Entra ID federates), which works in tenants
+// without the Azure authenticator. When no login is set, authn-jwt finds the host from the token.
+func (c *conjurClient) authenticate(ctx context.Context) (string, error) {
+	resource := "https://management.azure.com/"
+	if c.authnType == "jwt" {
+		resource = c.jwtAudience
+	}
+	jwt, err := getManagedIdentityToken(resource)
+	if err != nil {
+		return "", fmt.Errorf("conjur authn-%s: %w", c.authnType, err)
+	}
+
+	authnURL := fmt.Sprintf("%s/authn-%s/%s/%s/%s/authenticate",
+		c.applianceURL, c.authnType, url.PathEscape(c.serviceID), url.PathEscape(c.account), url.PathEscape(c.login))
+	if c.login == "" {
+		authnURL = fmt.Sprintf("%s/authn-%s/%s/%s/authenticate",
+			c.applianceURL, c.authnType, url.PathEscape(c.serviceID), url.PathEscape(c.account))
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, authnURL, strings.NewReader("jwt="+jwt))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept-Encoding", "base64")
+
+	body, _, err := c.do(req)
+	if err != nil && c.login == "" {
+		return "", fmt.Errorf("conjur authn-%s: %w", c.authnType, err)
+	}
+	if err != nil {
+		return "", fmt.Errorf("conjur authn-%s as %s: %w", c.authnType, c.login, err)
+	}
+	// Conjur returns the token base64 encoded when asked to, otherwise as raw JSON
+	if !strings.HasPrefix(strings.TrimSpace(string(body)), "{") {
+		return strings.TrimSpace(string(body)), nil
+	}
+	return base64.StdEncoding.EncodeToString(body), nil
+}
+
+// request calls the Conjur API at path (relative to the appliance URL) with an access token. When
+// Conjur rejects a cached token it authenticates again and retries once. It returns the response
+// body and status; statuses of 300 and above are returned with an error. Each call is bounded by
+// PAM_CALL_TIMEOUT as well as ctx; authenticating is bounded by PAM_CALL_TIMEOUT only, as the
+// access token is shared.
+func (c *conjurClient) request(ctx context.Context, method, path, contentType, body string) ([]byte, int, error) {
+	for attempt := 1; ; attempt++ {
+		token, err := c.accessToken()
+		if err != nil {
+			return nil, 0, err
+		}
+		callCtx, cancel := policyFor("").attemptContext(ctx)
+		defer cancel()
+		req, err := http.NewRequestWithContext(callCtx, method, c.applianceURL+path, strings.NewReader(body))
+		if err != nil {
+			return nil, 0, err
+		}
+		req.Header.Set("Authorization", fmt.Sprintf("Token token=%q", token))
+		if contentType != "" {
+			req.Header.Set("Content-Type", contentType)
+		}
+
+		respBody, status, err := c.do(req)
+		if status == http.StatusUnauthorized && attempt == 1 {
+			log.Printf("DEBUG: Conjur rejected the access token for %s, authenticating again", c.login)
+			c.forgetAccessToken()
+			continue
+		}
+		return respBody, status, err
+	}
+}
+
+// secret reads the current value of a Conjur variable
+func (c *conjurClient) secret(ctx context.Context, variable string) (string, error) {
+	body, _, err := c.request(ctx, http.MethodGet, fmt.Sprintf("/secrets/%s/variable/%s", url.PathEscape(c.account), url.PathEscape(variable)), "", "")
+	if err != nil {
+		return "", err
+	}
+	return string(body), nil
+}
+
+func (c *conjurClient) do(req *http.Request) ([]byte, int, error) {
+	injectTraceparent(req)
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, resp.StatusCode, err
+	}
+	if resp.StatusCode >= 300 {
+		return body, resp.StatusCode, fmt.Errorf("%s %s returned status %d: %s", req.Method, req.URL.Path, resp.StatusCode, strings.TrimSpace(string(body)))
+	}
+	return body, resp.StatusCode, nil
+}
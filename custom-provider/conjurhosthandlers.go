@@ -0,0 +1,381 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+)
+
+// conjurHosts resources are Conjur Cloud host identities, the workload identities applications
+// deployed by a template authenticate as. The resource name is the host's ID within its policy
+// branch, properties.policyBranch (default CONJUR_HOSTS_POLICY_BRANCH, which also bounds the
+// branches templates may use). Hosts are declared by loading policy into the branch, and each of
+// properties.variables is granted read and execute, so the host can fetch its value. Grants
+// removed from the template are denied again; the variables granted are kept in the resource record,
+// as Conjur does not list a host's privileges. The host's API key is never returned: hosts are meant
+// to authenticate with an authenticator, such as authn-jwt or authn-azure, set up through annotations.
+
+// ConjurHostRequest represents the request to create or update a Conjur host
+type ConjurHostRequest struct {
+	Properties ConjurHostProperties `json:"properties"`
+}
+
+// ConjurHostProperties is the properties schema of the conjurHosts resource type
+type ConjurHostProperties struct {
+	PolicyBranch string            `json:"policyBranch,omitempty" validate:"max=255,pattern=conjurPolicyBranch"`
+	Annotations  map[string]string `json:"annotations,omitempty"`
+	// Variables are the full IDs of the variables the host may read, e.g. data/apps/db-password
+	Variables []string `json:"variables,omitempty" validate:"max=255,pattern=conjurVariableId"`
+}
+
+// ConjurHostResourceProperties is the properties of a conjurHosts resource returned to ARM
+type ConjurHostResourceProperties struct {
+	HostID            string            `json:"hostId"`
+	PolicyBranch      string            `json:"policyBranch"`
+	Annotations       map[string]string `json:"annotations,omitempty"`
+	Variables         []string          `json:"variables"`
+	ProvisioningState string            `json:"provisioningState"`
+}
+
+var errConjurHostNotFound = errors.New("conjur host not found")
+
+// conjurHostVariables is the Declared key of the variables a host was granted
+const conjurHostVariables = "variables"
+
+// handleConjurHost routes conjurHosts requests to the appropriate handlers
+func handleConjurHost(w http.ResponseWriter, r *http.Request, cpRequest CustomProviderRequestPath) {
+	LogRequestDebug("ConjurHost", r)
+
+	switch r.Method {
+	case "PUT":
+		provision(w, r, cpRequest, handlePutConjurHost)
+	case "GET":
+		handleGetConjurHost(w, r, cpRequest)
+	case "DELETE":
+		handleDeleteConjurHost(w, r, cpRequest)
+	default:
+		sendJSONError(w, http.StatusMethodNotAllowed, "MethodNotAllowed", fmt.Sprintf("Method %s is not supported for conjurHosts", r.Method))
+	}
+}
+
+// conjurHostsRootBranch is the policy branch conjurHosts live in or under
+func conjurHostsRootBranch() string {
+	return strings.Trim(getEnvOrDefault("CONJUR_HOSTS_POLICY_BRANCH", "data"), "/")
+}
+
+// resolveConjurHost returns the policy branch and host ID a conjurHosts resource points at, and
+// the variables it was granted: the ones recorded when it was written, else the resource name in
+// the default branch
+func resolveConjurHost(cpRequest CustomProviderRequestPath) (string, string, []string) {
+	if rec, found, err := stateStore.Get(cpRequest.ID()); err == nil && found && rec.SafeName != "" && rec.PCloudID != "" {
+		return rec.SafeName, rec.PCloudID, recordedHostVariables(rec)
+	}
+	branch := conjurHostsRootBranch()
+	return branch, branch + "/" + cpRequest.ResourceInstanceName, nil
+}
+
+// recordedHostVariables returns the variables a record says its host was granted
+func recordedHostVariables(rec ResourceRecord) []string {
+	if rec.Declared[conjurHostVariables] == "" {
+		return nil
+	}
+	return strings.Split(rec.Declared[conjurHostVariables], ",")
+}
+
+// conjurHostPath is the Conjur API path of a host's metadata
+func conjurHostPath(client *conjurClient, hostID string) string {
+	return fmt.Sprintf("/resources/%s/host/%s", url.PathEscape(client.account), url.PathEscape(hostID))
+}
+
+// getConjurHost reads a host's metadata; errConjurHostNotFound when it does not exist
+func getConjurHost(ctx context.Context, client *conjurClient, hostID string) (conjurResource, error) {
+	var resource conjurResource
+	body, status, err := client.request(ctx, http.MethodGet, conjurHostPath(client, hostID), "", "")
+	if status == http.StatusNotFound {
+		return resource, fmt.Errorf("%w: %s", errConjurHostNotFound, hostID)
+	}
+	if err != nil {
+		return resource, fmt.Errorf("failed to get Conjur host %s: %w", hostID, err)
+	}
+	if err := json.Unmarshal(body, &resource); err != nil {
+		return resource, fmt.Errorf("failed to parse Conjur host %s: %w", hostID, err)
+	}
+	return resource, nil
+}
+
+// conjurHostPolicy declares a host with its annotations, grants it read and execute on grant and
+// takes them back on revoke. Variable IDs are absolute, as they may live outside the host's branch.
+func conjurHostPolicy(name string, annotations map[string]string, grant, revoke []string) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "- !host\n  id: %s\n", yamlString(name))
+	if len(annotations) > 0 {
+		keys := make([]string, 0, len(annotations))
+		for key := range annotations {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		b.WriteString("  annotations:\n")
+		for _, key := range keys {
+			fmt.Fprintf(&b, "    %s: %s\n", yamlString(key), yamlString(annotations[key]))
+		}
+	}
+	for _, variable := range grant {
+		fmt.Fprintf(&b, "- !permit\n  role: !host %s\n  privileges: [read, execute]\n  resource: !variable %s\n", yamlString(name), yamlString("/"+variable))
+	}
+	for _, variable := range revoke {
+		fmt.Fprintf(&b, "- !deny\n  role: !host %s\n  privileges: [read, execute]\n  resource: !variable %s\n", yamlString(name), yamlString("/"+variable))
+	}
+	return b.String()
+}
+
+// diffHostVariables returns the variables to grant and to revoke to go from granted to wanted
+func diffHostVariables(granted, wanted []string) (grant, revoke []string) {
+	had := map[string]bool{}
+	for _, variable := range granted {
+		had[variable] = true
+	}
+	want := map[string]bool{}
+	for _, variable := range wanted {
+		if !want[variable] && !had[variable] {
+			grant = append(grant, variable)
+		}
+		want[variable] = true
+	}
+	for _, variable := range granted {
+		if !want[variable] {
+			revoke = append(revoke, variable)
+		}
+	}
+	return grant, revoke
+}
+
+// conjurHostResponse shapes a Conjur host as a conjurHosts resource
+func conjurHostResponse(cpRequest CustomProviderRequestPath, branch, hostID string, resource conjurResource, variables []string) (CustomProviderResponse, error) {
+	sorted := append([]string{}, variables...)
+	sort.Strings(sorted)
+	properties, err := toProperties(ConjurHostResourceProperties{
+		HostID:            hostID,
+		PolicyBranch:      branch,
+		Annotations:       annotationsOf(resource),
+		Variables:         sorted,
+		ProvisioningState: "Succeeded",
+	})
+	if err != nil {
+		return CustomProviderResponse{}, err
+	}
+	return CustomProviderResponse{
+		ID:         cpRequest.ID(),
+		Name:       cpRequest.ResourceInstanceName,
+		Type:       fmt.Sprintf("Microsoft.CustomProviders/resourceProviders/%s", cpRequest.ResourceTypeName),
+		Properties: properties,
+	}, nil
+}
+
+// handlePutConjurHost declares the host in its policy branch, updates its annotations and grants
+// it the listed variables, taking back the variables dropped from the template
+func handlePutConjurHost(w http.ResponseWriter, r *http.Request, cpRequest CustomProviderRequestPath) {
+	LogRequestDebug("PutConjurHost", r)
+
+	name := cpRequest.ResourceInstanceName
+	if !conjurVariableName.MatchString(name) {
+		sendJSONError(w, http.StatusBadRequest, "ResourceNameMalformed", "resource name must be 1-120 letters, digits, '.', '_' or '-' and must not start with '.'")
+		return
+	}
+
+	var request ConjurHostRequest
+	if err := decodeRequestBody(r, &request); err != nil {
+		var unknownErr *UnknownPropertiesError
+		if errors.As(err, &unknownErr) {
+			sendJSONError(w, http.StatusBadRequest, "UnknownProperties", err.Error())
+			return
+		}
+		sendJSONError(w, http.StatusBadRequest, "InvalidRequestBody", fmt.Sprintf("Invalid request body: %v", err))
+		return
+	}
+	if details := validateRequest(request); len(details) > 0 {
+		sendValidationError(w, details)
+		return
+	}
+
+	root := conjurHostsRootBranch()
+	branch := strings.Trim(request.Properties.PolicyBranch, "/")
+	if branch == "" {
+		branch = root
+	}
+	if branch != root && !strings.HasPrefix(branch, root+"/") {
+		sendJSONError(w, http.StatusBadRequest, "InvalidPolicyBranch", fmt.Sprintf("properties.policyBranch %q must be %s or a branch under it", branch, root))
+		return
+	}
+	hostID := branch + "/" + name
+	var granted []string
+	rec, found, err := stateStore.Get(cpRequest.ID())
+	if err == nil && found && rec.PCloudID != "" {
+		if rec.PCloudID != hostID {
+			sendJSONError(w, http.StatusBadRequest, "InvalidPolicyBranch", fmt.Sprintf("properties.policyBranch cannot be changed from %s; delete and recreate the resource instead", rec.SafeName))
+			return
+		}
+		granted = recordedHostVariables(rec)
+	}
+
+	stopAuth := startPhase(r, "auth")
+	client, err := conjurSecretClient()
+	stopAuth()
+	if err != nil {
+		sendJSONError(w, http.StatusInternalServerError, "ConjurNotConfigured", err.Error())
+		return
+	}
+
+	stopConjur := startPhase(r, "conjur")
+	defer stopConjur()
+
+	code := http.StatusOK
+	resource, err := getConjurHost(r.Context(), client, hostID)
+	switch {
+	case errors.Is(err, errConjurHostNotFound):
+		// POST only adds to the branch, so loading it cannot remove anything declared elsewhere
+		grant, _ := diffHostVariables(nil, request.Properties.Variables)
+		span := startSpan(r, "LoadConjurPolicy")
+		_, status, err := client.request(r.Context(), http.MethodPost, conjurPolicyPath(client, branch), "application/x-yaml", conjurHostPolicy(name, request.Properties.Annotations, grant, nil))
+		span.End(err)
+		if err != nil {
+			sendJSONError(w, http.StatusConflict, "ConjurHostError", fmt.Sprintf("Failed to declare Conjur host %s: (%d) %v", hostID, status, err))
+			return
+		}
+		log.Printf("INFO: (PutConjurHost) declared Conjur host %s with %d variables", hostID, len(grant))
+		code = http.StatusCreated
+	case err != nil:
+		sendJSONError(w, http.StatusConflict, "ConjurHostError", err.Error())
+		return
+	default:
+		// A host not written by the provider may hold grants it does not know of; granting again is harmless
+		grant, revoke := diffHostVariables(granted, request.Properties.Variables)
+		if !found {
+			grant = request.Properties.Variables
+		}
+		annotationsChanged := len(request.Properties.Annotations) > 0 && !annotationsMatch(annotationsOf(resource), request.Properties.Annotations)
+		if len(grant) == 0 && len(revoke) == 0 && !annotationsChanged {
+			break
+		}
+		span := startSpan(r, "UpdateConjurPolicy")
+		_, status, err := client.request(r.Context(), http.MethodPatch, conjurPolicyPath(client, branch), "application/x-yaml", conjurHostPolicy(name, request.Properties.Annotations, grant, revoke))
+		span.End(err)
+		if err != nil {
+			sendJSONError(w, http.StatusConflict, "ConjurHostError", fmt.Sprintf("Failed to update Conjur host %s: (%d) %v", hostID, status, err))
+			return
+		}
+		log.Printf("INFO: (PutConjurHost) updated Conjur host %s: %d variables granted, %d revoked", hostID, len(grant), len(revoke))
+		if resource, err = getConjurHost(r.Context(), client, hostID); err != nil {
+			sendJSONError(w, http.StatusConflict, "ConjurHostError", err.Error())
+			return
+		}
+	}
+
+	variables, _ := diffHostVariables(nil, request.Properties.Variables)
+	sort.Strings(variables)
+	record := ResourceRecord{
+		ResourceID:   cpRequest.ID(),
+		ResourceType: cpRequest.ResourceTypeName,
+		SafeName:     branch,
+		PCloudID:     hostID,
+		Deployment:   newDeploymentStamp(r),
+	}
+	if len(variables) > 0 {
+		record.Declared = map[string]string{conjurHostVariables: strings.Join(variables, ",")}
+	}
+	recordResource(record)
+
+	if code == http.StatusCreated {
+		// The policy load answered with the host's API key, which is not kept; read the host back instead
+		if resource, err = getConjurHost(r.Context(), client, hostID); err != nil {
+			sendJSONError(w, http.StatusConflict, "ConjurHostError", err.Error())
+			return
+		}
+	}
+	response, err := conjurHostResponse(cpRequest, branch, hostID, resource, variables)
+	if err != nil {
+		sendJSONError(w, http.StatusInternalServerError, "ConjurHostMarshalError", err.Error())
+		return
+	}
+	sendJSONResource(w, r, code, response)
+}
+
+// handleGetConjurHost returns a Conjur host's metadata with the variables it was granted
+func handleGetConjurHost(w http.ResponseWriter, r *http.Request, cpRequest CustomProviderRequestPath) {
+	LogRequestDebug("GetConjurHost", r)
+
+	client, err := conjurSecretClient()
+	if err != nil {
+		sendJSONError(w, http.StatusInternalServerError, "ConjurNotConfigured", err.Error())
+		return
+	}
+	branch, hostID, variables := resolveConjurHost(cpRequest)
+
+	stopConjur := startPhase(r, "conjur")
+	resource, err := getConjurHost(r.Context(), client, hostID)
+	stopConjur()
+	if errors.Is(err, errConjurHostNotFound) {
+		sendJSONError(w, http.StatusNotFound, "ResourceNotFound", err.Error())
+		return
+	}
+	if err != nil {
+		sendJSONError(w, http.StatusConflict, "ConjurHostError", err.Error())
+		return
+	}
+
+	response, err := conjurHostResponse(cpRequest, branch, hostID, resource, variables)
+	if err != nil {
+		sendJSONError(w, http.StatusInternalServerError, "ConjurHostMarshalError", err.Error())
+		return
+	}
+	sendJSONResource(w, r, http.StatusOK, response)
+}
+
+// handleDeleteConjurHost removes the host, and with it its grants and API key, from its policy branch
+func handleDeleteConjurHost(w http.ResponseWriter, r *http.Request, cpRequest CustomProviderRequestPath) {
+	LogRequestDebug("DeleteConjurHost", r)
+
+	client, err := conjurSecretClient()
+	if err != nil {
+		sendJSONError(w, http.StatusInternalServerError, "ConjurNotConfigured", err.Error())
+		return
+	}
+	branch, hostID, _ := resolveConjurHost(cpRequest)
+
+	stopConjur := startPhase(r, "conjur")
+	defer stopConjur()
+
+	if _, err := getConjurHost(r.Context(), client, hostID); errors.Is(err, errConjurHostNotFound) {
+		forgetResource(cpRequest.ID())
+		sendJSONError(w, http.StatusNotFound, "ResourceNotFound", err.Error())
+		return
+	} else if err != nil {
+		sendJSONError(w, http.StatusConflict, "ConjurHostDeletionError", err.Error())
+		return
+	}
+
+	span := startSpan(r, "DeleteConjurHost")
+	err = deleteConjurHost(r.Context(), client, branch, hostID)
+	span.End(err)
+	if err != nil {
+		sendJSONError(w, http.StatusConflict, "ConjurHostDeletionError", err.Error())
+		return
+	}
+	log.Printf("INFO: (DeleteConjurHost) deleted Conjur host %s", hostID)
+	forgetResource(cpRequest.ID())
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// deleteConjurHost deletes a host by updating its policy branch
+func deleteConjurHost(ctx context.Context, client *conjurClient, branch, hostID string) error {
+	policy := fmt.Sprintf("- !delete\n  record: !host %s\n", yamlString(strings.TrimPrefix(hostID, branch+"/")))
+	if _, status, err := client.request(ctx, http.MethodPatch, conjurPolicyPath(client, branch), "application/x-yaml", policy); err != nil {
+		return fmt.Errorf("failed to delete Conjur host %s: (%d) %w", hostID, status, err)
+	}
+	return nil
+}
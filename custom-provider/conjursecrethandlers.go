@@ -0,0 +1,394 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// conjurSecrets resources are Conjur Cloud variables. The resource name is the variable's ID within
+// its policy branch, properties.policyBranch (default CONJUR_SECRETS_POLICY_BRANCH, which also bounds
+// the branches templates may use). Variables are declared by loading policy into the branch, so the
+// provider's Conjur host needs create and update on it, and update on the variables to set values.
+// The value is write-only: GET reports the variable's version, never the value.
+
+// ConjurSecretRequest represents the request to create or update a Conjur variable
+type ConjurSecretRequest struct {
+	Properties ConjurSecretProperties `json:"properties"`
+}
+
+// ConjurSecretProperties is the properties schema of the conjurSecrets resource type
+type ConjurSecretProperties struct {
+	PolicyBranch string            `json:"policyBranch,omitempty" validate:"max=255,pattern=conjurPolicyBranch"`
+	Value        string            `json:"value,omitempty"`
+	Annotations  map[string]string `json:"annotations,omitempty"`
+}
+
+// ConjurSecretResourceProperties is the properties of a conjurSecrets resource returned to ARM
+type ConjurSecretResourceProperties struct {
+	VariableID   string            `json:"variableId"`
+	PolicyBranch string            `json:"policyBranch"`
+	Annotations  map[string]string `json:"annotations,omitempty"`
+	// Version is the variable's latest secret version, 0 while it has no value
+	Version           int    `json:"version"`
+	ProvisioningState string `json:"provisioningState"`
+}
+
+// conjurResource is a resource as returned by the Conjur resources API
+type conjurResource struct {
+	ID          string `json:"id"`
+	Annotations []struct {
+		Name  string `json:"name"`
+		Value string `json:"value"`
+	} `json:"annotations"`
+	Secrets []struct {
+		Version int `json:"version"`
+	} `json:"secrets"`
+}
+
+var errConjurSecretNotFound = errors.New("conjur variable not found")
+
+// conjurVariableName is the format of a conjurSecrets resource name
+var conjurVariableName = regexp.MustCompile(`^[A-Za-z0-9_-][A-Za-z0-9_.-]{0,119}$`)
+
+// handleConjurSecret routes conjurSecrets requests to the appropriate handlers
+func handleConjurSecret(w http.ResponseWriter, r *http.Request, cpRequest CustomProviderRequestPath) {
+	LogRequestDebug("ConjurSecret", r)
+
+	switch r.Method {
+	case "PUT":
+		provision(w, r, cpRequest, handlePutConjurSecret)
+	case "GET":
+		handleGetConjurSecret(w, r, cpRequest)
+	case "DELETE":
+		handleDeleteConjurSecret(w, r, cpRequest)
+	default:
+		sendJSONError(w, http.StatusMethodNotAllowed, "MethodNotAllowed", fmt.Sprintf("Method %s is not supported for conjurSecrets", r.Method))
+	}
+}
+
+// conjurSecretsRootBranch is the policy branch conjurSecrets live in or under
+func conjurSecretsRootBranch() string {
+	return strings.Trim(getEnvOrDefault("CONJUR_SECRETS_POLICY_BRANCH", "data"), "/")
+}
+
+// conjurSecretClient returns the Conjur client, or an error naming the missing settings
+func conjurSecretClient() (*conjurClient, error) {
+	client := newConjurClient()
+	if missing := client.missingSettings(); len(missing) > 0 {
+		return nil, fmt.Errorf("conjurSecrets need Conjur settings, missing %v", missing)
+	}
+	return client, nil
+}
+
+// resolveConjurVariable returns the policy branch and variable ID a conjurSecrets resource points
+// at: the ones recorded when it was created, else the resource name in the default branch
+func resolveConjurVariable(cpRequest CustomProviderRequestPath) (string, string) {
+	if rec, found, err := stateStore.Get(cpRequest.ID()); err == nil && found && rec.SafeName != "" && rec.PCloudID != "" {
+		return rec.SafeName, rec.PCloudID
+	}
+	branch := conjurSecretsRootBranch()
+	return branch, branch + "/" + cpRequest.ResourceInstanceName
+}
+
+// conjurResourcePath is the Conjur API path of a variable's metadata
+func conjurResourcePath(client *conjurClient, variableID string) string {
+	return fmt.Sprintf("/resources/%s/variable/%s", url.PathEscape(client.account), url.PathEscape(variableID))
+}
+
+// conjurSecretPath is the Conjur API path of a variable's value
+func conjurSecretPath(client *conjurClient, variableID string) string {
+	return fmt.Sprintf("/secrets/%s/variable/%s", url.PathEscape(client.account), url.PathEscape(variableID))
+}
+
+// conjurPolicyPath is the Conjur API path of a policy branch
+func conjurPolicyPath(client *conjurClient, branch string) string {
+	return fmt.Sprintf("/policies/%s/policy/%s", url.PathEscape(client.account), url.PathEscape(branch))
+}
+
+// getConjurVariable reads a variable's metadata; errConjurSecretNotFound when it does not exist
+func getConjurVariable(ctx context.Context, client *conjurClient, variableID string) (conjurResource, error) {
+	var resource conjurResource
+	body, status, err := client.request(ctx, http.MethodGet, conjurResourcePath(client, variableID), "", "")
+	if status == http.StatusNotFound {
+		return resource, fmt.Errorf("%w: %s", errConjurSecretNotFound, variableID)
+	}
+	if err != nil {
+		return resource, fmt.Errorf("failed to get Conjur variable %s: %w", variableID, err)
+	}
+	if err := json.Unmarshal(body, &resource); err != nil {
+		return resource, fmt.Errorf("failed to parse Conjur variable %s: %w", variableID, err)
+	}
+	return resource, nil
+}
+
+// yamlString quotes s for policy YAML; a JSON string is a valid YAML double-quoted scalar
+func yamlString(s string) string {
+	quoted, _ := json.Marshal(s)
+	return string(quoted)
+}
+
+// conjurVariablePolicy declares a variable with its annotations
+func conjurVariablePolicy(name string, annotations map[string]string) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "- !variable\n  id: %s\n", yamlString(name))
+	if len(annotations) > 0 {
+		keys := make([]string, 0, len(annotations))
+		for key := range annotations {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		b.WriteString("  annotations:\n")
+		for _, key := range keys {
+			fmt.Fprintf(&b, "    %s: %s\n", yamlString(key), yamlString(annotations[key]))
+		}
+	}
+	return b.String()
+}
+
+// annotationsOf returns a variable's annotations as a map
+func annotationsOf(resource conjurResource) map[string]string {
+	annotations := map[string]string{}
+	for _, a := range resource.Annotations {
+		annotations[a.Name] = a.Value
+	}
+	return annotations
+}
+
+// conjurSecretResponse shapes a Conjur variable as a conjurSecrets resource
+func conjurSecretResponse(cpRequest CustomProviderRequestPath, branch, variableID string, resource conjurResource) (CustomProviderResponse, error) {
+	version := 0
+	for _, secret := range resource.Secrets {
+		if secret.Version > version {
+			version = secret.Version
+		}
+	}
+	properties, err := toProperties(ConjurSecretResourceProperties{
+		VariableID:        variableID,
+		PolicyBranch:      branch,
+		Annotations:       annotationsOf(resource),
+		Version:           version,
+		ProvisioningState: "Succeeded",
+	})
+	if err != nil {
+		return CustomProviderResponse{}, err
+	}
+	return CustomProviderResponse{
+		ID:         cpRequest.ID(),
+		Name:       cpRequest.ResourceInstanceName,
+		Type:       fmt.Sprintf("Microsoft.CustomProviders/resourceProviders/%s", cpRequest.ResourceTypeName),
+		Properties: properties,
+	}, nil
+}
+
+// handlePutConjurSecret declares the variable in its policy branch, updates its annotations and
+// sets its value when the value changed
+func handlePutConjurSecret(w http.ResponseWriter, r *http.Request, cpRequest CustomProviderRequestPath) {
+	LogRequestDebug("PutConjurSecret", r)
+
+	name := cpRequest.ResourceInstanceName
+	if !conjurVariableName.MatchString(name) {
+		sendJSONError(w, http.StatusBadRequest, "ResourceNameMalformed", "resource name must be 1-120 letters, digits, '.', '_' or '-' and must not start with '.'")
+		return
+	}
+
+	var request ConjurSecretRequest
+	if err := decodeRequestBody(r, &request); err != nil {
+		var unknownErr *UnknownPropertiesError
+		if errors.As(err, &unknownErr) {
+			sendJSONError(w, http.StatusBadRequest, "UnknownProperties", err.Error())
+			return
+		}
+		sendJSONError(w, http.StatusBadRequest, "InvalidRequestBody", fmt.Sprintf("Invalid request body: %v", err))
+		return
+	}
+	if details := validateRequest(request); len(details) > 0 {
+		sendValidationError(w, details)
+		return
+	}
+	if request.Properties.Value != "" {
+		registerSensitiveValue(request.Properties.Value)
+	}
+
+	root := conjurSecretsRootBranch()
+	branch := strings.Trim(request.Properties.PolicyBranch, "/")
+	if branch == "" {
+		branch = root
+	}
+	if branch != root && !strings.HasPrefix(branch, root+"/") {
+		sendJSONError(w, http.StatusBadRequest, "InvalidPolicyBranch", fmt.Sprintf("properties.policyBranch %q must be %s or a branch under it", branch, root))
+		return
+	}
+	variableID := branch + "/" + name
+	if rec, found, err := stateStore.Get(cpRequest.ID()); err == nil && found && rec.PCloudID != "" && rec.PCloudID != variableID {
+		sendJSONError(w, http.StatusBadRequest, "InvalidPolicyBranch", fmt.Sprintf("properties.policyBranch cannot be changed from %s; delete and recreate the resource instead", rec.SafeName))
+		return
+	}
+
+	stopAuth := startPhase(r, "auth")
+	client, err := conjurSecretClient()
+	stopAuth()
+	if err != nil {
+		sendJSONError(w, http.StatusInternalServerError, "ConjurNotConfigured", err.Error())
+		return
+	}
+
+	stopConjur := startPhase(r, "conjur")
+	defer stopConjur()
+
+	code := http.StatusOK
+	resource, err := getConjurVariable(r.Context(), client, variableID)
+	switch {
+	case errors.Is(err, errConjurSecretNotFound):
+		// POST only adds to the branch, so loading it cannot remove anything declared elsewhere
+		span := startSpan(r, "LoadConjurPolicy")
+		_, status, err := client.request(r.Context(), http.MethodPost, conjurPolicyPath(client, branch), "application/x-yaml", conjurVariablePolicy(name, request.Properties.Annotations))
+		span.End(err)
+		if err != nil {
+			sendJSONError(w, http.StatusConflict, "ConjurSecretError", fmt.Sprintf("Failed to declare Conjur variable %s: (%d) %v", variableID, status, err))
+			return
+		}
+		log.Printf("INFO: (PutConjurSecret) declared Conjur variable %s", variableID)
+		code = http.StatusCreated
+	case err != nil:
+		sendJSONError(w, http.StatusConflict, "ConjurSecretError", err.Error())
+		return
+	case len(request.Properties.Annotations) > 0 && !annotationsMatch(annotationsOf(resource), request.Properties.Annotations):
+		span := startSpan(r, "UpdateConjurPolicy")
+		_, status, err := client.request(r.Context(), http.MethodPatch, conjurPolicyPath(client, branch), "application/x-yaml", conjurVariablePolicy(name, request.Properties.Annotations))
+		span.End(err)
+		if err != nil {
+			sendJSONError(w, http.StatusConflict, "ConjurSecretError", fmt.Sprintf("Failed to update annotations of Conjur variable %s: (%d) %v", variableID, status, err))
+			return
+		}
+		log.Printf("INFO: (PutConjurSecret) updated annotations of Conjur variable %s", variableID)
+	}
+
+	if request.Properties.Value != "" {
+		// Setting the same value again would add a version on every deployment
+		current, err := client.secret(r.Context(), variableID)
+		if err != nil || current != request.Properties.Value {
+			span := startSpan(r, "SetConjurSecret")
+			_, status, err := client.request(r.Context(), http.MethodPost, conjurSecretPath(client, variableID), "text/plain", request.Properties.Value)
+			span.End(err)
+			if err != nil {
+				sendJSONError(w, http.StatusConflict, "ConjurSecretError", fmt.Sprintf("Failed to set the value of Conjur variable %s: (%d) %v", variableID, status, err))
+				return
+			}
+			log.Printf("INFO: (PutConjurSecret) set a new value for Conjur variable %s", variableID)
+		}
+	}
+
+	resource, err = getConjurVariable(r.Context(), client, variableID)
+	if err != nil {
+		sendJSONError(w, http.StatusConflict, "ConjurSecretError", err.Error())
+		return
+	}
+
+	recordResource(ResourceRecord{
+		ResourceID:   cpRequest.ID(),
+		ResourceType: cpRequest.ResourceTypeName,
+		SafeName:     branch,
+		PCloudID:     variableID,
+		Deployment:   newDeploymentStamp(r),
+	})
+
+	response, err := conjurSecretResponse(cpRequest, branch, variableID, resource)
+	if err != nil {
+		sendJSONError(w, http.StatusInternalServerError, "ConjurSecretMarshalError", err.Error())
+		return
+	}
+	sendJSONResource(w, r, code, response)
+}
+
+// annotationsMatch reports whether every wanted annotation is set to the wanted value
+func annotationsMatch(current, wanted map[string]string) bool {
+	for key, value := range wanted {
+		if current[key] != value {
+			return false
+		}
+	}
+	return true
+}
+
+// handleGetConjurSecret returns a Conjur variable's metadata
+func handleGetConjurSecret(w http.ResponseWriter, r *http.Request, cpRequest CustomProviderRequestPath) {
+	LogRequestDebug("GetConjurSecret", r)
+
+	client, err := conjurSecretClient()
+	if err != nil {
+		sendJSONError(w, http.StatusInternalServerError, "ConjurNotConfigured", err.Error())
+		return
+	}
+	branch, variableID := resolveConjurVariable(cpRequest)
+
+	stopConjur := startPhase(r, "conjur")
+	resource, err := getConjurVariable(r.Context(), client, variableID)
+	stopConjur()
+	if errors.Is(err, errConjurSecretNotFound) {
+		sendJSONError(w, http.StatusNotFound, "ResourceNotFound", err.Error())
+		return
+	}
+	if err != nil {
+		sendJSONError(w, http.StatusConflict, "ConjurSecretError", err.Error())
+		return
+	}
+
+	response, err := conjurSecretResponse(cpRequest, branch, variableID, resource)
+	if err != nil {
+		sendJSONError(w, http.StatusInternalServerError, "ConjurSecretMarshalError", err.Error())
+		return
+	}
+	sendJSONResource(w, r, http.StatusOK, response)
+}
+
+// handleDeleteConjurSecret removes the variable, and with it all its versions, from its policy branch
+func handleDeleteConjurSecret(w http.ResponseWriter, r *http.Request, cpRequest CustomProviderRequestPath) {
+	LogRequestDebug("DeleteConjurSecret", r)
+
+	client, err := conjurSecretClient()
+	if err != nil {
+		sendJSONError(w, http.StatusInternalServerError, "ConjurNotConfigured", err.Error())
+		return
+	}
+	branch, variableID := resolveConjurVariable(cpRequest)
+
+	stopConjur := startPhase(r, "conjur")
+	defer stopConjur()
+
+	if _, err := getConjurVariable(r.Context(), client, variableID); errors.Is(err, errConjurSecretNotFound) {
+		forgetResource(cpRequest.ID())
+		sendJSONError(w, http.StatusNotFound, "ResourceNotFound", err.Error())
+		return
+	} else if err != nil {
+		sendJSONError(w, http.StatusConflict, "ConjurSecretDeletionError", err.Error())
+		return
+	}
+
+	span := startSpan(r, "DeleteConjurVariable")
+	err = deleteConjurVariable(r.Context(), client, branch, variableID)
+	span.End(err)
+	if err != nil {
+		sendJSONError(w, http.StatusConflict, "ConjurSecretDeletionError", err.Error())
+		return
+	}
+	log.Printf("INFO: (DeleteConjurSecret) deleted Conjur variable %s", variableID)
+	forgetResource(cpRequest.ID())
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// deleteConjurVariable deletes a variable by updating its policy branch
+func deleteConjurVariable(ctx context.Context, client *conjurClient, branch, variableID string) error {
+	policy := fmt.Sprintf("- !delete\n  record: !variable %s\n", yamlString(strings.TrimPrefix(variableID, branch+"/")))
+	if _, status, err := client.request(ctx, http.MethodPatch, conjurPolicyPath(client, branch), "application/x-yaml", policy); err != nil {
+		return fmt.Errorf("failed to delete Conjur variable %s: (%d) %w", variableID, status, err)
+	}
+	return nil
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// createdResource is the PUT response of a resource the provider has just created
+type createdResource struct {
+	response CustomProviderResponse
+	expires  time.Time
+}
+
+// createdResourceCache keeps the responses of just-created safes and accounts, keyed by resource
+// ID. ARM GETs a resource right after its PUT succeeds, and PCloud search can take a while to list
+// a new account; answering those GETs from the cache keeps the deployment from seeing a 404.
+type createdResourceCache struct {
+	ttl       time.Duration
+	mu        sync.Mutex
+	resources map[string]createdResource
+}
+
+// recentlyCreated is shared by the handlers; CREATED_RESOURCE_TTL (default 2m, 0 disables) controls
+// how long a new resource is served from it
+var recentlyCreated = newCreatedResourceCache(createdResourceTTL())
+
+func init() {
+	registerFlusher("createdResources", recentlyCreated.Flush)
+}
+
+func createdResourceTTL() time.Duration {
+	ttl, err := time.ParseDuration(getEnvOrDefault("CREATED_RESOURCE_TTL", "2m"))
+	if err != nil {
+		log.Printf("WARNING: Invalid CREATED_RESOURCE_TTL, using 2m: %v", err)
+		return 2 * time.Minute
+	}
+	return ttl
+}
+
+func newCreatedResourceCache(ttl time.Duration) *createdResourceCache {
+	return &createdResourceCache{ttl: ttl, resources: map[string]createdResource{}}
+}
+
+// Put stores the response of a resource that was just created
+func (c *createdResourceCache) Put(response CustomProviderResponse) {
+	if c.ttl <= 0 {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.resources[stateKey(response.ID)] = createdResource{response: response, expires: time.Now().Add(c.ttl)}
+}
+
+// Get returns the stored response while it is fresh
+func (c *createdResourceCache) Get(resourceID string) (CustomProviderResponse, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	created, ok := c.resources[stateKey(resourceID)]
+	if !ok {
+		return CustomProviderResponse{}, false
+	}
+	if time.Now().After(created.expires) {
+		delete(c.resources, stateKey(resourceID))
+		return CustomProviderResponse{}, false
+	}
+	return created.response, true
+}
+
+// Forget drops a resource that was changed or deleted, so the next GET reads PCloud
+func (c *createdResourceCache) Forget(resourceID string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.resources, stateKey(resourceID))
+}
+
+// Flush drops every stored response and returns the number dropped
+func (c *createdResourceCache) Flush() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	dropped := len(c.resources)
+	c.resources = map[string]createdResource{}
+	return dropped
+}
+
+// serveRecentlyCreated answers a GET from the cache when the resource was created within the TTL
+func serveRecentlyCreated(w http.ResponseWriter, r *http.Request, cpRequest CustomProviderRequestPath) bool {
+	response, ok := recentlyCreated.Get(cpRequest.ID())
+	if !ok {
+		return false
+	}
+	log.Printf("DEBUG: Serving %s from the recently created resources", cpRequest.ID())
+	sendJSONResource(w, r, http.StatusOK, response)
+	return true
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestCreatedResourceCache(t *testing.T) {
+	const id = "/subscriptions/sub1/resourceGroups/rg1/providers/Microsoft.CustomProviders/resourceProviders/CyberArkProvider/accounts/safe1.root-web01"
+	response := CustomProviderResponse{ID: id, Name: "safe1.root-web01", Properties: map[string]interface{}{"accountId": "12_3"}}
+
+	cache := newCreatedResourceCache(time.Minute)
+	cache.Put(response)
+	if got, ok := cache.Get(stateKey(id)); !ok || got.Name != response.Name {
+		t.Fatalf("expected the stored response for a differently cased ID, got %+v %t", got, ok)
+	}
+	cache.Forget(id)
+	if _, ok := cache.Get(id); ok {
+		t.Error("expected no response after Forget")
+	}
+
+	cache.Put(response)
+	cache.resources[stateKey(id)] = createdResource{response: response, expires: time.Now().Add(-time.Second)}
+	if _, ok := cache.Get(id); ok {
+		t.Error("expected no response after the TTL")
+	}
+
+	disabled := newCreatedResourceCache(0)
+	disabled.Put(response)
+	if _, ok := disabled.Get(id); ok {
+		t.Error("expected nothing stored with a zero TTL")
+	}
+}
+
+func TestGetAccountServedAfterCreate(t *testing.T) {
+	t.Cleanup(func() { recentlyCreated.Flush() })
+
+	cpRequest := CustomProviderRequestPath{
+		Subscriptions:        "sub1",
+		ResourceGroups:       "rg1",
+		Providers:            "Microsoft.CustomProviders",
+		ResourceProviders:    "CyberArkProvider",
+		ResourceTypeName:     "accounts",
+		ResourceInstanceName: "safe1.root-web01",
+	}
+	recentlyCreated.Put(CustomProviderResponse{ID: cpRequest.ID(), Name: cpRequest.ResourceInstanceName, Properties: map[string]interface{}{"accountId": "12_3"}})
+
+	// No PCloud is configured, so the answer can only come from the cache
+	w := httptest.NewRecorder()
+	handleGetAccount(w, httptest.NewRequest(http.MethodGet, "/", nil), cpRequest)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", w.Code, w.Body.String())
+	}
+	var body CustomProviderResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil || body.Properties["accountId"] != "12_3" {
+		t.Errorf("expected the created account, got %s (%v)", w.Body.String(), err)
+	}
+}
@@ -0,0 +1,288 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// createPAMClient gets the PCloud connection settings and credentials from a credential source.
+// By default they are read from IDTENANTURL, PCLOUDURL, PAMUSER and PAMPASS. When KEYVAULT_URI is
+// set, each setting whose KEYVAULT_SECRET_{name} names a secret is read from Azure Key Vault; when
+// CONJUR_APPLIANCE_URL is set, the provider authenticates to Conjur Cloud with its Azure managed
+// identity (authn-azure, or authn-jwt) and reads each setting whose CONJUR_VAR_{name} names a Conjur variable,
+// e.g. CONJUR_VAR_PAMPASS=data/vault/pcloud/provider/password. Settings without one still come
+// from the environment.
+
+// pcloudCredentials are the settings createPAMClient needs to open a PCloud session
+type pcloudCredentials struct {
+	IDTenantURL string
+	PCloudURL   string
+	User        string
+	Password    string
+}
+
+// credentialSource supplies PCloud credentials
+type credentialSource interface {
+	// Name identifies the source in logs and the startup fingerprint
+	Name() string
+	// Check reports missing configuration without contacting any upstream
+	Check() error
+	// Credentials returns the current credentials
+	Credentials() (pcloudCredentials, error)
+	// Invalidate drops cached credentials after PCloud rejected them; it reports whether the
+	// next Credentials call can return different ones
+	Invalidate() bool
+	// Describe returns the source's configuration with secrets redacted
+	Describe() map[string]string
+}
+
+// credentialNames are the settings in pcloudCredentials, by environment variable name
+var credentialNames = []string{"IDTENANTURL", "PCLOUDURL", "PAMUSER", "PAMPASS"}
+
+var credentials = newCredentialSource()
+
+func newCredentialSource() credentialSource {
+	switch {
+	case os.Getenv("KEYVAULT_URI") != "":
+		if os.Getenv("CONJUR_APPLIANCE_URL") != "" {
+			log.Printf("WARNING: Both KEYVAULT_URI and CONJUR_APPLIANCE_URL are set, reading credentials from Key Vault")
+		}
+		return newKeyVaultCredentialSource()
+	case os.Getenv("CONJUR_APPLIANCE_URL") != "":
+		return newConjurCredentialSource()
+	default:
+		return envCredentialSource{}
+	}
+}
+
+// envCredentials returns the settings as they are set in the environment
+func envCredentials() pcloudCredentials {
+	var creds pcloudCredentials
+	for _, name := range credentialNames {
+		creds.set(name, os.Getenv(name))
+	}
+	return creds
+}
+
+// credentialCache holds credentials read from a secret store for a TTL. When the store cannot be
+// reached the last values are used until it can.
+type credentialCache struct {
+	source string
+	ttl    time.Duration
+
+	mu      sync.Mutex
+	cached  pcloudCredentials
+	fetched time.Time
+	stale   bool
+}
+
+func (c *credentialCache) get(fetch func() (pcloudCredentials, error)) (pcloudCredentials, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if !c.fetched.IsZero() && !c.stale && time.Since(c.fetched) < c.ttl {
+		return c.cached, nil
+	}
+	creds, err := fetch()
+	recordDependencyResult(c.source, err)
+	if err != nil {
+		if c.fetched.IsZero() {
+			return pcloudCredentials{}, err
+		}
+		log.Printf("WARNING: Could not refresh credentials from %s, using values from %s: %v", c.source, c.fetched.Format(time.RFC3339), err)
+		return c.cached, nil
+	}
+	c.cached = creds
+	c.fetched = time.Now()
+	c.stale = false
+	return creds, nil
+}
+
+// invalidate makes the next get read the store again
+func (c *credentialCache) invalidate() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.stale = true
+}
+
+// details describes the cache for the /healthex dependency report
+func (c *credentialCache) details() map[string]interface{} {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	details := map[string]interface{}{}
+	if !c.fetched.IsZero() {
+		details["credentialsAge"] = time.Since(c.fetched).Round(time.Second).String()
+	}
+	return details
+}
+
+// credentialsTTL reads a cache TTL setting
+func credentialsTTL(name string, fallback time.Duration) time.Duration {
+	ttl, err := time.ParseDuration(getEnvOrDefault(name, fallback.String()))
+	if err != nil {
+		log.Printf("WARNING: Invalid %s, using %s: %v", name, fallback, err)
+		return fallback
+	}
+	return ttl
+}
+
+// storedSettings maps each setting to the name of the secret holding it, read from {prefix}{setting}
+func storedSettings(prefix string) map[string]string {
+	stored := map[string]string{}
+	for _, name := range credentialNames {
+		if secret := os.Getenv(prefix + name); secret != "" {
+			stored[name] = secret
+		}
+	}
+	return stored
+}
+
+// missingSettings lists the settings that are neither stored nor set in the environment
+func missingSettings(prefix string, stored map[string]string) []string {
+	var missing []string
+	for _, name := range requiredCredentialNames() {
+		if stored[name] == "" && os.Getenv(name) == "" {
+			missing = append(missing, name+" (or "+prefix+name+")")
+		}
+	}
+	return missing
+}
+
+// describeSettings adds where each setting comes from to a source description
+func describeSettings(described map[string]string, stored map[string]string) map[string]string {
+	for _, name := range credentialNames {
+		if secret, ok := stored[name]; ok {
+			described[name] = described["type"] + ":" + secret
+		} else if name == "PAMUSER" || name == "PAMPASS" {
+			described[name] = redactSecret(os.Getenv(name))
+		} else {
+			described[name] = redactURL(os.Getenv(name))
+		}
+	}
+	return described
+}
+
+// set assigns a setting by its environment variable name
+func (c *pcloudCredentials) set(name, value string) {
+	switch name {
+	case "IDTENANTURL":
+		c.IDTenantURL = value
+	case "PCLOUDURL":
+		c.PCloudURL = value
+	case "PAMUSER":
+		c.User = value
+	case "PAMPASS":
+		c.Password = value
+	}
+}
+
+// envCredentialSource reads credentials from environment variables
+type envCredentialSource struct{}
+
+func (envCredentialSource) Name() string { return "env" }
+
+func (envCredentialSource) Check() error {
+	var missingVars []string
+	for _, varName := range requiredCredentialNames() {
+		if os.Getenv(varName) == "" {
+			missingVars = append(missingVars, varName)
+		}
+	}
+	if len(missingVars) > 0 {
+		return fmt.Errorf("missing required environment variables: %v", missingVars)
+	}
+	return nil
+}
+
+func (envCredentialSource) Credentials() (pcloudCredentials, error) {
+	return envCredentials(), nil
+}
+
+func (envCredentialSource) Invalidate() bool { return false }
+
+func (envCredentialSource) Describe() map[string]string {
+	return map[string]string{
+		"type":        "env",
+		"IDTENANTURL": redactURL(os.Getenv("IDTENANTURL")),
+		"PCLOUDURL":   redactURL(os.Getenv("PCLOUDURL")),
+		"PAMUSER":     redactSecret(os.Getenv("PAMUSER")),
+		"PAMPASS":     redactSecret(os.Getenv("PAMPASS")),
+	}
+}
+
+// conjurCredentialSource reads credentials from Conjur Cloud variables. Values are cached for
+// CONJUR_CREDENTIALS_TTL (default 5m) so every request does not authenticate to Conjur; when Conjur
+// cannot be reached the last values are used until it can.
+type conjurCredentialSource struct {
+	*conjurClient
+	// variables maps a setting (e.g. PAMPASS) to the Conjur variable holding it
+	variables map[string]string
+	cache     *credentialCache
+}
+
+func newConjurCredentialSource() *conjurCredentialSource {
+	s := &conjurCredentialSource{
+		conjurClient: newConjurClient(),
+		variables:    storedSettings("CONJUR_VAR_"),
+		cache:        &credentialCache{source: "conjur", ttl: credentialsTTL("CONJUR_CREDENTIALS_TTL", 5*time.Minute)},
+	}
+	registerDependency("conjur", func() map[string]interface{} {
+		details := s.cache.details()
+		details["login"] = s.login
+		details["variables"] = len(s.variables)
+		return details
+	})
+	return s
+}
+
+func (s *conjurCredentialSource) Name() string { return "conjur" }
+
+func (s *conjurCredentialSource) Check() error {
+	missingVars := s.missingSettings()
+	missingVars = append(missingVars, missingSettings("CONJUR_VAR_", s.variables)...)
+	if len(missingVars) > 0 {
+		return fmt.Errorf("missing required environment variables: %v", missingVars)
+	}
+	return nil
+}
+
+func (s *conjurCredentialSource) Credentials() (pcloudCredentials, error) {
+	return s.cache.get(s.fetch)
+}
+
+func (s *conjurCredentialSource) Invalidate() bool {
+	s.cache.invalidate()
+	return len(s.variables) > 0
+}
+
+// fetch authenticates to Conjur and reads every configured variable
+func (s *conjurCredentialSource) fetch() (pcloudCredentials, error) {
+	creds := envCredentials()
+	if len(s.variables) == 0 {
+		return creds, nil
+	}
+
+	for name, variable := range s.variables {
+		value, err := s.secret(context.Background(), variable)
+		if err != nil {
+			return creds, fmt.Errorf("failed to read %s from Conjur variable %s: %w", name, variable, err)
+		}
+		creds.set(name, value)
+	}
+	log.Printf("DEBUG: Read %d credential settings from Conjur as %s", len(s.variables), s.login)
+	return creds, nil
+}
+
+func (s *conjurCredentialSource) Describe() map[string]string {
+	return describeSettings(map[string]string{
+		"type":    "conjur",
+		"url":     redactURL(s.applianceURL),
+		"account": s.account,
+		"service": s.serviceID,
+		"login":   s.login,
+	}, s.variables)
+}
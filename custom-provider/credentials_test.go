@@ -0,0 +1,312 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestConjurCredentialSource(t *testing.T) {
+	authns := 0
+	failing := false
+	conjur := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path == "/identity":
+			w.Write([]byte(`{"access_token": "mi-token", "expires_on": "4102444800"}`))
+		case failing:
+			w.WriteHeader(http.StatusServiceUnavailable)
+		case r.URL.Path == "/authn-azure/prod/conjur/host/data/azure/provider/authenticate":
+			body, _ := io.ReadAll(r.Body)
+			if string(body) != "jwt=mi-token" {
+				t.Errorf("unexpected authn body %q", body)
+			}
+			authns++
+			w.Write([]byte("Y29uanVyLXRva2Vu"))
+		case strings.HasPrefix(r.URL.Path, "/secrets/conjur/variable/"):
+			if got := r.Header.Get("Authorization"); got != `Token token="Y29uanVyLXRva2Vu"` {
+				t.Errorf("unexpected Authorization %q", got)
+			}
+			w.Write([]byte("secret-of-" + strings.TrimPrefix(r.URL.Path, "/secrets/conjur/variable/")))
+		default:
+			t.Errorf("unexpected request %s", r.URL.Path)
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer conjur.Close()
+
+	resetTokens := func() {
+		miTokenMu.Lock()
+		miTokenCache = map[string]managedIdentityToken{}
+		miTokenMu.Unlock()
+	}
+	resetTokens()
+	defer resetTokens()
+
+	t.Setenv("IDENTITY_ENDPOINT", conjur.URL+"/identity")
+	t.Setenv("IDENTITY_HEADER", "test")
+	t.Setenv("CONJUR_APPLIANCE_URL", conjur.URL)
+	t.Setenv("CONJUR_AUTHN_SERVICE_ID", "prod")
+	t.Setenv("CONJUR_AUTHN_LOGIN", "host/data/azure/provider")
+	t.Setenv("CONJUR_VAR_PAMUSER", "pcloud/user")
+	t.Setenv("CONJUR_VAR_PAMPASS", "pcloud/password")
+	t.Setenv("IDTENANTURL", "https://tenant.id.cyberark.cloud")
+	t.Setenv("PCLOUDURL", "https://tenant.privilegecloud.cyberark.cloud")
+	t.Setenv("PAMUSER", "")
+	t.Setenv("PAMPASS", "")
+
+	source, ok := newCredentialSource().(*conjurCredentialSource)
+	if !ok {
+		t.Fatal("expected the Conjur credential source when CONJUR_APPLIANCE_URL is set")
+	}
+	if err := source.Check(); err != nil {
+		t.Fatalf("unexpected Check error: %v", err)
+	}
+
+	creds, err := source.Credentials()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := pcloudCredentials{
+		IDTenantURL: "https://tenant.id.cyberark.cloud",
+		PCloudURL:   "https://tenant.privilegecloud.cyberark.cloud",
+		User:        "secret-of-pcloud/user",
+		Password:    "secret-of-pcloud/password",
+	}
+	if creds != want {
+		t.Errorf("expected %+v, got %+v", want, creds)
+	}
+
+	// Cached within the TTL
+	if _, err := source.Credentials(); err != nil || authns != 1 {
+		t.Errorf("expected cached credentials, got %d authentications (err %v)", authns, err)
+	}
+
+	// Stale values are used while Conjur is down
+	source.cache.ttl = 0
+	failing = true
+	if creds, err := source.Credentials(); err != nil || creds != want {
+		t.Errorf("expected the last credentials while Conjur is down, got %+v (err %v)", creds, err)
+	}
+}
+
+func TestConjurCredentialSourceCheck(t *testing.T) {
+	t.Setenv("CONJUR_APPLIANCE_URL", "https://tenant.secretsmgr.cyberark.cloud/api")
+	t.Setenv("CONJUR_AUTHN_SERVICE_ID", "")
+	t.Setenv("CONJUR_AUTHN_LOGIN", "host/data/azure/provider")
+	t.Setenv("CONJUR_VAR_PAMPASS", "pcloud/password")
+	t.Setenv("PAMPASS", "")
+	t.Setenv("PAMUSER", "")
+
+	err := newConjurCredentialSource().Check()
+	if err == nil {
+		t.Fatal("expected missing configuration")
+	}
+	for _, want := range []string{"CONJUR_AUTHN_SERVICE_ID", "PAMUSER (or CONJUR_VAR_PAMUSER)"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("expected %q in %v", want, err)
+		}
+	}
+	if strings.Contains(err.Error(), "PAMPASS") {
+		t.Errorf("PAMPASS comes from Conjur and should not be reported missing: %v", err)
+	}
+}
+
+func TestKeyVaultCredentialsRefreshOnUnauthorized(t *testing.T) {
+	password := "old-password"
+	vaultUnauthorized := 1
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path == "/identity":
+			w.Write([]byte(`{"access_token": "mi-token", "expires_on": "4102444800"}`))
+		case strings.HasPrefix(r.URL.Path, "/secrets/"):
+			if vaultUnauthorized > 0 {
+				vaultUnauthorized--
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			switch r.URL.Path {
+			case "/secrets/pam-user":
+				w.Write([]byte(`{"value": "provider@cyberark.cloud"}`))
+			case "/secrets/pam-password":
+				w.Write([]byte(`{"value": "` + password + `"}`))
+			default:
+				w.WriteHeader(http.StatusNotFound)
+			}
+		case r.URL.Path == "/oauth2/platformtoken":
+			r.ParseForm()
+			if r.Form.Get("client_secret") != "new-password" {
+				w.WriteHeader(http.StatusUnauthorized)
+				w.Write([]byte(`{"error": "invalid_client", "error_description": "authentication failed"}`))
+				return
+			}
+			w.Write([]byte(`{"access_token": "pcloud-token", "token_type": "Bearer", "expires_in": 3600}`))
+		default:
+			t.Errorf("unexpected request %s", r.URL.Path)
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	resetTokens := func() {
+		miTokenMu.Lock()
+		miTokenCache = map[string]managedIdentityToken{}
+		miTokenMu.Unlock()
+	}
+	resetTokens()
+	defer resetTokens()
+
+	t.Setenv("IDENTITY_ENDPOINT", server.URL+"/identity")
+	t.Setenv("IDENTITY_HEADER", "test")
+	t.Setenv("KEYVAULT_URI", server.URL)
+	t.Setenv("KEYVAULT_SECRET_PAMUSER", "pam-user")
+	t.Setenv("KEYVAULT_SECRET_PAMPASS", "pam-password")
+	t.Setenv("IDTENANTURL", server.URL)
+	t.Setenv("PCLOUDURL", server.URL)
+
+	saved := credentials
+	defer func() { credentials = saved }()
+	credentials = newCredentialSource()
+	if credentials.Name() != "keyvault" {
+		t.Fatalf("expected the Key Vault credential source when KEYVAULT_URI is set, got %s", credentials.Name())
+	}
+
+	// The first Key Vault read is rejected and retried with a new managed identity token
+	creds, err := credentials.Credentials()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if creds.User != "provider@cyberark.cloud" || creds.Password != "old-password" {
+		t.Errorf("unexpected credentials %+v", creds)
+	}
+
+	// The password is rotated in Key Vault; PCloud rejects the cached one and the new one is read
+	password = "new-password"
+	client, err := createPAMClient()
+	if err != nil {
+		t.Fatalf("expected createPAMClient to read the rotated password: %v", err)
+	}
+	if client.Session == nil || client.Session.Token != "pcloud-token" {
+		t.Errorf("expected a PCloud session, got %+v", client.Session)
+	}
+}
+
+func TestPutKeyVaultSecret(t *testing.T) {
+	var stored map[string]interface{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path == "/identity":
+			w.Write([]byte(`{"access_token": "mi-token", "expires_on": "4102444800"}`))
+		case r.Method == http.MethodPut && r.URL.Path == "/secrets/app-password":
+			if r.Header.Get("Authorization") != "Bearer mi-token" {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			json.NewDecoder(r.Body).Decode(&stored)
+			w.Write([]byte(`{"id": "https://vault/secrets/app-password/v1", "value": "s3cret-value"}`))
+		default:
+			t.Errorf("unexpected request %s %s", r.Method, r.URL.Path)
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	miTokenMu.Lock()
+	miTokenCache = map[string]managedIdentityToken{}
+	miTokenMu.Unlock()
+	t.Setenv("IDENTITY_ENDPOINT", server.URL+"/identity")
+	t.Setenv("IDENTITY_HEADER", "test")
+
+	id, err := putKeyVaultSecret(server.URL, "app-password", "s3cret-value", map[string]string{"cyberarkAccountId": "12_3"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id != "https://vault/secrets/app-password/v1" {
+		t.Errorf("unexpected secret id %s", id)
+	}
+	if stored["value"] != "s3cret-value" || stored["tags"].(map[string]interface{})["cyberarkAccountId"] != "12_3" {
+		t.Errorf("unexpected secret written: %v", stored)
+	}
+}
+
+func TestValidKeyVaultURI(t *testing.T) {
+	tests := []struct {
+		uri   string
+		valid bool
+	}{
+		{"https://my-vault.vault.azure.net", true},
+		{"https://my-vault.vault.azure.net/", true},
+		{"https://my-vault.vault.usgovcloudapi.net", true},
+		{"http://my-vault.vault.azure.net", false},
+		{"https://my-vault.vault.azure.net.example.com", false},
+		{"https://my-vault.vault.azure.net:8443", false},
+		{"https://my-vault.vault.azure.net/secrets/x", false},
+		{"https://example.com", false},
+		{"", false},
+	}
+	for _, tt := range tests {
+		if err := validKeyVaultURI(tt.uri); (err == nil) != tt.valid {
+			t.Errorf("validKeyVaultURI(%q) = %v, want valid=%t", tt.uri, err, tt.valid)
+		}
+	}
+}
+
+func TestConjurAuthnJWT(t *testing.T) {
+	tests := []struct {
+		name         string
+		login        string
+		expectedPath string
+	}{
+		{name: "host from the token", login: "", expectedPath: "/authn-jwt/azure-jwt/conjur/authenticate"},
+		{name: "host from CONJUR_AUTHN_LOGIN", login: "host/data/azure/provider", expectedPath: "/authn-jwt/azure-jwt/conjur/host/data/azure/provider/authenticate"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var authnPath, audience string
+			conjur := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.URL.Path == "/identity" {
+					audience = r.URL.Query().Get("resource")
+					w.Write([]byte(`{"access_token": "federated-token", "expires_on": "4102444800"}`))
+					return
+				}
+				authnPath = r.URL.Path
+				if body, _ := io.ReadAll(r.Body); string(body) != "jwt=federated-token" {
+					t.Errorf("unexpected authn body %q", body)
+				}
+				w.Write([]byte("Y29uanVyLXRva2Vu"))
+			}))
+			defer conjur.Close()
+
+			resetTokens := func() {
+				miTokenMu.Lock()
+				miTokenCache = map[string]managedIdentityToken{}
+				miTokenMu.Unlock()
+			}
+			resetTokens()
+			defer resetTokens()
+
+			t.Setenv("IDENTITY_ENDPOINT", conjur.URL+"/identity")
+			t.Setenv("IDENTITY_HEADER", "test")
+			t.Setenv("CONJUR_APPLIANCE_URL", conjur.URL)
+			t.Setenv("CONJUR_AUTHN_TYPE", "jwt")
+			t.Setenv("CONJUR_AUTHN_SERVICE_ID", "azure-jwt")
+			t.Setenv("CONJUR_AUTHN_LOGIN", tt.login)
+
+			client := newConjurClient()
+			if missing := client.missingSettings(); len(missing) > 0 {
+				t.Fatalf("unexpected missing settings %v", missing)
+			}
+			token, err := client.authenticate(context.Background())
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if token != "Y29uanVyLXRva2Vu" || authnPath != tt.expectedPath || audience != defaultConjurJWTAudience {
+				t.Errorf("expected a token from %s for %s, got %q from %s for %s", tt.expectedPath, defaultConjurJWTAudience, token, authnPath, audience)
+			}
+		})
+	}
+}
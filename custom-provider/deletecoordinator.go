@@ -0,0 +1,146 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Dependency order for deletions in one batch: members, then accounts, then the safes that hold them
+const (
+	deleteRankSafeMember = iota
+	deleteRankAccount
+	deleteRankSafe
+)
+
+type deleteJob struct {
+	ctx  context.Context
+	rank int
+	name string
+	run  func(pamService PAMService) error
+	done chan error
+}
+
+// deleteCoordinator batches DELETEs that arrive close together (e.g. ARM tearing down a resource group),
+// runs them in dependency order on one shared PAM service, with bounded concurrency per rank
+type deleteCoordinator struct {
+	window         time.Duration
+	maxConcurrency int
+	newService     func() (PAMService, error)
+
+	mu      sync.Mutex
+	pending []*deleteJob
+	timer   *time.Timer
+}
+
+// deletes is the coordinator used by the DELETE handlers.
+// DELETE_BATCH_WINDOW (default 500ms) and DELETE_MAX_CONCURRENCY (default 4) tune it.
+var deletes = newDeleteCoordinator(deleteBatchWindow(), deleteMaxConcurrency(), func() (PAMService, error) { return newPAMService() })
+
+func newDeleteCoordinator(window time.Duration, maxConcurrency int, newService func() (PAMService, error)) *deleteCoordinator {
+	if maxConcurrency < 1 {
+		maxConcurrency = 1
+	}
+	return &deleteCoordinator{window: window, maxConcurrency: maxConcurrency, newService: newService}
+}
+
+func deleteBatchWindow() time.Duration {
+	window, err := time.ParseDuration(getEnvOrDefault("DELETE_BATCH_WINDOW", "500ms"))
+	if err != nil {
+		log.Printf("WARNING: Invalid DELETE_BATCH_WINDOW, using 500ms: %v", err)
+		return 500 * time.Millisecond
+	}
+	return window
+}
+
+func deleteMaxConcurrency() int {
+	n, err := strconv.Atoi(getEnvOrDefault("DELETE_MAX_CONCURRENCY", "4"))
+	if err != nil {
+		log.Printf("WARNING: Invalid DELETE_MAX_CONCURRENCY, using 4: %v", err)
+		return 4
+	}
+	return n
+}
+
+// Submit queues a deletion for the next batch and blocks until it has run or ctx is done. A job
+// whose ctx is done before its batch runs is skipped; one already running finishes on its own.
+func (c *deleteCoordinator) Submit(ctx context.Context, rank int, name string, run func(pamService PAMService) error) error {
+	job := &deleteJob{ctx: ctx, rank: rank, name: name, run: run, done: make(chan error, 1)}
+
+	c.mu.Lock()
+	c.pending = append(c.pending, job)
+	if c.timer == nil {
+		c.timer = time.AfterFunc(c.window, c.flush)
+	}
+	c.mu.Unlock()
+
+	select {
+	case err := <-job.done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// runJob runs one deletion, turning a panic into the job's error so it cannot take down the batch
+func runJob(job *deleteJob, pamService PAMService) (err error) {
+	defer func() {
+		if p := recover(); p != nil {
+			err = fmt.Errorf("panic deleting %s: %v", job.name, p)
+		}
+	}()
+	if err := job.ctx.Err(); err != nil {
+		return err
+	}
+	return job.run(pamService)
+}
+
+// flush runs every pending job; ranks run one after another, jobs within a rank run concurrently
+func (c *deleteCoordinator) flush() {
+	c.mu.Lock()
+	batch := c.pending
+	c.pending = nil
+	c.timer = nil
+	c.mu.Unlock()
+
+	log.Printf("DEBUG: (DeleteCoordinator) running batch of %d deletions", len(batch))
+
+	pamService, err := c.newService()
+	if err != nil {
+		for _, job := range batch {
+			job.done <- err
+		}
+		return
+	}
+
+	sort.SliceStable(batch, func(i, j int) bool { return batch[i].rank < batch[j].rank })
+
+	sem := make(chan struct{}, c.maxConcurrency)
+	for start := 0; start < len(batch); {
+		end := start
+		for end < len(batch) && batch[end].rank == batch[start].rank {
+			end++
+		}
+
+		var wg sync.WaitGroup
+		for _, job := range batch[start:end] {
+			wg.Add(1)
+			sem <- struct{}{}
+			go func(job *deleteJob) {
+				defer wg.Done()
+				defer func() { <-sem }()
+				err := runJob(job, pamService)
+				if err != nil {
+					log.Printf("ERROR: (DeleteCoordinator) failed to delete %s: %v", job.name, err)
+				}
+				job.done <- err
+			}(job)
+		}
+		wg.Wait()
+		start = end
+	}
+}
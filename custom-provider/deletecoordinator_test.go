@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestDeleteCoordinator_DependencyOrder(t *testing.T) {
+	clients := 0
+	coordinator := newDeleteCoordinator(20*time.Millisecond, 2, func() (PAMService, error) {
+		clients++
+		return newMockPAMService(), nil
+	})
+
+	var mu sync.Mutex
+	var order []int
+	record := func(rank int) func(PAMService) error {
+		return func(PAMService) error {
+			mu.Lock()
+			defer mu.Unlock()
+			order = append(order, rank)
+			return nil
+		}
+	}
+
+	ranks := []int{deleteRankSafe, deleteRankAccount, deleteRankSafeMember, deleteRankAccount, deleteRankSafe}
+	var wg sync.WaitGroup
+	for i, rank := range ranks {
+		wg.Add(1)
+		go func(i, rank int) {
+			defer wg.Done()
+			if err := coordinator.Submit(context.Background(), rank, fmt.Sprintf("job%d", i), record(rank)); err != nil {
+				t.Errorf("unexpected error: %v", err)
+			}
+		}(i, rank)
+	}
+	wg.Wait()
+
+	if clients != 1 {
+		t.Errorf("expected one shared PAM service for the batch, got %d", clients)
+	}
+	if len(order) != len(ranks) {
+		t.Fatalf("expected %d deletions, got %d", len(ranks), len(order))
+	}
+	for i := 1; i < len(order); i++ {
+		if order[i] < order[i-1] {
+			t.Errorf("deletions ran out of dependency order: %v", order)
+			break
+		}
+	}
+}
+
+func TestDeleteCoordinator_ClientError(t *testing.T) {
+	coordinator := newDeleteCoordinator(time.Millisecond, 1, func() (PAMService, error) {
+		return nil, fmt.Errorf("no session")
+	})
+
+	err := coordinator.Submit(context.Background(), deleteRankSafe, "safe1", func(PAMService) error { return nil })
+	if err == nil {
+		t.Errorf("expected the client error to be returned")
+	}
+}
+
+func TestDeleteCoordinator_Panic(t *testing.T) {
+	coordinator := newDeleteCoordinator(time.Millisecond, 2, func() (PAMService, error) {
+		return newMockPAMService(), nil
+	})
+
+	var wg sync.WaitGroup
+	errs := make([]error, 2)
+	for i, run := range []func(PAMService) error{
+		func(PAMService) error { panic("boom") },
+		func(PAMService) error { return nil },
+	} {
+		wg.Add(1)
+		go func(i int, run func(PAMService) error) {
+			defer wg.Done()
+			errs[i] = coordinator.Submit(context.Background(), deleteRankAccount, fmt.Sprintf("job%d", i), run)
+		}(i, run)
+	}
+	wg.Wait()
+
+	if errs[0] == nil {
+		t.Errorf("expected the panic to be returned as the job's error")
+	}
+	if errs[1] != nil {
+		t.Errorf("expected the other job in the batch to succeed, got %v", errs[1])
+	}
+}
+
+func TestDeleteCoordinator_Canceled(t *testing.T) {
+	coordinator := newDeleteCoordinator(50*time.Millisecond, 1, func() (PAMService, error) {
+		return newMockPAMService(), nil
+	})
+
+	ran := make(chan struct{}, 1)
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(5*time.Millisecond, cancel)
+	start := time.Now()
+	err := coordinator.Submit(ctx, deleteRankSafe, "safe1", func(PAMService) error {
+		ran <- struct{}{}
+		return nil
+	})
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("expected context.Canceled, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed >= 50*time.Millisecond {
+		t.Errorf("expected Submit to return when the request is canceled, waited %s", elapsed)
+	}
+
+	time.Sleep(80 * time.Millisecond)
+	select {
+	case <-ran:
+		t.Errorf("expected a canceled job to be skipped by its batch")
+	default:
+	}
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"reflect"
+)
+
+// A safe or account's deletionPolicy decides what removing the ARM resource does to the PCloud
+// object behind it: Delete (the default) deletes the safe or account, Retain leaves it in PCloud and
+// only drops the provider's resource record, so it can be taken under management again later. ARM
+// only sends the resource ID with a DELETE, so the policy is kept with the resource record.
+
+const (
+	deletionPolicyDelete = "Delete"
+	deletionPolicyRetain = "Retain"
+)
+
+// recordedDeletionPolicy is the policy to keep with a record; Delete, the default, is not stored
+func recordedDeletionPolicy(policy string) string {
+	if policy == deletionPolicyRetain {
+		return policy
+	}
+	return ""
+}
+
+// checkDeletionPolicy validates a deletionPolicy given on its own, as PATCH does
+func checkDeletionPolicy(policy string) []ErrorDetails {
+	return checkRules(reflect.ValueOf(policy), "properties.deletionPolicy", "pattern=deletionPolicy")
+}
+
+// addDeletionPolicyProperty adds a Retain policy kept with a record to the resource's properties
+func addDeletionPolicyProperty(properties map[string]interface{}, rec ResourceRecord) {
+	if rec.DeletionPolicy != "" {
+		properties["deletionPolicy"] = rec.DeletionPolicy
+	}
+}
+
+// retainOnDelete answers a DELETE itself when the resource's deletionPolicy is Retain: the record is
+// dropped and the PCloud object left alone. It returns false when the resource should be deleted.
+func retainOnDelete(w http.ResponseWriter, r *http.Request, cpRequest CustomProviderRequestPath) bool {
+	rec, found, err := stateStore.Get(cpRequest.ID())
+	if err != nil {
+		// Deleting would be wrong for a retained resource, and the policy cannot be read
+		sendJSONError(w, http.StatusServiceUnavailable, "StateStoreError", fmt.Sprintf("Failed to read the deletion policy of %s: %v", cpRequest.ID(), err))
+		return true
+	}
+	if !found || rec.DeletionPolicy != deletionPolicyRetain {
+		return false
+	}
+
+	log.Printf("INFO: (Delete%s) %s has deletionPolicy Retain, leaving %s in PCloud", cpRequest.ResourceTypeName, cpRequest.ID(), rec.PCloudID)
+	forgetResource(cpRequest.ID())
+	notifyLifecycle(r, "Retained", rec)
+	w.WriteHeader(http.StatusNoContent)
+	return true
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Deployment stacks and complete-mode deployments DELETE every resource that drops out of the
+// template, so one template mistake can remove safes full of credentials. A safe holding more than
+// SAFE_DELETE_ACCOUNT_THRESHOLD accounts is protected: it is only deleted when its template declared
+// confirmDelete: true, and that declaration has been in place for DELETE_PROTECTION_WINDOW, so a
+// single deployment cannot both confirm and delete.
+//
+// A safe declared with preventDeletion: true is locked regardless of its size: every DELETE, including
+// the ones of an `az group delete`, is refused until the lock is removed with PATCH or the caller
+// sends the force-delete request flag.
+
+// safeDeleteAccountThreshold is read from SAFE_DELETE_ACCOUNT_THRESHOLD; -1 (unset) disables protection
+func safeDeleteAccountThreshold() int {
+	raw := getEnvOrDefault("SAFE_DELETE_ACCOUNT_THRESHOLD", "-1")
+	threshold, err := strconv.Atoi(raw)
+	if err != nil {
+		log.Printf("WARNING: Invalid SAFE_DELETE_ACCOUNT_THRESHOLD %q, deletion protection disabled", raw)
+		return -1
+	}
+	return threshold
+}
+
+// deleteProtectionWindow is read from DELETE_PROTECTION_WINDOW (Go duration, default 1h)
+func deleteProtectionWindow() time.Duration {
+	window, err := time.ParseDuration(getEnvOrDefault("DELETE_PROTECTION_WINDOW", "1h"))
+	if err != nil {
+		log.Printf("WARNING: Invalid DELETE_PROTECTION_WINDOW, using 1h: %v", err)
+		return time.Hour
+	}
+	return window
+}
+
+// checkSafeDeletionLock returns an error when the safe has preventDeletion set and the request does
+// not force the delete
+func checkSafeDeletionLock(r *http.Request, cpRequest CustomProviderRequestPath) error {
+	rec, found, err := stateStore.Get(cpRequest.ID())
+	if err != nil {
+		return fmt.Errorf("could not read the resource record for %s: %v", cpRequest.ID(), err)
+	}
+	if !found || !rec.PreventDeletion {
+		return nil
+	}
+	if force, _ := requestFlag(r, "force-delete"); force {
+		log.Printf("WARNING: Deleting safe %s despite preventDeletion, forced by the caller", cpRequest.ResourceInstanceName)
+		return nil
+	}
+	return fmt.Errorf("safe %s has preventDeletion set; set it to false with PATCH, or send %sForce-Delete: true, to delete it",
+		cpRequest.ResourceInstanceName, requestFlagHeaderPrefix)
+}
+
+// addSafeRecordProperties adds the settings the provider keeps for a safe, rather than PCloud, to its properties
+func addSafeRecordProperties(properties map[string]interface{}, rec ResourceRecord) {
+	if rec.PreventDeletion {
+		properties["preventDeletion"] = true
+	}
+	addDeletionPolicyProperty(properties, rec)
+}
+
+// checkSafeDeletion returns an error when deleting the safe would break the deletion protection rules
+func checkSafeDeletion(r *http.Request, cpRequest CustomProviderRequestPath) error {
+	threshold := safeDeleteAccountThreshold()
+	if threshold < 0 {
+		return nil
+	}
+
+	accounts, err := GetAccounts(nil, r, cpRequest.ResourceInstanceName)
+	if err != nil {
+		return fmt.Errorf("could not count accounts in safe %s: %v", cpRequest.ResourceInstanceName, err)
+	}
+	count := 0
+	if accounts.Response != nil {
+		count = accounts.Response.Count
+	}
+	if count <= threshold {
+		return nil
+	}
+
+	rec, found, err := stateStore.Get(cpRequest.ID())
+	if err != nil {
+		return fmt.Errorf("could not read the resource record for %s: %v", cpRequest.ID(), err)
+	}
+	if !found || rec.ConfirmDeleteAt == nil {
+		return fmt.Errorf("safe %s holds %d accounts (threshold %d); set confirmDelete: true on the safe and redeploy before deleting it",
+			cpRequest.ResourceInstanceName, count, threshold)
+	}
+	if confirmedFor := time.Since(*rec.ConfirmDeleteAt); confirmedFor < deleteProtectionWindow() {
+		return fmt.Errorf("safe %s holds %d accounts and confirmDelete was set %s ago; it can be deleted after %s",
+			cpRequest.ResourceInstanceName, count, confirmedFor.Round(time.Second), rec.ConfirmDeleteAt.Add(deleteProtectionWindow()).Format(time.RFC3339))
+	}
+	return nil
+}
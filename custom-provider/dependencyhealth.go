@@ -0,0 +1,112 @@
+package main
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// Each upstream the provider depends on (PCloud today; Conjur or Key Vault when those credential
+// sources are enabled) records the outcome of its calls here, and /healthex reports them side by
+// side so operators can tell which dependency is failing.
+
+// dependency tracks the most recent outcomes of calls to one upstream
+type dependency struct {
+	lastSuccess time.Time
+	lastError   time.Time
+	lastErrMsg  string
+	// probe adds dependency-specific details (e.g. authenticator status) to the report; may be nil
+	probe func() map[string]interface{}
+}
+
+var (
+	dependenciesMu sync.Mutex
+	dependencies   = map[string]*dependency{}
+)
+
+func init() {
+	registerDependency("pcloud", func() map[string]interface{} {
+		active, _, reason := maintenance.active()
+		limit, inFlight := pcloudLimiter.snapshot()
+		details := pamSessions.details()
+		details["maintenance"] = active
+		details["concurrencyLimit"] = limit
+		details["inFlight"] = inFlight
+		details["identityCircuitBreaker"] = identityBreaker.details()
+		details["circuitBreaker"] = pcloudBreaker.details()
+		if paused := pcloudRate.pausedFor(); paused > 0 {
+			details["throttledForSeconds"] = int(paused.Seconds()) + 1
+		}
+		if active {
+			details["maintenanceReason"] = reason
+		}
+		return details
+	})
+}
+
+// registerDependency makes an upstream appear in the /healthex dependency report
+func registerDependency(name string, probe func() map[string]interface{}) {
+	dependenciesMu.Lock()
+	defer dependenciesMu.Unlock()
+	if dep, ok := dependencies[name]; ok {
+		dep.probe = probe
+		return
+	}
+	dependencies[name] = &dependency{probe: probe}
+}
+
+// recordDependencyResult notes the outcome of a call to a registered upstream
+func recordDependencyResult(name string, err error) {
+	dependenciesMu.Lock()
+	defer dependenciesMu.Unlock()
+	dep, ok := dependencies[name]
+	if !ok {
+		return
+	}
+	if err != nil {
+		dep.lastError = time.Now().UTC()
+		dep.lastErrMsg = err.Error()
+		return
+	}
+	dep.lastSuccess = time.Now().UTC()
+}
+
+// dependencyReport returns the status of every registered upstream: "ok" when the last call
+// succeeded, "error" when it failed, "unknown" before the first call
+func dependencyReport() map[string]interface{} {
+	dependenciesMu.Lock()
+	names := make([]string, 0, len(dependencies))
+	for name := range dependencies {
+		names = append(names, name)
+	}
+	dependenciesMu.Unlock()
+	sort.Strings(names)
+
+	report := map[string]interface{}{}
+	for _, name := range names {
+		dependenciesMu.Lock()
+		dep := *dependencies[name]
+		dependenciesMu.Unlock()
+
+		entry := map[string]interface{}{"status": "unknown"}
+		if dep.probe != nil {
+			for key, value := range dep.probe() {
+				entry[key] = value
+			}
+		}
+		if !dep.lastSuccess.IsZero() {
+			entry["status"] = "ok"
+			entry["lastSuccess"] = dep.lastSuccess.Format(time.RFC3339)
+			entry["sinceLastSuccess"] = time.Since(dep.lastSuccess).Round(time.Second).String()
+		}
+		if !dep.lastError.IsZero() {
+			entry["lastError"] = dep.lastErrMsg
+			entry["lastErrorAt"] = dep.lastError.Format(time.RFC3339)
+			if dep.lastError.After(dep.lastSuccess) {
+				entry["status"] = "error"
+			}
+		}
+		report[name] = entry
+	}
+	return report
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/davidh-cyberark/privilegeaccessmanager-sdk-go/pam"
+)
+
+// SettingDrift is a setting whose live PCloud value differs from the ARM-declared one
+type SettingDrift struct {
+	Declared string `json:"declared"`
+	Actual   string `json:"actual"`
+}
+
+// safeDriftSettings flattens the safe settings that are tracked for drift.
+// Values are compared as strings because the SDK types them inconsistently (numberOfVersionsRetention is `any`).
+func safeDriftSettings(description, managingCPM string, daysRetention int, versionsRetention any, olacEnabled bool) map[string]string {
+	versions := ""
+	if versionsRetention != nil {
+		versions = fmt.Sprint(versionsRetention)
+	}
+	return map[string]string{
+		"description":               description,
+		"managingCPM":               managingCPM,
+		"numberOfDaysRetention":     fmt.Sprint(daysRetention),
+		"numberOfVersionsRetention": versions,
+		"olacEnabled":               fmt.Sprint(olacEnabled),
+	}
+}
+
+// accountDriftSettings flattens the account settings that are tracked for drift; each platform
+// account property is a setting of its own, platformAccountProperties.{name}
+func accountDriftSettings(platformID, address, userName string, secretManagement pam.SecretManagement, properties pam.PlatformAccountProperties) map[string]string {
+	settings := map[string]string{
+		"platformId": platformID,
+		"address":    address,
+		"userName":   userName,
+		"secretManagement.automaticManagementEnabled": fmt.Sprint(secretManagement.AutomaticManagementEnabled),
+	}
+	for name, value := range properties {
+		settings["platformAccountProperties."+name] = value
+	}
+	return settings
+}
+
+// diffSettings returns the declared settings whose live value differs
+func diffSettings(declared, live map[string]string) map[string]SettingDrift {
+	drift := map[string]SettingDrift{}
+	for key, value := range declared {
+		if actual, ok := live[key]; ok && actual != value {
+			drift[key] = SettingDrift{Declared: value, Actual: actual}
+		}
+	}
+	return drift
+}
+
+// diffAllSettings is diffSettings for settings that come and go, like platform account properties:
+// a setting missing on either side counts as empty
+func diffAllSettings(declared, live map[string]string) map[string]SettingDrift {
+	drift := diffSettings(declared, live)
+	for key, value := range declared {
+		if _, ok := live[key]; !ok && value != "" {
+			drift[key] = SettingDrift{Declared: value}
+		}
+	}
+	for key, actual := range live {
+		if _, ok := declared[key]; !ok && actual != "" {
+			drift[key] = SettingDrift{Actual: actual}
+		}
+	}
+	return drift
+}
+
+// DetectDriftRequest is the body of the detectDrift action; without resourceType both safes and
+// accounts are checked, and without name every resource of the type
+type DetectDriftRequest struct {
+	ResourceType string `json:"resourceType,omitempty"`
+	Name         string `json:"name,omitempty"`
+}
+
+// DriftReport is the drift of one resource. Status is InSync, Drifted, Missing (deleted in PCloud),
+// or NotTracked when no settings were recorded for the resource.
+type DriftReport struct {
+	ResourceID   string                  `json:"resourceId"`
+	ResourceType string                  `json:"resourceType"`
+	Name         string                  `json:"name"`
+	Status       string                  `json:"status"`
+	Drift        map[string]SettingDrift `json:"drift,omitempty"`
+}
+
+// handleDetectDrift compares the settings recorded when ARM last wrote each managed safe and account
+// with the live PCloud objects, to find changes made outside ARM (e.g. in the CyberArk console)
+func handleDetectDrift(w http.ResponseWriter, r *http.Request, cpRequest CustomProviderRequestPath) {
+	LogRequestDebug("DetectDrift", r)
+
+	var request DetectDriftRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		sendJSONError(w, http.StatusBadRequest, "InvalidRequestBody", fmt.Sprintf("Invalid request body: %v", err))
+		return
+	}
+	resourceTypes := []string{"safes", "accounts"}
+	if request.ResourceType != "" {
+		if !strings.EqualFold(request.ResourceType, "safes") && !strings.EqualFold(request.ResourceType, "accounts") {
+			sendJSONError(w, http.StatusBadRequest, "InvalidRequestBody", "resourceType must be safes or accounts")
+			return
+		}
+		resourceTypes = []string{strings.ToLower(request.ResourceType)}
+	}
+
+	var records []ResourceRecord
+	for _, resourceType := range resourceTypes {
+		typeRequest := cpRequest
+		typeRequest.ResourceTypeName = resourceType
+		typeRequest.ResourceInstanceName = ""
+		managed, err := managedRecords(typeRequest)
+		if err != nil {
+			sendJSONError(w, http.StatusServiceUnavailable, "StateStoreError", fmt.Sprintf("Failed to list resource records: %v", err))
+			return
+		}
+		for _, rec := range managed {
+			if request.Name == "" || strings.EqualFold(resourceName(rec), request.Name) {
+				records = append(records, rec)
+			}
+		}
+	}
+	if request.Name != "" && len(records) == 0 {
+		sendJSONError(w, http.StatusNotFound, "ResourceNotFound", fmt.Sprintf("No managed resource named %s", request.Name))
+		return
+	}
+
+	reports := []DriftReport{}
+	drifted := false
+	if len(records) > 0 {
+		stopAuth := startPhase(r, "auth")
+		pamClient, err := createPAMClient()
+		stopAuth()
+		if err != nil {
+			sendJSONError(w, http.StatusInternalServerError, "PAMClientError", fmt.Sprintf("Failed to create PAM client: %v", err))
+			return
+		}
+
+		stopPAM := startPhase(r, "pam")
+		defer stopPAM()
+		for _, rec := range records {
+			report, err := detectResourceDrift(r, pamClient, rec)
+			if err != nil {
+				sendJSONError(w, http.StatusBadGateway, "DetectDriftError", fmt.Sprintf("Failed to read %s: %v", rec.ResourceID, checkMaintenance(err)))
+				return
+			}
+			if report.Status == "Drifted" || report.Status == "Missing" {
+				drifted = true
+				log.Printf("WARNING: (DetectDrift) %s is %s: %v", rec.ResourceID, report.Status, report.Drift)
+			}
+			reports = append(reports, report)
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"driftDetected": drifted, "checked": len(reports), "resources": reports})
+}
+
+// detectResourceDrift reads the live object behind a record and compares it with the recorded settings
+func detectResourceDrift(r *http.Request, pamClient *pam.Client, rec ResourceRecord) (DriftReport, error) {
+	report := DriftReport{ResourceID: rec.ResourceID, ResourceType: rec.ResourceType, Name: resourceName(rec), Status: "NotTracked"}
+	if rec.Declared == nil {
+		return report, nil
+	}
+
+	var live map[string]string
+	var drift map[string]SettingDrift
+	if strings.EqualFold(rec.ResourceType, "safes") {
+		safe, retcode, err := pcloudRetry(r.Context(), "safes", "GetSafeDetails", true, func(ctx context.Context) (pam.GetSafeDetails, int, error) {
+			return pamGetSafeDetails(ctx, pamClient, rec.SafeName)
+		})
+		if retcode == http.StatusNotFound {
+			report.Status = "Missing"
+			return report, nil
+		}
+		if err != nil {
+			return report, err
+		}
+		live = safeDriftSettings(safe.Description, safe.ManagingCPM, safe.NumberOfDaysRetention, safe.NumberOfVersionsRetention, safe.OlacEnabled)
+		drift = diffSettings(rec.Declared, live)
+	} else {
+		account, retcode, err := pcloudRetry(r.Context(), "accounts", "GetAccount", true, func(ctx context.Context) (pam.GetAccountResponse, int, error) {
+			return pamGetAccount(ctx, pamClient, rec.PCloudID)
+		})
+		if retcode == http.StatusNotFound {
+			report.Status = "Missing"
+			return report, nil
+		}
+		if err != nil {
+			return report, err
+		}
+		live = accountDriftSettings(account.PlatformID, account.Address, account.UserName, account.SecretManagement, account.PlatformAccountProperties)
+		drift = diffAllSettings(rec.Declared, live)
+	}
+
+	report.Status = "InSync"
+	if len(drift) > 0 {
+		report.Status = "Drifted"
+		report.Drift = drift
+	}
+	return report, nil
+}
+
+// resourceName is the ARM resource name of a record, the last segment of its ID
+func resourceName(rec ResourceRecord) string {
+	return rec.ResourceID[strings.LastIndex(rec.ResourceID, "/")+1:]
+}
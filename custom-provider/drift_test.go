@@ -0,0 +1,94 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/davidh-cyberark/privilegeaccessmanager-sdk-go/pam"
+)
+
+func TestDiffSettings(t *testing.T) {
+	declared := safeDriftSettings("team safe", "PasswordManager", 7, float64(5), true)
+
+	tests := []struct {
+		name     string
+		live     map[string]string
+		expected []string
+	}{
+		{
+			name:     "no drift",
+			live:     safeDriftSettings("team safe", "PasswordManager", 7, float64(5), true),
+			expected: nil,
+		},
+		{
+			name:     "retention and olac changed",
+			live:     safeDriftSettings("team safe", "PasswordManager", 30, float64(5), false),
+			expected: []string{"numberOfDaysRetention", "olacEnabled"},
+		},
+		{
+			name:     "versions retention cleared",
+			live:     safeDriftSettings("team safe", "PasswordManager", 7, nil, true),
+			expected: []string{"numberOfVersionsRetention"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			drift := diffSettings(declared, tt.live)
+			if len(drift) != len(tt.expected) {
+				t.Fatalf("expected %d drifted settings, got %d: %v", len(tt.expected), len(drift), drift)
+			}
+			for _, key := range tt.expected {
+				d, ok := drift[key]
+				if !ok {
+					t.Errorf("expected drift on %s", key)
+					continue
+				}
+				if d.Declared != declared[key] || d.Actual != tt.live[key] {
+					t.Errorf("unexpected drift values for %s: %+v", key, d)
+				}
+			}
+		})
+	}
+}
+
+func TestDiffAllSettings(t *testing.T) {
+	managed := pam.SecretManagement{AutomaticManagementEnabled: true}
+	declared := accountDriftSettings("UnixSSH", "web01", "root", managed, pam.PlatformAccountProperties{"Port": "22", "Location": "dc1"})
+
+	tests := []struct {
+		name     string
+		live     map[string]string
+		expected map[string]SettingDrift
+	}{
+		{
+			name:     "no drift",
+			live:     accountDriftSettings("UnixSSH", "web01", "root", managed, pam.PlatformAccountProperties{"Port": "22", "Location": "dc1"}),
+			expected: map[string]SettingDrift{},
+		},
+		{
+			name: "address changed and management disabled",
+			live: accountDriftSettings("UnixSSH", "web02", "root", pam.SecretManagement{}, pam.PlatformAccountProperties{"Port": "22", "Location": "dc1"}),
+			expected: map[string]SettingDrift{
+				"address": {Declared: "web01", Actual: "web02"},
+				"secretManagement.automaticManagementEnabled": {Declared: "true", Actual: "false"},
+			},
+		},
+		{
+			name: "platform account properties removed and added",
+			live: accountDriftSettings("UnixSSH", "web01", "root", managed, pam.PlatformAccountProperties{"Port": "22", "Owner": "ops"}),
+			expected: map[string]SettingDrift{
+				"platformAccountProperties.Location": {Declared: "dc1"},
+				"platformAccountProperties.Owner":    {Actual: "ops"},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if drift := diffAllSettings(declared, tt.live); !reflect.DeepEqual(drift, tt.expected) {
+				t.Errorf("expected %v, got %v", tt.expected, drift)
+			}
+		})
+	}
+}
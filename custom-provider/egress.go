@@ -0,0 +1,89 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"time"
+)
+
+// Every outbound call (Privilege Cloud, the identity tenant, Conjur, Key Vault, Azure and the
+// public IP services) goes through one transport. It sends requests through the proxy named by
+// HTTPS_PROXY or HTTP_PROXY, except for hosts in NO_PROXY, and trusts the certificates in
+// CA_BUNDLE_FILE in addition to the system roots, so egress can go through a proxy that
+// inspects TLS. Only the managed identity endpoint is always called directly (see azureauth.go).
+
+var outboundTransport, outboundTransportErr = newOutboundTransport(os.Getenv("CA_BUNDLE_FILE"))
+
+// newOutboundTransport returns the shared transport; on error the transport trusts the system
+// roots only, and main refuses to start
+func newOutboundTransport(bundle string) (*http.Transport, error) {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = http.ProxyFromEnvironment
+	if bundle == "" {
+		return transport, nil
+	}
+
+	pool, err := x509.SystemCertPool()
+	if err != nil {
+		pool = x509.NewCertPool()
+	}
+	data, err := os.ReadFile(bundle)
+	if err != nil {
+		return transport, fmt.Errorf("cannot read CA_BUNDLE_FILE: %v", err)
+	}
+	if !pool.AppendCertsFromPEM(data) {
+		return transport, fmt.Errorf("CA_BUNDLE_FILE %s holds no PEM certificates", bundle)
+	}
+	transport.TLSClientConfig = &tls.Config{RootCAs: pool, MinVersion: tls.VersionTLS12}
+	return transport, nil
+}
+
+// newOutboundClient returns a client on the shared transport
+func newOutboundClient(timeout time.Duration) *http.Client {
+	return &http.Client{Timeout: timeout, Transport: outboundTransport}
+}
+
+// outboundProxy reports the proxy requests to rawURL are sent through, or "direct"
+func outboundProxy(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil || u.Host == "" {
+		return "direct"
+	}
+	proxy, err := outboundTransport.Proxy(&http.Request{URL: u})
+	if err != nil || proxy == nil {
+		return "direct"
+	}
+	return redactURL(proxy.String())
+}
+
+// egressDescription is the startup fingerprint's view of the outbound configuration
+func egressDescription() map[string]string {
+	bundle := os.Getenv("CA_BUNDLE_FILE")
+	if bundle == "" {
+		bundle = "none"
+	}
+	return map[string]string{
+		"pcloudProxy":  outboundProxy(os.Getenv("PCLOUDURL")),
+		"tenantProxy":  outboundProxy(os.Getenv("IDTENANTURL")),
+		"noProxy":      getEnvOrDefault("NO_PROXY", os.Getenv("no_proxy")),
+		"caBundleFile": bundle,
+		"ipSource":     egressIP.sourceName(),
+	}
+}
+
+// directTransport never uses the proxy, for the managed identity endpoint, which is only reachable
+// from the container itself
+var directTransport = func() *http.Transport {
+	transport := outboundTransport.Clone()
+	transport.Proxy = nil
+	return transport
+}()
+
+// newDirectClient returns a client on directTransport
+func newDirectClient(timeout time.Duration) *http.Client {
+	return &http.Client{Timeout: timeout, Transport: directTransport}
+}
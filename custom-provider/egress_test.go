@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/davidh-cyberark/privilegeaccessmanager-sdk-go/pam"
+)
+
+func TestOutboundTransportCABundle(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"access_token": "pcloud-token", "token_type": "Bearer", "expires_in": 3600}`))
+	}))
+	defer server.Close()
+
+	dir := t.TempDir()
+	bundle := filepath.Join(dir, "ca.pem")
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})
+	if err := os.WriteFile(bundle, certPEM, 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	// Without the bundle the inspecting proxy's certificate is not trusted
+	plain, _ := newOutboundTransport("")
+	if _, err := (&http.Client{Transport: plain, Timeout: 5 * time.Second}).Get(server.URL); err == nil {
+		t.Fatal("expected the test server's certificate to be untrusted without a CA bundle")
+	}
+
+	transport, err := newOutboundTransport(bundle)
+	if err != nil {
+		t.Fatal(err)
+	}
+	saved := pamHTTPClient
+	pamHTTPClient = &http.Client{Transport: transport, Timeout: 5 * time.Second}
+	defer func() { pamHTTPClient = saved }()
+
+	// SDK calls go through the transport, so the identity tenant is reached with the bundle
+	client := pam.NewClient(server.URL, pam.NewConfig(server.URL, server.URL, "user", "pass"))
+	session, status, err := pamGetSession(context.Background(), client)
+	if err != nil || status != http.StatusOK || session.Token != "pcloud-token" {
+		t.Fatalf("expected a session through the CA bundle, got %v %d %v", session, status, err)
+	}
+}
+
+func TestOutboundTransportInvalidBundle(t *testing.T) {
+	dir := t.TempDir()
+	notPEM := filepath.Join(dir, "ca.pem")
+	os.WriteFile(notPEM, []byte("not a certificate"), 0o600)
+
+	tests := []struct {
+		bundle, want string
+	}{
+		{filepath.Join(dir, "missing.pem"), "cannot read CA_BUNDLE_FILE"},
+		{notPEM, "holds no PEM certificates"},
+	}
+	for _, tt := range tests {
+		if _, err := newOutboundTransport(tt.bundle); err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%s: expected error containing %q, got %v", tt.bundle, tt.want, err)
+		}
+	}
+}
+
+func TestDirectTransportSkipsProxy(t *testing.T) {
+	if directTransport.Proxy != nil {
+		t.Error("expected the managed identity transport not to use the proxy")
+	}
+	if outboundTransport.Proxy == nil {
+		t.Error("expected the outbound transport to use the proxy from the environment")
+	}
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The container's egress IP is what Privilege Cloud and Conjur allowlists must contain, so it is
+// logged at startup and shown in /healthex. EGRESS_IP_SOURCE picks how it is found: lookup asks
+// public "what is my IP" services, imds reads the Azure Instance Metadata Service, static reports
+// EGRESS_IP (e.g. the NAT gateway address of the Container Apps environment), and disabled skips
+// it. The address is resolved in the background and never delays startup or a request.
+
+// egressIPResolver finds the egress IP address
+type egressIPResolver interface {
+	// Name is the EGRESS_IP_SOURCE value of the resolver
+	Name() string
+	Resolve(ctx context.Context) (string, error)
+}
+
+// egressIPTimeout bounds one resolution, across all services a resolver tries
+const egressIPTimeout = 15 * time.Second
+
+var egressIP = newEgressIPInfo(newEgressIPResolver())
+
+func newEgressIPResolver() egressIPResolver {
+	switch source := strings.ToLower(getEnvOrDefault("EGRESS_IP_SOURCE", "lookup")); source {
+	case "disabled":
+		return nil
+	case "static":
+		return staticEgressIP(os.Getenv("EGRESS_IP"))
+	case "imds":
+		return imdsEgressIP{endpoint: "http://169.254.169.254"}
+	default:
+		if source != "lookup" {
+			log.Printf("WARNING: Invalid EGRESS_IP_SOURCE %q, using lookup", source)
+		}
+		return publicLookupEgressIP{services: []string{"https://ipinfo.io/ip", "https://api.ipify.org", "https://icanhazip.com"}}
+	}
+}
+
+// egressIPInfo holds the last resolved address
+type egressIPInfo struct {
+	resolver egressIPResolver
+
+	mu         sync.Mutex
+	address    string
+	err        error
+	resolvedAt time.Time
+	running    bool
+}
+
+func newEgressIPInfo(resolver egressIPResolver) *egressIPInfo {
+	return &egressIPInfo{resolver: resolver}
+}
+
+// sourceName is the EGRESS_IP_SOURCE in use
+func (e *egressIPInfo) sourceName() string {
+	if e.resolver == nil {
+		return "disabled"
+	}
+	return e.resolver.Name()
+}
+
+// resolveAsync starts a resolution unless one is running or an address is already known
+func (e *egressIPInfo) resolveAsync() {
+	if e.resolver == nil {
+		return
+	}
+	e.mu.Lock()
+	if e.running || e.address != "" {
+		e.mu.Unlock()
+		return
+	}
+	e.running = true
+	e.mu.Unlock()
+
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), egressIPTimeout)
+		defer cancel()
+		address, err := e.resolver.Resolve(ctx)
+
+		e.mu.Lock()
+		e.address, e.err, e.resolvedAt, e.running = address, err, time.Now(), false
+		e.mu.Unlock()
+		if err != nil {
+			log.Printf("WARNING: Could not determine the container egress IP address with %s: %v", e.resolver.Name(), err)
+			return
+		}
+		log.Printf("INFO: Container egress IP address: %s (from %s)", address, e.resolver.Name())
+	}()
+}
+
+// current returns the address, "pending" while it is being resolved, "unknown" when resolving
+// failed and "disabled" without a resolver. A failed resolution is retried in the background.
+func (e *egressIPInfo) current() string {
+	if e.resolver == nil {
+		return "disabled"
+	}
+	e.mu.Lock()
+	address, running, err := e.address, e.running, e.err
+	e.mu.Unlock()
+	switch {
+	case address != "":
+		return address
+	case running:
+		return "pending"
+	}
+	e.resolveAsync()
+	if err != nil {
+		return "unknown"
+	}
+	return "pending"
+}
+
+// staticEgressIP reports the configured address
+type staticEgressIP string
+
+func (s staticEgressIP) Name() string { return "static" }
+
+func (s staticEgressIP) Resolve(context.Context) (string, error) {
+	if s == "" {
+		return "", fmt.Errorf("EGRESS_IP is not set")
+	}
+	return string(s), nil
+}
+
+// publicLookupEgressIP asks public services, in order, for the address requests come from
+type publicLookupEgressIP struct {
+	services []string
+}
+
+func (publicLookupEgressIP) Name() string { return "lookup" }
+
+func (p publicLookupEgressIP) Resolve(ctx context.Context) (string, error) {
+	client := newOutboundClient(5 * time.Second)
+	var errs []string
+	for _, service := range p.services {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, service, nil)
+		if err != nil {
+			return "", err
+		}
+		body, err := readIPResponse(client, req)
+		if err != nil {
+			log.Printf("DEBUG: Failed to get IP from %s: %v", service, err)
+			errs = append(errs, fmt.Sprintf("%s: %v", service, err))
+			continue
+		}
+		return strings.TrimSpace(string(body)), nil
+	}
+	return "", fmt.Errorf("no service answered: %s", strings.Join(errs, "; "))
+}
+
+// imdsEgressIP reads the public addresses of the VM's network interfaces from the Azure Instance
+// Metadata Service; it is not available in Container Apps on the consumption plan
+type imdsEgressIP struct {
+	endpoint string
+}
+
+func (imdsEgressIP) Name() string { return "imds" }
+
+func (m imdsEgressIP) Resolve(ctx context.Context) (string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, m.endpoint+"/metadata/instance/network?api-version=2021-02-01", nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Metadata", "true")
+	body, err := readIPResponse(newDirectClient(5*time.Second), req)
+	if err != nil {
+		return "", err
+	}
+
+	var network struct {
+		Interface []struct {
+			IPv4 struct {
+				IPAddress []struct {
+					PublicIPAddress string `json:"publicIpAddress"`
+				} `json:"ipAddress"`
+			} `json:"ipv4"`
+		} `json:"interface"`
+	}
+	if err := json.Unmarshal(body, &network); err != nil {
+		return "", fmt.Errorf("failed to parse the instance metadata: %v", err)
+	}
+	var addresses []string
+	for _, iface := range network.Interface {
+		for _, address := range iface.IPv4.IPAddress {
+			if address.PublicIPAddress != "" {
+				addresses = append(addresses, address.PublicIPAddress)
+			}
+		}
+	}
+	if len(addresses) == 0 {
+		return "", fmt.Errorf("the instance metadata lists no public IP address")
+	}
+	return strings.Join(addresses, ","), nil
+}
+
+// readIPResponse sends req and returns the body of a 200 response
+func readIPResponse(client *http.Client, req *http.Request) ([]byte, error) {
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("status %d", resp.StatusCode)
+	}
+	return body, nil
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestEgressIPResolvers(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/down":
+			w.WriteHeader(http.StatusServiceUnavailable)
+		case "/ip":
+			w.Write([]byte("203.0.113.7\n"))
+		case "/metadata/instance/network":
+			if r.Header.Get("Metadata") != "true" {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			w.Write([]byte(`{"interface": [{"ipv4": {"ipAddress": [{"privateIpAddress": "10.0.0.4", "publicIpAddress": "198.51.100.20"}]}}]}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	tests := []struct {
+		name     string
+		resolver egressIPResolver
+		want     string
+		wantErr  string
+	}{
+		{"lookup falls back to the next service", publicLookupEgressIP{services: []string{server.URL + "/down", server.URL + "/ip"}}, "203.0.113.7", ""},
+		{"lookup without an answer", publicLookupEgressIP{services: []string{server.URL + "/down"}}, "", "no service answered"},
+		{"imds", imdsEgressIP{endpoint: server.URL}, "198.51.100.20", ""},
+		{"static", staticEgressIP("192.0.2.10"), "192.0.2.10", ""},
+		{"static without EGRESS_IP", staticEgressIP(""), "", "EGRESS_IP is not set"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.resolver.Resolve(context.Background())
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("expected error containing %q, got %q, %v", tt.wantErr, got, err)
+				}
+				return
+			}
+			if err != nil || got != tt.want {
+				t.Errorf("got %q, %v, want %q", got, err, tt.want)
+			}
+		})
+	}
+}
+
+// blockingEgressIP resolves once release is closed
+type blockingEgressIP struct {
+	release chan struct{}
+}
+
+func (blockingEgressIP) Name() string { return "blocking" }
+
+func (b blockingEgressIP) Resolve(context.Context) (string, error) {
+	<-b.release
+	return "192.0.2.99", nil
+}
+
+func TestEgressIPInfoIsAsync(t *testing.T) {
+	if got := newEgressIPInfo(nil).current(); got != "disabled" {
+		t.Errorf("expected disabled without a resolver, got %s", got)
+	}
+
+	resolver := blockingEgressIP{release: make(chan struct{})}
+	info := newEgressIPInfo(resolver)
+	info.resolveAsync()
+	if got := info.current(); got != "pending" {
+		t.Errorf("expected pending while resolving, got %s", got)
+	}
+	close(resolver.release)
+
+	deadline := time.Now().Add(2 * time.Second)
+	for info.current() != "192.0.2.99" {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected the resolved address, got %s", info.current())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
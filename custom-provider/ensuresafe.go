@@ -0,0 +1,62 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/davidh-cyberark/privilegeaccessmanager-sdk-go/pam"
+)
+
+// An account PUT with ensureSafe: true creates its safe, with PCloud's default settings, when the
+// safe does not exist yet, for teams that only declare accounts and would otherwise need a safes
+// resource and a dependsOn for every one of them. The safe is not a resource of the deployment:
+// nothing is recorded for it, so deleting the accounts leaves it in place.
+
+// ensureAccountSafe creates the safe of an account PUT with ensureSafe when it does not exist. It
+// reports whether the PUT may go on; when it may not, the request has been answered.
+func ensureAccountSafe(w http.ResponseWriter, r *http.Request, cpRequest CustomProviderRequestPath, properties AccountProperties) bool {
+	if !properties.EnsureSafe {
+		return true
+	}
+	safename, _ := requestedAccountName(cpRequest, properties)
+	if safename == "" {
+		return true
+	}
+
+	stopAuth := startPhase(r, "auth")
+	pamService, err := newPAMService()
+	stopAuth()
+	if err != nil {
+		sendJSONError(w, http.StatusInternalServerError, "PAMClientError", fmt.Sprintf("Failed to create PAM client: %v", err))
+		return false
+	}
+
+	stopPAM := startPhase(r, "pam")
+	defer stopPAM()
+	getSpan := startSpan(r, "GetSafeDetails", "pcloud.safeName", safename)
+	_, retcode, err := pcloudRetry(r.Context(), "safes", "GetSafeDetails", true, func(ctx context.Context) (pam.GetSafeDetails, int, error) {
+		return pamService.GetSafeDetails(ctx, safename)
+	})
+	getSpan.SetAttr("pcloud.status", strconv.Itoa(retcode))
+	getSpan.End(err)
+	if retcode != http.StatusNotFound {
+		if err != nil || retcode >= 300 {
+			sendJSONError(w, http.StatusInternalServerError, "GetSafeDetailsError", fmt.Sprintf("Failed to check for safe %s: (%d) %v", safename, retcode, checkMaintenance(err)))
+			return false
+		}
+		return true
+	}
+
+	addSpan := startSpan(r, "AddSafe", "pcloud.safeName", safename)
+	safe, err := createSafe(r.Context(), pamService, pam.PostAddSafeRequest{SafeName: safename})
+	addSpan.End(err)
+	if err != nil {
+		sendJSONError(w, http.StatusInternalServerError, "SafeCreationError", fmt.Sprintf("Failed to create safe %s for the account: %v", safename, err))
+		return false
+	}
+	log.Printf("INFO: (CreateAccount) created safe %s (%s) for %s, ensureSafe is set", safename, safe.SafeURLID, cpRequest.ID())
+	return true
+}
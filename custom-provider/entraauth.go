@@ -0,0 +1,289 @@
+package main
+
+import (
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"math/big"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// When the provider is exposed with authentication enabled, callers can also authenticate with an
+// Entra ID access token in the Authorization header. Tokens are validated locally: the RS256
+// signature against the tenant's published signing keys, the expiry, the issuer, the tenant and the
+// audience (ENTRA_AUDIENCE), and optionally the calling application (ENTRA_ALLOWED_APP_IDS), so a
+// token issued to some other client in the tenant does not let it bypass ARM.
+
+// entraClockSkew is the leeway allowed on exp and nbf
+const entraClockSkew = 5 * time.Minute
+
+// entraKeysMinRefresh limits how often an unknown key ID makes the signing keys be fetched again
+const entraKeysMinRefresh = 5 * time.Minute
+
+// entraValidator validates Entra ID access tokens for one tenant
+type entraValidator struct {
+	tenantID  string
+	keysURL   string
+	audiences map[string]bool
+	issuers   map[string]bool
+	appIDs    map[string]bool
+	client    *http.Client
+
+	mu          sync.Mutex
+	keys        map[string]*rsa.PublicKey
+	loadedAt    time.Time
+	lastAttempt time.Time
+}
+
+// entraClaims are the access token claims the provider checks
+type entraClaims struct {
+	Audience  json.RawMessage `json:"aud"`
+	Issuer    string          `json:"iss"`
+	TenantID  string          `json:"tid"`
+	AppID     string          `json:"appid"`
+	AZP       string          `json:"azp"`
+	ObjectID  string          `json:"oid"`
+	ExpiresAt int64           `json:"exp"`
+	NotBefore int64           `json:"nbf"`
+	Roles     []string        `json:"roles"`
+}
+
+// clientID is the application the token was issued to: appid in v1 tokens, azp in v2 tokens
+func (c *entraClaims) clientID() string {
+	if c.AppID != "" {
+		return c.AppID
+	}
+	return c.AZP
+}
+
+// hasRole reports whether the token carries the app role
+func (c *entraClaims) hasRole(role string) bool {
+	for _, r := range c.Roles {
+		if r == role {
+			return true
+		}
+	}
+	return false
+}
+
+// loadEntraValidator reads ENTRA_TENANT_ID and friends; nil when Entra ID tokens are not accepted
+func loadEntraValidator() *entraValidator {
+	tenantID := strings.TrimSpace(os.Getenv("ENTRA_TENANT_ID"))
+	if tenantID == "" {
+		return nil
+	}
+	authority := strings.TrimSuffix(getEnvOrDefault("ENTRA_AUTHORITY_HOST", "https://login.microsoftonline.com"), "/")
+	v := &entraValidator{
+		tenantID:  tenantID,
+		keysURL:   authority + "/" + tenantID + "/discovery/v2.0/keys",
+		audiences: splitSet(os.Getenv("ENTRA_AUDIENCE")),
+		issuers:   splitSet(os.Getenv("ENTRA_ISSUER")),
+		appIDs:    splitSet(strings.ToLower(os.Getenv("ENTRA_ALLOWED_APP_IDS"))),
+		client:    newOutboundClient(10 * time.Second),
+		keys:      map[string]*rsa.PublicKey{},
+	}
+	if len(v.issuers) == 0 {
+		// v2.0 tokens, and v1.0 tokens when the app registration has not opted into v2.0
+		v.issuers = map[string]bool{
+			authority + "/" + tenantID + "/v2.0":        true,
+			"https://sts.windows.net/" + tenantID + "/": true,
+		}
+	}
+	if len(v.audiences) == 0 {
+		log.Printf("WARNING: ENTRA_TENANT_ID is set without ENTRA_AUDIENCE, every Entra ID token will be rejected")
+	}
+	return v
+}
+
+// splitSet parses a comma separated list, ignoring blanks
+func splitSet(list string) map[string]bool {
+	set := map[string]bool{}
+	for _, item := range strings.Split(list, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			set[item] = true
+		}
+	}
+	return set
+}
+
+// validate checks token and returns its claims
+func (v *entraValidator) validate(token string) (*entraClaims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("malformed token")
+	}
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeJWTPart(parts[0], &header); err != nil {
+		return nil, fmt.Errorf("malformed token header: %w", err)
+	}
+	if header.Alg != "RS256" {
+		return nil, fmt.Errorf("unsupported signing algorithm %q", header.Alg)
+	}
+	key, err := v.signingKey(header.Kid)
+	if err != nil {
+		return nil, err
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("malformed token signature: %w", err)
+	}
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	if err := rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], signature); err != nil {
+		return nil, fmt.Errorf("invalid token signature")
+	}
+
+	var claims entraClaims
+	if err := decodeJWTPart(parts[1], &claims); err != nil {
+		return nil, fmt.Errorf("malformed token claims: %w", err)
+	}
+	now := time.Now()
+	if claims.ExpiresAt == 0 || now.After(time.Unix(claims.ExpiresAt, 0).Add(entraClockSkew)) {
+		return nil, fmt.Errorf("token expired")
+	}
+	if claims.NotBefore != 0 && now.Add(entraClockSkew).Before(time.Unix(claims.NotBefore, 0)) {
+		return nil, fmt.Errorf("token not yet valid")
+	}
+	if !v.issuers[claims.Issuer] {
+		return nil, fmt.Errorf("unexpected issuer %q", claims.Issuer)
+	}
+	if !strings.EqualFold(claims.TenantID, v.tenantID) {
+		return nil, fmt.Errorf("unexpected tenant %q", claims.TenantID)
+	}
+	if !v.audienceAllowed(claims.Audience) {
+		return nil, fmt.Errorf("unexpected audience %s", claims.Audience)
+	}
+	if len(v.appIDs) > 0 && !v.appIDs[strings.ToLower(claims.clientID())] {
+		return nil, fmt.Errorf("application %q is not allowed", claims.clientID())
+	}
+	return &claims, nil
+}
+
+// audienceAllowed reports whether aud, a string or an array of strings, names a configured audience
+func (v *entraValidator) audienceAllowed(aud json.RawMessage) bool {
+	var audiences []string
+	if err := json.Unmarshal(aud, &audiences); err != nil {
+		var single string
+		if err := json.Unmarshal(aud, &single); err != nil {
+			return false
+		}
+		audiences = []string{single}
+	}
+	for _, a := range audiences {
+		if v.audiences[a] {
+			return true
+		}
+	}
+	return false
+}
+
+func decodeJWTPart(part string, out interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, out)
+}
+
+// signingKey returns the tenant's signing key kid. Keys are fetched on first use, daily, and when a
+// token names a key not seen before (Entra ID rolls its keys), at most every entraKeysMinRefresh.
+func (v *entraValidator) signingKey(kid string) (*rsa.PublicKey, error) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	key, ok := v.keys[kid]
+	if ok && time.Since(v.loadedAt) < 24*time.Hour {
+		return key, nil
+	}
+	if time.Since(v.lastAttempt) >= entraKeysMinRefresh || v.loadedAt.IsZero() {
+		v.lastAttempt = time.Now()
+		err := v.loadKeys()
+		recordDependencyResult("entraId", err)
+		if err != nil {
+			log.Printf("WARNING: Failed to load Entra ID signing keys: %v", err)
+		}
+	}
+	if key, ok := v.keys[kid]; ok {
+		return key, nil
+	}
+	return nil, fmt.Errorf("unknown signing key %q", kid)
+}
+
+// loadKeys replaces the cached keys with the RSA keys published at keysURL; v.mu must be held
+func (v *entraValidator) loadKeys() error {
+	resp, err := v.client.Get(v.keysURL)
+	if err != nil {
+		return fmt.Errorf("signing keys request failed: %w", err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return fmt.Errorf("failed to read signing keys: %w", err)
+	}
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("signing keys request returned status %d", resp.StatusCode)
+	}
+
+	var set struct {
+		Keys []struct {
+			Kty string `json:"kty"`
+			Kid string `json:"kid"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+		} `json:"keys"`
+	}
+	if err := json.Unmarshal(body, &set); err != nil {
+		return fmt.Errorf("failed to parse signing keys: %w", err)
+	}
+	keys := map[string]*rsa.PublicKey{}
+	for _, k := range set.Keys {
+		if k.Kty != "RSA" {
+			continue
+		}
+		n, errN := base64.RawURLEncoding.DecodeString(k.N)
+		e, errE := base64.RawURLEncoding.DecodeString(k.E)
+		if errN != nil || errE != nil || len(e) > 4 {
+			log.Printf("WARNING: Skipping malformed Entra ID signing key %s", k.Kid)
+			continue
+		}
+		keys[k.Kid] = &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+	}
+	if len(keys) == 0 {
+		return fmt.Errorf("no RSA signing keys published")
+	}
+	v.keys = keys
+	v.loadedAt = time.Now()
+	log.Printf("DEBUG: Loaded %d Entra ID signing keys for tenant %s", len(keys), v.tenantID)
+	return nil
+}
+
+func (v *entraValidator) healthDetails() map[string]interface{} {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	details := map[string]interface{}{"tenantId": v.tenantID, "keys": len(v.keys)}
+	if !v.loadedAt.IsZero() {
+		details["loadedAt"] = v.loadedAt
+	}
+	return details
+}
+
+// Flush drops the cached signing keys, so they are fetched again for the next token
+func (v *entraValidator) Flush() int {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	dropped := len(v.keys)
+	v.keys = map[string]*rsa.PublicKey{}
+	v.loadedAt = time.Time{}
+	return dropped
+}
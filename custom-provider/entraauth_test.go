@@ -0,0 +1,190 @@
+package main
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testTenant = "11111111-2222-3333-4444-555555555555"
+
+// signTestToken returns an RS256 JWT with claims, signed by key under kid
+func signTestToken(t *testing.T, key *rsa.PrivateKey, kid string, alg string, claims map[string]interface{}) string {
+	t.Helper()
+	encode := func(v interface{}) string {
+		data, err := json.Marshal(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return base64.RawURLEncoding.EncodeToString(data)
+	}
+	signed := encode(map[string]string{"alg": alg, "kid": kid, "typ": "JWT"}) + "." + encode(claims)
+	digest := sha256.Sum256([]byte(signed))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+// newTestEntraAuthority serves key as kid at the tenant's discovery keys URL and counts the requests
+func newTestEntraAuthority(t *testing.T, key *rsa.PrivateKey, kid string) (*httptest.Server, *int) {
+	t.Helper()
+	fetches := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/"+testTenant+"/discovery/v2.0/keys" {
+			http.NotFound(w, r)
+			return
+		}
+		fetches++
+		json.NewEncoder(w).Encode(map[string]interface{}{"keys": []map[string]string{{
+			"kty": "RSA",
+			"kid": kid,
+			"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+			"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+		}}})
+	}))
+	t.Cleanup(srv.Close)
+	return srv, &fetches
+}
+
+func TestEntraValidator(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	authority, fetches := newTestEntraAuthority(t, key, "key1")
+
+	t.Setenv("ENTRA_TENANT_ID", testTenant)
+	t.Setenv("ENTRA_AUTHORITY_HOST", authority.URL)
+	t.Setenv("ENTRA_AUDIENCE", "api://cyberark-provider")
+	t.Setenv("ENTRA_ISSUER", "")
+	t.Setenv("ENTRA_ALLOWED_APP_IDS", "AAAA-arm")
+	v := loadEntraValidator()
+
+	valid := func() map[string]interface{} {
+		return map[string]interface{}{
+			"aud":   "api://cyberark-provider",
+			"iss":   "https://sts.windows.net/" + testTenant + "/",
+			"tid":   testTenant,
+			"appid": "aaaa-arm",
+			"exp":   time.Now().Add(time.Hour).Unix(),
+			"nbf":   time.Now().Add(-time.Minute).Unix(),
+		}
+	}
+	with := func(name string, value interface{}) map[string]interface{} {
+		claims := valid()
+		if value == nil {
+			delete(claims, name)
+		} else {
+			claims[name] = value
+		}
+		return claims
+	}
+
+	tests := []struct {
+		name    string
+		token   string
+		wantErr string
+	}{
+		{name: "valid v1 token", token: signTestToken(t, key, "key1", "RS256", valid())},
+		{name: "valid v2 token", token: signTestToken(t, key, "key1", "RS256", with("iss", authority.URL+"/"+testTenant+"/v2.0"))},
+		{name: "audience list", token: signTestToken(t, key, "key1", "RS256", with("aud", []string{"other", "api://cyberark-provider"}))},
+		{name: "no client", token: signTestToken(t, key, "key1", "RS256", with("appid", nil)), wantErr: "not allowed"},
+		{name: "wrong audience", token: signTestToken(t, key, "key1", "RS256", with("aud", "api://other")), wantErr: "unexpected audience"},
+		{name: "wrong issuer", token: signTestToken(t, key, "key1", "RS256", with("iss", "https://sts.windows.net/other/")), wantErr: "unexpected issuer"},
+		{name: "wrong tenant", token: signTestToken(t, key, "key1", "RS256", with("tid", "other")), wantErr: "unexpected tenant"},
+		{name: "expired", token: signTestToken(t, key, "key1", "RS256", with("exp", time.Now().Add(-time.Hour).Unix())), wantErr: "expired"},
+		{name: "not yet valid", token: signTestToken(t, key, "key1", "RS256", with("nbf", time.Now().Add(time.Hour).Unix())), wantErr: "not yet valid"},
+		{name: "other application", token: signTestToken(t, key, "key1", "RS256", with("appid", "bbbb")), wantErr: "not allowed"},
+		{name: "forged signature", token: signTestToken(t, otherKey, "key1", "RS256", valid()), wantErr: "invalid token signature"},
+		{name: "unknown key", token: signTestToken(t, key, "key2", "RS256", valid()), wantErr: "unknown signing key"},
+		{name: "unsigned", token: signTestToken(t, key, "key1", "none", valid()), wantErr: "unsupported signing algorithm"},
+		{name: "malformed", token: "abc.def", wantErr: "malformed token"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := v.validate(tt.token)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Errorf("unexpected error %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("expected error containing %q, got %v", tt.wantErr, err)
+			}
+		})
+	}
+
+	// Unknown keys only make the keys be fetched again after entraKeysMinRefresh
+	if *fetches != 1 {
+		t.Errorf("expected 1 signing key fetch, got %d", *fetches)
+	}
+	v.lastAttempt = time.Now().Add(-entraKeysMinRefresh)
+	v.validate(signTestToken(t, key, "key2", "RS256", valid()))
+	if *fetches != 2 {
+		t.Errorf("expected the keys to be fetched again for an unknown key, got %d fetches", *fetches)
+	}
+}
+
+func TestCallerAuthMiddlewareEntraToken(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	authority, _ := newTestEntraAuthority(t, key, "key1")
+	t.Setenv("CALLER_AUTH_TOKEN", "")
+	t.Setenv("CALLER_CERT_THUMBPRINTS", "")
+	t.Setenv("CALLER_CERT_SUBJECTS", "")
+	t.Setenv("ENTRA_TENANT_ID", testTenant)
+	t.Setenv("ENTRA_AUTHORITY_HOST", authority.URL)
+	t.Setenv("ENTRA_AUDIENCE", "api://cyberark-provider")
+
+	saved := callerAuth
+	defer func() { callerAuth = saved }()
+	callerAuth = loadCallerAuthConfig()
+
+	handler := callerAuthMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	token := signTestToken(t, key, "key1", "RS256", map[string]interface{}{
+		"aud": "api://cyberark-provider",
+		"iss": authority.URL + "/" + testTenant + "/v2.0",
+		"tid": testTenant,
+		"azp": "arm",
+		"exp": time.Now().Add(time.Hour).Unix(),
+	})
+
+	for _, tt := range []struct {
+		authorization  string
+		expectedStatus int
+	}{
+		{"Bearer " + token, http.StatusOK},
+		{"Bearer " + token + "x", http.StatusUnauthorized},
+		{"", http.StatusUnauthorized},
+	} {
+		req := httptest.NewRequest("PUT", "/", nil)
+		if tt.authorization != "" {
+			req.Header.Set("Authorization", tt.authorization)
+		}
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		if rr.Code != tt.expectedStatus {
+			t.Errorf("expected status %d, got %d", tt.expectedStatus, rr.Code)
+		}
+	}
+}
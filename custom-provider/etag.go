@@ -0,0 +1,135 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+)
+
+// computeETag derives a strong ETag from the serialized resource
+func computeETag(body []byte) string {
+	sum := sha256.Sum256(body)
+	return `"` + hex.EncodeToString(sum[:16]) + `"`
+}
+
+// resourceETag is the ETag sendJSONResource sends for the response
+func resourceETag(response CustomProviderResponse) string {
+	body, err := json.Marshal(response)
+	if err != nil {
+		return ""
+	}
+	return computeETag(body)
+}
+
+// etagMatches reports whether an If-None-Match/If-Match header value matches the ETag.
+// The header may be "*" or a comma separated list; weak validators compare equal to strong ones.
+func etagMatches(header, etag string) bool {
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+		if candidate == "*" || candidate == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// sendJSONResource writes a resource response with an ETag header, answering a GET whose
+// If-None-Match matches the current ETag with 304 Not Modified and no body
+func sendJSONResource(w http.ResponseWriter, r *http.Request, code int, response CustomProviderResponse) {
+	body, err := json.Marshal(response)
+	if err != nil {
+		sendJSONError(w, http.StatusInternalServerError, "ResponseMarshalError", err.Error())
+		return
+	}
+	etag := computeETag(body)
+	w.Header().Set("ETag", etag)
+
+	if r.Method == http.MethodGet {
+		if inm := r.Header.Get("If-None-Match"); inm != "" && etagMatches(inm, etag) {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	w.Write(append(body, '\n'))
+}
+
+// etagRecorder captures the status, ETag and body of a GET run to evaluate preconditions
+type etagRecorder struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (e *etagRecorder) Header() http.Header { return e.header }
+
+func (e *etagRecorder) WriteHeader(status int) {
+	if e.status == 0 {
+		e.status = status
+	}
+}
+
+func (e *etagRecorder) Write(data []byte) (int, error) {
+	e.WriteHeader(http.StatusOK)
+	return e.body.Write(data)
+}
+
+// checkPreconditions evaluates If-Match and If-None-Match on a PUT, PATCH or DELETE against the
+// ETag a GET of the resource returns now, so a deployment that read the resource before another
+// one changed it gets 412 Precondition Failed instead of overwriting the change. If-Match: * needs
+// the resource to exist and If-None-Match: * needs it not to. It answers the request itself and
+// returns false when a precondition fails or the resource cannot be read. The check and the write
+// are not atomic, so writes racing within the same moment can still both pass.
+func checkPreconditions(w http.ResponseWriter, r *http.Request, cpRequest CustomProviderRequestPath, get providerHandler) bool {
+	ifMatch, ifNoneMatch := r.Header.Get("If-Match"), r.Header.Get("If-None-Match")
+	if ifMatch == "" && ifNoneMatch == "" {
+		return true
+	}
+
+	getRequest := r.Clone(r.Context())
+	getRequest.Method = http.MethodGet
+	getRequest.Body = http.NoBody
+	getRequest.Header.Del("If-Match")
+	getRequest.Header.Del("If-None-Match")
+	current := &etagRecorder{header: http.Header{}}
+	get(current, getRequest, cpRequest)
+
+	var exists bool
+	switch current.status {
+	case http.StatusOK:
+		exists = true
+	case http.StatusNotFound:
+	default:
+		log.Printf("WARNING: Cannot evaluate the preconditions of %s %s: GET returned %d", r.Method, cpRequest.ID(), current.status)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(current.status)
+		w.Write(current.body.Bytes())
+		return false
+	}
+	etag := current.header.Get("ETag")
+
+	var message string
+	switch {
+	case ifMatch != "" && !exists:
+		message = fmt.Sprintf("%s does not exist, but If-Match is %s", cpRequest.ResourceInstanceName, ifMatch)
+	case ifMatch != "" && !etagMatches(ifMatch, etag):
+		message = fmt.Sprintf("%s has changed: its ETag is %s, not %s", cpRequest.ResourceInstanceName, etag, ifMatch)
+	case ifNoneMatch != "" && exists && etagMatches(ifNoneMatch, etag):
+		message = fmt.Sprintf("%s already exists with ETag %s", cpRequest.ResourceInstanceName, etag)
+	default:
+		return true
+	}
+	log.Printf("INFO: Precondition failed for %s %s: %s", r.Method, cpRequest.ID(), message)
+	if exists {
+		w.Header().Set("ETag", etag)
+	}
+	sendJSONError(w, http.StatusPreconditionFailed, "PreconditionFailed", message)
+	return false
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestEtagMatches(t *testing.T) {
+	etag := `"abc123"`
+	tests := []struct {
+		name     string
+		header   string
+		expected bool
+	}{
+		{name: "exact match", header: `"abc123"`, expected: true},
+		{name: "weak match", header: `W/"abc123"`, expected: true},
+		{name: "list match", header: `"zzz", "abc123"`, expected: true},
+		{name: "wildcard", header: "*", expected: true},
+		{name: "no match", header: `"zzz"`, expected: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if result := etagMatches(tt.header, etag); result != tt.expected {
+				t.Errorf("expected %t, got %t", tt.expected, result)
+			}
+		})
+	}
+}
+
+func TestSendJSONResource_ConditionalGet(t *testing.T) {
+	response := CustomProviderResponse{
+		ID:         "/subscriptions/test-sub/resourceGroups/test-rg/providers/Microsoft.CustomProviders/resourceProviders/test-provider/safes/test-safe",
+		Name:       "test-safe",
+		Type:       "Microsoft.CustomProviders/resourceProviders/safes",
+		Properties: map[string]interface{}{"safeName": "test-safe", "provisioningState": "Succeeded"},
+	}
+
+	first := httptest.NewRecorder()
+	sendJSONResource(first, httptest.NewRequest("GET", "/", nil), http.StatusOK, response)
+	etag := first.Header().Get("ETag")
+	if first.Code != http.StatusOK || etag == "" {
+		t.Fatalf("expected 200 with an ETag, got %d %q", first.Code, etag)
+	}
+
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("If-None-Match", etag)
+	second := httptest.NewRecorder()
+	sendJSONResource(second, req, http.StatusOK, response)
+	if second.Code != http.StatusNotModified || second.Body.Len() != 0 {
+		t.Errorf("expected 304 with empty body, got %d with %d bytes", second.Code, second.Body.Len())
+	}
+
+	response.Properties["description"] = "changed"
+	third := httptest.NewRecorder()
+	sendJSONResource(third, req, http.StatusOK, response)
+	if third.Code != http.StatusOK {
+		t.Errorf("expected 200 after the resource changed, got %d", third.Code)
+	}
+}
+
+func TestCheckPreconditions(t *testing.T) {
+	current := CustomProviderResponse{ID: "/subscriptions/sub1/resourceGroups/rg1/providers/Microsoft.CustomProviders/resourceProviders/CyberArkProvider/safes/safe1", Name: "safe1"}
+	etag := resourceETag(current)
+	existing := func(w http.ResponseWriter, r *http.Request, cpRequest CustomProviderRequestPath) {
+		if r.Method != http.MethodGet || r.Header.Get("If-None-Match") != "" {
+			t.Errorf("expected a plain GET, got %s with If-None-Match %q", r.Method, r.Header.Get("If-None-Match"))
+		}
+		sendJSONResource(w, r, http.StatusOK, current)
+	}
+	missing := func(w http.ResponseWriter, r *http.Request, cpRequest CustomProviderRequestPath) {
+		sendJSONError(w, http.StatusNotFound, "SafeNotFound", "Safe not found: safe1")
+	}
+	failing := func(w http.ResponseWriter, r *http.Request, cpRequest CustomProviderRequestPath) {
+		sendJSONError(w, http.StatusBadGateway, "GetSafeDetailsError", "PCloud is down")
+	}
+
+	tests := []struct {
+		name        string
+		method      string
+		ifMatch     string
+		ifNoneMatch string
+		get         providerHandler
+		wantOK      bool
+		wantStatus  int
+	}{
+		{name: "no preconditions", method: "DELETE", get: failing, wantOK: true},
+		{name: "if-match current", method: "PUT", ifMatch: etag, get: existing, wantOK: true},
+		{name: "if-match stale", method: "PATCH", ifMatch: `"stale"`, get: existing, wantStatus: http.StatusPreconditionFailed},
+		{name: "if-match any on missing", method: "DELETE", ifMatch: "*", get: missing, wantStatus: http.StatusPreconditionFailed},
+		{name: "if-none-match any on missing", method: "PUT", ifNoneMatch: "*", get: missing, wantOK: true},
+		{name: "if-none-match any on existing", method: "PUT", ifNoneMatch: "*", get: existing, wantStatus: http.StatusPreconditionFailed},
+		{name: "if-none-match other etag", method: "PUT", ifNoneMatch: `"other"`, get: existing, wantOK: true},
+		{name: "read fails", method: "PUT", ifMatch: etag, get: failing, wantStatus: http.StatusBadGateway},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(tt.method, "/", nil)
+			if tt.ifMatch != "" {
+				req.Header.Set("If-Match", tt.ifMatch)
+			}
+			if tt.ifNoneMatch != "" {
+				req.Header.Set("If-None-Match", tt.ifNoneMatch)
+			}
+			w := httptest.NewRecorder()
+			ok := checkPreconditions(w, req, CustomProviderRequestPath{ResourceInstanceName: "safe1"}, tt.get)
+			if ok != tt.wantOK {
+				t.Fatalf("expected %t, got %t (%d %s)", tt.wantOK, ok, w.Code, w.Body.String())
+			}
+			if !ok && w.Code != tt.wantStatus {
+				t.Errorf("expected status %d, got %d: %s", tt.wantStatus, w.Code, w.Body.String())
+			}
+		})
+	}
+}
@@ -0,0 +1,279 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/davidh-cyberark/privilegeaccessmanager-sdk-go/pam"
+)
+
+// The exportTemplate action renders a safe that exists in PCloud, with its members, as custom
+// provider resources in Bicep or ARM JSON, so a vault built by hand can be brought under a
+// template. Deploying the result adopts the safe and its members instead of creating them again
+// (see Re-running Deployments in the README). Accounts are not exported: their secrets cannot be
+// read into a template, so onboard them with importAccount.
+
+const (
+	exportFormatBicep = "bicep"
+	exportFormatJSON  = "json"
+)
+
+// ExportTemplateRequest is the body of the exportTemplate action
+type ExportTemplateRequest struct {
+	SafeName string `json:"safeName"`
+	// Format is bicep (the default) or json
+	Format string `json:"format,omitempty"`
+	// IncludePredefinedMembers also exports the built-in members PCloud adds to every safe
+	IncludePredefinedMembers bool `json:"includePredefinedMembers,omitempty"`
+}
+
+// exportedResource is one custom provider resource of an exported template
+type exportedResource struct {
+	Symbol       string
+	ResourceType string
+	Name         string
+	Properties   map[string]interface{}
+	DependsOn    string
+}
+
+// exportSafeResources returns the safe and its members as custom provider resources
+func exportSafeResources(safe pam.GetSafeDetails, members []pam.PostAddMemberResponse, includePredefined bool) []exportedResource {
+	properties := map[string]interface{}{"safeName": safe.SafeName}
+	if safe.Description != "" {
+		properties["description"] = safe.Description
+	}
+	if safe.ManagingCPM != "" {
+		properties["managingCPM"] = safe.ManagingCPM
+	}
+	if safe.Location != "" && safe.Location != `\` {
+		properties["location"] = safe.Location
+	}
+	// PCloud keeps either versions or days of retention; days is 0 when versions are kept
+	if safe.NumberOfDaysRetention > 0 {
+		properties["numberOfDaysRetention"] = safe.NumberOfDaysRetention
+	} else if versions, err := strconv.Atoi(fmt.Sprint(safe.NumberOfVersionsRetention)); err == nil && versions > 0 {
+		properties["numberOfVersionsRetention"] = versions
+	}
+	if safe.OlacEnabled {
+		properties["olacEnabled"] = true
+	}
+
+	safeSymbol := exportSymbol("safe", safe.SafeName, nil)
+	resources := []exportedResource{{Symbol: safeSymbol, ResourceType: "safes", Name: safe.SafeName, Properties: properties}}
+	symbols := map[string]bool{safeSymbol: true}
+
+	sort.Slice(members, func(i, j int) bool {
+		return strings.ToLower(members[i].MemberName) < strings.ToLower(members[j].MemberName)
+	})
+	for _, member := range members {
+		if member.IsPredefinedUser && !includePredefined {
+			continue
+		}
+		permissions, _ := toProperties(member.Permissions)
+		properties := map[string]interface{}{"permissions": permissions}
+		if member.MemberType != "" {
+			properties["memberType"] = member.MemberType
+		}
+		if member.MembershipExpirationDate > 0 {
+			properties["membershipExpirationDate"] = member.MembershipExpirationDate
+		}
+		symbol := exportSymbol("member", member.MemberName, symbols)
+		symbols[symbol] = true
+		resources = append(resources, exportedResource{Symbol: symbol, ResourceType: "safeMembers",
+			Name: safe.SafeName + "." + member.MemberName, Properties: properties, DependsOn: safeSymbol})
+	}
+	return resources
+}
+
+// exportSymbol turns a name into a unique Bicep symbolic name, e.g. member_jdoe_corp_com
+func exportSymbol(prefix, name string, taken map[string]bool) string {
+	symbol := prefix + "_" + strings.Map(func(r rune) rune {
+		if r < unicode.MaxASCII && (unicode.IsLetter(r) || unicode.IsDigit(r)) {
+			return r
+		}
+		return '_'
+	}, name)
+	unique := symbol
+	for i := 2; taken[unique]; i++ {
+		unique = fmt.Sprintf("%s_%d", symbol, i)
+	}
+	return unique
+}
+
+// renderBicep renders the resources as a Bicep file that references the custom provider
+func renderBicep(resources []exportedResource) string {
+	var b strings.Builder
+	b.WriteString("@description('The name of the custom provider')\n")
+	b.WriteString("param customProviderName string = 'CyberArkProvider'\n\n")
+	b.WriteString("resource customProvider 'Microsoft.CustomProviders/resourceProviders@2018-09-01-preview' existing = {\n")
+	b.WriteString("  name: customProviderName\n}\n")
+	for _, res := range resources {
+		b.WriteString("\n#disable-next-line BCP081\n")
+		fmt.Fprintf(&b, "resource %s 'Microsoft.CustomProviders/resourceProviders/%s@%s' = {\n", res.Symbol, res.ResourceType, armCustomProvidersAPIVersion)
+		b.WriteString("  parent: customProvider\n")
+		fmt.Fprintf(&b, "  name: %s\n", bicepValue(res.Name, "  "))
+		fmt.Fprintf(&b, "  properties: %s\n", bicepValue(res.Properties, "  "))
+		if res.DependsOn != "" {
+			fmt.Fprintf(&b, "  dependsOn: [\n    %s\n  ]\n", res.DependsOn)
+		}
+		b.WriteString("}\n")
+	}
+	return b.String()
+}
+
+// bicepValue renders a JSON-like value as a Bicep literal; indent is the indentation of the line
+// the value starts on
+func bicepValue(v interface{}, indent string) string {
+	switch value := v.(type) {
+	case string:
+		escaped := strings.NewReplacer(`\`, `\\`, `'`, `\'`, "${", `\${`, "\n", `\n`, "\r", `\r`, "\t", `\t`).Replace(value)
+		return "'" + escaped + "'"
+	case map[string]interface{}:
+		if len(value) == 0 {
+			return "{}"
+		}
+		keys := make([]string, 0, len(value))
+		for key := range value {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		var b strings.Builder
+		b.WriteString("{\n")
+		for _, key := range keys {
+			name := key
+			if !bicepIdentifier(key) {
+				name = bicepValue(key, "")
+			}
+			fmt.Fprintf(&b, "%s  %s: %s\n", indent, name, bicepValue(value[key], indent+"  "))
+		}
+		b.WriteString(indent + "}")
+		return b.String()
+	case []interface{}:
+		if len(value) == 0 {
+			return "[]"
+		}
+		var b strings.Builder
+		b.WriteString("[\n")
+		for _, item := range value {
+			fmt.Fprintf(&b, "%s  %s\n", indent, bicepValue(item, indent+"  "))
+		}
+		b.WriteString(indent + "]")
+		return b.String()
+	case nil:
+		return "null"
+	default:
+		data, _ := json.Marshal(value)
+		return string(data)
+	}
+}
+
+// bicepIdentifier reports whether an object key can be written without quotes
+func bicepIdentifier(key string) bool {
+	for i, r := range key {
+		if !(r == '_' || unicode.IsLetter(r) || (i > 0 && unicode.IsDigit(r))) || r >= unicode.MaxASCII {
+			return false
+		}
+	}
+	return key != ""
+}
+
+// renderARMTemplate renders the resources as an ARM JSON deployment template
+func renderARMTemplate(resources []exportedResource) map[string]interface{} {
+	armResources := []map[string]interface{}{}
+	for _, res := range resources {
+		armResource := map[string]interface{}{
+			"type":       "Microsoft.CustomProviders/resourceProviders/" + res.ResourceType,
+			"apiVersion": armCustomProvidersAPIVersion,
+			"name":       fmt.Sprintf("[format('{0}/{1}', parameters('customProviderName'), '%s')]", strings.ReplaceAll(res.Name, "'", "''")),
+			"properties": res.Properties,
+		}
+		for _, dependency := range resources {
+			if res.DependsOn != "" && dependency.Symbol == res.DependsOn {
+				armResource["dependsOn"] = []string{fmt.Sprintf("[resourceId('Microsoft.CustomProviders/resourceProviders/%s', parameters('customProviderName'), '%s')]",
+					dependency.ResourceType, strings.ReplaceAll(dependency.Name, "'", "''"))}
+			}
+		}
+		armResources = append(armResources, armResource)
+	}
+	return map[string]interface{}{
+		"$schema":        "https://schema.management.azure.com/schemas/2019-04-01/deploymentTemplate.json#",
+		"contentVersion": "1.0.0.0",
+		"parameters": map[string]interface{}{
+			"customProviderName": map[string]interface{}{
+				"type":         "string",
+				"defaultValue": "CyberArkProvider",
+				"metadata":     map[string]string{"description": "The name of the custom provider"},
+			},
+		},
+		"resources": armResources,
+	}
+}
+
+// handleExportTemplate renders an existing safe and its members as custom provider resources
+func handleExportTemplate(w http.ResponseWriter, r *http.Request, cpRequest CustomProviderRequestPath) {
+	LogRequestDebug("ExportTemplate", r)
+
+	var request ExportTemplateRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		sendJSONError(w, http.StatusBadRequest, "InvalidRequestBody", fmt.Sprintf("Invalid request body: %v", err))
+		return
+	}
+	if request.SafeName == "" {
+		sendJSONError(w, http.StatusBadRequest, "InvalidRequestBody", "safeName is required")
+		return
+	}
+	format := strings.ToLower(request.Format)
+	if format == "" {
+		format = exportFormatBicep
+	}
+	if format != exportFormatBicep && format != exportFormatJSON {
+		sendValidationError(w, []ErrorDetails{{Code: "PropertyInvalidFormat", Target: "format",
+			Message: fmt.Sprintf("format must be %s or %s, got %q", exportFormatBicep, exportFormatJSON, request.Format)}})
+		return
+	}
+
+	stopAuth := startPhase(r, "auth")
+	pamClient, err := createPAMClient()
+	stopAuth()
+	if err != nil {
+		sendJSONError(w, http.StatusInternalServerError, "PAMClientError", fmt.Sprintf("Failed to create PAM client: %v", err))
+		return
+	}
+
+	stopPAM := startPhase(r, "pam")
+	defer stopPAM()
+	safe, retcode, err := pcloudRetry(r.Context(), "safes", "GetSafeDetails", true, func(ctx context.Context) (pam.GetSafeDetails, int, error) {
+		return pamGetSafeDetails(ctx, pamClient, request.SafeName)
+	})
+	if retcode == http.StatusNotFound {
+		sendJSONError(w, http.StatusNotFound, "SafeNotFound", fmt.Sprintf("Safe not found: %s", request.SafeName))
+		return
+	}
+	if err != nil {
+		sendJSONError(w, http.StatusConflict, "GetSafeDetailsError", fmt.Sprintf("Failed to get safe: %v", checkMaintenance(err)))
+		return
+	}
+	members, retcode, err := listSafeMembers(r.Context(), pamClient, safe.SafeURLID)
+	if err != nil {
+		sendJSONError(w, http.StatusConflict, "GetSafeMembersError", fmt.Sprintf("Failed to list safe members: (%d) %v", retcode, err))
+		return
+	}
+
+	resources := exportSafeResources(safe, members, request.IncludePredefinedMembers)
+	response := map[string]interface{}{"safeName": safe.SafeName, "format": format, "resources": len(resources)}
+	if format == exportFormatJSON {
+		response["template"] = renderARMTemplate(resources)
+	} else {
+		response["template"] = renderBicep(resources)
+	}
+	log.Printf("INFO: (ExportTemplate) exported safe %s with %d members as %s", safe.SafeName, len(resources)-1, format)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
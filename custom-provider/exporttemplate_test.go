@@ -0,0 +1,66 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/davidh-cyberark/privilegeaccessmanager-sdk-go/pam"
+)
+
+func TestBicepValue(t *testing.T) {
+	tests := []struct {
+		name     string
+		value    interface{}
+		expected string
+	}{
+		{"string", "safe1", "'safe1'"},
+		{"escaped string", `it's ${x} \ ok`, `'it\'s \${x} \\ ok'`},
+		{"number", 5, "5"},
+		{"bool", true, "true"},
+		{"empty object", map[string]interface{}{}, "{}"},
+		{"object", map[string]interface{}{"b": true, "a-b": "x"}, "{\n  'a-b': 'x'\n  b: true\n}"},
+		{"nested", map[string]interface{}{"p": map[string]interface{}{"x": 1}}, "{\n  p: {\n    x: 1\n  }\n}"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := bicepValue(tt.value, ""); got != tt.expected {
+				t.Errorf("expected %q, got %q", tt.expected, got)
+			}
+		})
+	}
+}
+
+func TestExportSafeAsBicep(t *testing.T) {
+	safe := pam.GetSafeDetails{SafeName: "app-db", Description: "App databases", NumberOfDaysRetention: 7, OlacEnabled: true}
+	members := []pam.PostAddMemberResponse{
+		{MemberName: "jdoe@corp.com", MemberType: "User", Permissions: pam.Permissions{ListAccounts: true}},
+		{MemberName: "Auditors", MemberType: "Group", IsPredefinedUser: true, Permissions: pam.Permissions{ViewAuditLog: true}},
+		{MemberName: "jdoe_corp_com", MemberType: "User", Permissions: pam.Permissions{UseAccounts: true}},
+	}
+
+	resources := exportSafeResources(safe, members, false)
+	if len(resources) != 3 {
+		t.Fatalf("expected the safe and two members without the predefined one, got %d resources", len(resources))
+	}
+	bicep := renderBicep(resources)
+	for _, want := range []string{
+		"resource safe_app_db 'Microsoft.CustomProviders/resourceProviders/safes@2018-09-01-preview' = {",
+		"    numberOfDaysRetention: 7\n",
+		"    olacEnabled: true\n",
+		"resource member_jdoe_corp_com 'Microsoft.CustomProviders/resourceProviders/safeMembers@2018-09-01-preview' = {",
+		"  name: 'app-db.jdoe@corp.com'\n",
+		"resource member_jdoe_corp_com_2 ",
+		"  dependsOn: [\n    safe_app_db\n  ]\n",
+	} {
+		if !strings.Contains(bicep, want) {
+			t.Errorf("expected the Bicep to contain %q, got:\n%s", want, bicep)
+		}
+	}
+	if strings.Contains(bicep, "Auditors") {
+		t.Errorf("expected predefined members to be left out, got:\n%s", bicep)
+	}
+
+	if resources := exportSafeResources(safe, members, true); len(resources) != 4 {
+		t.Errorf("expected predefined members with includePredefinedMembers, got %d resources", len(resources))
+	}
+}
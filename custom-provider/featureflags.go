@@ -0,0 +1,268 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Feature flags switch risky behaviors on per deployment, so they can be rolled out gradually
+// instead of living on long-lived branches. A flag is read, in order, from Azure App Configuration
+// (APPCONFIG_ENDPOINT, refreshed every APPCONFIG_REFRESH_INTERVAL), from FEATURE_FLAGS
+// (e.g. "asyncProvisioning,strictRequestBodies=false"), and from the environment variable that
+// controlled the behavior before it became a flag. Flags are off by default. Request flags
+// (X-Provider-*) still override a feature flag for one request where the behavior supports it.
+
+// featureFlag is a deployment-wide switch for a behavior being rolled out
+type featureFlag struct {
+	Name        string
+	Description string
+	// Env is the environment variable that turned the behavior on before it became a flag
+	Env string
+}
+
+// featureFlagRegistry lists every known flag; flags not listed here are ignored
+var featureFlagRegistry = []featureFlag{
+	{Name: "asyncProvisioning", Env: "ASYNC_PROVISIONING", Description: "Answer safe, account and safe member PUTs with 202 Accepted and provision in the background"},
+	{Name: "strictRequestBodies", Env: "STRICT_REQUEST_BODIES", Description: "Reject PUT bodies whose property names do not match the schema exactly"},
+	{Name: "callerAuthReportOnly", Description: "Log and count unauthenticated custom provider requests instead of rejecting them"},
+}
+
+// featureFlagState is the effective value of a flag and where it came from
+type featureFlagState struct {
+	Enabled     bool   `json:"enabled"`
+	Source      string `json:"source"`
+	Description string `json:"description"`
+}
+
+// featureFlagStore holds the flag values loaded from App Configuration
+type featureFlagStore struct {
+	endpoint string
+	label    string
+	client   *http.Client
+
+	mu       sync.Mutex
+	remote   map[string]bool
+	loadedAt time.Time
+}
+
+var featureFlags = newFeatureFlagStore(os.Getenv("APPCONFIG_ENDPOINT"), os.Getenv("APPCONFIG_LABEL"), appConfigRefreshInterval())
+
+func newFeatureFlagStore(endpoint, label string, interval time.Duration) *featureFlagStore {
+	s := &featureFlagStore{
+		endpoint: strings.TrimSuffix(endpoint, "/"),
+		label:    label,
+		client:   newOutboundClient(10 * time.Second),
+		remote:   map[string]bool{},
+	}
+	if s.endpoint != "" && interval > 0 {
+		go func() {
+			s.refresh()
+			for range time.Tick(interval) {
+				s.refresh()
+			}
+		}()
+	}
+	return s
+}
+
+func init() {
+	if featureFlags.endpoint != "" {
+		registerDependency("appConfiguration", featureFlags.healthDetails)
+		registerFlusher("featureFlags", featureFlags.Flush)
+	}
+}
+
+// appConfigRefreshInterval is read from APPCONFIG_REFRESH_INTERVAL (Go duration, default 1m)
+func appConfigRefreshInterval() time.Duration {
+	interval, err := time.ParseDuration(getEnvOrDefault("APPCONFIG_REFRESH_INTERVAL", "1m"))
+	if err != nil {
+		log.Printf("WARNING: Invalid APPCONFIG_REFRESH_INTERVAL, using 1m: %v", err)
+		return time.Minute
+	}
+	return interval
+}
+
+// featureEnabled reports whether a flag is on for this deployment
+func featureEnabled(name string) bool {
+	return featureFlags.state(name).Enabled
+}
+
+// state resolves a flag from App Configuration, FEATURE_FLAGS and its legacy environment variable
+func (s *featureFlagStore) state(name string) featureFlagState {
+	var flag featureFlag
+	for _, f := range featureFlagRegistry {
+		if f.Name == name {
+			flag = f
+		}
+	}
+	state := featureFlagState{Source: "default", Description: flag.Description}
+
+	s.mu.Lock()
+	enabled, ok := s.remote[name]
+	s.mu.Unlock()
+	if ok {
+		state.Enabled, state.Source = enabled, "appConfiguration"
+		return state
+	}
+	if enabled, ok := envFeatureFlags()[name]; ok {
+		state.Enabled, state.Source = enabled, "FEATURE_FLAGS"
+		return state
+	}
+	if flag.Env != "" && os.Getenv(flag.Env) != "" {
+		state.Enabled, state.Source = os.Getenv(flag.Env) == "true", flag.Env
+	}
+	return state
+}
+
+// report returns the effective value of every known flag, for /metadata and the startup fingerprint
+func (s *featureFlagStore) report() map[string]featureFlagState {
+	report := map[string]featureFlagState{}
+	for _, flag := range featureFlagRegistry {
+		report[flag.Name] = s.state(flag.Name)
+	}
+	return report
+}
+
+// envFeatureFlags parses FEATURE_FLAGS: comma separated names, each optionally =true or =false
+func envFeatureFlags() map[string]bool {
+	flags := map[string]bool{}
+	for _, entry := range strings.Split(os.Getenv("FEATURE_FLAGS"), ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		name, value, hasValue := strings.Cut(entry, "=")
+		enabled := true
+		if hasValue {
+			var err error
+			if enabled, err = strconv.ParseBool(strings.TrimSpace(value)); err != nil {
+				log.Printf("WARNING: Ignoring feature flag %s, invalid value %q", name, value)
+				continue
+			}
+		}
+		flags[strings.TrimSpace(name)] = enabled
+	}
+	return flags
+}
+
+// appConfigFeatureFlag is the value of an App Configuration feature flag key
+type appConfigFeatureFlag struct {
+	ID      string `json:"id"`
+	Enabled bool   `json:"enabled"`
+}
+
+// refresh loads the feature flags of APPCONFIG_LABEL (no label when unset) from App Configuration.
+// On failure the last loaded values stay in effect.
+func (s *featureFlagStore) refresh() error {
+	remote, err := s.load()
+	recordDependencyResult("appConfiguration", err)
+	if err != nil {
+		log.Printf("WARNING: Could not load feature flags from App Configuration: %v", err)
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for name, enabled := range remote {
+		if previous, ok := s.remote[name]; !ok || previous != enabled {
+			log.Printf("INFO: Feature flag %s is now %t (App Configuration)", name, enabled)
+		}
+	}
+	s.remote = remote
+	s.loadedAt = time.Now().UTC()
+	return nil
+}
+
+func (s *featureFlagStore) load() (map[string]bool, error) {
+	token, err := getManagedIdentityToken(s.endpoint)
+	if err != nil {
+		return nil, err
+	}
+
+	q := url.Values{}
+	q.Set("key", ".appconfig.featureflag/*")
+	q.Set("label", s.label)
+	if s.label == "" {
+		q.Set("label", "\x00")
+	}
+	q.Set("api-version", "1.0")
+	req, err := http.NewRequest(http.MethodGet, s.endpoint+"/kv?"+q.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= 300 {
+		return nil, fmt.Errorf("GET %s returned status %d", req.URL.Path, resp.StatusCode)
+	}
+
+	var page struct {
+		Items []struct {
+			Key   string `json:"key"`
+			Value string `json:"value"`
+		} `json:"items"`
+	}
+	if err := json.Unmarshal(body, &page); err != nil {
+		return nil, fmt.Errorf("failed to parse feature flags: %w", err)
+	}
+	known := map[string]bool{}
+	for _, flag := range featureFlagRegistry {
+		known[flag.Name] = true
+	}
+	remote := map[string]bool{}
+	for _, item := range page.Items {
+		var flag appConfigFeatureFlag
+		if err := json.Unmarshal([]byte(item.Value), &flag); err != nil {
+			log.Printf("WARNING: Ignoring App Configuration key %s: %v", item.Key, err)
+			continue
+		}
+		if known[flag.ID] {
+			remote[flag.ID] = flag.Enabled
+		}
+	}
+	return remote, nil
+}
+
+// Flush drops the values loaded from App Configuration and loads them again
+func (s *featureFlagStore) Flush() int {
+	s.mu.Lock()
+	dropped := len(s.remote)
+	s.remote = map[string]bool{}
+	s.mu.Unlock()
+	s.refresh()
+	return dropped
+}
+
+func (s *featureFlagStore) healthDetails() map[string]interface{} {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	names := make([]string, 0, len(s.remote))
+	for name := range s.remote {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	details := map[string]interface{}{"label": s.label, "flags": names}
+	if !s.loadedAt.IsZero() {
+		details["loadedAt"] = s.loadedAt
+	}
+	return details
+}
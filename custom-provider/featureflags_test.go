@@ -0,0 +1,76 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestFeatureFlagSources(t *testing.T) {
+	tests := []struct {
+		name        string
+		env         map[string]string
+		remote      map[string]bool
+		wantEnabled bool
+		wantSource  string
+	}{
+		{name: "off by default", wantSource: "default"},
+		{name: "legacy variable", env: map[string]string{"ASYNC_PROVISIONING": "true"}, wantEnabled: true, wantSource: "ASYNC_PROVISIONING"},
+		{name: "FEATURE_FLAGS name alone", env: map[string]string{"FEATURE_FLAGS": "strictRequestBodies, asyncProvisioning"}, wantEnabled: true, wantSource: "FEATURE_FLAGS"},
+		{name: "FEATURE_FLAGS overrides legacy variable", env: map[string]string{"FEATURE_FLAGS": "asyncProvisioning=false", "ASYNC_PROVISIONING": "true"}, wantSource: "FEATURE_FLAGS"},
+		{name: "App Configuration overrides environment", env: map[string]string{"FEATURE_FLAGS": "asyncProvisioning=false"}, remote: map[string]bool{"asyncProvisioning": true}, wantEnabled: true, wantSource: "appConfiguration"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("ASYNC_PROVISIONING", "")
+			t.Setenv("FEATURE_FLAGS", "")
+			for key, value := range tt.env {
+				t.Setenv(key, value)
+			}
+			store := newFeatureFlagStore("", "", 0)
+			if tt.remote != nil {
+				store.remote = tt.remote
+			}
+			state := store.state("asyncProvisioning")
+			if state.Enabled != tt.wantEnabled || state.Source != tt.wantSource {
+				t.Errorf("expected enabled=%t from %s, got enabled=%t from %s", tt.wantEnabled, tt.wantSource, state.Enabled, state.Source)
+			}
+		})
+	}
+}
+
+func TestFeatureFlagsFromAppConfiguration(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/identity":
+			w.Write([]byte(`{"access_token": "mi-token", "expires_on": "4102444800"}`))
+		case "/kv":
+			if got := r.URL.Query().Get("label"); got != "canary" {
+				t.Errorf("expected label canary, got %q", got)
+			}
+			w.Write([]byte(`{"items": [
+				{"key": ".appconfig.featureflag/asyncProvisioning", "value": "{\"id\": \"asyncProvisioning\", \"enabled\": true}"},
+				{"key": ".appconfig.featureflag/somethingElse", "value": "{\"id\": \"somethingElse\", \"enabled\": true}"}
+			]}`))
+		default:
+			t.Errorf("unexpected request %s", r.URL.Path)
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+	t.Setenv("IDENTITY_ENDPOINT", server.URL+"/identity")
+	t.Setenv("IDENTITY_HEADER", "test")
+	defer forgetManagedIdentityToken(server.URL)
+
+	store := newFeatureFlagStore(server.URL, "canary", 0)
+	if err := store.refresh(); err != nil {
+		t.Fatal(err)
+	}
+	report := store.report()
+	if state := report["asyncProvisioning"]; !state.Enabled || state.Source != "appConfiguration" {
+		t.Errorf("expected asyncProvisioning on from App Configuration, got %+v", state)
+	}
+	if _, ok := report["somethingElse"]; ok {
+		t.Error("unknown flags should not be reported")
+	}
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/url"
+	"os"
+	"sort"
+
+	"cyberark-custom-provider/config"
+	"github.com/gorilla/mux"
+)
+
+// namedMiddleware pairs a middleware with the name reported in the startup fingerprint
+type namedMiddleware struct {
+	Name       string
+	Middleware mux.MiddlewareFunc
+}
+
+// redactURL keeps only the scheme and host of a configured URL
+func redactURL(raw string) string {
+	u, err := url.Parse(raw)
+	if err != nil || u.Host == "" {
+		return redactSecret(raw)
+	}
+	return u.Scheme + "://" + u.Host
+}
+
+// redactSecret reports only whether a secret is configured
+func redactSecret(value string) string {
+	if value == "" {
+		return "unset"
+	}
+	return "set"
+}
+
+// startupFingerprint describes the effective configuration, with secrets redacted, so support
+// can reconstruct the deployment's behavior from the first log lines
+func startupFingerprint(middlewares []namedMiddleware) map[string]interface{} {
+	var resourceTypeNames, actionNames, middlewareNames []string
+	for _, entry := range resourceTypes {
+		if entry.entryEnabled(false) {
+			resourceTypeNames = append(resourceTypeNames, entry.Name)
+		}
+	}
+	for _, entry := range actions {
+		if entry.entryEnabled(true) {
+			actionNames = append(actionNames, entry.Name)
+		}
+	}
+	for _, m := range middlewares {
+		middlewareNames = append(middlewareNames, m.Name)
+	}
+
+	profileNames, policyPlatforms := []string{}, []string{}
+	for name := range safeProfiles {
+		profileNames = append(profileNames, name)
+	}
+	for platform := range secretPolicies {
+		policyPlatforms = append(policyPlatforms, platform)
+	}
+	sort.Strings(profileNames)
+	sort.Strings(policyPlatforms)
+
+	return map[string]interface{}{
+		"version":          Version,
+		"buildDate":        BuildDate,
+		"resourceTypes":    resourceTypeNames,
+		"actions":          actionNames,
+		"middlewareChain":  middlewareNames,
+		"configFile":       getEnvOrDefault("CONFIG_FILE", "none"),
+		"credentialSource": credentials.Describe(),
+		"pamAuth":          pamAuthDescription(),
+		"egress":           egressDescription(),
+		"tls":              tlsDescription(),
+		"stateStore":       stateStore.Name(),
+		"tracing":          tracingEndpoint(),
+		"notifications":    notifierEndpoints(),
+		"auditSinks":       auditSinkNames(),
+		"callerAuth":       callerAuth.describe(),
+		"endpoints": map[string]bool{
+			"admin":   os.Getenv("ADMIN_TOKEN") != "",
+			"probe":   os.Getenv("PROBE_TOKEN") != "",
+			"metrics": os.Getenv("METRICS_TOKEN") != "",
+		},
+		"tuning": map[string]interface{}{
+			"SLOW_REQUEST_THRESHOLD":        slowRequestThreshold().String(),
+			"DELETE_BATCH_WINDOW":           deletes.window.String(),
+			"DELETE_MAX_CONCURRENCY":        deletes.maxConcurrency,
+			"ACCOUNT_INDEX_TTL":             accountIndex.ttl.String(),
+			"CREATED_RESOURCE_TTL":          recentlyCreated.ttl.String(),
+			"PLATFORM_CACHE_TTL":            platforms.ttl.String(),
+			"REQUEST_FLAGS_ALLOWED":         os.Getenv("REQUEST_FLAGS_ALLOWED"),
+			"MAINTENANCE_MODE":              maintenance.manualMode(),
+			"MAINTENANCE_SIGNATURES":        maintenanceSignatures(),
+			"MAINTENANCE_RETRY_AFTER":       maintenanceRetryAfter().String(),
+			"CIRCUIT_BREAKER_THRESHOLD":     circuitBreakerThreshold(),
+			"CIRCUIT_BREAKER_OPEN_DURATION": circuitBreakerOpenDuration().String(),
+			"OPERATION_AUDIT_CAPACITY":      operationAuditCapacity,
+			"RESPONSE_SHAPE":                getEnvOrDefault("RESPONSE_SHAPE", "v1"),
+			"SAFE_DELETE_ACCOUNT_THRESHOLD": safeDeleteAccountThreshold(),
+			"DELETE_PROTECTION_WINDOW":      deleteProtectionWindow().String(),
+			"STATE_STORE_RETRY_INTERVAL":    stateStoreRetryInterval().String(),
+			"ASYNC_WORKERS":                 cap(asyncOperations.slots),
+			"ASYNC_OPERATION_RETENTION":     asyncOperations.retention.String(),
+			"PCLOUD_CONCURRENCY_MIN":        int(pcloudLimiter.min),
+			"PCLOUD_CONCURRENCY_MAX":        int(pcloudLimiter.max),
+			"PCLOUD_LATENCY_TARGET":         pcloudLimiter.latencyTarget.String(),
+			"PCLOUD_RATE_LIMIT":             pcloudRate.rate,
+			"PCLOUD_RATE_BURST":             int(pcloudRate.burst),
+			"PCLOUD_RETRY_AFTER_MAX":        pcloudRate.maxPause.String(),
+			"LIST_PAGE_SIZE":                listPageSize(),
+			"LOG_LEVEL":                     currentLogLevel(),
+			"LOG_REDACT_KEYS":               sensitiveKeys,
+			"SHUTDOWN_GRACE_PERIOD":         shutdownGracePeriod().String(),
+			"MOCK_PAM":                      mockPAMEnabled(),
+			"BULK_ADD_CONCURRENCY":          bulkAddConcurrency(),
+			"MAX_REQUEST_BODY_BYTES":        maxRequestBodyBytes(),
+			"READYZ_SESSION_MAX_AGE":        readyzSessionMaxAge().String(),
+			"READYZ_TIMEOUT":                readyzTimeout().String(),
+			"CREDENTIALS_REFRESH_INTERVAL":  credentialsRefreshInterval().String(),
+			"TLS_CERT_REFRESH_INTERVAL":     tlsCertRefreshInterval().String(),
+		},
+		"featureFlags":      featureFlags.report(),
+		"operationPolicies": operationPolicies,
+		"safeProfiles":      profileNames,
+		"accessPolicies":    accessPolicyDescription(),
+		"secretPolicies":    policyPlatforms,
+		"registeredCaches":  flusherNames(),
+	}
+}
+
+// logStartupFingerprint writes the fingerprint as a single JSON log line
+func logStartupFingerprint(middlewares []namedMiddleware) {
+	data, err := json.Marshal(startupFingerprint(middlewares))
+	if err != nil {
+		log.Printf("WARNING: Failed to render startup fingerprint: %v", err)
+		return
+	}
+	log.Printf("INFO: Startup fingerprint %s", data)
+}
+
+// logEffectiveConfig writes every setting that is set, and whether it came from the config file
+// or the environment, as a single JSON log line; secrets are only reported as redacted
+func logEffectiveConfig() {
+	data, err := json.Marshal(config.Effective())
+	if err != nil {
+		log.Printf("WARNING: Failed to render effective configuration: %v", err)
+		return
+	}
+	log.Printf("INFO: Effective configuration %s", data)
+}
+
+// tracingEndpoint reports where spans are exported, or "disabled"
+func tracingEndpoint() string {
+	if traces == nil {
+		return "disabled"
+	}
+	return redactURL(traces.endpoint)
+}
@@ -0,0 +1,250 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Fixtures in testdata/fixtures/*.json describe a custom provider request, the PCloud responses it
+// should see, and the response ARM should get back. TestFixtures sends each request through the
+// full router against a mock PCloud and identity tenant, so covering a new resource type or action
+// only needs a new fixture file. See testdata/fixtures/README.md for the format.
+
+type fixtureCase struct {
+	Name    string            `json:"name"`
+	Env     map[string]string `json:"env,omitempty"`
+	State   []ResourceRecord  `json:"state,omitempty"`
+	Request fixtureRequest    `json:"request"`
+	PCloud  []*fixtureMock    `json:"pcloud,omitempty"`
+	Expect  fixtureExpect     `json:"expect"`
+}
+
+type fixtureRequest struct {
+	Method      string            `json:"method"`
+	RequestPath string            `json:"requestPath,omitempty"`
+	Path        string            `json:"path,omitempty"`
+	Headers     map[string]string `json:"headers,omitempty"`
+	Body        json.RawMessage   `json:"body,omitempty"`
+}
+
+type fixtureMock struct {
+	Method     string          `json:"method"`
+	Path       string          `json:"path"`
+	Status     int             `json:"status"`
+	Body       json.RawMessage `json:"body,omitempty"`
+	ExpectBody json.RawMessage `json:"expectBody,omitempty"`
+	Optional   bool            `json:"optional,omitempty"`
+	// Times limits how many requests the mock answers, so later mocks for the same path answer the rest
+	Times int `json:"times,omitempty"`
+
+	calls int
+}
+
+type fixtureExpect struct {
+	Status  int               `json:"status"`
+	Headers map[string]string `json:"headers,omitempty"`
+	Body    json.RawMessage   `json:"body,omitempty"`
+	State   map[string]bool   `json:"state,omitempty"`
+}
+
+func TestFixtures(t *testing.T) {
+	files, err := filepath.Glob(filepath.Join("testdata", "fixtures", "*.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) == 0 {
+		t.Fatal("no fixtures found")
+	}
+
+	savedPolicies := operationPolicies
+	savedStore := stateStore
+	defer func() {
+		operationPolicies = savedPolicies
+		stateStore = savedStore
+	}()
+	operationPolicies = map[string]operationPolicy{}
+	for kind, policy := range savedPolicies {
+		policy.RetryBackoff = time.Millisecond
+		policy.VerifyInterval = time.Millisecond
+		operationPolicies[kind] = policy
+	}
+
+	for _, file := range files {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var cases []fixtureCase
+		if err := json.Unmarshal(data, &cases); err != nil {
+			t.Fatalf("%s: %v", file, err)
+		}
+		for _, fc := range cases {
+			fc := fc
+			t.Run(strings.TrimSuffix(filepath.Base(file), ".json")+"/"+fc.Name, func(t *testing.T) {
+				runFixture(t, fc)
+			})
+		}
+	}
+}
+
+func runFixture(t *testing.T, fc fixtureCase) {
+	var mu sync.Mutex
+	pcloud := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/oauth2/platformtoken" {
+			w.Write([]byte(`{"access_token": "fixture-token", "token_type": "Bearer", "expires_in": 3600}`))
+			return
+		}
+		body, _ := io.ReadAll(r.Body)
+
+		mu.Lock()
+		defer mu.Unlock()
+		for _, mock := range fc.PCloud {
+			if mock.Method != r.Method || mock.Path != r.URL.Path || (mock.Times > 0 && mock.calls >= mock.Times) {
+				continue
+			}
+			mock.calls++
+			if len(mock.ExpectBody) > 0 {
+				if diff := jsonSubset(mock.ExpectBody, body); diff != "" {
+					t.Errorf("%s %s request body: %s", r.Method, r.URL.Path, diff)
+				}
+			}
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(mock.Status)
+			w.Write(mock.Body)
+			return
+		}
+		t.Errorf("unexpected PCloud request %s %s", r.Method, r.URL.RequestURI())
+		w.WriteHeader(http.StatusNotImplemented)
+	}))
+	defer pcloud.Close()
+
+	t.Setenv("IDTENANTURL", pcloud.URL)
+	t.Setenv("PCLOUDURL", pcloud.URL)
+	t.Setenv("PAMUSER", "fixture-user")
+	t.Setenv("PAMPASS", "fixture-pass")
+	for key, value := range fc.Env {
+		t.Setenv(key, strings.ReplaceAll(value, "{{server}}", pcloud.URL))
+	}
+
+	stateStore = newBufferedStateStore(newMemoryStateStore(), 0)
+	for _, rec := range fc.State {
+		stateStore.Put(rec)
+	}
+	for _, name := range flusherNames() {
+		flushersMu.Lock()
+		flush := flushers[name]
+		flushersMu.Unlock()
+		flush()
+	}
+
+	path := fc.Request.Path
+	if path == "" {
+		path = "/"
+	}
+	req := httptest.NewRequest(fc.Request.Method, path, bytes.NewReader(fc.Request.Body))
+	if fc.Request.RequestPath != "" {
+		req.Header.Set("X-Ms-Customproviders-Requestpath", fc.Request.RequestPath)
+	}
+	// ARM sends bodies as JSON; a fixture can say otherwise in its headers
+	if len(fc.Request.Body) > 0 {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	for key, value := range fc.Request.Headers {
+		req.Header.Set(key, value)
+	}
+
+	router, _ := newRouter()
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+
+	if w.Code != fc.Expect.Status {
+		t.Errorf("expected status %d, got %d: %s", fc.Expect.Status, w.Code, w.Body.String())
+	}
+	for key, want := range fc.Expect.Headers {
+		if got := w.Header().Get(key); got != want {
+			t.Errorf("expected header %s %q, got %q", key, want, got)
+		}
+	}
+	if len(fc.Expect.Body) > 0 {
+		if diff := jsonSubset(fc.Expect.Body, w.Body.Bytes()); diff != "" {
+			t.Errorf("response body: %s\n%s", diff, w.Body.String())
+		}
+	}
+	for resourceID, want := range fc.Expect.State {
+		_, found, _ := stateStore.Get(resourceID)
+		if found != want {
+			t.Errorf("expected state record %s present=%t, got %t", resourceID, want, found)
+		}
+	}
+	for _, mock := range fc.PCloud {
+		if mock.calls == 0 && !mock.Optional {
+			t.Errorf("expected a PCloud request %s %s", mock.Method, mock.Path)
+		}
+	}
+}
+
+// jsonSubset reports the first place where got does not contain want: objects must have every key
+// of want (extra keys are fine), arrays must match element by element, scalars must be equal
+func jsonSubset(want json.RawMessage, got []byte) string {
+	var w, g interface{}
+	if err := json.Unmarshal(want, &w); err != nil {
+		return fmt.Sprintf("invalid expected JSON: %v", err)
+	}
+	if err := json.Unmarshal(got, &g); err != nil {
+		return fmt.Sprintf("invalid JSON: %v", err)
+	}
+	return subsetDiff("$", w, g)
+}
+
+func subsetDiff(path string, want, got interface{}) string {
+	switch w := want.(type) {
+	case map[string]interface{}:
+		g, ok := got.(map[string]interface{})
+		if !ok {
+			return fmt.Sprintf("%s: expected an object, got %v", path, got)
+		}
+		keys := make([]string, 0, len(w))
+		for key := range w {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			value, ok := g[key]
+			if !ok {
+				return fmt.Sprintf("%s.%s: missing", path, key)
+			}
+			if diff := subsetDiff(path+"."+key, w[key], value); diff != "" {
+				return diff
+			}
+		}
+		return ""
+	case []interface{}:
+		g, ok := got.([]interface{})
+		if !ok || len(g) != len(w) {
+			return fmt.Sprintf("%s: expected %d elements, got %v", path, len(w), got)
+		}
+		for i := range w {
+			if diff := subsetDiff(fmt.Sprintf("%s[%d]", path, i), w[i], g[i]); diff != "" {
+				return diff
+			}
+		}
+		return ""
+	default:
+		if !reflect.DeepEqual(want, got) {
+			return fmt.Sprintf("%s: expected %v, got %v", path, want, got)
+		}
+		return ""
+	}
+}
@@ -5,7 +5,6 @@ import (
 	"fmt"
 	"log"
 	"net/http"
-	"os"
 )
 
 func handleHealth(w http.ResponseWriter, r *http.Request) {
@@ -41,8 +40,7 @@ func handleHealth(w http.ResponseWriter, r *http.Request) {
 func handleHealthEx(w http.ResponseWriter, r *http.Request) {
 	LogRequestDebug("HealthEx", r)
 
-	// Get the public IP for the health check
-	publicIP := getPublicIP()
+	publicIP := egressIP.current()
 
 	// Check environment variables
 	envStatus := "ok"
@@ -60,13 +58,9 @@ func handleHealthEx(w http.ResponseWriter, r *http.Request) {
 	}
 
 	if pamclient != nil && pamclient.Session == nil {
-		idTenantURL := os.Getenv("IDTENANTURL")
-		pamUser := os.Getenv("PAMUSER")
-		pamPass := os.Getenv("PAMPASS")
-		privCloudURL := os.Getenv("PCLOUDURL")
-		scrubbedPamPass := fmt.Sprintf("%d%s", len(pamPass), pamPass[:3])
+		creds, _ := credentials.Credentials()
 		pcMsg = fmt.Sprintf("PAM client session is nil; IDTENANTURL=%s; PCLOUDURL=%s; PAMUSER=%s; PAMPASS=%s",
-			idTenantURL, privCloudURL, pamUser, scrubbedPamPass)
+			creds.IDTenantURL, creds.PCloudURL, creds.User, redactSecret(creds.Password))
 	}
 
 	response := map[string]interface{}{
@@ -75,8 +69,10 @@ func handleHealthEx(w http.ResponseWriter, r *http.Request) {
 		"status":         "healthy",
 		"service":        "cyberark-custom-provider",
 		"publicIP":       publicIP,
+		"publicIPSource": egressIP.sourceName(),
 		"env_status":     envStatus,
 		"pamclientcheck": pcMsg,
+		"dependencies":   dependencyReport(),
 	}
 
 	// Add environment error details if any
@@ -88,3 +84,30 @@ func handleHealthEx(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(response)
 	log.Printf("INFO: Health check - Version: %s, Build date: %s, Container public IP: %s, env_status: %s", Version, BuildDate, publicIP, envStatus)
 }
+
+// handleGetMetadata describes what this deployment serves and which feature flags are on, so a
+// gradual rollout can be checked per deployment without reading its configuration
+func handleGetMetadata(w http.ResponseWriter, r *http.Request) {
+	LogRequestDebug("Metadata", r)
+
+	resourceTypeNames := make([]string, 0, len(resourceTypes))
+	for _, entry := range resourceTypes {
+		resourceTypeNames = append(resourceTypeNames, entry.Name)
+	}
+	actionNames := make([]string, 0, len(actions))
+	for _, entry := range actions {
+		actionNames = append(actionNames, entry.Name)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"version":          Version,
+		"build_date":       BuildDate,
+		"service":          "cyberark-custom-provider",
+		"resourceTypes":    resourceTypeNames,
+		"actions":          actionNames,
+		"apiVersions":      apiVersionNames(),
+		"credentialSource": credentials.Name(),
+		"featureFlags":     featureFlags.report(),
+	})
+}
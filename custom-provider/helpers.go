@@ -3,14 +3,10 @@ package main
 import (
 	"encoding/json"
 	"fmt"
-	"io"
 	"log"
 	"net/http"
 	"os"
 	"strings"
-	"time"
-
-	"github.com/davidh-cyberark/privilegeaccessmanager-sdk-go/pam"
 )
 
 type CustomProviderRequestPath struct {
@@ -23,10 +19,15 @@ type CustomProviderRequestPath struct {
 	FullPath             string
 }
 
-// ErrorDetails contains error information
+// ErrorDetails contains error information, in the shape of an ARM error: target names the
+// property the error is about, and details holds one entry per underlying problem
 type ErrorDetails struct {
-	Code    string `json:"code"`
-	Message string `json:"message"`
+	Code    string         `json:"code"`
+	Message string         `json:"message"`
+	Target  string         `json:"target,omitempty"`
+	Details []ErrorDetails `json:"details,omitempty"`
+	// InnerError is the PCloud or Conjur error behind this one, see armerrors.go
+	InnerError *InnerError `json:"innererror,omitempty"`
 }
 
 // ErrorResponse represents an error response in JSON format
@@ -36,111 +37,53 @@ type ErrorResponse struct {
 
 // sendJSONError sends a JSON-formatted error response
 func sendJSONError(w http.ResponseWriter, code int, errorCode, message string) {
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(code)
+	sendJSONErrorDetails(w, code, ErrorDetails{
+		Code:    errorCode,
+		Message: message,
+	})
+}
 
-	errorResponse := ErrorResponse{
-		Error: ErrorDetails{
-			Code:    errorCode,
-			Message: message,
-		},
+// sendJSONErrorDetails sends an error response with target and details. A code below 400 is a
+// handler passing on an upstream status it did not check; it is sent as 502.
+func sendJSONErrorDetails(w http.ResponseWriter, code int, details ErrorDetails) {
+	if code < http.StatusBadRequest {
+		log.Printf("WARNING: error %s sent with status %d, answering 502 instead", details.Code, code)
+		code = http.StatusBadGateway
 	}
-
-	json.NewEncoder(w).Encode(errorResponse)
+	code, details = armError(code, details)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(ErrorResponse{Error: details})
 }
 
 // loggingMiddleware logs all incoming requests
 func loggingMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		log.Printf("DEBUG: Incoming request - Method: %s, URL: %s, RemoteAddr: %s", r.Method, r.URL.Path, r.RemoteAddr)
-		log.Printf("DEBUG: Request headers: %v", r.Header)
+		log.Printf("DEBUG: [op=%s] Incoming request - Method: %s, URL: %s, RemoteAddr: %s", operationID(r), r.Method, r.URL.Path, r.RemoteAddr)
+		log.Printf("DEBUG: [op=%s] Request headers: %v", operationID(r), redactHeaders(r.Header))
 		next.ServeHTTP(w, r)
 	})
 }
 
-// getPublicIP gets the public IP address of the container
-func getPublicIP() string {
-	services := []string{
-		"https://ipinfo.io/ip",
-		"https://api.ipify.org",
-		"https://icanhazip.com",
-	}
-
-	client := &http.Client{Timeout: 5 * time.Second}
-
-	for _, service := range services {
-		resp, err := client.Get(service)
-		if err != nil {
-			log.Printf("DEBUG: Failed to get IP from %s: %v", service, err)
-			continue
-		}
-		defer resp.Body.Close()
-
-		if resp.StatusCode == 200 {
-			body, err := io.ReadAll(resp.Body)
-			if err != nil {
-				log.Printf("DEBUG: Failed to read response from %s: %v", service, err)
-				continue
-			}
-			ip := strings.TrimSpace(string(body))
-			log.Printf("DEBUG: Successfully got public IP %s from %s", ip, service)
-			return ip
-		}
-	}
-
-	log.Printf("DEBUG: Could not determine public IP from any service")
-	return "unknown"
-}
-
+// validEnvVars reports configuration the credential source is missing
 func validEnvVars() error {
-	var missingVars []string
-
-	// List of required environment variables
-	requiredVars := []string{"IDTENANTURL", "PAMUSER", "PAMPASS", "PCLOUDURL"}
-
-	// Check each required variable
-	for _, varName := range requiredVars {
-		if os.Getenv(varName) == "" {
-			missingVars = append(missingVars, varName)
-		}
+	if err := checkPAMAuthMode(); err != nil {
+		return err
 	}
-
-	// If any variables are missing, return error with the list
-	if len(missingVars) > 0 {
-		return fmt.Errorf("missing required environment variables: %v", missingVars)
-	}
-
-	return nil
+	return credentials.Check()
 }
 
-func createPAMClient() (*pam.Client, error) {
-	log.Printf("DEBUG: Creating PAM client - validating environment variables")
-
-	// Validate all required environment variables first
-	if err := validEnvVars(); err != nil {
-		log.Printf("ERROR: Environment validation failed: %v", err)
-		return nil, err
-	}
-
-	idTenantURL := os.Getenv("IDTENANTURL")
-	pamUser := os.Getenv("PAMUSER")
-	pamPass := os.Getenv("PAMPASS")
-	privCloudURL := os.Getenv("PCLOUDURL")
-
-	log.Printf("DEBUG: Environment variables loaded - ID Tenant URL: %s, PCloud URL: %s, User: %s",
-		idTenantURL, privCloudURL, pamUser)
-
-	config := pam.NewConfig(idTenantURL, privCloudURL, pamUser, pamPass)
-	client := pam.NewClient(privCloudURL, config)
-
-	err := client.RefreshSession()
+// toProperties converts a PAM SDK struct into a map suitable for CustomProviderResponse.Properties
+func toProperties(v interface{}) (map[string]interface{}, error) {
+	data, err := json.Marshal(v)
 	if err != nil {
-		errMsg := fmt.Errorf("could not refresh session: %s", err.Error())
-		log.Printf("ERROR: %s", errMsg.Error())
-		return nil, errMsg
+		return nil, fmt.Errorf("failed to marshal response: %v", err)
+	}
+	properties := map[string]interface{}{}
+	if err := json.Unmarshal(data, &properties); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal response: %v", err)
 	}
-	log.Printf("DEBUG: PAM client created successfully")
-	return client, nil
+	return properties, nil
 }
 
 func getEnvOrDefault(key, defaultValue string) string {
@@ -151,24 +94,42 @@ func getEnvOrDefault(key, defaultValue string) string {
 }
 
 func LogRequestDebug(from string, r *http.Request) {
-	log.Printf("DEBUG: (%s) Request - Method: %s, URL: %s, RemoteAddr: %s, Headers: %v", from, r.Method, r.URL.Path, r.RemoteAddr, r.Header)
+	log.Printf("DEBUG: [op=%s] (%s) Request - Method: %s, URL: %s, RemoteAddr: %s, Headers: %v", operationID(r), from, r.Method, r.URL.Path, r.RemoteAddr, redactHeaders(r.Header))
 }
 
-// Parse the Azure Custom Provider header, "X-Ms-Customproviders-Requestpath" and return the struct, CustomProviderRequestPath
+// requestPathHeader is the header ARM uses to pass the resource path when it routes to the endpoint root
+const requestPathHeader = "X-Ms-Customproviders-Requestpath"
+
+// customProviderRequestPath returns the ARM request path of a custom provider request: the
+// X-Ms-Customproviders-Requestpath header when ARM calls the endpoint root, or the URL path when
+// ARM or a proxy sends the full /subscriptions/... path. It is empty for other requests.
+func customProviderRequestPath(r *http.Request) string {
+	if path := r.Header.Get(requestPathHeader); path != "" {
+		// A query, e.g. a collection GET's $skipToken, is not part of the path
+		path, _, _ = strings.Cut(path, "?")
+		return path
+	}
+	if strings.HasPrefix(strings.ToLower(r.URL.Path), "/subscriptions/") {
+		return r.URL.Path
+	}
+	return ""
+}
+
+// Parse the Azure Custom Provider request path (see customProviderRequestPath) and return the struct, CustomProviderRequestPath
 // Example:
 //
-//			X-Ms-Customproviders-Requestpath:
+//			X-Ms-Customproviders-Requestpath, or the URL path:
 //		    segments[0,1] /subscriptions/{subscriptionId}
 //		    segments[2,3] /resourceGroups/{resourceGroupName}
 //		    segments[4,5] /providers/Microsoft.CustomProviders
 //		    segments[6,7] /resourceProviders/{resourceProviderName}
-//		    segments[8]   /{resources[].properties.resourceTypes.name}         // look at infra/main.bicep
-//	        segments[9]   /{literal name of the resource, aka resource name}
+//		    segments[8]   /{resources[].properties.resourceTypes.name}         // look at infra/main.bicep, or the action name
+//	        segments[9]   /{literal name of the resource, aka resource name}   // absent for actions
 //
 // REF: https://learn.microsoft.com/en-us/azure/azure-resource-manager/troubleshooting/error-invalid-name-segments?tabs=bicep
-func ParseCustomProviderHeaderRequestPath(r *http.Request) (CustomProviderRequestPath, error) {
+func ParseCustomProviderRequestPath(r *http.Request) (CustomProviderRequestPath, error) {
 	req := CustomProviderRequestPath{}
-	req.FullPath = r.Header.Get("X-Ms-Customproviders-Requestpath")
+	req.FullPath = customProviderRequestPath(r)
 	if req.FullPath == "" {
 		return req, fmt.Errorf("empty request path")
 	}
@@ -183,14 +144,17 @@ func ParseCustomProviderHeaderRequestPath(r *http.Request) (CustomProviderReques
 	req.Providers = segments[5]
 	req.ResourceProviders = segments[7]
 	req.ResourceTypeName = segments[8]
-	req.ResourceInstanceName = segments[9]
+	// Custom actions (POST) stop at segment 8, the action name
+	if len(segments) > 9 {
+		req.ResourceInstanceName = segments[9]
+	}
 
 	return req, nil
 }
 
-// HasCustomProviderRequestPath checks if the X-Ms-Customproviders-Requestpath header exists
+// HasCustomProviderRequestPath checks if the request carries an ARM request path, in the header or the URL
 func HasCustomProviderRequestPath(r *http.Request) bool {
-	return r.Header.Get("X-Ms-Customproviders-Requestpath") != ""
+	return customProviderRequestPath(r) != ""
 }
 
 func (r *CustomProviderRequestPath) ID() string {
@@ -2,12 +2,14 @@ package main
 
 import (
 	"net/http"
+	"net/http/httptest"
 	"testing"
 )
 
-func TestParseCustomProviderHeaderRequestPath(t *testing.T) {
+func TestParseCustomProviderRequestPath(t *testing.T) {
 	tests := []struct {
 		name           string
+		urlPath        string
 		requestPath    string
 		expectedResult CustomProviderRequestPath
 		expectError    bool
@@ -25,6 +27,30 @@ func TestParseCustomProviderHeaderRequestPath(t *testing.T) {
 			},
 			expectError: false,
 		},
+		{
+			name:    "request path in the URL",
+			urlPath: "/subscriptions/sub1/resourceGroups/rg1/providers/Microsoft.CustomProviders/resourceProviders/CyberArkProvider/safes/safe1",
+			expectedResult: CustomProviderRequestPath{
+				Subscriptions:        "sub1",
+				ResourceGroups:       "rg1",
+				Providers:            "Microsoft.CustomProviders",
+				ResourceProviders:    "CyberArkProvider",
+				ResourceTypeName:     "safes",
+				ResourceInstanceName: "safe1",
+			},
+		},
+		{
+			name:        "header wins over the URL",
+			urlPath:     "/subscriptions/other/resourceGroups/rg1/providers/Microsoft.CustomProviders/resourceProviders/CyberArkProvider/safes/other",
+			requestPath: "/subscriptions/sub1/resourceGroups/rg1/providers/Microsoft.CustomProviders/resourceProviders/CyberArkProvider/listPlatforms",
+			expectedResult: CustomProviderRequestPath{
+				Subscriptions:     "sub1",
+				ResourceGroups:    "rg1",
+				Providers:         "Microsoft.CustomProviders",
+				ResourceProviders: "CyberArkProvider",
+				ResourceTypeName:  "listPlatforms",
+			},
+		},
 		{
 			name:           "empty request path",
 			requestPath:    "",
@@ -60,12 +86,16 @@ func TestParseCustomProviderHeaderRequestPath(t *testing.T) {
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			req, _ := http.NewRequest("GET", "/", nil)
+			urlPath := tt.urlPath
+			if urlPath == "" {
+				urlPath = "/"
+			}
+			req, _ := http.NewRequest("GET", urlPath, nil)
 			if tt.requestPath != "" {
 				req.Header.Set("X-Ms-Customproviders-Requestpath", tt.requestPath)
 			}
 
-			result, err := ParseCustomProviderHeaderRequestPath(req)
+			result, err := ParseCustomProviderRequestPath(req)
 
 			if tt.expectError && err == nil {
 				t.Errorf("expected error but got none")
@@ -121,7 +151,18 @@ func TestCustomProviderRequestPath_String(t *testing.T) {
 		{
 			name:     "empty fields",
 			path:     CustomProviderRequestPath{},
-			expected: "/subscriptions//resourceGroups//providers//resourceProviders///",
+			expected: "/subscriptions//resourceGroups//providers//resourceProviders//",
+		},
+		{
+			name: "custom action has no instance name",
+			path: CustomProviderRequestPath{
+				Subscriptions:     "test-sub",
+				ResourceGroups:    "test-rg",
+				Providers:         "Microsoft.CustomProviders",
+				ResourceProviders: "test-provider",
+				ResourceTypeName:  "testAction",
+			},
+			expected: "/subscriptions/test-sub/resourceGroups/test-rg/providers/Microsoft.CustomProviders/resourceProviders/test-provider/testAction",
 		},
 		{
 			name: "path with special characters in resource name",
@@ -147,7 +188,7 @@ func TestCustomProviderRequestPath_String(t *testing.T) {
 	}
 }
 
-func TestParseCustomProviderHeaderRequestPath_EdgeCases(t *testing.T) {
+func TestParseCustomProviderRequestPath_EdgeCases(t *testing.T) {
 	tests := []struct {
 		name           string
 		requestPath    string
@@ -181,8 +222,21 @@ func TestParseCustomProviderHeaderRequestPath_EdgeCases(t *testing.T) {
 			expectError: false,
 		},
 		{
-			name:           "path with exactly 9 segments (one short)",
-			requestPath:    "/subscriptions/test-sub/resourceGroups/test-rg/providers/Microsoft.CustomProviders/resourceProviders/test-provider/testAction",
+			name:        "path with exactly 9 segments (custom action)",
+			requestPath: "/subscriptions/test-sub/resourceGroups/test-rg/providers/Microsoft.CustomProviders/resourceProviders/test-provider/testAction",
+			expectedResult: CustomProviderRequestPath{
+				Subscriptions:        "test-sub",
+				ResourceGroups:       "test-rg",
+				Providers:            "Microsoft.CustomProviders",
+				ResourceProviders:    "test-provider",
+				ResourceTypeName:     "testAction",
+				ResourceInstanceName: "",
+			},
+			expectError: false,
+		},
+		{
+			name:           "path with 8 segments (one short)",
+			requestPath:    "/subscriptions/test-sub/resourceGroups/test-rg/providers/Microsoft.CustomProviders/resourceProviders/test-provider",
 			expectedResult: CustomProviderRequestPath{},
 			expectError:    true,
 		},
@@ -219,7 +273,7 @@ func TestParseCustomProviderHeaderRequestPath_EdgeCases(t *testing.T) {
 			req, _ := http.NewRequest("GET", "/", nil)
 			req.Header.Set("X-Ms-Customproviders-Requestpath", tt.requestPath)
 
-			result, err := ParseCustomProviderHeaderRequestPath(req)
+			result, err := ParseCustomProviderRequestPath(req)
 
 			if tt.expectError && err == nil {
 				t.Errorf("expected error but got none")
@@ -254,3 +308,13 @@ func TestParseCustomProviderHeaderRequestPath_EdgeCases(t *testing.T) {
 		})
 	}
 }
+
+func TestSendJSONErrorBelow400(t *testing.T) {
+	for _, code := range []int{0, http.StatusOK, http.StatusFound} {
+		w := httptest.NewRecorder()
+		sendJSONError(w, code, "GetSafeDetailsError", "Failed to get safe: context deadline exceeded")
+		if w.Code != http.StatusBadGateway {
+			t.Errorf("code %d: expected 502, got %d", code, w.Code)
+		}
+	}
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// ARM retries a PUT it has not heard back from, often while the first one is still talking to
+// PCloud, and the two can each find no account and both add it. The in-flight tracker lets only
+// one of a set of identical concurrent requests for a resource run: a duplicate that arrives while
+// the first is in flight waits for it and is answered with a replay of its response. Requests are
+// identical when they have the same method, resource ID, api-version, body and conditional and
+// X-Provider-* headers; a request that differs in any of them runs as usual. Only requests that are
+// in flight are tracked, a retry after the first request finished is handled by the PUT handlers'
+// existing resource checks.
+
+// coalescedRequestsTotal counts duplicates answered with the response of the request in flight
+var coalescedRequestsTotal = newCounter("provider_coalesced_requests_total", "Duplicate concurrent requests answered with the response of the identical request in flight, by method")
+
+// inflightCall is a request in flight and, once done is closed, its response
+type inflightCall struct {
+	done   chan struct{}
+	status int
+	header http.Header
+	body   bytes.Buffer
+}
+
+// inflightTracker tracks the mutating resource requests in flight by their inflightKey
+type inflightTracker struct {
+	mu    sync.Mutex
+	calls map[string]*inflightCall
+}
+
+var inflight = &inflightTracker{calls: map[string]*inflightCall{}}
+
+// coalesced reports whether identical concurrent requests of a method are coalesced
+func coalesced(method string) bool {
+	return method == http.MethodPut || method == http.MethodPatch || method == http.MethodDelete
+}
+
+// inflightKey identifies a request: its method, resource ID, the api-version it was resolved to,
+// which picks the response schema, the headers that change what it does and a hash of its body.
+// The body was buffered by requestBodyMiddleware and is put back for the handler.
+func inflightKey(r *http.Request, cpRequest CustomProviderRequestPath) string {
+	body, _ := io.ReadAll(r.Body)
+	r.Body = io.NopCloser(bytes.NewReader(body))
+	sum := sha256.Sum256(body)
+
+	var headers []string
+	for name, values := range r.Header {
+		if strings.HasPrefix(name, requestFlagHeaderPrefix) || name == "If-Match" || name == "If-None-Match" {
+			headers = append(headers, name+"="+strings.Join(values, ","))
+		}
+	}
+	sort.Strings(headers)
+	return strings.Join([]string{r.Method, strings.ToLower(cpRequest.ID()), requestAPIVersion(r).Name, strings.Join(headers, ";"), hex.EncodeToString(sum[:])}, " ")
+}
+
+// serve runs next for the request, unless an identical request is in flight, in which case it waits
+// for that request and replays its response
+func (t *inflightTracker) serve(w http.ResponseWriter, r *http.Request, cpRequest CustomProviderRequestPath, next http.Handler) {
+	key := inflightKey(r, cpRequest)
+
+	t.mu.Lock()
+	if call, ok := t.calls[key]; ok {
+		t.mu.Unlock()
+		log.Printf("INFO: [op=%s] %s %s is already in flight, waiting for its response", operationID(r), r.Method, cpRequest.ID())
+		select {
+		case <-call.done:
+		case <-r.Context().Done():
+			return
+		}
+		// Nothing to replay when the first request failed before answering; run this one instead
+		if call.status == 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+		coalescedRequestsTotal.Inc("method", r.Method)
+		call.replay(w)
+		return
+	}
+	call := &inflightCall{done: make(chan struct{})}
+	t.calls[key] = call
+	t.mu.Unlock()
+
+	defer func() {
+		t.mu.Lock()
+		delete(t.calls, key)
+		t.mu.Unlock()
+		close(call.done)
+	}()
+	next.ServeHTTP(&inflightRecorder{ResponseWriter: w, call: call}, r)
+}
+
+// replay writes the recorded response; headers the request has already set, such as its own
+// operation ID, are kept
+func (c *inflightCall) replay(w http.ResponseWriter) {
+	for name, values := range c.header {
+		if _, set := w.Header()[name]; !set {
+			w.Header()[name] = values
+		}
+	}
+	w.WriteHeader(c.status)
+	w.Write(c.body.Bytes())
+}
+
+// inflightRecorder records the response of the request in flight for its duplicates
+type inflightRecorder struct {
+	http.ResponseWriter
+	call *inflightCall
+}
+
+func (ir *inflightRecorder) WriteHeader(code int) {
+	if ir.call.status == 0 {
+		ir.call.status = code
+		ir.call.header = ir.Header().Clone()
+	}
+	ir.ResponseWriter.WriteHeader(code)
+}
+
+func (ir *inflightRecorder) Write(b []byte) (int, error) {
+	if ir.call.status == 0 {
+		ir.WriteHeader(http.StatusOK)
+	}
+	ir.call.body.Write(b)
+	return ir.ResponseWriter.Write(b)
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestInflightCoalescesDuplicates(t *testing.T) {
+	cpRequest := CustomProviderRequestPath{
+		Subscriptions:        "sub1",
+		ResourceGroups:       "rg1",
+		Providers:            "Microsoft.CustomProviders",
+		ResourceProviders:    "CyberArkProvider",
+		ResourceTypeName:     "accounts",
+		ResourceInstanceName: "safe1.root-web01",
+	}
+	tracker := &inflightTracker{calls: map[string]*inflightCall{}}
+
+	var calls atomic.Int32
+	started, release := make(chan struct{}, 4), make(chan struct{})
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := calls.Add(1)
+		started <- struct{}{}
+		if body, _ := io.ReadAll(r.Body); strings.Contains(string(body), "web01") {
+			<-release
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("X-Call", string(rune('0'+n)))
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte(`{"properties":{"accountId":"12_3"}}`))
+	})
+	put := func(body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPut, "/", strings.NewReader(body))
+		w := httptest.NewRecorder()
+		tracker.serve(w, req, cpRequest, handler)
+		return w
+	}
+
+	var wg sync.WaitGroup
+	responses := make([]*httptest.ResponseRecorder, 2)
+	wg.Add(1)
+	go func() { defer wg.Done(); responses[0] = put(`{"properties":{"address":"web01"}}`) }()
+	<-started
+	wg.Add(1)
+	go func() { defer wg.Done(); responses[1] = put(`{"properties":{"address":"web01"}}`) }()
+
+	// A request with another body is not a duplicate and runs while the first is in flight
+	if other := put(`{"properties":{"address":"web02"}}`); other.Code != http.StatusCreated || calls.Load() != 2 {
+		t.Fatalf("expected the different request to run, got %d after %d calls", other.Code, calls.Load())
+	}
+	<-started
+
+	time.Sleep(100 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	if calls.Load() != 2 {
+		t.Fatalf("expected the duplicate to be coalesced, the handler ran %d times", calls.Load())
+	}
+	for i, w := range responses {
+		if w.Code != http.StatusCreated || w.Header().Get("X-Call") != "1" || !strings.Contains(w.Body.String(), "12_3") {
+			t.Errorf("response %d: expected the first request's response, got %d %v %s", i, w.Code, w.Header(), w.Body.String())
+		}
+	}
+	if len(tracker.calls) != 0 {
+		t.Errorf("expected no requests in flight, got %d", len(tracker.calls))
+	}
+
+	// Once the first request is done, the same request runs again
+	put(`{"properties":{"address":"web01"}}`)
+	if calls.Load() != 3 {
+		t.Errorf("expected a request after the first finished to run, the handler ran %d times", calls.Load())
+	}
+}
+
+func TestInflightKey(t *testing.T) {
+	cpRequest := CustomProviderRequestPath{
+		Subscriptions:        "sub1",
+		ResourceGroups:       "rg1",
+		Providers:            "Microsoft.CustomProviders",
+		ResourceProviders:    "CyberArkProvider",
+		ResourceTypeName:     "accounts",
+		ResourceInstanceName: "safe1.root-web01",
+	}
+	key := func(target, body string, header map[string]string) string {
+		var got string
+		req := httptest.NewRequest(http.MethodPut, target, strings.NewReader(body))
+		for name, value := range header {
+			req.Header.Set(name, value)
+		}
+		apiVersionMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			got = inflightKey(r, cpRequest)
+		})).ServeHTTP(httptest.NewRecorder(), req)
+		return got
+	}
+	base := key("/?api-version=2025-06-01", `{"properties":{}}`, nil)
+
+	tests := []struct {
+		name   string
+		target string
+		body   string
+		header map[string]string
+		same   bool
+	}{
+		{"identical", "/?api-version=2025-06-01", `{"properties":{}}`, nil, true},
+		{"other query parameters", "/?api-version=2025-06-01&x=1", `{"properties":{}}`, nil, true},
+		{"other api-version", "/?api-version=2018-09-01-preview", `{"properties":{}}`, nil, false},
+		{"no api-version", "/", `{"properties":{}}`, nil, false},
+		{"other body", "/?api-version=2025-06-01", `{"properties":{"address":"web02"}}`, nil, false},
+		{"conditional header", "/?api-version=2025-06-01", `{"properties":{}}`, map[string]string{"If-Match": "*"}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := key(tt.target, tt.body, tt.header); (got == base) != tt.same {
+				t.Errorf("expected the same key as the base request: %v, got %q and %q", tt.same, got, base)
+			}
+		})
+	}
+}
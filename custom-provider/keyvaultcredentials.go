@@ -0,0 +1,183 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// keyVaultResource is the token audience of Azure Key Vault
+const keyVaultResource = "https://vault.azure.net"
+
+// keyVaultCredentialSource reads credentials from Azure Key Vault secrets with the container's
+// managed identity. Values are cached for KEYVAULT_CREDENTIALS_TTL (default 1h) and read again
+// as soon as PCloud rejects them, so a rotated password is picked up on the next request.
+type keyVaultCredentialSource struct {
+	vaultURI string
+	// secrets maps a setting (e.g. PAMPASS) to the Key Vault secret holding it
+	secrets map[string]string
+	client  *http.Client
+	cache   *credentialCache
+}
+
+func newKeyVaultCredentialSource() *keyVaultCredentialSource {
+	s := &keyVaultCredentialSource{
+		vaultURI: strings.TrimSuffix(os.Getenv("KEYVAULT_URI"), "/"),
+		secrets:  storedSettings("KEYVAULT_SECRET_"),
+		client:   newOutboundClient(10 * time.Second),
+		cache:    &credentialCache{source: "keyvault", ttl: credentialsTTL("KEYVAULT_CREDENTIALS_TTL", time.Hour)},
+	}
+	registerDependency("keyvault", func() map[string]interface{} {
+		details := s.cache.details()
+		details["secrets"] = len(s.secrets)
+		return details
+	})
+	return s
+}
+
+func (s *keyVaultCredentialSource) Name() string { return "keyvault" }
+
+func (s *keyVaultCredentialSource) Check() error {
+	if missingVars := missingSettings("KEYVAULT_SECRET_", s.secrets); len(missingVars) > 0 {
+		return fmt.Errorf("missing required environment variables: %v", missingVars)
+	}
+	return nil
+}
+
+func (s *keyVaultCredentialSource) Credentials() (pcloudCredentials, error) {
+	return s.cache.get(s.fetch)
+}
+
+func (s *keyVaultCredentialSource) Invalidate() bool {
+	s.cache.invalidate()
+	return len(s.secrets) > 0
+}
+
+// fetch reads every configured secret
+func (s *keyVaultCredentialSource) fetch() (pcloudCredentials, error) {
+	creds := envCredentials()
+	for name, secret := range s.secrets {
+		value, err := s.secret(secret)
+		if err != nil {
+			return creds, fmt.Errorf("failed to read %s from Key Vault secret %s: %w", name, secret, err)
+		}
+		creds.set(name, value)
+	}
+	log.Printf("DEBUG: Read %d credential settings from Key Vault %s", len(s.secrets), s.vaultURI)
+	return creds, nil
+}
+
+// secret reads the current version of a secret
+func (s *keyVaultCredentialSource) secret(name string) (string, error) {
+	body, err := keyVaultDo(s.client, http.MethodGet, fmt.Sprintf("%s/secrets/%s?api-version=7.4", s.vaultURI, url.PathEscape(name)), nil)
+	if err != nil {
+		return "", err
+	}
+	var bundle struct {
+		Value string `json:"value"`
+	}
+	if err := json.Unmarshal(body, &bundle); err != nil {
+		return "", fmt.Errorf("failed to parse secret: %w", err)
+	}
+	return bundle.Value, nil
+}
+
+// keyVaultDo calls the Key Vault REST API with the managed identity. A 401 means the cached managed
+// identity token is no longer accepted, so it is dropped and the call is tried once more with a new one.
+func keyVaultDo(client *http.Client, method, apiurl string, body interface{}) ([]byte, error) {
+	var data []byte
+	if body != nil {
+		var err error
+		if data, err = json.Marshal(body); err != nil {
+			return nil, err
+		}
+	}
+	for attempt := 1; ; attempt++ {
+		token, err := getManagedIdentityToken(keyVaultResource)
+		if err != nil {
+			return nil, err
+		}
+		req, err := http.NewRequest(method, apiurl, bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+		if body != nil {
+			req.Header.Set("Content-Type", "application/json")
+		}
+
+		resp, err := client.Do(req)
+		if err != nil {
+			return nil, err
+		}
+		respBody, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode == http.StatusUnauthorized && attempt == 1 {
+			forgetManagedIdentityToken(keyVaultResource)
+			continue
+		}
+		if resp.StatusCode >= 300 {
+			return nil, fmt.Errorf("%s %s returned status %d", method, req.URL.Path, resp.StatusCode)
+		}
+		return respBody, nil
+	}
+}
+
+// keyVaultDNSSuffixes are the Key Vault host names of the Azure clouds; secrets are only written to
+// these, so the managed identity token is never sent anywhere else
+var keyVaultDNSSuffixes = []string{".vault.azure.net", ".vault.azure.cn", ".vault.usgovcloudapi.net", ".vault.microsoftazure.de"}
+
+// validKeyVaultURI checks that uri is the https URI of a Key Vault, e.g. https://my-vault.vault.azure.net
+func validKeyVaultURI(uri string) error {
+	u, err := url.Parse(uri)
+	if err != nil || u.Scheme != "https" || u.User != nil || strings.Trim(u.Path, "/") != "" || u.RawQuery != "" {
+		return fmt.Errorf("keyVaultUri must be a Key Vault URI such as https://my-vault.vault.azure.net, got %q", uri)
+	}
+	for _, suffix := range keyVaultDNSSuffixes {
+		if strings.HasSuffix(strings.ToLower(u.Hostname()), suffix) && u.Port() == "" {
+			return nil
+		}
+	}
+	return fmt.Errorf("keyVaultUri host %s is not an Azure Key Vault", u.Host)
+}
+
+// keyVaultSecretName matches the names Key Vault accepts for secrets
+var keyVaultSecretName = regexp.MustCompile(`^[0-9A-Za-z-]{1,127}$`)
+
+// keyVaultClient is used for secrets written on behalf of requests
+var keyVaultClient = newOutboundClient(10 * time.Second)
+
+// putKeyVaultSecret stores value as a new version of a secret and returns the ID of that version
+func putKeyVaultSecret(vaultURI, name, value string, tags map[string]string) (string, error) {
+	body, err := keyVaultDo(keyVaultClient, http.MethodPut,
+		fmt.Sprintf("%s/secrets/%s?api-version=7.4", strings.TrimSuffix(vaultURI, "/"), url.PathEscape(name)),
+		map[string]interface{}{"value": value, "tags": tags})
+	if err != nil {
+		return "", err
+	}
+	var bundle struct {
+		ID string `json:"id"`
+	}
+	if err := json.Unmarshal(body, &bundle); err != nil {
+		return "", fmt.Errorf("failed to parse secret: %w", err)
+	}
+	return bundle.ID, nil
+}
+
+func (s *keyVaultCredentialSource) Describe() map[string]string {
+	return describeSettings(map[string]string{
+		"type": "keyvault",
+		"url":  redactURL(s.vaultURI),
+	}, s.secrets)
+}
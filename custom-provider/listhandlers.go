@@ -0,0 +1,158 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/davidh-cyberark/privilegeaccessmanager-sdk-go/pam"
+)
+
+// CustomProviderListResponse is the body of a collection GET
+type CustomProviderListResponse struct {
+	Value []CustomProviderResponse `json:"value"`
+	// NextLink is the URL of the next page, see pagination.go
+	NextLink string `json:"nextLink,omitempty"`
+}
+
+// managedRecords returns the resource records of the requested type under the requesting custom
+// provider. The provider only lists what it created or imported; PCloud objects created elsewhere
+// are not ARM resources of this provider. Records are sorted by resource ID so pages are stable.
+func managedRecords(cpRequest CustomProviderRequestPath) ([]ResourceRecord, error) {
+	records, err := stateStore.List()
+	if err != nil {
+		return nil, err
+	}
+	prefix := stateKey(cpRequest.ID()) + "/"
+	var managed []ResourceRecord
+	for _, rec := range records {
+		if strings.HasPrefix(stateKey(rec.ResourceID), prefix) && strings.EqualFold(rec.ResourceType, cpRequest.ResourceTypeName) {
+			managed = append(managed, rec)
+		}
+	}
+	sort.Slice(managed, func(i, j int) bool { return stateKey(managed[i].ResourceID) < stateKey(managed[j].ResourceID) })
+	return managed, nil
+}
+
+// listResponse builds the collection element for a record; the name keeps the casing ARM used
+func listResponse(cpRequest CustomProviderRequestPath, rec ResourceRecord, properties map[string]interface{}) CustomProviderResponse {
+	return CustomProviderResponse{
+		ID:         rec.ResourceID,
+		Name:       resourceName(rec),
+		Type:       fmt.Sprintf("Microsoft.CustomProviders/resourceProviders/%s", cpRequest.ResourceTypeName),
+		Properties: properties,
+	}
+}
+
+// handleListSafes handles a collection GET on safes: every safe the provider manages, read from PCloud
+func handleListSafes(w http.ResponseWriter, r *http.Request, cpRequest CustomProviderRequestPath) {
+	LogRequestDebug("ListSafes", r)
+
+	records, pamClient, nextLink, ok := listPrelude(w, r, cpRequest)
+	if !ok {
+		return
+	}
+
+	stopPAM := startPhase(r, "pam")
+	defer stopPAM()
+
+	response := CustomProviderListResponse{Value: []CustomProviderResponse{}, NextLink: nextLink}
+	for _, rec := range records {
+		safe, retcode, err := pcloudRetry(r.Context(), "safes", "GetSafeDetails", true, func(ctx context.Context) (pam.GetSafeDetails, int, error) {
+			return pamGetSafeDetails(ctx, pamClient, rec.SafeName)
+		})
+		if retcode == http.StatusNotFound {
+			log.Printf("WARNING: (ListSafes) safe %s of %s no longer exists in PCloud", rec.SafeName, rec.ResourceID)
+			continue
+		}
+		if err != nil {
+			sendJSONError(w, http.StatusBadGateway, "GetSafeDetailsError", fmt.Sprintf("Failed to get safe %s: %v", rec.SafeName, checkMaintenance(err)))
+			return
+		}
+		properties, err := safeResourceProperties(r, safe, "")
+		if err != nil {
+			sendJSONError(w, http.StatusInternalServerError, "SafeMarshalError", err.Error())
+			return
+		}
+		addSafeRecordProperties(properties, rec)
+		response.Value = append(response.Value, listResponse(cpRequest, rec, properties))
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// handleListAccounts handles a collection GET on accounts: every account the provider manages, read from PCloud
+func handleListAccounts(w http.ResponseWriter, r *http.Request, cpRequest CustomProviderRequestPath) {
+	LogRequestDebug("ListAccounts", r)
+
+	records, pamClient, nextLink, ok := listPrelude(w, r, cpRequest)
+	if !ok {
+		return
+	}
+
+	stopPAM := startPhase(r, "pam")
+	defer stopPAM()
+
+	response := CustomProviderListResponse{Value: []CustomProviderResponse{}, NextLink: nextLink}
+	for _, rec := range records {
+		account, retcode, err := pcloudRetry(r.Context(), "accounts", "GetAccount", true, func(ctx context.Context) (pam.GetAccountResponse, int, error) {
+			return pamGetAccount(ctx, pamClient, rec.PCloudID)
+		})
+		if retcode == http.StatusNotFound {
+			log.Printf("WARNING: (ListAccounts) account %s of %s no longer exists in PCloud", rec.PCloudID, rec.ResourceID)
+			continue
+		}
+		if err != nil {
+			sendJSONError(w, http.StatusBadGateway, "GetAccountError", fmt.Sprintf("Failed to get account %s: %v", rec.PCloudID, checkMaintenance(err)))
+			return
+		}
+		properties, err := accountResourceProperties(r, account)
+		if err != nil {
+			sendJSONError(w, http.StatusInternalServerError, "GetAccountMarshalError", err.Error())
+			return
+		}
+		addAccountRecordProperties(properties, rec)
+		response.Value = append(response.Value, listResponse(cpRequest, rec, properties))
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// listPrelude loads the managed records of the requested page, the link to the next page and a PAM
+// client, answering the request itself on failure
+func listPrelude(w http.ResponseWriter, r *http.Request, cpRequest CustomProviderRequestPath) ([]ResourceRecord, *pam.Client, string, bool) {
+	page, err := collectionPage(r)
+	if err != nil {
+		sendJSONError(w, http.StatusBadRequest, "InvalidPageRequest", err.Error())
+		return nil, nil, "", false
+	}
+	records, err := managedRecords(cpRequest)
+	if err != nil {
+		sendJSONError(w, http.StatusServiceUnavailable, "StateStoreError", fmt.Sprintf("Failed to list resource records: %v", err))
+		return nil, nil, "", false
+	}
+	start, end, next := page.bounds(len(records))
+	records = records[start:end]
+	nextLink := ""
+	if next >= 0 {
+		nextLink = collectionNextLink(r, cpRequest, page, next)
+	}
+	if len(records) == 0 {
+		return records, nil, nextLink, true
+	}
+
+	stopAuth := startPhase(r, "auth")
+	pamClient, err := createPAMClient()
+	stopAuth()
+	if err != nil {
+		sendJSONError(w, http.StatusInternalServerError, "PAMClientError", fmt.Sprintf("Failed to create PAM client: %v", err))
+		return nil, nil, "", false
+	}
+	return records, pamClient, nextLink, true
+}
@@ -0,0 +1,38 @@
+package main
+
+import "testing"
+
+func TestManagedRecords(t *testing.T) {
+	saved := stateStore
+	defer func() { stateStore = saved }()
+	stateStore = newMemoryStateStore()
+
+	const provider = "/subscriptions/sub1/resourceGroups/rg1/providers/Microsoft.CustomProviders/resourceProviders/CyberArkProvider"
+	for _, rec := range []ResourceRecord{
+		{ResourceID: provider + "/safes/Safe1", ResourceType: "safes"},
+		{ResourceID: provider + "/safes/safe2", ResourceType: "safes"},
+		{ResourceID: provider + "/accounts/safe1.acct1", ResourceType: "accounts"},
+		{ResourceID: provider + "Two/safes/safe3", ResourceType: "safes"},
+		{ResourceID: "/subscriptions/sub1/resourceGroups/rg2/providers/Microsoft.CustomProviders/resourceProviders/CyberArkProvider/safes/safe4", ResourceType: "safes"},
+	} {
+		stateStore.Put(rec)
+	}
+
+	cpRequest := CustomProviderRequestPath{
+		Subscriptions:     "sub1",
+		ResourceGroups:    "RG1",
+		Providers:         "Microsoft.CustomProviders",
+		ResourceProviders: "cyberarkprovider",
+		ResourceTypeName:  "safes",
+	}
+	records, err := managedRecords(cpRequest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 2 || records[0].ResourceID != provider+"/safes/Safe1" || records[1].ResourceID != provider+"/safes/safe2" {
+		t.Errorf("expected Safe1 and safe2, got %+v", records)
+	}
+	if got := listResponse(cpRequest, records[0], nil).Name; got != "Safe1" {
+		t.Errorf("expected name Safe1, got %q", got)
+	}
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"sync/atomic"
+)
+
+// Log lines carry their level as a DEBUG:, INFO:, WARNING: or ERROR: prefix after the timestamp.
+// Lines below the current level are dropped by the log writer; lines without a level, such as the
+// ones the PAM SDK logs and ADMIN-AUDIT entries, are always written. LOG_LEVEL sets the level at
+// startup and PUT /admin/logLevel changes it at runtime.
+
+var logLevelNames = []string{"debug", "info", "warning", "error"}
+
+// logLevel is the index in logLevelNames of the lowest level that is written
+var logLevel atomic.Int32
+
+func init() {
+	level, err := parseLogLevel(getEnvOrDefault("LOG_LEVEL", "debug"))
+	if err != nil {
+		log.Printf("WARNING: Invalid LOG_LEVEL, using debug: %v", err)
+	}
+	logLevel.Store(int32(level))
+}
+
+func parseLogLevel(name string) (int, error) {
+	for i, level := range logLevelNames {
+		if strings.EqualFold(name, level) {
+			return i, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown log level %q, expected one of %v", name, logLevelNames)
+}
+
+// currentLogLevel returns the name of the level logs are written at
+func currentLogLevel() string {
+	return logLevelNames[logLevel.Load()]
+}
+
+// logLineEnabled reports whether a log line's level is at or above the current level
+func logLineEnabled(line []byte) bool {
+	// The level follows the date and time the log package writes, so only the start is searched
+	head := string(line[:min(len(line), 32)])
+	for i, level := range logLevelNames {
+		if strings.Contains(head, strings.ToUpper(level)+": ") {
+			return int32(i) >= logLevel.Load()
+		}
+	}
+	return true
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestLogLineEnabled(t *testing.T) {
+	defer logLevel.Store(logLevel.Load())
+	logLevel.Store(1) // info
+
+	tests := []struct {
+		line    string
+		enabled bool
+	}{
+		{"2026/10/16 01:25:44 DEBUG: Creating PAM client\n", false},
+		{"2026/10/16 01:25:44 INFO: Server starting\n", true},
+		{"2026/10/16 01:25:44 WARNING: Slow request\n", true},
+		{"2026/10/16 01:25:44 ERROR: could not refresh session\n", true},
+		{"2026/10/16 01:25:44 failed to parse json body for platform token\n", true},
+		{"2026/10/16 01:25:44 ADMIN-AUDIT: {\"message\":\"DEBUG: not a level\"}\n", true},
+	}
+	for _, tt := range tests {
+		if got := logLineEnabled([]byte(tt.line)); got != tt.enabled {
+			t.Errorf("%q: expected enabled %t, got %t", tt.line, tt.enabled, got)
+		}
+	}
+}
+
+func TestSetLogLevel(t *testing.T) {
+	defer logLevel.Store(logLevel.Load())
+
+	tests := []struct {
+		body           string
+		expectedStatus int
+		expectedLevel  string
+	}{
+		{body: `{"level": "WARNING"}`, expectedStatus: http.StatusOK, expectedLevel: "warning"},
+		{body: `{"level": "verbose"}`, expectedStatus: http.StatusBadRequest, expectedLevel: "warning"},
+		{body: `{"level": "debug"}`, expectedStatus: http.StatusOK, expectedLevel: "debug"},
+	}
+	for _, tt := range tests {
+		rr := httptest.NewRecorder()
+		handleSetLogLevel(rr, httptest.NewRequest(http.MethodPut, "/admin/logLevel", strings.NewReader(tt.body)))
+		if rr.Code != tt.expectedStatus || currentLogLevel() != tt.expectedLevel {
+			t.Errorf("%s: expected %d and level %s, got %d and %s", tt.body, tt.expectedStatus, tt.expectedLevel, rr.Code, currentLogLevel())
+		}
+	}
+}
@@ -1,10 +1,16 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"log"
+	"net"
 	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
 
+	"cyberark-custom-provider/config"
 	"github.com/gorilla/mux"
 )
 
@@ -19,6 +25,9 @@ type CustomProviderResponse struct {
 	Properties map[string]interface{} `json:"properties"`
 }
 
+// armRequestPath is the URL path of a resource type collection or custom action under direct routing
+const armRequestPath = "/subscriptions/{subscriptionId}/resourceGroups/{resourceGroupName}/providers/{providerNamespace}/resourceProviders/{resourceProviderName}/{resourceType}"
+
 // handleCatchAll handles requests that don't match any other route
 func handleCatchAll(w http.ResponseWriter, r *http.Request) {
 	LogRequestDebug("CatchAll", r)
@@ -30,22 +39,56 @@ func handleCatchAll(w http.ResponseWriter, r *http.Request) {
 func handleRootRequest(w http.ResponseWriter, r *http.Request) {
 	LogRequestDebug("RootRequest", r)
 
-	// If the custom provider header exists, then we process the custom provider request
+	// If the request carries an ARM request path (header or URL), then we process the custom provider request
 	if HasCustomProviderRequestPath(r) {
-		cpRequest, err := ParseCustomProviderHeaderRequestPath(r)
+		cpRequest, err := ParseCustomProviderRequestPath(r)
 		if err != nil {
-			sendJSONError(w, http.StatusBadRequest, "BadRequestPath", fmt.Sprintf("Invalid header, X-Ms-Customproviders-Requestpath: %s", err.Error()))
+			sendJSONError(w, http.StatusBadRequest, "BadRequestPath", fmt.Sprintf("Invalid request path: %s", err.Error()))
 			return
 		}
 		log.Printf("DEBUG: Parsed Custom Provider request - Action: %s, ResourceName: %s.", cpRequest.ResourceTypeName, cpRequest.ResourceInstanceName)
-		switch cpRequest.ResourceTypeName {
-		case "safes":
-			handleSafe(w, r, cpRequest)
-		case "accounts":
-			handleAccount(w, r, cpRequest)
-		default:
+		if !checkAccessPolicy(w, r, cpRequest) {
+			return
+		}
+		// Custom actions are POSTed to .../resourceProviders/{name}/{action}
+		if r.Method == http.MethodPost {
+			entry, ok := lookupProviderEntry(actions, cpRequest.ResourceTypeName)
+			if !ok {
+				sendJSONError(w, http.StatusMethodNotAllowed, "MethodNotAllowed", fmt.Sprintf("Action %s is not supported", cpRequest.ResourceTypeName))
+				return
+			}
+			if !entry.entryEnabled(true) {
+				sendResourceTypeDisabled(w, entry, true)
+				return
+			}
+			withRequestTimeout(entry.Name, entry.Handler.forRequest(cpRequest)).ServeHTTP(w, r)
+			return
+		}
+
+		entry, ok := lookupProviderEntry(resourceTypes, cpRequest.ResourceTypeName)
+		if !ok {
 			sendJSONError(w, http.StatusMethodNotAllowed, "MethodNotAllowed", fmt.Sprintf("Action %s is not supported", cpRequest.ResourceTypeName))
+			return
+		}
+		if !entry.entryEnabled(false) {
+			sendResourceTypeDisabled(w, entry, false)
+			return
 		}
+		// A request path ending at the resource type is a collection request
+		if cpRequest.ResourceInstanceName == "" {
+			if r.Method != http.MethodGet || entry.List == nil {
+				sendJSONError(w, http.StatusMethodNotAllowed, "MethodNotAllowed", fmt.Sprintf("%s on the %s collection is not supported", r.Method, cpRequest.ResourceTypeName))
+				return
+			}
+			withRequestTimeout(entry.Name, entry.List.forRequest(cpRequest)).ServeHTTP(w, r)
+			return
+		}
+		handler := withRequestTimeout(entry.Name, entry.Handler.forRequest(cpRequest))
+		if coalesced(r.Method) {
+			inflight.serve(w, r, cpRequest, handler)
+			return
+		}
+		handler.ServeHTTP(w, r)
 		return // Add return to prevent fall-through to regular request handling
 	}
 
@@ -57,41 +100,186 @@ func handleRootRequest(w http.ResponseWriter, r *http.Request) {
 		handleCatchAll(w, r)
 	}
 }
-func main() {
-	// Validate environment variables at startup
-	if err := validEnvVars(); err != nil {
-		log.Printf("FATAL: Environment validation failed: %v", err)
-		log.Fatal("Cannot start server due to missing environment variables")
-	}
-	log.Printf("INFO: All required environment variables are set")
 
+// newRouter builds the provider's router and returns it with its middleware chain
+func newRouter() (*mux.Router, []namedMiddleware) {
 	r := mux.NewRouter()
 
 	// Add debugging middleware to log all requests
-	r.Use(loggingMiddleware)
+	middlewares := []namedMiddleware{
+		{"operationId", operationIDMiddleware},
+		{"tracing", tracingMiddleware},
+		{"logging", loggingMiddleware},
+		{"requestTiming", requestTimingMiddleware},
+		{"callerAuth", callerAuthMiddleware},
+		{"requestBody", requestBodyMiddleware},
+		{"requestFlags", requestFlagsMiddleware},
+		{"apiVersion", apiVersionMiddleware},
+		{"operationAudit", operationAuditMiddleware},
+		{"maintenance", maintenanceMiddleware},
+		{"circuitBreaker", circuitBreakerMiddleware},
+	}
+	for _, m := range middlewares {
+		r.Use(m.Middleware)
+	}
 
 	// Custom resource endpoints
-	// Handle Custom Provider requests (PUT, DELETE, PATCH) that come to root with header routing
-	r.HandleFunc("/", handleRootRequest).Methods("GET", "PUT", "DELETE")
+	// Handle Custom Provider requests (PUT, DELETE, PATCH) and actions (POST) that come to root with header routing
+	r.HandleFunc("/", handleRootRequest).Methods("GET", "PUT", "PATCH", "DELETE", "POST")
+	// The same requests when ARM or a proxy sends the full resource path as the URL path (direct routing)
+	r.HandleFunc(armRequestPath, handleRootRequest).Methods("GET", "PUT", "PATCH", "DELETE", "POST")
+	r.HandleFunc(armRequestPath+"/{resourceName}", handleRootRequest).Methods("GET", "PUT", "PATCH", "DELETE")
 
 	// Health check endpoint
 	r.HandleFunc("/health", handleHealth).Methods("GET")
+	r.HandleFunc("/livez", handleLivez).Methods("GET")
+	r.HandleFunc("/readyz", handleReadyz).Methods("GET")
 	r.HandleFunc("/healthex", handleHealthEx).Methods("GET") // checks pamclient, so, only call this manually
 
+	// Status and results of async PUTs (see asyncops.go)
+	r.HandleFunc("/operations/{id}", handleGetOperation).Methods("GET")
+	r.HandleFunc("/operations/{id}/result", handleGetOperationResult).Methods("GET")
+
+	// Custom provider definition generated from the handler registry (see registry.go)
+	r.HandleFunc("/definition", handleGetDefinition).Methods("GET")
+
+	// Version and feature flags of this deployment (see featureflags.go)
+	r.HandleFunc("/metadata", handleGetMetadata).Methods("GET")
+
+	// Prometheus metrics (see metrics.go)
+	r.HandleFunc("/metrics", handleMetrics).Methods("GET")
+
+	// Operator endpoints, only registered when ADMIN_TOKEN is set
+	registerAdminRoutes(r)
+
+	// External tooling endpoints, only registered when PROBE_TOKEN is set
+	registerProbeRoutes(r)
+
 	// Catch-all route for debugging unmatched requests
 	r.PathPrefix("/").HandlerFunc(handleCatchAll)
 
+	return r, middlewares
+}
+
+func main() {
+	// The config file was applied to the environment before any setting was read (see config/)
+	if err := config.Err(); err != nil {
+		log.Fatalf("FATAL: Cannot load the config file: %v", err)
+	}
+	if file := config.File(); file != "" {
+		log.Printf("INFO: Loaded settings from config file %s", file)
+		for _, warning := range config.Warnings() {
+			log.Printf("WARNING: Config file %s: %s", file, warning)
+		}
+		for _, name := range config.Overridden() {
+			log.Printf("INFO: Config file setting %s is overridden by the environment", name)
+		}
+	}
+
+	if outboundTransportErr != nil {
+		log.Fatalf("FATAL: Cannot set up outbound connections: %v", outboundTransportErr)
+	}
+
+	if err := checkEnabledResourceTypes(); err != nil {
+		log.Fatalf("FATAL: %v", err)
+	}
+
+	tlsLoader, err := newTLSCertificateLoader()
+	if err != nil {
+		log.Fatalf("FATAL: Invalid TLS configuration: %v", err)
+	}
+
+	if mockPAMEnabled() {
+		if err := startMockPCloud(); err != nil {
+			log.Fatalf("FATAL: Cannot start the mock PCloud: %v", err)
+		}
+	}
+
+	// Validate environment variables at startup
+	if err := validEnvVars(); err != nil {
+		log.Printf("FATAL: Environment validation failed: %v", err)
+		log.Fatal("Cannot start server due to missing environment variables")
+	}
+	log.Printf("INFO: All required environment variables are set")
+
+	if interval := credentialsRefreshInterval(); interval > 0 {
+		pamSessions.watchCredentials(interval)
+	}
+
+	if err := loadSafeProfiles(); err != nil {
+		log.Fatalf("FATAL: Cannot load safe profiles: %v", err)
+	}
+	if err := loadSecretPolicies(); err != nil {
+		log.Fatalf("FATAL: Cannot load secret policies: %v", err)
+	}
+	if err := loadAccessPolicies(); err != nil {
+		log.Fatalf("FATAL: Cannot load access policies: %v", err)
+	}
+
+	if tlsLoader != nil {
+		tlsCertificates = newTLSCertificateStore(tlsLoader)
+		if _, err := tlsCertificates.reload(); err != nil {
+			log.Fatalf("FATAL: Cannot load the TLS certificate: %v", err)
+		}
+		if interval := tlsCertRefreshInterval(); interval > 0 {
+			tlsCertificates.watch(interval)
+		}
+	}
+
+	r, middlewares := newRouter()
+
 	port := getEnvOrDefault("PORT", "8080")
 	log.Printf("INFO: Starting CyberArk Custom Provider on port %s", port)
+	logStartupFingerprint(middlewares)
+	logEffectiveConfig()
 
-	// Get and log the public IP at startup
-	startupIP := getPublicIP()
-	log.Printf("INFO: Container startup public IP address: %s", startupIP)
+	// The egress IP is logged once it is known, without delaying startup
+	egressIP.resolveAsync()
 
 	log.Printf("DEBUG: Server routes configured - Endpoints available:")
 	log.Printf("  - GET  /health")
+	log.Printf("  - GET  /livez, /readyz -- liveness and readiness probes")
 	log.Printf("  - GET  /healthex -- only use this one when troubleshooting")
-	log.Printf("  - GET/PUT/DELETE /subscriptions/.../safes/{name}")
-	log.Printf("  - GET/PUT/DELETE /subscriptions/.../accounts/{name}")
-	log.Fatal(http.ListenAndServe(":"+port, r))
+	log.Printf("  - GET  /definition")
+	log.Printf("  - GET  /metadata -- version and feature flags")
+	log.Printf("  - GET  /metrics -- Prometheus metrics, requires METRICS_TOKEN when set")
+	log.Printf("  - GET  /operations/{id}[/result] -- async PUT status")
+	log.Printf("  - GET  /admin/audit, /admin/debug/pprof/ -- requires ADMIN_TOKEN")
+	log.Printf("  - POST /admin/cleanupOrphans -- requires ADMIN_TOKEN")
+	log.Printf("  - POST /admin/flush[/{name}] -- requires ADMIN_TOKEN")
+	log.Printf("  - GET/PUT /admin/logLevel -- requires ADMIN_TOKEN")
+	log.Printf("  - POST /admin/maintenance -- requires ADMIN_TOKEN")
+	log.Printf("  - POST /admin/pamSession/refresh -- requires ADMIN_TOKEN")
+	log.Printf("  - GET  /probe/accounts?safeName=&accountName= -- requires PROBE_TOKEN")
+	log.Printf("  - GET /subscriptions/.../safes, .../accounts, .../platforms -- collection")
+	log.Printf("  - GET/PUT/PATCH/DELETE /subscriptions/.../safes/{name}")
+	log.Printf("  - GET/PUT/PATCH/DELETE /subscriptions/.../accounts/{name}")
+	log.Printf("  - GET/PUT/DELETE /subscriptions/.../safeMembers/{safe}.{member}")
+	log.Printf("  - GET/PUT/DELETE /subscriptions/.../conjurSecrets/{variable}")
+	log.Printf("  - GET/PUT/DELETE /subscriptions/.../platforms/{platformId} -- read-only")
+	log.Printf("  - GET/PUT/DELETE /subscriptions/.../applications/{appId}")
+	log.Printf("  - GET/PUT/DELETE /subscriptions/.../conjurHosts/{host}")
+	log.Printf("  - POST /subscriptions/.../{action} -- %d actions registered", len(actions))
+	log.Printf("  - resource requests are accepted at / with X-Ms-Customproviders-Requestpath, or at the full /subscriptions/... path")
+	if mockPAMEnabled() {
+		log.Printf("  - PCloud calls go to the in-memory MOCK_PAM fake at %s", os.Getenv("PCLOUDURL"))
+	}
+
+	ln, err := net.Listen("tcp", ":"+port)
+	if err != nil {
+		log.Fatalf("FATAL: Cannot listen on port %s: %v", port, err)
+	}
+	srv := newServer(":"+port, r)
+	if tlsCertificates != nil {
+		ln = serveTLS(srv, ln, newTLSConfig(tlsCertificates, len(callerAuth.thumbprints)+len(callerAuth.subjects) > 0))
+		log.Printf("INFO: Terminating TLS on port %s (HTTP/2: %t)", port, tlsHTTP2Enabled())
+		if callerAuth.trustXFCC {
+			log.Printf("WARNING: CALLER_CERT_TRUST_XFCC is ignored while the provider terminates TLS; client certificates come from the TLS handshake")
+		}
+	}
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+	defer stop()
+	if err := runServer(ctx, srv, ln, shutdownGracePeriod()); err != nil {
+		log.Fatalf("FATAL: Server failed: %v", err)
+	}
 }
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maintenanceState tracks whether PCloud is in a maintenance window, either because an operator
+// said so (MAINTENANCE_MODE or POST /admin/maintenance) or because a PCloud error matched one of
+// the configured maintenance signatures
+type maintenanceState struct {
+	mu            sync.Mutex
+	manual        bool
+	detectedUntil time.Time
+	reason        string
+}
+
+var maintenance = &maintenanceState{manual: getEnvOrDefault("MAINTENANCE_MODE", "false") == "true"}
+
+// maintenanceSignatures are substrings of PCloud errors that indicate a maintenance window.
+// MAINTENANCE_SIGNATURES overrides the defaults (comma separated, case-insensitive).
+func maintenanceSignatures() []string {
+	raw := getEnvOrDefault("MAINTENANCE_SIGNATURES", "maintenance,status code(503)")
+	var signatures []string
+	for _, sig := range strings.Split(raw, ",") {
+		if sig = strings.ToLower(strings.TrimSpace(sig)); sig != "" {
+			signatures = append(signatures, sig)
+		}
+	}
+	return signatures
+}
+
+// maintenanceRetryAfter is how long a detected maintenance window is assumed to last, and the
+// Retry-After given to callers (MAINTENANCE_RETRY_AFTER, default 5m)
+func maintenanceRetryAfter() time.Duration {
+	d, err := time.ParseDuration(getEnvOrDefault("MAINTENANCE_RETRY_AFTER", "5m"))
+	if err != nil {
+		log.Printf("WARNING: Invalid MAINTENANCE_RETRY_AFTER, using 5m: %v", err)
+		return 5 * time.Minute
+	}
+	return d
+}
+
+// checkMaintenance inspects a PCloud error for a maintenance signature and returns the error unchanged
+func checkMaintenance(err error) error {
+	if err == nil {
+		return nil
+	}
+	msg := strings.ToLower(err.Error())
+	for _, sig := range maintenanceSignatures() {
+		if strings.Contains(msg, sig) {
+			until := time.Now().Add(maintenanceRetryAfter())
+			maintenance.mu.Lock()
+			maintenance.detectedUntil = until
+			maintenance.reason = err.Error()
+			maintenance.mu.Unlock()
+			log.Printf("WARNING: PCloud maintenance detected (signature %q), returning 503 until %s", sig, until.Format(time.RFC3339))
+			break
+		}
+	}
+	return err
+}
+
+// active reports whether requests should be turned away, and for how long
+func (m *maintenanceState) active() (bool, time.Duration, string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.manual {
+		return true, maintenanceRetryAfter(), "maintenance mode enabled by operator"
+	}
+	if remaining := time.Until(m.detectedUntil); remaining > 0 {
+		return true, remaining, m.reason
+	}
+	return false, 0, ""
+}
+
+// manualMode reports whether an operator turned maintenance mode on
+func (m *maintenanceState) manualMode() bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.manual
+}
+
+// maintenancePollInterval is how often a queued async operation checks whether the window ended
+var maintenancePollInterval = 5 * time.Second
+
+// wait blocks until no maintenance window is active
+func (m *maintenanceState) wait() {
+	for {
+		active, retryAfter, _ := m.active()
+		if !active {
+			return
+		}
+		time.Sleep(min(retryAfter, maintenancePollInterval))
+	}
+}
+
+// maintenanceMiddleware answers custom provider requests with 503 and Retry-After during a
+// PCloud maintenance window, so ARM retries later instead of failing the deployment. An async PUT
+// is let through instead: it is accepted with 202 and its operation starts when the window ends.
+func maintenanceMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if HasCustomProviderRequestPath(r) {
+			if active, retryAfter, reason := maintenance.active(); active {
+				if r.Method == http.MethodPut && asyncProvisioning(r) {
+					log.Printf("INFO: Queueing %s %s until the PCloud maintenance window ends", r.Method, r.URL.Path)
+					next.ServeHTTP(w, r)
+					return
+				}
+				seconds := int(retryAfter.Seconds()) + 1
+				log.Printf("INFO: Rejecting %s %s during PCloud maintenance, retry after %ds", r.Method, r.URL.Path, seconds)
+				w.Header().Set("Retry-After", strconv.Itoa(seconds))
+				sendJSONError(w, http.StatusServiceUnavailable, "PCloudMaintenance",
+					fmt.Sprintf("CyberArk Privilege Cloud is in a maintenance window (%s), retry after %d seconds", reason, seconds))
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// handleSetMaintenance lets an operator turn maintenance mode on or off: {"enabled": true}.
+// Turning it off also clears a detected maintenance window.
+func handleSetMaintenance(w http.ResponseWriter, r *http.Request) {
+	LogRequestDebug("SetMaintenance", r)
+
+	var request struct {
+		Enabled bool `json:"enabled"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		sendJSONError(w, http.StatusBadRequest, "InvalidRequestBody", fmt.Sprintf("Invalid request body: %v", err))
+		return
+	}
+
+	maintenance.mu.Lock()
+	maintenance.manual = request.Enabled
+	if !request.Enabled {
+		maintenance.detectedUntil = time.Time{}
+		maintenance.reason = ""
+	}
+	maintenance.mu.Unlock()
+	log.Printf("INFO: Maintenance mode set to %t by operator", request.Enabled)
+
+	active, retryAfter, reason := maintenance.active()
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"active":            active,
+		"retryAfterSeconds": int(retryAfter.Seconds()),
+		"reason":            reason,
+	})
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+
+	"github.com/davidh-cyberark/privilegeaccessmanager-sdk-go/pam"
+)
+
+// ReconcileMembersRequest is the body of the reconcileMembers action
+type ReconcileMembersRequest struct {
+	SafeName string                     `json:"safeName"`
+	Members  []pam.PostAddMemberRequest `json:"members"`
+	// RemoveExtras removes members that are not declared; predefined users and the provider's own user are always kept
+	RemoveExtras bool `json:"removeExtras,omitempty"`
+	// DryRun returns the planned changes without applying them
+	DryRun bool `json:"dryRun,omitempty"`
+}
+
+// MemberChange is one step of converging a safe's membership to the declared list
+type MemberChange struct {
+	MemberName  string          `json:"memberName"`
+	Action      string          `json:"action"` // add, update or remove
+	Permissions pam.Permissions `json:"permissions"`
+	Error       string          `json:"error,omitempty"`
+
+	member pam.PostAddMemberRequest
+}
+
+// safeMembersResponse is the body of GET /PasswordVault/API/Safes/{safeUrlId}/Members/
+type safeMembersResponse struct {
+	Value []pam.PostAddMemberResponse `json:"value"`
+	Count int                         `json:"count"`
+}
+
+// planMemberChanges compares the declared members with the current ones. Member names are
+// case-insensitive in PCloud.
+func planMemberChanges(declared []pam.PostAddMemberRequest, current []pam.PostAddMemberResponse, removeExtras bool, keep string) []MemberChange {
+	currentByName := map[string]pam.PostAddMemberResponse{}
+	for _, member := range current {
+		currentByName[strings.ToLower(member.MemberName)] = member
+	}
+
+	var changes []MemberChange
+	declaredNames := map[string]bool{}
+	for _, member := range declared {
+		name := strings.ToLower(member.MemberName)
+		declaredNames[name] = true
+		existing, ok := currentByName[name]
+		switch {
+		case !ok:
+			changes = append(changes, MemberChange{MemberName: member.MemberName, Action: "add", Permissions: member.Permissions, member: member})
+		case existing.Permissions != member.Permissions:
+			changes = append(changes, MemberChange{MemberName: existing.MemberName, Action: "update", Permissions: member.Permissions, member: member})
+		}
+	}
+
+	if removeExtras {
+		for _, member := range current {
+			name := strings.ToLower(member.MemberName)
+			if declaredNames[name] || member.IsPredefinedUser || (keep != "" && strings.EqualFold(member.MemberName, keep)) {
+				continue
+			}
+			changes = append(changes, MemberChange{MemberName: member.MemberName, Action: "remove", Permissions: member.Permissions})
+		}
+	}
+
+	sort.SliceStable(changes, func(i, j int) bool { return changes[i].MemberName < changes[j].MemberName })
+	return changes
+}
+
+// listSafeMembers returns the safe's members, excluding predefined users
+func listSafeMembers(ctx context.Context, pamClient *pam.Client, safeURLID string) ([]pam.PostAddMemberResponse, int, error) {
+	var current safeMembersResponse
+	retcode, err := pamDoRetry(ctx, pamClient, "members", http.MethodGet, fmt.Sprintf("/PasswordVault/API/Safes/%s/Members/", url.PathEscape(safeURLID)), nil, &current)
+	return current.Value, retcode, err
+}
+
+// applyMemberChanges carries out the planned changes, recording each failure on its change, and
+// returns a description of every failed change
+func applyMemberChanges(ctx context.Context, pamClient *pam.Client, safeURLID string, changes []MemberChange) []string {
+	var failed []string
+	for i := range changes {
+		change := &changes[i]
+		memberPath := fmt.Sprintf("/PasswordVault/API/Safes/%s/Members/%s/", url.PathEscape(safeURLID), url.PathEscape(change.MemberName))
+		var retcode int
+		var err error
+		switch change.Action {
+		case "add":
+			_, retcode, err = pcloudRetry(ctx, "members", "AddSafeMember", false, func(ctx context.Context) (pam.PostAddMemberResponse, int, error) {
+				return pamAddSafeMember(ctx, pamClient, change.member, safeURLID)
+			})
+		case "update":
+			retcode, err = pamDoRetry(ctx, pamClient, "members", http.MethodPut, memberPath, map[string]interface{}{"permissions": change.Permissions}, nil)
+		case "remove":
+			retcode, err = pamDoRetry(ctx, pamClient, "members", http.MethodDelete, memberPath, nil, nil)
+		}
+		if err != nil {
+			change.Error = fmt.Sprintf("(%d) %v", retcode, err)
+			failed = append(failed, fmt.Sprintf("%s %s: %s", change.Action, change.MemberName, change.Error))
+			continue
+		}
+		log.Printf("INFO: %s member %s on safe %s", change.Action, change.MemberName, safeURLID)
+	}
+	return failed
+}
+
+// handleReconcileMembers converges a safe's PCloud membership to the declared member list:
+// missing members are added, members with different permissions are updated, and with
+// removeExtras members that are not declared are removed
+func handleReconcileMembers(w http.ResponseWriter, r *http.Request, cpRequest CustomProviderRequestPath) {
+	LogRequestDebug("ReconcileMembers", r)
+
+	var request ReconcileMembersRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		sendJSONError(w, http.StatusBadRequest, "InvalidRequestBody", fmt.Sprintf("Invalid request body: %v", err))
+		return
+	}
+	if request.SafeName == "" {
+		sendJSONError(w, http.StatusBadRequest, "InvalidRequestBody", "safeName is required")
+		return
+	}
+	for _, member := range request.Members {
+		if member.MemberName == "" {
+			sendJSONError(w, http.StatusBadRequest, "InvalidRequestBody", "every member needs a memberName")
+			return
+		}
+	}
+
+	stopAuth := startPhase(r, "auth")
+	pamClient, err := createPAMClient()
+	stopAuth()
+	if err != nil {
+		sendJSONError(w, http.StatusInternalServerError, "PAMClientError", fmt.Sprintf("Failed to create PAM client: %v", err))
+		return
+	}
+
+	stopPAM := startPhase(r, "pam")
+	defer stopPAM()
+
+	safe, retcode, err := pcloudRetry(r.Context(), "safes", "GetSafeDetails", true, func(ctx context.Context) (pam.GetSafeDetails, int, error) {
+		return pamGetSafeDetails(ctx, pamClient, request.SafeName)
+	})
+	if retcode == http.StatusNotFound {
+		sendJSONError(w, http.StatusNotFound, "SafeNotFound", fmt.Sprintf("Safe not found: %s", request.SafeName))
+		return
+	}
+	if err != nil {
+		sendJSONError(w, http.StatusConflict, "GetSafeDetailsError", fmt.Sprintf("Failed to get safe: %v", checkMaintenance(err)))
+		return
+	}
+	current, retcode, err := listSafeMembers(r.Context(), pamClient, safe.SafeURLID)
+	if err != nil {
+		sendJSONError(w, http.StatusConflict, "GetSafeMembersError", fmt.Sprintf("Failed to list safe members: (%d) %v", retcode, err))
+		return
+	}
+
+	creds, _ := credentials.Credentials()
+	changes := planMemberChanges(request.Members, current, request.RemoveExtras, creds.User)
+	var failed []string
+	if !request.DryRun {
+		failed = applyMemberChanges(r.Context(), pamClient, safe.SafeURLID, changes)
+	}
+
+	if len(failed) > 0 {
+		sendJSONError(w, http.StatusConflict, "ReconcileMembersError",
+			fmt.Sprintf("%d of %d member changes failed on safe %s: %s", len(failed), len(changes), safe.SafeName, strings.Join(failed, "; ")))
+		return
+	}
+
+	if changes == nil {
+		changes = []MemberChange{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"safeName": safe.SafeName,
+		"dryRun":   request.DryRun,
+		"changes":  changes,
+	})
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/davidh-cyberark/privilegeaccessmanager-sdk-go/pam"
+)
+
+func TestPlanMemberChanges(t *testing.T) {
+	read := pam.Permissions{ListAccounts: true}
+	use := pam.Permissions{ListAccounts: true, UseAccounts: true}
+
+	current := []pam.PostAddMemberResponse{
+		{MemberName: "Vault Admins", Permissions: read},
+		{MemberName: "app-team", Permissions: read},
+		{MemberName: "old-team", Permissions: read},
+		{MemberName: "Administrator", IsPredefinedUser: true},
+		{MemberName: "svc-provider", Permissions: read},
+	}
+	declared := []pam.PostAddMemberRequest{
+		{MemberName: "vault admins", Permissions: read},
+		{MemberName: "app-team", Permissions: use},
+		{MemberName: "new-team", Permissions: read},
+	}
+
+	tests := []struct {
+		name         string
+		removeExtras bool
+		expected     []string
+	}{
+		{
+			name:     "add and update",
+			expected: []string{"update app-team", "add new-team"},
+		},
+		{
+			name:         "remove extras keeps predefined and provider users",
+			removeExtras: true,
+			expected:     []string{"update app-team", "add new-team", "remove old-team"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got []string
+			for _, change := range planMemberChanges(declared, current, tt.removeExtras, "svc-provider") {
+				got = append(got, change.Action+" "+change.MemberName)
+			}
+			if !reflect.DeepEqual(got, tt.expected) {
+				t.Errorf("expected %v, got %v", tt.expected, got)
+			}
+		})
+	}
+}
@@ -0,0 +1,279 @@
+package main
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Metrics are kept in process and exposed on GET /metrics in the Prometheus text format, so Azure
+// Monitor managed Prometheus (or any Prometheus) can scrape the container. When METRICS_TOKEN is set
+// the scraper must send "Authorization: Bearer $METRICS_TOKEN".
+
+// counter is a monotonically increasing metric, partitioned by label values
+type counter struct {
+	name   string
+	help   string
+	mu     sync.Mutex
+	values map[string]float64
+}
+
+// registeredCounters holds every counter created by newCounter, in creation order
+var registeredCounters []*counter
+
+func newCounter(name, help string) *counter {
+	c := &counter{name: name, help: help, values: map[string]float64{}}
+	registeredCounters = append(registeredCounters, c)
+	return c
+}
+
+// Inc adds one to the series identified by the label pairs (key1, value1, key2, value2, ...)
+func (c *counter) Inc(labels ...string) {
+	c.Add(1, labels...)
+}
+
+// Add adds v to the series identified by the label pairs
+func (c *counter) Add(v float64, labels ...string) {
+	key := labelKey(labels)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.values[key] += v
+}
+
+// Value returns the current value of a series
+func (c *counter) Value(labels ...string) float64 {
+	key := labelKey(labels)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.values[key]
+}
+
+// histogram counts observations in cumulative buckets, partitioned by label values
+type histogram struct {
+	name    string
+	help    string
+	buckets []float64
+	mu      sync.Mutex
+	series  map[string]*histogramSeries
+}
+
+type histogramSeries struct {
+	counts []uint64 // per bucket, not cumulative
+	sum    float64
+	count  uint64
+}
+
+// registeredHistograms holds every histogram created by newHistogram, in creation order
+var registeredHistograms []*histogram
+
+// durationBuckets are the bucket bounds, in seconds, of the request and PCloud call histograms
+var durationBuckets = []float64{0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60}
+
+func newHistogram(name, help string, buckets []float64) *histogram {
+	h := &histogram{name: name, help: help, buckets: buckets, series: map[string]*histogramSeries{}}
+	registeredHistograms = append(registeredHistograms, h)
+	return h
+}
+
+// Observe records a duration in the series identified by the label pairs
+func (h *histogram) Observe(d time.Duration, labels ...string) {
+	v := d.Seconds()
+	key := labelKey(labels)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	s, ok := h.series[key]
+	if !ok {
+		s = &histogramSeries{counts: make([]uint64, len(h.buckets))}
+		h.series[key] = s
+	}
+	for i, bound := range h.buckets {
+		if v <= bound {
+			s.counts[i]++
+			break
+		}
+	}
+	s.sum += v
+	s.count++
+}
+
+// Count returns the number of observations of a series
+func (h *histogram) Count(labels ...string) uint64 {
+	key := labelKey(labels)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if s, ok := h.series[key]; ok {
+		return s.count
+	}
+	return 0
+}
+
+// gauge is a metric read when /metrics is scraped
+type gauge struct {
+	name   string
+	help   string
+	labels []string
+	value  func() float64
+}
+
+// registeredGauges holds every gauge created by newGauge, in creation order
+var registeredGauges []*gauge
+
+func newGauge(name, help string, value func() float64, labels ...string) *gauge {
+	g := &gauge{name: name, help: help, labels: labels, value: value}
+	registeredGauges = append(registeredGauges, g)
+	return g
+}
+
+// labelKey renders label pairs as a stable `k1="v1",k2="v2"` string
+func labelKey(labels []string) string {
+	var parts []string
+	for i := 0; i+1 < len(labels); i += 2 {
+		parts = append(parts, labels[i]+`="`+labelEscaper.Replace(labels[i+1])+`"`)
+	}
+	sort.Strings(parts)
+	return strings.Join(parts, ",")
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+var slowRequestsTotal = newCounter("provider_slow_requests_total", "Requests that exceeded SLOW_REQUEST_THRESHOLD")
+
+var (
+	requestsTotal   = newCounter("provider_requests_total", "Requests handled, by method, resource type or action, and status code")
+	requestDuration = newHistogram("provider_request_duration_seconds", "Time to handle a request, by method and resource type or action", durationBuckets)
+
+	pcloudRequestsTotal   = newCounter("provider_pcloud_requests_total", "Calls to Privilege Cloud, by status code (0 when no response was received)")
+	pcloudErrorsTotal     = newCounter("provider_pcloud_errors_total", "Calls to Privilege Cloud that failed without a response, were throttled (429) or answered 5xx")
+	pcloudRequestDuration = newHistogram("provider_pcloud_request_duration_seconds", "Time of calls to Privilege Cloud, not counting time waiting for a concurrency slot", durationBuckets)
+
+	pamSessionRefreshesTotal = newCounter("provider_pcloud_session_refreshes_total", "PCloud sessions opened, by reason")
+	pamSessionErrorsTotal    = newCounter("provider_pcloud_session_errors_total", "Failed attempts to open a PCloud session")
+)
+
+func init() {
+	newGauge("provider_pcloud_concurrency_limit", "Current adaptive limit on concurrent PCloud calls", func() float64 {
+		limit, _ := pcloudLimiter.snapshot()
+		return float64(limit)
+	})
+	newGauge("provider_pcloud_in_flight", "PCloud calls in flight", func() float64 {
+		_, inFlight := pcloudLimiter.snapshot()
+		return float64(inFlight)
+	})
+	newGauge("provider_build_info", "Always 1; the version label is the provider version", func() float64 { return 1 }, "version", Version)
+}
+
+// observePCloudCall records the outcome of one PCloud call
+func observePCloudCall(status int, latency time.Duration) {
+	code := strconv.Itoa(status)
+	pcloudRequestsTotal.Inc("code", code)
+	pcloudRequestDuration.Observe(latency)
+	if status == 0 || status == http.StatusTooManyRequests || status >= 500 {
+		pcloudErrorsTotal.Inc("code", code)
+	}
+}
+
+// metricResourceType names the resource type or action of a request for metric labels. Only
+// registered names are used, so a caller cannot create series with arbitrary header values.
+func metricResourceType(r *http.Request) string {
+	if !HasCustomProviderRequestPath(r) {
+		return "none"
+	}
+	cpRequest, err := ParseCustomProviderRequestPath(r)
+	if err != nil {
+		return "unknown"
+	}
+	entries := resourceTypes
+	if r.Method == http.MethodPost {
+		entries = actions
+	}
+	if entry, ok := lookupProviderEntry(entries, cpRequest.ResourceTypeName); ok {
+		return entry.Name
+	}
+	return "unknown"
+}
+
+// writeMetrics renders every registered metric in the Prometheus text exposition format
+func writeMetrics(w io.Writer) {
+	for _, c := range registeredCounters {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", c.name, c.help, c.name)
+		c.mu.Lock()
+		keys := sortedKeys(c.values)
+		for _, key := range keys {
+			fmt.Fprintf(w, "%s %s\n", seriesName(c.name, key, ""), formatMetricValue(c.values[key]))
+		}
+		c.mu.Unlock()
+	}
+
+	for _, h := range registeredHistograms {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", h.name, h.help, h.name)
+		h.mu.Lock()
+		keys := sortedKeys(h.series)
+		for _, key := range keys {
+			s := h.series[key]
+			var cumulative uint64
+			for i, bound := range h.buckets {
+				cumulative += s.counts[i]
+				fmt.Fprintf(w, "%s %d\n", seriesName(h.name+"_bucket", key, `le="`+formatMetricValue(bound)+`"`), cumulative)
+			}
+			fmt.Fprintf(w, "%s %d\n", seriesName(h.name+"_bucket", key, `le="+Inf"`), s.count)
+			fmt.Fprintf(w, "%s %s\n", seriesName(h.name+"_sum", key, ""), formatMetricValue(s.sum))
+			fmt.Fprintf(w, "%s %d\n", seriesName(h.name+"_count", key, ""), s.count)
+		}
+		h.mu.Unlock()
+	}
+
+	for _, g := range registeredGauges {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n", g.name, g.help, g.name)
+		fmt.Fprintf(w, "%s %s\n", seriesName(g.name, labelKey(g.labels), ""), formatMetricValue(g.value()))
+	}
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// seriesName joins a metric name with its label key and an extra label such as le
+func seriesName(name, key, extra string) string {
+	labels := key
+	if extra != "" {
+		if labels != "" {
+			labels += ","
+		}
+		labels += extra
+	}
+	if labels == "" {
+		return name
+	}
+	return name + "{" + labels + "}"
+}
+
+func formatMetricValue(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// handleMetrics serves GET /metrics
+func handleMetrics(w http.ResponseWriter, r *http.Request) {
+	if expected := os.Getenv("METRICS_TOKEN"); expected != "" {
+		token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(token), []byte(expected)) != 1 {
+			log.Printf("WARNING: Rejected metrics request - RemoteAddr: %s", r.RemoteAddr)
+			sendJSONError(w, http.StatusUnauthorized, "Unauthorized", "Metrics token is missing or invalid")
+			return
+		}
+	}
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	writeMetrics(w)
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWriteMetrics(t *testing.T) {
+	savedCounters, savedHistograms, savedGauges := registeredCounters, registeredHistograms, registeredGauges
+	defer func() {
+		registeredCounters, registeredHistograms, registeredGauges = savedCounters, savedHistograms, savedGauges
+	}()
+	registeredCounters, registeredHistograms, registeredGauges = nil, nil, nil
+
+	c := newCounter("test_requests_total", "Requests")
+	c.Inc("method", "GET", "path", `a"b`)
+	c.Add(2, "method", "GET", "path", `a"b`)
+	h := newHistogram("test_duration_seconds", "Durations", []float64{0.1, 1})
+	h.Observe(50*time.Millisecond, "kind", "x")
+	h.Observe(500*time.Millisecond, "kind", "x")
+	h.Observe(5*time.Second, "kind", "x")
+	newGauge("test_in_flight", "In flight", func() float64 { return 4 })
+
+	var out strings.Builder
+	writeMetrics(&out)
+	for _, want := range []string{
+		"# TYPE test_requests_total counter\n",
+		`test_requests_total{method="GET",path="a\"b"} 3` + "\n",
+		"# TYPE test_duration_seconds histogram\n",
+		`test_duration_seconds_bucket{kind="x",le="0.1"} 1` + "\n",
+		`test_duration_seconds_bucket{kind="x",le="1"} 2` + "\n",
+		`test_duration_seconds_bucket{kind="x",le="+Inf"} 3` + "\n",
+		`test_duration_seconds_sum{kind="x"} 5.55` + "\n",
+		`test_duration_seconds_count{kind="x"} 3` + "\n",
+		"# TYPE test_in_flight gauge\ntest_in_flight 4\n",
+	} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("expected %q in\n%s", want, out.String())
+		}
+	}
+}
+
+func TestMetricResourceType(t *testing.T) {
+	tests := []struct {
+		method, requestPath, want string
+	}{
+		{"PUT", "/subscriptions/sub1/resourceGroups/rg1/providers/Microsoft.CustomProviders/resourceProviders/CyberArkProvider/Safes/safe1", "safes"},
+		{"POST", "/subscriptions/sub1/resourceGroups/rg1/providers/Microsoft.CustomProviders/resourceProviders/CyberArkProvider/verifyAccount", "verifyAccount"},
+		{"GET", "/subscriptions/sub1/resourceGroups/rg1/providers/Microsoft.CustomProviders/resourceProviders/CyberArkProvider/madeUp1234/x", "unknown"},
+		{"GET", "", "none"},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(tt.method, "/", nil)
+		if tt.requestPath != "" {
+			r.Header.Set("X-Ms-Customproviders-Requestpath", tt.requestPath)
+		}
+		if got := metricResourceType(r); got != tt.want {
+			t.Errorf("%s %s: expected %s, got %s", tt.method, tt.requestPath, tt.want, got)
+		}
+	}
+}
+
+func TestHandleMetricsToken(t *testing.T) {
+	t.Setenv("METRICS_TOKEN", "scrape")
+
+	w := httptest.NewRecorder()
+	handleMetrics(w, httptest.NewRequest("GET", "/metrics", nil))
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("expected 401 without a token, got %d", w.Code)
+	}
+
+	r := httptest.NewRequest("GET", "/metrics", nil)
+	r.Header.Set("Authorization", "Bearer scrape")
+	w = httptest.NewRecorder()
+	handleMetrics(w, r)
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "provider_requests_total") {
+		t.Errorf("expected metrics with the token, got %d: %s", w.Code, w.Body.String())
+	}
+}
@@ -0,0 +1,407 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// MOCK_PAM=true starts an in-memory fake of the Identity token endpoint and the PCloud APIs the
+// provider calls, and points the provider at it, so the provider can be run end to end (ARM
+// routing, handlers, SDK and REST calls) in CI or on a laptop without a CyberArk tenant. Nothing
+// is persisted; every start begins with no safes or accounts and a few built-in platforms.
+
+// mockPAMEnabled reports whether MOCK_PAM is set to true
+func mockPAMEnabled() bool {
+	enabled, _ := strconv.ParseBool(os.Getenv("MOCK_PAM"))
+	return enabled
+}
+
+// startMockPCloud serves the fake on MOCK_PAM_ADDR (default 127.0.0.1:0, a free port) and sets the
+// credential environment variables to use it
+func startMockPCloud() error {
+	listener, err := net.Listen("tcp", getEnvOrDefault("MOCK_PAM_ADDR", "127.0.0.1:0"))
+	if err != nil {
+		return fmt.Errorf("could not listen for the mock PCloud: %w", err)
+	}
+	server := &http.Server{Handler: newMockPCloud().router(), ReadHeaderTimeout: 10 * time.Second}
+	go server.Serve(listener)
+
+	mockURL := "http://" + listener.Addr().String()
+	os.Setenv("IDTENANTURL", mockURL)
+	os.Setenv("PCLOUDURL", mockURL)
+	os.Setenv("PAMUSER", getEnvOrDefault("PAMUSER", "mock-user"))
+	os.Setenv("PAMPASS", getEnvOrDefault("PAMPASS", "mock-pass"))
+	credentials = envCredentialSource{}
+	log.Printf("WARNING: MOCK_PAM is set, safes and accounts are kept in an in-memory fake PCloud at %s", mockURL)
+	return nil
+}
+
+// mockPCloud holds the fake tenant's objects; names are matched case-insensitively as PCloud does
+type mockPCloud struct {
+	mu        sync.Mutex
+	safes     map[string]map[string]interface{}
+	members   map[string]map[string]map[string]interface{}
+	accounts  map[string]map[string]interface{}
+	platforms []map[string]interface{}
+	nextID    int
+}
+
+func newMockPCloud() *mockPCloud {
+	platform := func(id, name, systemType string, required ...string) map[string]interface{} {
+		props := []map[string]string{}
+		for _, prop := range required {
+			props = append(props, map[string]string{"name": prop, "displayName": prop})
+		}
+		return map[string]interface{}{
+			"general":    map[string]interface{}{"id": id, "name": name, "systemType": systemType, "active": true, "platformType": "Regular"},
+			"properties": map[string]interface{}{"required": props, "optional": []map[string]string{}},
+		}
+	}
+	return &mockPCloud{
+		safes:    map[string]map[string]interface{}{},
+		members:  map[string]map[string]map[string]interface{}{},
+		accounts: map[string]map[string]interface{}{},
+		platforms: []map[string]interface{}{
+			platform("UnixSSH", "Unix via SSH", "*NIX", "Address", "Username"),
+			platform("WinDomain", "Windows Domain Account", "Windows", "Address", "Username"),
+			platform("MSSql", "MS SQL Server", "Database", "Address", "Username", "Database"),
+		},
+		nextID: 100,
+	}
+}
+
+func (m *mockPCloud) router() *mux.Router {
+	r := mux.NewRouter()
+	r.HandleFunc("/oauth2/platformtoken", m.handleToken).Methods("POST")
+	api := r.PathPrefix("/PasswordVault/API").Subrouter()
+	api.HandleFunc("/Platforms/", m.handleListPlatforms).Methods("GET")
+	api.HandleFunc("/Safes/", m.handleAddSafe).Methods("POST")
+	api.HandleFunc("/Safes/{safe}", m.handleSafe).Methods("GET", "PUT", "DELETE")
+	api.HandleFunc("/Safes/{safe}/", m.handleSafe).Methods("GET", "PUT", "DELETE")
+	api.HandleFunc("/Safes/{safe}/Members/", m.handleMembers).Methods("GET", "POST")
+	api.HandleFunc("/Safes/{safe}/Members/{member}/", m.handleMember).Methods("GET", "PUT", "DELETE")
+	api.HandleFunc("/Accounts", m.handleSearchAccounts).Methods("GET")
+	api.HandleFunc("/Accounts/", m.handleAddAccount).Methods("POST")
+	api.HandleFunc("/Accounts/{id}", m.handleAccount).Methods("GET", "PATCH", "DELETE")
+	api.HandleFunc("/Accounts/{id}/", m.handleAccount).Methods("GET", "PATCH", "DELETE")
+	api.HandleFunc("/Accounts/{id}/Password/Retrieve/", m.handleRetrieve).Methods("POST")
+	r.PathPrefix("/").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		log.Printf("WARNING: (MockPCloud) %s %s is not implemented", r.Method, r.URL.Path)
+		mockError(w, http.StatusNotImplemented, "MOCK0001", fmt.Sprintf("%s %s is not implemented by the mock", r.Method, r.URL.Path))
+	})
+	return r
+}
+
+func mockJSON(w http.ResponseWriter, status int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(body)
+}
+
+func mockError(w http.ResponseWriter, status int, code, message string) {
+	mockJSON(w, status, map[string]string{"ErrorCode": code, "ErrorMessage": message})
+}
+
+func mockBody(r *http.Request) (map[string]interface{}, error) {
+	body := map[string]interface{}{}
+	err := json.NewDecoder(r.Body).Decode(&body)
+	return body, err
+}
+
+func (m *mockPCloud) handleToken(w http.ResponseWriter, r *http.Request) {
+	mockJSON(w, http.StatusOK, map[string]interface{}{"access_token": "mock-token", "token_type": "Bearer", "expires_in": 3600})
+}
+
+func (m *mockPCloud) handleListPlatforms(w http.ResponseWriter, r *http.Request) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	mockJSON(w, http.StatusOK, map[string]interface{}{"Platforms": m.platforms, "Total": len(m.platforms)})
+}
+
+func (m *mockPCloud) handleAddSafe(w http.ResponseWriter, r *http.Request) {
+	body, err := mockBody(r)
+	name, _ := body["safeName"].(string)
+	if err != nil || name == "" {
+		mockError(w, http.StatusBadRequest, "CAWS00001E", "safeName is required")
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	key := strings.ToLower(name)
+	if _, ok := m.safes[key]; ok {
+		mockError(w, http.StatusConflict, "SFWS0002", fmt.Sprintf("Safe %s already exists", name))
+		return
+	}
+	safe := map[string]interface{}{"safeUrlId": name, "safeName": name, "description": "", "location": "\\", "olacEnabled": false,
+		"numberOfDaysRetention": 7, "creationTime": time.Now().Unix(), "lastModificationTime": time.Now().UnixMicro()}
+	for _, field := range []string{"description", "location", "managingCPM", "numberOfDaysRetention", "numberOfVersionsRetention", "autoPurgeEnabled"} {
+		if value, ok := body[field]; ok {
+			safe[field] = value
+		}
+	}
+	if _, ok := body["numberOfVersionsRetention"]; ok {
+		delete(safe, "numberOfDaysRetention")
+	}
+	if olac, ok := body["oLACEnabled"]; ok {
+		safe["olacEnabled"] = olac
+	}
+	m.safes[key] = safe
+	m.members[key] = map[string]map[string]interface{}{}
+	mockJSON(w, http.StatusCreated, safe)
+}
+
+func (m *mockPCloud) handleSafe(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["safe"]
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	key := strings.ToLower(name)
+	safe, ok := m.safes[key]
+	if !ok {
+		mockError(w, http.StatusNotFound, "SFWS0007", fmt.Sprintf("Safe %s does not exist", name))
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		mockJSON(w, http.StatusOK, safe)
+	case http.MethodPut:
+		body, err := mockBody(r)
+		if err != nil {
+			mockError(w, http.StatusBadRequest, "CAWS00001E", err.Error())
+			return
+		}
+		for field, value := range body {
+			if field != "safeName" && field != "safeUrlId" {
+				safe[field] = value
+			}
+		}
+		safe["lastModificationTime"] = time.Now().UnixMicro()
+		mockJSON(w, http.StatusOK, safe)
+	case http.MethodDelete:
+		for _, account := range m.accounts {
+			if strings.EqualFold(account["safeName"].(string), name) {
+				mockError(w, http.StatusConflict, "SFWS0005", fmt.Sprintf("Safe %s contains accounts", name))
+				return
+			}
+		}
+		delete(m.safes, key)
+		delete(m.members, key)
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func (m *mockPCloud) handleMembers(w http.ResponseWriter, r *http.Request) {
+	safeKey := strings.ToLower(mux.Vars(r)["safe"])
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	members, ok := m.members[safeKey]
+	if !ok {
+		mockError(w, http.StatusNotFound, "SFWS0007", "Safe does not exist")
+		return
+	}
+	if r.Method == http.MethodGet {
+		value := []map[string]interface{}{}
+		for _, member := range members {
+			value = append(value, member)
+		}
+		sort.Slice(value, func(i, j int) bool { return value[i]["memberName"].(string) < value[j]["memberName"].(string) })
+		mockJSON(w, http.StatusOK, map[string]interface{}{"value": value, "count": len(value)})
+		return
+	}
+	body, err := mockBody(r)
+	name, _ := body["memberName"].(string)
+	if err != nil || name == "" {
+		mockError(w, http.StatusBadRequest, "CAWS00001E", "memberName is required")
+		return
+	}
+	if _, exists := members[strings.ToLower(name)]; exists {
+		mockError(w, http.StatusConflict, "SFWS0012", fmt.Sprintf("%s is already a member", name))
+		return
+	}
+	body["safeUrlId"] = m.safes[safeKey]["safeUrlId"]
+	body["safeName"] = m.safes[safeKey]["safeName"]
+	members[strings.ToLower(name)] = body
+	mockJSON(w, http.StatusCreated, body)
+}
+
+func (m *mockPCloud) handleMember(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	members := m.members[strings.ToLower(vars["safe"])]
+	member, ok := members[strings.ToLower(vars["member"])]
+	if !ok {
+		mockError(w, http.StatusNotFound, "SFWS0015", fmt.Sprintf("%s is not a member of safe %s", vars["member"], vars["safe"]))
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		mockJSON(w, http.StatusOK, member)
+	case http.MethodPut:
+		body, err := mockBody(r)
+		if err != nil {
+			mockError(w, http.StatusBadRequest, "CAWS00001E", err.Error())
+			return
+		}
+		if permissions, ok := body["permissions"]; ok {
+			member["permissions"] = permissions
+		}
+		mockJSON(w, http.StatusOK, member)
+	case http.MethodDelete:
+		delete(members, strings.ToLower(vars["member"]))
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// handleSearchAccounts supports the "safeName eq X" filter and a search on the account name
+func (m *mockPCloud) handleSearchAccounts(w http.ResponseWriter, r *http.Request) {
+	safeName := strings.TrimSpace(strings.TrimPrefix(r.URL.Query().Get("filter"), "safeName eq"))
+	search := strings.ToLower(r.URL.Query().Get("search"))
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	value := []map[string]interface{}{}
+	for _, account := range m.accounts {
+		if safeName != "" && !strings.EqualFold(account["safeName"].(string), safeName) {
+			continue
+		}
+		if search != "" && !strings.Contains(strings.ToLower(account["name"].(string)), search) {
+			continue
+		}
+		value = append(value, mockAccountView(account))
+	}
+	sort.Slice(value, func(i, j int) bool { return value[i]["id"].(string) < value[j]["id"].(string) })
+
+	// Like PCloud, a search returns one page (50 accounts unless limit says otherwise, at most 1000)
+	// and count is the number of matching accounts
+	offset, _ := strconv.Atoi(r.URL.Query().Get("offset"))
+	limit, err := strconv.Atoi(r.URL.Query().Get("limit"))
+	if err != nil || limit <= 0 {
+		limit = 50
+	}
+	limit = min(limit, 1000)
+	count := len(value)
+	offset = min(max(offset, 0), count)
+	page := value[offset:min(offset+limit, count)]
+	response := map[string]interface{}{"value": page, "count": count}
+	if offset+len(page) < count {
+		response["nextLink"] = fmt.Sprintf("api/accounts?offset=%d&limit=%d", offset+len(page), limit)
+	}
+	mockJSON(w, http.StatusOK, response)
+}
+
+// mockAccountView is an account as PCloud returns it, without its secret
+func mockAccountView(account map[string]interface{}) map[string]interface{} {
+	view := map[string]interface{}{}
+	for field, value := range account {
+		if field != "secret" {
+			view[field] = value
+		}
+	}
+	return view
+}
+
+func (m *mockPCloud) handleAddAccount(w http.ResponseWriter, r *http.Request) {
+	body, err := mockBody(r)
+	if err != nil {
+		mockError(w, http.StatusBadRequest, "CAWS00001E", err.Error())
+		return
+	}
+	safeName, _ := body["safeName"].(string)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	safe, ok := m.safes[strings.ToLower(safeName)]
+	if !ok {
+		mockError(w, http.StatusNotFound, "PASWS027E", fmt.Sprintf("Safe %s does not exist", safeName))
+		return
+	}
+	if name, _ := body["name"].(string); name == "" {
+		body["name"] = fmt.Sprintf("%v-%v-%v", body["platformId"], body["address"], body["userName"])
+	}
+	for _, account := range m.accounts {
+		if strings.EqualFold(account["safeName"].(string), safeName) && strings.EqualFold(account["name"].(string), body["name"].(string)) {
+			mockError(w, http.StatusConflict, "PASWS004E", fmt.Sprintf("Account %s already exists", body["name"]))
+			return
+		}
+	}
+	m.nextID++
+	body["id"] = fmt.Sprintf("%d_%d", 10, m.nextID)
+	body["safeName"] = safe["safeName"]
+	body["createdTime"] = time.Now().Unix()
+	if _, ok := body["secretType"]; !ok {
+		body["secretType"] = "password"
+	}
+	if _, ok := body["secretManagement"]; !ok {
+		body["secretManagement"] = map[string]interface{}{"automaticManagementEnabled": true}
+	}
+	m.accounts[body["id"].(string)] = body
+	mockJSON(w, http.StatusCreated, mockAccountView(body))
+}
+
+func (m *mockPCloud) handleAccount(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	account, ok := m.accounts[id]
+	if !ok {
+		mockError(w, http.StatusNotFound, "PASWS165E", fmt.Sprintf("Account %s does not exist", id))
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		mockJSON(w, http.StatusOK, mockAccountView(account))
+	case http.MethodPatch:
+		var ops []struct {
+			Op    string      `json:"op"`
+			Path  string      `json:"path"`
+			Value interface{} `json:"value"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&ops); err != nil {
+			mockError(w, http.StatusBadRequest, "CAWS00001E", err.Error())
+			return
+		}
+		for _, op := range ops {
+			path := strings.Split(strings.Trim(op.Path, "/"), "/")
+			target := account
+			if len(path) == 2 {
+				nested, _ := account[path[0]].(map[string]interface{})
+				if nested == nil {
+					nested = map[string]interface{}{}
+					account[path[0]] = nested
+				}
+				target = nested
+			}
+			field := path[len(path)-1]
+			if op.Op == "remove" {
+				delete(target, field)
+			} else {
+				target[field] = op.Value
+			}
+		}
+		mockJSON(w, http.StatusOK, mockAccountView(account))
+	case http.MethodDelete:
+		delete(m.accounts, id)
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func (m *mockPCloud) handleRetrieve(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	account, ok := m.accounts[id]
+	if !ok {
+		mockError(w, http.StatusNotFound, "PASWS165E", fmt.Sprintf("Account %s does not exist", id))
+		return
+	}
+	mockJSON(w, http.StatusOK, account["secret"])
+}
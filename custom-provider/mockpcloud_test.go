@@ -0,0 +1,64 @@
+package main
+
+import (
+	"context"
+	"net/http/httptest"
+	"testing"
+
+	"cyberark-custom-provider/client"
+)
+
+func TestMockPCloudEndToEnd(t *testing.T) {
+	pcloud := httptest.NewServer(newMockPCloud().router())
+	defer pcloud.Close()
+	t.Setenv("IDTENANTURL", pcloud.URL)
+	t.Setenv("PCLOUDURL", pcloud.URL)
+	t.Setenv("PAMUSER", "mock-user")
+	t.Setenv("PAMPASS", "mock-pass")
+
+	stateStore = newBufferedStateStore(newMemoryStateStore(), 0)
+	for _, name := range flusherNames() {
+		flushersMu.Lock()
+		flush := flushers[name]
+		flushersMu.Unlock()
+		flush()
+	}
+
+	router, _ := newRouter()
+	provider := httptest.NewServer(router)
+	defer provider.Close()
+	c := client.New(provider.URL, "sub1", "rg1", "CyberArkProvider")
+	ctx := context.Background()
+
+	if _, err := c.CreateSafe(ctx, "safe1", client.SafeProperties{SafeName: "safe1", Description: "Linux root accounts"}); err != nil {
+		t.Fatalf("create safe: %v", err)
+	}
+	recentlyCreated.Flush()
+	safe, err := c.GetSafe(ctx, "safe1")
+	if err != nil || safe.Properties["description"] != "Linux root accounts" {
+		t.Fatalf("get safe: expected the created safe, got %+v, %v", safe, err)
+	}
+
+	account := client.AccountProperties{SafeName: "safe1", Name: "root-web01", PlatformID: "UnixSSH", Address: "web01", UserName: "root", Secret: "s3cret"}
+	if _, err := c.CreateAccount(ctx, account); err != nil {
+		t.Fatalf("create account: %v", err)
+	}
+	recentlyCreated.Flush()
+	got, err := c.GetAccount(ctx, "safe1", "root-web01")
+	if err != nil || got.Properties["address"] != "web01" {
+		t.Fatalf("get account: expected the created account, got %+v, %v", got, err)
+	}
+	if _, ok := got.Properties["secret"]; ok {
+		t.Errorf("get account: the secret must not be returned")
+	}
+
+	if err := c.DeleteAccount(ctx, "safe1", "root-web01"); err != nil {
+		t.Errorf("delete account: %v", err)
+	}
+	if err := c.DeleteSafe(ctx, "safe1"); err != nil {
+		t.Errorf("delete safe: %v", err)
+	}
+	if _, err := c.GetSafe(ctx, "safe1"); !client.IsNotFound(err) {
+		t.Errorf("get deleted safe: expected not found, got %v", err)
+	}
+}
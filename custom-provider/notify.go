@@ -0,0 +1,204 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Safe and account lifecycle events can be published for audit pipelines: set
+// EVENTGRID_TOPIC_ENDPOINT to send them to an Azure Event Grid topic, NOTIFY_WEBHOOK_URL to POST
+// them to any webhook, or both. Events use the Event Grid event schema and are sent in batches
+// every few seconds, so a slow or unreachable receiver never holds up ARM requests; a failed
+// batch is kept for the next attempt.
+
+// lifecycleEvent is one event in the Event Grid event schema
+type lifecycleEvent struct {
+	ID          string             `json:"id"`
+	EventType   string             `json:"eventType"`
+	Subject     string             `json:"subject"`
+	EventTime   string             `json:"eventTime"`
+	Data        lifecycleEventData `json:"data"`
+	DataVersion string             `json:"dataVersion"`
+}
+
+// lifecycleEventData identifies the changed resource in ARM and in PCloud
+type lifecycleEventData struct {
+	ResourceID   string `json:"resourceId"`
+	ResourceType string `json:"resourceType"`
+	// Operation is Created, Updated, Deleted or Retained (deleted from ARM, kept in PCloud)
+	Operation   string `json:"operation"`
+	SafeName    string `json:"safeName,omitempty"`
+	AccountName string `json:"accountName,omitempty"`
+	// PCloudID is the safe URL ID or the account ID
+	PCloudID      string `json:"pcloudId,omitempty"`
+	CorrelationID string `json:"correlationId,omitempty"`
+	OperationID   string `json:"operationId"`
+}
+
+// notifier batches events for one receiver
+type notifier struct {
+	name     string
+	endpoint string
+	headers  map[string]string
+	// tokenResource, when set, is the resource of a managed identity token sent as a bearer token
+	tokenResource string
+	client        *http.Client
+
+	mu      sync.Mutex
+	pending []lifecycleEvent
+}
+
+// maxPendingEvents bounds the events kept while a receiver is unreachable; older ones are dropped
+const maxPendingEvents = 1024
+
+var notifiers = newNotifiers()
+
+func newNotifiers() []*notifier {
+	var out []*notifier
+	if endpoint := os.Getenv("EVENTGRID_TOPIC_ENDPOINT"); endpoint != "" {
+		n := &notifier{name: "eventgrid", endpoint: endpoint, headers: map[string]string{}, client: newOutboundClient(10 * time.Second)}
+		if key := os.Getenv("EVENTGRID_TOPIC_KEY"); key != "" {
+			n.headers["aeg-sas-key"] = key
+		} else {
+			n.tokenResource = "https://eventgrid.azure.net"
+		}
+		out = append(out, n)
+	}
+	if endpoint := os.Getenv("NOTIFY_WEBHOOK_URL"); endpoint != "" {
+		out = append(out, &notifier{name: "webhook", endpoint: endpoint, headers: otlpHeaders(os.Getenv("NOTIFY_WEBHOOK_HEADERS")), client: newOutboundClient(10 * time.Second)})
+	}
+	return out
+}
+
+func init() {
+	for _, n := range notifiers {
+		n := n
+		registerDependency(n.name, func() map[string]interface{} {
+			n.mu.Lock()
+			defer n.mu.Unlock()
+			return map[string]interface{}{"endpoint": redactURL(n.endpoint), "pendingEvents": len(n.pending)}
+		})
+		registerShutdownHook("notify-"+n.name, func() { n.flush() })
+		go func() {
+			for range time.Tick(5 * time.Second) {
+				n.flush()
+			}
+		}()
+	}
+}
+
+// notifierEndpoints lists the configured receivers for the startup fingerprint, without secrets
+func notifierEndpoints() []string {
+	endpoints := []string{}
+	for _, n := range notifiers {
+		endpoints = append(endpoints, n.name+" "+redactURL(n.endpoint))
+	}
+	return endpoints
+}
+
+// notifyLifecycle publishes that the provider created, updated or deleted the resource rec describes
+func notifyLifecycle(r *http.Request, operation string, rec ResourceRecord) {
+	if len(notifiers) == 0 {
+		return
+	}
+	kind := strings.TrimSuffix(rec.ResourceType, "s")
+	if kind != "" {
+		kind = strings.ToUpper(kind[:1]) + kind[1:]
+	}
+	event := lifecycleEvent{
+		ID:        newOperationID(),
+		EventType: fmt.Sprintf("CyberArk.CustomProvider.%s%s", kind, operation),
+		Subject:   rec.ResourceID,
+		EventTime: time.Now().UTC().Format(time.RFC3339Nano),
+		Data: lifecycleEventData{
+			ResourceID:    rec.ResourceID,
+			ResourceType:  rec.ResourceType,
+			Operation:     operation,
+			SafeName:      rec.SafeName,
+			AccountName:   rec.AccountName,
+			PCloudID:      rec.PCloudID,
+			CorrelationID: r.Header.Get("X-Ms-Correlation-Request-Id"),
+			OperationID:   operationID(r),
+		},
+		DataVersion: "1.0",
+	}
+	for _, n := range notifiers {
+		n.queue(event)
+	}
+}
+
+func (n *notifier) queue(event lifecycleEvent) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.pending = append(n.pending, event)
+	if len(n.pending) > maxPendingEvents {
+		n.pending = n.pending[len(n.pending)-maxPendingEvents:]
+	}
+}
+
+// flush sends the queued events as one batch; on failure they are kept for the next flush
+func (n *notifier) flush() error {
+	n.mu.Lock()
+	batch := n.pending
+	n.pending = nil
+	n.mu.Unlock()
+	if len(batch) == 0 {
+		return nil
+	}
+
+	err := n.post(batch)
+	recordDependencyResult(n.name, err)
+	if err != nil {
+		log.Printf("WARNING: Could not send %d lifecycle events to %s: %v", len(batch), redactURL(n.endpoint), err)
+		n.mu.Lock()
+		n.pending = append(batch, n.pending...)
+		if len(n.pending) > maxPendingEvents {
+			n.pending = n.pending[len(n.pending)-maxPendingEvents:]
+		}
+		n.mu.Unlock()
+	}
+	return err
+}
+
+func (n *notifier) post(batch []lifecycleEvent) error {
+	body, err := json.Marshal(batch)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, n.endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for key, value := range n.headers {
+		req.Header.Set(key, value)
+	}
+	if n.tokenResource != "" {
+		token, err := getManagedIdentityToken(n.tokenResource)
+		if err != nil {
+			return fmt.Errorf("could not get a managed identity token: %w", err)
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := n.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode == http.StatusUnauthorized && n.tokenResource != "" {
+		forgetManagedIdentityToken(n.tokenResource)
+	}
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("POST %s returned status %d", req.URL.Path, resp.StatusCode)
+	}
+	return nil
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestNotifier(t *testing.T) {
+	var received [][]lifecycleEvent
+	var keys []string
+	status := http.StatusInternalServerError
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var batch []lifecycleEvent
+		if err := json.NewDecoder(r.Body).Decode(&batch); err != nil {
+			t.Errorf("invalid event batch: %v", err)
+		}
+		received = append(received, batch)
+		keys = append(keys, r.Header.Get("aeg-sas-key"))
+		w.WriteHeader(status)
+	}))
+	defer server.Close()
+
+	n := &notifier{name: "eventgrid", endpoint: server.URL, headers: map[string]string{"aeg-sas-key": "key1"}, client: &http.Client{Timeout: time.Second}}
+	saved := notifiers
+	notifiers = []*notifier{n}
+	defer func() { notifiers = saved }()
+
+	r := httptest.NewRequest(http.MethodPut, "/", nil)
+	r.Header.Set("X-Ms-Correlation-Request-Id", "corr1")
+	safeID := "/subscriptions/sub1/resourceGroups/rg1/providers/Microsoft.CustomProviders/resourceProviders/CyberArkProvider/safes/safe1"
+	notifyLifecycle(r, "Created", ResourceRecord{ResourceID: safeID, ResourceType: "safes", SafeName: "safe1", PCloudID: "safe1"})
+	notifyLifecycle(r, "Deleted", ResourceRecord{ResourceID: safeID + "x", ResourceType: "accounts", SafeName: "safe1", AccountName: "root", PCloudID: "12_3"})
+
+	// A failed batch is kept and sent again with later events
+	if err := n.flush(); err == nil {
+		t.Fatal("expected the flush to fail")
+	}
+	status = http.StatusOK
+	if err := n.flush(); err != nil {
+		t.Fatalf("flush: %v", err)
+	}
+	if len(received) != 2 || len(received[1]) != 2 || keys[1] != "key1" {
+		t.Fatalf("expected the batch of 2 events to be sent twice with the key, got %+v %v", received, keys)
+	}
+	created, deleted := received[1][0], received[1][1]
+	if created.EventType != "CyberArk.CustomProvider.SafeCreated" || created.Subject != safeID || created.Data.PCloudID != "safe1" || created.Data.CorrelationID != "corr1" {
+		t.Errorf("unexpected created event %+v", created)
+	}
+	if deleted.EventType != "CyberArk.CustomProvider.AccountDeleted" || deleted.Data.AccountName != "root" || deleted.Data.PCloudID != "12_3" || deleted.DataVersion != "1.0" {
+		t.Errorf("unexpected deleted event %+v", deleted)
+	}
+	if err := n.flush(); err != nil || len(received) != 2 {
+		t.Errorf("expected nothing left to send, got %v after %d batches", err, len(received))
+	}
+}
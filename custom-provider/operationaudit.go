@@ -0,0 +1,310 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// OperationAuditEntry records one ARM request handled by the provider
+type OperationAuditEntry struct {
+	Time            time.Time `json:"time"`
+	SubscriptionID  string    `json:"subscriptionId"`
+	ResourceGroup   string    `json:"resourceGroup"`
+	ResourceID      string    `json:"resourceId"`
+	Operation       string    `json:"operation"`
+	OperationID     string    `json:"operationId"`
+	CorrelationID   string    `json:"correlationId,omitempty"`
+	ClientRequestID string    `json:"clientRequestId,omitempty"`
+	Status          int       `json:"status"`
+	// Caller, CallerObjectID and CallerTenantID are the principal ARM reports in its request headers
+	Caller         string `json:"caller,omitempty"`
+	CallerObjectID string `json:"callerObjectId,omitempty"`
+	CallerTenantID string `json:"callerTenantId,omitempty"`
+	// BodySHA256 is the hex SHA-256 of the request body; the body itself may hold secrets
+	BodySHA256 string `json:"bodySha256,omitempty"`
+	// ErrorCode is the error code of a failed request, e.g. AddAccountError
+	ErrorCode string `json:"errorCode,omitempty"`
+}
+
+// operationAuditHeader is the CSV header, in the order written by csvRecord
+var operationAuditHeader = []string{"time", "subscriptionId", "resourceGroup", "resourceId", "operation", "operationId", "correlationId", "clientRequestId", "status"}
+
+func (e OperationAuditEntry) csvRecord() []string {
+	return []string{e.Time.Format(time.RFC3339), e.SubscriptionID, e.ResourceGroup, e.ResourceID, e.Operation,
+		e.OperationID, e.CorrelationID, e.ClientRequestID, strconv.Itoa(e.Status)}
+}
+
+var (
+	operationAuditMu sync.Mutex
+	operationAudit   []OperationAuditEntry
+)
+
+// operationAuditCapacity is the number of entries kept in memory for exportAudit (OPERATION_AUDIT_CAPACITY, default 10000)
+var operationAuditCapacity = func() int {
+	capacity, err := strconv.Atoi(getEnvOrDefault("OPERATION_AUDIT_CAPACITY", "10000"))
+	if err != nil || capacity < 1 {
+		log.Printf("WARNING: Invalid OPERATION_AUDIT_CAPACITY, using 10000")
+		return 10000
+	}
+	return capacity
+}()
+
+// recordOperationAudit logs the entry and appends it to the in-memory trail; entries of mutating
+// requests are also shipped to the configured audit stores (see auditsink.go)
+func recordOperationAudit(entry OperationAuditEntry, mutating bool) {
+	line, _ := json.Marshal(entry)
+	log.Printf("AUDIT: %s", line)
+	if mutating {
+		shipOperationAudit(entry)
+	}
+
+	operationAuditMu.Lock()
+	defer operationAuditMu.Unlock()
+	operationAudit = append(operationAudit, entry)
+	if len(operationAudit) > operationAuditCapacity {
+		operationAudit = operationAudit[len(operationAudit)-operationAuditCapacity:]
+	}
+}
+
+// operationAuditMiddleware writes an audit entry for every custom provider request
+func operationAuditMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !HasCustomProviderRequestPath(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		cpRequest, err := ParseCustomProviderRequestPath(r)
+		if err != nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		mutating := mutatingOperation(r.Method, cpRequest.ResourceTypeName)
+		var bodySum string
+		if mutating && r.Body != nil {
+			body, err := io.ReadAll(r.Body)
+			r.Body.Close()
+			if err == nil && len(body) > 0 {
+				sum := sha256.Sum256(body)
+				bodySum = hex.EncodeToString(sum[:])
+			}
+			r.Body = io.NopCloser(bytes.NewReader(body))
+		}
+
+		rec := &auditRecorder{statusRecorder: statusRecorder{ResponseWriter: w, status: http.StatusOK}}
+		next.ServeHTTP(rec, r)
+
+		operation := r.Method
+		if r.Method == http.MethodPost {
+			operation = "POST " + cpRequest.ResourceTypeName
+		}
+		recordOperationAudit(OperationAuditEntry{
+			Time:            time.Now().UTC(),
+			SubscriptionID:  cpRequest.Subscriptions,
+			ResourceGroup:   cpRequest.ResourceGroups,
+			ResourceID:      cpRequest.ID(),
+			Operation:       operation,
+			OperationID:     operationID(r),
+			CorrelationID:   r.Header.Get("X-Ms-Correlation-Request-Id"),
+			ClientRequestID: r.Header.Get("X-Ms-Client-Request-Id"),
+			Status:          rec.status,
+			Caller:          r.Header.Get("X-Ms-Client-Principal-Name"),
+			CallerObjectID:  r.Header.Get("X-Ms-Client-Principal-Id"),
+			CallerTenantID:  r.Header.Get("X-Ms-Client-Tenant-Id"),
+			BodySHA256:      bodySum,
+			ErrorCode:       rec.errorCode(),
+		}, mutating)
+	})
+}
+
+// auditRecorder keeps the start of an error response so its error code can be audited
+type auditRecorder struct {
+	statusRecorder
+	errorBody []byte
+}
+
+func (ar *auditRecorder) Write(b []byte) (int, error) {
+	if ar.status >= 400 && len(ar.errorBody) < 4096 {
+		ar.errorBody = append(ar.errorBody, b...)
+	}
+	return ar.statusRecorder.Write(b)
+}
+
+// errorCode returns error.code of the response, or "" when it succeeded
+func (ar *auditRecorder) errorCode() string {
+	var body ErrorResponse
+	if ar.status < 400 || json.Unmarshal(ar.errorBody, &body) != nil {
+		return ""
+	}
+	return body.Error.Code
+}
+
+// ExportAuditRequest is the body of the exportAudit action
+type ExportAuditRequest struct {
+	From   string `json:"from,omitempty"`   // RFC3339, default 24 hours ago
+	To     string `json:"to,omitempty"`     // RFC3339, default now
+	Format string `json:"format,omitempty"` // "jsonl" (default) or "csv"
+	// BlobSasURL, when set, receives the export as a block blob instead of the response body
+	BlobSasURL string `json:"blobSasUrl,omitempty"`
+}
+
+// handleExportAudit returns the audit entries of the caller's subscription for a time range, or
+// uploads them to a caller-supplied blob SAS URL. Only the subscription in the request path is
+// exported, so a subscription owner can never read another subscription's entries.
+func handleExportAudit(w http.ResponseWriter, r *http.Request, cpRequest CustomProviderRequestPath) {
+	LogRequestDebug("ExportAudit", r)
+
+	var request ExportAuditRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil && err != io.EOF {
+		sendJSONError(w, http.StatusBadRequest, "InvalidRequestBody", fmt.Sprintf("Invalid request body: %v", err))
+		return
+	}
+	if request.Format == "" {
+		request.Format = "jsonl"
+	}
+	if request.Format != "jsonl" && request.Format != "csv" {
+		sendJSONError(w, http.StatusBadRequest, "InvalidFormat", fmt.Sprintf("Format must be 'jsonl' or 'csv', got %q", request.Format))
+		return
+	}
+
+	to := time.Now().UTC()
+	from := to.Add(-24 * time.Hour)
+	var err error
+	if request.From != "" {
+		if from, err = time.Parse(time.RFC3339, request.From); err != nil {
+			sendJSONError(w, http.StatusBadRequest, "InvalidTimeRange", fmt.Sprintf("Invalid from: %v", err))
+			return
+		}
+	}
+	if request.To != "" {
+		if to, err = time.Parse(time.RFC3339, request.To); err != nil {
+			sendJSONError(w, http.StatusBadRequest, "InvalidTimeRange", fmt.Sprintf("Invalid to: %v", err))
+			return
+		}
+	}
+	if to.Before(from) {
+		sendJSONError(w, http.StatusBadRequest, "InvalidTimeRange", "to must not be before from")
+		return
+	}
+
+	var entries []OperationAuditEntry
+	operationAuditMu.Lock()
+	for _, entry := range operationAudit {
+		if strings.EqualFold(entry.SubscriptionID, cpRequest.Subscriptions) && !entry.Time.Before(from) && !entry.Time.After(to) {
+			entries = append(entries, entry)
+		}
+	}
+	operationAuditMu.Unlock()
+
+	content, contentType, err := formatOperationAudit(entries, request.Format)
+	if err != nil {
+		sendJSONError(w, http.StatusInternalServerError, "ExportAuditError", err.Error())
+		return
+	}
+
+	response := map[string]interface{}{
+		"subscriptionId": cpRequest.Subscriptions,
+		"from":           from.Format(time.RFC3339),
+		"to":             to.Format(time.RFC3339),
+		"format":         request.Format,
+		"count":          len(entries),
+	}
+	if request.BlobSasURL != "" {
+		blobURL, err := uploadAuditBlob(request.BlobSasURL, content, contentType)
+		if err != nil {
+			sendJSONError(w, http.StatusBadRequest, "BlobUploadError", err.Error())
+			return
+		}
+		response["blobUrl"] = blobURL
+	} else {
+		response["content"] = string(content)
+	}
+
+	log.Printf("INFO: (ExportAudit) exported %d entries for subscription %s", len(entries), cpRequest.Subscriptions)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// formatOperationAudit renders entries as JSON lines or CSV with a header row
+func formatOperationAudit(entries []OperationAuditEntry, format string) ([]byte, string, error) {
+	var buf bytes.Buffer
+	if format == "csv" {
+		cw := csv.NewWriter(&buf)
+		cw.Write(operationAuditHeader)
+		for _, entry := range entries {
+			cw.Write(entry.csvRecord())
+		}
+		cw.Flush()
+		return buf.Bytes(), "text/csv", cw.Error()
+	}
+
+	enc := json.NewEncoder(&buf)
+	for _, entry := range entries {
+		if err := enc.Encode(entry); err != nil {
+			return nil, "", err
+		}
+	}
+	return buf.Bytes(), "application/x-ndjson", nil
+}
+
+// blobStorageSuffix is the blob endpoint suffix of the cloud the provider runs in
+// (BLOB_STORAGE_SUFFIX, default blob.core.windows.net; e.g. blob.core.usgovcloudapi.net)
+func blobStorageSuffix() string {
+	return strings.ToLower(strings.Trim(getEnvOrDefault("BLOB_STORAGE_SUFFIX", "blob.core.windows.net"), "."))
+}
+
+// parseAuditBlobURL checks that sasURL is an https URL of a storage account's blob endpoint with
+// a SAS token, so the export cannot be sent to any other host
+func parseAuditBlobURL(sasURL string) (*url.URL, error) {
+	u, err := url.Parse(sasURL)
+	invalid := fmt.Errorf("blobSasUrl must be an https URL on a *.%s storage account with a SAS token", blobStorageSuffix())
+	if err != nil || u.Scheme != "https" || u.User != nil || u.Port() != "" || u.RawQuery == "" {
+		return nil, invalid
+	}
+	account, ok := strings.CutSuffix(strings.ToLower(u.Hostname()), "."+blobStorageSuffix())
+	if !ok || account == "" || strings.Contains(account, ".") {
+		return nil, invalid
+	}
+	return u, nil
+}
+
+// uploadAuditBlob PUTs content to an Azure blob SAS URL and returns the blob URL without its SAS token
+func uploadAuditBlob(sasURL string, content []byte, contentType string) (string, error) {
+	u, err := parseAuditBlobURL(sasURL)
+	if err != nil {
+		return "", err
+	}
+
+	req, err := http.NewRequest(http.MethodPut, u.String(), bytes.NewReader(content))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("x-ms-blob-type", "BlockBlob")
+	req.Header.Set("Content-Type", contentType)
+
+	client := newOutboundClient(30 * time.Second)
+	res, err := client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("failed to upload audit export: %v", err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode >= 300 {
+		body, _ := io.ReadAll(io.LimitReader(res.Body, 1024))
+		return "", fmt.Errorf("blob storage returned status %d: %s", res.StatusCode, string(body))
+	}
+
+	u.RawQuery = ""
+	return u.String(), nil
+}
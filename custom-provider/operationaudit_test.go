@@ -0,0 +1,35 @@
+package main
+
+import "testing"
+
+func TestParseAuditBlobURL(t *testing.T) {
+	tests := []struct {
+		name   string
+		suffix string
+		sasURL string
+		valid  bool
+	}{
+		{"storage account", "", "https://mystorage.blob.core.windows.net/audit/june.csv?sv=x&sig=y", true},
+		{"upper case host", "", "https://MyStorage.Blob.Core.Windows.Net/audit/june.csv?sig=y", true},
+		{"no SAS token", "", "https://mystorage.blob.core.windows.net/audit/june.csv", false},
+		{"http", "", "http://mystorage.blob.core.windows.net/audit/june.csv?sig=y", false},
+		{"look-alike host", "", "https://x.blob.attacker.example/audit/june.csv?sig=y", false},
+		{"suffix inside another domain", "", "https://mystorage.blob.core.windows.net.attacker.example/a?sig=y", false},
+		{"subdomain of an account", "", "https://a.mystorage.blob.core.windows.net/a?sig=y", false},
+		{"bare suffix", "", "https://blob.core.windows.net/a?sig=y", false},
+		{"internal host", "", "https://metadata.internal/a?sig=y", false},
+		{"explicit port", "", "https://mystorage.blob.core.windows.net:8443/a?sig=y", false},
+		{"user info", "", "https://user@mystorage.blob.core.windows.net/a?sig=y", false},
+		{"sovereign cloud", "blob.core.usgovcloudapi.net", "https://mystorage.blob.core.usgovcloudapi.net/a?sig=y", true},
+		{"public cloud under a sovereign suffix", "blob.core.usgovcloudapi.net", "https://mystorage.blob.core.windows.net/a?sig=y", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("BLOB_STORAGE_SUFFIX", tt.suffix)
+			_, err := parseAuditBlobURL(tt.sasURL)
+			if (err == nil) != tt.valid {
+				t.Errorf("expected valid %t, got error %v", tt.valid, err)
+			}
+		})
+	}
+}
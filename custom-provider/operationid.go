@@ -0,0 +1,52 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"log"
+	"net/http"
+	"time"
+)
+
+// Every request gets a provider-generated operation ID. It is returned in X-Provider-Operation-Id
+// and written into the request's log lines ("[op=...]"), PAM phase timings, audit entries and
+// state records, so interleaved concurrent deployments can be told apart in the logs.
+
+type operationIDKey struct{}
+
+// operationIDHeader is the response header carrying the operation ID
+const operationIDHeader = "X-Provider-Operation-Id"
+
+// newOperationID returns a random 16 hex digit ID prefixed with "op-"
+func newOperationID() string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return "op-" + time.Now().UTC().Format("20060102150405.000000000")
+	}
+	return "op-" + hex.EncodeToString(b)
+}
+
+// operationID returns the operation ID of the request, or "-" outside of operationIDMiddleware
+func operationID(r *http.Request) string {
+	if id, ok := r.Context().Value(operationIDKey{}).(string); ok {
+		return id
+	}
+	return "-"
+}
+
+// operationIDMiddleware assigns the operation ID and logs the begin/end pair of every request
+func operationIDMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := newOperationID()
+		r = r.WithContext(context.WithValue(r.Context(), operationIDKey{}, id))
+		w.Header().Set(operationIDHeader, id)
+
+		log.Printf("INFO: [op=%s] begin %s %s requestPath=%q correlationId=%q", id, r.Method, r.URL.Path,
+			customProviderRequestPath(r), r.Header.Get("X-Ms-Correlation-Request-Id"))
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(rec, r)
+		log.Printf("INFO: [op=%s] end %s %s status=%d durationMs=%d", id, r.Method, r.URL.Path, rec.status, time.Since(start).Milliseconds())
+	})
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"cyberark-custom-provider/retry"
+	"github.com/davidh-cyberark/privilegeaccessmanager-sdk-go/pam"
+)
+
+// operationPolicy is how long requests for one kind of PCloud object may run, how often failed
+// PCloud calls are retried, and how hard a create is verified afterwards
+type operationPolicy struct {
+	Timeout        time.Duration `json:"timeout"`        // whole-request budget, 0 means no limit
+	CallTimeout    time.Duration `json:"callTimeout"`    // budget of one attempt of a PCloud call, 0 means no limit
+	Retries        int           `json:"retries"`        // extra attempts when PCloud answers 429 or 5xx or cannot be reached
+	RetryBackoff   time.Duration `json:"retryBackoff"`   // the wait before the first retry, doubled for each further one
+	VerifyAttempts int           `json:"verifyAttempts"` // read-backs after a create, 0 skips verification
+	VerifyInterval time.Duration `json:"verifyInterval"` // wait before each read-back
+}
+
+// operationPolicyKinds are the kinds with their own policy; members covers safe member calls
+var operationPolicyKinds = []string{"safes", "accounts", "members"}
+
+// operationPolicies is the policy per kind. REQUEST_TIMEOUT, PAM_CALL_TIMEOUT, PAM_RETRY_MAX,
+// PAM_RETRY_BASE, VERIFY_ATTEMPTS and VERIFY_INTERVAL set the defaults; each can be overridden per kind with the
+// upper-cased kind as prefix, e.g. ACCOUNTS_VERIFY_ATTEMPTS or SAFES_REQUEST_TIMEOUT. The former
+// names PCLOUD_RETRIES and PCLOUD_RETRY_BACKOFF are still read when the new ones are not set.
+var operationPolicies = loadOperationPolicies()
+
+func loadOperationPolicies() map[string]operationPolicy {
+	defaults := operationPolicy{
+		Timeout:        policyDuration("REQUEST_TIMEOUT", "0s"),
+		CallTimeout:    policyDuration("PAM_CALL_TIMEOUT", "30s"),
+		Retries:        policyInt(retryEnv("", "PAM_RETRY_MAX", "PCLOUD_RETRIES"), "2"),
+		RetryBackoff:   policyDuration(retryEnv("", "PAM_RETRY_BASE", "PCLOUD_RETRY_BACKOFF"), "2s"),
+		VerifyAttempts: policyInt("VERIFY_ATTEMPTS", "3"),
+		VerifyInterval: policyDuration("VERIFY_INTERVAL", "2s"),
+	}
+
+	policies := map[string]operationPolicy{}
+	for _, kind := range operationPolicyKinds {
+		prefix := strings.ToUpper(kind) + "_"
+		policies[kind] = operationPolicy{
+			Timeout:        policyDuration(prefix+"REQUEST_TIMEOUT", defaults.Timeout.String()),
+			CallTimeout:    policyDuration(prefix+"PAM_CALL_TIMEOUT", defaults.CallTimeout.String()),
+			Retries:        policyInt(retryEnv(prefix, "PAM_RETRY_MAX", "PCLOUD_RETRIES"), strconv.Itoa(defaults.Retries)),
+			RetryBackoff:   policyDuration(retryEnv(prefix, "PAM_RETRY_BASE", "PCLOUD_RETRY_BACKOFF"), defaults.RetryBackoff.String()),
+			VerifyAttempts: policyInt(prefix+"VERIFY_ATTEMPTS", strconv.Itoa(defaults.VerifyAttempts)),
+			VerifyInterval: policyDuration(prefix+"VERIFY_INTERVAL", defaults.VerifyInterval.String()),
+		}
+	}
+	policies[""] = defaults
+	return policies
+}
+
+// retryEnv returns the prefixed variable name, or the former name when only that one is set
+func retryEnv(prefix, name, former string) string {
+	if os.Getenv(prefix+name) == "" && os.Getenv(prefix+former) != "" {
+		return prefix + former
+	}
+	return prefix + name
+}
+
+func policyDuration(name, fallback string) time.Duration {
+	d, err := time.ParseDuration(getEnvOrDefault(name, fallback))
+	if err != nil || d < 0 {
+		log.Printf("WARNING: Invalid %s, using %s: %v", name, fallback, err)
+		d, _ = time.ParseDuration(fallback)
+	}
+	return d
+}
+
+func policyInt(name, fallback string) int {
+	n, err := strconv.Atoi(getEnvOrDefault(name, fallback))
+	if err != nil || n < 0 {
+		log.Printf("WARNING: Invalid %s, using %s: %v", name, fallback, err)
+		n, _ = strconv.Atoi(fallback)
+	}
+	return n
+}
+
+// policyFor returns the policy for a kind, or the defaults for kinds without their own policy
+func policyFor(kind string) operationPolicy {
+	if policy, ok := operationPolicies[strings.ToLower(kind)]; ok {
+		return policy
+	}
+	return operationPolicies[""]
+}
+
+// withRequestTimeout bounds a handler by the kind's timeout. The handler's request context ends
+// when the time is up, which cancels the PCloud call in progress, but the handler still returns by
+// itself so that what it already did is recorded. A request that failed because it ran out of time
+// is answered with 503 RequestTimeout so ARM retries it instead of waiting on a stuck PCloud call;
+// otherwise the handler's own response is sent.
+func withRequestTimeout(kind string, handler http.Handler) http.Handler {
+	timeout := policyFor(kind).Timeout
+	if timeout <= 0 {
+		return handler
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := context.WithTimeout(r.Context(), timeout)
+		defer cancel()
+		result := &bufferedResponse{header: http.Header{}, code: http.StatusOK}
+		handler.ServeHTTP(result, r.WithContext(ctx))
+
+		if errors.Is(ctx.Err(), context.DeadlineExceeded) && (!result.wrote || result.code >= 500) {
+			log.Printf("WARNING: [op=%s] %s %s did not complete within %s", operationID(r), r.Method, r.URL.Path, timeout)
+			sendJSONError(w, http.StatusServiceUnavailable, "RequestTimeout", fmt.Sprintf("The request for %s did not complete within %s", kind, timeout))
+			return
+		}
+		for key, values := range result.header {
+			w.Header()[key] = values
+		}
+		w.WriteHeader(result.code)
+		w.Write(result.body.Bytes())
+	})
+}
+
+// maxRetryDelay caps the wait between two attempts of a PCloud call
+const maxRetryDelay = 30 * time.Second
+
+// retryPolicy is the kind's retry policy for PCloud calls
+func (p operationPolicy) retryPolicy(operation string) retry.Policy {
+	return retry.Policy{
+		MaxRetries: p.Retries,
+		Base:       p.RetryBackoff,
+		MaxDelay:   maxRetryDelay,
+		OnRetry: func(n int, delay time.Duration, err error) {
+			log.Printf("WARNING: %s failed (attempt %d of %d), retrying in %s: %v", operation, n, p.Retries+1, delay.Round(time.Millisecond), err)
+		},
+	}
+}
+
+// attemptContext bounds one attempt of a PCloud call by the kind's CallTimeout; the request's own
+// context still ends it first when the caller goes away or the request runs out of time
+func (p operationPolicy) attemptContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	if p.CallTimeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, p.CallTimeout)
+}
+
+// transientStatus reports whether a PCloud call that got status may be tried again. 429 always
+// may, as PCloud turned the call away; transport failures (0, or 502 from pamDo) and other 5xx
+// only when repeating the call is safe, since PCloud may have carried it out.
+func transientStatus(status int, idempotent bool) bool {
+	return status == http.StatusTooManyRequests || (idempotent && (status == 0 || status >= 500))
+}
+
+// pamDoRetry is pamDo with retries of transient failures according to the kind's policy; GET, PUT
+// and DELETE are retried on 429, 5xx and transport failures, other methods on 429 only
+func pamDoRetry(ctx context.Context, pamClient *pam.Client, kind, method, path string, body interface{}, out interface{}) (int, error) {
+	idempotent := method == http.MethodGet || method == http.MethodPut || method == http.MethodDelete
+	return statusRetry(ctx, kind, method+" "+path, idempotent, func(ctx context.Context) (int, error) {
+		return pamDo(ctx, pamClient, method, path, body, out)
+	})
+}
+
+// statusRetry retries a call that reports failures as an error with the status, like pamDo, on
+// transient statuses according to the kind's policy
+func statusRetry(ctx context.Context, kind, operation string, idempotent bool, call func(ctx context.Context) (int, error)) (int, error) {
+	var retcode int
+	policy := policyFor(kind)
+	err := retry.Do(ctx, policy.retryPolicy(operation), func(int) error {
+		attemptCtx, cancel := policy.attemptContext(ctx)
+		defer cancel()
+		var err error
+		retcode, err = call(attemptCtx)
+		if err != nil && transientStatus(retcode, idempotent) {
+			return retry.Retryable(err)
+		}
+		return err
+	})
+	return retcode, err
+}
+
+// pcloudRetry is pcloudCall with retries of transient failures according to the kind's policy.
+// The SDK reports most PCloud errors only in the status, so the result of the last attempt is
+// returned as the SDK returned it; when that attempt had no error of its own, the error of giving
+// up is returned, e.g. because ctx ended while waiting for the next attempt.
+func pcloudRetry[T any](ctx context.Context, kind, operation string, idempotent bool, call func(ctx context.Context) (T, int, error)) (T, int, error) {
+	var result T
+	var status int
+	var callErr error
+	policy := policyFor(kind)
+	err := retry.Do(ctx, policy.retryPolicy(operation), func(int) error {
+		attemptCtx, cancel := policy.attemptContext(ctx)
+		defer cancel()
+		result, status, callErr = pcloudCall(attemptCtx, call)
+		if transientStatus(status, idempotent) {
+			return retry.Retryable(fmt.Errorf("%s returned status %d", operation, status))
+		}
+		return nil
+	})
+	if callErr == nil {
+		callErr = err
+	}
+	return result, status, callErr
+}
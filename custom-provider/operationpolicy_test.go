@@ -0,0 +1,221 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/davidh-cyberark/privilegeaccessmanager-sdk-go/pam"
+)
+
+func TestLoadOperationPolicies(t *testing.T) {
+	t.Setenv("PCLOUD_RETRIES", "4")
+	t.Setenv("PAM_RETRY_BASE", "500ms")
+	t.Setenv("VERIFY_INTERVAL", "1s")
+	t.Setenv("ACCOUNTS_VERIFY_ATTEMPTS", "6")
+	t.Setenv("ACCOUNTS_PAM_RETRY_MAX", "1")
+	t.Setenv("SAFES_REQUEST_TIMEOUT", "45s")
+	t.Setenv("MEMBERS_PCLOUD_RETRIES", "bogus")
+	t.Setenv("MEMBERS_PAM_CALL_TIMEOUT", "10s")
+
+	policies := loadOperationPolicies()
+
+	tests := []struct {
+		kind string
+		want operationPolicy
+	}{
+		{kind: "safes", want: operationPolicy{Timeout: 45 * time.Second, CallTimeout: 30 * time.Second, Retries: 4, RetryBackoff: 500 * time.Millisecond, VerifyAttempts: 3, VerifyInterval: time.Second}},
+		{kind: "accounts", want: operationPolicy{CallTimeout: 30 * time.Second, Retries: 1, RetryBackoff: 500 * time.Millisecond, VerifyAttempts: 6, VerifyInterval: time.Second}},
+		{kind: "members", want: operationPolicy{CallTimeout: 10 * time.Second, Retries: 4, RetryBackoff: 500 * time.Millisecond, VerifyAttempts: 3, VerifyInterval: time.Second}},
+		{kind: "", want: operationPolicy{CallTimeout: 30 * time.Second, Retries: 4, RetryBackoff: 500 * time.Millisecond, VerifyAttempts: 3, VerifyInterval: time.Second}},
+	}
+	for _, tt := range tests {
+		if got := policies[tt.kind]; got != tt.want {
+			t.Errorf("%q: got %+v, want %+v", tt.kind, got, tt.want)
+		}
+	}
+}
+
+func TestPamDoRetry(t *testing.T) {
+	saved := operationPolicies["accounts"]
+	defer func() { operationPolicies["accounts"] = saved }()
+	policy := saved
+	policy.Retries = 2
+	policy.RetryBackoff = time.Millisecond
+	operationPolicies["accounts"] = policy
+	savedRate := pcloudRate
+	defer func() { pcloudRate = savedRate }()
+	pcloudRate = newRateLimiter(0, 1, time.Millisecond)
+
+	tests := []struct {
+		name          string
+		method        string
+		statuses      []int
+		wantErr       bool
+		expectedCalls int
+	}{
+		{name: "GET retried on 5xx", method: http.MethodGet, statuses: []int{503, 500, 200}, expectedCalls: 3},
+		{name: "GET retried on 429", method: http.MethodGet, statuses: []int{429, 200}, expectedCalls: 2},
+		{name: "POST retried on 429", method: http.MethodPost, statuses: []int{429, 429, 200}, expectedCalls: 3},
+		{name: "POST not retried on 5xx", method: http.MethodPost, statuses: []int{500, 200}, wantErr: true, expectedCalls: 1},
+		{name: "4xx not retried", method: http.MethodGet, statuses: []int{404, 200}, wantErr: true, expectedCalls: 1},
+		{name: "gives up", method: http.MethodGet, statuses: []int{429, 429, 429, 200}, wantErr: true, expectedCalls: 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			calls := 0
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(tt.statuses[calls])
+				calls++
+			}))
+			defer server.Close()
+
+			client := &pam.Client{Config: &pam.Config{PcloudUrl: server.URL}, Session: &pam.Session{Token: "token1", TokenType: "Bearer"}}
+			_, err := pamDoRetry(context.Background(), client, "accounts", tt.method, "/PasswordVault/API/Accounts/12_3/", nil, nil)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("expected error %t, got %v", tt.wantErr, err)
+			}
+			if calls != tt.expectedCalls {
+				t.Errorf("expected %d calls, got %d", tt.expectedCalls, calls)
+			}
+		})
+	}
+}
+
+func TestCallTimeoutBoundsAuthentication(t *testing.T) {
+	saved := operationPolicies[""]
+	defer func() { operationPolicies[""] = saved }()
+	policy := saved
+	policy.CallTimeout = 200 * time.Millisecond
+	operationPolicies[""] = policy
+
+	// A hung identity tenant and Conjur answer nothing but managed identity tokens
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/identity" {
+			w.Write([]byte(`{"access_token": "mi-token", "expires_on": "4102444800"}`))
+			return
+		}
+		select {
+		case <-release:
+		case <-r.Context().Done():
+		}
+	}))
+	defer server.Close()
+	defer close(release)
+
+	t.Setenv("IDENTITY_ENDPOINT", server.URL+"/identity")
+	t.Setenv("IDENTITY_HEADER", "test")
+	t.Setenv("CONJUR_APPLIANCE_URL", server.URL)
+	t.Setenv("CONJUR_AUTHN_SERVICE_ID", "prod")
+	t.Setenv("CONJUR_AUTHN_LOGIN", "host/data/azure/provider")
+	resetTokens := func() {
+		miTokenMu.Lock()
+		miTokenCache = map[string]managedIdentityToken{}
+		miTokenMu.Unlock()
+	}
+	resetTokens()
+	defer resetTokens()
+
+	tests := []struct {
+		name string
+		call func() error
+	}{
+		{"platform token", func() error {
+			ctx, cancel := policyFor("").attemptContext(context.Background())
+			defer cancel()
+			client := pam.NewClient(server.URL, pam.NewConfig(server.URL, server.URL, "user", "pass"))
+			_, _, err := pamGetSession(ctx, client)
+			return err
+		}},
+		{"conjur authn", func() error {
+			_, err := newConjurClient().accessToken()
+			return err
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			start := time.Now()
+			if err := tt.call(); err == nil {
+				t.Error("expected the hung call to fail")
+			}
+			if elapsed := time.Since(start); elapsed > 5*time.Second {
+				t.Errorf("expected the call to end after PAM_CALL_TIMEOUT, took %s", elapsed)
+			}
+		})
+	}
+}
+
+func TestWithRequestTimeout(t *testing.T) {
+	saved := operationPolicies["safes"]
+	defer func() { operationPolicies["safes"] = saved }()
+	policy := saved
+	policy.Timeout = 50 * time.Millisecond
+	operationPolicies["safes"] = policy
+
+	tests := []struct {
+		name     string
+		handler  http.HandlerFunc
+		wantCode int
+		wantBody string
+	}{
+		{"in time", func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusCreated)
+			w.Write([]byte(`{"id":"x"}`))
+		}, http.StatusCreated, `{"id":"x"}`},
+		{"canceled call", func(w http.ResponseWriter, r *http.Request) {
+			<-r.Context().Done()
+			sendJSONError(w, http.StatusBadGateway, "AddSafeError", r.Context().Err().Error())
+		}, http.StatusServiceUnavailable, `"RequestTimeout"`},
+		{"finished after the deadline", func(w http.ResponseWriter, r *http.Request) {
+			<-r.Context().Done()
+			w.WriteHeader(http.StatusOK)
+			w.Write([]byte(`{"id":"x"}`))
+		}, http.StatusOK, `{"id":"x"}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			returned := false
+			handler := withRequestTimeout("safes", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				tt.handler(w, r)
+				returned = true
+			}))
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, httptest.NewRequest(http.MethodPut, "/", nil))
+
+			if !returned {
+				t.Error("expected the handler to run to completion before the response is sent")
+			}
+			if w.Code != tt.wantCode || !strings.Contains(w.Body.String(), tt.wantBody) {
+				t.Errorf("expected %d with %s, got %d %s", tt.wantCode, tt.wantBody, w.Code, w.Body.String())
+			}
+			if w.Code >= 400 && w.Header().Get("Content-Type") != "application/json" {
+				t.Errorf("expected a JSON error, got Content-Type %q", w.Header().Get("Content-Type"))
+			}
+		})
+	}
+}
+
+func TestPcloudRetryCanceledDuringBackoff(t *testing.T) {
+	saved := operationPolicies["safes"]
+	defer func() { operationPolicies["safes"] = saved }()
+	policy := saved
+	policy.Retries = 2
+	policy.RetryBackoff = time.Minute
+	operationPolicies["safes"] = policy
+
+	ctx, cancel := context.WithCancel(context.Background())
+	calls := 0
+	_, status, err := pcloudRetry(ctx, "safes", "GetSafeDetails", true, func(ctx context.Context) (pam.GetSafeDetails, int, error) {
+		calls++
+		time.AfterFunc(20*time.Millisecond, cancel)
+		return pam.GetSafeDetails{}, http.StatusBadGateway, nil
+	})
+	if calls != 1 || !errors.Is(err, context.Canceled) {
+		t.Errorf("expected the cancellation after 1 call, got %d calls, status %d, %v", calls, status, err)
+	}
+}
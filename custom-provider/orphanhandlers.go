@@ -0,0 +1,142 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"time"
+)
+
+// CleanupOrphansRequest is the body of POST /admin/cleanupOrphans
+type CleanupOrphansRequest struct {
+	Mode   string `json:"mode,omitempty"`   // "report" (default) or "delete"
+	MinAge string `json:"minAge,omitempty"` // skip records younger than this, default 1h
+}
+
+// OrphanResult describes one orphaned record and what was done about it
+type OrphanResult struct {
+	ResourceRecord
+	Action string `json:"action"`
+	Error  string `json:"error,omitempty"`
+}
+
+// CleanupOrphansResponse is the result of an orphan scan
+type CleanupOrphansResponse struct {
+	Mode    string         `json:"mode"`
+	Checked int            `json:"checked"`
+	Skipped int            `json:"skipped"`
+	Orphans []OrphanResult `json:"orphans"`
+}
+
+// handleCleanupOrphans finds safes/accounts/Conjur variables the provider created whose ARM custom provider
+// (or resource group) no longer exists, and reports or deletes them
+func handleCleanupOrphans(w http.ResponseWriter, r *http.Request) {
+	LogRequestDebug("CleanupOrphans", r)
+
+	request := CleanupOrphansRequest{Mode: "report", MinAge: "1h"}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil && err != io.EOF {
+		sendJSONError(w, http.StatusBadRequest, "InvalidRequestBody", fmt.Sprintf("Invalid request body: %v", err))
+		return
+	}
+	if request.Mode != "report" && request.Mode != "delete" {
+		sendJSONError(w, http.StatusBadRequest, "InvalidMode", fmt.Sprintf("Mode must be 'report' or 'delete', got %q", request.Mode))
+		return
+	}
+	minAge, err := time.ParseDuration(request.MinAge)
+	if err != nil {
+		sendJSONError(w, http.StatusBadRequest, "InvalidMinAge", fmt.Sprintf("Invalid minAge: %v", err))
+		return
+	}
+
+	records, err := stateStore.List()
+	if err != nil {
+		sendJSONError(w, http.StatusInternalServerError, "StateStoreError", fmt.Sprintf("Failed to list resource records: %v", err))
+		return
+	}
+
+	response := CleanupOrphansResponse{Mode: request.Mode, Orphans: []OrphanResult{}}
+	providerExists := map[string]bool{}
+	for _, rec := range records {
+		if time.Since(rec.Deployment.CreatedAt) < minAge {
+			response.Skipped++
+			continue
+		}
+		response.Checked++
+
+		providerID, err := providerIDFromResourceID(rec.ResourceID)
+		if err != nil {
+			log.Printf("WARNING: (CleanupOrphans) %v", err)
+			continue
+		}
+		exists, seen := providerExists[providerID]
+		if !seen {
+			exists, err = armResourceExists(providerID)
+			if err != nil {
+				sendJSONError(w, http.StatusBadGateway, "ARMLookupError", fmt.Sprintf("Failed to check ARM for %s: %v", providerID, err))
+				return
+			}
+			providerExists[providerID] = exists
+		}
+		if exists {
+			continue
+		}
+
+		result := OrphanResult{ResourceRecord: rec, Action: "reported"}
+		if request.Mode == "delete" {
+			if err := deleteOrphan(r.Context(), rec); err != nil {
+				result.Action = "error"
+				result.Error = err.Error()
+			} else {
+				result.Action = "deleted"
+				forgetResource(rec.ResourceID)
+			}
+		}
+		log.Printf("INFO: (CleanupOrphans) %s %s (correlationId: %s)", result.Action, rec.ResourceID, rec.Deployment.CorrelationID)
+		response.Orphans = append(response.Orphans, result)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// deleteOrphan removes the PCloud object or Conjur variable behind an orphaned record
+func deleteOrphan(ctx context.Context, rec ResourceRecord) error {
+	if rec.ResourceType == "conjurSecrets" {
+		client, err := conjurSecretClient()
+		if err != nil {
+			return err
+		}
+		return deleteConjurVariable(ctx, client, rec.SafeName, rec.PCloudID)
+	}
+	if rec.ResourceType == "conjurHosts" {
+		client, err := conjurSecretClient()
+		if err != nil {
+			return err
+		}
+		return deleteConjurHost(ctx, client, rec.SafeName, rec.PCloudID)
+	}
+	if rec.ResourceType == "applications" {
+		pamClient, err := createPAMClient()
+		if err != nil {
+			return err
+		}
+		return deleteApplication(ctx, pamClient, rec.PCloudID)
+	}
+
+	pamService, err := newPAMService()
+	if err != nil {
+		return err
+	}
+
+	switch rec.ResourceType {
+	case "safes":
+		return deleteSafe(ctx, pamService, rec.SafeName)
+	case "accounts":
+		return deleteAccount(ctx, pamService, rec.PCloudID)
+	default:
+		return fmt.Errorf("unknown resource type %s", rec.ResourceType)
+	}
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// Collection GETs and the listAccounts action can return large inventories. A caller asks for a
+// page with $top (collection GETs) or top (actions), and gets a continuation token for the rest:
+// collection GETs answer with a nextLink URL carrying $skipToken, ARM's convention, and actions
+// with nextSkipToken, which is sent back as skipToken. LIST_PAGE_SIZE sets a page size for
+// callers that do not ask for one; by default everything is returned at once. The token is
+// opaque to callers; it holds the offset of the next page.
+
+// maxListPageSize bounds $top, matching the largest page PCloud returns
+const maxListPageSize = pamAccountsPageLimit
+
+// listPage is the part of a listing a request asks for; top 0 means the rest of the listing
+type listPage struct {
+	offset int
+	top    int
+}
+
+// skipToken is the content of a continuation token
+type skipToken struct {
+	Offset int `json:"offset"`
+}
+
+// encodeSkipToken returns the token for the page starting at offset
+func encodeSkipToken(offset int) string {
+	data, _ := json.Marshal(skipToken{Offset: offset})
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+// parseListPage reads a page request; top and token are empty when not given
+func parseListPage(top, token string) (listPage, error) {
+	page := listPage{top: listPageSize()}
+	if top != "" {
+		n, err := strconv.Atoi(top)
+		if err != nil || n < 1 || n > maxListPageSize {
+			return page, fmt.Errorf("top must be a number from 1 to %d, got %q", maxListPageSize, top)
+		}
+		page.top = n
+	}
+	if token != "" {
+		data, err := base64.RawURLEncoding.DecodeString(token)
+		var decoded skipToken
+		if err != nil || json.Unmarshal(data, &decoded) != nil || decoded.Offset < 0 {
+			return page, fmt.Errorf("invalid skipToken %q", token)
+		}
+		page.offset = decoded.Offset
+	}
+	return page, nil
+}
+
+// listPageSize reads LIST_PAGE_SIZE, 0 (the default) for no limit
+func listPageSize() int {
+	return min(policyInt("LIST_PAGE_SIZE", "0"), maxListPageSize)
+}
+
+// bounds returns the slice of n items the page covers, and the offset of the next page or -1
+func (p listPage) bounds(n int) (int, int, int) {
+	start := min(p.offset, n)
+	end := n
+	if p.top > 0 {
+		end = min(start+p.top, n)
+	}
+	if end < n {
+		return start, end, end
+	}
+	return start, end, -1
+}
+
+// collectionPage reads the $top and $skipToken query parameters of a collection GET. They are
+// also read from the query of the X-Ms-Customproviders-Requestpath header.
+func collectionPage(r *http.Request) (listPage, error) {
+	query := r.URL.Query()
+	if _, rawQuery, found := strings.Cut(r.Header.Get(requestPathHeader), "?"); found {
+		if headerQuery, err := url.ParseQuery(rawQuery); err == nil {
+			for key, values := range headerQuery {
+				query[key] = values
+			}
+		}
+	}
+	return parseListPage(query.Get("$top"), query.Get("$skipToken"))
+}
+
+// collectionNextLink returns the URL of the page starting at next. A request ARM routed to the
+// endpoint root gets an ARM URL, which ARM forwards with its query; a direct request gets one on
+// the provider's endpoint.
+func collectionNextLink(r *http.Request, cpRequest CustomProviderRequestPath, page listPage, next int) string {
+	query := url.Values{}
+	query.Set("$skipToken", encodeSkipToken(next))
+	if page.top > 0 {
+		query.Set("$top", strconv.Itoa(page.top))
+	}
+	if r.Header.Get(requestPathHeader) != "" {
+		apiVersion := r.URL.Query().Get("api-version")
+		if apiVersion == "" {
+			apiVersion = armCustomProvidersAPIVersion
+		}
+		query.Set("api-version", apiVersion)
+		return armEndpoint + cpRequest.ID() + "?" + query.Encode()
+	}
+	return providerEndpoint(r) + cpRequest.ID() + "?" + query.Encode()
+}
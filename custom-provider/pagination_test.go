@@ -0,0 +1,136 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"cyberark-custom-provider/client"
+)
+
+func TestParseListPage(t *testing.T) {
+	tests := []struct {
+		name      string
+		top       string
+		token     string
+		pageSize  string
+		n         int
+		wantStart int
+		wantEnd   int
+		wantNext  int
+		wantErr   bool
+	}{
+		{"everything", "", "", "", 5, 0, 5, -1, false},
+		{"first page", "2", "", "", 5, 0, 2, 2, false},
+		{"middle page", "2", encodeSkipToken(2), "", 5, 2, 4, 4, false},
+		{"last page", "2", encodeSkipToken(4), "", 5, 4, 5, -1, false},
+		{"token past the end", "2", encodeSkipToken(9), "", 5, 5, 5, -1, false},
+		{"LIST_PAGE_SIZE", "", "", "3", 5, 0, 3, 3, false},
+		{"top overrides LIST_PAGE_SIZE", "4", "", "3", 5, 0, 4, 4, false},
+		{"top zero", "0", "", "", 5, 0, 0, 0, true},
+		{"top too large", "1001", "", "", 5, 0, 0, 0, true},
+		{"invalid token", "", "not-a-token", "", 5, 0, 0, 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("LIST_PAGE_SIZE", tt.pageSize)
+			page, err := parseListPage(tt.top, tt.token)
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("expected an error, got %+v", page)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error %v", err)
+			}
+			start, end, next := page.bounds(tt.n)
+			if start != tt.wantStart || end != tt.wantEnd || next != tt.wantNext {
+				t.Errorf("expected [%d:%d] next %d, got [%d:%d] next %d", tt.wantStart, tt.wantEnd, tt.wantNext, start, end, next)
+			}
+		})
+	}
+}
+
+func TestPagedListings(t *testing.T) {
+	mock := newMockPCloud()
+	pcloud := httptest.NewServer(mock.router())
+	defer pcloud.Close()
+	t.Setenv("IDTENANTURL", pcloud.URL)
+	t.Setenv("PCLOUDURL", pcloud.URL)
+	t.Setenv("PAMUSER", "mock-user")
+	t.Setenv("PAMPASS", "mock-pass")
+
+	// Earlier tests may have left a detected maintenance window behind
+	maintenance.mu.Lock()
+	maintenance.detectedUntil = time.Time{}
+	maintenance.mu.Unlock()
+
+	stateStore = newBufferedStateStore(newMemoryStateStore(), 0)
+	for _, name := range flusherNames() {
+		flushersMu.Lock()
+		flush := flushers[name]
+		flushersMu.Unlock()
+		flush()
+	}
+
+	router, _ := newRouter()
+	provider := httptest.NewServer(router)
+	defer provider.Close()
+	c := client.New(provider.URL, "sub1", "rg1", "CyberArkProvider")
+	ctx := context.Background()
+
+	for i := 1; i <= 3; i++ {
+		if _, err := c.CreateSafe(ctx, fmt.Sprintf("safe%d", i), client.SafeProperties{SafeName: fmt.Sprintf("safe%d", i)}); err != nil {
+			t.Fatalf("create safe: %v", err)
+		}
+	}
+	recentlyCreated.Flush()
+
+	// The client follows nextLink through every page
+	t.Setenv("LIST_PAGE_SIZE", "2")
+	safes, err := c.ListResources(ctx, "safes")
+	if err != nil || len(safes) != 3 {
+		t.Fatalf("expected 3 safes over two pages, got %d, %v", len(safes), err)
+	}
+	t.Setenv("LIST_PAGE_SIZE", "")
+
+	// More accounts than PCloud returns in one search page
+	mock.mu.Lock()
+	for i := 1; i <= 60; i++ {
+		id := fmt.Sprintf("10_%d", 1000+i)
+		mock.accounts[id] = map[string]interface{}{"id": id, "safeName": "safe1", "name": fmt.Sprintf("acct%02d", i), "platformId": "UnixSSH",
+			"address": "web01", "userName": fmt.Sprintf("user%02d", i), "secretType": "password"}
+	}
+	mock.mu.Unlock()
+
+	var all map[string]interface{}
+	if err := c.InvokeAction(ctx, "listAccounts", map[string]interface{}{"safeName": "safe1"}, &all); err != nil {
+		t.Fatalf("list accounts: %v", err)
+	}
+	if all["count"] != float64(60) || all["totalCount"] != float64(60) || all["nextSkipToken"] != nil {
+		t.Errorf("expected all 60 accounts at once, got count %v, totalCount %v", all["count"], all["totalCount"])
+	}
+
+	seen := map[string]bool{}
+	request := map[string]interface{}{"safeName": "safe1", "top": 25}
+	for pages := 1; ; pages++ {
+		var page map[string]interface{}
+		if err := c.InvokeAction(ctx, "listAccounts", request, &page); err != nil {
+			t.Fatalf("list accounts page %d: %v", pages, err)
+		}
+		for _, account := range page["accounts"].([]interface{}) {
+			seen[account.(map[string]interface{})["accountId"].(string)] = true
+		}
+		token, _ := page["nextSkipToken"].(string)
+		if token == "" {
+			if pages != 3 || len(seen) != 60 {
+				t.Errorf("expected 60 accounts over 3 pages, got %d over %d", len(seen), pages)
+			}
+			break
+		}
+		request["skipToken"] = token
+	}
+}
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/davidh-cyberark/privilegeaccessmanager-sdk-go/pam"
+)
+
+// The SDK sends every request on a new http.Transport of its own (pam.GetHTTPClient), which
+// ignores the proxy and CA bundle of the outbound transport (see egress.go) and never reuses a
+// connection. The SDK calls the provider makes are therefore sent with the functions below, which
+// take the SDK's request and response types and return the same statuses and errors as the SDK
+// methods they replace.
+
+// pamHTTPClient sends PCloud and identity tenant requests, with the SDK's 30 second timeout
+var pamHTTPClient = newOutboundClient(30 * time.Second)
+
+// pamSend is pam.Client.SendRequest on the outbound transport, with the request's traceparent
+func pamSend(c *pam.Client, req *http.Request) (*http.Response, error) {
+	if c.Session != nil && c.Session.Token != "" {
+		req.Header.Add("Authorization", fmt.Sprintf("%s %s", c.Session.TokenType, c.Session.Token))
+	}
+	injectTraceparent(req)
+	return pamHTTPClient.Do(req)
+}
+
+// pamExchange sends a JSON request to a PCloud path and returns the response status and body;
+// transport failures are reported as 502, like the SDK does
+func pamExchange(ctx context.Context, c *pam.Client, method, path string, body interface{}) (int, []byte, error) {
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return http.StatusConflict, nil, fmt.Errorf("failed to marshal request body: %w", err)
+		}
+		reader = bytes.NewReader(data)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, c.Config.PcloudUrl+path, reader)
+	if err != nil {
+		return http.StatusConflict, nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	res, err := pamSend(c, req)
+	if err != nil {
+		return http.StatusBadGateway, nil, fmt.Errorf("failed to send request. %s", err)
+	}
+	defer res.Body.Close()
+	respBody, err := io.ReadAll(res.Body)
+	if err != nil {
+		return res.StatusCode, nil, fmt.Errorf("failed to read response body: %w", err)
+	}
+	return res.StatusCode, respBody, nil
+}
+
+// pamDecode parses a response body into out and, when checkStatus is set, fails non-2xx statuses
+func pamDecode(status int, body []byte, out interface{}, checkStatus bool) (int, error) {
+	if err := json.Unmarshal(body, out); err != nil {
+		return status, fmt.Errorf("response format failed to parse: %s: %s", err.Error(), string(body))
+	}
+	if checkStatus && status >= 300 {
+		return status, fmt.Errorf("received non-200 status code(%d): %s", status, string(body))
+	}
+	return status, nil
+}
+
+// pamGetSession is pam.Client.GetSession: a platform token for the service user from the
+// identity tenant. Unlike the SDK it returns an error for a response that is not JSON.
+func pamGetSession(ctx context.Context, c *pam.Client) (*pam.Session, int, error) {
+	data := url.Values{}
+	data.Set("grant_type", "client_credentials")
+	data.Set("client_id", c.Config.User)
+	data.Set("client_secret", c.Config.Pass)
+	return pamRequestToken(ctx, c.Config.IdTenantUrl+"/oauth2/platformtoken", data)
+}
+
+// pamRequestToken posts an OAuth2 token request to the identity tenant and returns the session it
+// answers with
+func pamRequestToken(ctx context.Context, tokenURL string, data url.Values) (*pam.Session, int, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, tokenURL, strings.NewReader(data.Encode()))
+	if err != nil {
+		return nil, http.StatusConflict, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	res, err := pamHTTPClient.Do(req)
+	if err != nil {
+		return nil, http.StatusBadGateway, fmt.Errorf("failed to send request. %s", err)
+	}
+	defer res.Body.Close()
+	body, err := io.ReadAll(res.Body)
+	if err != nil {
+		return nil, res.StatusCode, fmt.Errorf("failed to read platform token response: %w", err)
+	}
+
+	var idresp pam.IDTenantResponse
+	if err := json.Unmarshal(body, &idresp); err != nil {
+		return nil, res.StatusCode, fmt.Errorf("failed to parse platform token response (%d): %v", res.StatusCode, err)
+	}
+	if idresp.Error != "" {
+		return nil, res.StatusCode, fmt.Errorf("error getting token: (%s) %s", idresp.Error, idresp.ErrorDescription)
+	}
+	return &pam.Session{
+		Token:      idresp.AccessToken,
+		TokenType:  idresp.TokenType,
+		Expiration: time.Now().Add(time.Second * time.Duration(idresp.ExpiresIn)),
+	}, res.StatusCode, nil
+}
+
+// pamAddSafe is pam.Client.AddSafe; a PCloud error answer is returned with a nil error
+func pamAddSafe(ctx context.Context, c *pam.Client, request pam.PostAddSafeRequest) (pam.PostAddSafeResponse, int, error) {
+	var safe pam.PostAddSafeResponse
+	status, body, err := pamExchange(ctx, c, http.MethodPost, "/PasswordVault/API/Safes/", request)
+	if err != nil {
+		return safe, status, err
+	}
+	status, err = pamDecode(status, body, &safe, false)
+	return safe, status, err
+}
+
+// pamGetSafeDetails is pam.Client.GetSafeDetails; a PCloud error answer is returned with a nil error
+func pamGetSafeDetails(ctx context.Context, c *pam.Client, safeName string) (pam.GetSafeDetails, int, error) {
+	var safe pam.GetSafeDetails
+	status, body, err := pamExchange(ctx, c, http.MethodGet, "/PasswordVault/API/Safes/"+url.QueryEscape(safeName), nil)
+	if err != nil {
+		return safe, status, err
+	}
+	status, err = pamDecode(status, body, &safe, false)
+	return safe, status, err
+}
+
+// pamAddAccount is pam.Client.AddAccount
+func pamAddAccount(ctx context.Context, c *pam.Client, request pam.PostAddAccountRequest) (pam.PostAddAccountResponse, int, error) {
+	var account pam.PostAddAccountResponse
+	status, body, err := pamExchange(ctx, c, http.MethodPost, "/PasswordVault/API/Accounts/", request)
+	if err != nil {
+		return account, status, err
+	}
+	if status, err = pamDecode(status, body, &account, true); err != nil {
+		return account, status, err
+	}
+	return account, http.StatusOK, nil
+}
+
+// pamGetAccount is pam.Client.GetAccount
+func pamGetAccount(ctx context.Context, c *pam.Client, accountID string) (pam.GetAccountResponse, int, error) {
+	var account pam.GetAccountResponse
+	status, body, err := pamExchange(ctx, c, http.MethodGet, "/PasswordVault/API/Accounts/"+accountID, nil)
+	if err != nil {
+		return account, status, err
+	}
+	if status, err = pamDecode(status, body, &account, true); err != nil {
+		return account, status, err
+	}
+	return account, http.StatusOK, nil
+}
+
+// pamAccountsPageLimit is the largest page PCloud returns from an account search
+const pamAccountsPageLimit = 1000
+
+// pamGetAccounts is pam.Client.GetAccounts with only a filter, e.g. "safeName eq X". PCloud returns
+// at most pamAccountsPageLimit accounts per call, so the pages are read until all are collected.
+func pamGetAccounts(ctx context.Context, c *pam.Client, filter string) (*pam.GetAccountsResponse, int, error) {
+	accounts := &pam.GetAccountsResponse{}
+	for {
+		page, status, err := pamGetAccountsPage(ctx, c, filter, len(accounts.Value), pamAccountsPageLimit)
+		if err != nil {
+			if page == nil {
+				return nil, status, err
+			}
+			return accounts, status, err
+		}
+		accounts.Value = append(accounts.Value, page.Value...)
+		accounts.Count = page.Count
+		if len(page.Value) == 0 || len(accounts.Value) >= page.Count {
+			return accounts, http.StatusOK, nil
+		}
+	}
+}
+
+// pamGetAccountsPage reads one page of an account search; Count is the number of accounts that
+// match the filter across all pages
+func pamGetAccountsPage(ctx context.Context, c *pam.Client, filter string, offset, limit int) (*pam.GetAccountsResponse, int, error) {
+	accounts := &pam.GetAccountsResponse{}
+	query := url.Values{}
+	query.Set("filter", filter)
+	query.Set("offset", strconv.Itoa(offset))
+	query.Set("limit", strconv.Itoa(limit))
+	status, body, err := pamExchange(ctx, c, http.MethodGet, "/PasswordVault/API/Accounts?"+query.Encode(), nil)
+	if err != nil {
+		return nil, status, err
+	}
+	if status >= 300 {
+		return accounts, status, fmt.Errorf("received non-200 status code(%d): %s", status, string(body))
+	}
+	if status, err = pamDecode(status, body, accounts, false); err != nil {
+		return accounts, status, err
+	}
+	return accounts, http.StatusOK, nil
+}
+
+// pamAddSafeMember is pam.Client.AddSafeMember; safeURLID is the URL-encoded safe name
+func pamAddSafeMember(ctx context.Context, c *pam.Client, member pam.PostAddMemberRequest, safeURLID string) (pam.PostAddMemberResponse, int, error) {
+	var added pam.PostAddMemberResponse
+	status, body, err := pamExchange(ctx, c, http.MethodPost, "/PasswordVault/API/Safes/"+safeURLID+"/Members/", member)
+	if err != nil {
+		return added, status, err
+	}
+	if status, err = pamDecode(status, body, &added, true); err != nil {
+		return added, status, err
+	}
+	return added, http.StatusOK, nil
+}
+
+// pamGetPlatforms is pam.Client.GetPlatforms
+func pamGetPlatforms(ctx context.Context, c *pam.Client) (pam.GetPlatformsResponse, int, error) {
+	var platforms pam.GetPlatformsResponse
+	status, body, err := pamExchange(ctx, c, http.MethodGet, "/PasswordVault/API/Platforms/", nil)
+	if err != nil {
+		return platforms, status, err
+	}
+	status, err = pamDecode(status, body, &platforms, false)
+	return platforms, status, err
+}
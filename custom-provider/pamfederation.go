@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/davidh-cyberark/privilegeaccessmanager-sdk-go/pam"
+)
+
+// With PAM_AUTH_MODE=managedIdentity the deployment holds no PCloud password. The provider gets a
+// token for its Azure managed identity with the PAM_OIDC_AUDIENCE audience and presents it as a
+// client assertion (RFC 7523) to the CyberArk Identity OAuth2 server app PAM_OIDC_APP_ID, which
+// trusts Entra ID as an OIDC identity provider and issues a token for the service user the managed
+// identity is mapped to. IDTENANTURL and PCLOUDURL still come from the credential source.
+
+const (
+	pamAuthPassword        = "password"
+	pamAuthManagedIdentity = "managedIdentity"
+)
+
+// pamAuthMode is PAM_AUTH_MODE: password (PAMUSER and PAMPASS, the default) or managedIdentity
+func pamAuthMode() string {
+	switch mode := os.Getenv("PAM_AUTH_MODE"); {
+	case mode == "" || strings.EqualFold(mode, pamAuthPassword):
+		return pamAuthPassword
+	case strings.EqualFold(mode, pamAuthManagedIdentity):
+		return pamAuthManagedIdentity
+	default:
+		log.Printf("WARNING: Invalid PAM_AUTH_MODE %q, using %s", mode, pamAuthPassword)
+		return pamAuthPassword
+	}
+}
+
+// pamFederated reports whether sessions are opened with the managed identity
+func pamFederated() bool {
+	return pamAuthMode() == pamAuthManagedIdentity
+}
+
+// pamOIDCAudience is the audience of the managed identity token (PAM_OIDC_AUDIENCE, default
+// api://AzureADTokenExchange, the audience Entra ID recommends for federated credentials)
+func pamOIDCAudience() string {
+	return getEnvOrDefault("PAM_OIDC_AUDIENCE", "api://AzureADTokenExchange")
+}
+
+// requiredCredentialNames are the credential settings the authentication mode needs
+func requiredCredentialNames() []string {
+	if pamFederated() {
+		return []string{"IDTENANTURL", "PCLOUDURL"}
+	}
+	return credentialNames
+}
+
+// checkPAMAuthMode reports settings the authentication mode is missing
+func checkPAMAuthMode() error {
+	if pamFederated() && os.Getenv("PAM_OIDC_APP_ID") == "" {
+		return fmt.Errorf("PAM_AUTH_MODE=%s requires PAM_OIDC_APP_ID", pamAuthManagedIdentity)
+	}
+	return nil
+}
+
+// openPAMSession gets a session for the client with the configured authentication mode
+func openPAMSession(ctx context.Context, c *pam.Client) (*pam.Session, int, error) {
+	if pamFederated() {
+		return pamGetFederatedSession(ctx, c)
+	}
+	return pamGetSession(ctx, c)
+}
+
+// pamGetFederatedSession exchanges a managed identity token for an identity tenant token
+func pamGetFederatedSession(ctx context.Context, c *pam.Client) (*pam.Session, int, error) {
+	assertion, err := getManagedIdentityToken(pamOIDCAudience())
+	if err != nil {
+		return nil, http.StatusBadGateway, fmt.Errorf("could not get a managed identity token for %s: %v", pamOIDCAudience(), err)
+	}
+	data := url.Values{}
+	data.Set("grant_type", "client_credentials")
+	data.Set("client_assertion_type", "urn:ietf:params:oauth:client-assertion-type:jwt-bearer")
+	data.Set("client_assertion", assertion)
+	if scope := os.Getenv("PAM_OIDC_SCOPE"); scope != "" {
+		data.Set("scope", scope)
+	}
+	return pamRequestToken(ctx, c.Config.IdTenantUrl+"/oauth2/token/"+url.PathEscape(os.Getenv("PAM_OIDC_APP_ID")), data)
+}
+
+// renewCredentials is called once the identity tenant rejected a session request; it drops what
+// was presented and reports whether another attempt can present something different
+func renewCredentials() bool {
+	renewed := credentials.Invalidate()
+	if pamFederated() {
+		forgetManagedIdentityToken(pamOIDCAudience())
+		renewed = true
+	}
+	return renewed
+}
+
+// pamAuthDescription is the startup fingerprint's view of how PCloud sessions are opened
+func pamAuthDescription() map[string]string {
+	if !pamFederated() {
+		return map[string]string{"mode": pamAuthPassword}
+	}
+	return map[string]string{
+		"mode":     pamAuthManagedIdentity,
+		"appId":    os.Getenv("PAM_OIDC_APP_ID"),
+		"audience": pamOIDCAudience(),
+		"scope":    os.Getenv("PAM_OIDC_SCOPE"),
+	}
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestPAMFederatedSession(t *testing.T) {
+	var miTokens int
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/identity":
+			if r.URL.Query().Get("resource") != "api://AzureADTokenExchange" {
+				t.Errorf("unexpected managed identity audience %s", r.URL.Query().Get("resource"))
+			}
+			miTokens++
+			fmt.Fprintf(w, `{"access_token": "mi-token-%d", "expires_on": "4102444800"}`, miTokens)
+		case "/oauth2/token/provider-app":
+			r.ParseForm()
+			if r.Form.Get("client_assertion_type") != "urn:ietf:params:oauth:client-assertion-type:jwt-bearer" || r.Form.Get("client_secret") != "" {
+				t.Errorf("unexpected token request %v", r.Form)
+			}
+			// The first assertion is rejected, as if the cached token had been revoked
+			if r.Form.Get("client_assertion") != "mi-token-2" {
+				w.WriteHeader(http.StatusBadRequest)
+				w.Write([]byte(`{"error": "invalid_client", "error_description": "assertion rejected"}`))
+				return
+			}
+			w.Write([]byte(`{"access_token": "pcloud-token", "token_type": "Bearer", "expires_in": 3600}`))
+		default:
+			t.Errorf("unexpected request %s", r.URL.Path)
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	resetTokens := func() {
+		miTokenMu.Lock()
+		miTokenCache = map[string]managedIdentityToken{}
+		miTokenMu.Unlock()
+	}
+	resetTokens()
+	defer resetTokens()
+
+	t.Setenv("IDENTITY_ENDPOINT", server.URL+"/identity")
+	t.Setenv("IDENTITY_HEADER", "test")
+	t.Setenv("IDTENANTURL", server.URL)
+	t.Setenv("PCLOUDURL", server.URL)
+	t.Setenv("PAMUSER", "")
+	t.Setenv("PAMPASS", "")
+	t.Setenv("PAM_AUTH_MODE", "managedIdentity")
+	t.Setenv("PAM_OIDC_APP_ID", "provider-app")
+	pamSessions.Flush()
+	defer pamSessions.Flush()
+
+	client, err := createPAMClient()
+	if err != nil {
+		t.Fatalf("expected a session without PAMUSER and PAMPASS: %v", err)
+	}
+	if client.Session.Token != "pcloud-token" {
+		t.Errorf("expected the identity tenant token, got %+v", client.Session)
+	}
+	if miTokens != 2 {
+		t.Errorf("expected a new managed identity token after the rejection, got %d tokens", miTokens)
+	}
+}
+
+func TestCheckPAMAuthMode(t *testing.T) {
+	tests := []struct {
+		name    string
+		env     map[string]string
+		wantErr string
+	}{
+		{"password", map[string]string{"PAMUSER": "user", "PAMPASS": "pass"}, ""},
+		{"password without PAMPASS", map[string]string{"PAMUSER": "user"}, "PAMPASS"},
+		{"managed identity", map[string]string{"PAM_AUTH_MODE": "managedIdentity", "PAM_OIDC_APP_ID": "provider-app"}, ""},
+		{"managed identity without app", map[string]string{"PAM_AUTH_MODE": "managedIdentity"}, "requires PAM_OIDC_APP_ID"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("IDTENANTURL", "https://tenant.id.cyberark.cloud")
+			t.Setenv("PCLOUDURL", "https://example.privilegecloud.cyberark.cloud")
+			for _, name := range []string{"PAMUSER", "PAMPASS", "PAM_AUTH_MODE", "PAM_OIDC_APP_ID"} {
+				t.Setenv(name, tt.env[name])
+			}
+			err := validEnvVars()
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Errorf("unexpected error %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("expected error containing %q, got %v", tt.wantErr, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+
+	"github.com/davidh-cyberark/privilegeaccessmanager-sdk-go/pam"
+)
+
+// pamDo calls a PCloud REST endpoint the SDK does not cover, using the client's session token.
+// path is relative to the PCloud URL, e.g. /PasswordVault/API/Accounts/{id}/Password/Update/.
+// body and out may be nil. The returned error includes the response body for non-2xx statuses.
+func pamDo(ctx context.Context, pamClient *pam.Client, method, path string, body interface{}, out interface{}) (int, error) {
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return http.StatusConflict, fmt.Errorf("failed to marshal request body: %w", err)
+		}
+		reader = bytes.NewReader(data)
+	}
+
+	apiurl := fmt.Sprintf("%s%s", pamClient.Config.PcloudUrl, path)
+	req, err := http.NewRequestWithContext(ctx, method, apiurl, reader)
+	if err != nil {
+		return http.StatusConflict, fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	log.Printf("DEBUG: (pamDo) %s %s", method, path)
+	if err := pcloudRate.wait(ctx); err != nil {
+		return http.StatusBadGateway, fmt.Errorf("gave up waiting to send request: %w", err)
+	}
+	release, err := pcloudLimiter.acquire(ctx)
+	if err != nil {
+		return http.StatusBadGateway, fmt.Errorf("gave up waiting to send request: %w", err)
+	}
+	if err := pcloudBreaker.check(); err != nil {
+		release(statusCanceled)
+		return http.StatusServiceUnavailable, err
+	}
+	res, err := pamSend(pamClient, req)
+	if err != nil && errors.Is(ctx.Err(), context.Canceled) {
+		release(statusCanceled)
+		pcloudBreaker.abandon()
+		return http.StatusBadGateway, fmt.Errorf("request canceled: %w", err)
+	}
+	if err != nil {
+		release(0)
+		recordDependencyResult("pcloud", err)
+		return http.StatusBadGateway, fmt.Errorf("failed to send request. %s", err)
+	}
+	defer res.Body.Close()
+	release(res.StatusCode)
+	pcloudRate.throttled(res.StatusCode, res.Header)
+	pamSessions.rejected(res.StatusCode)
+	if res.StatusCode >= 500 {
+		recordDependencyResult("pcloud", fmt.Errorf("%s %s returned status %d", method, path, res.StatusCode))
+	} else {
+		recordDependencyResult("pcloud", nil)
+	}
+
+	respBody, err := io.ReadAll(res.Body)
+	if err != nil {
+		return res.StatusCode, fmt.Errorf("failed to read response body: %w", err)
+	}
+	if res.StatusCode >= 300 {
+		return res.StatusCode, checkMaintenance(fmt.Errorf("received non-200 status code(%d): %s", res.StatusCode, string(respBody)))
+	}
+	if out != nil && len(respBody) > 0 {
+		if err := json.Unmarshal(respBody, out); err != nil {
+			return res.StatusCode, fmt.Errorf("response format failed to parse: %s: %s", err.Error(), string(respBody))
+		}
+	}
+	return res.StatusCode, nil
+}
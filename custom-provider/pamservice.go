@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+
+	"github.com/davidh-cyberark/privilegeaccessmanager-sdk-go/pam"
+)
+
+// PAMService is the part of the Privilege Cloud API the safe and account handlers use. Handlers get
+// it from newPAMService, so tests can swap the SDK for a fake. Like the SDK, each call makes one
+// request and returns the HTTP status with the error; retries stay with the callers. Safe members
+// and the credential actions (change, verify, reconcile, versions) are not part of it; they stay
+// on the shared PAM client until a test needs to fake them.
+type PAMService interface {
+	// PCloudURL is the tenant's PCloud URL, used to build account resource IDs
+	PCloudURL() string
+	AddSafe(ctx context.Context, request pam.PostAddSafeRequest) (pam.PostAddSafeResponse, int, error)
+	GetSafeDetails(ctx context.Context, safeName string) (pam.GetSafeDetails, int, error)
+	DeleteSafe(ctx context.Context, safeName string) (int, error)
+	// UpdateSafe replaces a safe's settings; Update Safe takes all of them, not only the changed ones
+	UpdateSafe(ctx context.Context, safeURLID string, update map[string]interface{}) (int, error)
+	AddAccount(ctx context.Context, request pam.PostAddAccountRequest) (pam.PostAddAccountResponse, int, error)
+	// GetAccounts searches accounts with a PCloud filter, e.g. "safeName eq X"
+	GetAccounts(ctx context.Context, filter string) (*pam.GetAccountsResponse, int, error)
+	DeleteAccount(ctx context.Context, accountID string) (int, error)
+	// UpdateAccount applies JSON Patch operations to an account and returns the updated account
+	UpdateAccount(ctx context.Context, accountID string, ops []jsonPatchOperation) (pam.GetAccountResponse, int, error)
+	// RetrieveSecret returns an account's current secret; PCloud audits the retrieval with reason
+	RetrieveSecret(ctx context.Context, accountID, reason string) (string, int, error)
+}
+
+// newPAMService returns the service the handlers call; it is a variable so tests can replace it
+var newPAMService = func() (PAMService, error) {
+	pamClient, err := createPAMClient()
+	if err != nil {
+		return nil, err
+	}
+	return sdkPAMService{client: pamClient}, nil
+}
+
+// sdkPAMService is PAMService on the SDK client of the shared PAM session
+type sdkPAMService struct {
+	client *pam.Client
+}
+
+func (s sdkPAMService) PCloudURL() string {
+	return s.client.Config.PcloudUrl
+}
+
+func (s sdkPAMService) AddSafe(ctx context.Context, request pam.PostAddSafeRequest) (pam.PostAddSafeResponse, int, error) {
+	return pamAddSafe(ctx, s.client, request)
+}
+
+func (s sdkPAMService) GetSafeDetails(ctx context.Context, safeName string) (pam.GetSafeDetails, int, error) {
+	return pamGetSafeDetails(ctx, s.client, safeName)
+}
+
+// DeleteSafe calls the REST API directly, as the SDK has no DeleteSafe method
+func (s sdkPAMService) DeleteSafe(ctx context.Context, safeName string) (int, error) {
+	return pamDo(ctx, s.client, http.MethodDelete, fmt.Sprintf("/PasswordVault/API/Safes/%s/", url.PathEscape(safeName)), nil, nil)
+}
+
+// UpdateSafe calls the REST API directly, as the SDK has no UpdateSafe method
+func (s sdkPAMService) UpdateSafe(ctx context.Context, safeURLID string, update map[string]interface{}) (int, error) {
+	return pamDo(ctx, s.client, http.MethodPut, fmt.Sprintf("/PasswordVault/API/Safes/%s/", url.PathEscape(safeURLID)), update, nil)
+}
+
+func (s sdkPAMService) AddAccount(ctx context.Context, request pam.PostAddAccountRequest) (pam.PostAddAccountResponse, int, error) {
+	return pamAddAccount(ctx, s.client, request)
+}
+
+func (s sdkPAMService) GetAccounts(ctx context.Context, filter string) (*pam.GetAccountsResponse, int, error) {
+	return pamGetAccounts(ctx, s.client, filter)
+}
+
+// DeleteAccount calls the REST API directly, as the SDK has no DeleteAccount method
+func (s sdkPAMService) DeleteAccount(ctx context.Context, accountID string) (int, error) {
+	return pamDo(ctx, s.client, http.MethodDelete, fmt.Sprintf("/PasswordVault/API/Accounts/%s/", url.PathEscape(accountID)), nil, nil)
+}
+
+// UpdateAccount calls the REST API directly, as the SDK has no UpdateAccount method
+func (s sdkPAMService) UpdateAccount(ctx context.Context, accountID string, ops []jsonPatchOperation) (pam.GetAccountResponse, int, error) {
+	var updated pam.GetAccountResponse
+	status, err := pamDo(ctx, s.client, http.MethodPatch, fmt.Sprintf("/PasswordVault/API/Accounts/%s/", url.PathEscape(accountID)), ops, &updated)
+	return updated, status, err
+}
+
+// RetrieveSecret calls the REST API directly, as the SDK has no method to retrieve a secret
+func (s sdkPAMService) RetrieveSecret(ctx context.Context, accountID, reason string) (string, int, error) {
+	var secret string
+	status, err := pamDo(ctx, s.client, http.MethodPost, fmt.Sprintf("/PasswordVault/API/Accounts/%s/Password/Retrieve/", url.PathEscape(accountID)),
+		map[string]interface{}{"reason": reason}, &secret)
+	return secret, status, err
+}
@@ -0,0 +1,261 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/davidh-cyberark/privilegeaccessmanager-sdk-go/pam"
+)
+
+// mockPAMService is an in-memory PAMService. Like the SDK it reports PCloud errors in the status:
+// unknown safes and accounts are 404, an existing safe is 409 on AddSafe.
+type mockPAMService struct {
+	mu       sync.Mutex
+	safes    map[string]pam.GetSafeDetails
+	accounts map[string]pam.GetAccountResponse
+	nextID   int
+	calls    []string
+}
+
+func newMockPAMService() *mockPAMService {
+	return &mockPAMService{safes: map[string]pam.GetSafeDetails{}, accounts: map[string]pam.GetAccountResponse{}}
+}
+
+// useMockPAMService makes the handlers call m until the test ends
+func useMockPAMService(t *testing.T, m *mockPAMService) {
+	saved := newPAMService
+	newPAMService = func() (PAMService, error) { return m, nil }
+	t.Cleanup(func() { newPAMService = saved })
+}
+
+func (m *mockPAMService) record(call string) {
+	m.calls = append(m.calls, call)
+}
+
+func (m *mockPAMService) PCloudURL() string {
+	return "https://mock.privilegecloud.cyberark.cloud"
+}
+
+func (m *mockPAMService) AddSafe(ctx context.Context, request pam.PostAddSafeRequest) (pam.PostAddSafeResponse, int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.record("AddSafe " + request.SafeName)
+	if _, ok := m.safes[request.SafeName]; ok {
+		return pam.PostAddSafeResponse{}, http.StatusConflict, nil
+	}
+	m.safes[request.SafeName] = pam.GetSafeDetails{SafeURLID: request.SafeName, SafeName: request.SafeName, Description: request.Description, ManagingCPM: request.ManagingCPM}
+	return pam.PostAddSafeResponse{SafeURLID: request.SafeName, SafeName: request.SafeName, Description: request.Description, ManagingCPM: request.ManagingCPM}, http.StatusCreated, nil
+}
+
+func (m *mockPAMService) GetSafeDetails(ctx context.Context, safeName string) (pam.GetSafeDetails, int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.record("GetSafeDetails " + safeName)
+	safe, ok := m.safes[safeName]
+	if !ok {
+		return pam.GetSafeDetails{}, http.StatusNotFound, nil
+	}
+	return safe, http.StatusOK, nil
+}
+
+func (m *mockPAMService) DeleteSafe(ctx context.Context, safeName string) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.record("DeleteSafe " + safeName)
+	if _, ok := m.safes[safeName]; !ok {
+		return http.StatusNotFound, fmt.Errorf("safe %s does not exist", safeName)
+	}
+	delete(m.safes, safeName)
+	return http.StatusNoContent, nil
+}
+
+func (m *mockPAMService) AddAccount(ctx context.Context, request pam.PostAddAccountRequest) (pam.PostAddAccountResponse, int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.record("AddAccount " + request.SafeName + "/" + request.Name)
+	if _, ok := m.safes[request.SafeName]; !ok {
+		return pam.PostAddAccountResponse{}, http.StatusNotFound, nil
+	}
+	m.nextID++
+	id := fmt.Sprintf("12_%d", m.nextID)
+	m.accounts[id] = pam.GetAccountResponse{ID: id, Name: request.Name, SafeName: request.SafeName, Address: request.Address, UserName: request.UserName, PlatformID: request.PlatformID}
+	return pam.PostAddAccountResponse{ID: id, Name: request.Name, SafeName: request.SafeName, Address: request.Address, UserName: request.UserName, PlatformID: request.PlatformID}, http.StatusCreated, nil
+}
+
+func (m *mockPAMService) GetAccounts(ctx context.Context, filter string) (*pam.GetAccountsResponse, int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.record("GetAccounts " + filter)
+	safeName := strings.TrimPrefix(filter, "safeName eq ")
+	response := &pam.GetAccountsResponse{}
+	for _, account := range m.accounts {
+		if account.SafeName == safeName {
+			response.Value = append(response.Value, account)
+		}
+	}
+	response.Count = len(response.Value)
+	return response, http.StatusOK, nil
+}
+
+func (m *mockPAMService) DeleteAccount(ctx context.Context, accountID string) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.record("DeleteAccount " + accountID)
+	if _, ok := m.accounts[accountID]; !ok {
+		return http.StatusNotFound, fmt.Errorf("account %s does not exist", accountID)
+	}
+	delete(m.accounts, accountID)
+	return http.StatusNoContent, nil
+}
+
+func (m *mockPAMService) UpdateSafe(ctx context.Context, safeURLID string, update map[string]interface{}) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.record("UpdateSafe " + safeURLID)
+	safe, ok := m.safes[safeURLID]
+	if !ok {
+		return http.StatusNotFound, fmt.Errorf("safe %s does not exist", safeURLID)
+	}
+	if description, ok := update["description"].(string); ok {
+		safe.Description = description
+	}
+	m.safes[safeURLID] = safe
+	return http.StatusOK, nil
+}
+
+func (m *mockPAMService) UpdateAccount(ctx context.Context, accountID string, ops []jsonPatchOperation) (pam.GetAccountResponse, int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.record("UpdateAccount " + accountID)
+	account, ok := m.accounts[accountID]
+	if !ok {
+		return pam.GetAccountResponse{}, http.StatusNotFound, fmt.Errorf("account %s does not exist", accountID)
+	}
+	for _, op := range ops {
+		if op.Op == "replace" && op.Path == "/address" {
+			account.Address = op.Value.(string)
+		}
+	}
+	m.accounts[accountID] = account
+	return account, http.StatusOK, nil
+}
+
+func (m *mockPAMService) RetrieveSecret(ctx context.Context, accountID, reason string) (string, int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.record("RetrieveSecret " + accountID)
+	if _, ok := m.accounts[accountID]; !ok {
+		return "", http.StatusNotFound, fmt.Errorf("account %s does not exist", accountID)
+	}
+	return "secret-" + accountID, http.StatusOK, nil
+}
+
+func TestHandlersWithMockPAMService(t *testing.T) {
+	mock := newMockPAMService()
+	useMockPAMService(t, mock)
+	stateStore = newBufferedStateStore(newMemoryStateStore(), 0)
+	t.Cleanup(func() { recentlyCreated.Flush() })
+
+	safePath := CustomProviderRequestPath{Subscriptions: "sub1", ResourceGroups: "rg1", Providers: "Microsoft.CustomProviders",
+		ResourceProviders: "CyberArkProvider", ResourceTypeName: "safes", ResourceInstanceName: "safe1"}
+	accountPath := safePath
+	accountPath.ResourceTypeName, accountPath.ResourceInstanceName = "accounts", "safe1.root-web01"
+
+	call := func(handler providerHandler, method string, cpRequest CustomProviderRequestPath, body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		handler(w, httptest.NewRequest(method, "/", strings.NewReader(body)), cpRequest)
+		return w
+	}
+
+	if w := call(handleCreateSafe, http.MethodPut, safePath, `{"properties": {"safeName": "safe1", "description": "Linux root accounts"}}`); w.Code != http.StatusCreated {
+		t.Fatalf("create safe: expected 201, got %d: %s", w.Code, w.Body.String())
+	}
+	recentlyCreated.Flush()
+	w := call(handleGetSafe, http.MethodGet, safePath, "")
+	var safe CustomProviderResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &safe); w.Code != http.StatusOK || err != nil || safe.Properties["description"] != "Linux root accounts" {
+		t.Errorf("get safe: expected the created safe, got %d: %s", w.Code, w.Body.String())
+	}
+
+	if w := call(handleCreateAccount, http.MethodPut, accountPath, `{"properties": {"safeName": "safe1", "name": "root-web01", "platformId": "UnixSSH", "address": "web01", "userName": "root"}}`); w.Code != http.StatusCreated {
+		t.Fatalf("create account: expected 201, got %d: %s", w.Code, w.Body.String())
+	}
+	recentlyCreated.Flush()
+	if w := call(handleGetAccount, http.MethodGet, accountPath, ""); w.Code != http.StatusOK {
+		t.Errorf("get account: expected 200, got %d: %s", w.Code, w.Body.String())
+	}
+
+	if w := call(handleUpdateSafe, http.MethodPatch, safePath, `{"properties": {"description": "Linux root accounts (prod)"}}`); w.Code != http.StatusOK {
+		t.Errorf("update safe: expected 200, got %d: %s", w.Code, w.Body.String())
+	}
+	if got := mock.safes["safe1"].Description; got != "Linux root accounts (prod)" {
+		t.Errorf("update safe: expected the new description, got %q", got)
+	}
+	if w := call(handleUpdateAccount, http.MethodPatch, accountPath, `{"properties": {"address": "web01.example.com"}}`); w.Code != http.StatusOK {
+		t.Errorf("update account: expected 200, got %d: %s", w.Code, w.Body.String())
+	}
+	for _, account := range mock.accounts {
+		if account.Address != "web01.example.com" {
+			t.Errorf("update account: expected the new address, got %q", account.Address)
+		}
+	}
+
+	// Moving to another safe recreates the account there and removes the original
+	mock.safes["safe2"] = pam.GetSafeDetails{SafeURLID: "safe2", SafeName: "safe2"}
+	if w := call(handleUpdateAccount, http.MethodPatch, accountPath, `{"properties": {"safeName": "safe2"}}`); w.Code != http.StatusOK {
+		t.Errorf("move account: expected 200, got %d: %s", w.Code, w.Body.String())
+	}
+	if len(mock.accounts) != 1 {
+		t.Fatalf("move account: expected one account, got %v", mock.accounts)
+	}
+	for _, account := range mock.accounts {
+		if account.SafeName != "safe2" || account.Address != "web01.example.com" {
+			t.Errorf("move account: expected the account in safe2, got %+v", account)
+		}
+	}
+	delete(mock.safes, "safe2")
+
+	if w := call(handleDeleteAccount, http.MethodDelete, accountPath, ""); w.Code != http.StatusNoContent {
+		t.Errorf("delete account: expected 204, got %d: %s", w.Code, w.Body.String())
+	}
+	if w := call(handleDeleteSafe, http.MethodDelete, safePath, ""); w.Code != http.StatusNoContent {
+		t.Errorf("delete safe: expected 204, got %d: %s", w.Code, w.Body.String())
+	}
+	if len(mock.safes) != 0 || len(mock.accounts) != 0 {
+		t.Errorf("expected the safe and account to be deleted, got %v %v", mock.safes, mock.accounts)
+	}
+	if w := call(handleGetSafe, http.MethodGet, safePath, ""); w.Code != http.StatusNotFound {
+		t.Errorf("get deleted safe: expected 404, got %d: %s", w.Code, w.Body.String())
+	}
+}
+
+// stalledPAMService never gets an answer from PCloud: its calls wait for the request to end
+type stalledPAMService struct {
+	*mockPAMService
+}
+
+func (s stalledPAMService) GetSafeDetails(ctx context.Context, safeName string) (pam.GetSafeDetails, int, error) {
+	<-ctx.Done()
+	return pam.GetSafeDetails{}, 0, ctx.Err()
+}
+
+func TestGetSafeWithoutUpstreamStatus(t *testing.T) {
+	saved := newPAMService
+	newPAMService = func() (PAMService, error) { return stalledPAMService{newMockPAMService()}, nil }
+	defer func() { newPAMService = saved }()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	w := httptest.NewRecorder()
+	handleGetSafe(w, httptest.NewRequest(http.MethodGet, "/", nil).WithContext(ctx), CustomProviderRequestPath{ResourceTypeName: "safes", ResourceInstanceName: "stalled"})
+	if w.Code != http.StatusBadGateway {
+		t.Errorf("expected 502 for a call that never got a status, got %d: %s", w.Code, w.Body.String())
+	}
+}
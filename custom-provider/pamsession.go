@@ -0,0 +1,250 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/davidh-cyberark/privilegeaccessmanager-sdk-go/pam"
+)
+
+// Handlers share one PAM client and session instead of authenticating to the identity tenant on
+// every ARM request. The session is replaced when it is about to expire, when the credentials
+// change (e.g. a password rotated in Key Vault), or when PCloud answers 401. A pam.Client is never
+// modified once it is handed out, so concurrent requests can use it while a new one is created.
+// Credentials from a secret store are also re-read every CREDENTIALS_REFRESH_INTERVAL, so a
+// rotated password replaces the session before the old one is rejected.
+
+// pamSessionRefreshMargin is how long before its expiry a session is replaced
+const pamSessionRefreshMargin = time.Minute
+
+// pamSessionManager caches the current PAM client
+type pamSessionManager struct {
+	mu      sync.Mutex
+	client  *pam.Client
+	creds   pcloudCredentials
+	created time.Time
+}
+
+var pamSessions = &pamSessionManager{}
+
+func init() {
+	registerFlusher("pamSession", pamSessions.Flush)
+}
+
+// createPAMClient returns a PAM client with a valid session, shared between requests
+func createPAMClient() (*pam.Client, error) {
+	// Validate all required environment variables first
+	if err := validEnvVars(); err != nil {
+		log.Printf("ERROR: Environment validation failed: %v", err)
+		return nil, err
+	}
+	return pamSessions.get()
+}
+
+// get returns the cached client, or opens a new session; callers arriving while a session is
+// being opened wait for it instead of authenticating themselves
+func (m *pamSessionManager) get() (*pam.Client, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	creds, err := credentials.Credentials()
+	if err != nil {
+		log.Printf("ERROR: Could not get credentials from %s: %v", credentials.Name(), err)
+		return nil, fmt.Errorf("could not get credentials from %s: %w", credentials.Name(), err)
+	}
+	reason := "initial"
+	switch {
+	case m.client == nil && !m.created.IsZero():
+		reason = "invalidated"
+	case m.client == nil:
+	case m.creds != creds:
+		reason = "credentialsChanged"
+	case time.Until(m.client.Session.Expiration) <= pamSessionRefreshMargin:
+		reason = "expiring"
+	default:
+		return m.client, nil
+	}
+
+	client, creds, err := openPAMClient()
+	if err != nil {
+		pamSessionErrorsTotal.Inc()
+		return nil, err
+	}
+	pamSessionRefreshesTotal.Inc("reason", reason)
+	m.client, m.creds, m.created = client, creds, time.Now()
+	return client, nil
+}
+
+// refresh opens a new session and replaces the cached one when that succeeds; the current session
+// stays in use while it is opened
+func (m *pamSessionManager) refresh(reason string) error {
+	client, creds, err := openPAMClient()
+	if err != nil {
+		pamSessionErrorsTotal.Inc()
+		return err
+	}
+	pamSessionRefreshesTotal.Inc("reason", reason)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.client, m.creds, m.created = client, creds, time.Now()
+	return nil
+}
+
+// lastRefresh returns when the cached session was opened, zero when there is none
+func (m *pamSessionManager) lastRefresh() time.Time {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.client == nil {
+		return time.Time{}
+	}
+	return m.created
+}
+
+// invalidate drops the cached session so the next request authenticates again
+func (m *pamSessionManager) invalidate() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.client != nil {
+		log.Printf("WARNING: PCloud rejected the cached session, authenticating again on the next request")
+		m.client = nil
+	}
+}
+
+// rejected drops the session when PCloud answered a call with 401, and the cached credentials with
+// it, so the next session is opened with the secret store's current ones
+func (m *pamSessionManager) rejected(status int) {
+	if status == http.StatusUnauthorized {
+		m.invalidate()
+		credentials.Invalidate()
+	}
+}
+
+// reloadCredentials re-reads the credentials from the secret store and, when they changed since
+// the cached session was opened, replaces the session. It reports whether it did.
+func (m *pamSessionManager) reloadCredentials() (bool, error) {
+	m.mu.Lock()
+	cached, current := m.client != nil, m.creds
+	m.mu.Unlock()
+	if !cached || !credentials.Invalidate() {
+		return false, nil
+	}
+	creds, err := credentials.Credentials()
+	if err != nil {
+		return false, err
+	}
+	if creds == current {
+		return false, nil
+	}
+	log.Printf("INFO: Credentials from %s changed, opening a new PCloud session", credentials.Name())
+	return true, m.refresh("credentialsChanged")
+}
+
+// watchCredentials calls reloadCredentials every interval
+func (m *pamSessionManager) watchCredentials(interval time.Duration) {
+	go func() {
+		for range time.Tick(interval) {
+			if _, err := m.reloadCredentials(); err != nil {
+				log.Printf("WARNING: Could not reload credentials from %s: %v", credentials.Name(), err)
+			}
+		}
+	}()
+}
+
+// credentialsRefreshInterval is read from CREDENTIALS_REFRESH_INTERVAL (Go duration, default 5m); 0 turns the reload off
+func credentialsRefreshInterval() time.Duration {
+	return policyDuration("CREDENTIALS_REFRESH_INTERVAL", "5m")
+}
+
+// credentialsRejected reports whether the identity tenant refused a session because of the
+// credentials: 401 or 403, or an OAuth error naming the client or grant, which it answers with 400
+func credentialsRejected(status int, err error) bool {
+	switch status {
+	case http.StatusUnauthorized, http.StatusForbidden:
+		return true
+	case http.StatusBadRequest:
+		return err != nil && (strings.Contains(err.Error(), "invalid_client") || strings.Contains(err.Error(), "invalid_grant") ||
+			strings.Contains(err.Error(), "unauthorized_client"))
+	}
+	return false
+}
+
+// Flush drops the cached session
+func (m *pamSessionManager) Flush() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.client == nil {
+		return 0
+	}
+	m.client = nil
+	return 1
+}
+
+// details describes the cached session for the /healthex dependency report
+func (m *pamSessionManager) details() map[string]interface{} {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.client == nil {
+		return map[string]interface{}{"session": "none"}
+	}
+	return map[string]interface{}{
+		"session":          "cached",
+		"sessionAge":       time.Since(m.created).Round(time.Second).String(),
+		"sessionExpiresIn": time.Until(m.client.Session.Expiration).Round(time.Second).String(),
+	}
+}
+
+// openPAMClient authenticates to the identity tenant and returns a client with a new session and
+// the credentials it was opened with. The session is shared, so the token request is bounded by
+// PAM_CALL_TIMEOUT rather than by the context of the request that happens to open it.
+func openPAMClient() (*pam.Client, pcloudCredentials, error) {
+	log.Printf("DEBUG: Creating PAM client")
+	if err := identityBreaker.check(); err != nil {
+		return nil, pcloudCredentials{}, err
+	}
+
+	for attempt := 1; ; attempt++ {
+		creds, err := credentials.Credentials()
+		if err != nil {
+			log.Printf("ERROR: Could not get credentials from %s: %v", credentials.Name(), err)
+			identityBreaker.abandon()
+			return nil, creds, fmt.Errorf("could not get credentials from %s: %w", credentials.Name(), err)
+		}
+
+		log.Printf("DEBUG: Credentials loaded from %s - ID Tenant URL: %s, PCloud URL: %s, User: %s",
+			credentials.Name(), creds.IDTenantURL, creds.PCloudURL, creds.User)
+
+		registerSensitiveValue(creds.Password)
+		config := pam.NewConfig(creds.IDTenantURL, creds.PCloudURL, creds.User, creds.Password)
+		client := pam.NewClient(creds.PCloudURL, config)
+
+		ctx, cancel := policyFor("").attemptContext(context.Background())
+		session, status, err := openPAMSession(ctx, client)
+		cancel()
+		if err == nil && status >= 300 {
+			err = fmt.Errorf("failed to get session token: %d", status)
+		}
+		// Credentials from a secret store may have been rotated since they were cached
+		if credentialsRejected(status, err) && attempt == 1 && renewCredentials() {
+			log.Printf("WARNING: PCloud rejected the credentials from %s, reading them again", credentials.Name())
+			continue
+		}
+		if err != nil {
+			errMsg := fmt.Errorf("could not refresh session: %s", err.Error())
+			log.Printf("ERROR: %s", errMsg.Error())
+			recordDependencyResult("pcloud", errMsg)
+			identityBreaker.record(errMsg)
+			return nil, creds, checkMaintenance(errMsg)
+		}
+		registerSensitiveValue(session.Token)
+		client.Session = session
+		recordDependencyResult("pcloud", nil)
+		identityBreaker.record(nil)
+		log.Printf("DEBUG: PAM client created successfully, session expires %s", session.Expiration.Format(time.RFC3339))
+		return client, creds, nil
+	}
+}
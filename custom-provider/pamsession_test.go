@@ -0,0 +1,156 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+func TestPAMSessionSharing(t *testing.T) {
+	var tokens atomic.Int32
+	expiresIn := "3600"
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/oauth2/platformtoken" {
+			tokens.Add(1)
+			w.Write([]byte(`{"access_token": "pcloud-token", "token_type": "Bearer", "expires_in": ` + expiresIn + `}`))
+			return
+		}
+		w.WriteHeader(http.StatusUnauthorized)
+	}))
+	defer server.Close()
+
+	t.Setenv("IDTENANTURL", server.URL)
+	t.Setenv("PCLOUDURL", server.URL)
+	t.Setenv("PAMUSER", "session-user")
+	t.Setenv("PAMPASS", "session-pass")
+	pamSessions.Flush()
+	defer pamSessions.Flush()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := createPAMClient(); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+	if got := tokens.Load(); got != 1 {
+		t.Fatalf("expected concurrent requests to share one session, got %d authentications", got)
+	}
+
+	// A 401 from PCloud drops the session
+	client, _ := createPAMClient()
+	if status, _ := pamDo(context.Background(), client, http.MethodGet, "/PasswordVault/API/Safes/safe1", nil, nil); status != http.StatusUnauthorized {
+		t.Fatalf("expected 401, got %d", status)
+	}
+	createPAMClient()
+	if got := tokens.Load(); got != 2 {
+		t.Errorf("expected a new session after a 401, got %d authentications", got)
+	}
+
+	// A session about to expire is replaced
+	pamSessions.Flush()
+	expiresIn = "30"
+	createPAMClient()
+	createPAMClient()
+	if got := tokens.Load(); got != 4 {
+		t.Errorf("expected a session expiring within the refresh margin to be replaced, got %d authentications", got)
+	}
+
+	// New credentials open a new session
+	expiresIn = "3600"
+	t.Setenv("PAMPASS", "rotated-pass")
+	createPAMClient()
+	createPAMClient()
+	if got := tokens.Load(); got != 5 {
+		t.Errorf("expected one new session for the new credentials, got %d authentications", got)
+	}
+}
+
+// rotatingCredentialSource stands in for a secret store whose password is rotated
+type rotatingCredentialSource struct {
+	mu    sync.Mutex
+	creds pcloudCredentials
+}
+
+func (s *rotatingCredentialSource) Name() string                { return "rotating" }
+func (s *rotatingCredentialSource) Check() error                { return nil }
+func (s *rotatingCredentialSource) Invalidate() bool            { return true }
+func (s *rotatingCredentialSource) Describe() map[string]string { return nil }
+
+func (s *rotatingCredentialSource) Credentials() (pcloudCredentials, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.creds, nil
+}
+
+func TestPAMSessionReloadCredentials(t *testing.T) {
+	var tokens atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		tokens.Add(1)
+		w.Write([]byte(`{"access_token": "pcloud-token", "token_type": "Bearer", "expires_in": 3600}`))
+	}))
+	defer server.Close()
+
+	t.Setenv("IDTENANTURL", server.URL)
+	t.Setenv("PCLOUDURL", server.URL)
+	t.Setenv("PAMUSER", "session-user")
+	t.Setenv("PAMPASS", "session-pass")
+	source := &rotatingCredentialSource{creds: pcloudCredentials{IDTenantURL: server.URL, PCloudURL: server.URL, User: "session-user", Password: "old-pass"}}
+	saved := credentials
+	credentials = source
+	defer func() { credentials = saved }()
+	pamSessions.Flush()
+	defer pamSessions.Flush()
+
+	// Nothing to replace without a session
+	if reloaded, err := pamSessions.reloadCredentials(); reloaded || err != nil {
+		t.Fatalf("expected no reload without a session, got %v %v", reloaded, err)
+	}
+	if _, err := createPAMClient(); err != nil {
+		t.Fatal(err)
+	}
+	if reloaded, _ := pamSessions.reloadCredentials(); reloaded {
+		t.Error("expected unchanged credentials to keep the session")
+	}
+
+	source.mu.Lock()
+	source.creds.Password = "new-pass"
+	source.mu.Unlock()
+	if reloaded, err := pamSessions.reloadCredentials(); !reloaded || err != nil {
+		t.Fatalf("expected rotated credentials to replace the session, got %v %v", reloaded, err)
+	}
+	if got := tokens.Load(); got != 2 {
+		t.Errorf("expected 2 authentications, got %d", got)
+	}
+	if pamSessions.creds.Password != "new-pass" {
+		t.Errorf("expected the session to be opened with the rotated password")
+	}
+}
+
+func TestCredentialsRejected(t *testing.T) {
+	tests := []struct {
+		status int
+		err    error
+		want   bool
+	}{
+		{http.StatusUnauthorized, nil, true},
+		{http.StatusForbidden, nil, true},
+		{http.StatusBadRequest, errors.New("error getting token: (invalid_client) authentication failed"), true},
+		{http.StatusBadRequest, errors.New("error getting token: (invalid_request) missing grant_type"), false},
+		{http.StatusServiceUnavailable, errors.New("maintenance"), false},
+		{http.StatusOK, nil, false},
+	}
+	for _, tt := range tests {
+		if got := credentialsRejected(tt.status, tt.err); got != tt.want {
+			t.Errorf("credentialsRejected(%d, %v) = %v, want %v", tt.status, tt.err, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/davidh-cyberark/privilegeaccessmanager-sdk-go/pam"
+)
+
+// PlatformProperty is a property a platform requires or accepts on its accounts
+type PlatformProperty struct {
+	Name        string `json:"name"`
+	DisplayName string `json:"displayName,omitempty"`
+}
+
+// PlatformResourceProperties is the properties block of a platforms resource
+type PlatformResourceProperties struct {
+	PlatformID         string             `json:"platformId"`
+	Name               string             `json:"name"`
+	SystemType         string             `json:"systemType,omitempty"`
+	PlatformType       string             `json:"platformType,omitempty"`
+	PlatformBaseID     string             `json:"platformBaseId,omitempty"`
+	Description        string             `json:"description,omitempty"`
+	Active             bool               `json:"active"`
+	RequiredProperties []PlatformProperty `json:"requiredProperties"`
+	OptionalProperties []PlatformProperty `json:"optionalProperties"`
+	ProvisioningState  string             `json:"provisioningState,omitempty"`
+}
+
+// ListPlatformsRequest is the body of the listPlatforms action; every filter is optional
+type ListPlatformsRequest struct {
+	Active       *bool  `json:"active,omitempty"`
+	SystemType   string `json:"systemType,omitempty"`
+	PlatformType string `json:"platformType,omitempty"`
+}
+
+// handlePlatform serves the read-only platforms resource type. A PUT creates nothing: it checks
+// that the platform exists and is active, so a template that references a platform fails before
+// any account is added, and a DELETE leaves the platform in PCloud.
+func handlePlatform(w http.ResponseWriter, r *http.Request, cpRequest CustomProviderRequestPath) {
+	LogRequestDebug("Platform", r)
+
+	switch r.Method {
+	case "PUT":
+		handleGetPlatform(w, r, cpRequest, true)
+	case "GET":
+		handleGetPlatform(w, r, cpRequest, false)
+	case "DELETE":
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		sendJSONError(w, http.StatusMethodNotAllowed, "MethodNotAllowed", fmt.Sprintf("Method %s is not supported for platforms", r.Method))
+	}
+}
+
+// handleGetPlatform returns the platform named by the request path; requireActive rejects
+// inactive platforms
+func handleGetPlatform(w http.ResponseWriter, r *http.Request, cpRequest CustomProviderRequestPath, requireActive bool) {
+	stopPAM := startPhase(r, "pam")
+	platform, found, err := platforms.Lookup(r, cpRequest.ResourceInstanceName)
+	stopPAM()
+	if err != nil {
+		sendJSONError(w, http.StatusBadGateway, "GetPlatformsError", fmt.Sprintf("Failed to read platforms: %v", checkMaintenance(err)))
+		return
+	}
+	if !found {
+		sendJSONError(w, http.StatusNotFound, "PlatformNotFound", fmt.Sprintf("Platform %s does not exist in Privilege Cloud", cpRequest.ResourceInstanceName))
+		return
+	}
+	if requireActive && !platform.General.Active {
+		sendJSONError(w, http.StatusConflict, "PlatformInactive", fmt.Sprintf("Platform %s is not active; activate it in Privilege Cloud or choose another platform", platform.General.ID))
+		return
+	}
+
+	properties, err := toProperties(platformResourceProperties(platform))
+	if err != nil {
+		sendJSONError(w, http.StatusInternalServerError, "PlatformMarshalError", err.Error())
+		return
+	}
+	sendJSONResource(w, r, http.StatusOK, CustomProviderResponse{
+		ID:         cpRequest.ID(),
+		Name:       cpRequest.ResourceInstanceName,
+		Type:       fmt.Sprintf("Microsoft.CustomProviders/resourceProviders/%s", cpRequest.ResourceTypeName),
+		Properties: properties,
+	})
+}
+
+// handleListPlatforms handles a collection GET on platforms: every platform in PCloud
+func handleListPlatforms(w http.ResponseWriter, r *http.Request, cpRequest CustomProviderRequestPath) {
+	LogRequestDebug("ListPlatforms", r)
+
+	stopPAM := startPhase(r, "pam")
+	all, err := platforms.List(r)
+	stopPAM()
+	if err != nil {
+		sendJSONError(w, http.StatusBadGateway, "GetPlatformsError", fmt.Sprintf("Failed to read platforms: %v", checkMaintenance(err)))
+		return
+	}
+
+	response := CustomProviderListResponse{Value: []CustomProviderResponse{}}
+	for _, platform := range all {
+		properties, err := toProperties(platformResourceProperties(platform))
+		if err != nil {
+			sendJSONError(w, http.StatusInternalServerError, "PlatformMarshalError", err.Error())
+			return
+		}
+		response.Value = append(response.Value, CustomProviderResponse{
+			ID:         cpRequest.ID() + "/" + platform.General.ID,
+			Name:       platform.General.ID,
+			Type:       fmt.Sprintf("Microsoft.CustomProviders/resourceProviders/%s", cpRequest.ResourceTypeName),
+			Properties: properties,
+		})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// handleListPlatformsAction lists platforms matching the request's filters. Being named list*, it
+// can be called from a template with the list functions.
+func handleListPlatformsAction(w http.ResponseWriter, r *http.Request, cpRequest CustomProviderRequestPath) {
+	LogRequestDebug("ListPlatformsAction", r)
+
+	var request ListPlatformsRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil && err != io.EOF {
+		sendJSONError(w, http.StatusBadRequest, "InvalidRequestBody", fmt.Sprintf("Invalid request body: %v", err))
+		return
+	}
+
+	stopPAM := startPhase(r, "pam")
+	all, err := platforms.List(r)
+	stopPAM()
+	if err != nil {
+		sendJSONError(w, http.StatusBadGateway, "GetPlatformsError", fmt.Sprintf("Failed to read platforms: %v", checkMaintenance(err)))
+		return
+	}
+
+	value := []PlatformResourceProperties{}
+	for _, platform := range all {
+		if request.Active != nil && platform.General.Active != *request.Active {
+			continue
+		}
+		if request.SystemType != "" && !strings.EqualFold(platform.General.SystemType, request.SystemType) {
+			continue
+		}
+		if request.PlatformType != "" && !strings.EqualFold(platform.General.PlatformType, request.PlatformType) {
+			continue
+		}
+		properties := platformResourceProperties(platform)
+		properties.ProvisioningState = ""
+		value = append(value, properties)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"value": value})
+}
+
+// platformResourceProperties converts a PCloud platform to the resource's properties
+func platformResourceProperties(platform pam.Platform) PlatformResourceProperties {
+	properties := PlatformResourceProperties{
+		PlatformID:         platform.General.ID,
+		Name:               platform.General.Name,
+		SystemType:         platform.General.SystemType,
+		PlatformType:       platform.General.PlatformType,
+		PlatformBaseID:     platform.General.PlatformBaseID,
+		Description:        platform.General.Description,
+		Active:             platform.General.Active,
+		RequiredProperties: []PlatformProperty{},
+		OptionalProperties: []PlatformProperty{},
+		ProvisioningState:  "Succeeded",
+	}
+	for _, property := range platform.Properties.Required {
+		properties.RequiredProperties = append(properties.RequiredProperties, PlatformProperty{property.Name, property.DisplayName})
+	}
+	for _, property := range platform.Properties.Optional {
+		properties.OptionalProperties = append(properties.OptionalProperties, PlatformProperty{property.Name, property.DisplayName})
+	}
+	return properties
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/davidh-cyberark/privilegeaccessmanager-sdk-go/pam"
+)
+
+// platformCache holds the PCloud platform list, keyed by lowercased platform ID and refreshed
+// from PCloud after ttl
+type platformCache struct {
+	ttl       time.Duration
+	mu        sync.Mutex
+	platforms map[string]pam.Platform
+	fetched   time.Time
+}
+
+// platforms is shared by the handlers; PLATFORM_CACHE_TTL (default 10m) controls freshness
+var platforms = newPlatformCache(platformCacheTTL())
+
+func init() {
+	registerFlusher("platforms", platforms.Flush)
+}
+
+func platformCacheTTL() time.Duration {
+	ttl, err := time.ParseDuration(getEnvOrDefault("PLATFORM_CACHE_TTL", "10m"))
+	if err != nil {
+		log.Printf("WARNING: Invalid PLATFORM_CACHE_TTL, using 10m: %v", err)
+		return 10 * time.Minute
+	}
+	return ttl
+}
+
+func newPlatformCache(ttl time.Duration) *platformCache {
+	return &platformCache{ttl: ttl}
+}
+
+// Lookup returns the platform with the ID. Platform IDs are case-insensitive in PCloud.
+func (c *platformCache) Lookup(r *http.Request, platformID string) (pam.Platform, bool, error) {
+	list, err := c.load(r)
+	if err != nil {
+		return pam.Platform{}, false, err
+	}
+	platform, found := list[strings.ToLower(platformID)]
+	return platform, found, nil
+}
+
+// List returns every platform, ordered by ID
+func (c *platformCache) List(r *http.Request) ([]pam.Platform, error) {
+	list, err := c.load(r)
+	if err != nil {
+		return nil, err
+	}
+	all := make([]pam.Platform, 0, len(list))
+	for _, platform := range list {
+		all = append(all, platform)
+	}
+	sort.Slice(all, func(i, j int) bool {
+		return strings.ToLower(all[i].General.ID) < strings.ToLower(all[j].General.ID)
+	})
+	return all, nil
+}
+
+// load returns the cached platform list, reading it from PCloud when it is missing or stale
+func (c *platformCache) load(r *http.Request) (map[string]pam.Platform, error) {
+	c.mu.Lock()
+	if c.platforms != nil && time.Since(c.fetched) < c.ttl {
+		list := c.platforms
+		c.mu.Unlock()
+		return list, nil
+	}
+	c.mu.Unlock()
+
+	pamClient, err := createPAMClient()
+	if err != nil {
+		return nil, err
+	}
+	span := startSpan(r, "GetPlatforms")
+	resp, _, err := pcloudRetry(r.Context(), "accounts", "GetPlatforms", true, func(ctx context.Context) (pam.GetPlatformsResponse, int, error) {
+		return pamGetPlatforms(ctx, pamClient)
+	})
+	span.End(err)
+	if err != nil {
+		return nil, err
+	}
+
+	list := make(map[string]pam.Platform, len(resp.Platforms))
+	for _, platform := range resp.Platforms {
+		list[strings.ToLower(platform.General.ID)] = platform
+	}
+	c.mu.Lock()
+	c.platforms = list
+	c.fetched = time.Now()
+	c.mu.Unlock()
+	return list, nil
+}
+
+// Flush drops the cached platform list and returns the number of platforms dropped
+func (c *platformCache) Flush() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	dropped := len(c.platforms)
+	c.platforms = nil
+	return dropped
+}
+
+// validatePlatformProperties checks a new account against its platform: the platform must exist
+// and be active, and every property the platform requires must be set. Address and Username are
+// account fields rather than platformAccountProperties entries, and Password is the account's
+// secret, which PCloud can generate. When the platform list cannot be read the account is not
+// checked here and PCloud has the last word.
+func validatePlatformProperties(r *http.Request, properties pam.PostAddAccountRequest) []ErrorDetails {
+	platform, found, err := platforms.Lookup(r, properties.PlatformID)
+	if err != nil {
+		log.Printf("WARNING: Failed to read platforms, not checking the properties of platform %s: %v", properties.PlatformID, err)
+		return nil
+	}
+	if !found {
+		return []ErrorDetails{{
+			Code:    "PlatformNotFound",
+			Target:  "properties.platformId",
+			Message: fmt.Sprintf("Platform %s does not exist in Privilege Cloud", properties.PlatformID),
+		}}
+	}
+	if !platform.General.Active {
+		return []ErrorDetails{{
+			Code:    "PlatformInactive",
+			Target:  "properties.platformId",
+			Message: fmt.Sprintf("Platform %s is not active; activate it in Privilege Cloud or choose another platform", properties.PlatformID),
+		}}
+	}
+
+	accountFields := map[string]struct{ target, value string }{
+		"address":  {"properties.address", properties.Address},
+		"username": {"properties.userName", properties.UserName},
+	}
+	set := map[string]bool{}
+	for key, value := range properties.PlatformAccountProperties {
+		if value != "" {
+			set[strings.ToLower(key)] = true
+		}
+	}
+
+	var details []ErrorDetails
+	for _, required := range platform.Properties.Required {
+		name := strings.ToLower(required.Name)
+		if name == "password" {
+			continue
+		}
+		displayName := required.DisplayName
+		if displayName == "" {
+			displayName = required.Name
+		}
+		if field, ok := accountFields[name]; ok {
+			if field.value == "" {
+				details = append(details, ErrorDetails{
+					Code:    "PropertyRequired",
+					Target:  field.target,
+					Message: fmt.Sprintf("Platform %s requires %s (%s)", platform.General.ID, field.target, displayName),
+				})
+			}
+			continue
+		}
+		if !set[name] {
+			target := "properties.platformAccountProperties." + required.Name
+			details = append(details, ErrorDetails{
+				Code:    "PropertyRequired",
+				Target:  target,
+				Message: fmt.Sprintf("Platform %s requires %s (%s)", platform.General.ID, target, displayName),
+			})
+		}
+	}
+	return details
+}
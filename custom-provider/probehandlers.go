@@ -0,0 +1,74 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// registerProbeRoutes adds the /probe endpoints for external tooling (e.g. CI pipelines gating on PAM state).
+// They are outside the ARM header flow and are disabled unless PROBE_TOKEN is set.
+func registerProbeRoutes(r *mux.Router) {
+	if os.Getenv("PROBE_TOKEN") == "" {
+		log.Printf("INFO: PROBE_TOKEN not set, probe endpoints are disabled")
+		return
+	}
+
+	probe := r.PathPrefix("/probe").Subrouter()
+	probe.Use(probeAuthMiddleware)
+	probe.HandleFunc("/accounts", handleProbeAccount).Methods("GET")
+}
+
+// probeAuthMiddleware requires "Authorization: Bearer $PROBE_TOKEN"
+func probeAuthMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		expected := os.Getenv("PROBE_TOKEN")
+		if expected == "" || subtle.ConstantTimeCompare([]byte(token), []byte(expected)) != 1 {
+			log.Printf("WARNING: Rejected probe request - Method: %s, URL: %s, RemoteAddr: %s", r.Method, r.URL.Path, r.RemoteAddr)
+			sendJSONError(w, http.StatusUnauthorized, "Unauthorized", "Probe token is missing or invalid")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// handleProbeAccount answers GET /probe/accounts?safeName=X&accountName=Y with 200 when the
+// account exists and 404 when it does not, using the per-safe account index
+func handleProbeAccount(w http.ResponseWriter, r *http.Request) {
+	LogRequestDebug("ProbeAccount", r)
+
+	safeName := r.URL.Query().Get("safeName")
+	accountName := r.URL.Query().Get("accountName")
+	if safeName == "" || accountName == "" {
+		sendJSONError(w, http.StatusBadRequest, "InvalidQuery", "safeName and accountName query parameters are required")
+		return
+	}
+
+	id, found, cached, err := accountIndex.Lookup(r, safeName, accountName)
+	if err != nil {
+		sendJSONError(w, http.StatusBadGateway, "GetAccountsError", err.Error())
+		return
+	}
+
+	response := map[string]interface{}{
+		"safeName":    safeName,
+		"accountName": accountName,
+		"exists":      found,
+		"cached":      cached,
+	}
+	if found {
+		response["accountId"] = id
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if !found {
+		w.WriteHeader(http.StatusNotFound)
+	}
+	json.NewEncoder(w).Encode(response)
+}
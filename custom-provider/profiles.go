@@ -0,0 +1,98 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/davidh-cyberark/privilegeaccessmanager-sdk-go/pam"
+)
+
+// SafeProfile is a named set of organizational defaults applied to a safe on creation
+type SafeProfile struct {
+	ManagingCPM               string                     `json:"managingCPM,omitempty"`
+	Location                  string                     `json:"location,omitempty"`
+	NumberOfDaysRetention     int                        `json:"numberOfDaysRetention,omitempty"`
+	NumberOfVersionsRetention int                        `json:"numberOfVersionsRetention,omitempty"`
+	OlacEnabled               bool                       `json:"olacEnabled,omitempty"`
+	AutoPurgeEnabled          bool                       `json:"autoPurgeEnabled,omitempty"`
+	Members                   []pam.PostAddMemberRequest `json:"members,omitempty"`
+}
+
+// safeProfiles is loaded once at startup by loadSafeProfiles
+var safeProfiles = map[string]SafeProfile{}
+
+// loadSafeProfiles reads the profiles from SAFE_PROFILES_FILE (a JSON object keyed by profile name),
+// or inline JSON in SAFE_PROFILES. Neither being set means no profiles are available.
+func loadSafeProfiles() error {
+	data := []byte(os.Getenv("SAFE_PROFILES"))
+	if path := os.Getenv("SAFE_PROFILES_FILE"); path != "" {
+		var err error
+		data, err = os.ReadFile(path)
+		if err != nil {
+			return fmt.Errorf("failed to read SAFE_PROFILES_FILE: %w", err)
+		}
+	}
+	if len(data) == 0 {
+		return nil
+	}
+
+	profiles := map[string]SafeProfile{}
+	if err := json.Unmarshal(data, &profiles); err != nil {
+		return fmt.Errorf("failed to parse safe profiles: %w", err)
+	}
+	safeProfiles = profiles
+
+	for name, profile := range profiles {
+		log.Printf("INFO: Loaded safe profile %s - CPM: %s, Retention days: %d, OLAC: %t, Members: %d",
+			name, profile.ManagingCPM, profile.NumberOfDaysRetention, profile.OlacEnabled, len(profile.Members))
+	}
+	return nil
+}
+
+// applySafeProfile fills in the add safe request from the named profile
+func applySafeProfile(request *pam.PostAddSafeRequest, name string) (SafeProfile, error) {
+	profile, ok := safeProfiles[name]
+	if !ok {
+		return profile, fmt.Errorf("unknown safe profile %q", name)
+	}
+	request.ManagingCPM = profile.ManagingCPM
+	request.Location = profile.Location
+	request.NumberOfDaysRetention = profile.NumberOfDaysRetention
+	request.NumberOfVersionsRetention = profile.NumberOfVersionsRetention
+	request.OlacEnabled = profile.OlacEnabled
+	request.AutoPurgeEnabled = profile.AutoPurgeEnabled
+	return profile, nil
+}
+
+// addProfileMembers adds a profile's members to a safe; with onlyMissing, members the safe already
+// has are skipped. Members are not part of PAMService, so the PAM client is only opened when needed.
+func addProfileMembers(ctx context.Context, safeURLID string, members []pam.PostAddMemberRequest, onlyMissing bool) error {
+	if len(members) == 0 {
+		return nil
+	}
+	pamClient, err := createPAMClient()
+	if err != nil {
+		return err
+	}
+	if onlyMissing {
+		members = missingMembers(ctx, pamClient, safeURLID, members)
+	}
+	return addSafeMembers(ctx, pamClient, safeURLID, members)
+}
+
+// addSafeMembers adds each member to the newly created safe
+func addSafeMembers(ctx context.Context, pamClient *pam.Client, safeURLID string, members []pam.PostAddMemberRequest) error {
+	for _, member := range members {
+		log.Printf("DEBUG: Adding member %s to safe %s", member.MemberName, safeURLID)
+		_, statusCode, err := pcloudRetry(ctx, "members", "AddSafeMember", false, func(ctx context.Context) (pam.PostAddMemberResponse, int, error) {
+			return pamAddSafeMember(ctx, pamClient, member, safeURLID)
+		})
+		if err != nil {
+			return fmt.Errorf("failed to add member %s: (%d) %w", member.MemberName, statusCode, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// On top of the adaptive concurrency limit, calls to PCloud can be held to a request rate: a token
+// bucket refilled at PCLOUD_RATE_LIMIT tokens per second holding at most PCLOUD_RATE_BURST. When
+// PCloud throttles a call (429 or 503) it says how long to back off in Retry-After; the provider
+// then holds every call, not just the throttled one, until that time has passed.
+
+// rateLimiter is a token bucket with a pause that a throttled response can set
+type rateLimiter struct {
+	mu          sync.Mutex
+	rate        float64 // tokens per second; 0 or less disables the bucket
+	burst       float64
+	tokens      float64
+	last        time.Time
+	pausedUntil time.Time
+	maxPause    time.Duration
+}
+
+func newRateLimiter(rate float64, burst int, maxPause time.Duration) *rateLimiter {
+	if burst < 1 {
+		burst = 1
+	}
+	return &rateLimiter{rate: rate, burst: float64(burst), tokens: float64(burst), last: time.Now(), maxPause: maxPause}
+}
+
+// pcloudRate paces calls to Privilege Cloud. PCLOUD_RATE_LIMIT (requests per second, default 0 for
+// no limit), PCLOUD_RATE_BURST (default 10) and PCLOUD_RETRY_AFTER_MAX (default 60s, the longest
+// Retry-After that is honoured) tune it.
+var pcloudRate = newRateLimiter(
+	limiterFloat("PCLOUD_RATE_LIMIT", 0),
+	limiterInt("PCLOUD_RATE_BURST", 10),
+	limiterDuration("PCLOUD_RETRY_AFTER_MAX", time.Minute),
+)
+
+// pcloudThrottleDefault is the pause after a 429 that came without a usable Retry-After, e.g.
+// from an SDK call, which does not expose response headers
+const pcloudThrottleDefault = time.Second
+
+var (
+	pcloudRateWaitsTotal  = newCounter("provider_pcloud_rate_waits_total", "PCloud calls that waited for the rate limit or a Retry-After pause")
+	pcloudRetryAfterTotal = newCounter("provider_pcloud_retry_after_total", "Times PCloud throttling paused all PCloud calls")
+)
+
+func limiterFloat(name string, fallback float64) float64 {
+	f, err := strconv.ParseFloat(getEnvOrDefault(name, strconv.FormatFloat(fallback, 'f', -1, 64)), 64)
+	if err != nil {
+		log.Printf("WARNING: Invalid %s, using %g: %v", name, fallback, err)
+		return fallback
+	}
+	return f
+}
+
+// wait blocks until the limiter is not paused and a token is available, then takes the token. It
+// gives up with the context's error when the context ends first.
+func (l *rateLimiter) wait(ctx context.Context) error {
+	waited := false
+	for {
+		l.mu.Lock()
+		now := time.Now()
+		delay := l.pausedUntil.Sub(now)
+		if delay <= 0 && l.rate > 0 {
+			l.tokens += now.Sub(l.last).Seconds() * l.rate
+			if l.tokens > l.burst {
+				l.tokens = l.burst
+			}
+			l.last = now
+			if l.tokens < 1 {
+				delay = time.Duration((1 - l.tokens) / l.rate * float64(time.Second))
+			} else {
+				l.tokens--
+			}
+		}
+		l.mu.Unlock()
+		if delay <= 0 {
+			if waited {
+				pcloudRateWaitsTotal.Inc()
+			}
+			return nil
+		}
+		waited = true
+		timer := time.NewTimer(delay)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		}
+	}
+}
+
+// pause holds all calls for d, capped at the limiter's maxPause; a shorter pause than the one in
+// effect changes nothing
+func (l *rateLimiter) pause(d time.Duration, reason string) {
+	if d > l.maxPause {
+		d = l.maxPause
+	}
+	if d <= 0 {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	until := time.Now().Add(d)
+	if until.After(l.pausedUntil) {
+		l.pausedUntil = until
+		pcloudRetryAfterTotal.Inc()
+		log.Printf("WARNING: PCloud throttled (%s), holding PCloud calls for %s", reason, d.Round(time.Millisecond))
+	}
+}
+
+// pausedFor returns how long calls are still held
+func (l *rateLimiter) pausedFor() time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if d := time.Until(l.pausedUntil); d > 0 {
+		return d
+	}
+	return 0
+}
+
+// throttled pauses PCloud calls after a throttled response: for its Retry-After when it has one,
+// for pcloudThrottleDefault after a 429 without one
+func (l *rateLimiter) throttled(status int, header http.Header) {
+	if status != http.StatusTooManyRequests && status != http.StatusServiceUnavailable {
+		return
+	}
+	if d, ok := parseRetryAfter(header.Get("Retry-After"), time.Now()); ok {
+		l.pause(d, "status "+strconv.Itoa(status)+", Retry-After "+header.Get("Retry-After"))
+	} else if status == http.StatusTooManyRequests {
+		l.pause(pcloudThrottleDefault, "status 429")
+	}
+}
+
+// parseRetryAfter reads a Retry-After value, either delay seconds or an HTTP date
+func parseRetryAfter(value string, now time.Time) (time.Duration, bool) {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return 0, false
+	}
+	if seconds, err := strconv.Atoi(value); err == nil {
+		if seconds < 0 {
+			return 0, false
+		}
+		return time.Duration(seconds) * time.Second, true
+	}
+	if at, err := http.ParseTime(value); err == nil {
+		return at.Sub(now), true
+	}
+	return 0, false
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestParseRetryAfter(t *testing.T) {
+	now := time.Date(2025, 6, 1, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		value string
+		want  time.Duration
+		ok    bool
+	}{
+		{"", 0, false},
+		{"5", 5 * time.Second, true},
+		{" 0 ", 0, true},
+		{"-1", 0, false},
+		{"Sun, 01 Jun 2025 12:00:30 GMT", 30 * time.Second, true},
+		{"soon", 0, false},
+	}
+	for _, tt := range tests {
+		got, ok := parseRetryAfter(tt.value, now)
+		if got != tt.want || ok != tt.ok {
+			t.Errorf("parseRetryAfter(%q) = %s, %t, want %s, %t", tt.value, got, ok, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestRateLimiter(t *testing.T) {
+	// The burst passes at once, further calls are paced at the rate
+	l := newRateLimiter(50, 2, time.Second)
+	start := time.Now()
+	for i := 0; i < 4; i++ {
+		l.wait(context.Background())
+	}
+	if elapsed := time.Since(start); elapsed < 30*time.Millisecond || elapsed > time.Second {
+		t.Errorf("expected two calls paced at 50/s to take about 40ms, took %s", elapsed)
+	}
+
+	// Without a rate only a pause holds calls
+	l = newRateLimiter(0, 1, 50*time.Millisecond)
+	start = time.Now()
+	for i := 0; i < 100; i++ {
+		l.wait(context.Background())
+	}
+	if elapsed := time.Since(start); elapsed > 20*time.Millisecond {
+		t.Errorf("expected no pacing without a rate, took %s", elapsed)
+	}
+
+	// Retry-After is capped at maxPause and holds the next call
+	l.throttled(http.StatusTooManyRequests, http.Header{"Retry-After": []string{"120"}})
+	if paused := l.pausedFor(); paused <= 0 || paused > 50*time.Millisecond {
+		t.Fatalf("expected a pause capped at 50ms, got %s", paused)
+	}
+	start = time.Now()
+	l.wait(context.Background())
+	if elapsed := time.Since(start); elapsed < 30*time.Millisecond {
+		t.Errorf("expected the call to wait for the pause, took %s", elapsed)
+	}
+
+	// A canceled request stops waiting
+	l.throttled(http.StatusTooManyRequests, http.Header{"Retry-After": []string{"120"}})
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := l.wait(ctx); err == nil {
+		t.Error("expected a canceled context to end the wait with an error")
+	}
+	l = newRateLimiter(0, 1, 50*time.Millisecond)
+
+	// Other statuses, and a 503 without Retry-After, do not pause
+	l.throttled(http.StatusInternalServerError, http.Header{"Retry-After": []string{"1"}})
+	l.throttled(http.StatusServiceUnavailable, nil)
+	if paused := l.pausedFor(); paused != 0 {
+		t.Errorf("expected no pause, got %s", paused)
+	}
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Container Apps probes the provider on two endpoints. /livez only says the process serves HTTP, so
+// a failing upstream never gets replicas restarted. /readyz says whether the replica can handle
+// ARM requests: the configuration is complete, a PCloud session was opened within
+// READYZ_SESSION_MAX_AGE (opening one when the cached one is older), and Conjur accepts the
+// managed identity when it is configured. While shutting down, /readyz fails so traffic drains.
+// Operators can drain a replica the same way with POST /admin/drain, e.g. before debugging it.
+
+// draining is set once the server starts shutting down
+var draining atomic.Bool
+
+// drainRequested is set by an operator through POST /admin/drain
+var drainRequested atomic.Bool
+
+// readyzSessionMaxAge is how old the PCloud session may be before /readyz opens a new one
+// (READYZ_SESSION_MAX_AGE, default 15m)
+func readyzSessionMaxAge() time.Duration {
+	return policyDuration("READYZ_SESSION_MAX_AGE", "15m")
+}
+
+// readyzTimeout bounds how long /readyz waits for an upstream check (READYZ_TIMEOUT, default 4s);
+// a check still running afterwards keeps going, and a later probe sees its result
+func readyzTimeout() time.Duration {
+	return policyDuration("READYZ_TIMEOUT", "4s")
+}
+
+var errCheckPending = errors.New("check still running")
+
+// readinessCheck runs one upstream check at a time and remembers its last outcome
+type readinessCheck struct {
+	mu      sync.Mutex
+	running chan struct{}
+	err     error
+}
+
+// run starts the check unless it is already running and waits up to timeout for it
+func (c *readinessCheck) run(check func() error, timeout time.Duration) error {
+	c.mu.Lock()
+	if c.running == nil {
+		done := make(chan struct{})
+		c.running = done
+		go func() {
+			err := check()
+			c.mu.Lock()
+			c.err, c.running = err, nil
+			c.mu.Unlock()
+			close(done)
+		}()
+	}
+	running := c.running
+	c.mu.Unlock()
+
+	select {
+	case <-running:
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		return c.err
+	case <-time.After(timeout):
+		return errCheckPending
+	}
+}
+
+var (
+	sessionReadiness readinessCheck
+	conjurReadiness  readinessCheck
+)
+
+func handleLivez(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"status": "ok", "version": Version})
+}
+
+func handleReadyz(w http.ResponseWriter, r *http.Request) {
+	checks := map[string]interface{}{}
+	ready := true
+	report := func(name string, err error, details map[string]interface{}) {
+		entry := map[string]interface{}{"status": "ok"}
+		for key, value := range details {
+			entry[key] = value
+		}
+		if err != nil {
+			ready = false
+			entry["status"] = "error"
+			entry["error"] = err.Error()
+		}
+		checks[name] = entry
+	}
+
+	if draining.Load() {
+		report("shutdown", errors.New("shutting down"), nil)
+	}
+	if drainRequested.Load() {
+		report("drain", errors.New("drained by operator"), nil)
+	}
+	envErr := validEnvVars()
+	report("env", envErr, nil)
+
+	if envErr == nil {
+		var err error
+		refreshed := pamSessions.lastRefresh()
+		if refreshed.IsZero() || time.Since(refreshed) > readyzSessionMaxAge() {
+			err = sessionReadiness.run(func() error { return pamSessions.refresh("readiness") }, readyzTimeout())
+			refreshed = pamSessions.lastRefresh()
+		}
+		details := map[string]interface{}{}
+		if !refreshed.IsZero() {
+			details["sessionAge"] = time.Since(refreshed).Round(time.Second).String()
+		}
+		report("pcloudSession", err, details)
+	}
+
+	if os.Getenv("CONJUR_APPLIANCE_URL") != "" {
+		err := conjurReadiness.run(func() error {
+			_, err := newConjurClient().accessToken()
+			return err
+		}, readyzTimeout())
+		report("conjur", err, nil)
+	}
+
+	status := http.StatusOK
+	if !ready {
+		status = http.StatusServiceUnavailable
+		log.Printf("WARNING: Readiness check failed: %v", checks)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]interface{}{"ready": ready, "checks": checks})
+}
+
+// handleSetDrain takes the replica out of rotation, or puts it back: {"enabled": true}. Requests
+// still reaching the replica are served; /readyz fails until the drain is switched off.
+func handleSetDrain(w http.ResponseWriter, r *http.Request) {
+	LogRequestDebug("SetDrain", r)
+
+	var request struct {
+		Enabled bool `json:"enabled"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		sendJSONError(w, http.StatusBadRequest, "InvalidRequestBody", fmt.Sprintf("Invalid request body: %v", err))
+		return
+	}
+	drainRequested.Store(request.Enabled)
+	log.Printf("INFO: Drain set to %t by operator", request.Enabled)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]bool{"draining": request.Enabled})
+}
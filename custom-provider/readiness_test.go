@@ -0,0 +1,75 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestReadiness(t *testing.T) {
+	pcloud := httptest.NewServer(newMockPCloud().router())
+	defer pcloud.Close()
+	t.Setenv("IDTENANTURL", pcloud.URL)
+	t.Setenv("PCLOUDURL", pcloud.URL)
+	t.Setenv("PAMUSER", "mock-user")
+	t.Setenv("PAMPASS", "mock-pass")
+	t.Setenv("CONJUR_APPLIANCE_URL", "")
+	pamSessions.Flush()
+	defer pamSessions.Flush()
+
+	probe := func(handler http.HandlerFunc) (int, map[string]interface{}) {
+		rec := httptest.NewRecorder()
+		handler(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+		var body map[string]interface{}
+		json.Unmarshal(rec.Body.Bytes(), &body)
+		return rec.Code, body
+	}
+
+	if status, _ := probe(handleLivez); status != http.StatusOK {
+		t.Fatalf("/livez: expected 200, got %d", status)
+	}
+
+	// Without a session, /readyz opens one
+	status, body := probe(handleReadyz)
+	if status != http.StatusOK || pamSessions.lastRefresh().IsZero() {
+		t.Fatalf("/readyz: expected 200 with a new session, got %d %v", status, body)
+	}
+
+	// A failing session refresh makes the replica unready, but not dead
+	rejecting := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusUnauthorized)
+		w.Write([]byte(`{"error": "invalid_client"}`))
+	}))
+	defer rejecting.Close()
+	pamSessions.Flush()
+	t.Setenv("IDTENANTURL", rejecting.URL)
+	status, body = probe(handleReadyz)
+	checks, _ := body["checks"].(map[string]interface{})
+	if status != http.StatusServiceUnavailable || checks["pcloudSession"] == nil {
+		t.Fatalf("/readyz: expected 503 with a pcloudSession check, got %d %v", status, body)
+	}
+	if status, _ := probe(handleLivez); status != http.StatusOK {
+		t.Fatalf("/livez: expected 200 while unready, got %d", status)
+	}
+
+	// Missing configuration fails before any upstream is called
+	t.Setenv("PCLOUDURL", "")
+	if status, body := probe(handleReadyz); status != http.StatusServiceUnavailable || body["checks"].(map[string]interface{})["env"].(map[string]interface{})["status"] != "error" {
+		t.Fatalf("/readyz: expected 503 with a failed env check, got %d %v", status, body)
+	}
+
+	// Replicas drained by an operator are unready
+	drainRequested.Store(true)
+	if status, body := probe(handleReadyz); status != http.StatusServiceUnavailable || body["checks"].(map[string]interface{})["drain"] == nil {
+		t.Fatalf("/readyz: expected 503 while drained, got %d %v", status, body)
+	}
+	drainRequested.Store(false)
+
+	// Draining replicas are unready
+	draining.Store(true)
+	defer draining.Store(false)
+	if status, body := probe(handleReadyz); status != http.StatusServiceUnavailable || body["checks"].(map[string]interface{})["shutdown"] == nil {
+		t.Fatalf("/readyz: expected 503 while shutting down, got %d %v", status, body)
+	}
+}
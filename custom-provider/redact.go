@@ -0,0 +1,187 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// Everything the provider logs goes through redactText before it is written, including the lines
+// the PAM SDK logs itself. Values of sensitive keys are masked wherever they appear as a JSON field,
+// a key=value pair (PAMPASS=..., Conjur's Token token="..."), a Go struct field printed with %+v
+// (Password:...) or a Bearer/Basic credential, and the PCloud password and session token are masked
+// wherever they appear at all. LOG_REDACT_KEYS adds keys to the default list.
+
+// redactedValue replaces every masked value
+const redactedValue = "[REDACTED]"
+
+// defaultSensitiveKeys are masked without configuration. A key is sensitive when its name, ignoring
+// case, '-' and '_', ends with one of these, so clientSecret, client_secret, X-Api-Key and
+// PAMPASS all match.
+var defaultSensitiveKeys = []string{
+	"password", "passphrase", "pampass", "secret", "token", "authorization", "cookie", "apikey", "privatekey", "jwt",
+}
+
+var sensitiveKeys = loadSensitiveKeys(os.Getenv("LOG_REDACT_KEYS"))
+
+// loadSensitiveKeys returns the default keys and the comma separated extra keys
+func loadSensitiveKeys(extra string) []string {
+	keys := append([]string{}, defaultSensitiveKeys...)
+	for _, key := range strings.Split(extra, ",") {
+		if key = normalizeKey(key); key != "" {
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+func normalizeKey(key string) string {
+	return strings.NewReplacer("-", "", "_", "").Replace(strings.ToLower(strings.TrimSpace(key)))
+}
+
+// isSensitiveKey reports whether values of the key are masked
+func isSensitiveKey(key string) bool {
+	normalized := normalizeKey(key)
+	if normalized == "" {
+		return false
+	}
+	for _, sensitive := range sensitiveKeys {
+		if strings.HasSuffix(normalized, sensitive) {
+			return true
+		}
+	}
+	return false
+}
+
+// sensitiveValues are literal secrets masked wherever they appear, see registerSensitiveValue
+var sensitiveValues struct {
+	mu     sync.RWMutex
+	values []string
+}
+
+// minSensitiveValueLength keeps short values, which would mask unrelated text, from being
+// registered; maxSensitiveValues bounds the list as session tokens are replaced
+const (
+	minSensitiveValueLength = 6
+	maxSensitiveValues      = 32
+)
+
+// registerSensitiveValue masks the value in all log output from now on
+func registerSensitiveValue(value string) {
+	if len(value) < minSensitiveValueLength {
+		return
+	}
+	sensitiveValues.mu.Lock()
+	defer sensitiveValues.mu.Unlock()
+	for _, known := range sensitiveValues.values {
+		if known == value {
+			return
+		}
+	}
+	sensitiveValues.values = append(sensitiveValues.values, value)
+	if len(sensitiveValues.values) > maxSensitiveValues {
+		sensitiveValues.values = sensitiveValues.values[1:]
+	}
+}
+
+var (
+	jsonFieldPattern  = regexp.MustCompile(`"([\w.-]+)"\s*:\s*"(?:[^"\\]|\\.)*"`)
+	assignmentPattern = regexp.MustCompile(`\b([\w.-]+)=("[^"]*"|[^\s&,;"]+)`)
+	// Go prints struct fields as Name:value; lowercase names are not fields and are left alone
+	goFieldPattern    = regexp.MustCompile(`\b([A-Z]\w*):([^\s\[\]{}]+)`)
+	credentialPattern = regexp.MustCompile(`(?i)\b(Bearer|Basic)\s+[A-Za-z0-9._~+/=-]+`)
+)
+
+// redactText masks the secrets in a log line
+func redactText(text string) string {
+	sensitiveValues.mu.RLock()
+	for _, value := range sensitiveValues.values {
+		text = strings.ReplaceAll(text, value, redactedValue)
+	}
+	sensitiveValues.mu.RUnlock()
+
+	text = credentialPattern.ReplaceAllString(text, "$1 "+redactedValue)
+	text = maskMatches(jsonFieldPattern, text, func(key string) string { return `"` + key + `":"` + redactedValue + `"` })
+	text = maskMatches(assignmentPattern, text, func(key string) string { return key + "=" + redactedValue })
+	return maskMatches(goFieldPattern, text, func(key string) string { return key + ":" + redactedValue })
+}
+
+// maskMatches replaces the matches of pattern whose first group is a sensitive key
+func maskMatches(pattern *regexp.Regexp, text string, masked func(key string) string) string {
+	return pattern.ReplaceAllStringFunc(text, func(match string) string {
+		key := pattern.FindStringSubmatch(match)[1]
+		if !isSensitiveKey(key) {
+			return match
+		}
+		return masked(key)
+	})
+}
+
+// redactHeaders returns a copy of the headers with the values of sensitive headers masked
+func redactHeaders(headers http.Header) http.Header {
+	redacted := headers.Clone()
+	for name, values := range redacted {
+		if isSensitiveKey(name) {
+			for i := range values {
+				values[i] = redactedValue
+			}
+		}
+	}
+	return redacted
+}
+
+// redactJSON returns the JSON document with the values of sensitive keys masked; documents that
+// do not parse are redacted as text
+func redactJSON(body []byte) string {
+	var doc interface{}
+	if err := json.Unmarshal(body, &doc); err != nil {
+		return redactText(string(body))
+	}
+	redacted, err := json.Marshal(redactValue(doc))
+	if err != nil {
+		return redactText(string(body))
+	}
+	return string(redacted)
+}
+
+func redactValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for key, value := range v {
+			if isSensitiveKey(key) {
+				v[key] = redactedValue
+			} else {
+				v[key] = redactValue(value)
+			}
+		}
+	case []interface{}:
+		for i, value := range v {
+			v[i] = redactValue(value)
+		}
+	}
+	return v
+}
+
+// redactingWriter redacts every log line before writing it, and drops lines below the log level
+type redactingWriter struct {
+	out io.Writer
+}
+
+func (rw redactingWriter) Write(p []byte) (int, error) {
+	if !logLineEnabled(p) {
+		return len(p), nil
+	}
+	if _, err := io.WriteString(rw.out, redactText(string(p))); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func init() {
+	log.SetOutput(redactingWriter{out: os.Stderr})
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestRedactText(t *testing.T) {
+	registerSensitiveValue("pcloud-Passw0rd")
+	tests := []struct {
+		in, want string
+	}{
+		{`DEBUG: request body: {"name":"acct1","secret":"hunter22","platformId":"WinDomain"}`, `DEBUG: request body: {"name":"acct1","secret":"[REDACTED]","platformId":"WinDomain"}`},
+		{`{"client_secret": "abc", "access_token":"x\"y"}`, `{"client_secret":"[REDACTED]", "access_token":"[REDACTED]"}`},
+		{"PAMUSER=svc@tenant; PAMPASS=hunter22", "PAMUSER=svc@tenant; PAMPASS=[REDACTED]"},
+		{`Authorization: Token token="eyJhbGciOi"`, `Authorization: Token token=[REDACTED]`},
+		{"map[Authorization:[Bearer eyJ0eXAi.abc-def]]", "map[Authorization:[Bearer [REDACTED]]]"},
+		{"{SafeName:safe1 Secret:hunter22 SecretType:password}", "{SafeName:safe1 Secret:[REDACTED] SecretType:password}"},
+		{"could not log on with pcloud-Passw0rd", "could not log on with [REDACTED]"},
+		{"INFO: [op=abc] token:abcd sessionAge=5m", "INFO: [op=abc] token:abcd sessionAge=5m"},
+	}
+	for _, tt := range tests {
+		if got := redactText(tt.in); got != tt.want {
+			t.Errorf("redactText(%q)\n got %q\nwant %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestRedactHeaders(t *testing.T) {
+	headers := http.Header{}
+	headers.Set("Authorization", "Bearer abc")
+	headers.Set("X-Api-Key", "abc")
+	headers.Set("X-Ms-Correlation-Request-Id", "corr1")
+
+	redacted := redactHeaders(headers)
+	if redacted.Get("Authorization") != redactedValue || redacted.Get("X-Api-Key") != redactedValue {
+		t.Errorf("expected sensitive headers to be masked, got %v", redacted)
+	}
+	if redacted.Get("X-Ms-Correlation-Request-Id") != "corr1" {
+		t.Errorf("expected other headers to be kept, got %v", redacted)
+	}
+	if headers.Get("Authorization") != "Bearer abc" {
+		t.Error("redactHeaders modified the request headers")
+	}
+}
+
+func TestRedactJSON(t *testing.T) {
+	got := redactJSON([]byte(`{"properties":{"name":"acct1","secret":"hunter22","accounts":[{"password":"p"}]}}`))
+	if strings.Contains(got, "hunter22") || strings.Contains(got, `"p"`) || !strings.Contains(got, "acct1") {
+		t.Errorf("unexpected redaction: %s", got)
+	}
+}
+
+func TestLoadSensitiveKeys(t *testing.T) {
+	saved := sensitiveKeys
+	defer func() { sensitiveKeys = saved }()
+	sensitiveKeys = loadSensitiveKeys(" Connection-String ,,sas")
+
+	for key, want := range map[string]bool{
+		"connectionString":  true,
+		"CONNECTION_STRING": true,
+		"blobSas":           true,
+		"password":          true,
+		"safeName":          false,
+	} {
+		if got := isSensitiveKey(key); got != want {
+			t.Errorf("isSensitiveKey(%q) = %t, want %t", key, got, want)
+		}
+	}
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+)
+
+// providerHandler handles a custom provider request once the request path has been parsed
+type providerHandler func(w http.ResponseWriter, r *http.Request, cpRequest CustomProviderRequestPath)
+
+// forRequest binds the parsed request path so the handler can be used as an http.Handler
+func (h providerHandler) forRequest(cpRequest CustomProviderRequestPath) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		h(w, r, cpRequest)
+	})
+}
+
+// providerEntry is a resource type or action served by this provider
+type providerEntry struct {
+	Name        string
+	RoutingType string
+	Handler     providerHandler
+	// List handles a collection GET on a resource type; nil when listing is not supported
+	List providerHandler
+	// ResourceType is the resource type an action works on; the action is disabled with it (see
+	// ENABLED_RESOURCE_TYPES). Empty for actions that span resource types.
+	ResourceType string
+	// Upstreams are the circuit breakers of the services the entry calls; its requests are turned
+	// away while one of them is open (see circuitbreaker.go)
+	Upstreams []*circuitBreaker
+}
+
+// resourceTypes is the registry of resource types; it drives both routing and the generated definition
+var resourceTypes = []providerEntry{
+	{Name: "safes", RoutingType: "Proxy", Handler: handleSafe, List: handleListSafes, Upstreams: pcloudUpstreams},
+	{Name: "accounts", RoutingType: "Proxy", Handler: handleAccount, List: handleListAccounts, Upstreams: pcloudUpstreams},
+	{Name: "safeMembers", RoutingType: "Proxy", Handler: handleSafeMember, Upstreams: pcloudUpstreams},
+	{Name: "conjurSecrets", RoutingType: "Proxy", Handler: handleConjurSecret},
+	{Name: "platforms", RoutingType: "Proxy", Handler: handlePlatform, List: handleListPlatforms, Upstreams: pcloudUpstreams},
+	{Name: "applications", RoutingType: "Proxy", Handler: handleApplication, Upstreams: pcloudUpstreams},
+	{Name: "conjurHosts", RoutingType: "Proxy", Handler: handleConjurHost},
+}
+
+// actions is the registry of custom actions (POST)
+var actions = []providerEntry{
+	{Name: "importAccount", RoutingType: "Proxy", Handler: handleImportAccount, ResourceType: "accounts", Upstreams: pcloudUpstreams},
+	{Name: "regenerateSecret", RoutingType: "Proxy", Handler: handleRegenerateSecret, ResourceType: "accounts", Upstreams: pcloudUpstreams},
+	{Name: "exportAudit", RoutingType: "Proxy", Handler: handleExportAudit},
+	{Name: "reconcileMembers", RoutingType: "Proxy", Handler: handleReconcileMembers, ResourceType: "safeMembers", Upstreams: pcloudUpstreams},
+	{Name: "listSecretVersions", RoutingType: "Proxy", Handler: handleListSecretVersions, ResourceType: "accounts", Upstreams: pcloudUpstreams},
+	{Name: "rotateAccountPassword", RoutingType: "Proxy", Handler: handleRotateAccountPassword, ResourceType: "accounts", Upstreams: pcloudUpstreams},
+	{Name: "verifyAccount", RoutingType: "Proxy", Handler: handleVerifyAccount, ResourceType: "accounts", Upstreams: pcloudUpstreams},
+	{Name: "listSafeMembers", RoutingType: "Proxy", Handler: handleListSafeMembers, ResourceType: "safeMembers", Upstreams: pcloudUpstreams},
+	{Name: "listAccounts", RoutingType: "Proxy", Handler: handleListSafeAccounts, ResourceType: "accounts", Upstreams: pcloudUpstreams},
+	{Name: "retrievePassword", RoutingType: "Proxy", Handler: handleRetrievePassword, ResourceType: "accounts", Upstreams: pcloudUpstreams},
+	{Name: "listPlatforms", RoutingType: "Proxy", Handler: handleListPlatformsAction, ResourceType: "platforms", Upstreams: pcloudUpstreams},
+	{Name: "bulkAddAccounts", RoutingType: "Proxy", Handler: handleBulkAddAccounts, ResourceType: "accounts", Upstreams: pcloudUpstreams},
+	{Name: "changePassword", RoutingType: "Proxy", Handler: handleChangePassword, ResourceType: "accounts", Upstreams: pcloudUpstreams},
+	{Name: "detectDrift", RoutingType: "Proxy", Handler: handleDetectDrift, Upstreams: pcloudUpstreams},
+	{Name: "exportTemplate", RoutingType: "Proxy", Handler: handleExportTemplate, ResourceType: "safes", Upstreams: pcloudUpstreams},
+	{Name: "whatIf", RoutingType: "Proxy", Handler: handleWhatIf, Upstreams: pcloudUpstreams},
+}
+
+// enabledResourceTypes reads ENABLED_RESOURCE_TYPES, a comma separated list of the resource types
+// this deployment serves; nil (unset) serves every type
+func enabledResourceTypes() map[string]bool {
+	raw := os.Getenv("ENABLED_RESOURCE_TYPES")
+	if strings.TrimSpace(raw) == "" {
+		return nil
+	}
+	enabled := map[string]bool{}
+	for _, name := range strings.Split(raw, ",") {
+		if name = strings.ToLower(strings.TrimSpace(name)); name != "" {
+			enabled[name] = true
+		}
+	}
+	return enabled
+}
+
+// checkEnabledResourceTypes reports names in ENABLED_RESOURCE_TYPES that are not resource types,
+// so a typo does not quietly disable the type it meant
+func checkEnabledResourceTypes() error {
+	var unknown []string
+	for name := range enabledResourceTypes() {
+		if _, ok := lookupProviderEntry(resourceTypes, name); !ok {
+			unknown = append(unknown, name)
+		}
+	}
+	if len(unknown) > 0 {
+		sort.Strings(unknown)
+		return fmt.Errorf("ENABLED_RESOURCE_TYPES names unknown resource types: %s", strings.Join(unknown, ", "))
+	}
+	return nil
+}
+
+// resourceTypeEnabled reports whether a resource type is served; the empty name, for actions that
+// span resource types, always is
+func resourceTypeEnabled(name string) bool {
+	enabled := enabledResourceTypes()
+	return enabled == nil || name == "" || enabled[strings.ToLower(name)]
+}
+
+// entryEnabled reports whether a resource type, or the resource type of an action, is served
+func (e providerEntry) entryEnabled(isAction bool) bool {
+	if isAction {
+		return resourceTypeEnabled(e.ResourceType)
+	}
+	return resourceTypeEnabled(e.Name)
+}
+
+// sendResourceTypeDisabled answers a request for a resource type, or an action on one, that this
+// deployment does not serve
+func sendResourceTypeDisabled(w http.ResponseWriter, e providerEntry, isAction bool) {
+	message := fmt.Sprintf("Resource type %s is not enabled in this deployment", e.Name)
+	if isAction {
+		message = fmt.Sprintf("Action %s works on resource type %s, which is not enabled in this deployment", e.Name, e.ResourceType)
+	}
+	sendJSONError(w, http.StatusForbidden, "ResourceTypeDisabled", fmt.Sprintf("%s (ENABLED_RESOURCE_TYPES=%s)", message, os.Getenv("ENABLED_RESOURCE_TYPES")))
+}
+
+// lookupProviderEntry finds an entry by name; ARM names are case-insensitive
+func lookupProviderEntry(entries []providerEntry, name string) (providerEntry, bool) {
+	for _, entry := range entries {
+		if strings.EqualFold(entry.Name, name) {
+			return entry, true
+		}
+	}
+	return providerEntry{}, false
+}
+
+// ProviderDefinitionEntry is one element of resourceTypes/actions in a Microsoft.CustomProviders/resourceProviders definition
+type ProviderDefinitionEntry struct {
+	Name        string `json:"name"`
+	RoutingType string `json:"routingType"`
+	Endpoint    string `json:"endpoint"`
+}
+
+// ProviderDefinition is the properties block of a Microsoft.CustomProviders/resourceProviders resource
+type ProviderDefinition struct {
+	Properties struct {
+		ResourceTypes []ProviderDefinitionEntry `json:"resourceTypes"`
+		Actions       []ProviderDefinitionEntry `json:"actions"`
+	} `json:"properties"`
+}
+
+// buildProviderDefinition renders the enabled entries of the registries as a custom provider
+// definition pointing at endpoint
+func buildProviderDefinition(endpoint string) ProviderDefinition {
+	def := ProviderDefinition{}
+	def.Properties.ResourceTypes = []ProviderDefinitionEntry{}
+	def.Properties.Actions = []ProviderDefinitionEntry{}
+	for _, entry := range resourceTypes {
+		if !entry.entryEnabled(false) {
+			continue
+		}
+		def.Properties.ResourceTypes = append(def.Properties.ResourceTypes, ProviderDefinitionEntry{entry.Name, entry.RoutingType, endpoint})
+	}
+	for _, entry := range actions {
+		if !entry.entryEnabled(true) {
+			continue
+		}
+		def.Properties.Actions = append(def.Properties.Actions, ProviderDefinitionEntry{entry.Name, entry.RoutingType, endpoint})
+	}
+	return def
+}
+
+// providerEndpoint is the provider's public base URL: PROVIDER_ENDPOINT, or else the request's host
+func providerEndpoint(r *http.Request) string {
+	if endpoint := os.Getenv("PROVIDER_ENDPOINT"); endpoint != "" {
+		return strings.TrimSuffix(endpoint, "/")
+	}
+	scheme := "https"
+	if proto := r.Header.Get("X-Forwarded-Proto"); proto != "" {
+		scheme = proto
+	}
+	return scheme + "://" + r.Host
+}
+
+// callerTokenPlaceholder stands in for the caller token in a generated endpoint, which never carries the token itself
+const callerTokenPlaceholder = "{callerAuthToken}"
+
+// withCallerToken adds the code query parameter infra/main.bicep appends to the endpoint when
+// CALLER_AUTH_TOKEN is set, unless the endpoint already has one
+func withCallerToken(endpoint string) string {
+	if callerAuth.token == "" {
+		return endpoint
+	}
+	if u, err := url.Parse(endpoint); err == nil && u.Query().Has("code") {
+		return endpoint
+	}
+	separator := "?"
+	if strings.Contains(endpoint, "?") {
+		separator = "&"
+	}
+	return endpoint + separator + "code=" + callerTokenPlaceholder
+}
+
+// handleGetDefinition returns the custom provider definition for this build.
+// The endpoint is taken from ?endpoint=, then PROVIDER_ENDPOINT, then the request's host.
+func handleGetDefinition(w http.ResponseWriter, r *http.Request) {
+	LogRequestDebug("GetDefinition", r)
+
+	endpoint := r.URL.Query().Get("endpoint")
+	if endpoint == "" {
+		endpoint = providerEndpoint(r)
+	}
+	endpoint = withCallerToken(endpoint)
+
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(buildProviderDefinition(endpoint))
+}
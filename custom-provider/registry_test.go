@@ -0,0 +1,128 @@
+package main
+
+import (
+	"os"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func TestBuildProviderDefinition(t *testing.T) {
+	endpoint := "https://provider.example.com"
+	def := buildProviderDefinition(endpoint)
+
+	if len(def.Properties.ResourceTypes) != len(resourceTypes) {
+		t.Fatalf("expected %d resource types, got %d", len(resourceTypes), len(def.Properties.ResourceTypes))
+	}
+	for i, rt := range def.Properties.ResourceTypes {
+		if rt.Name != resourceTypes[i].Name {
+			t.Errorf("expected resource type %s, got %s", resourceTypes[i].Name, rt.Name)
+		}
+		if rt.RoutingType != "Proxy" {
+			t.Errorf("expected routingType Proxy for %s, got %s", rt.Name, rt.RoutingType)
+		}
+		if rt.Endpoint != endpoint {
+			t.Errorf("expected endpoint %s, got %s", endpoint, rt.Endpoint)
+		}
+	}
+	if len(def.Properties.Actions) != len(actions) {
+		t.Errorf("expected %d actions, got %d", len(actions), len(def.Properties.Actions))
+	}
+}
+
+func TestWithCallerToken(t *testing.T) {
+	t.Cleanup(func() { callerAuth.token = "" })
+	tests := []struct {
+		name     string
+		token    string
+		endpoint string
+		expected string
+	}{
+		{"no caller token", "", "https://provider.example.com", "https://provider.example.com"},
+		{"caller token", "s3cret", "https://provider.example.com", "https://provider.example.com?code={callerAuthToken}"},
+		{"other query parameters", "s3cret", "https://provider.example.com?x=1", "https://provider.example.com?x=1&code={callerAuthToken}"},
+		{"code already given", "s3cret", "https://provider.example.com?code=abc", "https://provider.example.com?code=abc"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			callerAuth.token = tt.token
+			if got := withCallerToken(tt.endpoint); got != tt.expected {
+				t.Errorf("expected %s, got %s", tt.expected, got)
+			}
+		})
+	}
+}
+
+func TestLookupProviderEntry(t *testing.T) {
+	if _, ok := lookupProviderEntry(resourceTypes, "Safes"); !ok {
+		t.Errorf("expected case-insensitive match for Safes")
+	}
+	if _, ok := lookupProviderEntry(resourceTypes, "unknown"); ok {
+		t.Errorf("expected no match for unknown")
+	}
+}
+
+func TestEnabledResourceTypes(t *testing.T) {
+	tests := []struct {
+		name          string
+		enabled       string
+		resourceTypes []string
+		action        string
+		actionEnabled bool
+		wantErr       bool
+	}{
+		{"all by default", "", []string{"safes", "accounts", "safeMembers", "conjurSecrets", "platforms", "applications", "conjurHosts"}, "retrievePassword", true, false},
+		{"safes only", "safes", []string{"safes"}, "retrievePassword", false, false},
+		{"case and spaces", " Safes , ACCOUNTS ", []string{"safes", "accounts"}, "retrievePassword", true, false},
+		{"actions spanning types stay", "safes", []string{"safes"}, "exportAudit", true, false},
+		{"unknown type", "safes,acounts", []string{"safes"}, "retrievePassword", false, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("ENABLED_RESOURCE_TYPES", tt.enabled)
+			if err := checkEnabledResourceTypes(); (err != nil) != tt.wantErr {
+				t.Errorf("expected error %v, got %v", tt.wantErr, err)
+			}
+
+			def := buildProviderDefinition("https://provider.example.com")
+			var names []string
+			for _, rt := range def.Properties.ResourceTypes {
+				names = append(names, rt.Name)
+			}
+			if strings.Join(names, ",") != strings.Join(tt.resourceTypes, ",") {
+				t.Errorf("expected resource types %v in the definition, got %v", tt.resourceTypes, names)
+			}
+			found := false
+			for _, action := range def.Properties.Actions {
+				found = found || action.Name == tt.action
+			}
+			if found != tt.actionEnabled {
+				t.Errorf("expected %s in the definition: %v, got %v", tt.action, tt.actionEnabled, found)
+			}
+		})
+	}
+}
+
+// TestBicepActionResourceTypes keeps the action filter of infra/main.bicep in step with the registry
+func TestBicepActionResourceTypes(t *testing.T) {
+	bicep, err := os.ReadFile("../infra/main.bicep")
+	if err != nil {
+		t.Skipf("infra/main.bicep not available: %v", err)
+	}
+	block := regexp.MustCompile(`(?s)var actionResourceTypes = \{(.*?)\n\}`).FindSubmatch(bicep)
+	if block == nil {
+		t.Fatal("expected an actionResourceTypes map in infra/main.bicep")
+	}
+	mapped := map[string]string{}
+	for _, m := range regexp.MustCompile(`(\w+): '(\w*)'`).FindAllSubmatch(block[1], -1) {
+		mapped[string(m[1])] = string(m[2])
+	}
+	if len(mapped) != len(actions) {
+		t.Errorf("expected %d actions in actionResourceTypes, got %d", len(actions), len(mapped))
+	}
+	for _, entry := range actions {
+		if resourceType, ok := mapped[entry.Name]; !ok || resourceType != entry.ResourceType {
+			t.Errorf("expected actionResourceTypes.%s to be %q, got %q", entry.Name, entry.ResourceType, resourceType)
+		}
+	}
+}
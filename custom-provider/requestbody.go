@@ -0,0 +1,90 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Request bodies are read once, up front, by requestBodyMiddleware: a body larger than
+// MAX_REQUEST_BODY_BYTES is answered with 413 before any handler (or the operation audit, which
+// records mutating bodies) reads it, and a custom provider request with a body must say it is
+// JSON. ARM sends JSON bodies of a few kilobytes, so anything else is a misrouted or malformed
+// call that would otherwise end in a confusing PCloud error.
+
+// defaultMaxRequestBodyBytes is the default body limit, well above any safe or account PUT and
+// enough for a few thousand accounts in one bulk action
+const defaultMaxRequestBodyBytes = 1 << 20
+
+// rejectedRequestBodiesTotal counts bodies turned away before reaching a handler, by reason
+var rejectedRequestBodiesTotal = newCounter("provider_rejected_request_bodies_total", "Request bodies rejected before reaching a handler, by reason")
+
+// maxRequestBodyBytes reads MAX_REQUEST_BODY_BYTES
+func maxRequestBodyBytes() int64 {
+	n, err := strconv.ParseInt(getEnvOrDefault("MAX_REQUEST_BODY_BYTES", strconv.Itoa(defaultMaxRequestBodyBytes)), 10, 64)
+	if err != nil || n <= 0 {
+		log.Printf("WARNING: Invalid MAX_REQUEST_BODY_BYTES, using %d: %v", defaultMaxRequestBodyBytes, err)
+		return defaultMaxRequestBodyBytes
+	}
+	return n
+}
+
+// jsonContentType reports whether a Content-Type names JSON: application/json, with or without
+// parameters such as charset, or a +json type such as application/merge-patch+json
+func jsonContentType(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	return mediaType == "application/json" || strings.HasSuffix(mediaType, "+json")
+}
+
+// requestBodyMiddleware bounds and buffers request bodies, and checks the Content-Type of custom
+// provider requests that carry one
+func requestBodyMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Body == nil || r.Body == http.NoBody {
+			next.ServeHTTP(w, r)
+			return
+		}
+		limit := maxRequestBodyBytes()
+		if r.ContentLength > limit {
+			rejectRequestBody(w, r, "tooLarge", http.StatusRequestEntityTooLarge, "RequestBodyTooLarge",
+				fmt.Sprintf("Request body of %d bytes exceeds the limit of %d bytes", r.ContentLength, limit))
+			return
+		}
+		body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, limit))
+		r.Body.Close()
+		if err != nil {
+			var tooLarge *http.MaxBytesError
+			if errors.As(err, &tooLarge) {
+				rejectRequestBody(w, r, "tooLarge", http.StatusRequestEntityTooLarge, "RequestBodyTooLarge",
+					fmt.Sprintf("Request body exceeds the limit of %d bytes", limit))
+				return
+			}
+			rejectRequestBody(w, r, "unreadable", http.StatusBadRequest, "InvalidRequestBody", fmt.Sprintf("Could not read request body: %v", err))
+			return
+		}
+		if len(body) > 0 && HasCustomProviderRequestPath(r) && !jsonContentType(r.Header.Get("Content-Type")) {
+			rejectRequestBody(w, r, "unsupportedMediaType", http.StatusUnsupportedMediaType, "UnsupportedMediaType",
+				fmt.Sprintf("Content-Type must be application/json, got %q", r.Header.Get("Content-Type")))
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		r.ContentLength = int64(len(body))
+		next.ServeHTTP(w, r)
+	})
+}
+
+// rejectRequestBody answers a request whose body was turned away
+func rejectRequestBody(w http.ResponseWriter, r *http.Request, reason string, status int, code, message string) {
+	log.Printf("WARNING: Rejecting %s %s: %s", r.Method, r.URL.Path, message)
+	rejectedRequestBodiesTotal.Inc("reason", reason)
+	sendJSONError(w, status, code, message)
+}
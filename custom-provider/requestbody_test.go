@@ -0,0 +1,67 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestRequestBodyMiddleware(t *testing.T) {
+	tests := []struct {
+		name          string
+		body          string
+		contentType   string
+		contentLength int64
+		requestPath   bool
+		status        int
+		code          string
+	}{
+		{"json", `{"properties": {}}`, "application/json", 0, true, http.StatusOK, ""},
+		{"json with charset", `{"properties": {}}`, "application/json; charset=utf-8", 0, true, http.StatusOK, ""},
+		{"merge patch", `{"properties": {}}`, "application/merge-patch+json", 0, true, http.StatusOK, ""},
+		{"form", `properties=1`, "application/x-www-form-urlencoded", 0, true, http.StatusUnsupportedMediaType, "UnsupportedMediaType"},
+		{"no content type", `{"properties": {}}`, "", 0, true, http.StatusUnsupportedMediaType, "UnsupportedMediaType"},
+		{"no content type outside custom provider requests", `{"enabled": true}`, "", 0, false, http.StatusOK, ""},
+		{"empty body", ``, "", 0, true, http.StatusOK, ""},
+		{"too large", strings.Repeat("x", 65), "application/json", 0, true, http.StatusRequestEntityTooLarge, "RequestBodyTooLarge"},
+		{"too large without content length", strings.Repeat("x", 65), "application/json", -1, true, http.StatusRequestEntityTooLarge, "RequestBodyTooLarge"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("MAX_REQUEST_BODY_BYTES", "64")
+			var received string
+			handler := requestBodyMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				body, _ := io.ReadAll(r.Body)
+				received = string(body)
+			}))
+
+			req := httptest.NewRequest(http.MethodPut, "/", strings.NewReader(tt.body))
+			if tt.contentLength != 0 {
+				req.ContentLength = tt.contentLength
+			}
+			if tt.contentType != "" {
+				req.Header.Set("Content-Type", tt.contentType)
+			}
+			if tt.requestPath {
+				req.Header.Set(requestPathHeader, "/subscriptions/sub1/resourceGroups/rg1/providers/Microsoft.CustomProviders/resourceProviders/CyberArkProvider/safes/safe1")
+			}
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, req)
+
+			if w.Code != tt.status {
+				t.Fatalf("expected status %d, got %d: %s", tt.status, w.Code, w.Body.String())
+			}
+			if tt.code != "" {
+				if !strings.Contains(w.Body.String(), tt.code) {
+					t.Errorf("expected error code %s, got %s", tt.code, w.Body.String())
+				}
+				return
+			}
+			if received != tt.body {
+				t.Errorf("expected the handler to read the whole body, got %q", received)
+			}
+		})
+	}
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// requestFlagHeaderPrefix is prepended to a flag name to form its header, e.g. X-Provider-Async
+const requestFlagHeaderPrefix = "X-Provider-"
+
+// knownRequestFlags are the per-request behaviors a caller may toggle with a header
+var knownRequestFlags = []string{"async", "force-delete", "strict-validation"}
+
+type requestFlagsKey struct{}
+
+// allowedRequestFlags is the server-side allow-list from REQUEST_FLAGS_ALLOWED (comma separated flag
+// names, "*" for all known flags). Flags not on the list are ignored.
+func allowedRequestFlags() map[string]bool {
+	allowed := map[string]bool{}
+	for _, name := range strings.Split(os.Getenv("REQUEST_FLAGS_ALLOWED"), ",") {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "*" {
+			for _, known := range knownRequestFlags {
+				allowed[known] = true
+			}
+			continue
+		}
+		if name != "" {
+			allowed[name] = true
+		}
+	}
+	return allowed
+}
+
+// requestFlagsMiddleware reads X-Provider-{flag} headers into the request context.
+// Applied flags are echoed back in X-Provider-Flags.
+func requestFlagsMiddleware(next http.Handler) http.Handler {
+	allowed := allowedRequestFlags()
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		flags := map[string]bool{}
+		var applied []string
+		for _, name := range knownRequestFlags {
+			value := r.Header.Get(requestFlagHeaderPrefix + name)
+			if value == "" {
+				continue
+			}
+			enabled, err := strconv.ParseBool(value)
+			if err != nil {
+				log.Printf("WARNING: Ignoring request flag %s, invalid value %q", name, value)
+				continue
+			}
+			if !allowed[name] {
+				log.Printf("WARNING: Ignoring request flag %s, not in REQUEST_FLAGS_ALLOWED", name)
+				continue
+			}
+			flags[name] = enabled
+			applied = append(applied, name+"="+strconv.FormatBool(enabled))
+		}
+
+		if len(flags) > 0 {
+			sort.Strings(applied)
+			w.Header().Set("X-Provider-Flags", strings.Join(applied, ","))
+			r = r.WithContext(context.WithValue(r.Context(), requestFlagsKey{}, flags))
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// requestFlag returns the value of a flag set on this request and whether it was set at all
+func requestFlag(r *http.Request, name string) (bool, bool) {
+	flags, _ := r.Context().Value(requestFlagsKey{}).(map[string]bool)
+	enabled, ok := flags[name]
+	return enabled, ok
+}
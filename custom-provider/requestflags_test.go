@@ -0,0 +1,33 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRequestFlagsMiddleware(t *testing.T) {
+	t.Setenv("REQUEST_FLAGS_ALLOWED", "strict-validation")
+
+	var strict, strictSet, async, asyncSet bool
+	handler := requestFlagsMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		strict, strictSet = requestFlag(r, "strict-validation")
+		async, asyncSet = requestFlag(r, "async")
+	}))
+
+	req := httptest.NewRequest("PUT", "/", nil)
+	req.Header.Set("X-Provider-Strict-Validation", "true")
+	req.Header.Set("X-Provider-Async", "true")
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+
+	if !strictSet || !strict {
+		t.Errorf("expected allowed flag strict-validation to be applied")
+	}
+	if asyncSet || async {
+		t.Errorf("expected flag async to be ignored, it is not in the allow-list")
+	}
+	if got := rr.Header().Get("X-Provider-Flags"); got != "strict-validation=true" {
+		t.Errorf("expected X-Provider-Flags strict-validation=true, got %q", got)
+	}
+}
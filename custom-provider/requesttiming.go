@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+type requestTimingsKey struct{}
+
+// requestTimings accumulates time spent in each phase of a request (auth, pam, verification)
+type requestTimings struct {
+	mu     sync.Mutex
+	phases map[string]time.Duration
+}
+
+// startPhase begins timing a phase for the request; call the returned func when the phase ends.
+// Phases that run more than once are summed.
+func startPhase(r *http.Request, name string) func() {
+	timings, _ := r.Context().Value(requestTimingsKey{}).(*requestTimings)
+	if timings == nil {
+		return func() {}
+	}
+	phaseSpan := startSpan(r, name)
+	start := time.Now()
+	return func() {
+		phaseSpan.End(nil)
+		elapsed := time.Since(start)
+		log.Printf("DEBUG: [op=%s] %s phase took %dms", operationID(r), name, elapsed.Milliseconds())
+		timings.mu.Lock()
+		defer timings.mu.Unlock()
+		timings.phases[name] += elapsed
+	}
+}
+
+// statusRecorder captures the status code written by a handler
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (sr *statusRecorder) WriteHeader(code int) {
+	sr.status = code
+	sr.ResponseWriter.WriteHeader(code)
+}
+
+// slowRequestThreshold is read from SLOW_REQUEST_THRESHOLD (Go duration, default 10s)
+func slowRequestThreshold() time.Duration {
+	threshold, err := time.ParseDuration(getEnvOrDefault("SLOW_REQUEST_THRESHOLD", "10s"))
+	if err != nil {
+		log.Printf("WARNING: Invalid SLOW_REQUEST_THRESHOLD, using 10s: %v", err)
+		return 10 * time.Second
+	}
+	return threshold
+}
+
+// upstreamDuration is the time spent talking to PCloud and the Identity tenant so far
+func (t *requestTimings) upstreamDuration() time.Duration {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.phases["auth"] + t.phases["pam"]
+}
+
+// timingResponseWriter stamps the duration headers just before the status line is written
+type timingResponseWriter struct {
+	http.ResponseWriter
+	start       time.Time
+	timings     *requestTimings
+	status      int
+	wroteHeader bool
+}
+
+func (tw *timingResponseWriter) WriteHeader(code int) {
+	if !tw.wroteHeader {
+		tw.wroteHeader = true
+		tw.status = code
+		tw.Header().Set("X-Provider-Duration-Ms", strconv.FormatInt(time.Since(tw.start).Milliseconds(), 10))
+		tw.Header().Set("X-Upstream-Duration-Ms", strconv.FormatInt(tw.timings.upstreamDuration().Milliseconds(), 10))
+	}
+	tw.ResponseWriter.WriteHeader(code)
+}
+
+func (tw *timingResponseWriter) Write(b []byte) (int, error) {
+	if !tw.wroteHeader {
+		tw.WriteHeader(http.StatusOK)
+	}
+	return tw.ResponseWriter.Write(b)
+}
+
+// requestTimingMiddleware times every request, adds X-Provider-Duration-Ms and X-Upstream-Duration-Ms
+// (PCloud time) to the response, and logs a structured warning with per-phase timings when the
+// request runs longer than the slow-request threshold
+func requestTimingMiddleware(next http.Handler) http.Handler {
+	threshold := slowRequestThreshold()
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		timings := &requestTimings{phases: map[string]time.Duration{}}
+		r = r.WithContext(context.WithValue(r.Context(), requestTimingsKey{}, timings))
+		start := time.Now()
+		tw := &timingResponseWriter{ResponseWriter: w, start: start, timings: timings, status: http.StatusOK}
+
+		next.ServeHTTP(tw, r)
+		elapsed := time.Since(start)
+
+		resourceType := metricResourceType(r)
+		requestsTotal.Inc("method", r.Method, "resourceType", resourceType, "code", strconv.Itoa(tw.status))
+		requestDuration.Observe(elapsed, "method", r.Method, "resourceType", resourceType)
+
+		if elapsed < threshold {
+			return
+		}
+
+		slowRequestsTotal.Inc("method", r.Method, "resourceType", resourceType)
+
+		timings.mu.Lock()
+		phases := map[string]int64{}
+		for name, d := range timings.phases {
+			phases[name] = d.Milliseconds()
+		}
+		timings.mu.Unlock()
+
+		entry, _ := json.Marshal(map[string]interface{}{
+			"event":         "slow_request",
+			"operationId":   operationID(r),
+			"method":        r.Method,
+			"path":          r.URL.Path,
+			"resourceType":  resourceType,
+			"requestPath":   customProviderRequestPath(r),
+			"correlationId": r.Header.Get("X-Ms-Correlation-Request-Id"),
+			"status":        tw.status,
+			"durationMs":    elapsed.Milliseconds(),
+			"thresholdMs":   threshold.Milliseconds(),
+			"phasesMs":      phases,
+		})
+		log.Printf("WARNING: Slow request %s", entry)
+	})
+}
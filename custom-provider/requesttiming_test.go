@@ -0,0 +1,42 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestRequestTimingMiddleware_Headers(t *testing.T) {
+	handler := requestTimingMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		stop := startPhase(r, "pam")
+		time.Sleep(5 * time.Millisecond)
+		stop()
+		w.WriteHeader(http.StatusCreated)
+	}))
+
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, httptest.NewRequest("PUT", "/", nil))
+
+	if rr.Code != http.StatusCreated {
+		t.Errorf("expected status %d, got %d", http.StatusCreated, rr.Code)
+	}
+	total, err := strconv.Atoi(rr.Header().Get("X-Provider-Duration-Ms"))
+	if err != nil {
+		t.Fatalf("missing or invalid X-Provider-Duration-Ms: %v", err)
+	}
+	upstream, err := strconv.Atoi(rr.Header().Get("X-Upstream-Duration-Ms"))
+	if err != nil {
+		t.Fatalf("missing or invalid X-Upstream-Duration-Ms: %v", err)
+	}
+	if upstream < 5 || upstream > total {
+		t.Errorf("expected 5 <= upstream (%d) <= total (%d)", upstream, total)
+	}
+}
+
+func TestStartPhase_NoTimings(t *testing.T) {
+	// Requests that did not pass through the middleware must not panic
+	stop := startPhase(httptest.NewRequest("GET", "/", nil), "auth")
+	stop()
+}
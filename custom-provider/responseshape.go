@@ -0,0 +1,159 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+
+	"github.com/davidh-cyberark/privilegeaccessmanager-sdk-go/pam"
+)
+
+// The properties returned to ARM follow a stable camelCase schema per resource type, independent
+// of how the PCloud SDK structs happen to marshal. RESPONSE_SHAPE=legacy emits the shape used by
+// earlier releases (SDK field names for accounts, safeID for safes) for templates that depend on it.
+
+// SafeResourceProperties is the properties schema of the safes resource type
+type SafeResourceProperties struct {
+	SafeName                  string `json:"safeName"`
+	SafeID                    string `json:"safeId"`
+	Description               string `json:"description"`
+	Location                  string `json:"location,omitempty"`
+	ManagingCPM               string `json:"managingCpm,omitempty"`
+	NumberOfDaysRetention     int    `json:"numberOfDaysRetention,omitempty"`
+	NumberOfVersionsRetention any    `json:"numberOfVersionsRetention,omitempty"`
+	OlacEnabled               bool   `json:"olacEnabled"`
+	AutoPurgeEnabled          bool   `json:"autoPurgeEnabled"`
+	CreationTime              int64  `json:"creationTime,omitempty"`
+	LastModificationTime      int64  `json:"lastModificationTime,omitempty"`
+	Profile                   string `json:"profile,omitempty"`
+	ProvisioningState         string `json:"provisioningState"`
+	DegradedMode              string `json:"degradedMode,omitempty"`
+}
+
+// AccountSecretManagement is the secretManagement block of the accounts schema
+type AccountSecretManagement struct {
+	AutomaticManagementEnabled bool   `json:"automaticManagementEnabled"`
+	ManualManagementReason     string `json:"manualManagementReason,omitempty"`
+	Status                     string `json:"status,omitempty"`
+}
+
+// AccountResourceProperties is the properties schema of the accounts resource type
+type AccountResourceProperties struct {
+	AccountID                 string                   `json:"accountId"`
+	Name                      string                   `json:"name"`
+	SafeName                  string                   `json:"safeName"`
+	PlatformID                string                   `json:"platformId"`
+	Address                   string                   `json:"address,omitempty"`
+	UserName                  string                   `json:"userName,omitempty"`
+	SecretType                string                   `json:"secretType,omitempty"`
+	PlatformAccountProperties map[string]string        `json:"platformAccountProperties,omitempty"`
+	SecretManagement          AccountSecretManagement  `json:"secretManagement"`
+	RemoteMachinesAccess      pam.RemoteMachinesAccess `json:"remoteMachinesAccess"`
+	CreatedTime               int                      `json:"createdTime,omitempty"`
+	CategoryModificationTime  int                      `json:"categoryModificationTime,omitempty"`
+	ProvisioningState         string                   `json:"provisioningState"`
+	DegradedMode              string                   `json:"degradedMode,omitempty"`
+}
+
+// legacyResponseShape reports whether the request's api-version, or RESPONSE_SHAPE when the version
+// does not pin a shape, asks for the pre-schema property shape
+func legacyResponseShape(r *http.Request) bool {
+	if shape := requestAPIVersion(r).Shape; shape != "" {
+		return shape == "legacy"
+	}
+	shape := getEnvOrDefault("RESPONSE_SHAPE", "v1")
+	if shape != "v1" && shape != "legacy" {
+		log.Printf("WARNING: Invalid RESPONSE_SHAPE %q, using v1", shape)
+	}
+	return shape == "legacy"
+}
+
+// safeResourceProperties shapes a safe returned by PCloud (GetSafeDetails or PostAddSafeResponse)
+func safeResourceProperties(r *http.Request, source interface{}, profile string) (map[string]interface{}, error) {
+	var safe pam.GetSafeDetails
+	if err := convertJSON(source, &safe); err != nil {
+		return nil, err
+	}
+
+	if legacyResponseShape(r) {
+		properties := map[string]interface{}{
+			"safeName":          safe.SafeName,
+			"safeID":            safe.SafeURLID,
+			"description":       safe.Description,
+			"provisioningState": "Succeeded",
+		}
+		if profile != "" {
+			properties["profile"] = profile
+		}
+		if mode := degradedMode(); mode != "" {
+			properties["degradedMode"] = mode
+		}
+		return properties, nil
+	}
+
+	return toProperties(SafeResourceProperties{
+		SafeName:                  safe.SafeName,
+		SafeID:                    safe.SafeURLID,
+		Description:               safe.Description,
+		Location:                  safe.Location,
+		ManagingCPM:               safe.ManagingCPM,
+		NumberOfDaysRetention:     safe.NumberOfDaysRetention,
+		NumberOfVersionsRetention: safe.NumberOfVersionsRetention,
+		OlacEnabled:               safe.OlacEnabled,
+		AutoPurgeEnabled:          safe.AutoPurgeEnabled,
+		CreationTime:              int64(safe.CreationTime),
+		LastModificationTime:      safe.LastModificationTime,
+		Profile:                   profile,
+		ProvisioningState:         "Succeeded",
+		DegradedMode:              degradedMode(),
+	})
+}
+
+// accountResourceProperties shapes an account returned by PCloud (GetAccountResponse or PostAddAccountResponse)
+func accountResourceProperties(r *http.Request, source interface{}) (map[string]interface{}, error) {
+	if legacyResponseShape(r) {
+		properties, err := toProperties(source)
+		if err != nil {
+			return nil, err
+		}
+		properties["provisioningState"] = "Succeeded"
+		if mode := degradedMode(); mode != "" {
+			properties["degradedMode"] = mode
+		}
+		return properties, nil
+	}
+
+	var account pam.GetAccountResponse
+	if err := convertJSON(source, &account); err != nil {
+		return nil, err
+	}
+	return toProperties(AccountResourceProperties{
+		AccountID:                 account.ID,
+		Name:                      account.Name,
+		SafeName:                  account.SafeName,
+		PlatformID:                account.PlatformID,
+		Address:                   account.Address,
+		UserName:                  account.UserName,
+		SecretType:                account.SecretType,
+		PlatformAccountProperties: account.PlatformAccountProperties,
+		SecretManagement: AccountSecretManagement{
+			AutomaticManagementEnabled: account.SecretManagement.AutomaticManagementEnabled,
+			ManualManagementReason:     account.SecretManagement.ManualManagementReason,
+			Status:                     account.SecretManagement.Status,
+		},
+		RemoteMachinesAccess:     account.RemoteMachinesAccess,
+		CreatedTime:              account.CreatedTime,
+		CategoryModificationTime: account.CategoryModificationTime,
+		ProvisioningState:        "Succeeded",
+		DegradedMode:             degradedMode(),
+	})
+}
+
+// convertJSON copies src into dst through their JSON representations
+func convertJSON(src, dst interface{}) error {
+	data, err := json.Marshal(src)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, dst)
+}
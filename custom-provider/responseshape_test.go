@@ -0,0 +1,133 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/davidh-cyberark/privilegeaccessmanager-sdk-go/pam"
+)
+
+func propertyKeys(properties map[string]interface{}) []string {
+	keys := make([]string, 0, len(properties))
+	for key := range properties {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func TestAccountResourceProperties(t *testing.T) {
+	account := pam.GetAccountResponse{
+		ID:                       "12_3",
+		Name:                     "acct1",
+		SafeName:                 "safe1",
+		PlatformID:               "UnixSSH",
+		Address:                  "host1",
+		CategoryModificationTime: 1700000000,
+	}
+
+	tests := []struct {
+		name     string
+		shape    string
+		expected []string
+	}{
+		{
+			name:  "v1",
+			shape: "v1",
+			expected: []string{"accountId", "address", "categoryModificationTime", "name", "platformId",
+				"provisioningState", "remoteMachinesAccess", "safeName", "secretManagement"},
+		},
+		{
+			name:  "legacy",
+			shape: "legacy",
+			expected: []string{"CategoryModificationTime", "address", "id", "name", "platformId",
+				"provisioningState", "remoteMachinesAccess", "safeName", "secretManagement"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("RESPONSE_SHAPE", tt.shape)
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			properties, err := accountResourceProperties(r, account)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if keys := propertyKeys(properties); !reflect.DeepEqual(keys, tt.expected) {
+				t.Errorf("expected keys %v, got %v", tt.expected, keys)
+			}
+		})
+	}
+}
+
+func TestSafeResourceProperties(t *testing.T) {
+	safe := pam.PostAddSafeResponse{SafeURLID: "safe1", SafeName: "safe1", Description: "d", ManagingCPM: "PasswordManager"}
+
+	tests := []struct {
+		name     string
+		shape    string
+		expected []string
+	}{
+		{
+			name:     "v1",
+			shape:    "v1",
+			expected: []string{"autoPurgeEnabled", "description", "managingCpm", "olacEnabled", "profile", "provisioningState", "safeId", "safeName"},
+		},
+		{
+			name:     "legacy",
+			shape:    "legacy",
+			expected: []string{"description", "profile", "provisioningState", "safeID", "safeName"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("RESPONSE_SHAPE", tt.shape)
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			properties, err := safeResourceProperties(r, safe, "prod-default")
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if keys := propertyKeys(properties); !reflect.DeepEqual(keys, tt.expected) {
+				t.Errorf("expected keys %v, got %v", tt.expected, keys)
+			}
+		})
+	}
+}
+
+func TestAPIVersionMiddleware(t *testing.T) {
+	t.Setenv("RESPONSE_SHAPE", "legacy")
+
+	tests := []struct {
+		name           string
+		query          string
+		expectedStatus int
+		expectedLegacy bool
+	}{
+		{name: "no api-version", query: "", expectedStatus: http.StatusOK, expectedLegacy: true},
+		{name: "ARM api-version follows RESPONSE_SHAPE", query: "?api-version=2018-09-01-preview", expectedStatus: http.StatusOK, expectedLegacy: true},
+		{name: "version pinning v1", query: "?api-version=2025-06-01", expectedStatus: http.StatusOK, expectedLegacy: false},
+		{name: "unknown version", query: "?api-version=2030-01-01", expectedStatus: http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var legacy bool
+			handler := apiVersionMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				legacy = legacyResponseShape(r)
+			}))
+			rr := httptest.NewRecorder()
+			handler.ServeHTTP(rr, httptest.NewRequest(http.MethodPut, "/"+tt.query, nil))
+
+			if rr.Code != tt.expectedStatus {
+				t.Fatalf("expected status %d, got %d: %s", tt.expectedStatus, rr.Code, rr.Body.String())
+			}
+			if rr.Code == http.StatusOK && legacy != tt.expectedLegacy {
+				t.Errorf("expected legacy shape %t, got %t", tt.expectedLegacy, legacy)
+			}
+		})
+	}
+}
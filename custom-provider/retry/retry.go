@@ -0,0 +1,93 @@
+// Package retry repeats operations that failed with a transient error, waiting an exponentially
+// growing, jittered delay between attempts. The provider uses it for every Privilege Cloud call;
+// callers decide which failures are transient by wrapping them with Retryable.
+package retry
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"time"
+)
+
+// Policy is how often and how patiently an operation is retried
+type Policy struct {
+	// MaxRetries is the number of attempts after the first one; 0 never retries
+	MaxRetries int
+	// Base is the delay before the first retry; each further retry waits twice as long
+	Base time.Duration
+	// MaxDelay caps the delay between attempts; 0 means no cap
+	MaxDelay time.Duration
+	// OnRetry, when set, is called before waiting for retry n (1-based)
+	OnRetry func(n int, delay time.Duration, err error)
+}
+
+// retryableError marks an error as transient
+type retryableError struct {
+	err error
+}
+
+func (e *retryableError) Error() string { return e.err.Error() }
+func (e *retryableError) Unwrap() error { return e.err }
+
+// Retryable marks err as transient, so Do tries the operation again; nil stays nil
+func Retryable(err error) error {
+	if err == nil {
+		return nil
+	}
+	return &retryableError{err: err}
+}
+
+// IsRetryable reports whether err was marked with Retryable
+func IsRetryable(err error) bool {
+	var r *retryableError
+	return errors.As(err, &r)
+}
+
+// Delay returns the wait before retry n (1-based): Base doubled n-1 times and capped at MaxDelay,
+// of which a random part up to half is taken off so concurrent callers do not retry in lockstep
+func (p Policy) Delay(n int) time.Duration {
+	if p.Base <= 0 || n < 1 {
+		return 0
+	}
+	delay := p.Base
+	for i := 1; i < n && (p.MaxDelay <= 0 || delay < p.MaxDelay); i++ {
+		delay *= 2
+	}
+	if p.MaxDelay > 0 && delay > p.MaxDelay {
+		delay = p.MaxDelay
+	}
+	return delay - time.Duration(rand.Int63n(int64(delay/2)+1))
+}
+
+// Do calls op until it succeeds, returns an error not marked with Retryable, or MaxRetries retries
+// have failed. It stops waiting when ctx is done. The returned error is op's last error with the
+// Retryable mark removed; when the retries are used up or ctx ends, it says so.
+func Do(ctx context.Context, p Policy, op func(attempt int) error) error {
+	for attempt := 1; ; attempt++ {
+		err := op(attempt)
+		var r *retryableError
+		if err == nil || !errors.As(err, &r) {
+			return err
+		}
+		if attempt > p.MaxRetries {
+			if attempt == 1 {
+				return r.err
+			}
+			return fmt.Errorf("giving up after %d attempts: %w", attempt, r.err)
+		}
+
+		delay := p.Delay(attempt)
+		if p.OnRetry != nil {
+			p.OnRetry(attempt, delay, r.err)
+		}
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return fmt.Errorf("%w after %d attempts: %w", ctx.Err(), attempt, r.err)
+		case <-timer.C:
+		}
+	}
+}
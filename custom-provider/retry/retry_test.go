@@ -0,0 +1,101 @@
+package retry
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDelay(t *testing.T) {
+	p := Policy{Base: 100 * time.Millisecond, MaxDelay: time.Second}
+	tests := []struct {
+		n        int
+		min, max time.Duration
+	}{
+		{1, 50 * time.Millisecond, 100 * time.Millisecond},
+		{2, 100 * time.Millisecond, 200 * time.Millisecond},
+		{3, 200 * time.Millisecond, 400 * time.Millisecond},
+		{5, 500 * time.Millisecond, time.Second},
+		{60, 500 * time.Millisecond, time.Second},
+	}
+	for _, tt := range tests {
+		for i := 0; i < 20; i++ {
+			if d := p.Delay(tt.n); d < tt.min || d > tt.max {
+				t.Fatalf("Delay(%d) = %s, want between %s and %s", tt.n, d, tt.min, tt.max)
+			}
+		}
+	}
+	if d := (Policy{}).Delay(1); d != 0 {
+		t.Errorf("expected no delay without a base, got %s", d)
+	}
+}
+
+func TestDo(t *testing.T) {
+	transient := errors.New("status 503")
+	permanent := errors.New("status 400")
+
+	tests := []struct {
+		name     string
+		results  []error
+		retries  int
+		calls    int
+		wantErr  error
+		giveUp   bool
+		wantNone bool
+	}{
+		{name: "succeeds first", results: []error{nil}, retries: 2, calls: 1, wantNone: true},
+		{name: "succeeds after transient", results: []error{Retryable(transient), nil}, retries: 2, calls: 2, wantNone: true},
+		{name: "permanent is not retried", results: []error{permanent}, retries: 2, calls: 1, wantErr: permanent},
+		{name: "gives up", results: []error{Retryable(transient), Retryable(transient), Retryable(transient)}, retries: 2, calls: 3, wantErr: transient, giveUp: true},
+		{name: "no retries", results: []error{Retryable(transient)}, retries: 0, calls: 1, wantErr: transient},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			calls := 0
+			retried := 0
+			p := Policy{MaxRetries: tt.retries, Base: time.Millisecond, OnRetry: func(int, time.Duration, error) { retried++ }}
+			err := Do(context.Background(), p, func(attempt int) error {
+				calls++
+				if attempt != calls {
+					t.Errorf("attempt %d on call %d", attempt, calls)
+				}
+				return tt.results[calls-1]
+			})
+			if calls != tt.calls || retried != calls-1 {
+				t.Errorf("expected %d calls, got %d (%d retries)", tt.calls, calls, retried)
+			}
+			if tt.wantNone {
+				if err != nil {
+					t.Errorf("unexpected error %v", err)
+				}
+				return
+			}
+			if !errors.Is(err, tt.wantErr) || IsRetryable(err) {
+				t.Errorf("expected %v without the retryable mark, got %v", tt.wantErr, err)
+			}
+			if tt.giveUp != strings.Contains(err.Error(), "giving up after") {
+				t.Errorf("unexpected error text %q", err.Error())
+			}
+		})
+	}
+}
+
+func TestDoStopsWhenContextEnds(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+
+	calls := 0
+	start := time.Now()
+	err := Do(ctx, Policy{MaxRetries: 5, Base: time.Minute}, func(int) error {
+		calls++
+		return Retryable(errors.New("status 429"))
+	})
+	if !errors.Is(err, context.DeadlineExceeded) || calls != 1 {
+		t.Errorf("expected the deadline after 1 call, got %v after %d calls", err, calls)
+	}
+	if time.Since(start) > 5*time.Second {
+		t.Errorf("Do kept waiting after the context ended")
+	}
+}
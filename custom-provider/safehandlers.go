@@ -1,14 +1,35 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"log"
 	"net/http"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/davidh-cyberark/privilegeaccessmanager-sdk-go/pam"
 )
 
+// SafePatchRequest is the body of a safes PATCH; only the properties present are changed
+type SafePatchRequest struct {
+	Properties struct {
+		Description *string `json:"description"`
+		// Members are added, or have their permissions updated; members not listed are left alone
+		Members       []pam.PostAddMemberRequest `json:"members"`
+		ConfirmDelete *bool                      `json:"confirmDelete"`
+		// PreventDeletion turns the safe's deletion lock on or off
+		PreventDeletion *bool   `json:"preventDeletion"`
+		DeletionPolicy  *string `json:"deletionPolicy"`
+	} `json:"properties"`
+}
+
 // SafeRequest represents the request to create a safe
 type SafeRequest struct {
 	Properties SafeProperties `json:"properties"`
@@ -16,21 +37,64 @@ type SafeRequest struct {
 
 // SafeProperties contains the properties for a safe
 type SafeProperties struct {
-	SafeName    string `json:"safeName"`
-	Description string `json:"description,omitempty"`
+	SafeName    string `json:"safeName" validate:"required,max=28,pattern=safeName"`
+	Description string `json:"description,omitempty" validate:"max=100"`
+	Profile     string `json:"profile,omitempty"` // name of a server-side SafeProfile
+	// ConfirmDelete allows deleting the safe while it holds more than SAFE_DELETE_ACCOUNT_THRESHOLD accounts
+	ConfirmDelete bool `json:"confirmDelete,omitempty"`
+	// PreventDeletion refuses every DELETE of the safe unless the caller forces it, see deletionprotection.go
+	PreventDeletion bool `json:"preventDeletion,omitempty"`
+	// DeletionPolicy Retain keeps the safe in PCloud when the resource is deleted, see deletionpolicy.go
+	DeletionPolicy string `json:"deletionPolicy,omitempty" validate:"pattern=deletionPolicy"`
+
+	// Creation options; when set they take precedence over the profile's settings. PCloud keeps
+	// either versions or days of retention, so at most one of the two may be set.
+	ManagingCPM               string `json:"managingCPM,omitempty" validate:"max=20"`
+	NumberOfVersionsRetention int    `json:"numberOfVersionsRetention,omitempty" validate:"min=1,max=999"`
+	NumberOfDaysRetention     int    `json:"numberOfDaysRetention,omitempty" validate:"min=1,max=3650"`
+	OlacEnabled               *bool  `json:"olacEnabled,omitempty"`
+	Location                  string `json:"location,omitempty" validate:"max=255"`
+}
+
+// applySafeOptions copies the creation options set on the request over the profile's settings
+func applySafeOptions(request *pam.PostAddSafeRequest, properties SafeProperties) {
+	if properties.ManagingCPM != "" {
+		request.ManagingCPM = properties.ManagingCPM
+	}
+	if properties.NumberOfVersionsRetention != 0 {
+		request.NumberOfVersionsRetention = properties.NumberOfVersionsRetention
+		request.NumberOfDaysRetention = 0
+	}
+	if properties.NumberOfDaysRetention != 0 {
+		request.NumberOfDaysRetention = properties.NumberOfDaysRetention
+		request.NumberOfVersionsRetention = 0
+	}
+	if properties.OlacEnabled != nil {
+		request.OlacEnabled = *properties.OlacEnabled
+	}
+	if properties.Location != "" {
+		request.Location = properties.Location
+	}
 }
 
 // handleSafe routes safe-related requests to appropriate handlers
 func handleSafe(w http.ResponseWriter, r *http.Request, cpRequest CustomProviderRequestPath) {
 	LogRequestDebug("Safe", r)
 
+	if r.Method != http.MethodGet && !checkPreconditions(w, r, cpRequest, handleGetSafe) {
+		return
+	}
 	switch r.Method {
 	case "PUT":
-		handleCreateSafe(w, r, cpRequest)
+		provision(w, r, cpRequest, handleCreateSafe)
+	case "PATCH":
+		handleUpdateSafe(w, r, cpRequest)
 	case "DELETE":
 		handleDeleteSafe(w, r, cpRequest)
 	case "GET":
 		handleGetSafe(w, r, cpRequest)
+	default:
+		sendJSONError(w, http.StatusMethodNotAllowed, "MethodNotAllowed", fmt.Sprintf("Method %s is not supported for safes", r.Method))
 	}
 }
 
@@ -39,73 +103,469 @@ func handleCreateSafe(w http.ResponseWriter, r *http.Request, cpRequest CustomPr
 	LogRequestDebug("CreateSafe", r)
 
 	var request SafeRequest
-	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+	if err := decodeRequestBody(r, &request); err != nil {
+		var unknownErr *UnknownPropertiesError
+		if errors.As(err, &unknownErr) {
+			sendJSONError(w, http.StatusBadRequest, "UnknownProperties", err.Error())
+			return
+		}
 		sendJSONError(w, http.StatusBadRequest, "InvalidRequestBody", fmt.Sprintf("Invalid request body: %v", err))
 		return
 	}
+	details := validateRequest(request)
+	if request.Properties.NumberOfVersionsRetention != 0 && request.Properties.NumberOfDaysRetention != 0 {
+		details = append(details, ErrorDetails{Code: "PropertyConflict", Target: "properties.numberOfDaysRetention",
+			Message: "properties.numberOfDaysRetention cannot be set together with properties.numberOfVersionsRetention"})
+	}
+	if len(details) > 0 {
+		sendValidationError(w, details)
+		return
+	}
+
+	addSafeRequest := pam.PostAddSafeRequest{
+		SafeName:    request.Properties.SafeName,
+		Description: request.Properties.Description,
+	}
+	var profile SafeProfile
+	if request.Properties.Profile != "" {
+		var err error
+		profile, err = applySafeProfile(&addSafeRequest, request.Properties.Profile)
+		if err != nil {
+			sendJSONError(w, http.StatusBadRequest, "InvalidSafeProfile", err.Error())
+			return
+		}
+	}
+	applySafeOptions(&addSafeRequest, request.Properties)
 
-	pamClient, err := createPAMClient()
+	stopAuth := startPhase(r, "auth")
+	pamService, err := newPAMService()
+	stopAuth()
 	if err != nil {
 		sendJSONError(w, http.StatusInternalServerError, "PAMClientError", fmt.Sprintf("Failed to create PAM client: %v", err))
 		return
 	}
 
-	safeID, err := createSafe(pamClient, request.Properties.SafeName, request.Properties.Description)
+	// A re-run deployment PUTs the safe again; answer with the existing safe instead of a failed AddSafe
+	stopPAM := startPhase(r, "pam")
+	getSpan := startSpan(r, "GetSafeDetails", "pcloud.safeName", addSafeRequest.SafeName)
+	existing, retcode, err := pcloudRetry(r.Context(), "safes", "GetSafeDetails", true, func(ctx context.Context) (pam.GetSafeDetails, int, error) {
+		return pamService.GetSafeDetails(ctx, addSafeRequest.SafeName)
+	})
+	getSpan.SetAttr("pcloud.status", strconv.Itoa(retcode))
+	getSpan.End(err)
+	stopPAM()
+	if err != nil || (retcode >= 300 && retcode != http.StatusNotFound) {
+		sendJSONError(w, http.StatusInternalServerError, "GetSafeDetailsError", fmt.Sprintf("Failed to check for an existing safe: (%d) %v", retcode, checkMaintenance(err)))
+		return
+	}
+	if retcode != http.StatusNotFound {
+		handleExistingSafe(w, r, cpRequest, request.Properties, addSafeRequest, existing, profile)
+		return
+	}
+
+	stopPAM = startPhase(r, "pam")
+	addSpan := startSpan(r, "AddSafe", "pcloud.safeName", addSafeRequest.SafeName)
+	safe, err := createSafe(r.Context(), pamService, addSafeRequest)
+	addSpan.End(err)
+	stopPAM()
 	if err != nil {
 		sendJSONError(w, http.StatusInternalServerError, "SafeCreationError", fmt.Sprintf("Failed to create safe: %v", err))
 		return
 	}
+	rec := ResourceRecord{
+		ResourceID:   cpRequest.ID(),
+		ResourceType: cpRequest.ResourceTypeName,
+		SafeName:     request.Properties.SafeName,
+		PCloudID:     safe.SafeURLID,
+		Deployment:   newDeploymentStamp(r),
+		Declared:     safeDriftSettings(safe.Description, safe.ManagingCPM, safe.NumberOfDaysRetention, safe.NumberOfVersionsRetention, safe.OlacEnabled),
 
+		PreventDeletion: request.Properties.PreventDeletion,
+		DeletionPolicy:  recordedDeletionPolicy(request.Properties.DeletionPolicy),
+	}
+	if request.Properties.ConfirmDelete {
+		confirmedAt := rec.Deployment.CreatedAt
+		rec.ConfirmDeleteAt = &confirmedAt
+	}
+	recordResource(rec)
+
+	stopPAM = startPhase(r, "pam")
+	err = addProfileMembers(r.Context(), safe.SafeURLID, profile.Members, false)
+	stopPAM()
+	if err != nil {
+		sendJSONError(w, http.StatusInternalServerError, "SafeMemberError", fmt.Sprintf("Safe created, but applying profile %s failed: %v", request.Properties.Profile, err))
+		return
+	}
+
+	properties, err := safeResourceProperties(r, safe, request.Properties.Profile)
+	if err != nil {
+		sendJSONError(w, http.StatusInternalServerError, "SafeMarshalError", err.Error())
+		return
+	}
+	addSafeRecordProperties(properties, rec)
 	response := CustomProviderResponse{
-		ID:   cpRequest.ID(),
-		Name: cpRequest.ResourceInstanceName,
-		Type: fmt.Sprintf("Microsoft.CustomProviders/resourceProviders/%s", cpRequest.ResourceTypeName),
-		Properties: map[string]interface{}{
-			"safeName":          request.Properties.SafeName,
-			"safeID":            safeID,
-			"description":       request.Properties.Description,
-			"provisioningState": "Succeeded",
-		},
+		ID:         cpRequest.ID(),
+		Name:       cpRequest.ResourceInstanceName,
+		Type:       fmt.Sprintf("Microsoft.CustomProviders/resourceProviders/%s", cpRequest.ResourceTypeName),
+		Properties: properties,
 	}
+	rec.ETag = resourceETag(response)
+	recordResource(rec)
+	recentlyCreated.Put(response)
+	notifyLifecycle(r, "Created", rec)
 
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusCreated)
 	json.NewEncoder(w).Encode(response)
 }
 
+// handleExistingSafe answers a PUT for a safe that already exists: 200 with the existing safe when
+// it has the requested settings, 409 with the differences otherwise (PATCH changes them)
+func handleExistingSafe(w http.ResponseWriter, r *http.Request, cpRequest CustomProviderRequestPath, properties SafeProperties, addSafeRequest pam.PostAddSafeRequest, safe pam.GetSafeDetails, profile SafeProfile) {
+	live := safeDriftSettings(safe.Description, safe.ManagingCPM, safe.NumberOfDaysRetention, safe.NumberOfVersionsRetention, safe.OlacEnabled)
+	if diff := diffSettings(requestedSafeSettings(addSafeRequest), live); len(diff) > 0 {
+		names := make([]string, 0, len(diff))
+		for name, d := range diff {
+			names = append(names, fmt.Sprintf("%s (requested %q, actual %q)", name, d.Declared, d.Actual))
+		}
+		sort.Strings(names)
+		sendJSONError(w, http.StatusConflict, "SafeAlreadyExists",
+			fmt.Sprintf("Safe %s already exists with different settings: %s", safe.SafeName, strings.Join(names, ", ")))
+		return
+	}
+	log.Printf("INFO: (CreateSafe) safe %s already exists with the requested settings", safe.SafeName)
+
+	rec := ResourceRecord{
+		ResourceID:   cpRequest.ID(),
+		ResourceType: cpRequest.ResourceTypeName,
+		SafeName:     safe.SafeName,
+		PCloudID:     safe.SafeURLID,
+		Deployment:   newDeploymentStamp(r),
+		Declared:     live,
+
+		PreventDeletion: properties.PreventDeletion,
+		DeletionPolicy:  recordedDeletionPolicy(properties.DeletionPolicy),
+	}
+	if properties.ConfirmDelete {
+		// Keep the time confirmDelete was first declared, so re-running the template does not restart the window
+		confirmedAt := rec.Deployment.CreatedAt
+		rec.ConfirmDeleteAt = &confirmedAt
+		if previous, found, err := stateStore.Get(cpRequest.ID()); err == nil && found && previous.ConfirmDeleteAt != nil {
+			rec.ConfirmDeleteAt = previous.ConfirmDeleteAt
+		}
+	}
+	recordResource(rec)
+
+	// Profile members may be missing when an earlier PUT failed after creating the safe
+	stopPAM := startPhase(r, "pam")
+	err := addProfileMembers(r.Context(), safe.SafeURLID, profile.Members, true)
+	stopPAM()
+	if err != nil {
+		sendJSONError(w, http.StatusInternalServerError, "SafeMemberError", fmt.Sprintf("Safe exists, but applying profile %s failed: %v", properties.Profile, err))
+		return
+	}
+
+	resourceProperties, err := safeResourceProperties(r, safe, properties.Profile)
+	if err != nil {
+		sendJSONError(w, http.StatusInternalServerError, "SafeMarshalError", err.Error())
+		return
+	}
+	addSafeRecordProperties(resourceProperties, rec)
+	sendJSONResource(w, r, http.StatusOK, CustomProviderResponse{
+		ID:         cpRequest.ID(),
+		Name:       cpRequest.ResourceInstanceName,
+		Type:       fmt.Sprintf("Microsoft.CustomProviders/resourceProviders/%s", cpRequest.ResourceTypeName),
+		Properties: resourceProperties,
+	})
+}
+
+// requestedSafeSettings returns the settings a PUT asks for, in the form of safeDriftSettings.
+// Settings left out of the request get PCloud defaults, so only the description is always compared.
+func requestedSafeSettings(request pam.PostAddSafeRequest) map[string]string {
+	requested := map[string]string{"description": request.Description}
+	if request.ManagingCPM != "" {
+		requested["managingCPM"] = request.ManagingCPM
+	}
+	if request.NumberOfDaysRetention != 0 {
+		requested["numberOfDaysRetention"] = fmt.Sprint(request.NumberOfDaysRetention)
+	}
+	if request.NumberOfVersionsRetention != 0 {
+		requested["numberOfVersionsRetention"] = fmt.Sprint(request.NumberOfVersionsRetention)
+	}
+	if request.OlacEnabled {
+		requested["olacEnabled"] = "true"
+	}
+	return requested
+}
+
+// missingMembers returns the members that are not on the safe yet; when the member list cannot be
+// read every member is returned, and adding an existing member then fails loudly
+func missingMembers(ctx context.Context, pamClient *pam.Client, safeURLID string, members []pam.PostAddMemberRequest) []pam.PostAddMemberRequest {
+	if len(members) == 0 {
+		return nil
+	}
+	current, retcode, err := listSafeMembers(ctx, pamClient, safeURLID)
+	if err != nil {
+		log.Printf("WARNING: Could not list members of safe %s: (%d) %v", safeURLID, retcode, err)
+		return members
+	}
+	present := map[string]bool{}
+	for _, member := range current {
+		present[strings.ToLower(member.MemberName)] = true
+	}
+	var missing []pam.PostAddMemberRequest
+	for _, member := range members {
+		if !present[strings.ToLower(member.MemberName)] {
+			missing = append(missing, member)
+		}
+	}
+	return missing
+}
+
+// handleUpdateSafe handles PATCH on a safe: description, member list and confirmDelete
+func handleUpdateSafe(w http.ResponseWriter, r *http.Request, cpRequest CustomProviderRequestPath) {
+	LogRequestDebug("UpdateSafe", r)
+	recentlyCreated.Forget(cpRequest.ID())
+
+	var request SafePatchRequest
+	var envelope struct {
+		Properties json.RawMessage `json:"properties"`
+	}
+	body, err := io.ReadAll(r.Body)
+	if err == nil {
+		err = json.Unmarshal(body, &request)
+	}
+	if err == nil {
+		err = json.Unmarshal(body, &envelope)
+	}
+	if err != nil {
+		sendJSONError(w, http.StatusBadRequest, "InvalidRequestBody", fmt.Sprintf("Invalid request body: %v", err))
+		return
+	}
+	// Anything outside the patchable properties would be silently ignored, so reject it
+	if unsupported := unknownProperties(envelope.Properties, reflect.TypeOf(request.Properties), "properties", true); len(unsupported) > 0 {
+		sort.Strings(unsupported)
+		sendJSONError(w, http.StatusBadRequest, "UnsupportedPatch", fmt.Sprintf("these properties cannot be changed with PATCH: %s", strings.Join(unsupported, ", ")))
+		return
+	}
+	if policy := request.Properties.DeletionPolicy; policy != nil {
+		if details := checkDeletionPolicy(*policy); len(details) > 0 {
+			sendValidationError(w, details)
+			return
+		}
+	}
+
+	stopAuth := startPhase(r, "auth")
+	pamService, err := newPAMService()
+	stopAuth()
+	if err != nil {
+		sendJSONError(w, http.StatusInternalServerError, "PAMClientError", fmt.Sprintf("Failed to create PAM client: %v", err))
+		return
+	}
+
+	stopPAM := startPhase(r, "pam")
+	defer stopPAM()
+
+	safe, retcode, err := pcloudRetry(r.Context(), "safes", "GetSafeDetails", true, func(ctx context.Context) (pam.GetSafeDetails, int, error) {
+		return pamService.GetSafeDetails(ctx, cpRequest.ResourceInstanceName)
+	})
+	if retcode == http.StatusNotFound {
+		sendJSONError(w, http.StatusNotFound, "SafeNotFound", fmt.Sprintf("Safe not found: %s", cpRequest.ResourceInstanceName))
+		return
+	}
+	if err != nil {
+		sendJSONError(w, http.StatusConflict, "GetSafeDetailsError", fmt.Sprintf("Failed to get safe: %v", checkMaintenance(err)))
+		return
+	}
+
+	if request.Properties.Description != nil && *request.Properties.Description != safe.Description {
+		// Update Safe replaces the safe's settings, so send the current ones along with the new description
+		update := map[string]interface{}{
+			"safeName":    safe.SafeName,
+			"description": *request.Properties.Description,
+			"location":    safe.Location,
+			"olacEnabled": safe.OlacEnabled,
+			"managingCPM": safe.ManagingCPM,
+		}
+		if safe.NumberOfDaysRetention > 0 {
+			update["numberOfDaysRetention"] = safe.NumberOfDaysRetention
+		} else if safe.NumberOfVersionsRetention != nil {
+			update["numberOfVersionsRetention"] = safe.NumberOfVersionsRetention
+		}
+		retcode, err := statusRetry(r.Context(), "safes", "UpdateSafe", true, func(ctx context.Context) (int, error) {
+			return pamService.UpdateSafe(ctx, safe.SafeURLID, update)
+		})
+		if err != nil {
+			sendJSONError(w, http.StatusConflict, "UpdateSafeError", fmt.Sprintf("Failed to update safe: (%d) %v", retcode, err))
+			return
+		}
+		log.Printf("INFO: (UpdateSafe) updated description of safe %s", safe.SafeName)
+		safe.Description = *request.Properties.Description
+	}
+
+	if len(request.Properties.Members) > 0 {
+		// Members are not part of PAMService, so the PAM client is only opened when they change
+		pamClient, err := createPAMClient()
+		if err != nil {
+			sendJSONError(w, http.StatusInternalServerError, "PAMClientError", fmt.Sprintf("Failed to create PAM client: %v", err))
+			return
+		}
+		current, retcode, err := listSafeMembers(r.Context(), pamClient, safe.SafeURLID)
+		if err != nil {
+			sendJSONError(w, http.StatusConflict, "GetSafeMembersError", fmt.Sprintf("Failed to list safe members: (%d) %v", retcode, err))
+			return
+		}
+		if failed := applyMemberChanges(r.Context(), pamClient, safe.SafeURLID, planMemberChanges(request.Properties.Members, current, false, "")); len(failed) > 0 {
+			sendJSONError(w, http.StatusConflict, "SafeMemberError", fmt.Sprintf("Failed to update safe members: %s", strings.Join(failed, "; ")))
+			return
+		}
+	}
+
+	// Keep drift detection and deletion protection in line with the declared settings
+	rec, found, _ := stateStore.Get(cpRequest.ID())
+	if !found {
+		rec = ResourceRecord{ResourceID: cpRequest.ID(), ResourceType: cpRequest.ResourceTypeName, SafeName: safe.SafeName, PCloudID: safe.SafeURLID, Deployment: newDeploymentStamp(r)}
+	}
+	rec.Declared = safeDriftSettings(safe.Description, safe.ManagingCPM, safe.NumberOfDaysRetention, safe.NumberOfVersionsRetention, safe.OlacEnabled)
+	if confirm := request.Properties.ConfirmDelete; confirm != nil {
+		if !*confirm {
+			rec.ConfirmDeleteAt = nil
+		} else if rec.ConfirmDeleteAt == nil {
+			confirmedAt := time.Now().UTC()
+			rec.ConfirmDeleteAt = &confirmedAt
+		}
+	}
+	if prevent := request.Properties.PreventDeletion; prevent != nil {
+		rec.PreventDeletion = *prevent
+	}
+	if policy := request.Properties.DeletionPolicy; policy != nil {
+		rec.DeletionPolicy = recordedDeletionPolicy(*policy)
+	}
+	recordResource(rec)
+	notifyLifecycle(r, "Updated", rec)
+
+	properties, err := safeResourceProperties(r, safe, "")
+	if err != nil {
+		sendJSONError(w, http.StatusInternalServerError, "SafeMarshalError", err.Error())
+		return
+	}
+	addSafeRecordProperties(properties, rec)
+	response := CustomProviderResponse{
+		ID:         cpRequest.ID(),
+		Name:       cpRequest.ResourceInstanceName,
+		Type:       fmt.Sprintf("Microsoft.CustomProviders/resourceProviders/%s", cpRequest.ResourceTypeName),
+		Properties: properties,
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
 // handleDeleteSafe handles Azure Custom Provider resource deletion
 func handleDeleteSafe(w http.ResponseWriter, r *http.Request, cpRequest CustomProviderRequestPath) {
 	LogRequestDebug("DeleteSafe", r)
 
-	pamClient, err := createPAMClient()
+	if retainOnDelete(w, r, cpRequest) {
+		return
+	}
+	// ARM treats DELETE as idempotent, so a safe that is already gone is a successful delete
+	exists, err := safeExists(r, cpRequest.ResourceInstanceName)
 	if err != nil {
-		sendJSONError(w, http.StatusInternalServerError, "PAMClientError", fmt.Sprintf("Failed to create PAM client: %v", err))
+		sendJSONError(w, http.StatusBadGateway, "GetSafeDetailsError", fmt.Sprintf("Failed to get safe: %v", err))
+		return
+	}
+	if !exists {
+		log.Printf("INFO: (DeleteSafe) safe %s does not exist, nothing to delete", cpRequest.ResourceInstanceName)
+		forgetResource(cpRequest.ID())
+		w.WriteHeader(http.StatusNoContent)
 		return
 	}
 
-	// For demonstration, we'll assume the safe name is the same as the resource name
-	err = deleteSafe(pamClient, cpRequest.ResourceInstanceName)
-	if err != nil {
+	if err := checkSafeDeletionLock(r, cpRequest); err != nil {
+		log.Printf("WARNING: (DeleteSafe) refusing to delete %s: %v", cpRequest.ID(), err)
+		sendJSONError(w, http.StatusConflict, "SafeDeletionPrevented", err.Error())
+		return
+	}
+	if err := checkSafeDeletion(r, cpRequest); err != nil {
+		log.Printf("WARNING: (DeleteSafe) refusing to delete %s: %v", cpRequest.ID(), err)
+		sendJSONError(w, http.StatusConflict, "SafeDeletionProtected", err.Error())
+		return
+	}
+
+	// Deletes are batched with other in-flight deletes so a resource group teardown runs in dependency order
+	stopPAM := startPhase(r, "pam")
+	err = deletes.Submit(r.Context(), deleteRankSafe, cpRequest.ResourceInstanceName, func(pamService PAMService) error {
+		return deleteSafe(r.Context(), pamService, cpRequest.ResourceInstanceName)
+	})
+	stopPAM()
+	switch {
+	case errors.Is(err, errSafeNotFound):
+		// Deleted by someone else since the existence check
+		log.Printf("INFO: (DeleteSafe) safe %s was already deleted", cpRequest.ResourceInstanceName)
+	case errors.Is(err, errSafeNotEmpty):
+		sendJSONError(w, http.StatusConflict, "SafeNotEmpty", fmt.Sprintf("Safe %s still holds accounts; delete them first: %v", cpRequest.ResourceInstanceName, err))
+		return
+	case err != nil:
 		sendJSONError(w, http.StatusInternalServerError, "SafeDeletionError", fmt.Sprintf("Failed to delete safe: %v", err))
 		return
 	}
+	forgetResource(cpRequest.ID())
+	notifyLifecycle(r, "Deleted", ResourceRecord{ResourceID: cpRequest.ID(), ResourceType: cpRequest.ResourceTypeName, SafeName: cpRequest.ResourceInstanceName})
 
 	w.WriteHeader(http.StatusNoContent)
 }
 
+// safeExists reports whether PCloud has the safe; a 404 is not an error
+func safeExists(r *http.Request, safeName string) (bool, error) {
+	stopAuth := startPhase(r, "auth")
+	pamService, err := newPAMService()
+	stopAuth()
+	if err != nil {
+		return false, err
+	}
+
+	stopPAM := startPhase(r, "pam")
+	_, retcode, err := pcloudRetry(r.Context(), "safes", "GetSafeDetails", true, func(ctx context.Context) (pam.GetSafeDetails, int, error) {
+		return pamService.GetSafeDetails(ctx, safeName)
+	})
+	stopPAM()
+	switch {
+	case retcode == http.StatusNotFound:
+		return false, nil
+	case err != nil:
+		return false, checkMaintenance(err)
+	case retcode >= 300:
+		return false, fmt.Errorf("get safe %s returned status %d", safeName, retcode)
+	}
+	return true, nil
+}
+
 // handleGetSafe handles Azure Custom Provider resource retrieval
 func handleGetSafe(w http.ResponseWriter, r *http.Request, cpRequest CustomProviderRequestPath) {
 	LogRequestDebug("GetSafe", r)
+	if serveRecentlyCreated(w, r, cpRequest) {
+		return
+	}
 
-	pamClient, err := createPAMClient()
+	stopAuth := startPhase(r, "auth")
+	pamService, err := newPAMService()
+	stopAuth()
 	if err != nil {
 		sendJSONError(w, http.StatusInternalServerError, "PAMClientError", fmt.Sprintf("Failed to create PAM client: %v", err))
 		return
 	}
 
-	safe, retcode, err := pamClient.GetSafeDetails(cpRequest.ResourceInstanceName)
-	if err != nil {
-		sendJSONError(w, retcode, "GetSafeDetailsError", fmt.Sprintf("Failed to get safe: %v", err))
+	stopPAM := startPhase(r, "pam")
+	safe, retcode, err := pcloudRetry(r.Context(), "safes", "GetSafeDetails", true, func(ctx context.Context) (pam.GetSafeDetails, int, error) {
+		return pamService.GetSafeDetails(ctx, cpRequest.ResourceInstanceName)
+	})
+	stopPAM()
+	if err = checkMaintenance(err); err != nil {
+		// A call that never reached PCloud (the request's deadline passed while waiting) has no status
+		status := upstreamARMStatus(retcode)
+		if status == 0 {
+			status = http.StatusBadGateway
+		}
+		sendJSONError(w, status, "GetSafeDetailsError", fmt.Sprintf("Failed to get safe: (%d) %v", retcode, err))
 		return
 	}
 	// Not found is an explicit status that Azure ARM looks for, so, we handle it specifically here
@@ -119,56 +579,78 @@ func handleGetSafe(w http.ResponseWriter, r *http.Request, cpRequest CustomProvi
 		return
 	}
 
+	properties, err := safeResourceProperties(r, safe, "")
+	if err != nil {
+		sendJSONError(w, http.StatusInternalServerError, "SafeMarshalError", err.Error())
+		return
+	}
 	response := CustomProviderResponse{
-		ID:   cpRequest.ID(),
-		Name: cpRequest.ResourceInstanceName,
-		Type: fmt.Sprintf("Microsoft.CustomProviders/resourceProviders/%s", cpRequest.ResourceTypeName),
-		Properties: map[string]interface{}{
-			"safeName":          safe.SafeName,
-			"safeID":            safe.SafeURLID,
-			"description":       safe.Description,
-			"provisioningState": "Succeeded",
-		},
+		ID:         cpRequest.ID(),
+		Name:       cpRequest.ResourceInstanceName,
+		Type:       fmt.Sprintf("Microsoft.CustomProviders/resourceProviders/%s", cpRequest.ResourceTypeName),
+		Properties: properties,
 	}
 
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(response)
-}
+	rec, found, err := stateStore.Get(cpRequest.ID())
+	if err == nil && found {
+		addSafeRecordProperties(response.Properties, rec)
+	}
+	// Compare the live settings with the ones recorded when ARM created the safe
+	if err == nil && found && rec.Declared != nil {
+		live := safeDriftSettings(safe.Description, safe.ManagingCPM, safe.NumberOfDaysRetention, safe.NumberOfVersionsRetention, safe.OlacEnabled)
+		drift := diffSettings(rec.Declared, live)
+		response.Properties["driftDetected"] = len(drift) > 0
+		if len(drift) > 0 {
+			response.Properties["drift"] = drift
+			log.Printf("WARNING: (GetSafe) drift detected on safe %s: %v", safe.SafeName, drift)
+		}
+	}
 
-// createSafe creates a safe using the PAM client
-func createSafe(pamClient *pam.Client, safeName, description string) (string, error) {
-	log.Printf("DEBUG: Attempting to create safe - Name: %s, Description: %s", safeName, description)
+	sendJSONResource(w, r, http.StatusOK, response)
+}
 
-	request := pam.PostAddSafeRequest{
-		SafeName:    safeName,
-		Description: description,
-	}
+// createSafe creates a safe using the PAM service
+func createSafe(ctx context.Context, pamService PAMService, request pam.PostAddSafeRequest) (pam.PostAddSafeResponse, error) {
+	log.Printf("DEBUG: Attempting to create safe - Name: %s, Description: %s", request.SafeName, request.Description)
 
 	log.Printf("DEBUG: Calling PAM API to add safe...")
-	response, statusCode, err := pamClient.AddSafe(request)
+	response, statusCode, err := pcloudRetry(ctx, "safes", "AddSafe", false, func(ctx context.Context) (pam.PostAddSafeResponse, int, error) {
+		return pamService.AddSafe(ctx, request)
+	})
 
 	log.Printf("DEBUG: PAM API response - StatusCode: %d, Error: %v", statusCode, err)
 
 	if err != nil {
 		log.Printf("ERROR: PAM API call failed: %v", err)
-		return "", fmt.Errorf("failed to add safe: %w", err)
+		return response, checkMaintenance(fmt.Errorf("failed to add safe: %w", err))
 	}
 
 	if statusCode >= 300 {
 		log.Printf("ERROR: PAM API returned non-success status code: %d", statusCode)
-		return "", fmt.Errorf("PAM API returned status %d when creating safe", statusCode)
+		return response, checkMaintenance(fmt.Errorf("PAM API returned status code(%d) when creating safe", statusCode))
 	}
 
-	log.Printf("SUCCESS: Safe created successfully - Name: %s, ID: %s", safeName, response.SafeURLID)
-	return response.SafeURLID, nil
+	log.Printf("SUCCESS: Safe created successfully - Name: %s, ID: %s", request.SafeName, response.SafeURLID)
+	return response, nil
 }
 
-// deleteSafe deletes a safe using the PAM client
-func deleteSafe(pamClient *pam.Client, safeName string) error {
-	_ = pamClient // unused parameter for future implementation
-	// Note: The current SDK version doesn't have a DeleteSafe method
-	// This would need to be implemented using a direct HTTP request
-	// or waiting for SDK updates
-	log.Printf("Delete safe functionality not available in current SDK version for safe: %s", safeName)
-	return fmt.Errorf("delete safe functionality not implemented in current SDK version")
+var (
+	errSafeNotFound = errors.New("safe not found")
+	errSafeNotEmpty = errors.New("safe is not empty")
+)
+
+func deleteSafe(ctx context.Context, pamService PAMService, safeName string) error {
+	retcode, err := statusRetry(ctx, "safes", "DeleteSafe", true, func(ctx context.Context) (int, error) {
+		return pamService.DeleteSafe(ctx, safeName)
+	})
+	switch {
+	case err == nil:
+		log.Printf("INFO: Deleted safe %s", safeName)
+		return nil
+	case retcode == http.StatusNotFound:
+		return fmt.Errorf("%w: %s", errSafeNotFound, safeName)
+	case retcode == http.StatusConflict:
+		return fmt.Errorf("%w: %s: %v", errSafeNotEmpty, safeName, err)
+	}
+	return fmt.Errorf("failed to delete safe %s: (%d) %v", safeName, retcode, err)
 }
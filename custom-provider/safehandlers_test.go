@@ -0,0 +1,65 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/davidh-cyberark/privilegeaccessmanager-sdk-go/pam"
+)
+
+func TestDeleteSafe(t *testing.T) {
+	saved := operationPolicies["safes"]
+	defer func() { operationPolicies["safes"] = saved }()
+	policy := saved
+	policy.Retries = 2
+	policy.RetryBackoff = time.Millisecond
+	operationPolicies["safes"] = policy
+
+	tests := []struct {
+		name          string
+		statuses      []int
+		wantErr       bool
+		expectedErr   error
+		expectedCalls int
+	}{
+		{name: "deleted", statuses: []int{http.StatusNoContent}, expectedCalls: 1},
+		{name: "not found", statuses: []int{http.StatusNotFound}, wantErr: true, expectedErr: errSafeNotFound, expectedCalls: 1},
+		{name: "not empty", statuses: []int{http.StatusConflict}, wantErr: true, expectedErr: errSafeNotEmpty, expectedCalls: 1},
+		{name: "retried 5xx", statuses: []int{http.StatusServiceUnavailable, http.StatusBadGateway, http.StatusNoContent}, expectedCalls: 3},
+		{name: "gives up on 5xx", statuses: []int{500, 500, 500, 500}, wantErr: true, expectedCalls: 3},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			calls := 0
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.Method != http.MethodDelete || r.URL.Path != "/PasswordVault/API/Safes/my safe/" {
+					t.Errorf("unexpected request %s %s", r.Method, r.URL.Path)
+				}
+				if got := r.Header.Get("Authorization"); got != "Bearer token1" {
+					t.Errorf("expected session token, got %q", got)
+				}
+				w.WriteHeader(tt.statuses[calls])
+				calls++
+			}))
+			defer server.Close()
+
+			client := &pam.Client{Config: &pam.Config{PcloudUrl: server.URL}, Session: &pam.Session{Token: "token1", TokenType: "Bearer"}}
+			err := deleteSafe(context.Background(), sdkPAMService{client: client}, "my safe")
+
+			if (err != nil) != tt.wantErr {
+				t.Errorf("expected error %t, got %v", tt.wantErr, err)
+			}
+			if tt.expectedErr != nil && !errors.Is(err, tt.expectedErr) {
+				t.Errorf("expected %v, got %v", tt.expectedErr, err)
+			}
+			if calls != tt.expectedCalls {
+				t.Errorf("expected %d calls, got %d", tt.expectedCalls, calls)
+			}
+		})
+	}
+}
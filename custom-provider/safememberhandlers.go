@@ -0,0 +1,263 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+
+	"github.com/davidh-cyberark/privilegeaccessmanager-sdk-go/pam"
+)
+
+// SafeMemberRequest represents the request to add or update a safe member
+type SafeMemberRequest struct {
+	Properties SafeMemberProperties `json:"properties"`
+}
+
+// SafeMemberProperties is the properties schema of the safeMembers resource type. The safe and
+// member are taken from the resource name, {safeName}.{memberName}.
+type SafeMemberProperties struct {
+	MemberName               string          `json:"memberName,omitempty"`
+	MemberType               string          `json:"memberType,omitempty"` // User, Group or Role
+	SearchIn                 string          `json:"searchIn,omitempty"`   // directory to search, default Vault
+	MembershipExpirationDate int             `json:"membershipExpirationDate,omitempty"`
+	IsReadOnly               bool            `json:"isReadOnly,omitempty"`
+	Permissions              pam.Permissions `json:"permissions"`
+}
+
+// SafeMemberResourceProperties is the properties of a safeMembers resource returned to ARM
+type SafeMemberResourceProperties struct {
+	SafeName                 string          `json:"safeName"`
+	MemberName               string          `json:"memberName"`
+	MemberID                 string          `json:"memberId,omitempty"`
+	MemberType               string          `json:"memberType,omitempty"`
+	MembershipExpirationDate int             `json:"membershipExpirationDate,omitempty"`
+	IsPredefinedUser         bool            `json:"isPredefinedUser"`
+	Permissions              pam.Permissions `json:"permissions"`
+	ProvisioningState        string          `json:"provisioningState"`
+}
+
+var errSafeMemberNotFound = errors.New("safe member not found")
+
+// handleSafeMember routes safeMembers requests to the appropriate handlers
+func handleSafeMember(w http.ResponseWriter, r *http.Request, cpRequest CustomProviderRequestPath) {
+	LogRequestDebug("SafeMember", r)
+
+	switch r.Method {
+	case "PUT":
+		provision(w, r, cpRequest, handlePutSafeMember)
+	case "GET":
+		handleGetSafeMember(w, r, cpRequest)
+	case "DELETE":
+		handleDeleteSafeMember(w, r, cpRequest)
+	default:
+		sendJSONError(w, http.StatusMethodNotAllowed, "MethodNotAllowed", fmt.Sprintf("Method %s is not supported for safeMembers", r.Method))
+	}
+}
+
+// safeMemberPath is the PCloud REST path of one member of a safe
+func safeMemberPath(safeName, memberName string) string {
+	return fmt.Sprintf("/PasswordVault/API/Safes/%s/Members/%s/", url.PathEscape(safeName), url.PathEscape(memberName))
+}
+
+// getSafeMember reads one member of a safe; errSafeMemberNotFound when the safe or member does not exist
+func getSafeMember(ctx context.Context, pamClient *pam.Client, safeName, memberName string) (pam.PostAddMemberResponse, error) {
+	var member pam.PostAddMemberResponse
+	retcode, err := pamDoRetry(ctx, pamClient, "members", http.MethodGet, safeMemberPath(safeName, memberName), nil, &member)
+	if retcode == http.StatusNotFound {
+		return member, fmt.Errorf("%w: %s in safe %s", errSafeMemberNotFound, memberName, safeName)
+	}
+	if err != nil {
+		return member, fmt.Errorf("failed to get member %s of safe %s: (%d) %v", memberName, safeName, retcode, err)
+	}
+	return member, nil
+}
+
+// safeMemberResponse shapes a PCloud safe member as a safeMembers resource
+func safeMemberResponse(cpRequest CustomProviderRequestPath, safeName string, member pam.PostAddMemberResponse) (CustomProviderResponse, error) {
+	properties, err := toProperties(SafeMemberResourceProperties{
+		SafeName:                 safeName,
+		MemberName:               member.MemberName,
+		MemberID:                 member.MemberID,
+		MemberType:               member.MemberType,
+		MembershipExpirationDate: member.MembershipExpirationDate,
+		IsPredefinedUser:         member.IsPredefinedUser,
+		Permissions:              member.Permissions,
+		ProvisioningState:        "Succeeded",
+	})
+	if err != nil {
+		return CustomProviderResponse{}, err
+	}
+	return CustomProviderResponse{
+		ID:         cpRequest.ID(),
+		Name:       cpRequest.ResourceInstanceName,
+		Type:       fmt.Sprintf("Microsoft.CustomProviders/resourceProviders/%s", cpRequest.ResourceTypeName),
+		Properties: properties,
+	}, nil
+}
+
+// handlePutSafeMember adds the member to the safe, or updates its permissions when it is already a member
+func handlePutSafeMember(w http.ResponseWriter, r *http.Request, cpRequest CustomProviderRequestPath) {
+	LogRequestDebug("PutSafeMember", r)
+
+	safeName, memberName, err := parseSafeNameAccountName(cpRequest.ResourceInstanceName)
+	if err != nil {
+		sendJSONError(w, http.StatusBadRequest, "ResourceNameMalformed", "resource name must be in format: {safename}.{membername}")
+		return
+	}
+
+	var request SafeMemberRequest
+	if err := decodeRequestBody(r, &request); err != nil {
+		var unknownErr *UnknownPropertiesError
+		if errors.As(err, &unknownErr) {
+			sendJSONError(w, http.StatusBadRequest, "UnknownProperties", err.Error())
+			return
+		}
+		sendJSONError(w, http.StatusBadRequest, "InvalidRequestBody", fmt.Sprintf("Invalid request body: %v", err))
+		return
+	}
+	if request.Properties.MemberName != "" && request.Properties.MemberName != memberName {
+		sendJSONError(w, http.StatusBadRequest, "InvalidRequestBody", fmt.Sprintf("properties.memberName %q does not match the resource name %q", request.Properties.MemberName, cpRequest.ResourceInstanceName))
+		return
+	}
+
+	stopAuth := startPhase(r, "auth")
+	pamClient, err := createPAMClient()
+	stopAuth()
+	if err != nil {
+		sendJSONError(w, http.StatusInternalServerError, "PAMClientError", fmt.Sprintf("Failed to create PAM client: %v", err))
+		return
+	}
+
+	stopPAM := startPhase(r, "pam")
+	defer stopPAM()
+
+	code := http.StatusOK
+	member, err := getSafeMember(r.Context(), pamClient, safeName, memberName)
+	switch {
+	case errors.Is(err, errSafeMemberNotFound):
+		member, _, err = pcloudRetry(r.Context(), "members", "AddSafeMember", false, func(ctx context.Context) (pam.PostAddMemberResponse, int, error) {
+			return pamAddSafeMember(ctx, pamClient, pam.PostAddMemberRequest{
+				MemberName:               memberName,
+				MemberType:               request.Properties.MemberType,
+				SearchIn:                 request.Properties.SearchIn,
+				MembershipExpirationDate: request.Properties.MembershipExpirationDate,
+				IsReadOnly:               request.Properties.IsReadOnly,
+				Permissions:              request.Properties.Permissions,
+			}, safeName)
+		})
+		if err != nil {
+			sendJSONError(w, http.StatusConflict, "SafeMemberError", fmt.Sprintf("Failed to add member %s to safe %s: %v", memberName, safeName, checkMaintenance(err)))
+			return
+		}
+		log.Printf("INFO: (PutSafeMember) added %s to safe %s", memberName, safeName)
+		code = http.StatusCreated
+	case err != nil:
+		sendJSONError(w, http.StatusConflict, "SafeMemberError", err.Error())
+		return
+	case member.Permissions != request.Properties.Permissions:
+		update := map[string]interface{}{"permissions": request.Properties.Permissions}
+		if request.Properties.MembershipExpirationDate != 0 {
+			update["membershipExpirationDate"] = request.Properties.MembershipExpirationDate
+		}
+		if retcode, err := pamDoRetry(r.Context(), pamClient, "members", http.MethodPut, safeMemberPath(safeName, memberName), update, &member); err != nil {
+			sendJSONError(w, http.StatusConflict, "SafeMemberError", fmt.Sprintf("Failed to update member %s of safe %s: (%d) %v", memberName, safeName, retcode, err))
+			return
+		}
+		log.Printf("INFO: (PutSafeMember) updated permissions of %s on safe %s", memberName, safeName)
+	}
+
+	recordResource(ResourceRecord{
+		ResourceID:   cpRequest.ID(),
+		ResourceType: cpRequest.ResourceTypeName,
+		SafeName:     safeName,
+		PCloudID:     memberName,
+		Deployment:   newDeploymentStamp(r),
+	})
+
+	response, err := safeMemberResponse(cpRequest, safeName, member)
+	if err != nil {
+		sendJSONError(w, http.StatusInternalServerError, "SafeMemberMarshalError", err.Error())
+		return
+	}
+	sendJSONResource(w, r, code, response)
+}
+
+// handleGetSafeMember returns one member of a safe
+func handleGetSafeMember(w http.ResponseWriter, r *http.Request, cpRequest CustomProviderRequestPath) {
+	LogRequestDebug("GetSafeMember", r)
+
+	safeName, memberName, err := parseSafeNameAccountName(cpRequest.ResourceInstanceName)
+	if err != nil {
+		sendJSONError(w, http.StatusNotFound, "ResourceNotFound", fmt.Sprintf("%s not found", cpRequest.ResourceInstanceName))
+		return
+	}
+
+	stopAuth := startPhase(r, "auth")
+	pamClient, err := createPAMClient()
+	stopAuth()
+	if err != nil {
+		sendJSONError(w, http.StatusInternalServerError, "PAMClientError", fmt.Sprintf("Failed to create PAM client: %v", err))
+		return
+	}
+
+	stopPAM := startPhase(r, "pam")
+	member, err := getSafeMember(r.Context(), pamClient, safeName, memberName)
+	stopPAM()
+	if errors.Is(err, errSafeMemberNotFound) {
+		sendJSONError(w, http.StatusNotFound, "ResourceNotFound", err.Error())
+		return
+	}
+	if err != nil {
+		sendJSONError(w, http.StatusConflict, "SafeMemberError", err.Error())
+		return
+	}
+
+	response, err := safeMemberResponse(cpRequest, safeName, member)
+	if err != nil {
+		sendJSONError(w, http.StatusInternalServerError, "SafeMemberMarshalError", err.Error())
+		return
+	}
+	sendJSONResource(w, r, http.StatusOK, response)
+}
+
+// handleDeleteSafeMember removes a member from a safe. Deletes are batched with other in-flight
+// deletes, members first, so a resource group teardown removes members before their safe.
+func handleDeleteSafeMember(w http.ResponseWriter, r *http.Request, cpRequest CustomProviderRequestPath) {
+	LogRequestDebug("DeleteSafeMember", r)
+
+	safeName, memberName, err := parseSafeNameAccountName(cpRequest.ResourceInstanceName)
+	if err != nil {
+		sendJSONError(w, http.StatusNotFound, "ResourceNotFound", fmt.Sprintf("%s not found", cpRequest.ResourceInstanceName))
+		return
+	}
+
+	stopPAM := startPhase(r, "pam")
+	err = deletes.Submit(r.Context(), deleteRankSafeMember, safeName+"/"+memberName, func(PAMService) error {
+		// Members are not part of PAMService; the client is the same shared session
+		pamClient, err := createPAMClient()
+		if err != nil {
+			return err
+		}
+		retcode, err := pamDoRetry(r.Context(), pamClient, "members", http.MethodDelete, safeMemberPath(safeName, memberName), nil, nil)
+		if retcode == http.StatusNotFound {
+			return fmt.Errorf("%w: %s in safe %s", errSafeMemberNotFound, memberName, safeName)
+		}
+		return err
+	})
+	stopPAM()
+	if errors.Is(err, errSafeMemberNotFound) {
+		forgetResource(cpRequest.ID())
+		sendJSONError(w, http.StatusNotFound, "ResourceNotFound", err.Error())
+		return
+	}
+	if err != nil {
+		sendJSONError(w, http.StatusConflict, "SafeMemberDeletionError", fmt.Sprintf("Failed to remove member %s from safe %s: %v", memberName, safeName, err))
+		return
+	}
+	log.Printf("INFO: (DeleteSafeMember) removed %s from safe %s", memberName, safeName)
+	forgetResource(cpRequest.ID())
+	w.WriteHeader(http.StatusNoContent)
+}
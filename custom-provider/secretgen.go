@@ -0,0 +1,219 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"log"
+	"math/big"
+	"os"
+	"strings"
+)
+
+const (
+	lowerChars   = "abcdefghijklmnopqrstuvwxyz"
+	upperChars   = "ABCDEFGHIJKLMNOPQRSTUVWXYZ"
+	digitChars   = "0123456789"
+	specialChars = "!#$%&*+-=?@^_~"
+)
+
+// SecretPolicy describes how to generate a compliant secret for a platform
+type SecretPolicy struct {
+	SecretType   string `json:"secretType"` // "password" or "key"
+	Length       int    `json:"length,omitempty"`
+	MinUpper     int    `json:"minUpper,omitempty"`
+	MinLower     int    `json:"minLower,omitempty"`
+	MinDigits    int    `json:"minDigits,omitempty"`
+	MinSpecial   int    `json:"minSpecial,omitempty"`
+	SpecialChars string `json:"specialChars,omitempty"`
+	KeyType      string `json:"keyType,omitempty"` // "rsa" or "ed25519"
+	KeyBits      int    `json:"keyBits,omitempty"` // rsa only
+}
+
+// GeneratedSecret is a new secret plus the public half when the secret is a key pair
+type GeneratedSecret struct {
+	Secret    string
+	PublicKey string // authorized_keys format, keys only
+}
+
+// defaultSecretPolicy is used for platforms without a policy; a "default" entry in the config overrides it
+var defaultSecretPolicy = SecretPolicy{SecretType: "password", Length: 20, MinUpper: 1, MinLower: 1, MinDigits: 1, MinSpecial: 1}
+
+// secretPolicies is keyed by platformId, loaded once at startup by loadSecretPolicies
+var secretPolicies = map[string]SecretPolicy{}
+
+// loadSecretPolicies reads per-platform policies from SECRET_POLICIES_FILE (a JSON object keyed by platformId)
+func loadSecretPolicies() error {
+	path := os.Getenv("SECRET_POLICIES_FILE")
+	if path == "" {
+		return nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("failed to read SECRET_POLICIES_FILE: %w", err)
+	}
+	policies := map[string]SecretPolicy{}
+	if err := json.Unmarshal(data, &policies); err != nil {
+		return fmt.Errorf("failed to parse secret policies: %w", err)
+	}
+	for platform, policy := range policies {
+		if err := policy.validate(); err != nil {
+			return fmt.Errorf("invalid secret policy for %s: %w", platform, err)
+		}
+		log.Printf("INFO: Loaded secret policy for platform %s - type: %s", platform, policy.SecretType)
+	}
+	secretPolicies = policies
+	return nil
+}
+
+// secretPolicyFor returns the policy for a platform, falling back to "default" and then the built-in default
+func secretPolicyFor(platformID string) SecretPolicy {
+	if policy, ok := secretPolicies[platformID]; ok {
+		return policy
+	}
+	if policy, ok := secretPolicies["default"]; ok {
+		return policy
+	}
+	return defaultSecretPolicy
+}
+
+func (p SecretPolicy) validate() error {
+	switch p.SecretType {
+	case "password":
+		if p.Length < p.MinUpper+p.MinLower+p.MinDigits+p.MinSpecial || p.Length < 8 {
+			return fmt.Errorf("length %d is below 8 or the sum of the minimums", p.Length)
+		}
+	case "key":
+		if p.KeyType != "rsa" && p.KeyType != "ed25519" {
+			return fmt.Errorf("keyType must be rsa or ed25519, got %q", p.KeyType)
+		}
+		if p.KeyType == "rsa" && p.KeyBits != 0 && p.KeyBits < 2048 {
+			return fmt.Errorf("keyBits must be at least 2048, got %d", p.KeyBits)
+		}
+	default:
+		return fmt.Errorf("secretType must be password or key, got %q", p.SecretType)
+	}
+	return nil
+}
+
+// generateSecret produces a new secret that satisfies the policy
+func generateSecret(p SecretPolicy) (GeneratedSecret, error) {
+	if err := p.validate(); err != nil {
+		return GeneratedSecret{}, err
+	}
+	if p.SecretType == "key" {
+		return generateKeyPair(p)
+	}
+	password, err := generatePassword(p)
+	return GeneratedSecret{Secret: password}, err
+}
+
+func generatePassword(p SecretPolicy) (string, error) {
+	special := p.SpecialChars
+	if special == "" {
+		special = specialChars
+	}
+
+	var chars []byte
+	for _, class := range []struct {
+		set string
+		min int
+	}{{upperChars, p.MinUpper}, {lowerChars, p.MinLower}, {digitChars, p.MinDigits}, {special, p.MinSpecial}} {
+		for i := 0; i < class.min; i++ {
+			c, err := randomChar(class.set)
+			if err != nil {
+				return "", err
+			}
+			chars = append(chars, c)
+		}
+	}
+
+	all := upperChars + lowerChars + digitChars + special
+	for len(chars) < p.Length {
+		c, err := randomChar(all)
+		if err != nil {
+			return "", err
+		}
+		chars = append(chars, c)
+	}
+
+	// Fisher-Yates so the required classes are not always at the front
+	for i := len(chars) - 1; i > 0; i-- {
+		j, err := rand.Int(rand.Reader, big.NewInt(int64(i+1)))
+		if err != nil {
+			return "", err
+		}
+		chars[i], chars[j.Int64()] = chars[j.Int64()], chars[i]
+	}
+	return string(chars), nil
+}
+
+func randomChar(set string) (byte, error) {
+	n, err := rand.Int(rand.Reader, big.NewInt(int64(len(set))))
+	if err != nil {
+		return 0, err
+	}
+	return set[n.Int64()], nil
+}
+
+func generateKeyPair(p SecretPolicy) (GeneratedSecret, error) {
+	switch p.KeyType {
+	case "ed25519":
+		pub, priv, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return GeneratedSecret{}, err
+		}
+		der, err := x509.MarshalPKCS8PrivateKey(priv)
+		if err != nil {
+			return GeneratedSecret{}, err
+		}
+		return GeneratedSecret{
+			Secret:    string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})),
+			PublicKey: sshAuthorizedKey("ssh-ed25519", sshString([]byte("ssh-ed25519")), sshString(pub)),
+		}, nil
+	default:
+		bits := p.KeyBits
+		if bits == 0 {
+			bits = 4096
+		}
+		priv, err := rsa.GenerateKey(rand.Reader, bits)
+		if err != nil {
+			return GeneratedSecret{}, err
+		}
+		return GeneratedSecret{
+			Secret: string(pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(priv)})),
+			PublicKey: sshAuthorizedKey("ssh-rsa", sshString([]byte("ssh-rsa")),
+				sshMPInt(big.NewInt(int64(priv.E))), sshMPInt(priv.N)),
+		}, nil
+	}
+}
+
+// sshString encodes a length-prefixed string in the SSH wire format (RFC 4251)
+func sshString(b []byte) []byte {
+	out := make([]byte, 4, 4+len(b))
+	binary.BigEndian.PutUint32(out, uint32(len(b)))
+	return append(out, b...)
+}
+
+// sshMPInt encodes a positive big integer in the SSH wire format (RFC 4251)
+func sshMPInt(n *big.Int) []byte {
+	b := n.Bytes()
+	if len(b) > 0 && b[0]&0x80 != 0 {
+		b = append([]byte{0}, b...)
+	}
+	return sshString(b)
+}
+
+func sshAuthorizedKey(keyType string, parts ...[]byte) string {
+	var blob []byte
+	for _, part := range parts {
+		blob = append(blob, part...)
+	}
+	return strings.Join([]string{keyType, base64.StdEncoding.EncodeToString(blob)}, " ")
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"unicode"
+)
+
+func TestGeneratePassword_Policy(t *testing.T) {
+	policy := SecretPolicy{SecretType: "password", Length: 16, MinUpper: 3, MinLower: 2, MinDigits: 4, MinSpecial: 2, SpecialChars: "!@"}
+
+	for i := 0; i < 20; i++ {
+		secret, err := generateSecret(policy)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if len(secret.Secret) != policy.Length {
+			t.Fatalf("expected length %d, got %d", policy.Length, len(secret.Secret))
+		}
+		var upper, lower, digits, special int
+		for _, c := range secret.Secret {
+			switch {
+			case unicode.IsUpper(c):
+				upper++
+			case unicode.IsLower(c):
+				lower++
+			case unicode.IsDigit(c):
+				digits++
+			case strings.ContainsRune(policy.SpecialChars, c):
+				special++
+			default:
+				t.Fatalf("unexpected character %q", c)
+			}
+		}
+		if upper < policy.MinUpper || lower < policy.MinLower || digits < policy.MinDigits || special < policy.MinSpecial {
+			t.Fatalf("password %q does not satisfy the policy", secret.Secret)
+		}
+	}
+}
+
+func TestGenerateSecret_Keys(t *testing.T) {
+	tests := []struct {
+		name       string
+		policy     SecretPolicy
+		pemType    string
+		authPrefix string
+	}{
+		{name: "ed25519", policy: SecretPolicy{SecretType: "key", KeyType: "ed25519"}, pemType: "PRIVATE KEY", authPrefix: "ssh-ed25519 AAAAC3NzaC1lZDI1NTE5"},
+		{name: "rsa", policy: SecretPolicy{SecretType: "key", KeyType: "rsa", KeyBits: 2048}, pemType: "RSA PRIVATE KEY", authPrefix: "ssh-rsa AAAAB3NzaC1yc2E"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			secret, err := generateSecret(tt.policy)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !strings.HasPrefix(secret.Secret, "-----BEGIN "+tt.pemType+"-----") {
+				t.Errorf("unexpected private key encoding: %.40s", secret.Secret)
+			}
+			if !strings.HasPrefix(secret.PublicKey, tt.authPrefix) {
+				t.Errorf("unexpected public key: %.40s", secret.PublicKey)
+			}
+		})
+	}
+}
+
+func TestSecretPolicy_Validate(t *testing.T) {
+	invalid := []SecretPolicy{
+		{SecretType: "password", Length: 4},
+		{SecretType: "password", Length: 8, MinDigits: 9},
+		{SecretType: "key", KeyType: "dsa"},
+		{SecretType: "key", KeyType: "rsa", KeyBits: 1024},
+		{SecretType: "token"},
+	}
+	for _, policy := range invalid {
+		if err := policy.validate(); err == nil {
+			t.Errorf("expected policy %+v to be invalid", policy)
+		}
+	}
+}
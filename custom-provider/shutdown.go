@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Container Apps stops a revision's replicas with SIGTERM and kills them after the termination
+// grace period (30s by default). On SIGTERM the provider stops accepting connections, lets the
+// requests and async operations already running finish for up to SHUTDOWN_GRACE_PERIOD, and then
+// runs the shutdown hooks, e.g. exporting the last spans and replaying queued state store writes.
+
+// shutdownHooks run once in-flight work has drained, in name order
+var (
+	shutdownHooksMu sync.Mutex
+	shutdownHooks   = map[string]func(){}
+)
+
+// registerShutdownHook adds work that must run before the process exits
+func registerShutdownHook(name string, hook func()) {
+	shutdownHooksMu.Lock()
+	defer shutdownHooksMu.Unlock()
+	shutdownHooks[name] = hook
+}
+
+func runShutdownHooks() {
+	shutdownHooksMu.Lock()
+	names := make([]string, 0, len(shutdownHooks))
+	for name := range shutdownHooks {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	hooks := make([]func(), 0, len(names))
+	for _, name := range names {
+		hooks = append(hooks, shutdownHooks[name])
+	}
+	shutdownHooksMu.Unlock()
+
+	for i, hook := range hooks {
+		log.Printf("DEBUG: Running shutdown hook %s", names[i])
+		hook()
+	}
+}
+
+// shutdownGracePeriod is how long in-flight work may run after SIGTERM (SHUTDOWN_GRACE_PERIOD,
+// default 25s, leaving the hooks time within Container Apps' default 30s)
+func shutdownGracePeriod() time.Duration {
+	return policyDuration("SHUTDOWN_GRACE_PERIOD", "25s")
+}
+
+// newServer returns the HTTP server for handler. The write timeout bounds a whole request, so it
+// must be longer than the slowest PCloud operation; REQUEST_TIMEOUT can fail requests earlier.
+func newServer(addr string, handler http.Handler) *http.Server {
+	return &http.Server{
+		Addr:              addr,
+		Handler:           handler,
+		ReadHeaderTimeout: policyDuration("HTTP_READ_HEADER_TIMEOUT", "10s"),
+		ReadTimeout:       policyDuration("HTTP_READ_TIMEOUT", "30s"),
+		WriteTimeout:      policyDuration("HTTP_WRITE_TIMEOUT", "120s"),
+		IdleTimeout:       policyDuration("HTTP_IDLE_TIMEOUT", "120s"),
+	}
+}
+
+// runServer serves on ln until ctx is done, then shuts down gracefully: new connections are refused,
+// in-flight requests and async operations get the grace period to finish, and the shutdown hooks run
+func runServer(ctx context.Context, srv *http.Server, ln net.Listener, grace time.Duration) error {
+	served := make(chan error, 1)
+	go func() {
+		served <- srv.Serve(ln)
+	}()
+
+	select {
+	case err := <-served:
+		return err
+	case <-ctx.Done():
+	}
+
+	draining.Store(true)
+	log.Printf("INFO: Shutting down, waiting up to %s for in-flight requests", grace)
+	drainCtx, cancel := context.WithTimeout(context.Background(), grace)
+	defer cancel()
+
+	if err := srv.Shutdown(drainCtx); err != nil {
+		log.Printf("WARNING: In-flight requests did not finish within %s, closing their connections: %v", grace, err)
+		srv.Close()
+	}
+	if n := asyncOperations.drain(drainCtx); n > 0 {
+		log.Printf("WARNING: %d async operations did not finish within %s and are abandoned", n, grace)
+	}
+	runShutdownHooks()
+	if err := <-served; err != nil && !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	log.Printf("INFO: Shutdown complete")
+	return nil
+}
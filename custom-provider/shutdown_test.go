@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestRunServerDrainsInFlightRequests(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	started := make(chan struct{})
+	release := make(chan struct{})
+	srv := newServer(ln.Addr().String(), http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-release
+		w.Write([]byte("done"))
+	}))
+
+	hookRan := false
+	registerShutdownHook("test", func() { hookRan = true })
+	defer func() {
+		shutdownHooksMu.Lock()
+		delete(shutdownHooks, "test")
+		shutdownHooksMu.Unlock()
+	}()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan error, 1)
+	go func() { stopped <- runServer(ctx, srv, ln, 5*time.Second) }()
+
+	type result struct {
+		body string
+		err  error
+	}
+	responses := make(chan result, 1)
+	go func() {
+		resp, err := http.Get("http://" + ln.Addr().String() + "/")
+		if err != nil {
+			responses <- result{err: err}
+			return
+		}
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		responses <- result{body: string(body), err: err}
+	}()
+
+	<-started
+	cancel()
+	// New connections are refused once shutdown has begun
+	time.Sleep(50 * time.Millisecond)
+	if conn, err := net.DialTimeout("tcp", ln.Addr().String(), time.Second); err == nil {
+		conn.Close()
+		t.Error("expected new connections to be refused during shutdown")
+	}
+	close(release)
+
+	if res := <-responses; res.err != nil || res.body != "done" {
+		t.Errorf("expected the in-flight request to complete, got %q, %v", res.body, res.err)
+	}
+	if err := <-stopped; err != nil {
+		t.Errorf("unexpected error from runServer: %v", err)
+	}
+	if !hookRan {
+		t.Error("expected the shutdown hooks to run")
+	}
+}
+
+func TestAsyncOperationsDrain(t *testing.T) {
+	clearMaintenance()
+	store := newAsyncOperationStore(1, time.Hour)
+	release := make(chan struct{})
+	store.start("op1", CustomProviderRequestPath{}, func(w http.ResponseWriter) { <-release })
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if n := store.drain(ctx); n != 1 {
+		t.Errorf("expected 1 running operation after the deadline, got %d", n)
+	}
+
+	close(release)
+	if n := store.drain(context.Background()); n != 0 {
+		t.Errorf("expected all operations to finish, got %d running", n)
+	}
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DeploymentStamp identifies the ARM deployment that caused the provider to create a PCloud object
+type DeploymentStamp struct {
+	OperationID     string    `json:"operationId,omitempty"`
+	CorrelationID   string    `json:"correlationId,omitempty"`
+	ClientRequestID string    `json:"clientRequestId,omitempty"`
+	CreatedAt       time.Time `json:"createdAt"`
+}
+
+// ResourceRecord maps an ARM resource ID to the PCloud object the provider created for it
+type ResourceRecord struct {
+	ResourceID   string          `json:"resourceId"`
+	ResourceType string          `json:"resourceType"`
+	SafeName     string          `json:"safeName,omitempty"`
+	AccountName  string          `json:"accountName,omitempty"`
+	PCloudID     string          `json:"pcloudId,omitempty"`
+	Deployment   DeploymentStamp `json:"deployment"`
+	// Declared holds the settings in effect when ARM last wrote the resource, for drift detection
+	Declared map[string]string `json:"declared,omitempty"`
+	// ConfirmDeleteAt is when the template first declared confirmDelete: true, see deletionprotection.go
+	ConfirmDeleteAt *time.Time `json:"confirmDeleteAt,omitempty"`
+	// PreventDeletion is the safe's preventDeletion property, see deletionprotection.go
+	PreventDeletion bool `json:"preventDeletion,omitempty"`
+	// DeletionPolicy is Retain when deleting the resource leaves the PCloud object, see deletionpolicy.go
+	DeletionPolicy string `json:"deletionPolicy,omitempty"`
+	// KeyFingerprint and PublicKey describe the SSH key of a secretType key account, see accountkeys.go
+	KeyFingerprint string `json:"keyFingerprint,omitempty"`
+	PublicKey      string `json:"publicKey,omitempty"`
+	// ProvisioningState and ETag are those of the last response the provider sent for the resource
+	ProvisioningState string `json:"provisioningState,omitempty"`
+	ETag              string `json:"etag,omitempty"`
+}
+
+// StateStore persists the provider's resource records
+type StateStore interface {
+	Name() string
+	Put(rec ResourceRecord) error
+	Get(resourceID string) (ResourceRecord, bool, error)
+	Delete(resourceID string) error
+	List() ([]ResourceRecord, error)
+}
+
+// stateStore is the store used by the handlers, selected by STATE_STORE (see tablestore.go); writes
+// are queued while the store is unavailable, see bufferedstore.go
+var stateStore StateStore = newBufferedStateStore(newStateStore(), stateStoreRetryInterval())
+
+// newDeploymentStamp builds the deployment metadata stamp from the ARM request headers
+func newDeploymentStamp(r *http.Request) DeploymentStamp {
+	return DeploymentStamp{
+		OperationID:     operationID(r),
+		CorrelationID:   r.Header.Get("X-Ms-Correlation-Request-Id"),
+		ClientRequestID: r.Header.Get("X-Ms-Client-Request-Id"),
+		CreatedAt:       time.Now().UTC(),
+	}
+}
+
+// recordResource stores the record for a newly created resource; failures are logged, not returned,
+// because the PCloud object already exists at this point
+func recordResource(rec ResourceRecord) {
+	if rec.ProvisioningState == "" {
+		rec.ProvisioningState = "Succeeded"
+	}
+	if err := stateStore.Put(rec); err != nil {
+		log.Printf("WARNING: Failed to record resource %s in state store: %v", rec.ResourceID, err)
+	}
+}
+
+// forgetResource removes the record for a deleted resource
+func forgetResource(resourceID string) {
+	recentlyCreated.Forget(resourceID)
+	if err := stateStore.Delete(resourceID); err != nil {
+		log.Printf("WARNING: Failed to remove resource %s from state store: %v", resourceID, err)
+	}
+}
+
+// stateKey normalizes ARM resource IDs, which are case-insensitive
+func stateKey(resourceID string) string {
+	return strings.ToLower(resourceID)
+}
+
+type memoryStateStore struct {
+	mu      sync.RWMutex
+	records map[string]ResourceRecord
+}
+
+func newMemoryStateStore() *memoryStateStore {
+	return &memoryStateStore{records: map[string]ResourceRecord{}}
+}
+
+func (s *memoryStateStore) Name() string {
+	return "memory"
+}
+
+func (s *memoryStateStore) Put(rec ResourceRecord) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.records[stateKey(rec.ResourceID)] = rec
+	return nil
+}
+
+func (s *memoryStateStore) Get(resourceID string) (ResourceRecord, bool, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	rec, ok := s.records[stateKey(resourceID)]
+	return rec, ok, nil
+}
+
+func (s *memoryStateStore) Delete(resourceID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.records, stateKey(resourceID))
+	return nil
+}
+
+func (s *memoryStateStore) List() ([]ResourceRecord, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	recs := make([]ResourceRecord, 0, len(s.records))
+	for _, rec := range s.records {
+		recs = append(recs, rec)
+	}
+	sort.Slice(recs, func(i, j int) bool { return recs[i].ResourceID < recs[j].ResourceID })
+	return recs, nil
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// UnknownPropertiesError lists the properties of a PUT body that do not match the resource schema
+type UnknownPropertiesError struct {
+	Fields []string
+}
+
+func (e *UnknownPropertiesError) Error() string {
+	return fmt.Sprintf("Unknown properties in request body: %s", strings.Join(e.Fields, ", "))
+}
+
+// strictRequestBodies reports whether property names must match the schema exactly for this
+// request: the strictRequestBodies feature flag turns it on for everyone, and the strict-validation
+// request flag overrides that per request
+func strictRequestBodies(r *http.Request) bool {
+	if enabled, set := requestFlag(r, "strict-validation"); set {
+		return enabled
+	}
+	return featureEnabled("strictRequestBodies")
+}
+
+// decodeRequestBody decodes a PUT body into v. The "properties" object must only use property
+// names from the schema, as with json.Decoder.DisallowUnknownFields, so a typo such as adress is
+// rejected instead of ignored; every unknown name is reported, not just the first. Other top-level
+// fields, such as the location ARM may send, are ignored. In strict mode names must also match
+// exactly; encoding/json would otherwise accept wrongly cased ones such as platformID for platformId.
+func decodeRequestBody(r *http.Request, v interface{}) error {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		return err
+	}
+	if err := json.NewDecoder(bytes.NewReader(body)).Decode(v); err != nil {
+		return err
+	}
+
+	var envelope struct {
+		Properties json.RawMessage `json:"properties"`
+	}
+	if err := json.Unmarshal(body, &envelope); err != nil || len(envelope.Properties) == 0 {
+		return err
+	}
+	propertiesField, ok := reflect.TypeOf(v).Elem().FieldByName("Properties")
+	if !ok {
+		return nil
+	}
+	if fields := unknownProperties(envelope.Properties, propertiesField.Type, "properties", strictRequestBodies(r)); len(fields) > 0 {
+		sort.Strings(fields)
+		return &UnknownPropertiesError{Fields: fields}
+	}
+	return nil
+}
+
+// unknownProperties walks a JSON object alongside the struct type it decodes into and returns
+// the dotted paths of keys that have no matching json tag; exact also rejects keys that only match
+// case-insensitively. Maps and interfaces accept any key.
+func unknownProperties(raw json.RawMessage, t reflect.Type, path string, exact bool) []string {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if t.Kind() != reflect.Struct {
+		return nil
+	}
+	var object map[string]json.RawMessage
+	if err := json.Unmarshal(raw, &object); err != nil {
+		return nil
+	}
+
+	known := map[string]reflect.Type{}
+	collectJSONFields(t, known)
+
+	var unknown []string
+	for key, value := range object {
+		fieldType, ok := known[key]
+		if !ok && !exact {
+			for name, candidate := range known {
+				if strings.EqualFold(name, key) {
+					fieldType, ok = candidate, true
+					break
+				}
+			}
+		}
+		if !ok {
+			unknown = append(unknown, path+"."+key)
+			continue
+		}
+		unknown = append(unknown, unknownProperties(value, fieldType, path+"."+key, exact)...)
+	}
+	return unknown
+}
+
+// collectJSONFields maps each json name of a struct, including promoted fields of embedded structs, to its type
+func collectJSONFields(t reflect.Type, fields map[string]reflect.Type) {
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		tag := field.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+		name := strings.Split(tag, ",")[0]
+		if field.Anonymous && name == "" && field.Type.Kind() == reflect.Struct {
+			collectJSONFields(field.Type, fields)
+			continue
+		}
+		if !field.IsExported() {
+			continue
+		}
+		if name == "" {
+			name = field.Name
+		}
+		fields[name] = field.Type
+	}
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"errors"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestDecodeRequestBodyStrict(t *testing.T) {
+	tests := []struct {
+		name     string
+		strict   bool
+		body     string
+		expected []string
+	}{
+		{
+			name:   "known properties",
+			strict: true,
+			body:   `{"location": "eastus", "properties": {"safeName": "s1", "platformId": "UnixSSH", "platformAccountProperties": {"LogonDomain": "corp"}}}`,
+		},
+		{
+			name:     "wrong casing and unknown property",
+			strict:   true,
+			body:     `{"properties": {"safeName": "s1", "platformID": "UnixSSH", "adress": "host1"}}`,
+			expected: []string{"properties.adress", "properties.platformID"},
+		},
+		{
+			name:     "nested unknown property",
+			strict:   true,
+			body:     `{"properties": {"safeName": "s1", "secretManagement": {"automaticManagmentEnabled": true}}}`,
+			expected: []string{"properties.secretManagement.automaticManagmentEnabled"},
+		},
+		{
+			name: "not strict",
+			body: `{"properties": {"safeName": "s1", "platformID": "UnixSSH"}}`,
+		},
+		{
+			name:     "unknown property when not strict",
+			body:     `{"properties": {"safeName": "s1", "platformID": "UnixSSH", "adress": "host1"}}`,
+			expected: []string{"properties.adress"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.strict {
+				t.Setenv("STRICT_REQUEST_BODIES", "true")
+			}
+			req := httptest.NewRequest("PUT", "/", strings.NewReader(tt.body))
+
+			var request AccountRequest
+			err := decodeRequestBody(req, &request)
+
+			var unknownErr *UnknownPropertiesError
+			if tt.expected == nil {
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				return
+			}
+			if !errors.As(err, &unknownErr) {
+				t.Fatalf("expected UnknownPropertiesError, got %v", err)
+			}
+			if !reflect.DeepEqual(unknownErr.Fields, tt.expected) {
+				t.Errorf("expected fields %v, got %v", tt.expected, unknownErr.Fields)
+			}
+		})
+	}
+}
@@ -0,0 +1,308 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// storageResource is the token audience of Azure Storage
+const storageResource = "https://storage.azure.com/"
+
+// tablePartition holds every resource record; the provider manages few enough resources that one
+// partition keeps List a single query
+const tablePartition = "resource"
+
+// tableStateStore keeps resource records in an Azure Table Storage table, or in a Cosmos DB table
+// (Table API), so they survive restarts and are shared by replicas. It authenticates with the
+// account key when STATE_STORE_TABLE_KEY is set and with the managed identity otherwise, which
+// needs the Storage Table Data Contributor role.
+type tableStateStore struct {
+	endpoint string
+	table    string
+	account  string
+	key      []byte
+	client   *http.Client
+
+	mu    sync.Mutex
+	ready bool
+}
+
+// tableEntity is a resource record as stored in the table. Record holds the whole record; the other
+// columns repeat its main fields so the table can be read in Storage Explorer.
+type tableEntity struct {
+	PartitionKey      string
+	RowKey            string
+	ResourceID        string `json:"ResourceId"`
+	ResourceType      string
+	SafeName          string `json:",omitempty"`
+	AccountName       string `json:",omitempty"`
+	PCloudID          string `json:"PCloudId,omitempty"`
+	ProvisioningState string `json:",omitempty"`
+	ResourceETag      string `json:",omitempty"`
+	Record            string
+}
+
+// newStateStore returns the store selected by STATE_STORE: memory (the default) or table
+func newStateStore() StateStore {
+	switch kind := getEnvOrDefault("STATE_STORE", "memory"); strings.ToLower(kind) {
+	case "memory":
+	case "table":
+		store, err := newTableStateStore()
+		if err != nil {
+			log.Printf("ERROR: Cannot use the table state store, keeping records in memory: %v", err)
+			break
+		}
+		log.Printf("INFO: Keeping resource records in table %s at %s", store.table, store.endpoint)
+		return store
+	default:
+		log.Printf("ERROR: Unknown STATE_STORE %q, keeping records in memory", kind)
+	}
+	return newMemoryStateStore()
+}
+
+func newTableStateStore() (*tableStateStore, error) {
+	endpoint := strings.TrimSuffix(os.Getenv("STATE_STORE_TABLE_ENDPOINT"), "/")
+	u, err := url.Parse(endpoint)
+	if endpoint == "" || err != nil || u.Host == "" {
+		return nil, fmt.Errorf("STATE_STORE_TABLE_ENDPOINT must be the table endpoint, e.g. https://{account}.table.core.windows.net, got %q", endpoint)
+	}
+	s := &tableStateStore{
+		endpoint: endpoint,
+		table:    getEnvOrDefault("STATE_STORE_TABLE_NAME", "providerstate"),
+		account:  strings.SplitN(u.Hostname(), ".", 2)[0],
+		client:   newOutboundClient(10 * time.Second),
+	}
+	if key := os.Getenv("STATE_STORE_TABLE_KEY"); key != "" {
+		registerSensitiveValue(key)
+		if s.key, err = base64.StdEncoding.DecodeString(key); err != nil {
+			return nil, fmt.Errorf("STATE_STORE_TABLE_KEY is not a base64 account key: %w", err)
+		}
+	}
+	return s, nil
+}
+
+func (s *tableStateStore) Name() string {
+	return "table"
+}
+
+// tableRowKey encodes a resource ID as a row key; '/' is not allowed in keys
+func tableRowKey(resourceID string) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(stateKey(resourceID)))
+}
+
+// entityPath is the path of a record's entity
+func (s *tableStateStore) entityPath(resourceID string) string {
+	return fmt.Sprintf("/%s(PartitionKey='%s',RowKey='%s')", s.table, tablePartition, tableRowKey(resourceID))
+}
+
+func (s *tableStateStore) Put(rec ResourceRecord) error {
+	record, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	entity := tableEntity{
+		PartitionKey:      tablePartition,
+		RowKey:            tableRowKey(rec.ResourceID),
+		ResourceID:        rec.ResourceID,
+		ResourceType:      rec.ResourceType,
+		SafeName:          rec.SafeName,
+		AccountName:       rec.AccountName,
+		PCloudID:          rec.PCloudID,
+		ProvisioningState: rec.ProvisioningState,
+		ResourceETag:      rec.ETag,
+		Record:            string(record),
+	}
+	// A PUT without If-Match is Insert Or Replace
+	_, _, err = s.do(http.MethodPut, s.entityPath(rec.ResourceID), nil, entity, nil)
+	return err
+}
+
+func (s *tableStateStore) Get(resourceID string) (ResourceRecord, bool, error) {
+	body, status, err := s.do(http.MethodGet, s.entityPath(resourceID), nil, nil, nil)
+	if status == http.StatusNotFound {
+		return ResourceRecord{}, false, nil
+	}
+	if err != nil {
+		return ResourceRecord{}, false, err
+	}
+	var entity tableEntity
+	if err := json.Unmarshal(body, &entity); err != nil {
+		return ResourceRecord{}, false, fmt.Errorf("failed to parse entity: %w", err)
+	}
+	rec, err := entity.record()
+	return rec, err == nil, err
+}
+
+func (s *tableStateStore) Delete(resourceID string) error {
+	_, status, err := s.do(http.MethodDelete, s.entityPath(resourceID), nil, nil, nil)
+	if status == http.StatusNotFound {
+		return nil
+	}
+	return err
+}
+
+// List reads every record, following the continuation the Table service returns after 1000 entities
+func (s *tableStateStore) List() ([]ResourceRecord, error) {
+	query := url.Values{}
+	query.Set("$filter", fmt.Sprintf("PartitionKey eq '%s'", tablePartition))
+	query.Set("$select", "Record")
+
+	var recs []ResourceRecord
+	for {
+		body, header, err := s.query(query)
+		if err != nil {
+			return nil, err
+		}
+		var page struct {
+			Value []tableEntity `json:"value"`
+		}
+		if err := json.Unmarshal(body, &page); err != nil {
+			return nil, fmt.Errorf("failed to parse entities: %w", err)
+		}
+		for _, entity := range page.Value {
+			rec, err := entity.record()
+			if err != nil {
+				return nil, err
+			}
+			recs = append(recs, rec)
+		}
+
+		nextPartition, nextRow := header.Get("X-Ms-Continuation-Nextpartitionkey"), header.Get("X-Ms-Continuation-Nextrowkey")
+		if nextPartition == "" && nextRow == "" {
+			break
+		}
+		query.Set("NextPartitionKey", nextPartition)
+		query.Set("NextRowKey", nextRow)
+	}
+	sort.Slice(recs, func(i, j int) bool { return recs[i].ResourceID < recs[j].ResourceID })
+	return recs, nil
+}
+
+// query runs an entity query and returns the body and the headers, which carry the continuation
+func (s *tableStateStore) query(query url.Values) ([]byte, http.Header, error) {
+	var header http.Header
+	body, _, err := s.do(http.MethodGet, "/"+s.table+"()", query, nil, func(resp *http.Response) { header = resp.Header })
+	return body, header, err
+}
+
+func (e tableEntity) record() (ResourceRecord, error) {
+	var rec ResourceRecord
+	if err := json.Unmarshal([]byte(e.Record), &rec); err != nil {
+		return rec, fmt.Errorf("failed to parse record %s: %w", e.ResourceID, err)
+	}
+	return rec, nil
+}
+
+// ensureTable creates the table the first time the store is used; an existing table is fine
+func (s *tableStateStore) ensureTable() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.ready {
+		return nil
+	}
+	_, status, err := s.send(http.MethodPost, "/Tables", nil, map[string]string{"TableName": s.table}, nil)
+	if err != nil && status != http.StatusConflict {
+		return fmt.Errorf("failed to create table %s: %w", s.table, err)
+	}
+	s.ready = true
+	return nil
+}
+
+// do calls the Table service for the store's table, creating the table first if needed. It returns
+// the response body and status; statuses of 300 and above are returned with an error. onResponse,
+// when set, sees the response of a successful call.
+func (s *tableStateStore) do(method, path string, query url.Values, body interface{}, onResponse func(*http.Response)) ([]byte, int, error) {
+	if err := s.ensureTable(); err != nil {
+		return nil, 0, err
+	}
+	return s.send(method, path, query, body, onResponse)
+}
+
+// send makes one authenticated Table service call. With the managed identity, a 401 drops the
+// cached token and the call is tried once more with a new one.
+func (s *tableStateStore) send(method, path string, query url.Values, body interface{}, onResponse func(*http.Response)) ([]byte, int, error) {
+	var data []byte
+	if body != nil {
+		var err error
+		if data, err = json.Marshal(body); err != nil {
+			return nil, 0, err
+		}
+	}
+	apiurl := s.endpoint + path
+	if len(query) > 0 {
+		apiurl += "?" + query.Encode()
+	}
+
+	for attempt := 1; ; attempt++ {
+		req, err := http.NewRequest(method, apiurl, bytes.NewReader(data))
+		if err != nil {
+			return nil, 0, err
+		}
+		req.Header.Set("x-ms-version", "2019-02-02")
+		req.Header.Set("x-ms-date", time.Now().UTC().Format(http.TimeFormat))
+		req.Header.Set("Accept", "application/json;odata=nometadata")
+		req.Header.Set("DataServiceVersion", "3.0;NetFx")
+		if body != nil {
+			req.Header.Set("Content-Type", "application/json")
+		}
+		if method == http.MethodDelete {
+			req.Header.Set("If-Match", "*")
+		}
+		if method == http.MethodPost {
+			req.Header.Set("Prefer", "return-no-content")
+		}
+		if err := s.authorize(req); err != nil {
+			return nil, 0, err
+		}
+
+		resp, err := s.client.Do(req)
+		if err != nil {
+			return nil, 0, err
+		}
+		respBody, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			return nil, resp.StatusCode, err
+		}
+		if resp.StatusCode == http.StatusUnauthorized && s.key == nil && attempt == 1 {
+			forgetManagedIdentityToken(storageResource)
+			continue
+		}
+		if resp.StatusCode >= 300 {
+			return respBody, resp.StatusCode, fmt.Errorf("%s %s returned status %d", method, req.URL.Path, resp.StatusCode)
+		}
+		if onResponse != nil {
+			onResponse(resp)
+		}
+		return respBody, resp.StatusCode, nil
+	}
+}
+
+// authorize signs the request with the account key (SharedKeyLite) or adds a managed identity token
+func (s *tableStateStore) authorize(req *http.Request) error {
+	if s.key == nil {
+		token, err := getManagedIdentityToken(storageResource)
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+		return nil
+	}
+	mac := hmac.New(sha256.New, s.key)
+	mac.Write([]byte(req.Header.Get("x-ms-date") + "\n/" + s.account + req.URL.EscapedPath()))
+	req.Header.Set("Authorization", fmt.Sprintf("SharedKeyLite %s:%s", s.account, base64.StdEncoding.EncodeToString(mac.Sum(nil))))
+	return nil
+}
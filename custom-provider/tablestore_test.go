@@ -0,0 +1,148 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeTableService is an in-memory Table service that returns one entity per query page
+type fakeTableService struct {
+	t        *testing.T
+	key      []byte
+	mu       sync.Mutex
+	tables   map[string]bool
+	entities map[string]map[string]interface{}
+}
+
+var fakeEntityPath = regexp.MustCompile(`^/(\w+)\(PartitionKey='([^']*)',RowKey='([^']*)'\)$`)
+
+func (f *fakeTableService) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	mac := hmac.New(sha256.New, f.key)
+	mac.Write([]byte(r.Header.Get("x-ms-date") + "\n/127" + r.URL.EscapedPath()))
+	if want := "SharedKeyLite 127:" + base64.StdEncoding.EncodeToString(mac.Sum(nil)); r.Header.Get("Authorization") != want {
+		f.t.Errorf("%s %s: bad Authorization %q", r.Method, r.URL.Path, r.Header.Get("Authorization"))
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+
+	body, _ := io.ReadAll(r.Body)
+	switch {
+	case r.Method == http.MethodPost && r.URL.Path == "/Tables":
+		var table struct{ TableName string }
+		json.Unmarshal(body, &table)
+		if f.tables[table.TableName] {
+			w.WriteHeader(http.StatusConflict)
+			return
+		}
+		f.tables[table.TableName] = true
+		w.WriteHeader(http.StatusNoContent)
+	case r.Method == http.MethodGet && strings.HasSuffix(r.URL.Path, "()"):
+		var keys []string
+		for key := range f.entities {
+			if next := r.URL.Query().Get("NextRowKey"); key >= next {
+				keys = append(keys, key)
+			}
+		}
+		sort.Strings(keys)
+		page := []map[string]interface{}{}
+		if len(keys) > 0 {
+			page = append(page, f.entities[keys[0]])
+		}
+		if len(keys) > 1 {
+			w.Header().Set("x-ms-continuation-NextPartitionKey", tablePartition)
+			w.Header().Set("x-ms-continuation-NextRowKey", keys[1])
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"value": page})
+	default:
+		match := fakeEntityPath.FindStringSubmatch(r.URL.Path)
+		if match == nil || !f.tables[match[1]] {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		entity, found := f.entities[match[3]]
+		switch r.Method {
+		case http.MethodPut:
+			var stored map[string]interface{}
+			json.Unmarshal(body, &stored)
+			f.entities[match[3]] = stored
+			w.WriteHeader(http.StatusNoContent)
+		case http.MethodGet:
+			if !found {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			json.NewEncoder(w).Encode(entity)
+		case http.MethodDelete:
+			if !found {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			delete(f.entities, match[3])
+			w.WriteHeader(http.StatusNoContent)
+		}
+	}
+}
+
+func TestTableStateStore(t *testing.T) {
+	key := []byte("fixture-account-key")
+	fake := &fakeTableService{t: t, key: key, tables: map[string]bool{}, entities: map[string]map[string]interface{}{}}
+	server := httptest.NewServer(fake)
+	defer server.Close()
+
+	t.Setenv("STATE_STORE_TABLE_ENDPOINT", server.URL)
+	t.Setenv("STATE_STORE_TABLE_KEY", base64.StdEncoding.EncodeToString(key))
+	store, err := newTableStateStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	safe := ResourceRecord{ResourceID: "/subscriptions/sub1/resourceGroups/rg1/providers/Microsoft.CustomProviders/resourceProviders/CyberArkProvider/safes/Safe1", ResourceType: "safes", SafeName: "Safe1", PCloudID: "Safe1", ProvisioningState: "Succeeded", ETag: `"abc"`}
+	account := ResourceRecord{ResourceID: "/subscriptions/sub1/resourceGroups/rg1/providers/Microsoft.CustomProviders/resourceProviders/CyberArkProvider/accounts/Safe1.root", ResourceType: "accounts", SafeName: "Safe1", AccountName: "root", PCloudID: "12_3"}
+	for _, rec := range []ResourceRecord{safe, account} {
+		if err := store.Put(rec); err != nil {
+			t.Fatalf("Put %s: %v", rec.ResourceID, err)
+		}
+	}
+
+	got, found, err := store.Get(strings.ToUpper(safe.ResourceID))
+	if err != nil || !found || got.PCloudID != "Safe1" || got.ETag != `"abc"` {
+		t.Errorf("Get: expected the safe record, got %+v %t %v", got, found, err)
+	}
+	if entity := fake.entities[tableRowKey(safe.ResourceID)]; entity["SafeName"] != "Safe1" || entity["ProvisioningState"] != "Succeeded" {
+		t.Errorf("expected readable columns in the entity, got %v", entity)
+	}
+
+	recs, err := store.List()
+	if err != nil || len(recs) != 2 || recs[0].ResourceType != "accounts" || recs[1].ResourceType != "safes" {
+		t.Errorf("List: expected both records across pages, got %+v %v", recs, err)
+	}
+
+	if err := store.Delete(account.ResourceID); err != nil {
+		t.Errorf("Delete: %v", err)
+	}
+	if err := store.Delete(account.ResourceID); err != nil {
+		t.Errorf("Delete of a missing record: %v", err)
+	}
+	if _, found, err := store.Get(account.ResourceID); found || err != nil {
+		t.Errorf("expected no record after Delete, got %t %v", found, err)
+	}
+
+	// A second store finds the table already there
+	again, _ := newTableStateStore()
+	if _, found, err := again.Get(safe.ResourceID); !found || err != nil {
+		t.Errorf("expected the record from a new store, got %t %v", found, err)
+	}
+}
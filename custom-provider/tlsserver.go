@@ -0,0 +1,240 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// In Container Apps the ingress terminates TLS, so the provider serves plain HTTP. On AKS or a VM
+// without such an ingress it can terminate TLS itself: the certificate and key come from
+// TLS_CERT_FILE and TLS_KEY_FILE (e.g. a mounted Kubernetes secret) or from the Key Vault
+// certificate TLS_KEYVAULT_CERT, and are re-read every TLS_CERT_REFRESH_INTERVAL so a rotated
+// certificate is served without a restart. Over TLS both HTTP/2 and HTTP/1.1 are offered, unless
+// TLS_HTTP2 is false. The listener accepts IPv4 and IPv6 connections either way.
+
+// tlsCertificateLoader reads the current certificate and key as PEM
+type tlsCertificateLoader interface {
+	// Name describes where the certificate comes from, for logs and the startup fingerprint
+	Name() string
+	Load() (certPEM, keyPEM []byte, err error)
+}
+
+// newTLSCertificateLoader returns the configured loader, or nil when the provider serves plain HTTP
+func newTLSCertificateLoader() (tlsCertificateLoader, error) {
+	certFile, keyFile, vaultCert := os.Getenv("TLS_CERT_FILE"), os.Getenv("TLS_KEY_FILE"), os.Getenv("TLS_KEYVAULT_CERT")
+	switch {
+	case vaultCert != "" && (certFile != "" || keyFile != ""):
+		return nil, fmt.Errorf("set either TLS_KEYVAULT_CERT or TLS_CERT_FILE and TLS_KEY_FILE, not both")
+	case vaultCert != "":
+		vaultURI := strings.TrimRight(os.Getenv("KEYVAULT_URI"), "/")
+		if err := validKeyVaultURI(vaultURI); err != nil {
+			return nil, fmt.Errorf("TLS_KEYVAULT_CERT requires KEYVAULT_URI: %v", err)
+		}
+		return keyVaultTLSCertificate{vaultURI: vaultURI, name: vaultCert, client: newOutboundClient(10 * time.Second)}, nil
+	case certFile != "" && keyFile != "":
+		return fileTLSCertificate{certFile: certFile, keyFile: keyFile}, nil
+	case certFile != "" || keyFile != "":
+		return nil, fmt.Errorf("TLS_CERT_FILE and TLS_KEY_FILE must be set together")
+	}
+	return nil, nil
+}
+
+// fileTLSCertificate reads PEM files; the key file may also be the certificate file
+type fileTLSCertificate struct {
+	certFile, keyFile string
+}
+
+func (f fileTLSCertificate) Name() string { return "file:" + f.certFile }
+
+func (f fileTLSCertificate) Load() ([]byte, []byte, error) {
+	certPEM, err := os.ReadFile(f.certFile)
+	if err != nil {
+		return nil, nil, err
+	}
+	keyPEM, err := os.ReadFile(f.keyFile)
+	if err != nil {
+		return nil, nil, err
+	}
+	return certPEM, keyPEM, nil
+}
+
+// keyVaultTLSCertificate reads a Key Vault certificate through the secret that holds its key. Only
+// certificates created with the PEM content type (application/x-pem-file) can be read; PKCS#12
+// secrets are rejected because the standard library cannot parse them.
+type keyVaultTLSCertificate struct {
+	vaultURI, name string
+	client         *http.Client
+}
+
+func (k keyVaultTLSCertificate) Name() string { return "keyvault:" + k.name }
+
+func (k keyVaultTLSCertificate) Load() ([]byte, []byte, error) {
+	body, err := keyVaultDo(k.client, http.MethodGet, fmt.Sprintf("%s/secrets/%s?api-version=7.4", k.vaultURI, url.PathEscape(k.name)), nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	var bundle struct {
+		Value       string `json:"value"`
+		ContentType string `json:"contentType"`
+	}
+	if err := json.Unmarshal(body, &bundle); err != nil {
+		return nil, nil, fmt.Errorf("failed to parse secret: %w", err)
+	}
+	if bundle.ContentType != "" && bundle.ContentType != "application/x-pem-file" {
+		return nil, nil, fmt.Errorf("certificate %s has content type %s, only application/x-pem-file is supported", k.name, bundle.ContentType)
+	}
+	// The PEM secret holds the key and the chain
+	return []byte(bundle.Value), []byte(bundle.Value), nil
+}
+
+// tlsCertificateStore serves the last certificate that loaded successfully
+type tlsCertificateStore struct {
+	loader tlsCertificateLoader
+
+	mu      sync.RWMutex
+	cert    *tls.Certificate
+	leaf    *x509.Certificate
+	lastPEM []byte
+}
+
+func newTLSCertificateStore(loader tlsCertificateLoader) *tlsCertificateStore {
+	return &tlsCertificateStore{loader: loader}
+}
+
+// reload reads the certificate again and reports whether it changed; on error the current
+// certificate stays in use
+func (s *tlsCertificateStore) reload() (bool, error) {
+	certPEM, keyPEM, err := s.loader.Load()
+	if err != nil {
+		return false, err
+	}
+	combined := append(append([]byte{}, certPEM...), keyPEM...)
+	s.mu.RLock()
+	unchanged := s.cert != nil && bytes.Equal(combined, s.lastPEM)
+	s.mu.RUnlock()
+	if unchanged {
+		return false, nil
+	}
+
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return false, fmt.Errorf("invalid certificate or key from %s: %v", s.loader.Name(), err)
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return false, fmt.Errorf("invalid certificate from %s: %v", s.loader.Name(), err)
+	}
+	if time.Now().After(leaf.NotAfter) {
+		log.Printf("WARNING: TLS certificate from %s expired at %s", s.loader.Name(), leaf.NotAfter.Format(time.RFC3339))
+	}
+
+	s.mu.Lock()
+	s.cert, s.leaf, s.lastPEM = &cert, leaf, combined
+	s.mu.Unlock()
+	log.Printf("INFO: Loaded TLS certificate %s from %s, valid until %s", leaf.Subject, s.loader.Name(), leaf.NotAfter.Format(time.RFC3339))
+	return true, nil
+}
+
+// getCertificate is tls.Config.GetCertificate
+func (s *tlsCertificateStore) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.cert == nil {
+		return nil, fmt.Errorf("no TLS certificate loaded")
+	}
+	return s.cert, nil
+}
+
+// watch reloads the certificate every interval
+func (s *tlsCertificateStore) watch(interval time.Duration) {
+	go func() {
+		for range time.Tick(interval) {
+			if _, err := s.reload(); err != nil {
+				log.Printf("WARNING: Failed to reload the TLS certificate, keeping the current one: %v", err)
+			}
+		}
+	}()
+}
+
+// describe is the startup fingerprint's view of the certificate
+func (s *tlsCertificateStore) describe() map[string]interface{} {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	description := map[string]interface{}{
+		"source": s.loader.Name(),
+		"http2":  tlsHTTP2Enabled(),
+	}
+	if s.leaf != nil {
+		description["subject"] = s.leaf.Subject.String()
+		description["notAfter"] = s.leaf.NotAfter.Format(time.RFC3339)
+	}
+	return description
+}
+
+// tlsHTTP2Enabled reports whether HTTP/2 is offered over TLS (TLS_HTTP2, default true)
+func tlsHTTP2Enabled() bool {
+	return !strings.EqualFold(os.Getenv("TLS_HTTP2"), "false")
+}
+
+// tlsCertRefreshInterval is how often the certificate is re-read (TLS_CERT_REFRESH_INTERVAL, default
+// 1m, 0 to read it only at startup)
+func tlsCertRefreshInterval() time.Duration {
+	return policyDuration("TLS_CERT_REFRESH_INTERVAL", "1m")
+}
+
+// newTLSConfig returns the server TLS configuration. Client certificates are requested, but not
+// verified here, when caller certificate authentication is configured; callerauth.go checks them.
+func newTLSConfig(store *tlsCertificateStore, requestClientCerts bool) *tls.Config {
+	cfg := &tls.Config{
+		GetCertificate: store.getCertificate,
+		MinVersion:     tls.VersionTLS12,
+		NextProtos:     []string{"http/1.1"},
+	}
+	if tlsHTTP2Enabled() {
+		cfg.NextProtos = []string{"h2", "http/1.1"}
+	}
+	if requestClientCerts {
+		cfg.ClientAuth = tls.RequestClientCert
+	}
+	return cfg
+}
+
+// serveTLS switches srv to TLS: ln is wrapped in a TLS listener and, because srv.TLSConfig offers
+// h2, net/http serves HTTP/2 on the connections that negotiate it. No ingress sits in front of a
+// provider that terminates TLS itself, so X-Forwarded-Client-Cert can only come from the client and
+// is dropped before any handler sees it.
+func serveTLS(srv *http.Server, ln net.Listener, cfg *tls.Config) net.Listener {
+	srv.TLSConfig = cfg
+	srv.Handler = stripForwardedClientCert(srv.Handler)
+	return tls.NewListener(ln, cfg)
+}
+
+// stripForwardedClientCert removes X-Forwarded-Client-Cert from every request
+func stripForwardedClientCert(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.Header.Del("X-Forwarded-Client-Cert")
+		next.ServeHTTP(w, r)
+	})
+}
+
+// tlsCertificates is the store in use, or nil when the provider serves plain HTTP
+var tlsCertificates *tlsCertificateStore
+
+// tlsDescription is the startup fingerprint's "tls" entry
+func tlsDescription() interface{} {
+	if tlsCertificates == nil {
+		return "disabled"
+	}
+	return tlsCertificates.describe()
+}
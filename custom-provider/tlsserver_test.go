@@ -0,0 +1,225 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// writeTestCertificate writes a self-signed certificate for localhost and its key
+func writeTestCertificate(t *testing.T, certFile, keyFile, commonName string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		DNSNames:     []string{"localhost"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestTLSServerReloadsRotatedCertificate(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "tls.crt"), filepath.Join(dir, "tls.key")
+	writeTestCertificate(t, certFile, keyFile, "first")
+
+	store := newTLSCertificateStore(fileTLSCertificate{certFile: certFile, keyFile: keyFile})
+	if changed, err := store.reload(); err != nil || !changed {
+		t.Fatalf("expected the certificate to load, got %t %v", changed, err)
+	}
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := newServer(ln.Addr().String(), http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.Proto))
+	}))
+	ln = serveTLS(srv, ln, newTLSConfig(store, false))
+	go srv.Serve(ln)
+	defer srv.Close()
+
+	// get returns the protocol the request was served with and the served certificate's name
+	get := func() (string, string) {
+		t.Helper()
+		client := &http.Client{Timeout: 5 * time.Second, Transport: &http.Transport{
+			TLSClientConfig:   &tls.Config{InsecureSkipVerify: true},
+			ForceAttemptHTTP2: true,
+		}}
+		defer client.CloseIdleConnections()
+		resp, err := client.Get("https://" + ln.Addr().String() + "/")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		return resp.Proto, resp.TLS.PeerCertificates[0].Subject.CommonName
+	}
+
+	if proto, name := get(); proto != "HTTP/2.0" || name != "first" {
+		t.Fatalf("expected HTTP/2 with the first certificate, got %s %s", proto, name)
+	}
+
+	if changed, err := store.reload(); err != nil || changed {
+		t.Errorf("expected an unchanged certificate not to be reloaded, got %t %v", changed, err)
+	}
+
+	writeTestCertificate(t, certFile, keyFile, "second")
+	if changed, err := store.reload(); err != nil || !changed {
+		t.Fatalf("expected the rotated certificate to load, got %t %v", changed, err)
+	}
+	if _, name := get(); name != "second" {
+		t.Errorf("expected new connections to get the rotated certificate, got %s", name)
+	}
+
+	// A broken file keeps the current certificate in use
+	os.WriteFile(keyFile, []byte("not a key"), 0o600)
+	if _, err := store.reload(); err == nil {
+		t.Error("expected an error for an invalid key")
+	}
+	if _, name := get(); name != "second" {
+		t.Errorf("expected the last good certificate, got %s", name)
+	}
+}
+
+func TestTLSServerIgnoresForwardedClientCert(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "tls.crt"), filepath.Join(dir, "tls.key")
+	writeTestCertificate(t, certFile, keyFile, "provider")
+	store := newTLSCertificateStore(fileTLSCertificate{certFile: certFile, keyFile: keyFile})
+	if _, err := store.reload(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Even with the ingress opt-in, a direct client cannot pass a certificate it does not hold
+	ca, caKey := newTestCertificate(t, "Test CA", true, nil, nil)
+	trusted, _ := newTestCertificate(t, "arm-caller", false, ca, caKey)
+	t.Setenv("CALLER_AUTH_TOKEN", "")
+	t.Setenv("CALLER_CERT_THUMBPRINTS", "")
+	t.Setenv("CALLER_CERT_SUBJECTS", "arm-caller")
+	t.Setenv("CALLER_CERT_TRUST_XFCC", "true")
+	saved := callerAuth
+	defer func() { callerAuth = saved }()
+	callerAuth = loadCallerAuthConfig()
+	callerAuth.roots = x509.NewCertPool()
+	callerAuth.roots.AddCert(ca)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	forwarded := make(chan string, 1)
+	srv := newServer(ln.Addr().String(), callerAuthMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		forwarded <- r.Header.Get("X-Forwarded-Client-Cert")
+		w.WriteHeader(http.StatusOK)
+	})))
+	ln = serveTLS(srv, ln, newTLSConfig(store, true))
+	go srv.Serve(ln)
+	defer srv.Close()
+
+	client := &http.Client{Timeout: 5 * time.Second, Transport: &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}}
+	defer client.CloseIdleConnections()
+	req, _ := http.NewRequest(http.MethodPut, "https://"+ln.Addr().String()+"/", nil)
+	req.Header.Set("X-Forwarded-Client-Cert", `Cert="`+url.QueryEscape(string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: trusted.Raw})))+`"`)
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("expected a forged X-Forwarded-Client-Cert to be rejected with 401, got %d", resp.StatusCode)
+	}
+
+	// Handlers never see the header, also on paths without caller authentication
+	req, _ = http.NewRequest(http.MethodGet, "https://"+ln.Addr().String()+"/health", nil)
+	req.Header.Set("X-Forwarded-Client-Cert", "Hash=abc")
+	if resp, err = client.Do(req); err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if got := <-forwarded; got != "" {
+		t.Errorf("expected X-Forwarded-Client-Cert to be stripped, got %q", got)
+	}
+}
+
+func TestTLSHTTP2CanBeDisabled(t *testing.T) {
+	t.Setenv("TLS_HTTP2", "false")
+	cfg := newTLSConfig(newTLSCertificateStore(fileTLSCertificate{}), true)
+	if len(cfg.NextProtos) != 1 || cfg.NextProtos[0] != "http/1.1" {
+		t.Errorf("expected only http/1.1, got %v", cfg.NextProtos)
+	}
+	if cfg.ClientAuth != tls.RequestClientCert {
+		t.Errorf("expected client certificates to be requested, got %v", cfg.ClientAuth)
+	}
+}
+
+func TestNewTLSCertificateLoader(t *testing.T) {
+	tests := []struct {
+		name     string
+		env      map[string]string
+		wantName string
+		wantErr  string
+	}{
+		{"plain HTTP", nil, "", ""},
+		{"files", map[string]string{"TLS_CERT_FILE": "/certs/tls.crt", "TLS_KEY_FILE": "/certs/tls.key"}, "file:/certs/tls.crt", ""},
+		{"certificate without key", map[string]string{"TLS_CERT_FILE": "/certs/tls.crt"}, "", "must be set together"},
+		{"key vault", map[string]string{"TLS_KEYVAULT_CERT": "provider-tls", "KEYVAULT_URI": "https://my-vault.vault.azure.net"}, "keyvault:provider-tls", ""},
+		{"key vault without vault", map[string]string{"TLS_KEYVAULT_CERT": "provider-tls"}, "", "requires KEYVAULT_URI"},
+		{"both sources", map[string]string{"TLS_KEYVAULT_CERT": "provider-tls", "TLS_CERT_FILE": "/certs/tls.crt"}, "", "not both"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, name := range []string{"TLS_CERT_FILE", "TLS_KEY_FILE", "TLS_KEYVAULT_CERT", "KEYVAULT_URI"} {
+				t.Setenv(name, tt.env[name])
+			}
+			loader, err := newTLSCertificateLoader()
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("expected error containing %q, got %v", tt.wantErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			switch {
+			case tt.wantName == "" && loader != nil:
+				t.Errorf("expected no loader, got %s", loader.Name())
+			case tt.wantName != "" && (loader == nil || loader.Name() != tt.wantName):
+				t.Errorf("expected loader %s, got %v", tt.wantName, loader)
+			}
+		})
+	}
+}
@@ -0,0 +1,392 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Requests are traced with OpenTelemetry-compatible spans when OTEL_EXPORTER_OTLP_ENDPOINT (or
+// OTEL_EXPORTER_OTLP_TRACES_ENDPOINT) is set. Every request is a server span that continues the
+// caller's W3C traceparent; the auth, pam and verification phases (see startPhase) and named PCloud
+// operations such as AddSafe, AddAccount and the GetAccounts polling are child spans. PCloud and
+// Conjur requests carry a traceparent naming the innermost open span, so their spans join the
+// trace. Spans are batched and sent as OTLP/HTTP JSON, so any OpenTelemetry collector or
+// Application Insights OTLP endpoint can receive them.
+
+// OTLP span kinds
+const (
+	spanKindInternal = 1
+	spanKindServer   = 2
+)
+
+// span is one timed operation of a trace
+type span struct {
+	tracer   *tracer
+	traceID  string
+	spanID   string
+	parentID string
+	name     string
+	kind     int
+	start    time.Time
+
+	mu    sync.Mutex
+	attrs map[string]string
+	err   error
+	ended bool
+	// onEnd removes the span from the request's open spans
+	onEnd func()
+}
+
+// traceState is the trace of one request: the server span and the spans currently open below it
+type traceState struct {
+	mu   sync.Mutex
+	open []*span
+}
+
+type traceStateKey struct{}
+
+// tracer batches finished spans and exports them to the OTLP endpoint
+type tracer struct {
+	endpoint    string
+	serviceName string
+	headers     map[string]string
+	client      *http.Client
+
+	mu      sync.Mutex
+	pending []*otlpSpan
+}
+
+// maxPendingSpans bounds the spans kept while the collector is unreachable; older ones are dropped
+const maxPendingSpans = 2048
+
+var traces = newTracer()
+
+func newTracer() *tracer {
+	endpoint := os.Getenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT")
+	if endpoint == "" && os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT") != "" {
+		endpoint = strings.TrimSuffix(os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT"), "/") + "/v1/traces"
+	}
+	if endpoint == "" {
+		return nil
+	}
+	t := &tracer{
+		endpoint:    endpoint,
+		serviceName: getEnvOrDefault("OTEL_SERVICE_NAME", "cyberark-custom-provider"),
+		headers:     otlpHeaders(os.Getenv("OTEL_EXPORTER_OTLP_HEADERS")),
+		client:      newOutboundClient(10 * time.Second),
+	}
+	go func() {
+		for range time.Tick(5 * time.Second) {
+			t.flush()
+		}
+	}()
+	return t
+}
+
+func init() {
+	if traces != nil {
+		registerDependency("otlp", func() map[string]interface{} {
+			traces.mu.Lock()
+			defer traces.mu.Unlock()
+			return map[string]interface{}{"endpoint": redactURL(traces.endpoint), "pendingSpans": len(traces.pending)}
+		})
+	}
+}
+
+// otlpHeaders parses OTEL_EXPORTER_OTLP_HEADERS ("key1=value1,key2=value2")
+func otlpHeaders(raw string) map[string]string {
+	headers := map[string]string{}
+	for _, entry := range strings.Split(raw, ",") {
+		key, value, ok := strings.Cut(entry, "=")
+		if ok && strings.TrimSpace(key) != "" {
+			headers[strings.TrimSpace(key)] = strings.TrimSpace(value)
+		}
+	}
+	return headers
+}
+
+func randomHex(n int) string {
+	b := make([]byte, n)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// parseTraceparent returns the trace ID, parent span ID and sampled flag of a W3C traceparent header
+func parseTraceparent(header string) (traceID, parentID string, sampled, ok bool) {
+	parts := strings.Split(strings.TrimSpace(header), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" || len(parts[1]) != 32 || len(parts[2]) != 16 || len(parts[3]) != 2 {
+		return "", "", false, false
+	}
+	if _, err := hex.DecodeString(parts[1] + parts[2] + parts[3]); err != nil {
+		return "", "", false, false
+	}
+	if parts[1] == strings.Repeat("0", 32) || parts[2] == strings.Repeat("0", 16) {
+		return "", "", false, false
+	}
+	flags, _ := strconv.ParseUint(parts[3], 16, 8)
+	return parts[1], parts[2], flags&1 == 1, true
+}
+
+// tracingMiddleware opens the server span of every request, continuing the caller's traceparent
+func tracingMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if traces == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		traceID, parentID, sampled, ok := parseTraceparent(r.Header.Get("traceparent"))
+		if ok && !sampled {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if !ok {
+			traceID, parentID = randomHex(16), ""
+		}
+
+		resourceType := metricResourceType(r)
+		name := r.Method + " " + r.URL.Path
+		if resourceType != "none" {
+			name = r.Method + " " + resourceType
+		}
+		server := &span{tracer: traces, traceID: traceID, spanID: randomHex(8), parentID: parentID, name: name, kind: spanKindServer, start: time.Now(), attrs: map[string]string{
+			"http.request.method":  r.Method,
+			"url.path":             r.URL.Path,
+			"provider.operationId": operationID(r),
+			"provider.requestPath": customProviderRequestPath(r),
+			"azure.correlationId":  r.Header.Get("X-Ms-Correlation-Request-Id"),
+		}}
+		state := &traceState{open: []*span{server}}
+		r = r.WithContext(context.WithValue(r.Context(), traceStateKey{}, state))
+		w.Header().Set("traceresponse", fmt.Sprintf("00-%s-%s-01", server.traceID, server.spanID))
+
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(rec, r)
+
+		server.SetAttr("http.response.status_code", strconv.Itoa(rec.status))
+		var err error
+		if rec.status >= 500 {
+			err = fmt.Errorf("status %d", rec.status)
+		}
+		server.End(err)
+	})
+}
+
+// startSpan opens a child of the innermost open span of the request; it returns nil when the
+// request is not traced, and all span methods accept a nil span
+func startSpan(r *http.Request, name string, attrs ...string) *span {
+	state, _ := r.Context().Value(traceStateKey{}).(*traceState)
+	if state == nil {
+		return nil
+	}
+	state.mu.Lock()
+	defer state.mu.Unlock()
+	if len(state.open) == 0 {
+		return nil
+	}
+	parent := state.open[len(state.open)-1]
+	s := &span{tracer: parent.tracer, traceID: parent.traceID, spanID: randomHex(8), parentID: parent.spanID, name: name, kind: spanKindInternal, start: time.Now(), attrs: map[string]string{}}
+	for i := 0; i+1 < len(attrs); i += 2 {
+		s.attrs[attrs[i]] = attrs[i+1]
+	}
+	state.open = append(state.open, s)
+	s.onEnd = func() {
+		state.mu.Lock()
+		defer state.mu.Unlock()
+		for i, open := range state.open {
+			if open == s {
+				state.open = append(state.open[:i], state.open[i+1:]...)
+				break
+			}
+		}
+	}
+	return s
+}
+
+// traceparent returns the W3C traceparent for an outbound call made under ctx: the request's trace
+// with its innermost open span as parent, or empty when the request is not traced
+func traceparent(ctx context.Context) string {
+	state, _ := ctx.Value(traceStateKey{}).(*traceState)
+	if state == nil {
+		return ""
+	}
+	state.mu.Lock()
+	defer state.mu.Unlock()
+	if len(state.open) == 0 {
+		return ""
+	}
+	parent := state.open[len(state.open)-1]
+	return fmt.Sprintf("00-%s-%s-01", parent.traceID, parent.spanID)
+}
+
+// injectTraceparent adds the traceparent of the request's context to an outbound request
+func injectTraceparent(req *http.Request) {
+	if header := traceparent(req.Context()); header != "" {
+		req.Header.Set("traceparent", header)
+	}
+}
+
+// SetAttr sets a string attribute on the span
+func (s *span) SetAttr(key, value string) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.attrs[key] = value
+}
+
+// End finishes the span; a non-nil err marks it failed
+func (s *span) End(err error) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	if s.ended {
+		s.mu.Unlock()
+		return
+	}
+	s.ended, s.err = true, err
+	end := time.Now()
+	s.mu.Unlock()
+	if s.onEnd != nil {
+		s.onEnd()
+	}
+	s.tracer.record(s, end)
+}
+
+// otlpSpan is a span in the OTLP/HTTP JSON encoding
+type otlpSpan struct {
+	TraceID           string          `json:"traceId"`
+	SpanID            string          `json:"spanId"`
+	ParentSpanID      string          `json:"parentSpanId,omitempty"`
+	Name              string          `json:"name"`
+	Kind              int             `json:"kind"`
+	StartTimeUnixNano string          `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string          `json:"endTimeUnixNano"`
+	Attributes        []otlpAttribute `json:"attributes,omitempty"`
+	Status            otlpStatus      `json:"status"`
+}
+
+type otlpAttribute struct {
+	Key   string `json:"key"`
+	Value struct {
+		StringValue string `json:"stringValue"`
+	} `json:"value"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code,omitempty"` // 1 ok, 2 error
+	Message string `json:"message,omitempty"`
+}
+
+func otlpAttributes(attrs map[string]string) []otlpAttribute {
+	keys := sortedKeys(attrs)
+	out := make([]otlpAttribute, 0, len(keys))
+	for _, key := range keys {
+		if attrs[key] == "" {
+			continue
+		}
+		attr := otlpAttribute{Key: key}
+		attr.Value.StringValue = attrs[key]
+		out = append(out, attr)
+	}
+	return out
+}
+
+// record queues a finished span for export
+func (t *tracer) record(s *span, end time.Time) {
+	s.mu.Lock()
+	o := &otlpSpan{
+		TraceID:           s.traceID,
+		SpanID:            s.spanID,
+		ParentSpanID:      s.parentID,
+		Name:              s.name,
+		Kind:              s.kind,
+		StartTimeUnixNano: strconv.FormatInt(s.start.UnixNano(), 10),
+		EndTimeUnixNano:   strconv.FormatInt(end.UnixNano(), 10),
+		Attributes:        otlpAttributes(s.attrs),
+		Status:            otlpStatus{Code: 1},
+	}
+	if s.err != nil {
+		o.Status = otlpStatus{Code: 2, Message: s.err.Error()}
+	}
+	s.mu.Unlock()
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.pending = append(t.pending, o)
+	if len(t.pending) > maxPendingSpans {
+		t.pending = t.pending[len(t.pending)-maxPendingSpans:]
+	}
+}
+
+// flush exports the queued spans; on failure they are kept for the next flush
+func (t *tracer) flush() error {
+	t.mu.Lock()
+	batch := t.pending
+	t.pending = nil
+	t.mu.Unlock()
+	if len(batch) == 0 {
+		return nil
+	}
+
+	resource := otlpAttributes(map[string]string{"service.name": t.serviceName, "service.version": Version})
+	body, err := json.Marshal(map[string]interface{}{
+		"resourceSpans": []interface{}{map[string]interface{}{
+			"resource": map[string]interface{}{"attributes": resource},
+			"scopeSpans": []interface{}{map[string]interface{}{
+				"scope": map[string]string{"name": "cyberark-custom-provider"},
+				"spans": batch,
+			}},
+		}},
+	})
+	if err != nil {
+		return err
+	}
+
+	err = t.post(body)
+	recordDependencyResult("otlp", err)
+	if err != nil {
+		log.Printf("WARNING: Could not export %d spans to %s: %v", len(batch), redactURL(t.endpoint), err)
+		t.mu.Lock()
+		t.pending = append(batch, t.pending...)
+		if len(t.pending) > maxPendingSpans {
+			t.pending = t.pending[len(t.pending)-maxPendingSpans:]
+		}
+		t.mu.Unlock()
+	}
+	return err
+}
+
+func (t *tracer) post(body []byte) error {
+	req, err := http.NewRequest(http.MethodPost, t.endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for key, value := range t.headers {
+		req.Header.Set(key, value)
+	}
+	resp, err := t.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("POST %s returned status %d", req.URL.Path, resp.StatusCode)
+	}
+	return nil
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/davidh-cyberark/privilegeaccessmanager-sdk-go/pam"
+)
+
+func TestParseTraceparent(t *testing.T) {
+	tests := []struct {
+		header          string
+		traceID, parent string
+		sampled, ok     bool
+	}{
+		{"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", "4bf92f3577b34da6a3ce929d0e0e4736", "00f067aa0ba902b7", true, true},
+		{"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00", "4bf92f3577b34da6a3ce929d0e0e4736", "00f067aa0ba902b7", false, true},
+		{"00-00000000000000000000000000000000-00f067aa0ba902b7-01", "", "", false, false},
+		{"ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", "", "", false, false},
+		{"not a traceparent", "", "", false, false},
+		{"", "", "", false, false},
+	}
+	for _, tt := range tests {
+		traceID, parent, sampled, ok := parseTraceparent(tt.header)
+		if traceID != tt.traceID || parent != tt.parent || sampled != tt.sampled || ok != tt.ok {
+			t.Errorf("%q: got (%s, %s, %t, %t)", tt.header, traceID, parent, sampled, ok)
+		}
+	}
+}
+
+func TestTracingMiddleware(t *testing.T) {
+	var exported struct {
+		ResourceSpans []struct {
+			ScopeSpans []struct {
+				Spans []otlpSpan `json:"spans"`
+			} `json:"scopeSpans"`
+		} `json:"resourceSpans"`
+	}
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/traces" {
+			t.Errorf("unexpected export path %s", r.URL.Path)
+		}
+		body, _ := io.ReadAll(r.Body)
+		if err := json.Unmarshal(body, &exported); err != nil {
+			t.Errorf("invalid OTLP JSON: %v", err)
+		}
+	}))
+	defer collector.Close()
+
+	saved := traces
+	defer func() { traces = saved }()
+	traces = &tracer{endpoint: collector.URL + "/v1/traces", serviceName: "test", client: collector.Client()}
+
+	handler := tracingMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		stopAuth := startPhase(r, "auth")
+		stopAuth()
+		add := startSpan(r, "AddSafe", "pcloud.safeName", "safe1")
+		add.End(nil)
+		w.WriteHeader(http.StatusCreated)
+	}))
+	handler = requestTimingMiddleware(handler)
+
+	r := httptest.NewRequest("PUT", "/", nil)
+	r.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	handler.ServeHTTP(httptest.NewRecorder(), r)
+	if err := traces.flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	spans := map[string]otlpSpan{}
+	for _, rs := range exported.ResourceSpans {
+		for _, ss := range rs.ScopeSpans {
+			for _, s := range ss.Spans {
+				spans[s.Name] = s
+			}
+		}
+	}
+	server, ok := spans["PUT /"]
+	if !ok {
+		t.Fatalf("expected a server span, got %v", spans)
+	}
+	if server.TraceID != "4bf92f3577b34da6a3ce929d0e0e4736" || server.ParentSpanID != "00f067aa0ba902b7" || server.Kind != spanKindServer {
+		t.Errorf("server span does not continue the traceparent: %+v", server)
+	}
+	for _, name := range []string{"auth", "AddSafe"} {
+		child, ok := spans[name]
+		if !ok {
+			t.Errorf("expected a %s span", name)
+			continue
+		}
+		if child.TraceID != server.TraceID || child.ParentSpanID != server.SpanID {
+			t.Errorf("%s span is not a child of the server span: %+v", name, child)
+		}
+	}
+}
+
+func TestTraceparentPropagation(t *testing.T) {
+	saved := traces
+	defer func() { traces = saved }()
+	traces = &tracer{endpoint: "http://collector.invalid/v1/traces", serviceName: "test", client: http.DefaultClient}
+
+	var received []string
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received = append(received, r.Header.Get("traceparent"))
+	}))
+	defer upstream.Close()
+
+	var want []string
+	handler := tracingMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for _, send := range []func(*http.Request){
+			func(req *http.Request) {
+				pamSend(pam.NewClient(upstream.URL, pam.NewConfig(upstream.URL, upstream.URL, "user", "pass")), req)
+			},
+			func(req *http.Request) { (&conjurClient{client: upstream.Client()}).do(req) },
+		} {
+			add := startSpan(r, "AddSafe")
+			want = append(want, "00-4bf92f3577b34da6a3ce929d0e0e4736-"+add.spanID+"-01")
+			req, _ := http.NewRequestWithContext(r.Context(), http.MethodGet, upstream.URL, nil)
+			send(req)
+			add.End(nil)
+		}
+	}))
+
+	r := httptest.NewRequest("PUT", "/", nil)
+	r.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	handler.ServeHTTP(httptest.NewRecorder(), r)
+
+	if len(received) != len(want) {
+		t.Fatalf("expected %d upstream requests, got %d", len(want), len(received))
+	}
+	for i := range want {
+		if received[i] != want[i] {
+			t.Errorf("request %d: expected traceparent %s, got %q", i, want[i], received[i])
+		}
+	}
+
+	// Untraced requests send none
+	req, _ := http.NewRequest(http.MethodGet, upstream.URL, nil)
+	(&conjurClient{client: upstream.Client()}).do(req)
+	if got := received[len(received)-1]; got != "" {
+		t.Errorf("expected no traceparent outside a traced request, got %q", got)
+	}
+}
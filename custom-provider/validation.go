@@ -0,0 +1,203 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/davidh-cyberark/privilegeaccessmanager-sdk-go/pam"
+)
+
+// PUT bodies are validated before anything is sent to PCloud, so a template mistake is reported
+// against the property that caused it instead of as a PCloud error. Rules are written as
+// `validate:"required,max=28,pattern=safeName"` struct tags; SDK types cannot carry tags, so their
+// rules live in sdkValidationRules.
+
+// validationPatterns are the named formats a pattern= rule can refer to
+var validationPatterns = map[string]struct {
+	re          *regexp.Regexp
+	description string
+}{
+	"safeName": {
+		regexp.MustCompile(`^[^\\/:*?"<>|.'\t\r\n]([^\\/:*?"<>|'\t\r\n]*[^\\/:*?"<>|'\t\r\n ])?$`),
+		`must not contain \ / : * ? " < > | ', start with a period or end with a space`,
+	},
+	"accountName": {
+		regexp.MustCompile(`^[^\\/:*?"<>|\t\r\n]+$`),
+		`must not contain \ / : * ? " < > |`,
+	},
+	"conjurPolicyBranch": {
+		regexp.MustCompile(`^[A-Za-z0-9_-][A-Za-z0-9_.-]*(/[A-Za-z0-9_-][A-Za-z0-9_.-]*)*/?$`),
+		"must be a Conjur policy ID such as data/apps, of letters, digits, '.', '_' and '-'",
+	},
+	"conjurVariableId": {
+		regexp.MustCompile(`^[A-Za-z0-9_-][A-Za-z0-9_.-]*(/[A-Za-z0-9_-][A-Za-z0-9_.-]*)+$`),
+		"must be the full ID of a Conjur variable, such as data/apps/db-password",
+	},
+	"platformId": {
+		regexp.MustCompile(`^[A-Za-z0-9_-]+$`),
+		"must contain only letters, digits, underscores and hyphens",
+	},
+	"secretType": {
+		regexp.MustCompile(`^(password|key)$`),
+		"must be password or key",
+	},
+	"linkedAccountType": {
+		regexp.MustCompile(`^(?i)(logon|enable|reconcile)$`),
+		"must be logon, enable or reconcile",
+	},
+	"applicationExpirationDate": {
+		regexp.MustCompile(`^(0[1-9]|1[0-2])-(0[1-9]|[12][0-9]|3[01])-[0-9]{4}$`),
+		"must be a date in MM-DD-YYYY format",
+	},
+	"deletionPolicy": {
+		regexp.MustCompile(`^(Retain|Delete)$`),
+		"must be Retain or Delete",
+	},
+}
+
+// sdkValidationRules holds validate rules for fields of SDK types, keyed by type and Go field name
+var sdkValidationRules = map[reflect.Type]map[string]string{
+	reflect.TypeOf(pam.PostAddAccountRequest{}): {
+		"SafeName":   "required,max=28,pattern=safeName",
+		"PlatformID": "required,max=99,pattern=platformId",
+		"Name":       "max=128,pattern=accountName",
+		"Address":    "max=255",
+		"UserName":   "max=128",
+		"SecretType": "pattern=secretType",
+	},
+}
+
+// validateRequest checks v against its validate rules and returns one ErrorDetails per violation,
+// with the JSON path of the property as target
+func validateRequest(v interface{}) []ErrorDetails {
+	return validateValue(reflect.ValueOf(v), "")
+}
+
+func validateValue(v reflect.Value, path string) []ErrorDetails {
+	for v.Kind() == reflect.Ptr {
+		if v.IsNil() {
+			return nil
+		}
+		v = v.Elem()
+	}
+	if v.Kind() == reflect.Slice {
+		var details []ErrorDetails
+		for i := 0; i < v.Len(); i++ {
+			details = append(details, validateValue(v.Index(i), fmt.Sprintf("%s[%d]", path, i))...)
+		}
+		return details
+	}
+	if v.Kind() != reflect.Struct {
+		return nil
+	}
+
+	var details []ErrorDetails
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if !field.IsExported() {
+			continue
+		}
+		name, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+		if name == "-" {
+			continue
+		}
+		if name == "" {
+			name = field.Name
+		}
+		target := name
+		if field.Anonymous && field.Tag.Get("json") == "" {
+			target = path
+		} else if path != "" {
+			target = path + "." + name
+		}
+
+		rules := field.Tag.Get("validate")
+		if rules == "" {
+			rules = sdkValidationRules[t][field.Name]
+		}
+		if rules != "" {
+			details = append(details, checkRules(v.Field(i), target, rules)...)
+		}
+		details = append(details, validateValue(v.Field(i), target)...)
+	}
+	return details
+}
+
+// checkRules applies the comma separated rules of one field. String fields support required, max
+// (length) and pattern; int fields support min and max (value), and 0 is taken as not set. The
+// rules of a string list apply to each of its elements.
+func checkRules(v reflect.Value, target, rules string) []ErrorDetails {
+	if v.Kind() == reflect.Int {
+		return checkIntRules(v.Int(), target, rules)
+	}
+	if v.Kind() == reflect.Slice && v.Type().Elem().Kind() == reflect.String {
+		var details []ErrorDetails
+		for i := 0; i < v.Len(); i++ {
+			details = append(details, checkRules(v.Index(i), fmt.Sprintf("%s[%d]", target, i), rules)...)
+		}
+		return details
+	}
+	if v.Kind() != reflect.String {
+		return nil
+	}
+	value := v.String()
+
+	var details []ErrorDetails
+	for _, rule := range strings.Split(rules, ",") {
+		name, arg, _ := strings.Cut(rule, "=")
+		switch name {
+		case "required":
+			if strings.TrimSpace(value) == "" {
+				return []ErrorDetails{{Code: "PropertyRequired", Target: target, Message: fmt.Sprintf("%s is required", target)}}
+			}
+		case "max":
+			limit, _ := strconv.Atoi(arg)
+			if utf8.RuneCountInString(value) > limit {
+				details = append(details, ErrorDetails{Code: "PropertyTooLong", Target: target,
+					Message: fmt.Sprintf("%s must be at most %d characters, got %d", target, limit, utf8.RuneCountInString(value))})
+			}
+		case "pattern":
+			pattern, ok := validationPatterns[arg]
+			if ok && value != "" && !pattern.re.MatchString(value) {
+				details = append(details, ErrorDetails{Code: "PropertyInvalidFormat", Target: target,
+					Message: fmt.Sprintf("%s %s", target, pattern.description)})
+			}
+		}
+	}
+	return details
+}
+
+func checkIntRules(value int64, target, rules string) []ErrorDetails {
+	if value == 0 {
+		return nil
+	}
+	for _, rule := range strings.Split(rules, ",") {
+		name, arg, _ := strings.Cut(rule, "=")
+		limit, _ := strconv.ParseInt(arg, 10, 64)
+		if (name == "min" && value < limit) || (name == "max" && value > limit) {
+			return []ErrorDetails{{Code: "PropertyOutOfRange", Target: target,
+				Message: fmt.Sprintf("%s must be %s %d, got %d", target, map[string]string{"min": "at least", "max": "at most"}[name], limit, value)}}
+		}
+	}
+	return nil
+}
+
+// sendValidationError answers 400 InvalidRequestContent with one detail per invalid property
+func sendValidationError(w http.ResponseWriter, details []ErrorDetails) {
+	targets := make([]string, 0, len(details))
+	for _, detail := range details {
+		targets = append(targets, detail.Target)
+	}
+	sendJSONErrorDetails(w, http.StatusBadRequest, ErrorDetails{
+		Code:    "InvalidRequestContent",
+		Target:  "properties",
+		Message: fmt.Sprintf("The request content is invalid: %s", strings.Join(targets, ", ")),
+		Details: details,
+	})
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/davidh-cyberark/privilegeaccessmanager-sdk-go/pam"
+)
+
+func TestValidateRequest(t *testing.T) {
+	tests := []struct {
+		name    string
+		request interface{}
+		want    map[string]string // target -> code
+	}{
+		{
+			name:    "valid safe",
+			request: SafeRequest{Properties: SafeProperties{SafeName: "Linux Root-01", Description: "Linux root accounts"}},
+			want:    map[string]string{},
+		},
+		{
+			name:    "missing safe name",
+			request: SafeRequest{Properties: SafeProperties{SafeName: "  "}},
+			want:    map[string]string{"properties.safeName": "PropertyRequired"},
+		},
+		{
+			name:    "safe name too long with illegal characters",
+			request: SafeRequest{Properties: SafeProperties{SafeName: "linux/root:accounts-of-the-web-tier", Description: strings.Repeat("d", 101)}},
+			want: map[string]string{
+				"properties.safeName":    "PropertyInvalidFormat",
+				"properties.description": "PropertyTooLong",
+			},
+		},
+		{
+			name:    "safe name ending with a space",
+			request: SafeRequest{Properties: SafeProperties{SafeName: "linux "}},
+			want:    map[string]string{"properties.safeName": "PropertyInvalidFormat"},
+		},
+		{
+			name:    "safe retention out of range",
+			request: SafeRequest{Properties: SafeProperties{SafeName: "safe1", NumberOfVersionsRetention: 1000, NumberOfDaysRetention: 3650}},
+			want:    map[string]string{"properties.numberOfVersionsRetention": "PropertyOutOfRange"},
+		},
+		{
+			name:    "valid account",
+			request: AccountRequest{Properties: AccountProperties{PostAddAccountRequest: pam.PostAddAccountRequest{SafeName: "safe1", PlatformID: "Unix_SSH-2", Name: "root-web01"}}},
+			want:    map[string]string{},
+		},
+		{
+			name:    "account without safe and with a bad platform",
+			request: AccountRequest{Properties: AccountProperties{PostAddAccountRequest: pam.PostAddAccountRequest{PlatformID: "Unix SSH", Name: "root|web01"}}},
+			want: map[string]string{
+				"properties.safeName":   "PropertyRequired",
+				"properties.platformId": "PropertyInvalidFormat",
+				"properties.name":       "PropertyInvalidFormat",
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := map[string]string{}
+			for _, detail := range validateRequest(tt.request) {
+				got[detail.Target] = detail.Code
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("expected %v, got %v", tt.want, got)
+			}
+		})
+	}
+}
@@ -0,0 +1,339 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/davidh-cyberark/privilegeaccessmanager-sdk-go/pam"
+)
+
+// The whatIf action takes the body of a safe or account PUT and reports what the PUT would do,
+// without changing anything in PCloud or the state store: the properties are validated, the safe
+// or account name is looked up, the platform of a new account is checked, and the provider's PCloud
+// user's permissions on the safe are read. A deployment script can call it for every resource of a
+// template ahead of az deployment group create, alongside az deployment what-if, which cannot see
+// inside custom provider resources.
+
+// what-if change types, after ARM's
+const (
+	whatIfCreate   = "Create"
+	whatIfNoChange = "NoChange"
+	whatIfModify   = "Modify"
+	// whatIfConflict is a PUT the provider would refuse, e.g. an existing safe with other settings
+	whatIfConflict = "Conflict"
+	// whatIfInvalid is a PUT that would fail validation
+	whatIfInvalid = "Invalid"
+)
+
+// check results
+const (
+	whatIfPassed  = "Passed"
+	whatIfFailed  = "Failed"
+	whatIfSkipped = "Skipped"
+)
+
+// WhatIfRequest is the body of the whatIf action: the resource type and name of a PUT, and its properties
+type WhatIfRequest struct {
+	ResourceType string          `json:"resourceType"`
+	Name         string          `json:"name"`
+	Properties   json.RawMessage `json:"properties"`
+}
+
+// WhatIfChange is one property a PUT would set or change
+type WhatIfChange struct {
+	Property string `json:"property"`
+	Before   string `json:"before,omitempty"`
+	After    string `json:"after,omitempty"`
+}
+
+// WhatIfCheck is the result of one check of a what-if
+type WhatIfCheck struct {
+	Name    string `json:"name"`
+	Status  string `json:"status"`
+	Message string `json:"message,omitempty"`
+	// Details are the validation errors the PUT would answer with
+	Details []ErrorDetails `json:"details,omitempty"`
+}
+
+// WhatIfResult is the response of the whatIf action
+type WhatIfResult struct {
+	ResourceID   string         `json:"resourceId"`
+	ResourceType string         `json:"resourceType"`
+	Name         string         `json:"name"`
+	ChangeType   string         `json:"changeType"`
+	WouldSucceed bool           `json:"wouldSucceed"`
+	Changes      []WhatIfChange `json:"changes"`
+	Checks       []WhatIfCheck  `json:"checks"`
+}
+
+// check records the result of a check; a failed check means the PUT would fail
+func (res *WhatIfResult) check(name, status, message string, details ...ErrorDetails) {
+	res.Checks = append(res.Checks, WhatIfCheck{Name: name, Status: status, Message: message, Details: details})
+	if status == whatIfFailed {
+		res.WouldSucceed = false
+	}
+}
+
+// handleWhatIf reports what a safe or account PUT would do without doing it
+func handleWhatIf(w http.ResponseWriter, r *http.Request, cpRequest CustomProviderRequestPath) {
+	LogRequestDebug("WhatIf", r)
+
+	var request WhatIfRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		sendJSONError(w, http.StatusBadRequest, "InvalidRequestBody", fmt.Sprintf("Invalid request body: %v", err))
+		return
+	}
+	entry, ok := lookupProviderEntry(resourceTypes, request.ResourceType)
+	if !ok || (entry.Name != "safes" && entry.Name != "accounts") {
+		sendJSONError(w, http.StatusBadRequest, "InvalidRequestBody", fmt.Sprintf("resourceType must be safes or accounts, got %q", request.ResourceType))
+		return
+	}
+	if request.Name == "" {
+		sendJSONError(w, http.StatusBadRequest, "InvalidRequestBody", "name is required")
+		return
+	}
+	if !entry.entryEnabled(false) {
+		sendResourceTypeDisabled(w, entry, false)
+		return
+	}
+
+	target := cpRequest
+	target.ResourceTypeName, target.ResourceInstanceName = entry.Name, request.Name
+	result := WhatIfResult{ResourceID: target.ID(), ResourceType: entry.Name, Name: request.Name, WouldSucceed: true, Changes: []WhatIfChange{}}
+	if entry.Name == "safes" {
+		whatIfSafe(r, request.Properties, &result)
+	} else {
+		whatIfAccount(w, r, target, request.Properties, &result)
+	}
+	if result.ChangeType == whatIfConflict || result.ChangeType == whatIfInvalid {
+		result.WouldSucceed = false
+	}
+
+	log.Printf("INFO: (WhatIf) %s: %s, would succeed: %t", result.ResourceID, result.ChangeType, result.WouldSucceed)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
+
+// whatIfProperties decodes the properties of a what-if like decodeRequestBody decodes a PUT's,
+// reporting unknown properties as validation details
+func whatIfProperties(r *http.Request, raw json.RawMessage, v interface{}) []ErrorDetails {
+	if len(raw) == 0 {
+		return []ErrorDetails{{Code: "PropertyRequired", Target: "properties", Message: "properties is required"}}
+	}
+	if err := json.Unmarshal(raw, v); err != nil {
+		return []ErrorDetails{{Code: "PropertyInvalidFormat", Target: "properties", Message: err.Error()}}
+	}
+	var details []ErrorDetails
+	fields := unknownProperties(raw, reflect.TypeOf(v).Elem(), "properties", strictRequestBodies(r))
+	sort.Strings(fields)
+	for _, field := range fields {
+		details = append(details, ErrorDetails{Code: "UnknownProperty", Target: field, Message: fmt.Sprintf("%s is not a property of the resource", field)})
+	}
+	return details
+}
+
+// whatIfSafe checks a safe PUT
+func whatIfSafe(r *http.Request, raw json.RawMessage, res *WhatIfResult) {
+	var properties SafeProperties
+	details := whatIfProperties(r, raw, &properties)
+	if len(details) == 0 {
+		details = validateRequest(SafeRequest{Properties: properties})
+		if properties.NumberOfVersionsRetention != 0 && properties.NumberOfDaysRetention != 0 {
+			details = append(details, ErrorDetails{Code: "PropertyConflict", Target: "properties.numberOfDaysRetention",
+				Message: "properties.numberOfDaysRetention cannot be set together with properties.numberOfVersionsRetention"})
+		}
+	}
+	addSafeRequest := pam.PostAddSafeRequest{SafeName: properties.SafeName, Description: properties.Description}
+	if len(details) == 0 && properties.Profile != "" {
+		if _, err := applySafeProfile(&addSafeRequest, properties.Profile); err != nil {
+			details = append(details, ErrorDetails{Code: "InvalidSafeProfile", Target: "properties.profile", Message: err.Error()})
+		}
+	}
+	if len(details) > 0 {
+		res.ChangeType = whatIfInvalid
+		res.check("validation", whatIfFailed, "The PUT would be answered with 400 ValidationFailed", details...)
+		return
+	}
+	res.check("validation", whatIfPassed, "")
+	applySafeOptions(&addSafeRequest, properties)
+
+	pamClient, err := createPAMClient()
+	if err != nil {
+		res.check("nameAvailability", whatIfFailed, fmt.Sprintf("Failed to create PAM client: %v", err))
+		return
+	}
+	safe, retcode, err := pcloudRetry(r.Context(), "safes", "GetSafeDetails", true, func(ctx context.Context) (pam.GetSafeDetails, int, error) {
+		return pamGetSafeDetails(ctx, pamClient, addSafeRequest.SafeName)
+	})
+	if retcode == http.StatusNotFound {
+		res.ChangeType = whatIfCreate
+		requested := requestedSafeSettings(addSafeRequest)
+		for _, name := range sortedKeys(requested) {
+			if requested[name] != "" {
+				res.Changes = append(res.Changes, WhatIfChange{Property: name, After: requested[name]})
+			}
+		}
+		res.check("nameAvailability", whatIfPassed, fmt.Sprintf("Safe %s does not exist and would be created", addSafeRequest.SafeName))
+		res.check("permissions", whatIfSkipped, "Creating safes needs the Add Safes vault authorization, which cannot be read through the API")
+		return
+	}
+	if err != nil {
+		res.check("nameAvailability", whatIfFailed, fmt.Sprintf("Failed to look up safe %s: (%d) %v", addSafeRequest.SafeName, retcode, checkMaintenance(err)))
+		return
+	}
+
+	live := safeDriftSettings(safe.Description, safe.ManagingCPM, safe.NumberOfDaysRetention, safe.NumberOfVersionsRetention, safe.OlacEnabled)
+	diff := diffSettings(requestedSafeSettings(addSafeRequest), live)
+	for _, name := range sortedKeys(diff) {
+		res.Changes = append(res.Changes, WhatIfChange{Property: name, Before: diff[name].Actual, After: diff[name].Declared})
+	}
+	if len(diff) > 0 {
+		res.ChangeType = whatIfConflict
+		res.check("nameAvailability", whatIfFailed, fmt.Sprintf("Safe %s already exists with different settings; the PUT would be answered with 409 SafeAlreadyExists, change them with PATCH", safe.SafeName))
+	} else {
+		res.ChangeType = whatIfNoChange
+		res.check("nameAvailability", whatIfPassed, fmt.Sprintf("Safe %s already exists with the requested settings and would be taken under management", safe.SafeName))
+	}
+	whatIfPermissions(r.Context(), pamClient, safe, "manageSafeMembers", res)
+}
+
+// whatIfAccount checks an account PUT
+func whatIfAccount(w http.ResponseWriter, r *http.Request, cpRequest CustomProviderRequestPath, raw json.RawMessage, res *WhatIfResult) {
+	var properties AccountProperties
+	details := whatIfProperties(r, raw, &properties)
+	if len(details) == 0 {
+		details = validateRequest(AccountRequest{Properties: properties})
+	}
+	if len(details) > 0 {
+		res.ChangeType = whatIfInvalid
+		res.check("validation", whatIfFailed, "The PUT would be answered with 400 ValidationFailed", details...)
+		return
+	}
+	res.check("validation", whatIfPassed, "")
+
+	pamClient, err := createPAMClient()
+	if err != nil {
+		res.check("nameAvailability", whatIfFailed, fmt.Sprintf("Failed to create PAM client: %v", err))
+		return
+	}
+	safename, acctname := requestedAccountName(cpRequest, properties)
+	safe, retcode, err := pcloudRetry(r.Context(), "safes", "GetSafeDetails", true, func(ctx context.Context) (pam.GetSafeDetails, int, error) {
+		return pamGetSafeDetails(ctx, pamClient, safename)
+	})
+	if retcode == http.StatusNotFound && properties.EnsureSafe {
+		res.check("safe", whatIfPassed, fmt.Sprintf("Safe %s does not exist and would be created, ensureSafe is set", safename))
+		whatIfNewAccount(r, properties, safename, acctname, res)
+		res.check("permissions", whatIfSkipped, "Creating safes needs the Add Safes vault authorization, which cannot be read through the API")
+		return
+	}
+	if retcode == http.StatusNotFound {
+		res.ChangeType = whatIfConflict
+		res.check("safe", whatIfFailed, fmt.Sprintf("Safe %s does not exist; deploy it before the account, or set ensureSafe", safename))
+		return
+	}
+	if err != nil {
+		res.check("safe", whatIfFailed, fmt.Sprintf("Failed to look up safe %s: (%d) %v", safename, retcode, checkMaintenance(err)))
+		return
+	}
+	res.check("safe", whatIfPassed, "")
+
+	// A resource that points at an account under another safe or name would move it
+	if previous, found, err := stateStore.Get(cpRequest.ID()); err == nil && found && previous.PCloudID != "" &&
+		(!strings.EqualFold(previous.SafeName, safename) || previous.AccountName != acctname) {
+		policy := accountMovePolicy()
+		res.Changes = append(res.Changes, WhatIfChange{Property: "safeName", Before: previous.SafeName, After: safename},
+			WhatIfChange{Property: "name", Before: previous.AccountName, After: acctname})
+		if policy == accountMovePolicyReject {
+			res.ChangeType = whatIfConflict
+			res.check("nameAvailability", whatIfFailed, "The account would have to move, which ACCOUNT_MOVE_POLICY=reject refuses")
+			return
+		}
+		res.ChangeType = whatIfModify
+		res.check("nameAvailability", whatIfPassed, fmt.Sprintf("Account %s would be moved from %s.%s (ACCOUNT_MOVE_POLICY=%s)", previous.PCloudID, previous.SafeName, previous.AccountName, policy))
+		whatIfPermissions(r.Context(), pamClient, safe, "addAccounts", res)
+		return
+	}
+
+	lookup := properties.PostAddAccountRequest
+	lookup.SafeName, lookup.Name = safename, acctname
+	existing, err := findExistingAccount(w, r, cpRequest, lookup)
+	if err != nil {
+		res.check("nameAvailability", whatIfFailed, err.Error())
+		return
+	}
+	if existing != nil {
+		if differences := accountDifferences(properties, existing); len(differences) > 0 {
+			res.ChangeType = whatIfConflict
+			for _, field := range []struct{ name, requested, actual string }{
+				{"platformId", properties.PlatformID, existing.PlatformID},
+				{"address", properties.Address, existing.Address},
+				{"userName", properties.UserName, existing.UserName},
+			} {
+				if field.requested != "" && !strings.EqualFold(field.requested, field.actual) {
+					res.Changes = append(res.Changes, WhatIfChange{Property: field.name, Before: field.actual, After: field.requested})
+				}
+			}
+			res.check("nameAvailability", whatIfFailed, fmt.Sprintf("Account %s already exists in safe %s with different settings; the PUT would be answered with 409 AccountAlreadyExists", existing.Name, existing.SafeName))
+			return
+		}
+		res.ChangeType = whatIfNoChange
+		res.check("nameAvailability", whatIfPassed, fmt.Sprintf("Account %s already exists in safe %s with the requested settings and would be taken under management", existing.Name, existing.SafeName))
+		return
+	}
+
+	res.check("nameAvailability", whatIfPassed, fmt.Sprintf("No account %s in safe %s, it would be created", acctname, safename))
+	whatIfNewAccount(r, properties, safename, acctname, res)
+	whatIfPermissions(r.Context(), pamClient, safe, "addAccounts", res)
+}
+
+// whatIfNewAccount lists the properties of an account the PUT would add and checks its platform
+func whatIfNewAccount(r *http.Request, properties AccountProperties, safename, acctname string, res *WhatIfResult) {
+	res.ChangeType = whatIfCreate
+	for _, field := range []struct{ name, value string }{
+		{"safeName", safename}, {"name", acctname}, {"platformId", properties.PlatformID},
+		{"address", properties.Address}, {"userName", properties.UserName},
+	} {
+		if field.value != "" {
+			res.Changes = append(res.Changes, WhatIfChange{Property: field.name, After: field.value})
+		}
+	}
+	if details := validatePlatformProperties(r, properties.PostAddAccountRequest); len(details) > 0 {
+		res.ChangeType = whatIfInvalid
+		res.check("platform", whatIfFailed, "The PUT would be answered with 400 ValidationFailed", details...)
+	} else {
+		res.check("platform", whatIfPassed, "")
+	}
+}
+
+// whatIfPermissions checks that the provider's PCloud user holds a permission on the safe
+func whatIfPermissions(ctx context.Context, pamClient *pam.Client, safe pam.GetSafeDetails, permission string, res *WhatIfResult) {
+	creds, _ := credentials.Credentials()
+	if creds.User == "" {
+		res.check("permissions", whatIfSkipped, "The provider signs in without a PCloud user name, so its safe membership cannot be looked up")
+		return
+	}
+	members, retcode, err := listSafeMembers(ctx, pamClient, safe.SafeURLID)
+	if err != nil {
+		res.check("permissions", whatIfSkipped, fmt.Sprintf("Could not read the members of safe %s: (%d) %v", safe.SafeName, retcode, err))
+		return
+	}
+	for _, member := range members {
+		if !strings.EqualFold(member.MemberName, creds.User) {
+			continue
+		}
+		granted, _ := toProperties(member.Permissions)
+		if granted[permission] == true {
+			res.check("permissions", whatIfPassed, fmt.Sprintf("%s has %s on safe %s", creds.User, permission, safe.SafeName))
+		} else {
+			res.check("permissions", whatIfFailed, fmt.Sprintf("%s is a member of safe %s without %s", creds.User, safe.SafeName, permission))
+		}
+		return
+	}
+	res.check("permissions", whatIfFailed, fmt.Sprintf("%s is not a member of safe %s", creds.User, safe.SafeName))
+}